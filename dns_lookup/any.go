@@ -0,0 +1,53 @@
+package main
+
+import "golang.org/x/net/dns/dnsmessage"
+
+// asked one by one when a server answers ANY with the RFC 8482 stub
+var anyFallbackTypes = []dnsmessage.Type{
+	dnsmessage.TypeA,
+	dnsmessage.TypeAAAA,
+	dnsmessage.TypeCNAME,
+	dnsmessage.TypeMX,
+	dnsmessage.TypeNS,
+	dnsmessage.TypeSOA,
+	dnsmessage.TypeTXT,
+	dnsmessage.TypeSRV,
+}
+
+// RFC 8482 4.2: a lone synthesized HINFO "RFC8482" record instead of the rrsets
+func isRFC8482(res dnsmessage.Message) bool {
+	if len(res.Answers) != 1 || res.Answers[0].Header.Type != typeHINFO {
+		return false
+	}
+	body, ok := res.Answers[0].Body.(*dnsmessage.UnknownResource)
+	if !ok {
+		return false
+	}
+	strs := characterStrings(body.Data)
+	return len(strs) > 0 && strs[0] == "RFC8482"
+}
+
+// replace a minimal ANY response by the answers of individual queries
+func anyFallback(res dnsmessage.Message, lookup func(qtype dnsmessage.Type) (dnsmessage.Message, error)) dnsmessage.Message {
+	if !isRFC8482(res) {
+		return res
+	}
+
+	tracef("\nServer gave a minimal ANY response (RFC 8482), querying record types individually\n")
+	merged := res
+	merged.Answers = nil
+	for _, qtype := range anyFallbackTypes {
+		typed, err := lookup(qtype)
+		if err != nil {
+			tracef("-> %s lookup failed: %v\n", typeName(qtype), err)
+			continue
+		}
+		for _, answer := range typed.Answers {
+			// skip the CNAME that comes along with every type of an alias
+			if answer.Header.Type == qtype || qtype == dnsmessage.TypeCNAME {
+				merged.Answers = append(merged.Answers, answer)
+			}
+		}
+	}
+	return merged
+}
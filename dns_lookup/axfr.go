@@ -0,0 +1,43 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// dns_lookup axfr [-server addr] zone
+func runAXFR(args []string) {
+	fs := flag.NewFlagSet("axfr", flag.ExitOnError)
+	server := fs.String("server", "", "name server to transfer from (default: the zone's authoritative servers)")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fmt.Println("usage: dns_lookup axfr [-server addr] zone")
+		os.Exit(2)
+	}
+	zone := strings.TrimSuffix(fs.Arg(0), ".") + "."
+
+	servers := []string{*server}
+	if *server == "" {
+		var err error
+		if servers, err = authServers(client, zone); err != nil {
+			fmt.Println("Error:", err)
+			os.Exit(1)
+		}
+	}
+
+	// most servers refuse transfers, try each of them
+	for _, s := range servers {
+		records, err := client.TransferZone(zone, s)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "; transfer from %s failed: %v\n", s, err)
+			continue
+		}
+		fmt.Printf("; %s transferred from %s, %d records\n", zone, s, len(records))
+		writeZoneFile(os.Stdout, zone, records)
+		return
+	}
+	os.Exit(1)
+}
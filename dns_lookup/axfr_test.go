@@ -0,0 +1,49 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestTransferZone(t *testing.T) {
+	c := startHierarchy(t)
+
+	records, err := c.TransferZone("example.com.", "127.0.0.4")
+	if err != nil || len(records) != 9 {
+		t.Fatalf("got %d records, %v", len(records), err)
+	}
+	var out strings.Builder
+	writeZoneFile(&out, "example.com.", records)
+	lines := strings.Split(out.String(), "\n")
+	if lines[0] != "$ORIGIN example.com." || !strings.Contains(lines[1], "\tSOA\t") {
+		t.Errorf("zone starts with %q", lines[:2])
+	}
+	for _, want := range []string{
+		"www.example.com.\t300\tIN\tTXT\t\"v=spf1 -all\"",
+		"example.com.\t300\tIN\tCAA\t0 issuewild \";\"",
+	} {
+		if !strings.Contains(out.String(), want+"\n") {
+			t.Errorf("missing %q in\n%s", want, out.String())
+		}
+	}
+
+	if res, err := c.Query("example.com.", dnsmessage.TypeAXFR, "127.0.0.4"); err != nil || res.RCode != dnsmessage.RCodeRefused {
+		t.Errorf("AXFR over udp got %s, %v", res.RCode, err)
+	}
+}
+
+func TestZoneQuote(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"plain", `"plain"`},
+		{"a\"b\\c\x01é", `"a\"b\\c\001\195\169"`},
+	}
+	for _, tt := range tests {
+		if got := zoneQuote(tt.in); got != tt.want {
+			t.Errorf("zoneQuote(%q) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const typeCAA dnsmessage.Type = 257
+
+type caaRecord struct {
+	critical bool
+	tag      string
+	value    string
+}
+
+func parseCAA(data []byte) (caaRecord, error) {
+	if len(data) < 2 || len(data) < 2+int(data[1]) {
+		return caaRecord{}, errors.New("short CAA rdata")
+	}
+	tagLen := int(data[1])
+	return caaRecord{
+		critical: data[0]&0x80 != 0,
+		tag:      strings.ToLower(string(data[2 : 2+tagLen])),
+		value:    string(data[2+tagLen:]),
+	}, nil
+}
+
+func (r caaRecord) String() string {
+	flags := 0
+	if r.critical {
+		flags = 128
+	}
+	return fmt.Sprintf("%d %s %q", flags, r.tag, r.value)
+}
+
+// outcome of RFC 8659 processing for one hostname
+type caaPolicy struct {
+	foundAt     string // owner of the relevant RRset, empty when none exists
+	records     []caaRecord
+	issuers     []string // may issue for the name itself
+	wildIssuers []string // may issue wildcard certificates
+	anyIssuer   bool     // no relevant CAA, unrestricted
+	noWild      bool     // issuewild/issue forbid all wildcard issuance
+	noIssue     bool     // issue forbids all issuance
+	iodef       []string
+	blocked     string // critical unknown property, nothing may be issued
+}
+
+// RFC 8659 3: climb from the name toward the root, the first non-empty
+// CAA RRset is the relevant one
+func relevantCAA(host string, lookup func(name string) (dnsmessage.Message, error), trace func(string)) (string, []caaRecord, error) {
+	labels := nameLabels(host)
+	for i := 0; i < len(labels); i++ {
+		name := strings.Join(labels[i:], ".") + "."
+
+		res, err := lookup(name)
+		if err != nil {
+			return "", nil, fmt.Errorf("CAA lookup for %s failed: %w", name, err)
+		}
+
+		var records []caaRecord
+		for _, rr := range res.Answers {
+			body, ok := rr.Body.(*dnsmessage.UnknownResource)
+			if !ok || rr.Header.Type != typeCAA {
+				continue
+			}
+			if rec, err := parseCAA(body.Data); err == nil {
+				records = append(records, rec)
+			}
+		}
+
+		if len(records) == 0 {
+			trace(fmt.Sprintf("%s: no CAA records", name))
+			continue
+		}
+		trace(fmt.Sprintf("%s: %d CAA records (relevant)", name, len(records)))
+		return name, records, nil
+	}
+	return "", nil, nil
+}
+
+func evaluateCAA(foundAt string, records []caaRecord) caaPolicy {
+	policy := caaPolicy{foundAt: foundAt, records: records}
+	if len(records) == 0 {
+		policy.anyIssuer = true
+		return policy
+	}
+
+	var issue, issueWild []string
+	hasIssue, hasIssueWild := false, false
+	for _, rec := range records {
+		switch rec.tag {
+		case "issue":
+			hasIssue = true
+			if domain := caaIssuerDomain(rec.value); domain != "" {
+				issue = append(issue, domain)
+			}
+		case "issuewild":
+			hasIssueWild = true
+			if domain := caaIssuerDomain(rec.value); domain != "" {
+				issueWild = append(issueWild, domain)
+			}
+		case "iodef":
+			policy.iodef = append(policy.iodef, rec.value)
+		default:
+			if rec.critical {
+				policy.blocked = rec.tag
+			}
+		}
+	}
+
+	// no issue property means any CA may issue for the name itself
+	policy.issuers = issue
+	policy.noIssue = hasIssue && len(issue) == 0
+	if !hasIssue {
+		policy.anyIssuer = true
+	}
+
+	// RFC 8659 4.3: issuewild takes precedence for wildcards, issue applies otherwise
+	if hasIssueWild {
+		policy.wildIssuers = issueWild
+		policy.noWild = len(issueWild) == 0
+	} else {
+		policy.wildIssuers = issue
+		policy.noWild = policy.noIssue
+	}
+	return policy
+}
+
+// issuer domain name of an issue/issuewild value, parameters after ';' dropped
+func caaIssuerDomain(value string) string {
+	domain, _, _ := strings.Cut(value, ";")
+	return strings.ToLower(strings.TrimSpace(domain))
+}
+
+// dns_lookup caa hostname
+func runCAA(args []string) {
+	if len(args) != 1 {
+		fmt.Println("usage: dns_lookup caa hostname")
+		os.Exit(2)
+	}
+	host := strings.TrimSuffix(args[0], ".") + "."
+
+	lookup := func(name string) (dnsmessage.Message, error) {
+		return client.Iterate(name, typeCAA)
+	}
+
+	fmt.Printf("Checking CAA for %s\n", host)
+	foundAt, records, err := relevantCAA(host, lookup, func(line string) { fmt.Println("->", line) })
+	if err != nil {
+		// RFC 8659 allows issuance to be refused when the lookup fails
+		fmt.Println("Error:", err)
+		fmt.Println("A CA must not issue while CAA can't be looked up")
+		os.Exit(1)
+	}
+	for _, rec := range records {
+		fmt.Printf("   %s\n", rec)
+	}
+
+	printCAAPolicy(host, evaluateCAA(foundAt, records))
+}
+
+func printCAAPolicy(host string, policy caaPolicy) {
+	fmt.Println()
+	switch {
+	case policy.blocked != "":
+		fmt.Printf("Unknown critical property %q, no CA may issue for %s\n", policy.blocked, host)
+		return
+	case policy.foundAt == "":
+		fmt.Printf("No CAA records, any CA may issue for %s\n", host)
+		return
+	case policy.anyIssuer:
+		fmt.Printf("No issue property, any CA may issue for %s\n", host)
+	case policy.noIssue:
+		fmt.Printf("No CA may issue for %s\n", host)
+	default:
+		fmt.Printf("Certificates for %s may be issued by: %s\n", host, strings.Join(policy.issuers, ", "))
+	}
+
+	switch {
+	case policy.noWild:
+		fmt.Println("No CA may issue wildcard certificates")
+	case len(policy.wildIssuers) > 0:
+		fmt.Printf("Wildcard certificates may be issued by: %s\n", strings.Join(policy.wildIssuers, ", "))
+	case policy.anyIssuer:
+		fmt.Println("Any CA may issue wildcard certificates")
+	}
+
+	if len(policy.iodef) > 0 {
+		fmt.Printf("Violation reports go to: %s\n", strings.Join(policy.iodef, ", "))
+	}
+}
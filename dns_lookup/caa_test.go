@@ -0,0 +1,24 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestRelevantCAA(t *testing.T) {
+	c := startHierarchy(t)
+
+	lookup := func(name string) (dnsmessage.Message, error) {
+		return c.Iterate(name, typeCAA)
+	}
+	foundAt, records, err := relevantCAA("www.example.com.", lookup, func(string) {})
+	if err != nil || foundAt != "example.com." {
+		t.Fatalf("relevant RRset at %q, %v", foundAt, err)
+	}
+	policy := evaluateCAA(foundAt, records)
+	if strings.Join(policy.issuers, ",") != "letsencrypt.org,pki.goog" || !policy.noWild || len(policy.iodef) != 1 {
+		t.Errorf("got %+v", policy)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// answers kept by the server, keyed by client view and question
+type cacheEntry struct {
+	res     dnsmessage.Message
+	stored  time.Time
+	expires time.Time
+}
+
+type responseCache struct {
+	mu         sync.Mutex
+	entries    map[string]cacheEntry
+	maxEntries int
+	hits       uint64
+	misses     uint64
+}
+
+var cache = &responseCache{entries: map[string]cacheEntry{}, maxEntries: 10000}
+
+func cacheKey(view string, q dnsmessage.Question) string {
+	return view + "/" + strings.ToLower(q.Name.String()) + "/" + q.Type.String() + "/" + q.Class.String()
+}
+
+// cached response with TTLs counted down, ok is false on a miss
+func (c *responseCache) get(view string, q dnsmessage.Question) (dnsmessage.Message, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[cacheKey(view, q)]
+	if !ok || time.Now().After(entry.expires) {
+		c.misses++
+		return dnsmessage.Message{}, false
+	}
+	c.hits++
+
+	elapsed := uint32(time.Since(entry.stored).Seconds())
+	res := entry.res
+	res.Answers = agedRecords(res.Answers, elapsed)
+	res.Authorities = agedRecords(res.Authorities, elapsed)
+	return res, true
+}
+
+func agedRecords(records []dnsmessage.Resource, elapsed uint32) []dnsmessage.Resource {
+	aged := make([]dnsmessage.Resource, len(records))
+	for i, rr := range records {
+		aged[i] = rr
+		if rr.Header.TTL > elapsed {
+			aged[i].Header.TTL -= elapsed
+		} else {
+			aged[i].Header.TTL = 0
+		}
+	}
+	return aged
+}
+
+// store successful and NXDOMAIN responses for their smallest TTL
+func (c *responseCache) put(view string, q dnsmessage.Question, res dnsmessage.Message) {
+	if res.RCode != dnsmessage.RCodeSuccess && res.RCode != dnsmessage.RCodeNameError {
+		return
+	}
+
+	ttl := cacheTTL(res)
+	if ttl == 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.entries) >= c.maxEntries {
+		c.evict()
+	}
+	now := time.Now()
+	c.entries[cacheKey(view, q)] = cacheEntry{res: res, stored: now, expires: now.Add(time.Duration(ttl) * time.Second)}
+}
+
+// drop expired entries, or an arbitrary tenth of the cache if none expired
+func (c *responseCache) evict() {
+	now := time.Now()
+	for key, entry := range c.entries {
+		if now.After(entry.expires) {
+			delete(c.entries, key)
+		}
+	}
+
+	for key := range c.entries {
+		if len(c.entries) < c.maxEntries*9/10 {
+			break
+		}
+		delete(c.entries, key)
+	}
+}
+
+// smallest answer TTL, negative answers use the SOA minimum (RFC 2308)
+func cacheTTL(res dnsmessage.Message) uint32 {
+	var ttl uint32
+	for _, rr := range res.Answers {
+		if ttl == 0 || rr.Header.TTL < ttl {
+			ttl = rr.Header.TTL
+		}
+	}
+
+	if len(res.Answers) == 0 {
+		for _, rr := range res.Authorities {
+			if soa, ok := rr.Body.(*dnsmessage.SOAResource); ok {
+				ttl = min(rr.Header.TTL, soa.MinTTL)
+			}
+		}
+	}
+	return min(ttl, 86400)
+}
+
+func (c *responseCache) stats() (size int, hits, misses uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries), c.hits, c.misses
+}
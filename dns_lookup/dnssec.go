@@ -0,0 +1,374 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// DNSSEC types dnsmessage has no constants for
+const (
+	typeDS         dnsmessage.Type = 43
+	typeRRSIG      dnsmessage.Type = 46
+	typeNSEC       dnsmessage.Type = 47
+	typeDNSKEY     dnsmessage.Type = 48
+	typeNSEC3      dnsmessage.Type = 50
+	typeNSEC3PARAM dnsmessage.Type = 51
+)
+
+var base32Hex = base32.HexEncoding.WithPadding(base32.NoPadding)
+
+type nsecRecord struct {
+	owner string
+	next  string
+	types []dnsmessage.Type
+}
+
+type nsec3Record struct {
+	owner      string // full owner name, first label is the hash
+	zone       string
+	hashAlg    uint8
+	optOut     bool
+	iterations uint16
+	salt       []byte
+	nextHash   string // base32hex, lowercase
+	types      []dnsmessage.Type
+}
+
+func (n nsec3Record) ownerHash() string {
+	return strings.ToLower(strings.SplitN(n.owner, ".", 2)[0])
+}
+
+func parseNSEC(owner string, data []byte) (nsecRecord, error) {
+	next, rest, err := wireName(data)
+	if err != nil {
+		return nsecRecord{}, err
+	}
+	return nsecRecord{owner: owner, next: next, types: typeBitmap(rest)}, nil
+}
+
+func parseNSEC3(owner string, data []byte) (nsec3Record, error) {
+	if len(data) < 5 {
+		return nsec3Record{}, errors.New("short NSEC3 rdata")
+	}
+	rec := nsec3Record{
+		owner:      owner,
+		hashAlg:    data[0],
+		optOut:     data[1]&1 == 1,
+		iterations: binary.BigEndian.Uint16(data[2:4]),
+	}
+	if parts := strings.SplitN(owner, ".", 2); len(parts) == 2 {
+		rec.zone = parts[1]
+	}
+
+	saltLen := int(data[4])
+	data = data[5:]
+	if len(data) < saltLen+1 {
+		return nsec3Record{}, errors.New("short NSEC3 rdata")
+	}
+	rec.salt = data[:saltLen]
+	data = data[saltLen:]
+
+	hashLen := int(data[0])
+	data = data[1:]
+	if len(data) < hashLen {
+		return nsec3Record{}, errors.New("short NSEC3 rdata")
+	}
+	rec.nextHash = strings.ToLower(base32Hex.EncodeToString(data[:hashLen]))
+	rec.types = typeBitmap(data[hashLen:])
+	return rec, nil
+}
+
+// uncompressed wire format name at the start of data
+func wireName(data []byte) (string, []byte, error) {
+	var labels []string
+	for {
+		if len(data) == 0 {
+			return "", nil, errors.New("truncated name")
+		}
+		n := int(data[0])
+		if n == 0 {
+			break
+		}
+		if n > 63 || len(data) < 1+n {
+			return "", nil, errors.New("bad label")
+		}
+		labels = append(labels, string(data[1:1+n]))
+		data = data[1+n:]
+	}
+	return strings.Join(labels, ".") + ".", data[1:], nil
+}
+
+// RFC 4034 4.1.2 window blocks
+func typeBitmap(data []byte) []dnsmessage.Type {
+	var types []dnsmessage.Type
+	for len(data) >= 2 {
+		window, length := int(data[0]), int(data[1])
+		if len(data) < 2+length {
+			break
+		}
+		for i, octet := range data[2 : 2+length] {
+			for bit := 0; bit < 8; bit++ {
+				if octet&(0x80>>bit) != 0 {
+					types = append(types, dnsmessage.Type(window*256+i*8+bit))
+				}
+			}
+		}
+		data = data[2+length:]
+	}
+	return types
+}
+
+func hasType(types []dnsmessage.Type, t dnsmessage.Type) bool {
+	for _, known := range types {
+		if known == t {
+			return true
+		}
+	}
+	return false
+}
+
+func typeList(types []dnsmessage.Type) string {
+	names := make([]string, len(types))
+	for i, t := range types {
+		names[i] = typeName(t)
+	}
+	return strings.Join(names, " ")
+}
+
+// RFC 5155 5: iterated SHA-1 over the canonical wire name and salt
+func nsec3Hash(name string, salt []byte, iterations uint16) string {
+	wire := canonicalWire(name)
+
+	h := sha1.Sum(append(wire, salt...))
+	for i := 0; i < int(iterations); i++ {
+		h = sha1.Sum(append(h[:], salt...))
+	}
+	return strings.ToLower(base32Hex.EncodeToString(h[:]))
+}
+
+func canonicalWire(name string) []byte {
+	var wire []byte
+	for _, label := range nameLabels(name) {
+		wire = append(wire, byte(len(label)))
+		wire = append(wire, strings.ToLower(label)...)
+	}
+	return append(wire, 0)
+}
+
+func nameLabels(name string) []string {
+	name = strings.TrimSuffix(name, ".")
+	if name == "" {
+		return nil
+	}
+	return strings.Split(name, ".")
+}
+
+// RFC 4034 6.1 canonical ordering, compares labels right to left
+func canonicalCompare(a, b string) int {
+	la, lb := nameLabels(strings.ToLower(a)), nameLabels(strings.ToLower(b))
+	for i := 1; i <= len(la) && i <= len(lb); i++ {
+		if c := bytes.Compare([]byte(la[len(la)-i]), []byte(lb[len(lb)-i])); c != 0 {
+			return c
+		}
+	}
+	return len(la) - len(lb)
+}
+
+// does the NSEC interval owner..next contain name (exclusive, wrapping at the zone end)
+func (n nsecRecord) covers(name string) bool {
+	afterOwner := canonicalCompare(name, n.owner) > 0
+	beforeNext := canonicalCompare(name, n.next) < 0
+	if canonicalCompare(n.owner, n.next) >= 0 {
+		return afterOwner || beforeNext // last NSEC of the zone
+	}
+	return afterOwner && beforeNext
+}
+
+func (n nsec3Record) covers(hash string) bool {
+	owner := n.ownerHash()
+	if owner >= n.nextHash {
+		return hash > owner || hash < n.nextHash
+	}
+	return hash > owner && hash < n.nextHash
+}
+
+// human readable account of how the authority section proves the denial,
+// proven is false when the records present don't add up to a proof
+func explainDenial(qname string, qtype dnsmessage.Type, res dnsmessage.Message) (lines []string, proven bool) {
+	var nsecs []nsecRecord
+	var nsec3s []nsec3Record
+	for _, rr := range res.Authorities {
+		body, ok := rr.Body.(*dnsmessage.UnknownResource)
+		if !ok {
+			continue
+		}
+		switch rr.Header.Type {
+		case typeNSEC:
+			if rec, err := parseNSEC(rr.Header.Name.String(), body.Data); err == nil {
+				nsecs = append(nsecs, rec)
+			}
+		case typeNSEC3:
+			if rec, err := parseNSEC3(rr.Header.Name.String(), body.Data); err == nil {
+				nsec3s = append(nsec3s, rec)
+			}
+		}
+	}
+
+	nxdomain := res.RCode == dnsmessage.RCodeNameError
+	switch {
+	case len(nsecs) > 0:
+		return explainNSEC(qname, qtype, nxdomain, nsecs)
+	case len(nsec3s) > 0:
+		return explainNSEC3(qname, qtype, nxdomain, nsec3s)
+	}
+	return []string{"no NSEC or NSEC3 records in the response, the denial is not provable"}, false
+}
+
+func explainNSEC(qname string, qtype dnsmessage.Type, nxdomain bool, nsecs []nsecRecord) ([]string, bool) {
+	var lines []string
+
+	if !nxdomain {
+		for _, n := range nsecs {
+			if canonicalCompare(n.owner, qname) == 0 {
+				lines = append(lines, fmt.Sprintf("NSEC at %s lists types [%s]", n.owner, typeList(n.types)))
+				if hasType(n.types, qtype) || hasType(n.types, dnsmessage.TypeCNAME) {
+					return append(lines, fmt.Sprintf("the bitmap contains %s or CNAME, NODATA is NOT proven", typeName(qtype))), false
+				}
+				return append(lines, fmt.Sprintf("%s exists but has no %s records (NODATA proven)", qname, typeName(qtype))), true
+			}
+		}
+		return append(lines, "no NSEC record matches the name, NODATA is not proven"), false
+	}
+
+	nameCovered := false
+	closestEncloser := "."
+	for _, n := range nsecs {
+		if n.covers(qname) {
+			nameCovered = true
+			lines = append(lines, fmt.Sprintf("NSEC %s -> %s covers %s, so the name does not exist", n.owner, n.next, qname))
+			// the longest common ancestor of the interval ends is the closest encloser
+			for _, end := range []string{n.owner, n.next} {
+				if ce := commonAncestor(qname, end); len(ce) > len(closestEncloser) {
+					closestEncloser = ce
+				}
+			}
+		}
+	}
+	if !nameCovered {
+		return append(lines, fmt.Sprintf("no NSEC covers %s, NXDOMAIN is not proven", qname)), false
+	}
+
+	wildcard := "*." + closestEncloser
+	if closestEncloser == "." {
+		wildcard = "*."
+	}
+	for _, n := range nsecs {
+		if n.covers(wildcard) {
+			lines = append(lines, fmt.Sprintf("NSEC %s -> %s covers %s, so no wildcard could have matched", n.owner, n.next, wildcard))
+			return append(lines, "NXDOMAIN proven"), true
+		}
+	}
+	return append(lines, fmt.Sprintf("no NSEC covers the wildcard %s, NXDOMAIN is not fully proven", wildcard)), false
+}
+
+func explainNSEC3(qname string, qtype dnsmessage.Type, nxdomain bool, nsec3s []nsec3Record) ([]string, bool) {
+	params := nsec3s[0]
+	if params.hashAlg != 1 {
+		return []string{fmt.Sprintf("unknown NSEC3 hash algorithm %d", params.hashAlg)}, false
+	}
+
+	lines := []string{fmt.Sprintf("NSEC3 parameters: SHA-1, %d extra iterations, salt %s",
+		params.iterations, saltString(params.salt))}
+
+	hashOf := func(name string) string { return nsec3Hash(name, params.salt, params.iterations) }
+	matching := func(hash string) (nsec3Record, bool) {
+		for _, n := range nsec3s {
+			if n.ownerHash() == hash {
+				return n, true
+			}
+		}
+		return nsec3Record{}, false
+	}
+	covering := func(hash string) (nsec3Record, bool) {
+		for _, n := range nsec3s {
+			if n.covers(hash) {
+				return n, true
+			}
+		}
+		return nsec3Record{}, false
+	}
+
+	if !nxdomain {
+		hash := hashOf(qname)
+		lines = append(lines, fmt.Sprintf("H(%s) = %s", qname, hash))
+		n, ok := matching(hash)
+		if !ok {
+			return append(lines, "no NSEC3 matches the name, NODATA is not proven"), false
+		}
+		lines = append(lines, fmt.Sprintf("matching NSEC3 lists types [%s]", typeList(n.types)))
+		if hasType(n.types, qtype) || hasType(n.types, dnsmessage.TypeCNAME) {
+			return append(lines, fmt.Sprintf("the bitmap contains %s or CNAME, NODATA is NOT proven", typeName(qtype))), false
+		}
+		return append(lines, fmt.Sprintf("%s exists but has no %s records (NODATA proven)", qname, typeName(qtype))), true
+	}
+
+	// RFC 5155 8.3 closest encloser proof
+	labels := nameLabels(qname)
+	for i := 1; i <= len(labels); i++ {
+		encloser := strings.Join(labels[i:], ".") + "."
+		nextCloser := strings.Join(labels[i-1:], ".") + "."
+
+		ceHash := hashOf(encloser)
+		if _, ok := matching(ceHash); !ok {
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("closest encloser %s: H = %s has a matching NSEC3", encloser, ceHash))
+
+		ncHash := hashOf(nextCloser)
+		n, ok := covering(ncHash)
+		if !ok {
+			return append(lines, fmt.Sprintf("next closer %s (H = %s) is not covered, NXDOMAIN is not proven", nextCloser, ncHash)), false
+		}
+		lines = append(lines, fmt.Sprintf("next closer %s: H = %s falls between %s and %s", nextCloser, ncHash, n.ownerHash(), n.nextHash))
+		if n.optOut {
+			lines = append(lines, "the covering NSEC3 has opt-out set, an unsigned delegation may still exist")
+		}
+
+		wildcard := "*." + encloser
+		if encloser == "." {
+			wildcard = "*."
+		}
+		wcHash := hashOf(wildcard)
+		if w, ok := covering(wcHash); ok {
+			lines = append(lines, fmt.Sprintf("wildcard %s: H = %s falls between %s and %s", wildcard, wcHash, w.ownerHash(), w.nextHash))
+			return append(lines, "NXDOMAIN proven"), true
+		}
+		return append(lines, fmt.Sprintf("wildcard %s (H = %s) is not covered, NXDOMAIN is not fully proven", wildcard, wcHash)), false
+	}
+	return append(lines, "no closest encloser found among the NSEC3 records"), false
+}
+
+func saltString(salt []byte) string {
+	if len(salt) == 0 {
+		return "-"
+	}
+	return hex.EncodeToString(salt)
+}
+
+// longest ancestor shared by both names
+func commonAncestor(a, b string) string {
+	la, lb := nameLabels(strings.ToLower(a)), nameLabels(strings.ToLower(b))
+	var common []string
+	for i := 1; i <= len(la) && i <= len(lb) && la[len(la)-i] == lb[len(lb)-i]; i++ {
+		common = append([]string{la[len(la)-i]}, common...)
+	}
+	return strings.Join(common, ".") + "."
+}
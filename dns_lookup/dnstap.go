@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+)
+
+// dnstap message types (dnstap.proto Message.Type)
+const (
+	dnstapResolverQuery    = 3
+	dnstapResolverResponse = 4
+	dnstapClientQuery      = 5
+	dnstapClientResponse   = 6
+)
+
+// frame streams control frame types
+const (
+	fstrmControlStart = 0x02
+	fstrmControlStop  = 0x03
+	fstrmFieldType    = 0x01
+)
+
+const dnstapContentType = "protobuf:dnstap.Dnstap"
+
+// writes dnstap protobuf payloads in a unidirectional frame streams file,
+// readable with `dnstap -r` or any fstrm consumer
+type dnstapWriter struct {
+	mu       sync.Mutex
+	file     *os.File
+	w        *bufio.Writer
+	identity []byte
+}
+
+var tap *dnstapWriter
+
+func newDnstapWriter(path string) (*dnstapWriter, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	identity, _ := os.Hostname()
+	d := &dnstapWriter{file: file, w: bufio.NewWriter(file), identity: []byte(identity)}
+
+	start := binary.BigEndian.AppendUint32(nil, fstrmControlStart)
+	start = binary.BigEndian.AppendUint32(start, fstrmFieldType)
+	start = binary.BigEndian.AppendUint32(start, uint32(len(dnstapContentType)))
+	start = append(start, dnstapContentType...)
+	d.writeControl(start)
+
+	return d, d.w.Flush()
+}
+
+// log a query/response pair as two dnstap messages, the query type is
+// followed by its matching response type
+func (d *dnstapWriter) logExchange(queryType, protocol int, peer string, query []byte, queryTime time.Time, response []byte, responseTime time.Time) {
+	addr, _ := netip.ParseAddrPort(peer)
+
+	// for resolver messages the peer is the responder, for client messages
+	// it is the querier
+	d.write(d.message(queryType, protocol, addr, query, queryTime, nil, time.Time{}))
+	d.write(d.message(queryType+1, protocol, addr, query, queryTime, response, responseTime))
+}
+
+func (d *dnstapWriter) message(msgType, protocol int, peer netip.AddrPort, query []byte, queryTime time.Time, response []byte, responseTime time.Time) []byte {
+	var msg []byte
+	msg = appendVarintField(msg, 1, uint64(msgType))
+
+	if peer.IsValid() {
+		family := uint64(1) // INET
+		if peer.Addr().Is6() && !peer.Addr().Is4In6() {
+			family = 2 // INET6
+		}
+		msg = appendVarintField(msg, 2, family)
+		msg = appendVarintField(msg, 3, uint64(protocol))
+
+		addr := peer.Addr().Unmap().AsSlice()
+		if msgType == dnstapClientQuery || msgType == dnstapClientResponse {
+			msg = appendBytesField(msg, 4, addr)
+			msg = appendVarintField(msg, 6, uint64(peer.Port()))
+		} else {
+			msg = appendBytesField(msg, 5, addr)
+			msg = appendVarintField(msg, 7, uint64(peer.Port()))
+		}
+	}
+
+	msg = appendVarintField(msg, 8, uint64(queryTime.Unix()))
+	msg = appendFixed32Field(msg, 9, uint32(queryTime.Nanosecond()))
+	if response == nil {
+		msg = appendBytesField(msg, 10, query)
+	} else {
+		msg = appendVarintField(msg, 12, uint64(responseTime.Unix()))
+		msg = appendFixed32Field(msg, 13, uint32(responseTime.Nanosecond()))
+		msg = appendBytesField(msg, 14, response)
+	}
+
+	var frame []byte
+	frame = appendBytesField(frame, 1, d.identity)
+	frame = appendBytesField(frame, 2, []byte("dns_lookup"))
+	frame = appendBytesField(frame, 14, msg)
+	frame = appendVarintField(frame, 15, 1) // Dnstap.Type MESSAGE
+	return frame
+}
+
+func (d *dnstapWriter) write(frame []byte) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(frame)))
+	d.w.Write(length[:])
+	d.w.Write(frame)
+	d.w.Flush()
+}
+
+// control frames are escaped by a zero length
+func (d *dnstapWriter) writeControl(control []byte) {
+	var header [8]byte
+	binary.BigEndian.PutUint32(header[4:], uint32(len(control)))
+	d.w.Write(header[:])
+	d.w.Write(control)
+}
+
+func (d *dnstapWriter) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.writeControl(binary.BigEndian.AppendUint32(nil, fstrmControlStop))
+	if err := d.w.Flush(); err != nil {
+		d.file.Close()
+		return err
+	}
+	return d.file.Close()
+}
+
+// dnstap SocketProtocol of the transport used towards name servers
+func dnstapProtocol() int {
+	switch client.Transport {
+	case "tcp":
+		return 2
+	case "dot":
+		return 3
+	case "doh":
+		return 4
+	}
+	return 1
+}
+
+// minimal protobuf wire encoding
+
+func appendVarint(b []byte, v uint64) []byte {
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(b, byte(v))
+}
+
+func appendVarintField(b []byte, field int, v uint64) []byte {
+	b = appendVarint(b, uint64(field)<<3)
+	return appendVarint(b, v)
+}
+
+func appendFixed32Field(b []byte, field int, v uint32) []byte {
+	b = appendVarint(b, uint64(field)<<3|5)
+	return binary.LittleEndian.AppendUint32(b, v)
+}
+
+func appendBytesField(b []byte, field int, v []byte) []byte {
+	b = appendVarint(b, uint64(field)<<3|2)
+	b = appendVarint(b, uint64(len(v)))
+	return append(b, v...)
+}
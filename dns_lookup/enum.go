@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"internet_services/dns_lookup/resolver"
+)
+
+// tried when no wordlist is given
+var defaultWordlist = []string{
+	"www", "mail", "smtp", "imap", "pop", "mx", "ns1", "ns2", "dns", "ftp",
+	"api", "app", "dev", "staging", "test", "beta", "admin", "portal", "vpn", "remote",
+	"blog", "shop", "cdn", "static", "img", "m", "webmail", "git", "ci", "status",
+}
+
+// dns_lookup enum [flags] domain
+func runEnum(args []string) {
+	fs := flag.NewFlagSet("enum", flag.ExitOnError)
+	wordlistPath := fs.String("wordlist", "", "file with one label per line for brute forcing (default: small built-in list)")
+	concurrency := fs.Int("concurrency", 10, "parallel brute force queries")
+	rate := fs.Int("rate", 50, "maximum brute force queries per second")
+	noWalk := fs.Bool("no-walk", false, "skip NSEC walking")
+	noBrute := fs.Bool("no-brute", false, "skip wordlist brute forcing")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fmt.Println("usage: dns_lookup enum [flags] domain")
+		os.Exit(2)
+	}
+	domain := strings.TrimSuffix(fs.Arg(0), ".") + "."
+
+	words := defaultWordlist
+	if *wordlistPath != "" {
+		var err error
+		if words, err = readWordlist(*wordlistPath); err != nil {
+			fmt.Println("Failed to read wordlist:", err)
+			os.Exit(1)
+		}
+	}
+
+	servers, err := authServers(client, domain)
+	if err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Authoritative servers for %s: %s\n", domain, strings.Join(servers, ", "))
+
+	if !*noWalk {
+		names, err := nsecWalk(client, domain, servers[0])
+		if err == nil {
+			fmt.Printf("\nNSEC walk found %d names:\n", len(names))
+			for _, name := range names {
+				fmt.Println("->", name)
+			}
+			return
+		}
+		fmt.Println("\nNSEC walk not possible:", err)
+	}
+
+	if !*noBrute {
+		fmt.Printf("\nBrute forcing %d labels (%d at a time, %d/s)\n", len(words), *concurrency, *rate)
+		for _, found := range bruteForce(client, domain, servers, words, *concurrency, *rate) {
+			fmt.Println("->", found)
+		}
+	}
+}
+
+func readWordlist(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var words []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if word := strings.TrimSpace(scanner.Text()); word != "" && !strings.HasPrefix(word, "#") {
+			words = append(words, word)
+		}
+	}
+	return words, scanner.Err()
+}
+
+// addresses of the zone's name servers, found with the iterative resolver
+func authServers(c *resolver.Client, domain string) ([]string, error) {
+	res, err := c.Iterate(domain, dnsmessage.TypeNS)
+	if err != nil {
+		return nil, fmt.Errorf("finding name servers: %w", err)
+	}
+
+	var servers []string
+	for _, rr := range res.Answers {
+		ns, ok := rr.Body.(*dnsmessage.NSResource)
+		if !ok {
+			continue
+		}
+		addrs, err := c.Iterate(ns.NS.String(), dnsmessage.TypeA)
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs.Answers {
+			if body, ok := a.Body.(*dnsmessage.AResource); ok {
+				servers = append(servers, rdataString(body))
+			}
+		}
+	}
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("no reachable name servers for %s", domain)
+	}
+	return servers, nil
+}
+
+// follow the NSEC chain from the apex until it wraps around
+func nsecWalk(client *resolver.Client, zone, server string) ([]string, error) {
+	c := *client
+	c.DNSSEC = true
+
+	names := []string{}
+	seen := map[string]bool{}
+	name := zone
+	for !seen[strings.ToLower(name)] {
+		seen[strings.ToLower(name)] = true
+
+		res, err := c.Query(name, typeNSEC, server)
+		if err != nil {
+			return nil, err
+		}
+
+		var next string
+		for _, rr := range append(res.Answers, res.Authorities...) {
+			body, ok := rr.Body.(*dnsmessage.UnknownResource)
+			if !ok || rr.Header.Type != typeNSEC || canonicalCompare(rr.Header.Name.String(), name) != 0 {
+				continue
+			}
+			if n, err := parseNSEC(name, body.Data); err == nil {
+				next = n.next
+			}
+		}
+		if next == "" {
+			if len(names) == 0 {
+				return nil, errors.New("zone does not use NSEC (unsigned or NSEC3)")
+			}
+			return nil, fmt.Errorf("NSEC chain broken after %s", name)
+		}
+		// "black lies" style signers point at \000.name instead of the real next name
+		if strings.HasPrefix(next, "\x00.") || strings.HasPrefix(next, "\\000.") {
+			return nil, errors.New("server synthesizes minimal NSEC records, the chain can't be walked")
+		}
+
+		names = append(names, name)
+		name = next
+	}
+	return names, nil
+}
+
+// query word.domain for every word against the authoritative servers
+func bruteForce(c *resolver.Client, domain string, servers, words []string, concurrency, rate int) []string {
+	// a wildcard makes every label resolve, remember its answer to filter it out
+	wildcard := ""
+	probe := fmt.Sprintf("wildcard-probe-%d.%s", rand.Int63(), domain)
+	if res, err := c.Query(probe, dnsmessage.TypeA, servers[0]); err == nil && len(res.Answers) > 0 {
+		wildcard = answerSummary(res)
+		fmt.Printf("Wildcard detected (%s), ignoring names that resolve to it\n", wildcard)
+	}
+
+	limiter := time.NewTicker(time.Second / time.Duration(max(rate, 1)))
+	defer limiter.Stop()
+
+	jobs := make(chan string)
+	var mu sync.Mutex
+	var found []string
+
+	var wg sync.WaitGroup
+	for w := 0; w < max(concurrency, 1); w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for name := range jobs {
+				<-limiter.C
+				res, err := c.Query(name, dnsmessage.TypeA, servers[w%len(servers)])
+				if err != nil || res.RCode != dnsmessage.RCodeSuccess {
+					continue
+				}
+				summary := answerSummary(res)
+				if wildcard != "" && summary == wildcard {
+					continue
+				}
+				if summary == "" {
+					summary = "(exists, no A records)"
+				}
+				mu.Lock()
+				found = append(found, fmt.Sprintf("%s %s", name, summary))
+				mu.Unlock()
+			}
+		}(w)
+	}
+
+	for _, word := range words {
+		jobs <- word + "." + domain
+	}
+	close(jobs)
+	wg.Wait()
+
+	sort.Strings(found)
+	return found
+}
+
+func answerSummary(res dnsmessage.Message) string {
+	var values []string
+	for _, rr := range res.Answers {
+		values = append(values, typeName(rr.Header.Type)+" "+rdataString(rr.Body))
+	}
+	sort.Strings(values)
+	return strings.Join(values, ", ")
+}
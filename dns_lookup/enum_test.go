@@ -0,0 +1,36 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAuthServers(t *testing.T) {
+	c := startHierarchy(t)
+
+	servers, err := authServers(c, "example.com.")
+	if err != nil || len(servers) != 1 || servers[0] != "127.0.0.4" {
+		t.Errorf("got %v, %v, want [127.0.0.4]", servers, err)
+	}
+}
+
+func TestNSECWalk(t *testing.T) {
+	c := startHierarchy(t)
+
+	names, err := nsecWalk(c, "nsec.test.", "127.0.0.9")
+	if want := "nsec.test. a.nsec.test. c.nsec.test."; err != nil || strings.Join(names, " ") != want {
+		t.Errorf("got %v, %v, want %s", names, err, want)
+	}
+	if _, err := nsecWalk(c, "nsec3.test.", "127.0.0.9"); err == nil {
+		t.Error("walk of an NSEC3 zone succeeded")
+	}
+}
+
+func TestBruteForce(t *testing.T) {
+	c := startHierarchy(t)
+
+	found := bruteForce(c, "example.com.", []string{"127.0.0.4"}, []string{"www", "nope", "ns1"}, 2, 1000)
+	if len(found) != 2 || !strings.HasPrefix(found[0], "ns1.example.com.") || !strings.HasPrefix(found[1], "www.example.com.") {
+		t.Errorf("got %v", found)
+	}
+}
@@ -0,0 +1,458 @@
+// Package fakedns runs scripted name servers on loopback addresses so the
+// iterative resolver can be exercised without real network access.
+//
+// Every server of a hierarchy listens on its own 127.0.0.x address and the
+// same port, which lets referrals carry plain glue addresses the way real
+// ones do. Linux routes all of 127.0.0.0/8 to loopback; on other systems
+// the extra addresses have to be configured first.
+package fakedns
+
+import (
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Zone is the data one server is authoritative for. NS records below the
+// origin are delegations and produce referrals, A and AAAA records for the
+// delegated name servers are handed out as glue.
+type Zone struct {
+	Origin  string
+	Records []dnsmessage.Resource
+}
+
+// Server is a single scripted name server.
+type Server struct {
+	IP    string
+	Zones []Zone
+
+	// failure knobs, safe to change while the server runs
+	Truncate atomic.Bool  // answer udp with TC set and no records, tcp normally
+	Drop     atomic.Bool  // never answer, the client times out
+	RCode    atomic.Int32 // when non zero, answer every query with this rcode
+
+	MinimalANY    atomic.Bool // answer ANY with the RFC 8482 HINFO record
+	AuthenticData atomic.Bool // set AD in responses, as a validating resolver does
+
+	Queries atomic.Int64 // queries received over udp and tcp
+
+	udp net.PacketConn
+	tcp net.Listener
+	wg  sync.WaitGroup
+}
+
+// Addr is the ip:port the server listens on.
+func (s *Server) Addr() string {
+	return s.udp.LocalAddr().String()
+}
+
+// Start listens on ip:port for udp and tcp. Port 0 picks a free port.
+func (s *Server) Start(port int) error {
+	udp, err := net.ListenPacket("udp", net.JoinHostPort(s.IP, strconv.Itoa(port)))
+	if err != nil {
+		return err
+	}
+	port = udp.LocalAddr().(*net.UDPAddr).Port
+
+	tcp, err := net.Listen("tcp", net.JoinHostPort(s.IP, strconv.Itoa(port)))
+	if err != nil {
+		udp.Close()
+		return err
+	}
+
+	s.udp, s.tcp = udp, tcp
+	s.wg.Add(2)
+	go s.serveUDP()
+	go s.serveTCP()
+	return nil
+}
+
+// Close stops the listeners and waits for them to exit.
+func (s *Server) Close() {
+	s.udp.Close()
+	s.tcp.Close()
+	s.wg.Wait()
+}
+
+func (s *Server) serveUDP() {
+	defer s.wg.Done()
+
+	buf := make([]byte, 512)
+	for {
+		n, peer, err := s.udp.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if res := s.respond(buf[:n], true); res != nil {
+			s.udp.WriteTo(res, peer)
+		}
+	}
+}
+
+func (s *Server) serveTCP() {
+	defer s.wg.Done()
+
+	for {
+		conn, err := s.tcp.Accept()
+		if err != nil {
+			return
+		}
+		go s.handleTCP(conn)
+	}
+}
+
+func (s *Server) handleTCP(conn net.Conn) {
+	defer conn.Close()
+
+	for {
+		var length [2]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return
+		}
+		query := make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(conn, query); err != nil {
+			return
+		}
+
+		res := s.respond(query, false)
+		if res == nil {
+			return
+		}
+		framed := binary.BigEndian.AppendUint16(nil, uint16(len(res)))
+		if _, err := conn.Write(append(framed, res...)); err != nil {
+			return
+		}
+	}
+}
+
+// packed response to a packed query, nil means stay silent
+func (s *Server) respond(packet []byte, overUDP bool) []byte {
+	s.Queries.Add(1)
+	if s.Drop.Load() {
+		return nil
+	}
+
+	var req dnsmessage.Message
+	if err := req.Unpack(packet); err != nil || len(req.Questions) != 1 {
+		return nil
+	}
+
+	res := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: req.ID, Response: true, RecursionDesired: req.RecursionDesired,
+			AuthenticData: s.AuthenticData.Load()},
+		Questions: req.Questions,
+	}
+
+	switch {
+	case s.RCode.Load() != 0:
+		res.RCode = dnsmessage.RCode(s.RCode.Load())
+	case s.Truncate.Load() && overUDP:
+		res.Truncated = true
+	case req.Questions[0].Type == dnsmessage.TypeAXFR:
+		s.transfer(&res, req.Questions[0], overUDP)
+	default:
+		s.lookup(&res, req.Questions[0])
+	}
+
+	packed, err := res.Pack()
+	if err != nil {
+		return nil
+	}
+	return packed
+}
+
+// fill in an answer, referral or negative response from the zones
+func (s *Server) lookup(res *dnsmessage.Message, q dnsmessage.Question) {
+	qname := canonical(q.Name.String())
+
+	zone, ok := s.closestZone(qname)
+	if !ok {
+		res.RCode = dnsmessage.RCodeRefused
+		return
+	}
+
+	// delegation between the zone apex and qname ?
+	if cut, ns := zone.delegation(qname); cut != "" {
+		res.Authorities = ns
+		for _, rr := range ns {
+			target := canonical(rr.Body.(*dnsmessage.NSResource).NS.String())
+			res.Additionals = append(res.Additionals, zone.find(target, dnsmessage.TypeA)...)
+			res.Additionals = append(res.Additionals, zone.find(target, dnsmessage.TypeAAAA)...)
+		}
+		return
+	}
+
+	res.Authoritative = true
+	if q.Type == dnsmessage.TypeALL && s.MinimalANY.Load() && zone.exists(qname) {
+		res.Answers = []dnsmessage.Resource{Raw(qname, 13, 3600, []byte("\x07RFC8482\x00"))}
+		return
+	}
+	res.Answers = zone.find(qname, q.Type)
+	if len(res.Answers) == 0 && q.Type != dnsmessage.TypeCNAME {
+		res.Answers = zone.find(qname, dnsmessage.TypeCNAME)
+	}
+	if len(res.Answers) > 0 {
+		return
+	}
+
+	if !zone.exists(qname) {
+		res.RCode = dnsmessage.RCodeNameError
+	}
+	res.Authorities = zone.find(canonical(zone.Origin), dnsmessage.TypeSOA)
+
+	// signed zones hand out their whole denial chain, picking the
+	// relevant records is the resolver's job
+	for _, rr := range zone.Records {
+		if rr.Header.Type == typeNSEC || rr.Header.Type == typeNSEC3 {
+			res.Authorities = append(res.Authorities, rr)
+		}
+	}
+}
+
+// whole zone in one message, SOA first and last (RFC 5936), tcp only
+func (s *Server) transfer(res *dnsmessage.Message, q dnsmessage.Question, overUDP bool) {
+	zone, ok := s.closestZone(canonical(q.Name.String()))
+	if overUDP || !ok || canonical(zone.Origin) != canonical(q.Name.String()) {
+		res.RCode = dnsmessage.RCodeRefused
+		return
+	}
+
+	soa := zone.find(canonical(zone.Origin), dnsmessage.TypeSOA)
+	if len(soa) == 0 {
+		res.RCode = dnsmessage.RCodeServerFailure
+		return
+	}
+	res.Authoritative = true
+	res.Answers = append(res.Answers, soa[0])
+	for _, rr := range zone.Records {
+		if rr.Header.Type != dnsmessage.TypeSOA {
+			res.Answers = append(res.Answers, rr)
+		}
+	}
+	res.Answers = append(res.Answers, soa[0])
+}
+
+func (s *Server) closestZone(qname string) (Zone, bool) {
+	var best Zone
+	found := false
+	for _, zone := range s.Zones {
+		origin := canonical(zone.Origin)
+		if isSubdomain(qname, origin) && (!found || len(origin) > len(canonical(best.Origin))) {
+			best, found = zone, true
+		}
+	}
+	return best, found
+}
+
+// closest delegation point at or above qname, below the apex
+func (z Zone) delegation(qname string) (string, []dnsmessage.Resource) {
+	origin := canonical(z.Origin)
+	for name := qname; name != origin && isSubdomain(name, origin); name = parent(name) {
+		if ns := z.find(name, dnsmessage.TypeNS); len(ns) > 0 {
+			return name, ns
+		}
+	}
+	return "", nil
+}
+
+func (z Zone) find(name string, qtype dnsmessage.Type) []dnsmessage.Resource {
+	var found []dnsmessage.Resource
+	for _, rr := range z.Records {
+		if canonical(rr.Header.Name.String()) == name && (qtype == dnsmessage.TypeALL || rr.Header.Type == qtype) {
+			found = append(found, rr)
+		}
+	}
+	return found
+}
+
+// a name exists when it, or anything below it, owns records
+func (z Zone) exists(name string) bool {
+	for _, rr := range z.Records {
+		if rr.Header.Type == typeNSEC3 {
+			continue // hashed owner names don't make names exist
+		}
+		if isSubdomain(canonical(rr.Header.Name.String()), name) {
+			return true
+		}
+	}
+	return false
+}
+
+func canonical(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, ".")) + "."
+}
+
+func isSubdomain(name, zone string) bool {
+	return zone == "." || name == zone || strings.HasSuffix(name, "."+zone)
+}
+
+func parent(name string) string {
+	if i := strings.Index(name, "."); i >= 0 && i < len(name)-1 {
+		return name[i+1:]
+	}
+	return "."
+}
+
+// Hierarchy is a set of running servers that make up a namespace.
+type Hierarchy struct {
+	Servers map[string]*Server // keyed by IP
+	Port    int
+}
+
+// Start brings up every server on the same port, the first one picking it.
+func Start(servers ...*Server) (*Hierarchy, error) {
+	if len(servers) == 0 {
+		return nil, errors.New("fakedns: no servers")
+	}
+
+	h := &Hierarchy{Servers: map[string]*Server{}}
+	for _, s := range servers {
+		if err := s.Start(h.Port); err != nil {
+			h.Close()
+			return nil, fmt.Errorf("fakedns: starting %s: %w", s.IP, err)
+		}
+		h.Port = s.udp.LocalAddr().(*net.UDPAddr).Port
+		h.Servers[s.IP] = s
+	}
+	return h, nil
+}
+
+// Close stops all servers.
+func (h *Hierarchy) Close() {
+	for _, s := range h.Servers {
+		s.Close()
+	}
+}
+
+// record constructors for scripting zones
+
+func A(name, ip string, ttl uint32) dnsmessage.Resource {
+	var a [4]byte
+	copy(a[:], net.ParseIP(ip).To4())
+	return dnsmessage.Resource{Header: header(name, dnsmessage.TypeA, ttl), Body: &dnsmessage.AResource{A: a}}
+}
+
+func AAAA(name, ip string, ttl uint32) dnsmessage.Resource {
+	var aaaa [16]byte
+	copy(aaaa[:], net.ParseIP(ip).To16())
+	return dnsmessage.Resource{Header: header(name, dnsmessage.TypeAAAA, ttl), Body: &dnsmessage.AAAAResource{AAAA: aaaa}}
+}
+
+func NS(name, target string, ttl uint32) dnsmessage.Resource {
+	return dnsmessage.Resource{Header: header(name, dnsmessage.TypeNS, ttl), Body: &dnsmessage.NSResource{NS: mustName(target)}}
+}
+
+func CNAME(name, target string, ttl uint32) dnsmessage.Resource {
+	return dnsmessage.Resource{Header: header(name, dnsmessage.TypeCNAME, ttl), Body: &dnsmessage.CNAMEResource{CNAME: mustName(target)}}
+}
+
+func MX(name string, pref uint16, host string, ttl uint32) dnsmessage.Resource {
+	return dnsmessage.Resource{Header: header(name, dnsmessage.TypeMX, ttl), Body: &dnsmessage.MXResource{Pref: pref, MX: mustName(host)}}
+}
+
+func PTR(name, target string, ttl uint32) dnsmessage.Resource {
+	return dnsmessage.Resource{Header: header(name, dnsmessage.TypePTR, ttl), Body: &dnsmessage.PTRResource{PTR: mustName(target)}}
+}
+
+func TXT(name string, ttl uint32, txt ...string) dnsmessage.Resource {
+	return dnsmessage.Resource{Header: header(name, dnsmessage.TypeTXT, ttl), Body: &dnsmessage.TXTResource{TXT: txt}}
+}
+
+func SOA(name, ns string, minTTL uint32) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: header(name, dnsmessage.TypeSOA, minTTL),
+		Body: &dnsmessage.SOAResource{
+			NS: mustName(ns), MBox: mustName("hostmaster." + canonical(name)),
+			Serial: 1, Refresh: 3600, Retry: 600, Expire: 86400, MinTTL: minTTL,
+		},
+	}
+}
+
+const (
+	typeNSEC  dnsmessage.Type = 47
+	typeNSEC3 dnsmessage.Type = 50
+)
+
+// NSEC builds a denial record pointing at the next name of the zone.
+func NSEC(name, next string, ttl uint32, types ...dnsmessage.Type) dnsmessage.Resource {
+	data := wireName(canonical(next))
+	return Raw(name, typeNSEC, ttl, append(data, typeBitmap(types)...))
+}
+
+// NSEC3 builds a hashed denial record, owner and next are base32hex hashes
+// and owner is placed below zone. It fails when next is not base32hex.
+func NSEC3(owner, zone, next string, salt []byte, iterations uint16, ttl uint32, types ...dnsmessage.Type) (dnsmessage.Resource, error) {
+	hash, err := base32.HexEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(next))
+	if err != nil {
+		return dnsmessage.Resource{}, fmt.Errorf("fakedns: bad NSEC3 next hash %q: %w", next, err)
+	}
+
+	data := []byte{1, 0, byte(iterations >> 8), byte(iterations), byte(len(salt))}
+	data = append(data, salt...)
+	data = append(data, byte(len(hash)))
+	data = append(data, hash...)
+	data = append(data, typeBitmap(types)...)
+	return Raw(owner+"."+canonical(zone), typeNSEC3, ttl, data), nil
+}
+
+func wireName(name string) []byte {
+	var wire []byte
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label != "" {
+			wire = append(wire, byte(len(label)))
+			wire = append(wire, label...)
+		}
+	}
+	return append(wire, 0)
+}
+
+// RFC 4034 4.1.2 window blocks
+func typeBitmap(types []dnsmessage.Type) []byte {
+	windows := map[int][]byte{}
+	for _, t := range types {
+		window, bit := int(t)/256, int(t)%256
+		bitmap := windows[window]
+		for len(bitmap) <= bit/8 {
+			bitmap = append(bitmap, 0)
+		}
+		bitmap[bit/8] |= 0x80 >> (bit % 8)
+		windows[window] = bitmap
+	}
+
+	var data []byte
+	for window := 0; window < 256; window++ {
+		if bitmap, ok := windows[window]; ok {
+			data = append(data, byte(window), byte(len(bitmap)))
+			data = append(data, bitmap...)
+		}
+	}
+	return data
+}
+
+// CAA builds an issuance policy record, flags 128 marks it critical.
+func CAA(name string, ttl uint32, flags uint8, tag, value string) dnsmessage.Resource {
+	data := append([]byte{flags, byte(len(tag))}, tag...)
+	return Raw(name, 257, ttl, append(data, value...))
+}
+
+// Raw builds a record of any type from its wire format rdata.
+func Raw(name string, rrtype dnsmessage.Type, ttl uint32, data []byte) dnsmessage.Resource {
+	return dnsmessage.Resource{Header: header(name, rrtype, ttl), Body: &dnsmessage.UnknownResource{Type: rrtype, Data: data}}
+}
+
+func header(name string, rrtype dnsmessage.Type, ttl uint32) dnsmessage.ResourceHeader {
+	return dnsmessage.ResourceHeader{Name: mustName(name), Type: rrtype, Class: dnsmessage.ClassINET, TTL: ttl}
+}
+
+func mustName(name string) dnsmessage.Name {
+	return dnsmessage.MustNewName(canonical(name))
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// public resolvers that filter by category, queries from a client group are
+// forwarded to the upstreams of its category
+var filterUpstreams = map[string][]string{
+	"malware":  {"9.9.9.9", "149.112.112.112"},         // Quad9
+	"security": {"185.228.168.9", "185.228.169.9"},     // CleanBrowsing security filter
+	"adult":    {"185.228.168.10", "185.228.169.11"},   // CleanBrowsing adult filter
+	"family":   {"185.228.168.168", "185.228.169.168"}, // CleanBrowsing family filter
+}
+
+type filterCategory struct {
+	name      string
+	upstreams *forwarder
+	allow     []string // always resolved unfiltered
+	block     []string // always answered with NXDOMAIN
+}
+
+// clients in prefix use category, nil means unfiltered
+type clientGroup struct {
+	prefix   netip.Prefix
+	category *filterCategory
+}
+
+type clientFilters struct {
+	groups     []clientGroup
+	categories map[string]*filterCategory
+}
+
+// set in server mode when -filter is given
+var filters *clientFilters
+
+// parse "192.168.1.0/24=family,10.0.0.0/8=none,0.0.0.0/0=malware"
+func parseClientGroups(spec string, healthInterval time.Duration) (*clientFilters, error) {
+	f := &clientFilters{categories: map[string]*filterCategory{}}
+	for _, group := range strings.Split(spec, ",") {
+		cidr, name, ok := strings.Cut(strings.TrimSpace(group), "=")
+		if !ok {
+			return nil, fmt.Errorf("client group %q: want prefix=category", group)
+		}
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("client group %q: %w", group, err)
+		}
+
+		var category *filterCategory
+		if name != "none" {
+			if category, err = f.category(name, healthInterval); err != nil {
+				return nil, err
+			}
+		}
+		f.groups = append(f.groups, clientGroup{prefix: prefix.Masked(), category: category})
+	}
+
+	// most specific prefix first
+	sort.SliceStable(f.groups, func(i, j int) bool {
+		return f.groups[i].prefix.Bits() > f.groups[j].prefix.Bits()
+	})
+	return f, nil
+}
+
+func (f *clientFilters) category(name string, healthInterval time.Duration) (*filterCategory, error) {
+	if c, ok := f.categories[name]; ok {
+		return c, nil
+	}
+	addrs, ok := filterUpstreams[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown filter category %q (want malware, security, adult, family or none)", name)
+	}
+	c := &filterCategory{name: name, upstreams: newForwarder(addrs, healthInterval)}
+	f.categories[name] = c
+	return c, nil
+}
+
+// override file lines: "category allow|block domain", a domain covers its subdomains
+func (f *clientFilters) loadOverrides(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 3 {
+			return fmt.Errorf("%s:%d: want category allow|block domain", path, line)
+		}
+
+		c, ok := f.categories[fields[0]]
+		if !ok {
+			return fmt.Errorf("%s:%d: category %q is not used by any client group", path, line, fields[0])
+		}
+		domain := strings.ToLower(strings.TrimSuffix(fields[2], ".")) + "."
+		switch fields[1] {
+		case "allow":
+			c.allow = append(c.allow, domain)
+		case "block":
+			c.block = append(c.block, domain)
+		default:
+			return fmt.Errorf("%s:%d: unknown action %q", path, line, fields[1])
+		}
+	}
+	return scanner.Err()
+}
+
+// probe the upstreams of every category in the background
+func (f *clientFilters) checkHealth() {
+	for _, c := range f.categories {
+		go c.upstreams.checkHealth()
+	}
+}
+
+// health of the upstreams of every category, by category name
+func (f *clientFilters) status() []categoryStatus {
+	var statuses []categoryStatus
+	for name, c := range f.categories {
+		statuses = append(statuses, categoryStatus{Category: name, Upstreams: c.upstreams.status()})
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Category < statuses[j].Category })
+	return statuses
+}
+
+// category of the most specific group containing the client
+func (f *clientFilters) forClient(peer net.Addr) *filterCategory {
+	addrPort, err := netip.ParseAddrPort(peer.String())
+	if err != nil {
+		return nil
+	}
+	addr := addrPort.Addr().Unmap().WithZone("") // prefixes never match zoned addresses
+	for _, g := range f.groups {
+		if g.prefix.Contains(addr) {
+			return g.category
+		}
+	}
+	return nil
+}
+
+// "allow", "block" or "" when no override matches, block wins over allow
+func (c *filterCategory) override(name string) string {
+	name = strings.ToLower(name)
+	for _, domain := range c.block {
+		if inDomain(name, domain) {
+			return "block"
+		}
+	}
+	for _, domain := range c.allow {
+		if inDomain(name, domain) {
+			return "allow"
+		}
+	}
+	return ""
+}
+
+func inDomain(name, domain string) bool {
+	return name == domain || strings.HasSuffix(name, "."+domain)
+}
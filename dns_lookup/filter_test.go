@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestClientGroups(t *testing.T) {
+	f, err := parseClientGroups("0.0.0.0/0=malware,127.0.0.0/8=family,127.0.0.5/32=none", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		ip   string
+		want string // category, empty for unfiltered
+	}{
+		{"127.0.0.1", "family"},
+		{"127.0.0.5", ""},
+		{"192.0.2.1", "malware"},
+	}
+	for _, tt := range tests {
+		got := ""
+		if c := f.forClient(&net.UDPAddr{IP: net.ParseIP(tt.ip), Port: 5353}); c != nil {
+			got = c.name
+		}
+		if got != tt.want {
+			t.Errorf("%s got %q, want %q", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestFilterBlocks(t *testing.T) {
+	f, err := parseClientGroups("127.0.0.0/8=family", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.categories["family"].block = []string{"games.example."}
+	saved := filters
+	filters = f
+	t.Cleanup(func() { filters = saved })
+
+	req := dnsmessage.Message{Questions: []dnsmessage.Question{{
+		Name: dnsmessage.MustNewName("www.games.example."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET,
+	}}}
+	kid := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5353}
+	if res := answer(req, kid); res.RCode != dnsmessage.RCodeNameError {
+		t.Errorf("blocked name got %s", res.RCode)
+	}
+}
+
+func TestFilterStatus(t *testing.T) {
+	f, err := parseClientGroups("0.0.0.0/0=malware,127.0.0.0/8=family", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := filters
+	filters = f
+	t.Cleanup(func() { filters = saved })
+
+	status := currentStatus()
+	if len(status.Filters) != 2 {
+		t.Fatalf("got %d categories, want 2", len(status.Filters))
+	}
+	for i, want := range []string{"family", "malware"} {
+		c := status.Filters[i]
+		if c.Category != want || len(c.Upstreams) != len(filterUpstreams[want]) || c.Upstreams[0].Addr != filterUpstreams[want][0] {
+			t.Errorf("category %d: got %+v, want %s", i, c, want)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	handleDashboard(w, httptest.NewRequest("GET", "/", nil))
+	if page := w.Body.String(); !strings.Contains(page, "Upstreams of the family filter") || !strings.Contains(page, filterUpstreams["malware"][1]) {
+		t.Errorf("dashboard without the filter upstreams:\n%s", page)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// health of an upstream as shown on the status endpoint
+type upstreamStatus struct {
+	Addr      string        `json:"addr"`
+	Healthy   bool          `json:"healthy"`
+	Failures  int           `json:"consecutive_failures"`
+	LastCheck time.Time     `json:"last_check"`
+	LastRTT   time.Duration `json:"last_rtt_ns"`
+	LastError string        `json:"last_error,omitempty"`
+}
+
+// an upstream resolver used in forwarder mode
+type upstream struct {
+	mu sync.Mutex
+	upstreamStatus
+}
+
+// record the outcome of a probe or forwarded query
+func (u *upstream) report(rtt time.Duration, err error, failThreshold int) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.LastCheck = time.Now()
+	if err != nil {
+		u.Failures++
+		u.LastError = err.Error()
+		if u.Failures >= failThreshold {
+			u.Healthy = false
+		}
+		return
+	}
+	u.Failures = 0
+	u.LastError = ""
+	u.LastRTT = rtt
+	u.Healthy = true
+}
+
+func (u *upstream) isHealthy() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.Healthy
+}
+
+func (u *upstream) status() upstreamStatus {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.upstreamStatus
+}
+
+// forwards client queries to the first healthy upstream
+type forwarder struct {
+	upstreams     []*upstream
+	interval      time.Duration
+	failThreshold int
+}
+
+// set in server mode when -forward is given, nil means iterate from the roots
+var fwd *forwarder
+
+func newForwarder(addrs []string, interval time.Duration) *forwarder {
+	f := &forwarder{interval: interval, failThreshold: 3}
+	for _, addr := range addrs {
+		// assume healthy until the first probe says otherwise
+		f.upstreams = append(f.upstreams, &upstream{upstreamStatus: upstreamStatus{Addr: addr, Healthy: true}})
+	}
+	return f
+}
+
+// probe every upstream periodically in the background
+func (f *forwarder) checkHealth() {
+	for {
+		for _, u := range f.upstreams {
+			go f.probe(u)
+		}
+		time.Sleep(f.interval)
+	}
+}
+
+// a root NS query is small and answered from cache by any working resolver
+func (f *forwarder) probe(u *upstream) {
+	start := time.Now()
+	res, err := client.Query(".", dnsmessage.TypeNS, u.Addr)
+	if err == nil && res.RCode != dnsmessage.RCodeSuccess {
+		err = errors.New(res.RCode.String())
+	}
+	u.report(time.Since(start), err, f.failThreshold)
+}
+
+// try healthy upstreams in order, fall back to the unhealthy ones when
+// none are left
+func (f *forwarder) forward(q dnsmessage.Question) (dnsmessage.Message, error) {
+	var healthy, unhealthy []*upstream
+	for _, u := range f.upstreams {
+		if u.isHealthy() {
+			healthy = append(healthy, u)
+		} else {
+			unhealthy = append(unhealthy, u)
+		}
+	}
+
+	lastErr := errors.New("no upstreams configured")
+	for _, u := range append(healthy, unhealthy...) {
+		start := time.Now()
+		res, err := client.Query(q.Name.String(), q.Type, u.Addr)
+		if err == nil && res.RCode == dnsmessage.RCodeServerFailure {
+			err = errors.New("upstream returned SERVFAIL")
+		}
+		u.report(time.Since(start), err, f.failThreshold)
+		if err == nil {
+			return res, nil
+		}
+		lastErr = err
+	}
+	return dnsmessage.Message{}, lastErr
+}
+
+func (f *forwarder) status() []upstreamStatus {
+	statuses := make([]upstreamStatus, len(f.upstreams))
+	for i, u := range f.upstreams {
+		statuses[i] = u.status()
+	}
+	return statuses
+}
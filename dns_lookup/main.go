@@ -1,201 +1,278 @@
 package main
 
 import (
+	"flag"
 	"fmt"
-	"math/rand"
-	"net"
+	"net/url"
+	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
 	"golang.org/x/net/dns/dnsmessage"
+
+	"internet_services/dns_lookup/resolver"
 )
 
-var rootServers = map[string]string{
-	"a.root-servers.net": "198.41.0.4",
-	"b.root-servers.net": "192.228.79.201",
-	"c.root-servers.net": "192.33.4.12",
-	"d.root-servers.net": "128.8.10.90",
-	"e.root-servers.net": "192.203.230.10",
-	"f.root-servers.net": "192.5.5.241",
-	"g.root-servers.net": "192.112.36.4",
-	"h.root-servers.net": "128.63.2.53",
-	"i.root-servers.net": "192.36.148.17",
-	"j.root-servers.net": "192.58.128.30",
-	"k.root-servers.net": "193.0.14.129",
-	"l.root-servers.net": "199.7.83.42",
-	"m.root-servers.net": "202.12.27.33",
-}
+// settings and counters of every query the tool sends
+var client = resolver.New()
 
 func main() {
-	domain := "example.com." // trailing . for lookup
-
-	fmt.Println("Loading root server list:")
-	for name, ip := range rootServers {
-		fmt.Printf("-> %s (%s)\n", name, ip)
-	}
-
-	// random root server
-	rootNames := make([]string, 0, len(rootServers))
-	for name, _ := range rootServers {
-		rootNames = append(rootNames, name)
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "enum":
+			runEnum(os.Args[2:])
+			return
+		case "caa":
+			runCAA(os.Args[2:])
+			return
+		case "axfr":
+			runAXFR(os.Args[2:])
+			return
+		}
 	}
-	rootName := rootNames[rand.Intn(len(rootNames))]
-
-	fmt.Printf("\nStarting recursive lookup for %s\n", domain)
-	recursiveLookup(domain, rootName, rootServers[rootName])
-}
 
-func recursiveLookup(domain, firstServerName string, firstServerIP string) {
-	triedServers := map[string]bool{}
-	serverName, serverIP := firstServerName, firstServerIP
+	hostname, _ := os.Hostname()
+
+	server := flag.String("server", "", "query this server directly instead of iterating from the root servers")
+	transport := flag.String("transport", "udp", "transport to reach name servers: udp, tcp, dot or doh")
+	proxyAddr := flag.String("proxy", "", "route tcp/dot/doh through a proxy, eg. socks5h://127.0.0.1:9050 (tor) or http://host:3128")
+	qtypeName := flag.String("type", "A", "record type to look up, eg. A, AAAA, MX, TXT")
+	qclassName := flag.String("class", "IN", "query class: IN, or CH for version.bind style queries (needs -server)")
+	serveAddr := flag.String("serve", "", "run as a DNS server on this address, eg. 127.0.0.1:5353")
+	flag.StringVar(&chaosVersion, "chaos-version", "dns_lookup", "server mode: answer for version.bind CH TXT queries, empty to refuse")
+	flag.StringVar(&chaosID, "chaos-id", hostname, "server mode: answer for hostname.bind/id.server CH TXT queries, empty to refuse")
+	flag.BoolVar(&rotateAnswers, "rotate", false, "server mode: round-robin A/AAAA answers served from the cache")
+	forwardTo := flag.String("forward", "", "server mode: comma separated upstream resolvers to forward to instead of iterating")
+	filterGroups := flag.String("filter", "", "server mode: filtering upstream per client group, eg. 192.168.1.0/24=family,0.0.0.0/0=malware (categories: malware, security, adult, family, none)")
+	filterOverrides := flag.String("filter-overrides", "", "server mode: file with \"category allow|block domain\" lines")
+	healthInterval := flag.Duration("health-interval", 10*time.Second, "forwarder mode: how often upstreams are probed")
+	statusAddr := flag.String("status", "", "server mode: serve the status page and JSON API on this address, eg. 127.0.0.1:8053")
+	dnstapPath := flag.String("dnstap", "", "write queries and responses to this file in dnstap format")
+	queryLogPath := flag.String("querylog", "", "server mode: append a text line per client query to this file")
+	queryLogSize := flag.Int64("querylog-size", 10, "rotate the query log after this many MB")
+	queryLogKeep := flag.Int("querylog-keep", 3, "number of rotated query logs to keep")
+	flag.StringVar(&client.UDPSockets, "udp-sockets", resolver.UDPDial, "udp socket handling: dial (new socket per query), pool (reuse per server) or shared (one unconnected socket)")
+	maxOutbound := flag.Int("max-outbound", 256, "maximum queries in flight to all name servers, 0 for no limit")
+	maxPerServer := flag.Int("max-per-server", 16, "maximum queries in flight to a single name server, 0 for no limit")
+	flag.BoolVar(&client.DNSSEC, "dnssec", false, "request DNSSEC records (EDNS0 DO bit) and explain NSEC/NSEC3 denials")
+	flag.BoolVar(&zoneOutput, "zonefile", false, "print answers in zone file (RFC 1035 master file) syntax")
+	showStats := flag.Bool("stats", false, "print resolver statistics after the lookup")
+	flag.Parse()
 
-	for {
-		triedServers[serverIP] = true
+	domain := "example.com." // trailing . for lookup
+	if flag.NArg() > 0 {
+		domain = strings.TrimSuffix(flag.Arg(0), ".") + "."
+	}
 
-		fmt.Printf("\nSending request to %s (%s)\n", serverName, serverIP)
+	qtype, err := parseType(*qtypeName)
+	if err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+	qclass, err := parseClass(*qclassName)
+	if err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
 
-		res, err := queryDNS(domain, serverIP)
+	client.Transport = *transport
+	client.SetLimits(*maxOutbound, *maxPerServer)
+	if *proxyAddr != "" {
+		u, err := url.Parse(*proxyAddr)
 		if err != nil {
+			fmt.Println("Invalid proxy:", err)
+			os.Exit(1)
+		}
+		client.Proxy = u
+	}
+	if err := client.Check(); err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+	for _, addr := range append(strings.Split(*forwardTo, ","), *server) {
+		if err := resolver.CheckZone(addr); err != nil {
 			fmt.Println("Error:", err)
+			os.Exit(1)
+		}
+	}
 
-			newServerName, newServerIP := pickNewRootServer(triedServers)
-			if newServerIP == "" {
-				fmt.Println("No more root servers available. Stopping.")
-				return
-			}
+	if *dnstapPath != "" {
+		if tap, err = newDnstapWriter(*dnstapPath); err != nil {
+			fmt.Println("Failed to open dnstap file:", err)
+			os.Exit(1)
+		}
+		defer tap.Close()
+		client.OnExchange = func(server string, query []byte, sent time.Time, response []byte, received time.Time) {
+			tap.logExchange(dnstapResolverQuery, dnstapProtocol(), server, query, sent, response, received)
+		}
+	}
 
-			fmt.Printf("Retrying with a new root server: %s (%s)\n", newServerName, newServerIP)
-			serverName, serverIP = newServerName, newServerIP
-			continue
+	if *serveAddr != "" {
+		client.CacheStats = func() (uint64, uint64) {
+			_, hits, misses := cache.stats()
+			return hits, misses
+		}
+		if *queryLogPath != "" {
+			if queryLog, err = newRotatingLog(*queryLogPath, *queryLogSize<<20, *queryLogKeep); err != nil {
+				fmt.Println("Failed to open query log:", err)
+				os.Exit(1)
+			}
 		}
 
-		// response is authoritative ?
-		if res.Authoritative {
-			fmt.Println("\nReceived authoritative (AA) response:")
-			for _, answer := range res.Answers {
-				if answer.Header.Type == dnsmessage.TypeA {
-					ip := net.IP(answer.Body.(*dnsmessage.AResource).A[:])
-					fmt.Printf("-> Answer: A-record for %s = %v\n", domain, ip)
-				} else if answer.Header.Type == dnsmessage.TypeAAAA {
-					ip := net.IP(answer.Body.(*dnsmessage.AAAAResource).AAAA[:])
-					fmt.Printf("-> Answer: AAAA-record for %s = %v\n", domain, ip)
+		if *forwardTo != "" {
+			client.RecursionDesired = true
+			fwd = newForwarder(strings.Split(*forwardTo, ","), *healthInterval)
+			go fwd.checkHealth()
+		}
+		if *filterGroups != "" {
+			if filters, err = parseClientGroups(*filterGroups, *healthInterval); err != nil {
+				fmt.Println("Error:", err)
+				os.Exit(1)
+			}
+			if *filterOverrides != "" {
+				if err := filters.loadOverrides(*filterOverrides); err != nil {
+					fmt.Println("Failed to read filter overrides:", err)
+					os.Exit(1)
 				}
 			}
-			return
+			client.RecursionDesired = true
+			filters.checkHealth()
 		}
-
-		// next nameservers
-		nextServers := getNextServers(res)
-		if len(nextServers) == 0 {
-			fmt.Println("No more name servers found, stopping.")
-			return
+		if *statusAddr != "" {
+			go func() {
+				if err := serveStatus(*statusAddr); err != nil {
+					fmt.Println("Status endpoint failed:", err)
+				}
+			}()
 		}
 
-		// resolve ns names to ips
-		serverName, serverIP = resolveNS(nextServers)
-		if serverIP == "" {
-			fmt.Println("Failed to resolve next NS IP, stopping.")
-			return
+		// flush the dnstap stream and query log on ctrl-c
+		go func() {
+			sig := make(chan os.Signal, 1)
+			signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+			<-sig
+			if tap != nil {
+				tap.Close()
+			}
+			if queryLog != nil {
+				queryLog.Close()
+			}
+			os.Exit(0)
+		}()
+
+		if err := serve(*serveAddr); err != nil {
+			fmt.Println("Error:", err)
+			os.Exit(1)
 		}
+		return
 	}
-}
 
-func pickNewRootServer(tried map[string]bool) (string, string) {
-	for name, ip := range rootServers {
-		if !tried[ip] {
-			return name, ip
+	client.Trace = os.Stdout
+	if *server != "" {
+		directLookup(domain, qtype, qclass, *server)
+		if *showStats {
+			printStats(client.Stats())
 		}
+		return
 	}
-	return "", ""
-}
-
-func queryDNS(domain, server string) (dnsmessage.Message, error) {
-
-	dialer := net.Dialer{Timeout: 3 * time.Second}
-
-	conn, err := dialer.Dial("udp", server+":53")
-	if err != nil {
-		return dnsmessage.Message{}, fmt.Errorf("timeout or connection error: %w", err)
+	if qclass != dnsmessage.ClassINET {
+		fmt.Println("Error: only class IN can be looked up from the root servers, use -server")
+		os.Exit(1)
 	}
-	defer conn.Close()
-
-	msg := dnsmessage.Message{
-		Header: dnsmessage.Header{ID: 1, RecursionDesired: false},
-		Questions: []dnsmessage.Question{
-			{Name: dnsmessage.MustNewName(domain), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET},
-		},
+	if client.Transport == "dot" || client.Transport == "doh" {
+		fmt.Println("Error: root servers don't offer dot/doh, use -server with a resolver that does")
+		os.Exit(1)
 	}
-
-	query, err := msg.Pack()
-	if err != nil {
-		return dnsmessage.Message{}, err
+	fmt.Println("Loading root server list:")
+	for name, ip := range resolver.RootServers {
+		fmt.Printf("-> %s (%s)\n", name, ip)
 	}
 
-	conn.SetWriteDeadline(time.Now().Add(3 * time.Second))
-	_, err = conn.Write(query)
-	if err != nil {
-		return dnsmessage.Message{}, fmt.Errorf("timeout or write error: %w", err)
+	fmt.Printf("\nStarting recursive lookup for %s\n", domain)
+	recursiveLookup(domain, qtype)
+	if *showStats {
+		printStats(client.Stats())
 	}
+}
 
-	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
-	response := make([]byte, 512)
-	n, err := conn.Read(response)
-	if err != nil {
-		return dnsmessage.Message{}, fmt.Errorf("timeout or read error: %w", err)
+func printStats(stats resolver.Stats) {
+	fmt.Println("\nResolver statistics:")
+	fmt.Printf("-> queries sent: %d, retries: %d, errors: %d\n", stats.QueriesSent, stats.Retries, stats.Errors)
+	fmt.Printf("-> bytes sent: %d, bytes received: %d\n", stats.BytesSent, stats.BytesReceived)
+	if stats.Throttled > 0 {
+		fmt.Printf("-> throttled by concurrency limit: %d\n", stats.Throttled)
+	}
+	for server, n := range stats.Timeouts {
+		fmt.Printf("-> timeouts from %s: %d\n", server, n)
 	}
+}
 
-	var res dnsmessage.Message
-	err = res.Unpack(response[:n])
+func recursiveLookup(domain string, qtype dnsmessage.Type) {
+	res, err := client.Iterate(domain, qtype)
 	if err != nil {
-		return dnsmessage.Message{}, err
+		fmt.Printf("%v, stopping.\n", err)
+		return
+	}
+	if qtype == dnsmessage.TypeALL {
+		res = anyFallback(res, func(t dnsmessage.Type) (dnsmessage.Message, error) {
+			return client.Iterate(domain, t)
+		})
 	}
 
-	return res, nil
+	fmt.Println("\nReceived authoritative (AA) response:")
+	printAnswers(res)
+	printDenial(domain, qtype, res)
 }
 
-func getNextServers(res dnsmessage.Message) []string {
-	servers := []string{}
-	var referralDomain string
-	for _, ns := range res.Authorities {
-		if ns.Header.Type == dnsmessage.TypeNS {
-			nsName := ns.Body.(*dnsmessage.NSResource).NS.String()
-			servers = append(servers, nsName)
-
-			referralDomain = ns.Header.Name.String()
-		}
+// progress output of the lookup, on the client's Trace writer
+func tracef(format string, args ...any) {
+	if client.Trace != nil {
+		fmt.Fprintf(client.Trace, format, args...)
 	}
+}
 
-	if referralDomain == "" {
-		referralDomain = "(unknown domain)"
-	}
+// ask a single (usually recursive) server for the answer
+func directLookup(domain string, qtype dnsmessage.Type, qclass dnsmessage.Class, server string) {
+	client.RecursionDesired = qclass == dnsmessage.ClassINET
 
-	// check if additional resolved ips
-	resolvedIPs := map[string]string{}
-	for _, extra := range res.Additionals {
-		if extra.Header.Type == dnsmessage.TypeA {
-			resolvedIPs[extra.Header.Name.String()] = net.IP(extra.Body.(*dnsmessage.AResource).A[:]).String()
-		}
+	fmt.Printf("\nSending request to %s over %s\n", server, client.Transport)
+	res, err := client.QueryClass(domain, qtype, qclass, server)
+	if err != nil {
+		fmt.Println("Error:", err)
+		return
 	}
-
-	fmt.Println("\nReceived referral response - DNS servers for domain:", referralDomain)
-	for _, ns := range servers {
-		if ip, exists := resolvedIPs[ns]; exists {
-			fmt.Printf("-> %s (%s)\n", ns, ip)
-		} else {
-			fmt.Printf("-> %s (no IP address)\n", ns)
-		}
+	if qtype == dnsmessage.TypeALL {
+		res = anyFallback(res, func(t dnsmessage.Type) (dnsmessage.Message, error) {
+			return client.QueryClass(domain, t, qclass, server)
+		})
 	}
 
-	return servers
+	fmt.Printf("\nReceived response (%s):\n", res.RCode)
+	printAnswers(res)
+	printDenial(domain, qtype, res)
 }
 
-func resolveNS(servers []string) (string, string) {
-	for _, ns := range servers {
-		ip, err := net.LookupHost(strings.TrimSuffix(ns, ".")) // trailing dot
-		if err == nil && len(ip) > 0 {
-			fmt.Printf("\nResolved DNS server name %s to IP %s\n", ns, ip[0])
-			return ns, ip[0]
-		}
+func printAnswers(res dnsmessage.Message) {
+	if zoneOutput {
+		writeZoneFile(os.Stdout, "", res.Answers)
+		return
+	}
+	for _, answer := range res.Answers {
+		fmt.Printf("-> Answer: %s-record for %s = %s\n", typeName(answer.Header.Type), answer.Header.Name, rdataString(answer.Body))
+	}
+}
+
+// explain NSEC/NSEC3 proofs of negative answers when DNSSEC is on
+func printDenial(domain string, qtype dnsmessage.Type, res dnsmessage.Message) {
+	if !client.DNSSEC || (res.RCode != dnsmessage.RCodeNameError && len(res.Answers) > 0) {
+		return
+	}
+
+	lines, _ := explainDenial(domain, qtype, res)
+	fmt.Println("\nDenial of existence:")
+	for _, line := range lines {
+		fmt.Println("->", line)
 	}
-	return "", ""
 }
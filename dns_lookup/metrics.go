@@ -0,0 +1,123 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// counters collected in server mode for the status page
+type serverMetrics struct {
+	mu       sync.Mutex
+	started  time.Time
+	queries  uint64
+	perSec   [60]uint64 // queries per second over the last minute, indexed by unix second
+	secStamp [60]int64
+	domains  map[string]uint64
+	errors   []recentError
+}
+
+type recentError struct {
+	Time  time.Time `json:"time"`
+	Query string    `json:"query"`
+	Error string    `json:"error"`
+}
+
+type domainCount struct {
+	Domain string `json:"domain"`
+	Count  uint64 `json:"count"`
+}
+
+const (
+	maxTrackedDomains = 10000
+	maxRecentErrors   = 20
+)
+
+var metrics = &serverMetrics{started: time.Now(), domains: map[string]uint64{}}
+
+func (m *serverMetrics) countQuery(domain string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.queries++
+
+	now := time.Now().Unix()
+	slot := now % 60
+	if m.secStamp[slot] != now {
+		m.secStamp[slot], m.perSec[slot] = now, 0
+	}
+	m.perSec[slot]++
+
+	domain = strings.ToLower(domain)
+	if _, ok := m.domains[domain]; ok || len(m.domains) < maxTrackedDomains {
+		m.domains[domain]++
+	}
+}
+
+func (m *serverMetrics) countError(query string, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.errors = append(m.errors, recentError{Time: time.Now(), Query: query, Error: err.Error()})
+	if len(m.errors) > maxRecentErrors {
+		m.errors = m.errors[len(m.errors)-maxRecentErrors:]
+	}
+}
+
+// average queries per second over the last minute
+func (m *serverMetrics) qps() float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now().Unix()
+	var total uint64
+	for i, stamp := range m.secStamp {
+		if now-stamp < 60 {
+			total += m.perSec[i]
+		}
+	}
+	window := min(time.Since(m.started).Seconds(), 60)
+	if window < 1 {
+		window = 1
+	}
+	return float64(total) / window
+}
+
+func (m *serverMetrics) topDomains(n int) []domainCount {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	top := make([]domainCount, 0, len(m.domains))
+	for domain, count := range m.domains {
+		top = append(top, domainCount{domain, count})
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Count != top[j].Count {
+			return top[i].Count > top[j].Count
+		}
+		return top[i].Domain < top[j].Domain
+	})
+	if len(top) > n {
+		top = top[:n]
+	}
+	return top
+}
+
+func (m *serverMetrics) recentErrors() []recentError {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	recent := make([]recentError, len(m.errors))
+	// newest first
+	for i, e := range m.errors {
+		recent[len(m.errors)-1-i] = e
+	}
+	return recent
+}
+
+func (m *serverMetrics) totals() (queries uint64, uptime time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.queries, time.Since(m.started)
+}
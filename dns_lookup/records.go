@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// types dnsmessage has no constant for
+const typeHINFO dnsmessage.Type = 13
+
+var typeNames = map[string]dnsmessage.Type{
+	"A":     dnsmessage.TypeA,
+	"NS":    dnsmessage.TypeNS,
+	"CNAME": dnsmessage.TypeCNAME,
+	"SOA":   dnsmessage.TypeSOA,
+	"PTR":   dnsmessage.TypePTR,
+	"MX":    dnsmessage.TypeMX,
+	"TXT":   dnsmessage.TypeTXT,
+	"AAAA":  dnsmessage.TypeAAAA,
+	"HINFO": typeHINFO,
+	"SRV":   dnsmessage.TypeSRV,
+	"CAA":   typeCAA,
+	"ANY":   dnsmessage.TypeALL,
+
+	"DS":         typeDS,
+	"RRSIG":      typeRRSIG,
+	"NSEC":       typeNSEC,
+	"DNSKEY":     typeDNSKEY,
+	"NSEC3":      typeNSEC3,
+	"NSEC3PARAM": typeNSEC3PARAM,
+}
+
+var classNames = map[string]dnsmessage.Class{
+	"IN": dnsmessage.ClassINET,
+	"CH": dnsmessage.ClassCHAOS,
+	"HS": dnsmessage.ClassHESIOD,
+}
+
+// type from its mnemonic or the RFC 3597 TYPEnnn form
+func parseType(s string) (dnsmessage.Type, error) {
+	s = strings.ToUpper(s)
+	if t, ok := typeNames[s]; ok {
+		return t, nil
+	}
+	if n, err := strconv.ParseUint(strings.TrimPrefix(s, "TYPE"), 10, 16); err == nil && strings.HasPrefix(s, "TYPE") {
+		return dnsmessage.Type(n), nil
+	}
+	return 0, fmt.Errorf("unknown record type %q", s)
+}
+
+func parseClass(s string) (dnsmessage.Class, error) {
+	s = strings.ToUpper(s)
+	if c, ok := classNames[s]; ok {
+		return c, nil
+	}
+	return 0, fmt.Errorf("unknown class %q (want IN, CH or HS)", s)
+}
+
+func typeName(t dnsmessage.Type) string {
+	for name, known := range typeNames {
+		if known == t {
+			return name
+		}
+	}
+	return fmt.Sprintf("TYPE%d", t)
+}
+
+func className(c dnsmessage.Class) string {
+	for name, known := range classNames {
+		if known == c {
+			return name
+		}
+	}
+	return fmt.Sprintf("CLASS%d", c)
+}
+
+// record data in master file presentation format
+func rdataString(body dnsmessage.ResourceBody) string {
+	switch b := body.(type) {
+	case *dnsmessage.AResource:
+		return net.IP(b.A[:]).String()
+	case *dnsmessage.AAAAResource:
+		return net.IP(b.AAAA[:]).String()
+	case *dnsmessage.NSResource:
+		return b.NS.String()
+	case *dnsmessage.CNAMEResource:
+		return b.CNAME.String()
+	case *dnsmessage.PTRResource:
+		return b.PTR.String()
+	case *dnsmessage.MXResource:
+		return fmt.Sprintf("%d %s", b.Pref, b.MX)
+	case *dnsmessage.SRVResource:
+		return fmt.Sprintf("%d %d %d %s", b.Priority, b.Weight, b.Port, b.Target)
+	case *dnsmessage.SOAResource:
+		return fmt.Sprintf("%s %s %d %d %d %d %d", b.NS, b.MBox, b.Serial, b.Refresh, b.Retry, b.Expire, b.MinTTL)
+	case *dnsmessage.TXTResource:
+		return quoteAll(b.TXT)
+	case *dnsmessage.UnknownResource:
+		switch b.Type {
+		case typeHINFO:
+			return quoteAll(characterStrings(b.Data))
+		case typeCAA:
+			if caa, err := parseCAA(b.Data); err == nil {
+				return caa.String()
+			}
+		case typeNSEC:
+			if n, err := parseNSEC("", b.Data); err == nil {
+				return strings.TrimSpace(n.next + " " + typeList(n.types))
+			}
+		case typeNSEC3:
+			if n, err := parseNSEC3("", b.Data); err == nil {
+				flags := 0
+				if n.optOut {
+					flags = 1
+				}
+				return strings.TrimSpace(fmt.Sprintf("%d %d %d %s %s %s",
+					n.hashAlg, flags, n.iterations, saltString(n.salt), strings.ToUpper(n.nextHash), typeList(n.types)))
+			}
+		}
+		// RFC 3597 generic form
+		return fmt.Sprintf("\\# %d %s", len(b.Data), hex.EncodeToString(b.Data))
+	}
+	return "(unsupported)"
+}
+
+func quoteAll(strs []string) string {
+	quoted := make([]string, len(strs))
+	for i, str := range strs {
+		quoted[i] = strconv.Quote(str)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// split rdata made of length prefixed <character-string>s
+func characterStrings(data []byte) []string {
+	var strs []string
+	for len(data) > 0 {
+		n := int(data[0])
+		if 1+n > len(data) {
+			break
+		}
+		strs = append(strs, string(data[1:1+n]))
+		data = data[1+n:]
+	}
+	return strs
+}
@@ -0,0 +1,76 @@
+package resolver
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// TransferZone fetches zone from server with an RFC 5936 zone transfer over
+// tcp. The closing repeat of the SOA record is left out.
+func (c *Client) TransferZone(zone, server string) ([]dnsmessage.Resource, error) {
+	name, err := dnsmessage.NewName(zone)
+	if err != nil {
+		return nil, err
+	}
+	msg := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: uint16(rand.Intn(1 << 16))},
+		Questions: []dnsmessage.Question{{Name: name, Type: dnsmessage.TypeAXFR, Class: dnsmessage.ClassINET}},
+	}
+	packed, err := msg.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := c.dial(withPort(server, c.Port))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(c.Timeout))
+	if err := writeFrame(conn, packed); err != nil {
+		return nil, err
+	}
+
+	var records []dnsmessage.Resource
+	soas := 0
+	for soas < 2 {
+		// the deadline is per message, large zones take a while
+		conn.SetDeadline(time.Now().Add(c.Timeout))
+		response, err := readFrame(conn)
+		if err != nil {
+			return nil, err
+		}
+
+		var res dnsmessage.Message
+		if err := res.Unpack(response); err != nil {
+			return nil, err
+		}
+		if res.ID != msg.ID {
+			return nil, fmt.Errorf("response ID %d does not match query ID %d", res.ID, msg.ID)
+		}
+		if res.RCode != dnsmessage.RCodeSuccess {
+			return nil, fmt.Errorf("server answered %s", res.RCode)
+		}
+		if len(res.Answers) == 0 {
+			return nil, errors.New("empty transfer message")
+		}
+		if len(records) == 0 && res.Answers[0].Header.Type != dnsmessage.TypeSOA {
+			return nil, errors.New("transfer does not start with the SOA record")
+		}
+
+		for _, rr := range res.Answers {
+			if rr.Header.Type == dnsmessage.TypeSOA {
+				if soas++; soas == 2 {
+					break // closing SOA, not part of the zone twice
+				}
+			}
+			records = append(records, rr)
+		}
+	}
+	return records, nil
+}
@@ -0,0 +1,83 @@
+package resolver
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var errThrottled = errors.New("too many outstanding queries")
+
+// caps the queries in flight, overall and towards each server, so a burst of
+// clients can't flood a small authoritative server or run out of local ports
+type queryLimiter struct {
+	global       chan struct{} // nil when unlimited
+	maxPerServer int           // 0 when unlimited
+
+	mu      sync.Mutex
+	servers map[string]*serverSlots
+}
+
+type serverSlots struct {
+	slots chan struct{}
+	users int // waiting or holding a slot, the entry goes away at 0
+}
+
+func newQueryLimiter(global, perServer int) *queryLimiter {
+	l := &queryLimiter{maxPerServer: max(perServer, 0), servers: map[string]*serverSlots{}}
+	if global > 0 {
+		l.global = make(chan struct{}, global)
+	}
+	return l
+}
+
+// wait up to timeout for a slot, release must be called once the exchange is done
+func (l *queryLimiter) acquire(server string, timeout time.Duration) (release func(), err error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	if l.global != nil {
+		select {
+		case l.global <- struct{}{}:
+		case <-timer.C:
+			return nil, errThrottled
+		}
+	}
+	releaseGlobal := func() {
+		if l.global != nil {
+			<-l.global
+		}
+	}
+	if l.maxPerServer == 0 {
+		return releaseGlobal, nil
+	}
+
+	l.mu.Lock()
+	s := l.servers[server]
+	if s == nil {
+		s = &serverSlots{slots: make(chan struct{}, l.maxPerServer)}
+		l.servers[server] = s
+	}
+	s.users++
+	l.mu.Unlock()
+
+	done := func() {
+		l.mu.Lock()
+		if s.users--; s.users == 0 {
+			delete(l.servers, server)
+		}
+		l.mu.Unlock()
+		releaseGlobal()
+	}
+
+	select {
+	case s.slots <- struct{}{}:
+		return func() {
+			<-s.slots
+			done()
+		}, nil
+	case <-timer.C:
+		done()
+		return nil, errThrottled
+	}
+}
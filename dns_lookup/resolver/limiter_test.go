@@ -0,0 +1,26 @@
+package resolver
+
+import (
+	"testing"
+	"time"
+)
+
+func TestQueryLimiterPerServer(t *testing.T) {
+	limiter := newQueryLimiter(0, 1)
+	release, err := limiter.acquire("127.0.0.4", time.Second)
+	if err != nil {
+		t.Fatalf("first slot: %v", err)
+	}
+	if _, err := limiter.acquire("127.0.0.4", 50*time.Millisecond); err != errThrottled {
+		t.Errorf("second query to a busy server: %v", err)
+	}
+	other, err := limiter.acquire("127.0.0.3", 50*time.Millisecond)
+	if err != nil {
+		t.Fatalf("other server blocked: %v", err)
+	}
+	other()
+	release()
+	if len(limiter.servers) != 0 {
+		t.Errorf("%d idle servers still tracked", len(limiter.servers))
+	}
+}
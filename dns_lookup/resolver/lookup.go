@@ -0,0 +1,280 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// the lookup methods mirror those of net.Resolver: names come back
+// absolute, failures as *net.DNSError with IsNotFound set for names that
+// don't exist or have no records of the type
+
+// longest CNAME chain followed
+const maxCNAMEs = 8
+
+// Lookup returns the records of qtype for name, following CNAMEs. It asks
+// Server when one is set and iterates from the roots otherwise.
+func (c *Client) Lookup(ctx context.Context, name string, qtype dnsmessage.Type) ([]dnsmessage.Resource, error) {
+	records, _, err := c.lookup(ctx, name, qtype)
+	return records, err
+}
+
+// LookupTXT returns the TXT records of name, the strings of each record
+// joined.
+func (c *Client) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	records, _, err := c.lookup(ctx, name, dnsmessage.TypeTXT)
+	if err != nil {
+		return nil, err
+	}
+	txts := make([]string, 0, len(records))
+	for _, rr := range records {
+		txts = append(txts, strings.Join(rr.Body.(*dnsmessage.TXTResource).TXT, ""))
+	}
+	return txts, nil
+}
+
+// LookupMX returns the MX records of name sorted by preference.
+func (c *Client) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	records, _, err := c.lookup(ctx, name, dnsmessage.TypeMX)
+	if err != nil {
+		return nil, err
+	}
+	mxs := make([]*net.MX, 0, len(records))
+	for _, rr := range records {
+		body := rr.Body.(*dnsmessage.MXResource)
+		mxs = append(mxs, &net.MX{Host: body.MX.String(), Pref: body.Pref})
+	}
+	sort.SliceStable(mxs, func(i, j int) bool { return mxs[i].Pref < mxs[j].Pref })
+	return mxs, nil
+}
+
+// LookupNetIP returns the addresses of host, network is "ip", "ip4" or
+// "ip6". An IP address is returned as is.
+func (c *Client) LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	var qtypes []dnsmessage.Type
+	switch network {
+	case "ip":
+		qtypes = []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA}
+	case "ip4":
+		qtypes = []dnsmessage.Type{dnsmessage.TypeA}
+	case "ip6":
+		qtypes = []dnsmessage.Type{dnsmessage.TypeAAAA}
+	default:
+		return nil, &net.AddrError{Err: "unknown network", Addr: network}
+	}
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return []netip.Addr{addr}, nil
+	}
+
+	var addrs []netip.Addr
+	var notFound error
+	for _, qtype := range qtypes {
+		records, _, err := c.lookup(ctx, host, qtype)
+		if isNotFound(err) {
+			notFound = err
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, rr := range records {
+			if addr, ok := recordAddr(rr); ok {
+				addrs = append(addrs, addr)
+			}
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, notFound
+	}
+	return addrs, nil
+}
+
+// LookupIP returns the addresses of host, network is "ip", "ip4" or "ip6".
+func (c *Client) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	addrs, err := c.LookupNetIP(ctx, network, host)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, len(addrs))
+	for i, addr := range addrs {
+		ips[i] = addr.AsSlice()
+	}
+	return ips, nil
+}
+
+// LookupIPAddr returns the IPv4 and IPv6 addresses of host.
+func (c *Client) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	addrs, err := c.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil, err
+	}
+	ipAddrs := make([]net.IPAddr, len(addrs))
+	for i, addr := range addrs {
+		ipAddrs[i] = net.IPAddr{IP: addr.AsSlice(), Zone: addr.Zone()}
+	}
+	return ipAddrs, nil
+}
+
+// LookupHost returns the addresses of host as strings.
+func (c *Client) LookupHost(ctx context.Context, host string) ([]string, error) {
+	addrs, err := c.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil, err
+	}
+	hosts := make([]string, len(addrs))
+	for i, addr := range addrs {
+		hosts[i] = addr.String()
+	}
+	return hosts, nil
+}
+
+// LookupAddr returns the names an address points back to (PTR records).
+func (c *Client) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		return nil, &net.DNSError{Err: "unrecognized address", Name: addr}
+	}
+	records, _, err := c.lookup(ctx, reverseName(ip), dnsmessage.TypePTR)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(records))
+	for _, rr := range records {
+		names = append(names, rr.Body.(*dnsmessage.PTRResource).PTR.String())
+	}
+	return names, nil
+}
+
+// LookupCNAME returns the canonical name of host, the end of its CNAME
+// chain, or host itself when it is no alias.
+func (c *Client) LookupCNAME(ctx context.Context, host string) (string, error) {
+	_, name, err := c.lookup(ctx, host, dnsmessage.TypeA)
+	if name != "" {
+		// a name without addresses still has a canonical name
+		return name, nil
+	}
+	return "", err
+}
+
+// the in-addr.arpa or ip6.arpa name of addr
+func reverseName(addr netip.Addr) string {
+	addr = addr.Unmap()
+	if addr.Is4() {
+		b := addr.As4()
+		return fmt.Sprintf("%d.%d.%d.%d.in-addr.arpa.", b[3], b[2], b[1], b[0])
+	}
+	const hex = "0123456789abcdef"
+	b := addr.As16()
+	var name strings.Builder
+	for i := len(b) - 1; i >= 0; i-- {
+		name.WriteByte(hex[b[i]&0xf])
+		name.WriteByte('.')
+		name.WriteByte(hex[b[i]>>4])
+		name.WriteByte('.')
+	}
+	name.WriteString("ip6.arpa.")
+	return name.String()
+}
+
+// records of qtype for host, and the name they belong to at the end of
+// the CNAME chain. The name is also returned when it exists without
+// records of the type.
+func (c *Client) lookup(ctx context.Context, host string, qtype dnsmessage.Type) ([]dnsmessage.Resource, string, error) {
+	name := strings.TrimSuffix(host, ".") + "."
+	var res dnsmessage.Message
+	var answered string // the name res is the answer for
+
+	// a recursive server answers with the whole chain, an authoritative one
+	// only with the links in its own zone
+	for range 2 * maxCNAMEs {
+		if records := answersFor(res, name, qtype); len(records) > 0 {
+			return records, name, nil
+		}
+		if target := cnameTarget(res, name); target != "" && qtype != dnsmessage.TypeCNAME {
+			name = target
+			continue
+		}
+		if answered == name {
+			return nil, name, &net.DNSError{Err: "no such host", Name: host, Server: c.Server, IsNotFound: true}
+		}
+
+		var err error
+		if res, err = c.resolve(ctx, name, qtype); err != nil {
+			return nil, "", c.dnsError(host, err)
+		}
+		answered = name
+
+		switch res.RCode {
+		case dnsmessage.RCodeSuccess:
+		case dnsmessage.RCodeNameError:
+			return nil, "", &net.DNSError{Err: "no such host", Name: host, Server: c.Server, IsNotFound: true}
+		default:
+			return nil, "", &net.DNSError{Err: "server misbehaving: " + res.RCode.String(), Name: host, Server: c.Server, IsTemporary: true}
+		}
+	}
+	return nil, "", &net.DNSError{Err: "too many CNAMEs", Name: host, Server: c.Server}
+}
+
+// one query for name, abandoned when ctx is done
+func (c *Client) resolve(ctx context.Context, name string, qtype dnsmessage.Type) (dnsmessage.Message, error) {
+	type result struct {
+		res dnsmessage.Message
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		var r result
+		if c.Server != "" {
+			recursive := *c
+			recursive.RecursionDesired = true
+			r.res, r.err = recursive.Query(name, qtype, c.Server)
+		} else {
+			r.res, r.err = c.Iterate(name, qtype)
+		}
+		done <- r
+	}()
+
+	select {
+	case r := <-done:
+		return r.res, r.err
+	case <-ctx.Done():
+		return dnsmessage.Message{}, ctx.Err()
+	}
+}
+
+func (c *Client) dnsError(name string, err error) *net.DNSError {
+	var netErr net.Error
+	timeout := errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout())
+	return &net.DNSError{Err: err.Error(), UnwrapErr: err, Name: name, Server: c.Server, IsTimeout: timeout, IsTemporary: timeout}
+}
+
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
+
+func answersFor(res dnsmessage.Message, name string, qtype dnsmessage.Type) []dnsmessage.Resource {
+	var records []dnsmessage.Resource
+	for _, rr := range res.Answers {
+		if rr.Header.Type == qtype && strings.EqualFold(rr.Header.Name.String(), name) {
+			records = append(records, rr)
+		}
+	}
+	return records
+}
+
+func cnameTarget(res dnsmessage.Message, name string) string {
+	for _, rr := range res.Answers {
+		if body, ok := rr.Body.(*dnsmessage.CNAMEResource); ok && strings.EqualFold(rr.Header.Name.String(), name) {
+			return body.CNAME.String()
+		}
+	}
+	return ""
+}
@@ -0,0 +1,112 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLookup(t *testing.T) {
+	c := startHierarchy(t)
+	ctx := context.Background()
+
+	txts, err := c.LookupTXT(ctx, "www.example.com")
+	if err != nil || len(txts) != 1 || txts[0] != "v=spf1 -all" {
+		t.Errorf("LookupTXT: %q, %v", txts, err)
+	}
+
+	mxs, err := c.LookupMX(ctx, "example.com")
+	if err != nil || len(mxs) != 2 || mxs[0].Host != "mx1.example.com." || mxs[1].Pref != 20 {
+		t.Errorf("LookupMX: %v, %v", mxs, err)
+	}
+
+	addrs, err := c.LookupHost(ctx, "alias.example.com")
+	if err != nil || strings.Join(addrs, " ") != "192.0.2.10" {
+		t.Errorf("LookupHost through a CNAME: %v, %v", addrs, err)
+	}
+	// the alias points into another zone, asked in a second iteration
+	addrs, err = c.LookupHost(ctx, "outside.example.com")
+	if err != nil || strings.Join(addrs, " ") != "192.0.2.50" {
+		t.Errorf("LookupHost through a CNAME to another zone: %v, %v", addrs, err)
+	}
+
+	ips, err := c.LookupIP(ctx, "ip6", "www.example.com")
+	var dnsErr *net.DNSError
+	if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+		t.Errorf("LookupIP ip6 of an IPv4 only name: %v, %v", ips, err)
+	}
+
+	cname, err := c.LookupCNAME(ctx, "alias.example.com")
+	if err != nil || cname != "www.example.com." {
+		t.Errorf("LookupCNAME: %q, %v", cname, err)
+	}
+
+	names, err := c.LookupAddr(ctx, "192.0.2.10")
+	if err != nil || len(names) != 1 || names[0] != "www.example.com." {
+		t.Errorf("LookupAddr: %v, %v", names, err)
+	}
+}
+
+func TestLookupErrors(t *testing.T) {
+	c := startHierarchy(t)
+
+	tests := []struct {
+		name      string
+		host      string
+		timeout   time.Duration
+		notFound  bool
+		isTimeout bool
+		wantErr   string
+	}{
+		{name: "nxdomain", host: "nope.example.com", notFound: true},
+		{name: "nodata", host: "example.com", notFound: true},
+		{name: "cname loop", host: "loop1.example.com", wantErr: "too many CNAMEs"},
+		{name: "context deadline", host: "www.dead.test", timeout: 50 * time.Millisecond, isTimeout: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			if tt.timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tt.timeout)
+				defer cancel()
+			}
+
+			addrs, err := c.LookupIPAddr(ctx, tt.host)
+			var dnsErr *net.DNSError
+			if !errors.As(err, &dnsErr) {
+				t.Fatalf("got %v, %v, want a *net.DNSError", addrs, err)
+			}
+			if dnsErr.IsNotFound != tt.notFound || dnsErr.IsTimeout != tt.isTimeout || !strings.Contains(dnsErr.Err, tt.wantErr) {
+				t.Errorf("got %#v", dnsErr)
+			}
+		})
+	}
+}
+
+// a recursive server is asked directly, with RD set
+func TestLookupServer(t *testing.T) {
+	c := startHierarchy(t)
+	c.Server = "127.0.0.4"
+
+	txts, err := c.LookupTXT(context.Background(), "www.example.com")
+	if err != nil || len(txts) != 1 {
+		t.Errorf("got %q, %v", txts, err)
+	}
+	if c.RecursionDesired {
+		t.Error("lookup changed the client's RecursionDesired")
+	}
+}
+
+func TestReverseName(t *testing.T) {
+	if got := reverseName(netip.MustParseAddr("192.0.2.1")); got != "1.2.0.192.in-addr.arpa." {
+		t.Errorf("IPv4: %s", got)
+	}
+	if got := reverseName(netip.MustParseAddr("2001:db8::1")); got != "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa." {
+		t.Errorf("IPv6: %s", got)
+	}
+}
@@ -0,0 +1,109 @@
+package resolver
+
+import (
+	"net/netip"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// drop duplicate records from every section and order address answers
+func normalize(res *dnsmessage.Message) {
+	res.Answers = sortAddresses(dedupeRecords(res.Answers))
+	res.Authorities = dedupeRecords(res.Authorities)
+	res.Additionals = dedupeRecords(res.Additionals)
+}
+
+func dedupeRecords(records []dnsmessage.Resource) []dnsmessage.Resource {
+	seen := map[string]bool{}
+	unique := records[:0:0]
+	for _, rr := range records {
+		key := strings.ToLower(rr.Header.Name.String()) + " " + rr.Header.Class.String() + " " +
+			rr.Header.Type.String() + " " + rr.Body.GoString()
+		if rr.Header.Type == dnsmessage.TypeOPT || !seen[key] {
+			seen[key] = true
+			unique = append(unique, rr)
+		}
+	}
+	return unique
+}
+
+// address records are sorted by RFC 6724 destination preference within the
+// positions they already hold, so CNAME chains and other types stay put
+func sortAddresses(records []dnsmessage.Resource) []dnsmessage.Resource {
+	var positions []int
+	var addrs []dnsmessage.Resource
+	for i, rr := range records {
+		if _, ok := recordAddr(rr); ok {
+			positions = append(positions, i)
+			addrs = append(addrs, rr)
+		}
+	}
+
+	sort.SliceStable(addrs, func(i, j int) bool {
+		a, _ := recordAddr(addrs[i])
+		b, _ := recordAddr(addrs[j])
+		// rule 6: higher precedence first
+		if pa, pb := precedence(a), precedence(b); pa != pb {
+			return pa > pb
+		}
+		// rule 8: smaller scope first
+		return addrScope(a) < addrScope(b)
+	})
+
+	sorted := make([]dnsmessage.Resource, len(records))
+	copy(sorted, records)
+	for i, pos := range positions {
+		sorted[pos] = addrs[i]
+	}
+	return sorted
+}
+
+func recordAddr(rr dnsmessage.Resource) (netip.Addr, bool) {
+	switch body := rr.Body.(type) {
+	case *dnsmessage.AResource:
+		return netip.AddrFrom4(body.A), true
+	case *dnsmessage.AAAAResource:
+		return netip.AddrFrom16(body.AAAA), true
+	}
+	return netip.Addr{}, false
+}
+
+// RFC 6724 2.1 default policy table
+var policyTable = []struct {
+	prefix     netip.Prefix
+	precedence int
+}{
+	{netip.MustParsePrefix("::1/128"), 50},
+	{netip.MustParsePrefix("::ffff:0:0/96"), 35},
+	{netip.MustParsePrefix("2002::/16"), 30},
+	{netip.MustParsePrefix("2001::/32"), 5},
+	{netip.MustParsePrefix("fc00::/7"), 3},
+	{netip.MustParsePrefix("::/96"), 1},
+	{netip.MustParsePrefix("fec0::/10"), 1},
+	{netip.MustParsePrefix("3ffe::/16"), 1},
+	{netip.MustParsePrefix("::/0"), 40},
+}
+
+func precedence(addr netip.Addr) int {
+	if addr.Is4() {
+		addr = netip.AddrFrom16(addr.As16()) // ipv4 mapped form
+	}
+	best, bestBits := 0, -1
+	for _, p := range policyTable {
+		if p.prefix.Contains(addr) && p.prefix.Bits() > bestBits {
+			best, bestBits = p.precedence, p.prefix.Bits()
+		}
+	}
+	return best
+}
+
+// RFC 6724 3.1 / 3.2 scopes, loopback and link local are 2, everything
+// else (unique local included) is global, 14
+func addrScope(addr netip.Addr) int {
+	if addr.IsLoopback() || addr.IsLinkLocalUnicast() {
+		return 2
+	}
+	return 14
+}
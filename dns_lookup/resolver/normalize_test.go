@@ -0,0 +1,34 @@
+package resolver
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"internet_services/dns_lookup/fakedns"
+)
+
+func TestNormalize(t *testing.T) {
+	res := dnsmessage.Message{Answers: []dnsmessage.Resource{
+		fakedns.CNAME("www.example.net.", "web.example.net.", 60),
+		fakedns.A("web.example.net.", "192.0.2.1", 60),
+		fakedns.AAAA("web.example.net.", "fd00::1", 60),
+		fakedns.A("web.example.net.", "192.0.2.1", 60),
+		fakedns.AAAA("web.example.net.", "2001:db8::1", 60),
+	}}
+	normalize(&res)
+	var got []string
+	for _, rr := range res.Answers {
+		if addr, ok := recordAddr(rr); ok {
+			got = append(got, addr.String())
+		} else {
+			got = append(got, rr.Body.(*dnsmessage.CNAMEResource).CNAME.String())
+		}
+	}
+	// duplicates gone, then global IPv6 (40) before IPv4 (35) before
+	// unique local (3)
+	if want := "web.example.net. 2001:db8::1 192.0.2.1 fd00::1"; strings.Join(got, " ") != want {
+		t.Errorf("got %v, want %s", got, want)
+	}
+}
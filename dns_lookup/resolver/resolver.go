@@ -0,0 +1,395 @@
+// Package resolver looks up DNS records either by iterating from the root
+// servers, following referrals down to an authoritative server, or by asking
+// a single recursive server. Queries go out over udp, tcp, DNS over TLS or
+// DNS over HTTPS, optionally through a proxy.
+//
+// Besides raw queries a Client offers the lookup methods of net.Resolver,
+// so code that only needs addresses, MX or TXT records can resolve through
+// it instead of the system resolver.
+package resolver
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// RootServers are the root hints used when a Client has no Roots.
+var RootServers = map[string]string{
+	"a.root-servers.net": "198.41.0.4",
+	"b.root-servers.net": "192.228.79.201",
+	"c.root-servers.net": "192.33.4.12",
+	"d.root-servers.net": "128.8.10.90",
+	"e.root-servers.net": "192.203.230.10",
+	"f.root-servers.net": "192.5.5.241",
+	"g.root-servers.net": "192.112.36.4",
+	"h.root-servers.net": "128.63.2.53",
+	"i.root-servers.net": "192.36.148.17",
+	"j.root-servers.net": "192.58.128.30",
+	"k.root-servers.net": "193.0.14.129",
+	"l.root-servers.net": "199.7.83.42",
+	"m.root-servers.net": "202.12.27.33",
+}
+
+// Client holds the settings used to reach name servers. Create it with New,
+// the exported fields can be changed before the first query.
+type Client struct {
+	Transport        string   // udp, tcp, dot or doh
+	Proxy            *url.URL // socks5:// (names resolved here), socks5h:// (by the proxy) or http:// proxy for tcp, dot and doh
+	Port             string   // udp/tcp port used when the server address has none
+	Timeout          time.Duration
+	RecursionDesired bool   // set when asking a recursive server directly
+	DNSSEC           bool   // send EDNS0 with the DO bit to get signatures and denial records
+	UDPSockets       string // UDPDial, UDPPool or UDPShared
+
+	// Server is the recursive server asked by the Lookup methods, when
+	// empty they iterate from Roots
+	Server string
+	Roots  map[string]string // root server name to address, RootServers when nil
+
+	// Trace receives the progress of iterations, nil keeps them silent
+	Trace io.Writer
+	// OnExchange is called after every answered query with the server's
+	// address, eg. to log the traffic
+	OnExchange func(server string, query []byte, sent time.Time, response []byte, received time.Time)
+	// CacheStats reports the hits and misses of a cache in front of the
+	// client, it fills in those fields of Stats
+	CacheStats func() (hits, misses uint64)
+
+	stats   *statsCounters
+	limiter *queryLimiter
+	doh     *dohClient
+}
+
+// EDNS0 udp payload size we advertise
+const ednsUDPSize = 1232
+
+// New returns a client that queries over udp with a 3 second timeout, at
+// most 256 queries in flight and 16 of them to the same server.
+func New() *Client {
+	return &Client{
+		Transport:  "udp",
+		Port:       "53",
+		UDPSockets: UDPDial,
+		Timeout:    3 * time.Second,
+		stats:      newStatsCounters(),
+		limiter:    newQueryLimiter(256, 16),
+		doh:        &dohClient{},
+	}
+}
+
+// SetLimits caps the queries in flight, overall and to a single server, 0
+// for no limit.
+func (c *Client) SetLimits(global, perServer int) {
+	c.limiter = newQueryLimiter(global, perServer)
+}
+
+// Check validates the transport, socket mode and proxy combination.
+func (c *Client) Check() error {
+	switch c.Transport {
+	case "udp", "tcp", "dot", "doh":
+	default:
+		return fmt.Errorf("unknown transport %q (want udp, tcp, dot or doh)", c.Transport)
+	}
+	switch c.UDPSockets {
+	case UDPDial, UDPPool, UDPShared:
+	default:
+		return fmt.Errorf("unknown udp socket mode %q (want dial, pool or shared)", c.UDPSockets)
+	}
+
+	if c.Proxy == nil {
+		return nil
+	}
+	if c.Transport == "udp" {
+		return errors.New("proxy can only be used with tcp, dot or doh transport")
+	}
+	switch c.Proxy.Scheme {
+	case "socks5", "socks5h", "http":
+		return nil
+	}
+	return fmt.Errorf("unsupported proxy scheme %q (want socks5, socks5h or http)", c.Proxy.Scheme)
+}
+
+func (c *Client) tracef(format string, args ...any) {
+	if c.Trace != nil {
+		fmt.Fprintf(c.Trace, format, args...)
+	}
+}
+
+// guards against referral loops
+const maxReferrals = 30
+
+// how deep lookups of glueless name servers may nest, each of them is an
+// iteration of its own
+const maxGluelessDepth = 4
+
+// Iterate follows referrals starting at a random one of the root servers,
+// name to address, until an authoritative response.
+func (c *Client) Iterate(domain string, qtype dnsmessage.Type) (dnsmessage.Message, error) {
+	return c.iterate(domain, qtype, 0)
+}
+
+func (c *Client) iterate(domain string, qtype dnsmessage.Type, depth int) (dnsmessage.Message, error) {
+	roots := c.Roots
+	if roots == nil {
+		roots = RootServers
+	}
+
+	triedServers := map[string]bool{}
+	serverName, serverIP := randomRootServer(roots)
+	serverIPs := []string{serverIP}
+
+	for referrals := 0; ; referrals++ {
+		if referrals > maxReferrals {
+			return dnsmessage.Message{}, errors.New("too many referrals")
+		}
+		for _, ip := range serverIPs {
+			triedServers[ip] = true
+		}
+
+		c.tracef("\nSending request to %s (%s)\n", serverName, serverIPs[0])
+
+		res, err := c.queryFamilies(domain, qtype, serverIPs)
+		if err != nil {
+			c.tracef("Error: %v\n", err)
+
+			newServerName, newServerIP := pickNewRootServer(roots, triedServers)
+			if newServerIP == "" {
+				return dnsmessage.Message{}, errors.New("no more root servers available")
+			}
+
+			c.tracef("Retrying with a new root server: %s (%s)\n", newServerName, newServerIP)
+			c.stats.retry()
+			serverName, serverIPs = newServerName, []string{newServerIP}
+			continue
+		}
+
+		// response is authoritative ?
+		if res.Authoritative {
+			return res, nil
+		}
+
+		// next nameservers
+		nextServers, glue := c.getNextServers(res)
+		if len(nextServers) == 0 {
+			return res, errors.New("no more name servers found")
+		}
+
+		// resolve ns names to ips
+		serverName, serverIPs = c.resolveNS(nextServers, glue, depth)
+		if len(serverIPs) == 0 {
+			return res, errors.New("failed to resolve next NS IP")
+		}
+	}
+}
+
+// query a server at each of its addresses in turn, moving on to the next
+// (other family) address only when the network failed
+func (c *Client) queryFamilies(domain string, qtype dnsmessage.Type, ips []string) (dnsmessage.Message, error) {
+	var netErr net.Error
+	for i, ip := range ips {
+		res, err := c.Query(domain, qtype, ip)
+		if err == nil || !errors.As(err, &netErr) || i == len(ips)-1 {
+			return res, err
+		}
+
+		c.tracef("Error: %v\nRetrying the same server over %s\n", err, ips[i+1])
+		c.stats.retry()
+	}
+	return dnsmessage.Message{}, errors.New("server has no addresses")
+}
+
+// random root server to start from
+func randomRootServer(roots map[string]string) (string, string) {
+	rootNames := make([]string, 0, len(roots))
+	for name := range roots {
+		rootNames = append(rootNames, name)
+	}
+	rootName := rootNames[rand.Intn(len(rootNames))]
+	return rootName, roots[rootName]
+}
+
+func pickNewRootServer(roots map[string]string, tried map[string]bool) (string, string) {
+	for name, ip := range roots {
+		if !tried[ip] {
+			return name, ip
+		}
+	}
+	return "", ""
+}
+
+// Query asks server for domain in class IN.
+func (c *Client) Query(domain string, qtype dnsmessage.Type, server string) (dnsmessage.Message, error) {
+	return c.QueryClass(domain, qtype, dnsmessage.ClassINET, server)
+}
+
+// QueryClass sends a single query to server, retrying over tcp when a udp
+// answer comes back truncated.
+func (c *Client) QueryClass(domain string, qtype dnsmessage.Type, qclass dnsmessage.Class, server string) (dnsmessage.Message, error) {
+	name, err := dnsmessage.NewName(domain)
+	if err != nil {
+		return dnsmessage.Message{}, err
+	}
+
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: uint16(rand.Intn(1 << 16)), RecursionDesired: c.RecursionDesired},
+		Questions: []dnsmessage.Question{
+			{Name: name, Type: qtype, Class: qclass},
+		},
+	}
+
+	if c.DNSSEC {
+		var opt dnsmessage.Resource
+		if err := opt.Header.SetEDNS0(ednsUDPSize, dnsmessage.RCodeSuccess, true); err != nil {
+			return dnsmessage.Message{}, err
+		}
+		opt.Body = &dnsmessage.OPTResource{}
+		msg.Additionals = append(msg.Additionals, opt)
+	}
+
+	packed, err := msg.Pack()
+	if err != nil {
+		return dnsmessage.Message{}, err
+	}
+
+	sent := time.Now()
+	response, err := c.exchange(packed, server)
+	if err != nil {
+		return dnsmessage.Message{}, err
+	}
+	if c.OnExchange != nil {
+		c.OnExchange(withPort(server, c.Port), packed, sent, response, time.Now())
+	}
+
+	var res dnsmessage.Message
+	err = res.Unpack(response)
+	if err != nil {
+		return dnsmessage.Message{}, err
+	}
+
+	// truncated udp answer, ask again over tcp
+	if res.Truncated && c.Transport == "udp" {
+		c.tracef("Response truncated, retrying over tcp\n")
+		c.stats.retry()
+		tcp := *c
+		tcp.Transport = "tcp"
+		if response, err = tcp.exchange(packed, server); err != nil {
+			return dnsmessage.Message{}, err
+		}
+		if err = res.Unpack(response); err != nil {
+			return dnsmessage.Message{}, err
+		}
+	}
+	if res.ID != msg.ID {
+		return dnsmessage.Message{}, fmt.Errorf("response ID %d does not match query ID %d", res.ID, msg.ID)
+	}
+	normalize(&res)
+
+	return res, nil
+}
+
+func (c *Client) getNextServers(res dnsmessage.Message) ([]string, map[string][]string) {
+	servers := []string{}
+	var referralDomain string
+	for _, ns := range res.Authorities {
+		if ns.Header.Type == dnsmessage.TypeNS {
+			nsName := ns.Body.(*dnsmessage.NSResource).NS.String()
+			servers = append(servers, nsName)
+
+			referralDomain = ns.Header.Name.String()
+		}
+	}
+
+	if referralDomain == "" {
+		referralDomain = "(unknown domain)"
+	}
+
+	// check if additional resolved ips
+	resolvedIPs := map[string][]string{}
+	for _, extra := range res.Additionals {
+		name := extra.Header.Name.String()
+		switch body := extra.Body.(type) {
+		case *dnsmessage.AResource:
+			resolvedIPs[name] = append(resolvedIPs[name], net.IP(body.A[:]).String())
+		case *dnsmessage.AAAAResource:
+			resolvedIPs[name] = append(resolvedIPs[name], net.IP(body.AAAA[:]).String())
+		}
+	}
+
+	c.tracef("\nReceived referral response - DNS servers for domain: %s\n", referralDomain)
+	for _, ns := range servers {
+		if ips, exists := resolvedIPs[ns]; exists {
+			c.tracef("-> %s (%s)\n", ns, strings.Join(ips, ", "))
+		} else {
+			c.tracef("-> %s (no IP address)\n", ns)
+		}
+	}
+
+	return servers, resolvedIPs
+}
+
+// glue from the referral first, otherwise look the name up by iterating
+// from the roots again
+func (c *Client) resolveNS(servers []string, glue map[string][]string, depth int) (string, []string) {
+	for _, ns := range servers {
+		if ips, ok := glue[ns]; ok {
+			return ns, onePerFamily(ips)
+		}
+	}
+	if depth >= maxGluelessDepth {
+		return "", nil
+	}
+
+	// the nested lookups would drown the trace of this one
+	quiet := *c
+	quiet.Trace = nil
+	for _, ns := range servers {
+		var ips []string
+		for _, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+			res, err := quiet.iterate(ns, qtype, depth+1)
+			if err != nil {
+				continue
+			}
+			for _, rr := range res.Answers {
+				if addr, ok := recordAddr(rr); ok {
+					ips = append(ips, addr.String())
+				}
+			}
+		}
+		if len(ips) > 0 {
+			c.tracef("\nResolved DNS server name %s to IP %s\n", ns, strings.Join(ips, ", "))
+			return ns, onePerFamily(ips)
+		}
+	}
+	return "", nil
+}
+
+// first IPv4 and first IPv6 address, IPv4 preferred
+func onePerFamily(ips []string) []string {
+	var v4, v6 string
+	for _, ip := range ips {
+		parsed := net.ParseIP(ip)
+		switch {
+		case parsed == nil:
+		case parsed.To4() != nil && v4 == "":
+			v4 = ip
+		case parsed.To4() == nil && v6 == "":
+			v6 = ip
+		}
+	}
+
+	var picked []string
+	for _, ip := range []string{v4, v6} {
+		if ip != "" {
+			picked = append(picked, ip)
+		}
+	}
+	return picked
+}
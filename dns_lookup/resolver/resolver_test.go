@@ -0,0 +1,196 @@
+package resolver
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"internet_services/dns_lookup/fakedns"
+)
+
+// fake root, TLD and authoritative servers on 127.0.0.x, and a client
+// that reaches them on their port
+func startHierarchy(t *testing.T) *Client {
+	t.Helper()
+	h, err := fakedns.Start(testHierarchy()...)
+	if err != nil {
+		t.Fatalf("failed to start fake name servers: %v", err)
+	}
+	t.Cleanup(h.Close)
+
+	c := New()
+	c.Port = strconv.Itoa(h.Port)
+	c.Timeout = 500 * time.Millisecond
+	c.Roots = map[string]string{"a.root.test.": "127.0.0.2"}
+	c.SetLimits(0, 0)
+	return c
+}
+
+func testHierarchy() []*fakedns.Server {
+	root := &fakedns.Server{IP: "127.0.0.2", Zones: []fakedns.Zone{{Origin: ".", Records: []dnsmessage.Resource{
+		fakedns.SOA(".", "a.root.test.", 86400),
+		fakedns.NS("com.", "ns.com.test.", 172800),
+		fakedns.A("ns.com.test.", "127.0.0.3", 172800),
+		fakedns.NS("trunc.test.", "ns.trunc.test.", 172800),
+		fakedns.A("ns.trunc.test.", "127.0.0.5", 172800),
+		fakedns.NS("dead.test.", "ns.dead.test.", 172800),
+		fakedns.A("ns.dead.test.", "127.0.0.6", 172800),
+		fakedns.NS("loop.test.", "ns.loop.test.", 172800),
+		fakedns.A("ns.loop.test.", "127.0.0.7", 172800),
+		fakedns.NS("dual.test.", "ns.dual.test.", 172800),
+		fakedns.A("ns.dual.test.", "127.0.0.10", 172800), // nothing listens here
+		fakedns.AAAA("ns.dual.test.", "::1", 172800),
+		fakedns.NS("glueless.test.", "ns.elsewhere.invalid.", 172800),
+		// served by example.com's name server, whose address has to be
+		// looked up first
+		fakedns.NS("2.0.192.in-addr.arpa.", "ns1.example.com.", 172800),
+	}}}}
+
+	com := &fakedns.Server{IP: "127.0.0.3", Zones: []fakedns.Zone{{Origin: "com.", Records: []dnsmessage.Resource{
+		fakedns.SOA("com.", "ns.com.test.", 900),
+		fakedns.NS("example.com.", "ns1.example.com.", 172800),
+		fakedns.A("ns1.example.com.", "127.0.0.4", 172800),
+	}}}}
+
+	example := &fakedns.Server{IP: "127.0.0.4", Zones: []fakedns.Zone{
+		{Origin: "example.com.", Records: []dnsmessage.Resource{
+			fakedns.SOA("example.com.", "ns1.example.com.", 300),
+			fakedns.NS("example.com.", "ns1.example.com.", 3600),
+			fakedns.A("ns1.example.com.", "127.0.0.4", 3600),
+			fakedns.MX("example.com.", 20, "mx2.example.com.", 300),
+			fakedns.MX("example.com.", 10, "mx1.example.com.", 300),
+			fakedns.A("www.example.com.", "192.0.2.10", 300),
+			fakedns.TXT("www.example.com.", 300, "v=spf1 ", "-all"),
+			fakedns.CNAME("alias.example.com.", "www.example.com.", 300),
+			fakedns.CNAME("outside.example.com.", "www.dual.test.", 300),
+			fakedns.CNAME("loop1.example.com.", "loop2.example.com.", 300),
+			fakedns.CNAME("loop2.example.com.", "loop1.example.com.", 300),
+		}},
+		{Origin: "2.0.192.in-addr.arpa.", Records: []dnsmessage.Resource{
+			fakedns.SOA("2.0.192.in-addr.arpa.", "ns1.example.com.", 300),
+			fakedns.PTR("10.2.0.192.in-addr.arpa.", "www.example.com.", 300),
+		}},
+	}}
+
+	trunc := &fakedns.Server{IP: "127.0.0.5", Zones: []fakedns.Zone{{Origin: "trunc.test.", Records: []dnsmessage.Resource{
+		fakedns.SOA("trunc.test.", "ns.trunc.test.", 300),
+		fakedns.TXT("big.trunc.test.", 300, "served over tcp"),
+	}}}}
+	trunc.Truncate.Store(true)
+
+	dead := &fakedns.Server{IP: "127.0.0.6"}
+	dead.Drop.Store(true)
+
+	// keeps delegating loop.test back to itself
+	loop := &fakedns.Server{IP: "127.0.0.7", Zones: []fakedns.Zone{{Origin: ".", Records: []dnsmessage.Resource{
+		fakedns.NS("loop.test.", "ns.loop.test.", 172800),
+		fakedns.A("ns.loop.test.", "127.0.0.7", 172800),
+	}}}}
+
+	dual := &fakedns.Server{IP: "::1", Zones: []fakedns.Zone{{Origin: "dual.test.", Records: []dnsmessage.Resource{
+		fakedns.SOA("dual.test.", "ns.dual.test.", 300),
+		fakedns.A("www.dual.test.", "192.0.2.50", 300),
+	}}}}
+
+	return []*fakedns.Server{root, com, example, trunc, dead, loop, dual}
+}
+
+func TestIterate(t *testing.T) {
+	c := startHierarchy(t)
+
+	tests := []struct {
+		name    string
+		domain  string
+		qtype   dnsmessage.Type
+		wantErr string // substring of the expected error
+		rcode   dnsmessage.RCode
+		answer  string // first answer
+	}{
+		{name: "referral with glue", domain: "www.example.com.", qtype: dnsmessage.TypeA, answer: "192.0.2.10"},
+		{name: "nxdomain", domain: "nope.example.com.", qtype: dnsmessage.TypeA, rcode: dnsmessage.RCodeNameError},
+		{name: "nodata", domain: "www.example.com.", qtype: dnsmessage.TypeAAAA},
+		{name: "truncated udp retried over tcp", domain: "big.trunc.test.", qtype: dnsmessage.TypeTXT, answer: "served over tcp"},
+		{name: "unresponsive server", domain: "www.dead.test.", qtype: dnsmessage.TypeA, wantErr: "no more root servers"},
+		{name: "referral loop", domain: "www.loop.test.", qtype: dnsmessage.TypeA, wantErr: "too many referrals"},
+		{name: "unreachable IPv4 retried over IPv6", domain: "www.dual.test.", qtype: dnsmessage.TypeA, answer: "192.0.2.50"},
+		{name: "glueless ns looked up", domain: "10.2.0.192.in-addr.arpa.", qtype: dnsmessage.TypePTR, answer: "www.example.com."},
+		{name: "glueless unresolvable ns", domain: "www.glueless.test.", qtype: dnsmessage.TypeA, wantErr: "failed to resolve next NS IP"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := c.Iterate(tt.domain, tt.qtype)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if res.RCode != tt.rcode {
+				t.Fatalf("got %s, want %s", res.RCode, tt.rcode)
+			}
+			if tt.answer == "" {
+				if len(res.Answers) > 0 {
+					t.Errorf("got %d answers, want none", len(res.Answers))
+				}
+				return
+			}
+			if len(res.Answers) == 0 {
+				t.Fatal("no answers")
+			}
+			if got := rdata(res.Answers[0]); got != tt.answer {
+				t.Errorf("got answer %s, want %s", got, tt.answer)
+			}
+		})
+	}
+}
+
+// the record data the tests compare
+func rdata(rr dnsmessage.Resource) string {
+	if addr, ok := recordAddr(rr); ok {
+		return addr.String()
+	}
+	switch body := rr.Body.(type) {
+	case *dnsmessage.TXTResource:
+		return strings.Join(body.TXT, "")
+	case *dnsmessage.PTRResource:
+		return body.PTR.String()
+	}
+	return rr.Body.GoString()
+}
+
+func TestUDPSocketModes(t *testing.T) {
+	c := startHierarchy(t)
+
+	for _, mode := range []string{UDPPool, UDPShared} {
+		c.UDPSockets = mode
+		for i := 0; i < 3; i++ {
+			res, err := c.Iterate("www.example.com.", dnsmessage.TypeA)
+			if err != nil || len(res.Answers) == 0 {
+				t.Errorf("%s mode: got %v, %v", mode, res.Answers, err)
+			}
+		}
+	}
+}
+
+func TestStats(t *testing.T) {
+	c := startHierarchy(t)
+	c.CacheStats = func() (uint64, uint64) { return 3, 1 }
+
+	if _, err := c.Iterate("www.example.com.", dnsmessage.TypeA); err != nil {
+		t.Fatal(err)
+	}
+	stats := c.Stats()
+	// root, com and example.com
+	if stats.QueriesSent != 3 || stats.BytesSent == 0 || stats.BytesReceived == 0 {
+		t.Errorf("got %+v", stats)
+	}
+	if stats.CacheHits != 3 || stats.CacheMisses != 1 {
+		t.Errorf("cache figures %d/%d, want 3/1", stats.CacheHits, stats.CacheMisses)
+	}
+}
@@ -0,0 +1,78 @@
+package resolver
+
+import (
+	"errors"
+	"net"
+	"sync"
+)
+
+// Stats is a snapshot of a client's counters.
+type Stats struct {
+	QueriesSent   uint64            `json:"queries_sent"`
+	Retries       uint64            `json:"retries"`
+	Errors        uint64            `json:"errors"`
+	Throttled     uint64            `json:"throttled"` // not sent, concurrency limit reached
+	Timeouts      map[string]uint64 `json:"timeouts"`  // per server address
+	BytesSent     uint64            `json:"bytes_sent"`
+	BytesReceived uint64            `json:"bytes_received"`
+	CacheHits     uint64            `json:"cache_hits"`
+	CacheMisses   uint64            `json:"cache_misses"`
+}
+
+// shared by every copy of a Client
+type statsCounters struct {
+	mu    sync.Mutex
+	stats Stats
+}
+
+func newStatsCounters() *statsCounters {
+	return &statsCounters{stats: Stats{Timeouts: map[string]uint64{}}}
+}
+
+// account for one exchange with a server
+func (s *statsCounters) exchange(server string, sent, received int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.stats.QueriesSent++
+	s.stats.BytesSent += uint64(sent)
+	s.stats.BytesReceived += uint64(received)
+
+	var netErr net.Error
+	switch {
+	case err == nil:
+	case errors.As(err, &netErr) && netErr.Timeout():
+		s.stats.Timeouts[server]++
+	default:
+		s.stats.Errors++
+	}
+}
+
+func (s *statsCounters) retry() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stats.Retries++
+}
+
+func (s *statsCounters) throttle() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stats.Throttled++
+}
+
+// Stats returns the counters collected since the client was created, cache
+// figures come from CacheStats.
+func (c *Client) Stats() Stats {
+	c.stats.mu.Lock()
+	snapshot := c.stats.stats
+	snapshot.Timeouts = make(map[string]uint64, len(c.stats.stats.Timeouts))
+	for server, n := range c.stats.stats.Timeouts {
+		snapshot.Timeouts[server] = n
+	}
+	c.stats.mu.Unlock()
+
+	if c.CacheStats != nil {
+		snapshot.CacheHits, snapshot.CacheMisses = c.CacheStats()
+	}
+	return snapshot
+}
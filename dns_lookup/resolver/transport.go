@@ -0,0 +1,335 @@
+package resolver
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// send a packed query and return the raw response
+func (c *Client) exchange(query []byte, server string) ([]byte, error) {
+	release, err := c.limiter.acquire(server, c.Timeout)
+	if err != nil {
+		c.stats.throttle()
+		return nil, fmt.Errorf("%s: %w", server, err)
+	}
+	defer release()
+
+	response, err := c.send(query, server)
+	c.stats.exchange(server, len(query), len(response), err)
+	return response, err
+}
+
+func (c *Client) send(query []byte, server string) ([]byte, error) {
+	switch c.Transport {
+	case "tcp":
+		conn, err := c.dial(withPort(server, c.Port))
+		if err != nil {
+			return nil, err
+		}
+		defer conn.Close()
+		return exchangeStream(conn, query, c.Timeout)
+	case "dot":
+		conn, err := c.dial(withPort(server, "853"))
+		if err != nil {
+			return nil, err
+		}
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: hostOnly(server)})
+		defer tlsConn.Close()
+		return exchangeStream(tlsConn, query, c.Timeout)
+	case "doh":
+		return c.exchangeHTTPS(query, server)
+	default:
+		return c.exchangeUDP(query, server)
+	}
+}
+
+func (c *Client) exchangeUDP(query []byte, server string) ([]byte, error) {
+	dest := withPort(server, c.Port)
+	size := 512
+	if c.DNSSEC {
+		size = ednsUDPSize
+	}
+
+	switch c.UDPSockets {
+	case UDPShared:
+		return shared.exchange(query, dest, c.Timeout)
+	case UDPPool:
+		conn, err := connPool.get(dest, c.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("timeout or connection error: %w", err)
+		}
+		response, err := exchangeDatagram(conn, query, size, c.Timeout)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		connPool.put(dest, conn)
+		return response, nil
+	}
+
+	dialer := net.Dialer{Timeout: c.Timeout}
+	conn, err := dialer.Dial("udp", dest)
+	if err != nil {
+		return nil, fmt.Errorf("timeout or connection error: %w", err)
+	}
+	defer conn.Close()
+	return exchangeDatagram(conn, query, size, c.Timeout)
+}
+
+func exchangeDatagram(conn net.Conn, query []byte, size int, timeout time.Duration) ([]byte, error) {
+	conn.SetWriteDeadline(time.Now().Add(timeout))
+	_, err := conn.Write(query)
+	if err != nil {
+		return nil, fmt.Errorf("timeout or write error: %w", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	response, err := readMatching(conn, query, size)
+	if err != nil {
+		return nil, fmt.Errorf("timeout or read error: %w", err)
+	}
+
+	return response, nil
+}
+
+// tcp and dot share the 2 byte length prefixed framing (RFC 1035 4.2.2)
+func exchangeStream(conn net.Conn, query []byte, timeout time.Duration) ([]byte, error) {
+	conn.SetDeadline(time.Now().Add(timeout))
+	if err := writeFrame(conn, query); err != nil {
+		return nil, err
+	}
+	return readFrame(conn)
+}
+
+func writeFrame(conn net.Conn, msg []byte) error {
+	framed := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(framed, uint16(len(msg)))
+	copy(framed[2:], msg)
+	if _, err := conn.Write(framed); err != nil {
+		return fmt.Errorf("timeout or write error: %w", err)
+	}
+	return nil
+}
+
+func readFrame(conn net.Conn) ([]byte, error) {
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, fmt.Errorf("timeout or read error: %w", err)
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, msg); err != nil {
+		return nil, fmt.Errorf("timeout or read error: %w", err)
+	}
+	return msg, nil
+}
+
+// RFC 8484 POST with application/dns-message body
+func (c *Client) exchangeHTTPS(query []byte, server string) ([]byte, error) {
+	endpoint := server
+	if !strings.HasPrefix(endpoint, "https://") {
+		endpoint = "https://" + urlHost(endpoint) + "/dns-query"
+	}
+
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("DoH request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DoH server returned %s", resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 65535))
+}
+
+// the DoH client, built on first use and shared by copies of c so that
+// connections to the server are kept alive between queries
+func (c *Client) httpClient() *http.Client {
+	c.doh.once.Do(func() {
+		transport := &http.Transport{
+			// dial goes through the proxy the way the other transports do
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return c.dial(addr)
+			},
+			TLSHandshakeTimeout: c.Timeout,
+		}
+		c.doh.client = &http.Client{Transport: transport, Timeout: c.Timeout}
+	})
+	return c.doh.client
+}
+
+type dohClient struct {
+	once   sync.Once
+	client *http.Client
+}
+
+// open a tcp connection, through the proxy if one is configured
+func (c *Client) dial(addr string) (net.Conn, error) {
+	direct := &net.Dialer{Timeout: c.Timeout}
+
+	if c.Proxy == nil {
+		conn, err := direct.Dial("tcp", addr)
+		if err != nil {
+			return nil, fmt.Errorf("timeout or connection error: %w", err)
+		}
+		return conn, nil
+	}
+
+	if c.Proxy.Scheme == "http" {
+		return dialHTTPConnect(direct, c.Proxy, addr, c.Timeout)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.Timeout)
+	defer cancel()
+
+	// x/net/proxy hands hostnames to the proxy to resolve, which is what
+	// socks5h asks for. With socks5 the name is resolved here and only the
+	// address goes to the proxy.
+	if c.Proxy.Scheme == "socks5" {
+		var err error
+		if addr, err = resolveLocally(ctx, addr); err != nil {
+			return nil, err
+		}
+	}
+	proxyURL := *c.Proxy
+	proxyURL.Scheme = "socks5"
+	dialer, err := proxy.FromURL(&proxyURL, direct)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy: %w", err)
+	}
+	conn, err := dialer.(proxy.ContextDialer).DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("proxy connection error: %w", err)
+	}
+	return conn, nil
+}
+
+// host:port with the host looked up by the system resolver, addresses are
+// returned as they are
+func resolveLocally(ctx context.Context, addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	if _, err := netip.ParseAddr(host); err == nil {
+		return addr, nil
+	}
+	ips, err := net.DefaultResolver.LookupHost(ctx, host)
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(ips[0], port), nil
+}
+
+// tunnel through an HTTP proxy with the CONNECT method
+func dialHTTPConnect(direct *net.Dialer, proxyURL *url.URL, addr string, timeout time.Duration) (net.Conn, error) {
+	conn, err := direct.Dial("tcp", withPort(proxyURL.Host, "8080"))
+	if err != nil {
+		return nil, fmt.Errorf("proxy connection error: %w", err)
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if user := proxyURL.User; user != nil {
+		password, _ := user.Password()
+		creds := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+creds)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("proxy CONNECT failed: %w", err)
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("proxy CONNECT failed: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy CONNECT refused: %s", resp.Status)
+	}
+
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// append default port unless one is given
+func withPort(server, port string) string {
+	if _, _, err := net.SplitHostPort(server); err == nil {
+		return server
+	}
+	return net.JoinHostPort(strings.Trim(server, "[]"), port)
+}
+
+// host part for TLS name checks, a zone ID is no part of a certificate
+func hostOnly(server string) string {
+	host := strings.Trim(server, "[]")
+	if h, _, err := net.SplitHostPort(server); err == nil {
+		host = h
+	}
+	host, _, _ = strings.Cut(host, "%")
+	return host
+}
+
+// host for a URL, IPv6 literals are bracketed and "%" in a zone ID is
+// escaped (RFC 6874)
+func urlHost(server string) string {
+	host, port, err := net.SplitHostPort(server)
+	if err != nil {
+		host, port = strings.Trim(server, "[]"), ""
+	}
+	if strings.Contains(host, ":") {
+		host = "[" + strings.Replace(host, "%", "%25", 1) + "]"
+	}
+	if port != "" {
+		host += ":" + port
+	}
+	return host
+}
+
+// CheckZone rejects link-local addresses without a zone: they are only
+// meaningful together with the interface, fe80::1 has to be given as
+// fe80::1%eth0.
+func CheckZone(server string) error {
+	host := strings.Trim(server, "[]")
+	if h, _, err := net.SplitHostPort(server); err == nil {
+		host = h
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return nil // a hostname or DoH URL
+	}
+	if addr.Is6() && addr.IsLinkLocalUnicast() && addr.Zone() == "" {
+		return fmt.Errorf("link-local address %s needs a zone ID, eg. %s%%eth0", addr, addr)
+	}
+	return nil
+}
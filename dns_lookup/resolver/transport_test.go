@@ -0,0 +1,149 @@
+package resolver
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestZoneIDs(t *testing.T) {
+	if got := withPort("fe80::1%eth0", "53"); got != "[fe80::1%eth0]:53" {
+		t.Errorf("withPort: %s", got)
+	}
+	if got := urlHost("fe80::1%eth0"); got != "[fe80::1%25eth0]" {
+		t.Errorf("urlHost: %s", got)
+	}
+	if got := hostOnly("[fe80::1%eth0]:853"); got != "fe80::1" {
+		t.Errorf("hostOnly: %s", got)
+	}
+
+	tests := []struct {
+		server string
+		ok     bool
+	}{
+		{"fe80::1", false},
+		{"fe80::1%eth0", true},
+		{"192.0.2.1", true},
+	}
+	for _, tt := range tests {
+		if err := CheckZone(tt.server); (err == nil) != tt.ok {
+			t.Errorf("CheckZone(%q) = %v", tt.server, err)
+		}
+	}
+}
+
+// the loopback interface stands in for a link, in both socket modes
+func TestQueryWithZone(t *testing.T) {
+	c := startHierarchy(t)
+
+	for _, mode := range []string{UDPDial, UDPShared} {
+		c.UDPSockets = mode
+		res, err := c.Query("www.dual.test.", dnsmessage.TypeA, "::1%lo")
+		if err != nil || len(res.Answers) == 0 {
+			t.Errorf("%s mode via ::1%%lo: %v, %v", mode, res.Answers, err)
+		}
+	}
+}
+
+// socks5 sends the proxy an address it looked up itself, socks5h leaves
+// the name to the proxy
+func TestSOCKSResolution(t *testing.T) {
+	tests := []struct {
+		scheme string
+		byName bool
+	}{
+		{"socks5", false},
+		{"socks5h", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.scheme, func(t *testing.T) {
+			proxy, requested := startSOCKSServer(t)
+			c := New()
+			c.Transport = "tcp"
+			c.Timeout = time.Second
+			c.Proxy = &url.URL{Scheme: tt.scheme, Host: proxy}
+
+			conn, err := c.dial("localhost:53")
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn.Close()
+			got := <-requested
+			host, _, _ := net.SplitHostPort(got)
+			if byName := net.ParseIP(host) == nil; byName != tt.byName {
+				t.Errorf("proxy was asked for %s", got)
+			}
+		})
+	}
+}
+
+// a SOCKS5 server that reports the destination of the first CONNECT and
+// then closes the connection
+func startSOCKSServer(t *testing.T) (string, <-chan string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	requested := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		// greeting: version, methods; answered with "no authentication"
+		greeting := make([]byte, 2)
+		if _, err := io.ReadFull(conn, greeting); err != nil {
+			return
+		}
+		if _, err := io.ReadFull(conn, make([]byte, greeting[1])); err != nil {
+			return
+		}
+		conn.Write([]byte{5, 0})
+
+		// request: version, command, reserved, address type
+		head := make([]byte, 4)
+		if _, err := io.ReadFull(conn, head); err != nil {
+			return
+		}
+		var host string
+		switch head[3] {
+		case 1:
+			ip := make([]byte, 4)
+			io.ReadFull(conn, ip)
+			host = net.IP(ip).String()
+		case 3:
+			length := make([]byte, 1)
+			io.ReadFull(conn, length)
+			name := make([]byte, length[0])
+			io.ReadFull(conn, name)
+			host = string(name)
+		default:
+			return
+		}
+		port := make([]byte, 2)
+		io.ReadFull(conn, port)
+		requested <- net.JoinHostPort(host, fmt.Sprint(int(port[0])<<8|int(port[1])))
+		conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+	}()
+	return ln.Addr().String(), requested
+}
+
+// copies of a client share one DoH client and with it the idle connections
+func TestHTTPClientShared(t *testing.T) {
+	c := New()
+	tcp := *c
+	tcp.Transport = "tcp"
+	if c.httpClient() != tcp.httpClient() {
+		t.Error("copies of a client built separate DoH clients")
+	}
+}
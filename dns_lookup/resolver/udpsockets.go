@@ -0,0 +1,187 @@
+package resolver
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// How udp queries get a socket, the values of Client.UDPSockets.
+const (
+	UDPDial   = "dial"   // fresh connected socket per query
+	UDPPool   = "pool"   // connected sockets reused per destination
+	UDPShared = "shared" // one unconnected socket for everything
+)
+
+// idle connected sockets kept per destination
+const maxIdlePerDest = 8
+
+type udpConnPool struct {
+	mu   sync.Mutex
+	idle map[string][]*net.UDPConn
+}
+
+var connPool = &udpConnPool{idle: map[string][]*net.UDPConn{}}
+
+func (p *udpConnPool) get(dest string, timeout time.Duration) (*net.UDPConn, error) {
+	p.mu.Lock()
+	if conns := p.idle[dest]; len(conns) > 0 {
+		conn := conns[len(conns)-1]
+		p.idle[dest] = conns[:len(conns)-1]
+		p.mu.Unlock()
+		return conn, nil
+	}
+	p.mu.Unlock()
+
+	dialer := net.Dialer{Timeout: timeout}
+	conn, err := dialer.Dial("udp", dest)
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
+
+func (p *udpConnPool) put(dest string, conn *net.UDPConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.idle[dest]) >= maxIdlePerDest {
+		conn.Close()
+		return
+	}
+	p.idle[dest] = append(p.idle[dest], conn)
+}
+
+// read until a datagram carrying the query ID arrives, a reused socket can
+// still hold late answers to earlier queries
+func readMatching(conn net.Conn, query []byte, size int) ([]byte, error) {
+	buf := make([]byte, size)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		if n >= 2 && buf[0] == query[0] && buf[1] == query[1] {
+			return buf[:n], nil
+		}
+	}
+}
+
+// single unconnected socket, responses are matched to waiting queries by
+// source address and ID. This trades away source port randomization, so
+// it is meant for high query rates towards trusted networks.
+type sharedSocket struct {
+	once    sync.Once
+	conn    *net.UDPConn
+	err     error
+	mu      sync.Mutex
+	pending map[string]chan []byte
+}
+
+var shared = &sharedSocket{pending: map[string]chan []byte{}}
+
+func (s *sharedSocket) start() {
+	s.conn, s.err = net.ListenUDP("udp", nil)
+	if s.err == nil {
+		go s.readLoop()
+	}
+}
+
+func pendingKey(from netip.AddrPort, id0, id1 byte) string {
+	from = netip.AddrPortFrom(zoneByName(from.Addr().Unmap()), from.Port())
+	return fmt.Sprintf("%s/%02x%02x", from, id0, id1)
+}
+
+// replies carry the interface name as zone, the user may have given its
+// index, and a zone on anything but a link-local address means nothing
+func zoneByName(addr netip.Addr) netip.Addr {
+	if !addr.IsLinkLocalUnicast() {
+		return addr.WithZone("")
+	}
+	if index, err := strconv.Atoi(addr.Zone()); err == nil {
+		if ifi, err := net.InterfaceByIndex(index); err == nil {
+			return addr.WithZone(ifi.Name)
+		}
+	}
+	return addr
+}
+
+func (s *sharedSocket) readLoop() {
+	buf := make([]byte, 65535)
+	for {
+		n, from, err := s.conn.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			return
+		}
+		if n < 2 {
+			continue
+		}
+
+		s.mu.Lock()
+		ch, ok := s.pending[pendingKey(from, buf[0], buf[1])]
+		s.mu.Unlock()
+
+		// unknown source or ID: spoofed or late, drop it
+		if ok {
+			response := make([]byte, n)
+			copy(response, buf[:n])
+			select {
+			case ch <- response:
+			default:
+			}
+		}
+	}
+}
+
+func (s *sharedSocket) exchange(query []byte, dest string, timeout time.Duration) ([]byte, error) {
+	s.once.Do(s.start)
+	if s.err != nil {
+		return nil, fmt.Errorf("shared udp socket: %w", s.err)
+	}
+
+	to, err := netip.ParseAddrPort(dest)
+	if err != nil {
+		addr, err := net.ResolveUDPAddr("udp", dest)
+		if err != nil {
+			return nil, err
+		}
+		to = addr.AddrPort()
+	}
+
+	key := pendingKey(to, query[0], query[1])
+	ch := make(chan []byte, 1)
+	s.mu.Lock()
+	if _, busy := s.pending[key]; busy {
+		s.mu.Unlock()
+		return nil, errors.New("query ID already in flight to this server")
+	}
+	s.pending[key] = ch
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.pending, key)
+		s.mu.Unlock()
+	}()
+
+	if _, err := s.conn.WriteToUDPAddrPort(query, to); err != nil {
+		return nil, fmt.Errorf("timeout or write error: %w", err)
+	}
+
+	select {
+	case response := <-ch:
+		return response, nil
+	case <-time.After(timeout):
+		return nil, fmt.Errorf("timeout or read error: %w", timeoutError{})
+	}
+}
+
+// satisfies net.Error so timeouts are counted and retried like socket ones
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
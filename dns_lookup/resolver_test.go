@@ -0,0 +1,191 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"internet_services/dns_lookup/fakedns"
+	"internet_services/dns_lookup/resolver"
+)
+
+// fake root, TLD and authoritative servers on 127.0.0.x, and a client
+// that reaches them on their port
+func startHierarchy(t *testing.T) *resolver.Client {
+	t.Helper()
+	servers, err := testHierarchy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := fakedns.Start(servers...)
+	if err != nil {
+		t.Fatalf("failed to start fake name servers: %v", err)
+	}
+	t.Cleanup(h.Close)
+
+	c := resolver.New()
+	c.Port = strconv.Itoa(h.Port)
+	c.Timeout = 500 * time.Millisecond
+	c.Roots = map[string]string{"a.root.test.": "127.0.0.2"}
+	c.SetLimits(0, 0)
+	return c
+}
+
+func testHierarchy() ([]*fakedns.Server, error) {
+	root := &fakedns.Server{IP: "127.0.0.2", Zones: []fakedns.Zone{{Origin: ".", Records: []dnsmessage.Resource{
+		fakedns.SOA(".", "a.root.test.", 86400),
+		fakedns.NS("com.", "ns.com.test.", 172800),
+		fakedns.A("ns.com.test.", "127.0.0.3", 172800),
+		fakedns.NS("minimal.test.", "ns.minimal.test.", 172800),
+		fakedns.A("ns.minimal.test.", "127.0.0.8", 172800),
+		fakedns.NS("nsec.test.", "ns.signed.test.", 172800),
+		fakedns.NS("nsec3.test.", "ns.signed.test.", 172800),
+		fakedns.A("ns.signed.test.", "127.0.0.9", 172800),
+	}}}}
+
+	com := &fakedns.Server{IP: "127.0.0.3", Zones: []fakedns.Zone{{Origin: "com.", Records: []dnsmessage.Resource{
+		fakedns.SOA("com.", "ns.com.test.", 900),
+		fakedns.NS("example.com.", "ns1.example.com.", 172800),
+		fakedns.A("ns1.example.com.", "127.0.0.4", 172800),
+	}}}}
+
+	example := &fakedns.Server{IP: "127.0.0.4", Zones: []fakedns.Zone{{Origin: "example.com.", Records: []dnsmessage.Resource{
+		fakedns.SOA("example.com.", "ns1.example.com.", 300),
+		fakedns.NS("example.com.", "ns1.example.com.", 3600),
+		fakedns.A("ns1.example.com.", "127.0.0.4", 3600),
+		fakedns.A("www.example.com.", "192.0.2.10", 300),
+		fakedns.TXT("www.example.com.", 300, "v=spf1 -all"),
+		fakedns.CAA("example.com.", 300, 0, "issue", "letsencrypt.org"),
+		fakedns.CAA("example.com.", 300, 0, "issue", "pki.goog; cansignhttpexchanges=yes"),
+		fakedns.CAA("example.com.", 300, 0, "issuewild", ";"),
+		fakedns.CAA("example.com.", 300, 0, "iodef", "mailto:security@example.com"),
+	}}}}
+
+	minimal := &fakedns.Server{IP: "127.0.0.8", Zones: []fakedns.Zone{{Origin: "minimal.test.", Records: []dnsmessage.Resource{
+		fakedns.SOA("minimal.test.", "ns.minimal.test.", 300),
+		fakedns.A("www.minimal.test.", "192.0.2.20", 300),
+		fakedns.AAAA("www.minimal.test.", "2001:db8::20", 300),
+	}}}}
+	minimal.MinimalANY.Store(true)
+
+	chain, err := nsec3Chain("nsec3.test.", map[string][]dnsmessage.Type{
+		"nsec3.test.":   {dnsmessage.TypeSOA, typeNSEC3PARAM},
+		"a.nsec3.test.": {dnsmessage.TypeA},
+	})
+	if err != nil {
+		return nil, err
+	}
+	signed := &fakedns.Server{IP: "127.0.0.9", Zones: []fakedns.Zone{
+		{Origin: "nsec.test.", Records: []dnsmessage.Resource{
+			fakedns.SOA("nsec.test.", "ns.signed.test.", 300),
+			fakedns.A("a.nsec.test.", "192.0.2.30", 300),
+			fakedns.A("c.nsec.test.", "192.0.2.31", 300),
+			fakedns.NSEC("nsec.test.", "a.nsec.test.", 300, dnsmessage.TypeSOA, typeNSEC),
+			fakedns.NSEC("a.nsec.test.", "c.nsec.test.", 300, dnsmessage.TypeA, typeNSEC),
+			fakedns.NSEC("c.nsec.test.", "nsec.test.", 300, dnsmessage.TypeA, typeNSEC),
+		}},
+		{Origin: "nsec3.test.", Records: append([]dnsmessage.Resource{
+			fakedns.SOA("nsec3.test.", "ns.signed.test.", 300),
+			fakedns.A("a.nsec3.test.", "192.0.2.40", 300),
+		}, chain...)},
+	}}
+
+	return []*fakedns.Server{root, com, example, minimal, signed}, nil
+}
+
+// NSEC3 records linking the hashes of the given names in order
+func nsec3Chain(zone string, names map[string][]dnsmessage.Type) ([]dnsmessage.Resource, error) {
+	salt := []byte{0xab}
+	const iterations = 2
+
+	hashed := map[string][]dnsmessage.Type{}
+	var hashes []string
+	for name, types := range names {
+		hash := nsec3Hash(name, salt, iterations)
+		hashed[hash] = types
+		hashes = append(hashes, hash)
+	}
+	sort.Strings(hashes)
+
+	var records []dnsmessage.Resource
+	for i, hash := range hashes {
+		next := hashes[(i+1)%len(hashes)]
+		rr, err := fakedns.NSEC3(hash, zone, next, salt, iterations, 300, hashed[hash]...)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, rr)
+	}
+	return records, nil
+}
+
+func TestIterate(t *testing.T) {
+	c := startHierarchy(t)
+
+	tests := []struct {
+		name    string
+		domain  string
+		qtype   dnsmessage.Type
+		wantErr string // substring of the expected error
+		rcode   dnsmessage.RCode
+		answer  string // rdata of the first answer
+		count   int    // number of answers when more than one is expected
+		denial  bool   // negative answer whose NSEC/NSEC3 proof must hold
+	}{
+		{name: "nxdomain", domain: "nope.example.com.", qtype: dnsmessage.TypeA, rcode: dnsmessage.RCodeNameError},
+		{name: "nodata", domain: "www.example.com.", qtype: dnsmessage.TypeAAAA},
+		{name: "ANY answered in full", domain: "www.example.com.", qtype: dnsmessage.TypeALL, answer: "192.0.2.10", count: 2},
+		{name: "minimal ANY falls back to single types", domain: "www.minimal.test.", qtype: dnsmessage.TypeALL, answer: "192.0.2.20", count: 2},
+		{name: "NSEC proves nxdomain", domain: "b.nsec.test.", qtype: dnsmessage.TypeA, rcode: dnsmessage.RCodeNameError, denial: true},
+		{name: "NSEC proves nodata", domain: "a.nsec.test.", qtype: dnsmessage.TypeAAAA, denial: true},
+		{name: "NSEC3 proves nxdomain", domain: "b.nsec3.test.", qtype: dnsmessage.TypeA, rcode: dnsmessage.RCodeNameError, denial: true},
+		{name: "NSEC3 proves nodata", domain: "a.nsec3.test.", qtype: dnsmessage.TypeTXT, denial: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := c.Iterate(tt.domain, tt.qtype)
+			if err == nil && tt.qtype == dnsmessage.TypeALL {
+				res = anyFallback(res, func(qtype dnsmessage.Type) (dnsmessage.Message, error) {
+					return c.Iterate(tt.domain, qtype)
+				})
+			}
+
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if res.RCode != tt.rcode {
+				t.Fatalf("got %s, want %s", res.RCode, tt.rcode)
+			}
+			if tt.denial {
+				if lines, proven := explainDenial(tt.domain, tt.qtype, res); !proven {
+					t.Errorf("denial not proven: %s", strings.Join(lines, "; "))
+				}
+			}
+			if tt.answer == "" {
+				if len(res.Answers) > 0 {
+					t.Errorf("got %d answers, want none", len(res.Answers))
+				}
+				return
+			}
+			if len(res.Answers) == 0 {
+				t.Fatal("no answers")
+			}
+			if tt.count > 0 && len(res.Answers) != tt.count {
+				t.Errorf("got %d answers, want %d", len(res.Answers), tt.count)
+			}
+			if got := rdataString(res.Answers[0].Body); got != tt.answer {
+				t.Errorf("got answer %s, want %s", got, tt.answer)
+			}
+		})
+	}
+}
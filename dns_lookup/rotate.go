@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/netip"
+	"sync/atomic"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// rotate A/AAAA answers served from the cache (server mode)
+var rotateAnswers bool
+
+var rotation atomic.Uint64
+
+func recordAddr(rr dnsmessage.Resource) (netip.Addr, bool) {
+	switch body := rr.Body.(type) {
+	case *dnsmessage.AResource:
+		return netip.AddrFrom4(body.A), true
+	case *dnsmessage.AAAAResource:
+		return netip.AddrFrom16(body.AAAA), true
+	}
+	return netip.Addr{}, false
+}
+
+// move the address records round by one position per call
+func rotateAddresses(records []dnsmessage.Resource) []dnsmessage.Resource {
+	var positions []int
+	for i, rr := range records {
+		if _, ok := recordAddr(rr); ok {
+			positions = append(positions, i)
+		}
+	}
+	if len(positions) < 2 {
+		return records
+	}
+
+	shift := int(rotation.Add(1) % uint64(len(positions)))
+	rotated := make([]dnsmessage.Resource, len(records))
+	copy(rotated, records)
+	for i, pos := range positions {
+		rotated[pos] = records[positions[(i+shift)%len(positions)]]
+	}
+	return rotated
+}
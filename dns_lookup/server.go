@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// answer queries on addr by running the iterative lookup for each of them,
+// or by forwarding them when upstreams are configured
+func serve(addr string) error {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen: %w", err)
+	}
+	defer conn.Close()
+
+	fmt.Printf("Serving DNS on %s (udp)\n", conn.LocalAddr())
+
+	buf := make([]byte, 512)
+	for {
+		n, peer, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+
+		packet := make([]byte, n)
+		copy(packet, buf[:n])
+		go handleQuery(conn, peer, packet)
+	}
+}
+
+func handleQuery(conn net.PacketConn, peer net.Addr, packet []byte) {
+	received := time.Now()
+
+	var req dnsmessage.Message
+	if err := req.Unpack(packet); err != nil || req.Response || len(req.Questions) != 1 {
+		return // not something we can answer, drop it
+	}
+
+	metrics.countQuery(req.Questions[0].Name.String())
+	res := answer(req, peer)
+	packed, err := res.Pack()
+	if err != nil {
+		return
+	}
+
+	// classic 512 byte udp limit, client has to retry over tcp
+	if len(packed) > 512 {
+		res.Answers, res.Authorities = nil, nil
+		res.Truncated = true
+		if packed, err = res.Pack(); err != nil {
+			return
+		}
+	}
+
+	conn.WriteTo(packed, peer)
+
+	if tap != nil {
+		tap.logExchange(dnstapClientQuery, 1, peer.String(), packet, received, packed, time.Now())
+	}
+	if queryLog != nil {
+		q := req.Questions[0]
+		queryLog.logQuery(peer.String(), q.Name.String(), q.Type.String(), res.RCode.String(), time.Since(received))
+	}
+}
+
+// values served for CH TXT diagnostics, empty refuses the query
+var (
+	chaosVersion string
+	chaosID      string
+)
+
+// version.bind / hostname.bind / id.server / version.server
+func chaosAnswer(res dnsmessage.Message, q dnsmessage.Question) dnsmessage.Message {
+	var value string
+	switch strings.ToLower(q.Name.String()) {
+	case "version.bind.", "version.server.":
+		value = chaosVersion
+	case "hostname.bind.", "id.server.":
+		value = chaosID
+	}
+
+	if value == "" || (q.Type != dnsmessage.TypeTXT && q.Type != dnsmessage.TypeALL) {
+		res.RCode = dnsmessage.RCodeRefused
+		return res
+	}
+
+	res.Authoritative = true
+	res.Answers = []dnsmessage.Resource{{
+		Header: dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeTXT, Class: dnsmessage.ClassCHAOS},
+		Body:   &dnsmessage.TXTResource{TXT: []string{value}},
+	}}
+	return res
+}
+
+// build the response to a client request
+func answer(req dnsmessage.Message, peer net.Addr) dnsmessage.Message {
+	res := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:                 req.ID,
+			Response:           true,
+			OpCode:             req.OpCode,
+			RecursionDesired:   req.RecursionDesired,
+			RecursionAvailable: true,
+		},
+		Questions: req.Questions,
+	}
+
+	if req.OpCode != 0 {
+		res.RCode = dnsmessage.RCodeNotImplemented
+		return res
+	}
+
+	q := req.Questions[0]
+	if q.Class == dnsmessage.ClassCHAOS {
+		return chaosAnswer(res, q)
+	}
+	if q.Class != dnsmessage.ClassINET {
+		res.RCode = dnsmessage.RCodeRefused
+		return res
+	}
+
+	// filtered clients get their own cache view so answers don't leak between groups
+	view := ""
+	var category *filterCategory
+	if filters != nil {
+		category = filters.forClient(peer)
+	}
+	if category != nil {
+		switch category.override(q.Name.String()) {
+		case "block":
+			res.RCode = dnsmessage.RCodeNameError
+			return res
+		case "allow":
+			category = nil
+		default:
+			view = category.name
+		}
+	}
+
+	if cached, ok := cache.get(view, q); ok {
+		res.RCode = cached.RCode
+		res.Answers = cached.Answers
+		if rotateAnswers {
+			res.Answers = rotateAddresses(res.Answers)
+		}
+		res.Authorities = cached.Authorities
+		return res
+	}
+
+	var upstream dnsmessage.Message
+	var err error
+	switch {
+	case category != nil:
+		upstream, err = category.upstreams.forward(q)
+	case fwd != nil:
+		upstream, err = fwd.forward(q)
+	default:
+		upstream, err = client.Iterate(q.Name.String(), q.Type)
+	}
+	if err != nil {
+		metrics.countError(q.Name.String()+" "+typeName(q.Type), err)
+		res.RCode = dnsmessage.RCodeServerFailure
+		return res
+	}
+	cache.put(view, q, upstream)
+
+	res.RCode = upstream.RCode
+	res.Answers = upstream.Answers
+	res.Authorities = upstream.Authorities
+	return res
+}
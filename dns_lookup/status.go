@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+
+	"internet_services/dns_lookup/resolver"
+)
+
+// small HTTP status page and JSON API for server mode
+func serveStatus(addr string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", handleStatus)
+	mux.HandleFunc("/", handleDashboard)
+
+	fmt.Printf("Serving status on http://%s/ (JSON at /status)\n", addr)
+	return http.ListenAndServe(addr, mux)
+}
+
+type serverStatus struct {
+	Mode          string           `json:"mode"`
+	UptimeSeconds int64            `json:"uptime_seconds"`
+	Queries       uint64           `json:"queries"`
+	QPS           float64          `json:"qps"`
+	CacheSize     int              `json:"cache_size"`
+	CacheHits     uint64           `json:"cache_hits"`
+	CacheMisses   uint64           `json:"cache_misses"`
+	CacheHitRate  float64          `json:"cache_hit_rate"`
+	TopDomains    []domainCount    `json:"top_domains"`
+	RecentErrors  []recentError    `json:"recent_errors"`
+	Upstreams     []upstreamStatus `json:"upstreams,omitempty"`
+	Filters       []categoryStatus `json:"filter_categories,omitempty"`
+	Resolver      resolver.Stats   `json:"resolver"`
+}
+
+// the upstreams a filter category forwards to
+type categoryStatus struct {
+	Category  string           `json:"category"`
+	Upstreams []upstreamStatus `json:"upstreams"`
+}
+
+func currentStatus() serverStatus {
+	queries, uptime := metrics.totals()
+	size, hits, misses := cache.stats()
+
+	status := serverStatus{
+		Mode:          "recursive",
+		UptimeSeconds: int64(uptime.Seconds()),
+		Queries:       queries,
+		QPS:           metrics.qps(),
+		CacheSize:     size,
+		CacheHits:     hits,
+		CacheMisses:   misses,
+		TopDomains:    metrics.topDomains(10),
+		RecentErrors:  metrics.recentErrors(),
+		Resolver:      client.Stats(),
+	}
+	if hits+misses > 0 {
+		status.CacheHitRate = float64(hits) / float64(hits+misses)
+	}
+	if fwd != nil {
+		status.Mode = "forwarder"
+		status.Upstreams = fwd.status()
+	}
+	if filters != nil {
+		status.Filters = filters.status()
+	}
+	return status
+}
+
+func handleStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(currentStatus())
+}
+
+func handleDashboard(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	dashboard.Execute(w, currentStatus())
+}
+
+var dashboard = template.Must(template.New("dashboard").Funcs(template.FuncMap{
+	"percent": func(f float64) string { return fmt.Sprintf("%.1f%%", f*100) },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+    <meta http-equiv="refresh" content="5">
+    <title>dns_lookup status</title>
+    <style>
+        body { font-family: monospace; margin: 20px; }
+        table { border-collapse: collapse; margin-bottom: 20px; }
+        td, th { border: 1px solid #ccc; padding: 4px 8px; text-align: left; }
+        .down { color: red; }
+        .up { color: green; }
+    </style>
+</head>
+<body>
+    <h1>dns_lookup ({{.Mode}})</h1>
+    <table>
+        <tr><th>Uptime</th><td>{{.UptimeSeconds}}s</td></tr>
+        <tr><th>Queries</th><td>{{.Queries}}</td></tr>
+        <tr><th>QPS (1m)</th><td>{{printf "%.2f" .QPS}}</td></tr>
+        <tr><th>Cache size</th><td>{{.CacheSize}}</td></tr>
+        <tr><th>Cache hit rate</th><td>{{percent .CacheHitRate}} ({{.CacheHits}} hits / {{.CacheMisses}} misses)</td></tr>
+    </table>
+
+    {{if .Upstreams}}
+    <h2>Upstreams</h2>
+    {{template "upstreams" .Upstreams}}
+    {{end}}
+
+    {{range .Filters}}
+    <h2>Upstreams of the {{.Category}} filter</h2>
+    {{template "upstreams" .Upstreams}}
+    {{end}}
+
+    <h2>Top domains</h2>
+    <table>
+        <tr><th>Domain</th><th>Queries</th></tr>
+        {{range .TopDomains}}<tr><td>{{.Domain}}</td><td>{{.Count}}</td></tr>{{end}}
+    </table>
+
+    <h2>Recent errors</h2>
+    <table>
+        <tr><th>Time</th><th>Query</th><th>Error</th></tr>
+        {{range .RecentErrors}}<tr><td>{{.Time.Format "15:04:05"}}</td><td>{{.Query}}</td><td>{{.Error}}</td></tr>{{end}}
+    </table>
+</body>
+</html>
+{{define "upstreams"}}
+    <table>
+        <tr><th>Address</th><th>State</th><th>Failures</th><th>Last RTT</th><th>Last error</th></tr>
+        {{range .}}
+        <tr>
+            <td>{{.Addr}}</td>
+            <td>{{if .Healthy}}<span class="up">healthy</span>{{else}}<span class="down">unhealthy</span>{{end}}</td>
+            <td>{{.Failures}}</td>
+            <td>{{.LastRTT}}</td>
+            <td>{{.LastError}}</td>
+        </tr>
+        {{end}}
+    </table>
+{{end}}`))
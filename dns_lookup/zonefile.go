@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// print answers as master file lines instead of "-> Answer:" lines
+var zoneOutput bool
+
+// write records in RFC 1035 master file syntax: SOA first, the rest in
+// canonical order with absolute owner names, so the output loads into an
+// authoritative server and diffs cleanly against other dumps
+func writeZoneFile(w io.Writer, origin string, records []dnsmessage.Resource) error {
+	sorted := make([]dnsmessage.Resource, len(records))
+	copy(sorted, records)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		a, b := sorted[i].Header, sorted[j].Header
+		if (a.Type == dnsmessage.TypeSOA) != (b.Type == dnsmessage.TypeSOA) {
+			return a.Type == dnsmessage.TypeSOA
+		}
+		if c := canonicalCompare(a.Name.String(), b.Name.String()); c != 0 {
+			return c < 0
+		}
+		return a.Type < b.Type
+	})
+
+	out := bufio.NewWriter(w)
+	if origin != "" {
+		fmt.Fprintf(out, "$ORIGIN %s\n", origin)
+	}
+	for _, rr := range sorted {
+		fmt.Fprintln(out, zoneLine(rr))
+	}
+	return out.Flush()
+}
+
+func zoneLine(rr dnsmessage.Resource) string {
+	return fmt.Sprintf("%s\t%d\t%s\t%s\t%s", rr.Header.Name, rr.Header.TTL,
+		className(rr.Header.Class), typeName(rr.Header.Type), zoneRdata(rr.Body))
+}
+
+// like rdataString, but text is quoted with master file escapes instead of Go's
+func zoneRdata(body dnsmessage.ResourceBody) string {
+	switch b := body.(type) {
+	case *dnsmessage.TXTResource:
+		return zoneQuoteAll(b.TXT)
+	case *dnsmessage.UnknownResource:
+		if b.Type == typeHINFO {
+			return zoneQuoteAll(characterStrings(b.Data))
+		}
+		if b.Type == typeCAA {
+			if caa, err := parseCAA(b.Data); err == nil {
+				flags := 0
+				if caa.critical {
+					flags = 128
+				}
+				return fmt.Sprintf("%d %s %s", flags, caa.tag, zoneQuote(caa.value))
+			}
+		}
+	}
+	return rdataString(body)
+}
+
+func zoneQuoteAll(strs []string) string {
+	quoted := make([]string, len(strs))
+	for i, str := range strs {
+		quoted[i] = zoneQuote(str)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// RFC 1035 5.1: \" and \\ escaped, bytes outside printable ASCII as \DDD
+func zoneQuote(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < 0x20 || c > 0x7e:
+			fmt.Fprintf(&b, "\\%03d", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
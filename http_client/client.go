@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Client sends a request the way a service should: each attempt with its
+// own timeout, failed idempotent requests again after a backoff, and
+// redirects only as far as the policy allows. OnAttempt sees every
+// attempt with the timing of each of its requests, redirects included.
+type Client struct {
+	HTTP           *http.Client  // its Transport and Jar, default http.DefaultTransport
+	AttemptTimeout time.Duration // of an attempt, the response body included, default 10 seconds
+	Retries        int           // attempts after the first, default 2, negative for none
+	Backoff        time.Duration // before the first retry, doubling with jitter, default 200ms
+	MaxBackoff     time.Duration // default 10 seconds, which a Retry-After is capped at as well
+	MaxRedirects   int           // default 10, negative to return redirects as they are
+
+	OnAttempt func(Attempt)
+}
+
+// Attempt is one try of a request
+type Attempt struct {
+	Number int    // from 1
+	Hops   []*Hop // the request and the redirects it followed
+	Err    error  // why the attempt failed, nil if it got a response
+	Retry  bool   // whether another attempt follows
+	Wait   time.Duration
+}
+
+// the status codes worth another attempt: the server, or one in front of
+// it, said it may work later
+var retryStatus = map[int]bool{
+	http.StatusTooManyRequests:    true,
+	http.StatusBadGateway:         true,
+	http.StatusServiceUnavailable: true,
+	http.StatusGatewayTimeout:     true,
+}
+
+// ErrRedirectPolicy is the error of a redirect the policy refused
+var ErrRedirectPolicy = errors.New("redirect refused")
+
+// Do sends req. A request with a body is retried only when it has
+// GetBody, as http.NewRequest sets for the usual readers, and only when it
+// is idempotent: GET, HEAD, OPTIONS, TRACE, PUT, DELETE, or any with an
+// Idempotency-Key header. The response body must be closed, which also
+// ends the attempt's timeout.
+func (c *Client) Do(req *http.Request) (*http.Response, error) {
+	retries := c.Retries
+	if retries == 0 {
+		retries = 2
+	}
+	if !retryable(req) {
+		retries = 0
+	}
+	backoff := c.Backoff
+	if backoff <= 0 {
+		backoff = 200 * time.Millisecond
+	}
+
+	for number := 1; ; number++ {
+		resp, attempt, err := c.attempt(req, number)
+		// a refused redirect would be refused again
+		canRetry := number <= retries && req.Context().Err() == nil && !errors.Is(err, ErrRedirectPolicy)
+		if err == nil && !retryStatus[resp.StatusCode] || !canRetry {
+			c.report(attempt)
+			return resp, err
+		}
+
+		attempt.Retry = true
+		attempt.Wait = c.wait(backoff, resp)
+		c.report(attempt)
+		if resp != nil {
+			// drained a little, so that the connection can be reused
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+			resp.Body.Close()
+		}
+		timer := time.NewTimer(attempt.Wait)
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		}
+		backoff *= 2
+
+		if req.Body != nil && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, fmt.Errorf("failed to rewind the request body: %w", err)
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+	}
+}
+
+func (c *Client) report(attempt Attempt) {
+	if c.OnAttempt != nil {
+		c.OnAttempt(attempt)
+	}
+}
+
+func retryable(req *http.Request) bool {
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return false
+	}
+	switch req.Method {
+	case "", http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return req.Header.Get("Idempotency-Key") != ""
+}
+
+// the backoff with up to a quarter of jitter either way, so that clients
+// that failed together don't come back together; or the Retry-After of
+// resp, if it has one
+func (c *Client) wait(backoff time.Duration, resp *http.Response) time.Duration {
+	maxBackoff := c.MaxBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = 10 * time.Second
+	}
+	wait := backoff + time.Duration(rand.Int63n(int64(backoff)/2+1)) - backoff/4
+	if resp != nil {
+		if after, ok := retryAfter(resp.Header.Get("Retry-After")); ok {
+			wait = after
+		}
+	}
+	return min(max(wait, 0), maxBackoff)
+}
+
+// Retry-After in seconds or as an HTTP date
+func retryAfter(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return time.Until(t), true
+	}
+	return 0, false
+}
+
+// one attempt, with its timeout and a trace of each request
+func (c *Client) attempt(req *http.Request, number int) (*http.Response, Attempt, error) {
+	timeout := c.AttemptTimeout
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	attempt := Attempt{Number: number}
+	recorder := &traceRecorder{}
+	ctx, cancel := context.WithTimeout(withTrace(req.Context(), recorder), timeout)
+
+	client := http.Client{Transport: http.DefaultTransport}
+	if c.HTTP != nil {
+		client = *c.HTTP
+	}
+	client.Timeout = 0 // the attempt's context has it
+	client.CheckRedirect = c.checkRedirect
+
+	resp, err := client.Do(req.WithContext(ctx))
+	// with a redirect refused there is a response as well, its body closed
+	attempt.Hops = recorder.finish(req, resp)
+	if err != nil {
+		cancel()
+		attempt.Err = err
+		return nil, attempt, err
+	}
+	// the timeout covers reading the body, which the caller does
+	resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+	return resp, attempt, nil
+}
+
+// the redirect policy: at most MaxRedirects, and never from https to http,
+// which would send what was meant to be private in the clear
+func (c *Client) checkRedirect(req *http.Request, via []*http.Request) error {
+	maxRedirects := c.MaxRedirects
+	if maxRedirects == 0 {
+		maxRedirects = 10
+	}
+	if maxRedirects < 0 {
+		return http.ErrUseLastResponse
+	}
+	if len(via) > maxRedirects {
+		return fmt.Errorf("%w: more than %d redirects", ErrRedirectPolicy, maxRedirects)
+	}
+	if prev := via[len(via)-1]; prev.URL.Scheme == "https" && req.URL.Scheme != "https" {
+		return fmt.Errorf("%w: %s downgrades to %s", ErrRedirectPolicy, prev.URL.Redacted(), req.URL.Redacted())
+	}
+	return nil
+}
+
+// a body whose Close ends the attempt's context
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
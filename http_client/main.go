@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+)
+
+func main() {
+	var client Client
+	method := flag.String("X", "", "request method, default GET, or POST with -d")
+	data := flag.String("d", "", "request body, @file to read it from a file")
+	var headers []string
+	flag.Func("H", "request header \"Name: value\", repeatable", func(h string) error {
+		if !strings.Contains(h, ":") {
+			return fmt.Errorf("header %q has no colon", h)
+		}
+		headers = append(headers, h)
+		return nil
+	})
+	flag.DurationVar(&client.AttemptTimeout, "timeout", 10*time.Second, "per attempt, reading the body included")
+	flag.IntVar(&client.Retries, "retries", 2, "attempts after the first for idempotent requests, -1 for none")
+	flag.DurationVar(&client.Backoff, "backoff", 200*time.Millisecond, "before the first retry, doubling")
+	flag.IntVar(&client.MaxRedirects, "max-redirects", 10, "redirects to follow, -1 to return them as they are")
+	include := flag.Bool("i", false, "print the response status and headers before the body")
+	output := flag.String("o", "", "write the body to this file instead of stdout")
+	quiet := flag.Bool("q", false, "don't print the timing of each request")
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		fmt.Println("usage: http_client [flags] url")
+		os.Exit(2)
+	}
+	target := flag.Arg(0)
+	if !strings.Contains(target, "://") {
+		target = "https://" + target
+	}
+
+	var body io.Reader
+	if *data != "" {
+		if name, ok := strings.CutPrefix(*data, "@"); ok {
+			content, err := os.ReadFile(name)
+			if err != nil {
+				fmt.Println("Error:", err)
+				os.Exit(1)
+			}
+			body = strings.NewReader(string(content))
+		} else {
+			body = strings.NewReader(*data)
+		}
+		if *method == "" {
+			*method = http.MethodPost
+		}
+	}
+	if *method == "" {
+		*method = http.MethodGet
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	req, err := http.NewRequestWithContext(ctx, strings.ToUpper(*method), target, body)
+	if err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(2)
+	}
+	for _, h := range headers {
+		name, value, _ := strings.Cut(h, ":")
+		req.Header.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+	if body != nil && req.Header.Get("Content-Type") == "" {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	if !*quiet {
+		// to stderr, so that the body on stdout stays clean
+		client.OnAttempt = func(a Attempt) { printAttempt(os.Stderr, a) }
+	}
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+	defer resp.Body.Close()
+
+	out := io.Writer(os.Stdout)
+	if *output != "" {
+		file, err := os.Create(*output)
+		if err != nil {
+			fmt.Println("Error:", err)
+			os.Exit(1)
+		}
+		defer file.Close()
+		out = file
+	}
+	if *include {
+		fmt.Fprintf(out, "%s %s\r\n", resp.Proto, resp.Status)
+		resp.Header.Write(out)
+		fmt.Fprint(out, "\r\n")
+	}
+	n, err := io.Copy(out, resp.Body)
+	if err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+	if !*quiet {
+		fmt.Fprintf(os.Stderr, "* %d bytes in %s\n", n, time.Since(start).Round(time.Millisecond))
+	}
+}
+
+// a line per request of the attempt and its phases
+func printAttempt(w io.Writer, a Attempt) {
+	ms := func(d time.Duration) string {
+		return fmt.Sprintf("%.1fms", float64(d.Microseconds())/1000)
+	}
+	for _, hop := range a.Hops {
+		status := "---"
+		if hop.Status != 0 {
+			status = fmt.Sprint(hop.Status)
+		}
+		fmt.Fprintf(w, "* #%d %s %s %s\n", a.Number, hop.Method, hop.URL, status)
+		var phases []string
+		if hop.Reused {
+			phases = append(phases, "reused connection")
+		} else {
+			phases = append(phases, "dns "+ms(hop.DNS), "connect "+ms(hop.Connect))
+			if hop.TLS > 0 {
+				phases = append(phases, "tls "+ms(hop.TLS))
+			}
+		}
+		if hop.TTFB > 0 {
+			phases = append(phases, "server "+ms(hop.Wait), "ttfb "+ms(hop.TTFB))
+		}
+		if hop.Addr != "" {
+			phases = append(phases, hop.Addr)
+		}
+		if hop.Proto != "" {
+			phases = append(phases, hop.Proto)
+		}
+		fmt.Fprintf(w, "*   %s\n", strings.Join(phases, ", "))
+	}
+	if a.Err != nil {
+		fmt.Fprintf(w, "*   failed: %v\n", a.Err)
+	}
+	if a.Retry {
+		fmt.Fprintf(w, "*   retrying in %s\n", a.Wait.Round(time.Millisecond))
+	}
+}
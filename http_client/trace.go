@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// Hop is one request of an attempt, the first or a redirect, and where
+// its time went. A phase the request skipped, such as DNS and connect on
+// a reused connection or TLS for http, is zero.
+type Hop struct {
+	Method string
+	URL    string
+	Status int // 0 when it got no response
+
+	Addr   string // of the server, when it got a connection
+	Reused bool   // an idle keep-alive connection
+	Proto  string // of the TLS connection, eg. "h2" from ALPN
+
+	DNS     time.Duration
+	Connect time.Duration // TCP, the successful one of happy eyeballs
+	TLS     time.Duration
+	Wait    time.Duration // from the request written to the first response byte: the server's time
+	TTFB    time.Duration // from the start of the request
+}
+
+// collects the hops of an attempt from the httptrace hooks, which the
+// transport may call from more than one goroutine
+type traceRecorder struct {
+	mu   sync.Mutex
+	hops []*hopTrace
+}
+
+type hopTrace struct {
+	Hop
+	start, dnsStart, connectStart, tlsStart, wrote time.Time
+}
+
+func withTrace(ctx context.Context, r *traceRecorder) context.Context {
+	// the current hop
+	hop := func() *hopTrace {
+		if len(r.hops) == 0 {
+			r.hops = append(r.hops, &hopTrace{start: time.Now()})
+		}
+		return r.hops[len(r.hops)-1]
+	}
+	locked := func(f func(h *hopTrace)) {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		f(hop())
+	}
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GetConn: func(string) {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			// every request of the attempt starts by asking for a connection
+			r.hops = append(r.hops, &hopTrace{start: time.Now()})
+		},
+		DNSStart: func(httptrace.DNSStartInfo) {
+			locked(func(h *hopTrace) { h.dnsStart = time.Now() })
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			locked(func(h *hopTrace) { h.DNS = time.Since(h.dnsStart) })
+		},
+		ConnectStart: func(string, string) {
+			locked(func(h *hopTrace) {
+				if h.connectStart.IsZero() {
+					h.connectStart = time.Now()
+				}
+			})
+		},
+		ConnectDone: func(_, _ string, err error) {
+			locked(func(h *hopTrace) {
+				if err == nil && h.Connect == 0 {
+					h.Connect = time.Since(h.connectStart)
+				}
+			})
+		},
+		TLSHandshakeStart: func() {
+			locked(func(h *hopTrace) { h.tlsStart = time.Now() })
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			locked(func(h *hopTrace) {
+				h.TLS = time.Since(h.tlsStart)
+				h.Proto = state.NegotiatedProtocol
+			})
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			locked(func(h *hopTrace) {
+				h.Addr, h.Reused = info.Conn.RemoteAddr().String(), info.Reused
+			})
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			locked(func(h *hopTrace) { h.wrote = time.Now() })
+		},
+		GotFirstResponseByte: func() {
+			locked(func(h *hopTrace) {
+				h.TTFB = time.Since(h.start)
+				if !h.wrote.IsZero() {
+					h.Wait = time.Since(h.wrote)
+				}
+			})
+		},
+	})
+}
+
+// the hops, with the method, URL and status of each request of the
+// redirect chain that ended at resp
+func (r *traceRecorder) finish(req *http.Request, resp *http.Response) []*Hop {
+	// the chain from the last request back to the first
+	var requests []*http.Request
+	var statuses []int
+	if resp != nil {
+		status := resp.StatusCode
+		for last := resp.Request; last != nil; {
+			requests = append([]*http.Request{last}, requests...)
+			statuses = append([]int{status}, statuses...)
+			if last.Response == nil {
+				break
+			}
+			status, last = last.Response.StatusCode, last.Response.Request
+		}
+	} else {
+		requests = []*http.Request{req}
+		statuses = []int{0}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	hops := make([]*Hop, 0, len(r.hops))
+	for i, h := range r.hops {
+		hop := h.Hop
+		if i < len(requests) {
+			hop.Method, hop.URL, hop.Status = requests[i].Method, requests[i].URL.Redacted(), statuses[i]
+		}
+		hops = append(hops, &hop)
+	}
+	if len(hops) == 0 {
+		// failed before asking for a connection
+		hops = append(hops, &Hop{Method: req.Method, URL: req.URL.Redacted()})
+	}
+	return hops
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// fileServer serves the files under Root: a file with ranges and
+// conditional requests as http.ServeContent does them, a directory by its
+// index.html or a listing, and uploads when Upload is set
+type fileServer struct {
+	Root          string
+	Upload        bool
+	MaxUploadSize int64 // per request
+	ShowHidden    bool  // dot files in listings and to requests
+}
+
+func (s *fileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		s.serve(w, r)
+	case http.MethodPost, http.MethodPut:
+		if !s.Upload {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "uploads are disabled", http.StatusMethodNotAllowed)
+			return
+		}
+		if r.Method == http.MethodPost {
+			s.uploadForm(w, r)
+		} else {
+			s.put(w, r)
+		}
+	default:
+		allow := "GET, HEAD"
+		if s.Upload {
+			allow += ", POST, PUT"
+		}
+		w.Header().Set("Allow", allow)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// the file system path of a URL path, "" if it may not be served: a
+// hidden one, or one that isn't a name under Root
+func (s *fileServer) resolve(urlPath string) string {
+	clean := path.Clean("/" + urlPath)
+	if !s.ShowHidden {
+		for _, part := range strings.Split(clean, "/") {
+			if strings.HasPrefix(part, ".") {
+				return ""
+			}
+		}
+	}
+	// Clean took out "..", but a backslash on windows would be a separator
+	// the URL path doesn't know of
+	if filepath.Separator != '/' && strings.ContainsRune(clean, filepath.Separator) || strings.ContainsRune(clean, 0) {
+		return ""
+	}
+	return filepath.Join(s.Root, filepath.FromSlash(clean))
+}
+
+func (s *fileServer) serve(w http.ResponseWriter, r *http.Request) {
+	name := s.resolve(r.URL.Path)
+	if name == "" {
+		http.NotFound(w, r)
+		return
+	}
+	info, err := os.Stat(name)
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+
+	if info.IsDir() {
+		if !strings.HasSuffix(r.URL.Path, "/") {
+			// relative links in the listing need the slash
+			http.Redirect(w, r, path.Base(r.URL.Path)+"/", http.StatusMovedPermanently)
+			return
+		}
+		index := filepath.Join(name, "index.html")
+		if indexInfo, err := os.Stat(index); err == nil && !indexInfo.IsDir() {
+			s.serveFile(w, r, index, indexInfo)
+			return
+		}
+		s.list(w, r, name)
+		return
+	}
+	s.serveFile(w, r, name, info)
+}
+
+func (s *fileServer) serveFile(w http.ResponseWriter, r *http.Request, name string, info fs.FileInfo) {
+	file, err := os.Open(name)
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	defer file.Close()
+	// Range, If-Range, If-Modified-Since and the Content-Type from the
+	// extension or the content
+	http.ServeContent(w, r, info.Name(), info.ModTime(), file)
+}
+
+// a directory entry of the listing
+type listEntry struct {
+	Name    string
+	URL     string
+	Dir     bool
+	Size    int64
+	ModTime time.Time
+}
+
+var listTemplate = template.Must(template.New("list").Funcs(template.FuncMap{
+	"size": humanSize,
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width">
+<title>Index of {{.Path}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+td, th { padding: 0.2em 1em; text-align: left; }
+td.size { text-align: right; }
+</style>
+</head>
+<body>
+<h1>Index of {{.Path}}</h1>
+<table>
+<tr><th>Name</th><th>Size</th><th>Modified</th></tr>
+{{if ne .Path "/"}}<tr><td><a href="../">../</a></td><td></td><td></td></tr>
+{{end}}{{range .Entries}}<tr><td><a href="{{.URL}}">{{.Name}}{{if .Dir}}/{{end}}</a></td><td class="size">{{if not .Dir}}{{size .Size}}{{end}}</td><td>{{.ModTime.Format "2006-01-02 15:04"}}</td></tr>
+{{end}}</table>
+{{if .Upload}}<hr>
+<form method="post" enctype="multipart/form-data">
+<input type="file" name="file" multiple required>
+<button type="submit">Upload</button>
+</form>
+{{end}}</body>
+</html>
+`))
+
+func (s *fileServer) list(w http.ResponseWriter, r *http.Request, dir string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	var list []listEntry
+	for _, entry := range entries {
+		if !s.ShowHidden && strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			// gone since ReadDir
+			continue
+		}
+		e := listEntry{Name: entry.Name(), Dir: info.IsDir(), Size: info.Size(), ModTime: info.ModTime()}
+		// a link relative to the directory, ./ so that a name with a colon
+		// isn't taken for a scheme
+		e.URL = "./" + (&url.URL{Path: entry.Name()}).EscapedPath()
+		if e.Dir {
+			e.URL += "/"
+		}
+		list = append(list, e)
+	}
+	// directories first, then by name
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Dir != list[j].Dir {
+			return list[i].Dir
+		}
+		return strings.ToLower(list[i].Name) < strings.ToLower(list[j].Name)
+	})
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	if r.Method == http.MethodHead {
+		return
+	}
+	err = listTemplate.Execute(w, struct {
+		Path    string
+		Entries []listEntry
+		Upload  bool
+	}{r.URL.Path, list, s.Upload})
+	if err != nil {
+		log.Printf("listing %s: %v", r.URL.Path, err)
+	}
+}
+
+// sizes as ls -h writes them
+func humanSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// the status of a file system error, without the path in the message
+func httpError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		http.NotFound(w, r)
+	case errors.Is(err, fs.ErrPermission):
+		http.Error(w, "forbidden", http.StatusForbidden)
+	default:
+		log.Printf("%s %s: %v", r.Method, r.URL.Path, err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+	}
+}
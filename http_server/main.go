@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+func main() {
+	var files fileServer
+	addr := flag.String("addr", ":8000", "address to listen on")
+	flag.StringVar(&files.Root, "dir", ".", "directory to serve")
+	flag.BoolVar(&files.Upload, "upload", false, "accept uploads: a form POSTed to a directory, or a PUT of a file")
+	files.MaxUploadSize = 1 << 30
+	flag.Func("max-upload", "the most bytes of an upload, with a K, M or G suffix, 0 for no limit (default 1G)", func(s string) error {
+		n, err := parseSize(s)
+		files.MaxUploadSize = n
+		return err
+	})
+	flag.BoolVar(&files.ShowHidden, "hidden", false, "serve dot files too")
+	auth := flag.String("auth", "", "user:password to require, default $HTTP_SERVER_AUTH, which ps doesn't show")
+	certFile := flag.String("tls-cert", "", "certificate file, to serve https")
+	keyFile := flag.String("tls-key", "", "key file of -tls-cert")
+	grace := flag.Duration("shutdown-timeout", 10*time.Second, "for requests in flight to finish on SIGINT or SIGTERM")
+	quiet := flag.Bool("q", false, "don't log requests")
+	flag.Parse()
+
+	if flag.NArg() > 0 {
+		fmt.Println("usage: http_server [flags]")
+		os.Exit(2)
+	}
+	if (*certFile == "") != (*keyFile == "") {
+		fmt.Println("Error: -tls-cert and -tls-key go together")
+		os.Exit(2)
+	}
+	root, err := filepath.Abs(files.Root)
+	if err == nil {
+		var info os.FileInfo
+		if info, err = os.Stat(root); err == nil && !info.IsDir() {
+			err = fmt.Errorf("%s is not a directory", root)
+		}
+	}
+	if err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+	files.Root = root
+
+	var handler http.Handler = &files
+	if *auth == "" {
+		*auth = os.Getenv("HTTP_SERVER_AUTH")
+	}
+	if *auth != "" {
+		basic, err := parseAuth(*auth)
+		if err != nil {
+			fmt.Println("Error:", err)
+			os.Exit(2)
+		}
+		handler = basic.Wrap(handler)
+	}
+	if !*quiet {
+		handler = logRequests(handler)
+	}
+
+	ln, err := net.Listen("tcp", *addr)
+	if err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+	srv := &http.Server{
+		Handler: handler,
+		// no WriteTimeout, a large download takes as long as it takes
+		ReadHeaderTimeout: 10 * time.Second,
+		IdleTimeout:       2 * time.Minute,
+	}
+	scheme := "http"
+	if *certFile != "" {
+		scheme = "https"
+	}
+	fmt.Printf("Serving %s on %s://%s/\n", root, scheme, ln.Addr())
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	served := make(chan error, 1)
+	go func() {
+		if *certFile != "" {
+			served <- srv.ServeTLS(ln, *certFile, *keyFile)
+		} else {
+			served <- srv.Serve(ln)
+		}
+	}()
+
+	select {
+	case err := <-served:
+		// it didn't get to start
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	case <-ctx.Done():
+	}
+	// a second signal kills it the usual way
+	stop()
+	fmt.Println("Shutting down, waiting for requests in flight")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), *grace)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		srv.Close()
+		fmt.Println("Error: requests cut off:", err)
+		os.Exit(1)
+	}
+	if err := <-served; !errors.Is(err, http.ErrServerClosed) {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+}
+
+// sizes such as 1048576, 512K or 1G
+func parseSize(s string) (int64, error) {
+	shift := 0
+	switch {
+	case strings.HasSuffix(strings.ToUpper(s), "K"):
+		shift = 10
+	case strings.HasSuffix(strings.ToUpper(s), "M"):
+		shift = 20
+	case strings.HasSuffix(strings.ToUpper(s), "G"):
+		shift = 30
+	}
+	digits := s
+	if shift > 0 {
+		digits = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil || n < 0 || n > 1<<(62-shift) {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n << shift, nil
+}
+
+// a line per request, as python -m http.server logs them
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		log.Printf("%s %s %s %d %d %s", r.RemoteAddr, r.Method, r.URL.RequestURI(), rec.status, rec.bytes, time.Since(start).Round(time.Millisecond))
+	})
+}
+
+// a ResponseWriter noting the status and the body bytes
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+	return n, err
+}
+
+// what io.Copy looks for, so that ServeContent still gets to use
+// sendfile
+func (r *statusRecorder) ReadFrom(src io.Reader) (int64, error) {
+	n, err := io.Copy(r.ResponseWriter, src)
+	r.bytes += n
+	return n, err
+}
+
+// for http.ResponseController
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// the mode of uploaded files, as a shell's umask of 022 leaves them
+const uploadMode = 0o644
+
+// a POST of a multipart form to a directory: the files of its parts saved
+// in the directory as they stream in, each under its own name or, if that
+// is taken, "name (1).ext" and so on. A browser is sent back to the
+// listing; the body says the names the files got, for curl -F.
+func (s *fileServer) uploadForm(w http.ResponseWriter, r *http.Request) {
+	dir := s.resolve(r.URL.Path)
+	if dir == "" {
+		http.NotFound(w, r)
+		return
+	}
+	if info, err := os.Stat(dir); err != nil {
+		httpError(w, r, err)
+		return
+	} else if !info.IsDir() {
+		http.Error(w, "post a form to a directory, or put a file", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.limit(w, r) {
+		return
+	}
+	reader, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, "expected a multipart/form-data body", http.StatusBadRequest)
+		return
+	}
+
+	var saved []string
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			uploadError(w, r, err)
+			return
+		}
+		// FileName has only the last element of what the client sent
+		name := part.FileName()
+		if part.FormName() != "file" || name == "" {
+			continue
+		}
+		if !s.validName(name) {
+			http.Error(w, fmt.Sprintf("invalid file name %q", name), http.StatusBadRequest)
+			return
+		}
+		name, err = saveNew(dir, name, part)
+		if err != nil {
+			uploadError(w, r, err)
+			return
+		}
+		log.Printf("upload: %s saved %s", r.RemoteAddr, path.Join(r.URL.Path, name))
+		saved = append(saved, name)
+	}
+	if len(saved) == 0 {
+		http.Error(w, `no files in the form's "file" field`, http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Location", r.URL.Path)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusSeeOther)
+	for _, name := range saved {
+		fmt.Fprintln(w, name)
+	}
+}
+
+// a PUT of a file, as curl -T does it: the body written beside it and
+// renamed over it once complete, so that a reader never sees half of it.
+// The directory has to be there already.
+func (s *fileServer) put(w http.ResponseWriter, r *http.Request) {
+	name := s.resolve(r.URL.Path)
+	if name == "" || strings.HasSuffix(r.URL.Path, "/") || !s.validName(path.Base(r.URL.Path)) {
+		http.Error(w, "put a file to its path", http.StatusBadRequest)
+		return
+	}
+	existed := false
+	if info, err := os.Stat(name); err == nil {
+		if info.IsDir() {
+			http.Error(w, "a directory is in the way", http.StatusConflict)
+			return
+		}
+		existed = true
+	}
+	if info, err := os.Stat(filepath.Dir(name)); err != nil || !info.IsDir() {
+		http.Error(w, "the directory doesn't exist", http.StatusConflict)
+		return
+	}
+	if !s.limit(w, r) {
+		return
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(name), ".upload-*")
+	if err != nil {
+		uploadError(w, r, err)
+		return
+	}
+	_, err = io.Copy(tmp, r.Body)
+	if err == nil {
+		err = tmp.Chmod(uploadMode)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), name)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		uploadError(w, r, err)
+		return
+	}
+	log.Printf("upload: %s put %s", r.RemoteAddr, r.URL.Path)
+
+	if existed {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Location", r.URL.Path)
+	w.WriteHeader(http.StatusCreated)
+}
+
+// whether an upload may be named name; a hidden one would be as good as
+// lost, and refused when asked for
+func (s *fileServer) validName(name string) bool {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\\\x00") {
+		return false
+	}
+	return s.ShowHidden || !strings.HasPrefix(name, ".")
+}
+
+// the body cut at MaxUploadSize; false, with the response sent, if its
+// Content-Length is over it already
+func (s *fileServer) limit(w http.ResponseWriter, r *http.Request) bool {
+	if s.MaxUploadSize <= 0 {
+		return true
+	}
+	if r.ContentLength > s.MaxUploadSize {
+		http.Error(w, fmt.Sprintf("uploads are limited to %s", humanSize(s.MaxUploadSize)), http.StatusRequestEntityTooLarge)
+		return false
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, s.MaxUploadSize)
+	return true
+}
+
+// r saved as a new file in dir, name or the first free "name (n).ext";
+// the name it got. A file cut short is removed.
+func saveNew(dir, name string, r io.Reader) (string, error) {
+	ext := filepath.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+	for n := 1; ; n++ {
+		file, err := os.OpenFile(filepath.Join(dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, uploadMode)
+		if errors.Is(err, fs.ErrExist) {
+			name = fmt.Sprintf("%s (%d)%s", stem, n, ext)
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		_, err = io.Copy(file, r)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(file.Name())
+			return "", err
+		}
+		return name, nil
+	}
+}
+
+// the status of a failed upload: too large, what httpError makes of a file
+// system error, or else a body that broke off or didn't parse
+func uploadError(w http.ResponseWriter, r *http.Request, err error) {
+	var tooLarge *http.MaxBytesError
+	var pathErr *fs.PathError
+	var linkErr *os.LinkError
+	switch {
+	case errors.As(err, &tooLarge):
+		http.Error(w, fmt.Sprintf("uploads are limited to %s", humanSize(tooLarge.Limit)), http.StatusRequestEntityTooLarge)
+	case errors.As(err, &pathErr), errors.As(err, &linkErr):
+		httpError(w, r, err)
+	default:
+		http.Error(w, "failed to read the upload", http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Consensus is the offset the servers agree on. Each response puts the
+// true offset within Offset ± Delay/2; the largest group of servers
+// whose intervals overlap are the truechimers (Marzullo's algorithm, as
+// ntpd's clock select) and the others, falsetickers, are left out.
+type Consensus struct {
+	Offset    time.Duration // the median of the truechimers'
+	Agreeing  []*Response   // the truechimers, by offset
+	Outliers  []*Response   // the falsetickers
+	Failed    []error       // servers that didn't answer usefully
+	Responses []*Response   // every answer, in the order of the servers
+}
+
+// no server QueryAll asked answered
+var ErrNoResponse = errors.New("no NTP server answered")
+
+// the most addresses asked of one name, pool.ntp.org has 4 at a time
+const maxAddrsPerName = 4
+
+// QueryAll asks every address of every server at once, eg. the four
+// pool.ntp.org resolves to, and returns what they agree on
+func QueryAll(ctx context.Context, servers []string) (*Consensus, error) {
+	var targets []string
+	var failed []error
+	for _, server := range servers {
+		addrs, err := resolve(ctx, server)
+		if err != nil {
+			failed = append(failed, err)
+			continue
+		}
+		targets = append(targets, addrs...)
+	}
+
+	responses := make([]*Response, len(targets))
+	errs := make([]error, len(targets))
+	var wg sync.WaitGroup
+	for i, target := range targets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			responses[i], errs[i] = Query(ctx, target)
+		}()
+	}
+	wg.Wait()
+
+	c := &Consensus{Failed: failed}
+	for i := range targets {
+		if errs[i] != nil {
+			c.Failed = append(c.Failed, errs[i])
+			continue
+		}
+		c.Responses = append(c.Responses, responses[i])
+	}
+	if len(c.Responses) == 0 {
+		return c, fmt.Errorf("%w: %w", ErrNoResponse, errors.Join(c.Failed...))
+	}
+	c.selectTruechimers()
+	return c, nil
+}
+
+// the addresses of server, host or host:port, as host:port
+func resolve(ctx context.Context, server string) ([]string, error) {
+	host, port, err := net.SplitHostPort(server)
+	if err != nil {
+		host, port = server, ntpPort
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return []string{net.JoinHostPort(host, port)}, nil
+	}
+	addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %s: %w", host, err)
+	}
+	if len(addrs) > maxAddrsPerName {
+		addrs = addrs[:maxAddrsPerName]
+	}
+	for i, addr := range addrs {
+		addrs[i] = net.JoinHostPort(addr, port)
+	}
+	return addrs, nil
+}
+
+// Marzullo's algorithm: the point most intervals contain, and the
+// responses whose intervals do
+func (c *Consensus) selectTruechimers() {
+	type edge struct {
+		at    time.Duration
+		start bool
+	}
+	var edges []edge
+	for _, r := range c.Responses {
+		// the delay doesn't tell the server's own error; its root
+		// dispersion and a little for the sake of a loopback server do
+		margin := r.Delay/2 + r.RootDispersion + time.Millisecond
+		edges = append(edges, edge{r.Offset - margin, true}, edge{r.Offset + margin, false})
+	}
+	// at the same point the starts go first, touching intervals overlap
+	sort.Slice(edges, func(i, j int) bool {
+		if edges[i].at != edges[j].at {
+			return edges[i].at < edges[j].at
+		}
+		return edges[i].start && !edges[j].start
+	})
+	best, count := 0, 0
+	var bestAt time.Duration
+	for _, e := range edges {
+		if e.start {
+			count++
+			if count > best {
+				best, bestAt = count, e.at
+			}
+		} else {
+			count--
+		}
+	}
+
+	for _, r := range c.Responses {
+		margin := r.Delay/2 + r.RootDispersion + time.Millisecond
+		if r.Offset-margin <= bestAt && bestAt <= r.Offset+margin {
+			c.Agreeing = append(c.Agreeing, r)
+		} else {
+			c.Outliers = append(c.Outliers, r)
+		}
+	}
+	slices.SortFunc(c.Agreeing, func(a, b *Response) int {
+		return cmp.Compare(a.Offset, b.Offset)
+	})
+	n := len(c.Agreeing)
+	c.Offset = c.Agreeing[n/2].Offset
+	if n%2 == 0 {
+		c.Offset = (c.Agreeing[n/2-1].Offset + c.Agreeing[n/2].Offset) / 2
+	}
+}
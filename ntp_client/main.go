@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+func main() {
+	servers := flag.String("servers", "pool.ntp.org", "comma separated servers to ask, host or host:port")
+	timeout := flag.Duration("timeout", 5*time.Second, "for all the queries")
+	flag.Parse()
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	consensus, err := QueryAll(ctx, strings.Split(*servers, ","))
+	if err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("%-40s %7s %-16s %12s %12s\n", "server", "stratum", "reference", "offset", "delay")
+	for _, r := range consensus.Responses {
+		mark := ""
+		for _, o := range consensus.Outliers {
+			if o == r {
+				mark = " (outlier)"
+			}
+		}
+		fmt.Printf("%-40s %7d %-16s %12s %12s%s\n", r.Server, r.Stratum, r.Reference,
+			r.Offset.Round(time.Microsecond), r.Delay.Round(time.Microsecond), mark)
+	}
+	for _, err := range consensus.Failed {
+		fmt.Println("failed:", err)
+	}
+	fmt.Printf("\nconsensus offset %s from %d of %d servers\n",
+		consensus.Offset.Round(time.Microsecond), len(consensus.Agreeing), len(consensus.Responses))
+	fmt.Println("server time     ", time.Now().Add(consensus.Offset).Format(time.RFC3339Nano))
+}
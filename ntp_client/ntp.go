@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net"
+	"strings"
+	"time"
+)
+
+// SNTP (RFC 4330): one request, one reply, and from the four timestamps
+// of the exchange the offset of the local clock and the round trip delay
+const ntpPort = "123"
+
+// the size of a packet without extension fields or a MAC
+const packetSize = 48
+
+const (
+	modeClient = 3
+	modeServer = 4
+	ntpVersion = 4
+)
+
+// leap indicator 3: the server's clock isn't synchronised
+const leapNotSync = 3
+
+// the seconds from the NTP epoch, 1900, to the Unix one
+const ntpEpochOffset = 2208988800
+
+// a packet, the header fields of RFC 5905 section 7.3
+type packet struct {
+	Leap           uint8
+	Version        uint8
+	Mode           uint8
+	Stratum        uint8
+	Poll           int8
+	Precision      int8
+	RootDelay      time.Duration
+	RootDispersion time.Duration
+	ReferenceID    [4]byte
+	Reference      uint64 // timestamps in NTP format, 32.32 fixed point
+	Origin         uint64
+	Receive        uint64
+	Transmit       uint64
+}
+
+func (p *packet) marshal() []byte {
+	b := make([]byte, packetSize)
+	b[0] = p.Leap<<6 | p.Version<<3 | p.Mode
+	b[1] = p.Stratum
+	b[2] = byte(p.Poll)
+	b[3] = byte(p.Precision)
+	binary.BigEndian.PutUint32(b[4:], toShort(p.RootDelay))
+	binary.BigEndian.PutUint32(b[8:], toShort(p.RootDispersion))
+	copy(b[12:16], p.ReferenceID[:])
+	binary.BigEndian.PutUint64(b[16:], p.Reference)
+	binary.BigEndian.PutUint64(b[24:], p.Origin)
+	binary.BigEndian.PutUint64(b[32:], p.Receive)
+	binary.BigEndian.PutUint64(b[40:], p.Transmit)
+	return b
+}
+
+func parsePacket(b []byte) (*packet, error) {
+	if len(b) < packetSize {
+		return nil, fmt.Errorf("short NTP packet of %d bytes", len(b))
+	}
+	return &packet{
+		Leap:           b[0] >> 6,
+		Version:        b[0] >> 3 & 7,
+		Mode:           b[0] & 7,
+		Stratum:        b[1],
+		Poll:           int8(b[2]),
+		Precision:      int8(b[3]),
+		RootDelay:      fromShort(binary.BigEndian.Uint32(b[4:])),
+		RootDispersion: fromShort(binary.BigEndian.Uint32(b[8:])),
+		ReferenceID:    [4]byte(b[12:16]),
+		Reference:      binary.BigEndian.Uint64(b[16:]),
+		Origin:         binary.BigEndian.Uint64(b[24:]),
+		Receive:        binary.BigEndian.Uint64(b[32:]),
+		Transmit:       binary.BigEndian.Uint64(b[40:]),
+	}, nil
+}
+
+// a time as an NTP timestamp
+func toTimestamp(t time.Time) uint64 {
+	secs := uint64(t.Unix() + ntpEpochOffset) // wraps in 2036, era 1, as it should
+	frac := uint64(t.Nanosecond()) << 32 / 1e9
+	return secs<<32 | frac
+}
+
+// an NTP timestamp as a time; seconds with the top bit clear are taken
+// to be in era 1, from 2036 on, so that this works for the next 100 years
+func fromTimestamp(ts uint64) time.Time {
+	secs := int64(ts >> 32)
+	if secs&0x80000000 == 0 {
+		secs += 1 << 32
+	}
+	nsec := int64((ts & 0xffffffff) * 1e9 >> 32)
+	return time.Unix(secs-ntpEpochOffset, nsec)
+}
+
+// the 16.16 fixed point format of the root delay and dispersion
+func toShort(d time.Duration) uint32 {
+	return uint32(d * (1 << 16) / time.Second)
+}
+
+func fromShort(v uint32) time.Duration {
+	return time.Duration(uint64(v) * uint64(time.Second) >> 16)
+}
+
+// Response is what one server said and what it makes of the local clock
+type Response struct {
+	Server    string // the address asked
+	Stratum   int    // 1 for a server with a reference clock, eg. GPS
+	Reference string // its reference clock for stratum 1, eg. "GPS", its upstream's address otherwise
+	Leap      int    // 1 or 2 when a leap second is due at the end of the day
+	Precision time.Duration
+
+	RootDelay      time.Duration // to the reference clock
+	RootDispersion time.Duration
+
+	Time   time.Time     // the server's, when it sent the reply
+	Offset time.Duration // to add to the local clock to be on the server's
+	Delay  time.Duration // the round trip, less the time the server took
+}
+
+// the error of a server's kiss-o'-death reply (RFC 5905 section 7.4),
+// eg. RATE to ask for fewer queries or DENY
+type KissError struct {
+	Server string
+	Code   string
+}
+
+func (e *KissError) Error() string {
+	return fmt.Sprintf("%s refused the query: kiss code %s", e.Server, e.Code)
+}
+
+// Query asks one server, a host or host:port; with a host name its first
+// address
+func Query(ctx context.Context, server string) (*Response, error) {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, ntpPort)
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", server)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", server, err)
+	}
+	defer conn.Close()
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(5 * time.Second)
+	}
+	conn.SetDeadline(deadline)
+
+	// the transmit timestamp comes back as the reply's origin, random bits
+	// in it keep an off-path attacker from guessing it (RFC 5905 section 9.1)
+	var noise [4]byte
+	rand.Read(noise[:])
+	sent := time.Now()
+	origin := toTimestamp(sent)&^0xffffffff | uint64(binary.BigEndian.Uint32(noise[:]))
+	request := packet{Version: ntpVersion, Mode: modeClient, Transmit: origin}
+	if _, err := conn.Write(request.marshal()); err != nil {
+		return nil, fmt.Errorf("failed to query %s: %w", server, err)
+	}
+
+	buf := make([]byte, 1024)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, fmt.Errorf("no reply from %s: %w", server, err)
+		}
+		// the monotonic clock for the round trip, a step of the wall clock
+		// meanwhile doesn't skew it
+		received := sent.Add(time.Since(sent))
+		reply, err := parsePacket(buf[:n])
+		if err != nil || reply.Mode != modeServer || reply.Origin != origin {
+			// a stray or forged packet, wait for the real reply
+			continue
+		}
+		return newResponse(conn.RemoteAddr().String(), reply, sent, received)
+	}
+}
+
+// the offset and delay of a reply (RFC 4330 section 5)
+func newResponse(server string, reply *packet, sent, received time.Time) (*Response, error) {
+	if reply.Stratum == 0 {
+		return nil, &KissError{Server: server, Code: strings.TrimRight(string(reply.ReferenceID[:]), "\x00")}
+	}
+	if reply.Leap == leapNotSync || reply.Stratum > 15 {
+		return nil, fmt.Errorf("%s isn't synchronised", server)
+	}
+	if reply.Transmit == 0 || reply.Receive == 0 {
+		return nil, fmt.Errorf("%s sent a reply without timestamps", server)
+	}
+
+	// t1 and t4 are the local clock's, t2 and t3 the server's; the random
+	// bits of the origin are no time, t1 is sent itself
+	t2, t3 := fromTimestamp(reply.Receive), fromTimestamp(reply.Transmit)
+	offset := (t2.Sub(sent) + t3.Sub(received)) / 2
+	delay := received.Sub(sent) - t3.Sub(t2)
+	if delay < 0 {
+		// a server whose clock went back between t2 and t3
+		delay = 0
+	}
+
+	r := &Response{
+		Server:         server,
+		Stratum:        int(reply.Stratum),
+		Leap:           int(reply.Leap),
+		Precision:      time.Duration(math.Ldexp(float64(time.Second), int(reply.Precision))),
+		RootDelay:      reply.RootDelay,
+		RootDispersion: reply.RootDispersion,
+		Time:           t3,
+		Offset:         offset,
+		Delay:          delay,
+	}
+	if reply.Stratum == 1 {
+		r.Reference = strings.TrimRight(string(reply.ReferenceID[:]), "\x00")
+	} else {
+		r.Reference = net.IP(reply.ReferenceID[:]).String()
+	}
+	return r, nil
+}
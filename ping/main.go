@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"os/signal"
+	"time"
+
+	"golang.org/x/net/icmp"
+)
+
+func main() {
+	var pinger Pinger
+	flag.IntVar(&pinger.Count, "c", 0, "stop after this many requests, 0 to go on until interrupted")
+	flag.DurationVar(&pinger.Interval, "i", time.Second, "between requests")
+	flag.IntVar(&pinger.Size, "s", 56, "payload bytes per request")
+	flag.DurationVar(&pinger.Timeout, "W", 2*time.Second, "to wait for the replies after the last request")
+	flag.BoolVar(&pinger.Privileged, "privileged", false, "use a raw socket rather than an unprivileged one")
+	deadline := flag.Duration("w", 0, "stop after this long, whatever the count")
+	only4 := flag.Bool("4", false, "IPv4 only")
+	only6 := flag.Bool("6", false, "IPv6 only")
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		fmt.Println("usage: ping [flags] host")
+		os.Exit(2)
+	}
+	host := flag.Arg(0)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	network := "ip"
+	switch {
+	case *only4 && *only6:
+		fmt.Println("Error: -4 and -6 exclude each other")
+		os.Exit(2)
+	case *only4:
+		network = "ip4"
+	case *only6:
+		network = "ip6"
+	}
+	addr, err := resolve(ctx, network, host)
+	if err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+	if *deadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *deadline)
+		defer cancel()
+	}
+
+	fmt.Printf("PING %s (%s) %d data bytes\n", host, addr, pinger.Size)
+	stats, err := pinger.Run(ctx, addr, func(r Reply) {
+		line := fmt.Sprintf("%d bytes from %s: icmp_seq=%d", r.Size, r.From, r.Seq)
+		if r.TTL >= 0 {
+			line += fmt.Sprintf(" ttl=%d", r.TTL)
+		}
+		line += fmt.Sprintf(" time=%.3f ms", float64(r.RTT.Microseconds())/1000)
+		if r.Duplicate {
+			line += " (DUP!)"
+		}
+		fmt.Println(line)
+	}, func(from netip.Addr, msg *icmp.Message) {
+		fmt.Printf("From %s: %v (code %d)\n", from, msg.Type, msg.Code)
+	})
+	if err != nil && !errors.Is(err, context.Canceled) {
+		fmt.Println("Error:", err)
+		if stats == nil {
+			os.Exit(1)
+		}
+	}
+
+	fmt.Printf("\n--- %s ping statistics ---\n", host)
+	summary := fmt.Sprintf("%d packets transmitted, %d received", stats.Sent, stats.Received)
+	if stats.Duplicates > 0 {
+		summary += fmt.Sprintf(", +%d duplicates", stats.Duplicates)
+	}
+	if stats.Errors > 0 {
+		summary += fmt.Sprintf(", +%d errors", stats.Errors)
+	}
+	fmt.Printf("%s, %.1f%% packet loss, time %dms\n", summary, stats.Loss(), stats.Elapsed.Milliseconds())
+	if len(stats.RTTs) > 0 {
+		ms := func(d time.Duration) float64 { return float64(d.Microseconds()) / 1000 }
+		min, avg, max, stddev := stats.RTT()
+		fmt.Printf("rtt min/avg/max/stddev = %.3f/%.3f/%.3f/%.3f ms\n", ms(min), ms(avg), ms(max), ms(stddev))
+	}
+	if stats.Received == 0 {
+		os.Exit(1)
+	}
+}
+
+// the first address of host in network, ip, ip4 or ip6
+func resolve(ctx context.Context, network, host string) (netip.Addr, error) {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		if network == "ip4" && !addr.Is4() || network == "ip6" && !addr.Is6() {
+			return netip.Addr{}, fmt.Errorf("%s isn't an %s address", host, network)
+		}
+		return addr, nil
+	}
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, network, host)
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("failed to resolve %s: %w", host, err)
+	}
+	return addrs[0].Unmap(), nil
+}
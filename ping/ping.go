@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/netip"
+	"os"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// Pinger sends ICMP echo requests and times the replies. Without
+// Privileged it uses an unprivileged datagram socket, which Linux allows
+// to the groups in net.ipv4.ping_group_range and macOS to everyone, and
+// falls back to a raw socket where there is none; with it a raw socket,
+// which needs root or CAP_NET_RAW.
+type Pinger struct {
+	Count      int           // requests to send, 0 for no limit
+	Interval   time.Duration // between requests, default 1 second
+	Size       int           // of the payload, default 56 as ping(8)
+	Timeout    time.Duration // to wait for the replies after the last request, default 2 seconds
+	Privileged bool
+}
+
+// Reply is one echo reply
+type Reply struct {
+	From      netip.Addr
+	Seq       int
+	Size      int // of the ICMP message
+	TTL       int // or the hop limit, -1 when the system doesn't tell
+	RTT       time.Duration
+	Duplicate bool // a second reply to the same request
+}
+
+// Statistics of a run, as ping(8) prints them at the end
+type Statistics struct {
+	Addr       netip.Addr
+	Sent       int
+	Received   int // not counting duplicates
+	Duplicates int
+	Errors     int // ICMP errors, eg. destination unreachable
+	RTTs       []time.Duration
+	Elapsed    time.Duration
+}
+
+// the percentage of requests without a reply
+func (s *Statistics) Loss() float64 {
+	if s.Sent == 0 {
+		return 0
+	}
+	return 100 * float64(s.Sent-s.Received) / float64(s.Sent)
+}
+
+// min, avg, max and the standard deviation of the round trips
+func (s *Statistics) RTT() (min, avg, max, stddev time.Duration) {
+	if len(s.RTTs) == 0 {
+		return
+	}
+	min, max = s.RTTs[0], s.RTTs[0]
+	var sum, sumSquares float64
+	for _, rtt := range s.RTTs {
+		if rtt < min {
+			min = rtt
+		}
+		if rtt > max {
+			max = rtt
+		}
+		sum += float64(rtt)
+		sumSquares += float64(rtt) * float64(rtt)
+	}
+	n := float64(len(s.RTTs))
+	mean := sum / n
+	return min, time.Duration(mean), max, time.Duration(math.Sqrt(math.Max(sumSquares/n-mean*mean, 0)))
+}
+
+// an ICMP socket and what differs between IPv4 and IPv6 on it
+type echoConn struct {
+	conn      *icmp.PacketConn
+	datagram  bool // the system picks the echo ID of an unprivileged socket
+	proto     int  // for icmp.ParseMessage
+	echo      icmp.Type
+	echoReply icmp.Type
+}
+
+func listen(addr netip.Addr, privileged bool) (*echoConn, error) {
+	c := &echoConn{proto: 1, echo: ipv4.ICMPTypeEcho, echoReply: ipv4.ICMPTypeEchoReply}
+	datagram, raw, wildcard := "udp4", "ip4:icmp", "0.0.0.0"
+	if addr.Is6() {
+		c.proto, c.echo, c.echoReply = 58, ipv6.ICMPTypeEchoRequest, ipv6.ICMPTypeEchoReply
+		datagram, raw, wildcard = "udp6", "ip6:ipv6-icmp", "::"
+	}
+
+	var err error
+	if !privileged {
+		if c.conn, err = icmp.ListenPacket(datagram, wildcard); err == nil {
+			c.datagram = true
+		}
+	}
+	if c.conn == nil {
+		if c.conn, err = icmp.ListenPacket(raw, wildcard); err != nil {
+			return nil, fmt.Errorf("failed to open an ICMP socket, unprivileged ones aren't allowed and raw ones need root or CAP_NET_RAW: %w", err)
+		}
+	}
+	// the TTL of the replies, where the system passes it on
+	if addr.Is4() {
+		c.conn.IPv4PacketConn().SetControlMessage(ipv4.FlagTTL, true)
+	} else {
+		c.conn.IPv6PacketConn().SetControlMessage(ipv6.FlagHopLimit, true)
+	}
+	return c, nil
+}
+
+func (c *echoConn) dest(addr netip.Addr) net.Addr {
+	if c.datagram {
+		return &net.UDPAddr{IP: addr.AsSlice(), Zone: addr.Zone()}
+	}
+	return &net.IPAddr{IP: addr.AsSlice(), Zone: addr.Zone()}
+}
+
+// a message read, the TTL with it or -1
+func (c *echoConn) read(b []byte) (int, int, net.Addr, error) {
+	if c.proto == 1 {
+		n, cm, peer, err := c.conn.IPv4PacketConn().ReadFrom(b)
+		if cm != nil {
+			return n, cm.TTL, peer, err
+		}
+		return n, -1, peer, err
+	}
+	n, cm, peer, err := c.conn.IPv6PacketConn().ReadFrom(b)
+	if cm != nil {
+		return n, cm.HopLimit, peer, err
+	}
+	return n, -1, peer, err
+}
+
+// a message that came in
+type incoming struct {
+	msg  *icmp.Message
+	size int
+	ttl  int
+	from netip.Addr
+	at   time.Time
+}
+
+// Run pings addr until Count requests had their replies or timed out, or
+// ctx is done, and calls onReply for each reply and onError for each ICMP
+// error about a request as they come
+func (p Pinger) Run(ctx context.Context, addr netip.Addr, onReply func(Reply), onError func(from netip.Addr, msg *icmp.Message)) (*Statistics, error) {
+	interval, size, timeout := p.Interval, p.Size, p.Timeout
+	if interval <= 0 {
+		interval = time.Second
+	}
+	if size <= 0 {
+		size = 56
+	}
+	if timeout <= 0 {
+		timeout = 2 * time.Second
+	}
+
+	c, err := listen(addr, p.Privileged)
+	if err != nil {
+		return nil, err
+	}
+	defer c.conn.Close()
+
+	messages := make(chan incoming, 16)
+	go func() {
+		defer close(messages)
+		buf := make([]byte, 65536)
+		for {
+			n, ttl, peer, err := c.read(buf)
+			if err != nil {
+				return
+			}
+			at := time.Now()
+			msg, err := icmp.ParseMessage(c.proto, buf[:n])
+			if err != nil {
+				continue
+			}
+			var from netip.Addr
+			switch peer := peer.(type) {
+			case *net.UDPAddr:
+				from, _ = netip.AddrFromSlice(peer.IP)
+			case *net.IPAddr:
+				from, _ = netip.AddrFromSlice(peer.IP)
+			}
+			messages <- incoming{msg: msg, size: n, ttl: ttl, from: from.Unmap(), at: at}
+		}
+	}()
+
+	id := os.Getpid() & 0xffff
+	payload := make([]byte, size)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	stats := &Statistics{Addr: addr}
+	sent := map[int]time.Time{}
+	replied := map[int]bool{}
+	start := time.Now()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	// armed after the last request
+	var done <-chan time.Time
+
+	send := func() error {
+		seq := stats.Sent & 0xffff
+		msg := icmp.Message{Type: c.echo, Body: &icmp.Echo{ID: id, Seq: seq, Data: payload}}
+		b, err := msg.Marshal(nil)
+		if err != nil {
+			return err
+		}
+		sent[seq] = time.Now()
+		delete(replied, seq)
+		stats.Sent++
+		if p.Count > 0 && stats.Sent >= p.Count {
+			ticker.Stop()
+			done = time.After(timeout)
+		}
+		_, err = c.conn.WriteTo(b, c.dest(addr))
+		return err
+	}
+	if err := send(); err != nil {
+		return stats, fmt.Errorf("failed to send to %s: %w", addr, err)
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			stats.Elapsed = time.Since(start)
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				// -w: running out of time is how it ends
+				return stats, nil
+			}
+			return stats, ctx.Err()
+		case <-done:
+			stats.Elapsed = time.Since(start)
+			return stats, nil
+		case <-ticker.C:
+			if err := send(); err != nil {
+				stats.Errors++
+			}
+		case in, ok := <-messages:
+			if !ok {
+				return stats, errors.New("the ICMP socket closed")
+			}
+			switch body := in.msg.Body.(type) {
+			case *icmp.Echo:
+				// an unprivileged socket only gets its own replies, with the
+				// ID the system chose
+				if in.msg.Type != c.echoReply || (!c.datagram && body.ID != id) || in.from != addr.Unmap() {
+					continue
+				}
+				at, ok := sent[body.Seq]
+				if !ok {
+					continue
+				}
+				reply := Reply{From: in.from, Seq: body.Seq, Size: in.size, TTL: in.ttl, RTT: in.at.Sub(at), Duplicate: replied[body.Seq]}
+				if reply.Duplicate {
+					stats.Duplicates++
+				} else {
+					replied[body.Seq] = true
+					stats.Received++
+					stats.RTTs = append(stats.RTTs, reply.RTT)
+				}
+				if onReply != nil {
+					onReply(reply)
+				}
+			case *icmp.DstUnreach, *icmp.TimeExceeded, *icmp.PacketTooBig:
+				// raw sockets see every host's errors, only ours count; a
+				// datagram socket gets them only with IP_RECVERR
+				if !c.datagram && !c.quotesOurs(in.msg, id) {
+					continue
+				}
+				stats.Errors++
+				if onError != nil {
+					onError(in.from, in.msg)
+				}
+			}
+			if p.Count > 0 && stats.Received >= p.Count {
+				stats.Elapsed = time.Since(start)
+				return stats, nil
+			}
+		}
+	}
+}
+
+// whether an ICMP error quotes one of our requests
+func (c *echoConn) quotesOurs(msg *icmp.Message, id int) bool {
+	var data []byte
+	switch body := msg.Body.(type) {
+	case *icmp.DstUnreach:
+		data = body.Data
+	case *icmp.TimeExceeded:
+		data = body.Data
+	case *icmp.PacketTooBig:
+		data = body.Data
+	}
+	// the IP header of the request, then its ICMP header
+	headerLen := 40
+	if c.proto == 1 {
+		if len(data) < 1 {
+			return false
+		}
+		headerLen = int(data[0]&0x0f) * 4
+	}
+	if len(data) < headerLen+8 {
+		return false
+	}
+	quoted := data[headerLen:]
+	return int(quoted[4])<<8|int(quoted[5]) == id
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// the most of a banner kept
+const maxBanner = 200
+
+// what the service on conn says first: ftp, ssh, smtp, pop3 and imap
+// greet. One that doesn't is sent a HEAD request, so that a web server
+// tells its Server header and others at least answer with an error.
+func grabBanner(conn net.Conn, port int, timeout time.Duration) string {
+	reader := bufio.NewReader(conn)
+	if ask, ok := bannerRequests[port]; ok {
+		conn.SetDeadline(time.Now().Add(timeout))
+		if _, err := conn.Write([]byte(ask)); err != nil {
+			return ""
+		}
+		return httpBanner(reader)
+	}
+
+	// give a talker-first service a moment before asking
+	conn.SetDeadline(time.Now().Add(timeout / 2))
+	if banner := readBanner(reader); banner != "" {
+		return banner
+	}
+	conn.SetDeadline(time.Now().Add(timeout / 2))
+	if _, err := conn.Write([]byte(httpHead)); err != nil {
+		return ""
+	}
+	return httpBanner(reader)
+}
+
+const httpHead = "HEAD / HTTP/1.0\r\n\r\n"
+
+// what to send the services that wait to be asked
+var bannerRequests = map[int]string{
+	80:    httpHead,
+	8000:  httpHead,
+	8008:  httpHead,
+	8080:  httpHead,
+	8888:  httpHead,
+	6379:  "PING\r\n",    // redis
+	11211: "version\r\n", // memcached
+}
+
+// the first line
+func readBanner(reader *bufio.Reader) string {
+	line, err := reader.ReadString('\n')
+	if line == "" && err != nil {
+		return ""
+	}
+	return printable([]byte(line))
+}
+
+// the status line and the Server header of a HEAD response, or the first
+// line of any other answer
+func httpBanner(reader *bufio.Reader) string {
+	status, err := reader.ReadString('\n')
+	if err != nil && status == "" {
+		return ""
+	}
+	banner := strings.TrimSpace(status)
+	if !strings.HasPrefix(banner, "HTTP/") {
+		return printable([]byte(banner))
+	}
+	for {
+		line, err := reader.ReadString('\n')
+		line = strings.TrimSpace(line)
+		if line == "" || err != nil {
+			break
+		}
+		if name, value, ok := strings.Cut(line, ":"); ok && strings.EqualFold(name, "server") {
+			banner += " (" + strings.TrimSpace(value) + ")"
+			break
+		}
+	}
+	return printable([]byte(banner))
+}
+
+// b with control characters and invalid UTF-8 replaced, trimmed and cut
+// to maxBanner, so that a banner can't mess up the terminal or the output
+func printable(b []byte) string {
+	s := strings.Map(func(r rune) rune {
+		if r == unicode.ReplacementChar || !unicode.IsPrint(r) {
+			return '.'
+		}
+		return r
+	}, strings.TrimSpace(strings.ToValidUTF8(string(b), "�")))
+	if len(s) > maxBanner {
+		s = s[:maxBanner]
+	}
+	return strings.TrimSpace(s)
+}
+
+// a udp probe a service on port answers to; most stay silent at an
+// empty datagram, which is the rest's
+func udpPayload(port int) []byte {
+	switch port {
+	case 53, 5353:
+		// a DNS query for the root NS
+		return []byte{0x13, 0x37, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 2, 0, 1}
+	case 123:
+		// an NTP version 4 client request
+		b := make([]byte, 48)
+		b[0] = 4<<3 | 3
+		return b
+	case 161:
+		// an SNMPv1 get of sysDescr.0 with community public
+		return []byte{0x30, 0x29, 0x02, 0x01, 0x00, 0x04, 0x06, 'p', 'u', 'b', 'l', 'i', 'c',
+			0xa0, 0x1c, 0x02, 0x04, 0x13, 0x37, 0x13, 0x37, 0x02, 0x01, 0x00, 0x02, 0x01, 0x00,
+			0x30, 0x0e, 0x30, 0x0c, 0x06, 0x08, 0x2b, 0x06, 0x01, 0x02, 0x01, 0x01, 0x01, 0x00, 0x05, 0x00}
+	case 1900:
+		return []byte("M-SEARCH * HTTP/1.1\r\nHOST: 239.255.255.250:1900\r\nMAN: \"ssdp:discover\"\r\nMX: 1\r\nST: ssdp:all\r\n\r\n")
+	case 5060:
+		return []byte("OPTIONS sip:nm SIP/2.0\r\nVia: SIP/2.0/UDP nm;branch=z9hG4bK1337\r\nFrom: <sip:nm@nm>;tag=1337\r\nTo: <sip:nm@nm>\r\nCall-ID: 1337\r\nCSeq: 1 OPTIONS\r\nContent-Length: 0\r\n\r\n")
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"time"
+)
+
+func main() {
+	var scanner Scanner
+	portSpec := flag.String("p", "1-1024", "ports to scan, eg. 22,80,8000-8100")
+	flag.BoolVar(&scanner.UDP, "udp", false, "scan udp ports instead of tcp")
+	flag.IntVar(&scanner.Workers, "workers", 100, "probes at once")
+	flag.DurationVar(&scanner.Timeout, "timeout", time.Second, "per connect or udp reply")
+	flag.BoolVar(&scanner.Banners, "banner", false, "grab the banners of open tcp ports")
+	names := flag.Bool("names", true, "name the services of well known ports")
+	servicesFile := flag.String("services-file", "", "more port names, from a file in /etc/services format")
+	format := flag.String("format", "text", "output format: text, json or csv")
+	all := flag.Bool("all", false, "report closed and filtered ports too, not only open ones")
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		fmt.Println("usage: port_scanner [flags] host|address|prefix...")
+		os.Exit(2)
+	}
+	write := map[string]func(io.Writer, []Result) error{
+		"text": writeText,
+		"json": writeJSON,
+		"csv":  writeCSV,
+	}[*format]
+	if write == nil {
+		fmt.Printf("Error: unknown format %q (want text, json or csv)\n", *format)
+		os.Exit(2)
+	}
+	ports, err := parsePorts(*portSpec)
+	if err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(2)
+	}
+	switch {
+	case *servicesFile != "":
+		if scanner.Services, err = loadServices(*servicesFile); err != nil {
+			fmt.Println("Error:", err)
+			os.Exit(1)
+		}
+	case *names:
+		scanner.Services = defaultServices
+	}
+
+	// an interrupt ends the scan with what it found so far
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	targets, err := parseTargets(ctx, flag.Args())
+	if err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+
+	start := time.Now()
+	results := scanner.Scan(ctx, targets, ports)
+	if !*all {
+		open := results[:0]
+		for _, r := range results {
+			if r.State == stateOpen || r.State == stateOpenFiltered && scanner.UDP {
+				open = append(open, r)
+			}
+		}
+		results = open
+	}
+	if err := write(os.Stdout, results); err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+	if *format == "text" {
+		fmt.Printf("\n%d ports of %d hosts scanned in %s\n", len(ports), len(targets), time.Since(start).Round(time.Millisecond))
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+// the results as a table, grouped by host
+func writeText(w io.Writer, results []Result) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	host := ""
+	for _, r := range results {
+		if r.Host != host {
+			if host != "" {
+				fmt.Fprintln(tw)
+			}
+			host = r.Host
+			if r.Host != r.Addr {
+				fmt.Fprintf(tw, "%s (%s)\n", r.Host, r.Addr)
+			} else {
+				fmt.Fprintf(tw, "%s\n", r.Host)
+			}
+			fmt.Fprintln(tw, "PORT\tSTATE\tSERVICE\tRTT\tBANNER")
+		}
+		rtt := ""
+		if r.RTT > 0 {
+			rtt = r.RTT.Round(10 * time.Microsecond).String()
+		}
+		fmt.Fprintf(tw, "%d/%s\t%s\t%s\t%s\t%s\n", r.Port, r.Proto, r.State, r.Service, rtt, r.Banner)
+	}
+	return tw.Flush()
+}
+
+func writeJSON(w io.Writer, results []Result) error {
+	if results == nil {
+		results = []Result{}
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(results)
+}
+
+func writeCSV(w io.Writer, results []Result) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"host", "addr", "port", "proto", "state", "service", "rtt_ms", "banner"})
+	for _, r := range results {
+		rtt := ""
+		if r.RTT > 0 {
+			rtt = strconv.FormatFloat(float64(r.RTT.Microseconds())/1000, 'f', 3, 64)
+		}
+		cw.Write([]string{r.Host, r.Addr, strconv.Itoa(r.Port), r.Proto, r.State, r.Service, rtt, r.Banner})
+	}
+	cw.Flush()
+	return cw.Error()
+}
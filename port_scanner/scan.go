@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// port states, as nmap names them
+const (
+	stateOpen         = "open"
+	stateClosed       = "closed"        // a RST, or an ICMP port unreachable for udp
+	stateFiltered     = "filtered"      // no answer to a SYN, a firewall drops it
+	stateOpenFiltered = "open|filtered" // no answer to a udp probe, which an open port may not give either
+)
+
+// Scanner probes ports with a bounded number at a time
+type Scanner struct {
+	Workers int           // probes at once, default 100
+	Timeout time.Duration // per connect or udp reply, default 1 second
+	Banners bool          // read what the service says, or asks it for a line
+	UDP     bool          // probe udp ports instead of tcp
+	// the service names of ports, nil for none
+	Services map[string]string // "80/tcp": "http"
+}
+
+// the outcome of one port of one host
+type Result struct {
+	Host    string        `json:"host"`
+	Addr    string        `json:"addr"`
+	Port    int           `json:"port"`
+	Proto   string        `json:"proto"`
+	State   string        `json:"state"`
+	Service string        `json:"service,omitempty"`
+	Banner  string        `json:"banner,omitempty"`
+	RTT     time.Duration `json:"rtt_ns,omitempty"` // of the connect, or of the udp reply
+}
+
+// a host to scan, with the name it was given by
+type target struct {
+	host string
+	addr netip.Addr
+}
+
+// Scan probes every port of every target and returns the results by
+// target and port, in the order they were given
+func (s *Scanner) Scan(ctx context.Context, targets []target, ports []int) []Result {
+	workers := s.Workers
+	if workers <= 0 {
+		workers = 100
+	}
+	type job struct {
+		index int
+		t     target
+		port  int
+	}
+	jobs := make(chan job)
+	results := make([]Result, len(targets)*len(ports))
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				results[j.index] = s.probe(ctx, j.t, j.port)
+			}
+		}()
+	}
+	// port by port across the hosts, so that no one host gets all the
+	// probes at once
+	n := 0
+feed:
+	for i, port := range ports {
+		for k, t := range targets {
+			select {
+			case jobs <- job{index: k*len(ports) + i, t: t, port: port}:
+				n++
+			case <-ctx.Done():
+				break feed
+			}
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	if n < len(results) {
+		// interrupted, the probes not sent have no state
+		kept := results[:0]
+		for _, r := range results {
+			if r.State != "" {
+				kept = append(kept, r)
+			}
+		}
+		results = kept
+	}
+	return results
+}
+
+func (s *Scanner) probe(ctx context.Context, t target, port int) Result {
+	r := Result{Host: t.host, Addr: t.addr.String(), Port: port, Proto: "tcp"}
+	if s.UDP {
+		r.Proto = "udp"
+	}
+	r.Service = s.Services[strconv.Itoa(port)+"/"+r.Proto]
+	timeout := s.Timeout
+	if timeout <= 0 {
+		timeout = time.Second
+	}
+	addr := netip.AddrPortFrom(t.addr, uint16(port)).String()
+	if s.UDP {
+		r.State, r.Banner, r.RTT = probeUDP(ctx, addr, port, timeout)
+		return r
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	var dialer net.Dialer
+	start := time.Now()
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	r.RTT = time.Since(start)
+	switch {
+	case err == nil:
+		r.State = stateOpen
+		if s.Banners {
+			r.Banner = grabBanner(conn, port, timeout)
+		}
+		conn.Close()
+	case errors.Is(err, syscall.ECONNREFUSED):
+		r.State = stateClosed
+	default:
+		// a timeout, or an ICMP error such as host unreachable
+		r.State, r.RTT = stateFiltered, 0
+	}
+	return r
+}
+
+// a udp probe: a reply means open, a port unreachable closed, and
+// silence either
+func probeUDP(ctx context.Context, addr string, port int, timeout time.Duration) (string, string, time.Duration) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", addr)
+	if err != nil {
+		return stateFiltered, "", 0
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	start := time.Now()
+	if _, err := conn.Write(udpPayload(port)); err != nil {
+		return stateFiltered, "", 0
+	}
+	buf := make([]byte, 512)
+	n, err := conn.Read(buf)
+	rtt := time.Since(start)
+	switch {
+	case err == nil:
+		return stateOpen, printable(buf[:n]), rtt
+	case errors.Is(err, syscall.ECONNREFUSED):
+		// the ICMP port unreachable, which a connected socket reports
+		return stateClosed, "", 0
+	}
+	return stateOpenFiltered, "", 0
+}
+
+// the hosts of specs: names, addresses and CIDR prefixes
+func parseTargets(ctx context.Context, specs []string) ([]target, error) {
+	var targets []target
+	for _, spec := range specs {
+		if prefix, err := netip.ParsePrefix(spec); err == nil {
+			addrs, err := prefixAddrs(prefix.Masked())
+			if err != nil {
+				return nil, err
+			}
+			for _, addr := range addrs {
+				targets = append(targets, target{host: addr.String(), addr: addr})
+			}
+			continue
+		}
+		if addr, err := netip.ParseAddr(spec); err == nil {
+			targets = append(targets, target{host: spec, addr: addr})
+			continue
+		}
+		addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", spec)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve %s: %w", spec, err)
+		}
+		targets = append(targets, target{host: spec, addr: addrs[0].Unmap()})
+	}
+	return targets, nil
+}
+
+// the most hosts of a prefix
+const maxPrefixHosts = 1 << 16
+
+// the host addresses of prefix, without the network and broadcast ones of
+// an IPv4 prefix that has them
+func prefixAddrs(prefix netip.Prefix) ([]netip.Addr, error) {
+	hostBits := prefix.Addr().BitLen() - prefix.Bits()
+	if hostBits > 16 {
+		return nil, fmt.Errorf("%s has more than %d addresses", prefix, maxPrefixHosts)
+	}
+	var addrs []netip.Addr
+	for addr := prefix.Addr(); prefix.Contains(addr); addr = addr.Next() {
+		addrs = append(addrs, addr)
+		if !addr.Next().IsValid() {
+			break
+		}
+	}
+	if prefix.Addr().Is4() && hostBits >= 2 {
+		addrs = addrs[1 : len(addrs)-1]
+	}
+	return addrs, nil
+}
+
+// ports such as "22,80,8000-8100", sorted and without repeats
+func parsePorts(spec string) ([]int, error) {
+	seen := map[int]bool{}
+	var ports []int
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		low, high, isRange := strings.Cut(part, "-")
+		first, err := strconv.Atoi(low)
+		last := first
+		if err == nil && isRange {
+			last, err = strconv.Atoi(high)
+		}
+		if err != nil || first < 1 || last > 65535 || first > last {
+			return nil, fmt.Errorf("invalid port or range %q", part)
+		}
+		for port := first; port <= last; port++ {
+			if !seen[port] {
+				seen[port] = true
+				ports = append(ports, port)
+			}
+		}
+	}
+	if len(ports) == 0 {
+		return nil, errors.New("no ports to scan")
+	}
+	sort.Ints(ports)
+	return ports, nil
+}
+
+// the names of well known ports, enough for the usual scan
+var defaultServices = map[string]string{
+	"20/tcp": "ftp-data", "21/tcp": "ftp", "22/tcp": "ssh", "23/tcp": "telnet", "25/tcp": "smtp",
+	"53/tcp": "domain", "53/udp": "domain", "67/udp": "dhcps", "69/udp": "tftp", "80/tcp": "http",
+	"88/tcp": "kerberos", "110/tcp": "pop3", "111/tcp": "sunrpc", "111/udp": "sunrpc", "123/udp": "ntp",
+	"135/tcp": "msrpc", "137/udp": "netbios-ns", "139/tcp": "netbios-ssn", "143/tcp": "imap",
+	"161/udp": "snmp", "389/tcp": "ldap", "443/tcp": "https", "445/tcp": "microsoft-ds",
+	"465/tcp": "submissions", "500/udp": "isakmp", "514/udp": "syslog", "587/tcp": "submission",
+	"636/tcp": "ldaps", "853/tcp": "domain-s", "873/tcp": "rsync", "993/tcp": "imaps", "995/tcp": "pop3s",
+	"1194/udp": "openvpn", "1433/tcp": "ms-sql-s", "1521/tcp": "oracle", "1883/tcp": "mqtt",
+	"1900/udp": "ssdp", "2049/tcp": "nfs", "3306/tcp": "mysql", "3389/tcp": "ms-wbt-server",
+	"4500/udp": "ipsec-nat-t", "5060/udp": "sip", "5353/udp": "mdns", "5432/tcp": "postgresql",
+	"5672/tcp": "amqp", "5900/tcp": "vnc", "6379/tcp": "redis", "8000/tcp": "http-alt",
+	"8080/tcp": "http-proxy", "8443/tcp": "https-alt", "9200/tcp": "elasticsearch",
+	"11211/tcp": "memcache", "27017/tcp": "mongodb",
+}
+
+// the services of an /etc/services style file, added to the default ones
+func loadServices(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	services := map[string]string{}
+	for key, name := range defaultServices {
+		services[key] = name
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		line, _, _ = strings.Cut(line, "#")
+		fields := strings.Fields(line)
+		// "http 80/tcp www"
+		if len(fields) >= 2 && strings.Contains(fields[1], "/") {
+			services[strings.ToLower(fields[1])] = fields[0]
+		}
+	}
+	return services, nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func main() {
+	asJSON := flag.Bool("json", false, "print the response as the server sent it, indented")
+	bootstrap := flag.String("bootstrap", ianaBootstrap, "where to fetch the bootstrap registries from")
+	timeout := flag.Duration("timeout", 30*time.Second, "per request")
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		fmt.Println("usage: rdap_lookup [flags] domain|address|prefix|ASnumber")
+		os.Exit(2)
+	}
+	query := flag.Arg(0)
+
+	client := &Client{HTTP: &http.Client{Timeout: *timeout}, BootstrapURL: *bootstrap}
+	ctx := context.Background()
+
+	var object *Object
+	var show func()
+	var err error
+	switch kind, asn := classify(query); kind {
+	case "ip":
+		var network *IPNetwork
+		if network, err = client.IP(ctx, query); err == nil {
+			object, show = &network.Object, func() { printIPNetwork(network) }
+		}
+	case "autnum":
+		var autnum *Autnum
+		if autnum, err = client.Autnum(ctx, asn); err == nil {
+			object, show = &autnum.Object, func() { printAutnum(autnum) }
+		}
+	default:
+		var domain *Domain
+		if domain, err = client.Domain(ctx, query); err == nil {
+			object, show = &domain.Object, func() { printDomain(domain) }
+		}
+	}
+	if err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+
+	if *asJSON {
+		var out bytes.Buffer
+		if err := json.Indent(&out, object.Raw, "", "  "); err != nil {
+			fmt.Println("Error:", err)
+			os.Exit(1)
+		}
+		fmt.Println(out.String())
+		return
+	}
+	show()
+	printCommon(object)
+}
+
+// what query asks about: "ip" for an address or prefix, "autnum" for
+// 64496 or AS64496, "domain" otherwise
+func classify(query string) (string, uint32) {
+	if _, err := netip.ParseAddr(query); err == nil {
+		return "ip", 0
+	}
+	if _, err := netip.ParsePrefix(query); err == nil {
+		return "ip", 0
+	}
+	number := query
+	if len(number) > 2 && strings.EqualFold(number[:2], "AS") {
+		number = number[2:]
+	}
+	if asn, err := strconv.ParseUint(number, 10, 32); err == nil {
+		return "autnum", uint32(asn)
+	}
+	return "domain", 0
+}
+
+func printDomain(d *Domain) {
+	fmt.Printf("%-12s %s\n", "domain", d.LDHName)
+	if d.UnicodeName != "" && d.UnicodeName != d.LDHName {
+		fmt.Printf("%-12s %s\n", "unicode", d.UnicodeName)
+	}
+	if registrar := d.Entity("registrar"); registrar != nil {
+		fmt.Printf("%-12s %s\n", "registrar", registrar.Name())
+	}
+	for _, ns := range d.Nameservers {
+		fmt.Printf("%-12s %s\n", "name server", strings.ToLower(ns.LDHName))
+	}
+	if d.SecureDNS != nil {
+		fmt.Printf("%-12s %t\n", "dnssec", d.SecureDNS.DelegationSigned)
+	}
+}
+
+func printIPNetwork(n *IPNetwork) {
+	fmt.Printf("%-12s %s - %s\n", "range", n.StartAddress, n.EndAddress)
+	if prefixes := n.Prefixes(); len(prefixes) > 0 {
+		fmt.Printf("%-12s %s\n", "prefixes", strings.Join(prefixes, ", "))
+	}
+	fmt.Printf("%-12s %s\n", "name", n.Name)
+	if n.Type != "" {
+		fmt.Printf("%-12s %s\n", "type", n.Type)
+	}
+	if n.Country != "" {
+		fmt.Printf("%-12s %s\n", "country", n.Country)
+	}
+	if n.ParentHandle != "" {
+		fmt.Printf("%-12s %s\n", "parent", n.ParentHandle)
+	}
+}
+
+func printAutnum(a *Autnum) {
+	if a.StartAutnum == a.EndAutnum {
+		fmt.Printf("%-12s AS%d\n", "autnum", a.StartAutnum)
+	} else {
+		fmt.Printf("%-12s AS%d - AS%d\n", "autnums", a.StartAutnum, a.EndAutnum)
+	}
+	fmt.Printf("%-12s %s\n", "name", a.Name)
+	if a.Country != "" {
+		fmt.Printf("%-12s %s\n", "country", a.Country)
+	}
+}
+
+// what every object class has: handle, status, events and contacts
+func printCommon(o *Object) {
+	if o.Handle != "" {
+		fmt.Printf("%-12s %s\n", "handle", o.Handle)
+	}
+	if len(o.Status) > 0 {
+		fmt.Printf("%-12s %s\n", "status", strings.Join(o.Status, ", "))
+	}
+	for _, e := range o.Events {
+		if !e.Date.IsZero() {
+			fmt.Printf("%-12s %s\n", e.Action, e.Date.Format(time.DateOnly))
+		}
+	}
+	for _, role := range []string{"registrant", "administrative", "technical", "abuse"} {
+		if e := o.Entity(role); e != nil {
+			contact := e.Name()
+			if email := e.VCard.Get("email"); email != "" {
+				contact += " <" + email + ">"
+			}
+			fmt.Printf("%-12s %s\n", role, contact)
+		}
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/idna"
+)
+
+// where IANA publishes which RDAP servers answer for which TLDs, address
+// blocks and AS numbers (RFC 9224)
+const ianaBootstrap = "https://data.iana.org/rdap/"
+
+// the media type of RDAP responses (RFC 7480)
+const rdapMediaType = "application/rdap+json"
+
+// RDAP (RFC 9082, 9083) is WHOIS over HTTPS with JSON answers in a common
+// format. The server for a query comes from IANA's bootstrap registries,
+// which the client fetches once and keeps for a day.
+type Client struct {
+	HTTP         *http.Client // default one with a 30 second timeout
+	BootstrapURL string       // default IANA's; dns.json, ipv4.json and so on are fetched from it
+
+	mu         sync.Mutex
+	registries map[string]*registry
+}
+
+// Error is the answer of a server that didn't have or wouldn't give the
+// object, with the error object of the body when it had one
+type Error struct {
+	URL         string
+	StatusCode  int
+	Title       string
+	Description []string
+}
+
+func (e *Error) Error() string {
+	msg := fmt.Sprintf("%s: %d %s", e.URL, e.StatusCode, http.StatusText(e.StatusCode))
+	if e.Title != "" && e.Title != http.StatusText(e.StatusCode) {
+		msg += ": " + e.Title
+	}
+	if len(e.Description) > 0 {
+		msg += ": " + strings.Join(e.Description, " ")
+	}
+	return msg
+}
+
+// so that errors.Is(err, ErrNotFound) tells a 404
+func (e *Error) Unwrap() error {
+	if e.StatusCode == http.StatusNotFound {
+		return ErrNotFound
+	}
+	return nil
+}
+
+var (
+	// the server has no such object
+	ErrNotFound = errors.New("object not found")
+	// no RDAP server is registered for the TLD, address or AS number
+	ErrNoServer = errors.New("no RDAP server known")
+)
+
+// Domain looks up a domain name, in Unicode or ASCII
+func (c *Client) Domain(ctx context.Context, name string) (*Domain, error) {
+	name, err := idna.Lookup.ToASCII(strings.TrimSuffix(strings.TrimSpace(name), "."))
+	if err != nil {
+		return nil, fmt.Errorf("invalid domain: %w", err)
+	}
+	reg, err := c.registry(ctx, "dns")
+	if err != nil {
+		return nil, err
+	}
+	base := reg.domain(strings.ToLower(name))
+	if base == "" {
+		return nil, fmt.Errorf("%w for %s", ErrNoServer, name)
+	}
+	domain := new(Domain)
+	if err := c.get(ctx, base, "domain/"+name, domain); err != nil {
+		return nil, err
+	}
+	return domain, nil
+}
+
+// IP looks up the network of an address, or of a prefix such as
+// 192.0.2.0/24
+func (c *Client) IP(ctx context.Context, query string) (*IPNetwork, error) {
+	prefix, err := netip.ParsePrefix(query)
+	if err != nil {
+		addr, err := netip.ParseAddr(query)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address %q", query)
+		}
+		prefix = netip.PrefixFrom(addr, addr.BitLen())
+	}
+	prefix = prefix.Masked()
+	kind := "ipv4"
+	if prefix.Addr().Is6() {
+		kind = "ipv6"
+	}
+	reg, err := c.registry(ctx, kind)
+	if err != nil {
+		return nil, err
+	}
+	base := reg.ip(prefix)
+	if base == "" {
+		return nil, fmt.Errorf("%w for %s", ErrNoServer, prefix)
+	}
+	path := "ip/" + prefix.Addr().String()
+	if prefix.Bits() < prefix.Addr().BitLen() {
+		path += "/" + strconv.Itoa(prefix.Bits())
+	}
+	network := new(IPNetwork)
+	if err := c.get(ctx, base, path, network); err != nil {
+		return nil, err
+	}
+	return network, nil
+}
+
+// Autnum looks up an autonomous system number
+func (c *Client) Autnum(ctx context.Context, asn uint32) (*Autnum, error) {
+	reg, err := c.registry(ctx, "asn")
+	if err != nil {
+		return nil, err
+	}
+	base := reg.asn(asn)
+	if base == "" {
+		return nil, fmt.Errorf("%w for AS%d", ErrNoServer, asn)
+	}
+	autnum := new(Autnum)
+	if err := c.get(ctx, base, "autnum/"+strconv.FormatUint(uint64(asn), 10), autnum); err != nil {
+		return nil, err
+	}
+	return autnum, nil
+}
+
+// the most a response may be
+const maxResponse = 4 << 20
+
+// GET base+path into v, which keeps the JSON in its Raw
+func (c *Client) get(ctx context.Context, base, path string, v interface{ setRaw([]byte) }) error {
+	url := strings.TrimSuffix(base, "/") + "/" + path
+	body, err := c.fetch(ctx, url)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("invalid RDAP response from %s: %w", url, err)
+	}
+	v.setRaw(body)
+	return nil
+}
+
+func (c *Client) fetch(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", rdapMediaType+", application/json")
+	client := c.HTTP
+	if client == nil {
+		client = &http.Client{Timeout: 30 * time.Second}
+	}
+	// redirects are followed, a registry may send the query on to a
+	// registrar or another RIR
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxResponse))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", url, err)
+	}
+	if resp.StatusCode/100 != 2 {
+		rdapErr := &Error{URL: url, StatusCode: resp.StatusCode}
+		var object struct {
+			Title       string   `json:"title"`
+			Description []string `json:"description"`
+		}
+		if json.Unmarshal(body, &object) == nil {
+			rdapErr.Title, rdapErr.Description = object.Title, object.Description
+		}
+		return nil, rdapErr
+	}
+	return body, nil
+}
+
+// how long a fetched bootstrap registry is used
+const bootstrapTTL = 24 * time.Hour
+
+// a bootstrap registry: the entries, TLDs, prefixes or AS number ranges,
+// with the base URLs of the servers that answer for them
+type registry struct {
+	fetched  time.Time
+	services [][2][]string
+}
+
+// the registry of kind, dns, ipv4, ipv6 or asn, fetched if it isn't kept
+func (c *Client) registry(ctx context.Context, kind string) (*registry, error) {
+	c.mu.Lock()
+	reg := c.registries[kind]
+	c.mu.Unlock()
+	if reg != nil && time.Since(reg.fetched) < bootstrapTTL {
+		return reg, nil
+	}
+
+	base := c.BootstrapURL
+	if base == "" {
+		base = ianaBootstrap
+	}
+	body, err := c.fetch(ctx, strings.TrimSuffix(base, "/")+"/"+kind+".json")
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch the RDAP bootstrap registry: %w", err)
+	}
+	reg = &registry{fetched: time.Now()}
+	var file struct {
+		Services [][2][]string `json:"services"`
+	}
+	if err := json.Unmarshal(body, &file); err != nil {
+		return nil, fmt.Errorf("invalid RDAP bootstrap registry %s: %w", kind, err)
+	}
+	reg.services = file.Services
+
+	c.mu.Lock()
+	if c.registries == nil {
+		c.registries = map[string]*registry{}
+	}
+	c.registries[kind] = reg
+	c.mu.Unlock()
+	return reg, nil
+}
+
+// of a service's URLs, the https one
+func serviceURL(urls []string) string {
+	for _, u := range urls {
+		if strings.HasPrefix(u, "https://") {
+			return u
+		}
+	}
+	if len(urls) > 0 {
+		return urls[0]
+	}
+	return ""
+}
+
+// the server of the longest entry name ends in, label-wise
+func (r *registry) domain(name string) string {
+	best, bestLen := "", -1
+	for _, service := range r.services {
+		for _, entry := range service[0] {
+			entry = strings.ToLower(entry)
+			if (name == entry || strings.HasSuffix(name, "."+entry)) && len(entry) > bestLen {
+				best, bestLen = serviceURL(service[1]), len(entry)
+			}
+		}
+	}
+	return best
+}
+
+// the server of the longest prefix containing query
+func (r *registry) ip(query netip.Prefix) string {
+	best, bestBits := "", -1
+	for _, service := range r.services {
+		for _, entry := range service[0] {
+			prefix, err := netip.ParsePrefix(entry)
+			if err != nil {
+				continue
+			}
+			if prefix.Bits() <= query.Bits() && prefix.Contains(query.Addr()) && prefix.Bits() > bestBits {
+				best, bestBits = serviceURL(service[1]), prefix.Bits()
+			}
+		}
+	}
+	return best
+}
+
+// the server of the range, "64512-65534", asn is in
+func (r *registry) asn(asn uint32) string {
+	for _, service := range r.services {
+		for _, entry := range service[0] {
+			low, high, found := strings.Cut(entry, "-")
+			if !found {
+				high = low
+			}
+			lo, err1 := strconv.ParseUint(low, 10, 32)
+			hi, err2 := strconv.ParseUint(high, 10, 32)
+			if err1 == nil && err2 == nil && uint64(asn) >= lo && uint64(asn) <= hi {
+				return serviceURL(service[1])
+			}
+		}
+	}
+	return ""
+}
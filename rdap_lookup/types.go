@@ -0,0 +1,301 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// the members every RDAP object class has (RFC 9083 section 4)
+type Object struct {
+	ObjectClassName string   `json:"objectClassName"`
+	Handle          string   `json:"handle"`
+	Status          []string `json:"status"` // eg. "active", "client transfer prohibited"
+	Events          []Event  `json:"events"`
+	Entities        []Entity `json:"entities"`
+	Links           []Link   `json:"links"`
+	Remarks         []Notice `json:"remarks"`
+	Notices         []Notice `json:"notices"` // of the response, only on the top object
+	Port43          string   `json:"port43"`  // the WHOIS server with the same data
+
+	Raw json.RawMessage `json:"-"` // the response as the server sent it
+}
+
+func (o *Object) setRaw(raw []byte) {
+	o.Raw = raw
+}
+
+// the date of the first event of action, eg. "registration",
+// "expiration" or "last changed"; zero if there is none
+func (o *Object) Event(action string) time.Time {
+	for _, e := range o.Events {
+		if strings.EqualFold(e.Action, action) {
+			return e.Date
+		}
+	}
+	return time.Time{}
+}
+
+// the first entity with role, eg. "registrar", "registrant" or "abuse",
+// looked for among the entities' own entities as well; nil if none has it
+func (o *Object) Entity(role string) *Entity {
+	return findEntity(o.Entities, role)
+}
+
+func findEntity(entities []Entity, role string) *Entity {
+	for i := range entities {
+		for _, r := range entities[i].Roles {
+			if strings.EqualFold(r, role) {
+				return &entities[i]
+			}
+		}
+	}
+	for i := range entities {
+		if e := findEntity(entities[i].Entities, role); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+// the href of the first link with rel, eg. "related" for the registrar's
+// own RDAP record of a domain; "" if there is none
+func (o *Object) Link(rel string) string {
+	for _, l := range o.Links {
+		if strings.EqualFold(l.Rel, rel) {
+			return l.Href
+		}
+	}
+	return ""
+}
+
+type Event struct {
+	Action string    `json:"eventAction"`
+	Actor  string    `json:"eventActor"`
+	Date   time.Time `json:"eventDate"` // zero when the server's isn't RFC 3339
+}
+
+// a date some servers get wrong, without a time zone, doesn't fail the
+// whole response
+func (e *Event) UnmarshalJSON(data []byte) error {
+	var event struct {
+		Action string `json:"eventAction"`
+		Actor  string `json:"eventActor"`
+		Date   string `json:"eventDate"`
+	}
+	if err := json.Unmarshal(data, &event); err != nil {
+		return err
+	}
+	e.Action, e.Actor = event.Action, event.Actor
+	e.Date = time.Time{}
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05", "2006-01-02"} {
+		if t, err := time.Parse(layout, event.Date); err == nil {
+			e.Date = t
+			break
+		}
+	}
+	return nil
+}
+
+type Link struct {
+	Value string `json:"value"`
+	Rel   string `json:"rel"`
+	Href  string `json:"href"`
+	Type  string `json:"type"`
+}
+
+type Notice struct {
+	Title       string   `json:"title"`
+	Description []string `json:"description"`
+	Links       []Link   `json:"links"`
+}
+
+// a domain name (RFC 9083 section 5.3)
+type Domain struct {
+	Object
+	LDHName     string       `json:"ldhName"`     // the ASCII form
+	UnicodeName string       `json:"unicodeName"` // for an IDN
+	Nameservers []Nameserver `json:"nameservers"`
+	SecureDNS   *SecureDNS   `json:"secureDNS"`
+}
+
+type Nameserver struct {
+	Object
+	LDHName     string `json:"ldhName"`
+	IPAddresses struct {
+		V4 []string `json:"v4"`
+		V6 []string `json:"v6"`
+	} `json:"ipAddresses"`
+}
+
+// the DNSSEC delegation of a domain
+type SecureDNS struct {
+	ZoneSigned       bool     `json:"zoneSigned"`
+	DelegationSigned bool     `json:"delegationSigned"`
+	DSData           []DSData `json:"dsData"`
+}
+
+type DSData struct {
+	KeyTag     int    `json:"keyTag"`
+	Algorithm  int    `json:"algorithm"`
+	DigestType int    `json:"digestType"`
+	Digest     string `json:"digest"`
+}
+
+// an address block (RFC 9083 section 5.4)
+type IPNetwork struct {
+	Object
+	StartAddress string `json:"startAddress"`
+	EndAddress   string `json:"endAddress"`
+	IPVersion    string `json:"ipVersion"` // "v4" or "v6"
+	Name         string `json:"name"`
+	Type         string `json:"type"` // eg. "ALLOCATED PA", "DIRECT ALLOCATION"
+	Country      string `json:"country"`
+	ParentHandle string `json:"parentHandle"`
+	// the block as prefixes, the cidr0 extension most registries have
+	CIDRs []struct {
+		V4Prefix string `json:"v4prefix"`
+		V6Prefix string `json:"v6prefix"`
+		Length   int    `json:"length"`
+	} `json:"cidr0_cidrs"`
+}
+
+// the block as prefixes, eg. 192.0.2.0/24; empty without the cidr0 extension
+func (n *IPNetwork) Prefixes() []string {
+	var prefixes []string
+	for _, c := range n.CIDRs {
+		prefix := c.V4Prefix
+		if prefix == "" {
+			prefix = c.V6Prefix
+		}
+		prefixes = append(prefixes, fmt.Sprintf("%s/%d", prefix, c.Length))
+	}
+	return prefixes
+}
+
+// an autonomous system number, or a range of them (RFC 9083 section 5.5)
+type Autnum struct {
+	Object
+	StartAutnum uint32 `json:"startAutnum"`
+	EndAutnum   uint32 `json:"endAutnum"`
+	Name        string `json:"name"`
+	Type        string `json:"type"`
+	Country     string `json:"country"`
+}
+
+// a person or organisation with its roles towards the object
+// (RFC 9083 section 5.1)
+type Entity struct {
+	Object
+	Roles     []string `json:"roles"`
+	VCard     VCard    `json:"vcardArray"`
+	PublicIDs []struct {
+		Type       string `json:"type"` // eg. "IANA Registrar ID"
+		Identifier string `json:"identifier"`
+	} `json:"publicIds"`
+}
+
+// the entity's name, from its vCard, or its handle
+func (e *Entity) Name() string {
+	if fn := e.VCard.Get("fn"); fn != "" {
+		return fn
+	}
+	if org := e.VCard.Get("org"); org != "" {
+		return org
+	}
+	return e.Handle
+}
+
+// a jCard (RFC 7095): ["vcard", [[name, params, type, value...], ...]]
+type VCard []VCardProperty
+
+type VCardProperty struct {
+	Name   string
+	Params map[string]any
+	Type   string // eg. "text", "uri"
+	Values []any  // a string mostly, an array for structured ones like adr
+}
+
+func (v *VCard) UnmarshalJSON(data []byte) error {
+	var card []json.RawMessage
+	if err := json.Unmarshal(data, &card); err != nil {
+		return err
+	}
+	if len(card) < 2 {
+		*v = nil
+		return nil
+	}
+	var props [][]json.RawMessage
+	if err := json.Unmarshal(card[1], &props); err != nil {
+		return fmt.Errorf("invalid jCard: %w", err)
+	}
+	*v = (*v)[:0]
+	for _, p := range props {
+		if len(p) < 4 {
+			return fmt.Errorf("invalid jCard property of %d members", len(p))
+		}
+		var prop VCardProperty
+		if err := json.Unmarshal(p[0], &prop.Name); err != nil {
+			return fmt.Errorf("invalid jCard property name: %w", err)
+		}
+		json.Unmarshal(p[1], &prop.Params)
+		json.Unmarshal(p[2], &prop.Type)
+		for _, raw := range p[3:] {
+			var value any
+			if err := json.Unmarshal(raw, &value); err != nil {
+				return fmt.Errorf("invalid jCard value of %s: %w", prop.Name, err)
+			}
+			prop.Values = append(prop.Values, value)
+		}
+		prop.Name = strings.ToLower(prop.Name)
+		*v = append(*v, prop)
+	}
+	return nil
+}
+
+// back into a jCard, so that an object marshals as it was received
+func (v VCard) MarshalJSON() ([]byte, error) {
+	if v == nil {
+		return []byte("null"), nil
+	}
+	props := make([][]any, len(v))
+	for i, p := range v {
+		params := p.Params
+		if params == nil {
+			params = map[string]any{}
+		}
+		props[i] = append([]any{p.Name, params, p.Type}, p.Values...)
+	}
+	return json.Marshal([]any{"vcard", props})
+}
+
+// the first value of the property name as text, eg. "fn" or "email";
+// "" if there is none
+func (v VCard) Get(name string) string {
+	for _, p := range v {
+		if p.Name == name && len(p.Values) > 0 {
+			return vcardText(p.Values[0])
+		}
+	}
+	return ""
+}
+
+// a structured value, such as an org with units, joined by commas
+func vcardText(value any) string {
+	switch value := value.(type) {
+	case string:
+		return value
+	case []any:
+		var parts []string
+		for _, v := range value {
+			if s := vcardText(v); s != "" {
+				parts = append(parts, s)
+			}
+		}
+		return strings.Join(parts, ", ")
+	case nil:
+		return ""
+	}
+	return fmt.Sprint(value)
+}
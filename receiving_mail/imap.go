@@ -0,0 +1,753 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/mail"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// how the connection to the server is secured
+type TLSMode int
+
+const (
+	ImplicitTLS TLSMode = iota // TLS from the first byte (IMAPS, port 993)
+	StartTLS                   // plaintext connect, then STARTTLS (port 143)
+	NoTLS                      // plaintext only, for local test servers
+)
+
+type IMAPConfig struct {
+	Host     string
+	Port     string // default 993, or 143 without implicit TLS
+	Username string
+	Password string
+	TLSMode  TLSMode     // default implicit TLS
+	TLS      *tls.Config // nil for the system roots and Host as server name
+
+	Timeout time.Duration // per command, default 1 minute
+
+	// the largest literal, eg. a message body, taken from the server,
+	// default 64 MiB; a FETCH of a bigger message fails
+	MaxLiteral int
+}
+
+func (c IMAPConfig) addr() string {
+	port := c.Port
+	if port == "" {
+		port = "993"
+		if c.TLSMode != ImplicitTLS {
+			port = "143"
+		}
+	}
+	return net.JoinHostPort(c.Host, port)
+}
+
+func (c IMAPConfig) tlsConfig() *tls.Config {
+	if c.TLS != nil {
+		return c.TLS
+	}
+	return &tls.Config{ServerName: c.Host, MinVersion: tls.VersionTLS12}
+}
+
+// IMAPClient is an IMAP4rev1 (RFC 3501) session: list mailboxes, select
+// one, search and fetch its messages by UID, set flags and move them. It
+// is not safe for concurrent use, IMAP commands go one at a time.
+type IMAPClient struct {
+	conn    net.Conn
+	r       imapReader
+	w       *bufio.Writer
+	tag     int
+	timeout time.Duration
+	limit   time.Time // no command runs past it, when set
+	caps    map[string]bool
+
+	// the mailbox Select or Examine opened, nil before
+	Mailbox *MailboxStatus
+}
+
+// a mailbox from List
+type MailboxInfo struct {
+	Name       string   // decoded from modified UTF-7
+	Delimiter  string   // hierarchy delimiter, eg. "/" or "."
+	Attributes []string // eg. \HasChildren, \Noselect, \Sent, \Trash
+}
+
+// the state of the selected mailbox
+type MailboxStatus struct {
+	Name        string
+	ReadOnly    bool
+	Flags       []string
+	Exists      uint32 // messages
+	Recent      uint32
+	Unseen      uint32 // number of the first unseen message, 0 if unknown
+	UIDValidity uint32 // UIDs are only valid as long as this stays the same
+	UIDNext     uint32
+}
+
+// a message from FetchHeaders or FetchMessages
+type Message struct {
+	UID          uint32
+	Flags        []string
+	InternalDate time.Time // when the server received it
+	Size         int       // of the whole message
+
+	Header mail.Header
+	Raw    []byte // the header section, or the whole message
+}
+
+// connect, log in and read the capabilities
+func DialIMAP(ctx context.Context, config IMAPConfig) (*IMAPClient, error) {
+	var dialer net.Dialer
+	var conn net.Conn
+	var err error
+	if config.TLSMode == ImplicitTLS {
+		tlsDialer := tls.Dialer{NetDialer: &dialer, Config: config.tlsConfig()}
+		conn, err = tlsDialer.DialContext(ctx, "tcp", config.addr())
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", config.addr())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial IMAP server: %w", err)
+	}
+
+	c := newIMAPClient(conn, config.Timeout)
+	c.r.maxLiteral = config.MaxLiteral
+	// ctx covers the greeting and the login
+	c.limit, _ = ctx.Deadline()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	err = c.setup(config)
+	if !stop() {
+		// the connection was closed under the setup
+		err = ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	c.limit = time.Time{}
+	return c, nil
+}
+
+func newIMAPClient(conn net.Conn, timeout time.Duration) *IMAPClient {
+	if timeout <= 0 {
+		timeout = time.Minute
+	}
+	return &IMAPClient{
+		conn:    conn,
+		r:       imapReader{r: bufio.NewReader(conn)},
+		w:       bufio.NewWriter(conn),
+		timeout: timeout,
+	}
+}
+
+// greeting, STARTTLS, login
+func (c *IMAPClient) setup(config IMAPConfig) error {
+	c.setDeadline()
+	greeting, err := c.r.readResponse()
+	if err != nil {
+		return fmt.Errorf("failed to read greeting: %w", err)
+	}
+	switch greeting.name {
+	case "OK", "PREAUTH":
+	default:
+		return fmt.Errorf("server refused the connection: %s %s", greeting.name, greeting.text)
+	}
+	c.readCode(greeting.code)
+
+	if config.TLSMode == StartTLS {
+		if _, err := c.execute("STARTTLS"); err != nil {
+			return fmt.Errorf("failed to start TLS: %w", err)
+		}
+		tlsConn := tls.Client(c.conn, config.tlsConfig())
+		if err := tlsConn.Handshake(); err != nil {
+			return fmt.Errorf("failed to start TLS: %w", err)
+		}
+		c.conn = tlsConn
+		c.r.r = bufio.NewReader(tlsConn)
+		c.w = bufio.NewWriter(tlsConn)
+		c.caps = nil // RFC 3501 6.2.1: ask again
+	}
+
+	if greeting.name != "PREAUTH" {
+		if err := c.login(config.Username, config.Password); err != nil {
+			return err
+		}
+	}
+	if c.caps == nil {
+		return c.capability()
+	}
+	return nil
+}
+
+// the LOGIN command, or AUTHENTICATE PLAIN where LOGIN is disabled
+func (c *IMAPClient) login(username, password string) error {
+	if c.caps == nil {
+		if err := c.capability(); err != nil {
+			return err
+		}
+	}
+	var resp *imapResult
+	var err error
+	if c.caps["LOGINDISABLED"] {
+		if !c.caps["AUTH=PLAIN"] {
+			return errors.New("imap: server allows neither LOGIN nor AUTHENTICATE PLAIN")
+		}
+		resp, err = c.execute("AUTHENTICATE PLAIN",
+			imapContinuation(base64.StdEncoding.EncodeToString([]byte("\x00"+username+"\x00"+password))))
+	} else {
+		resp, err = c.execute("LOGIN", imapString(username), imapString(password))
+	}
+	if err != nil {
+		return fmt.Errorf("login failed: %w", err)
+	}
+	// servers may send new capabilities with the completion
+	c.caps = nil
+	c.readCode(resp.code)
+	return nil
+}
+
+func (c *IMAPClient) capability() error {
+	resp, err := c.execute("CAPABILITY")
+	if err != nil {
+		return err
+	}
+	for _, data := range resp.data {
+		if data.name == "CAPABILITY" {
+			c.setCaps(data.fields)
+		}
+	}
+	return nil
+}
+
+// the response code of a greeting or completion, the capabilities if it
+// has them
+func (c *IMAPClient) readCode(code string) {
+	if rest, ok := strings.CutPrefix(code, "CAPABILITY "); ok {
+		var fields []any
+		for _, cap := range strings.Fields(rest) {
+			fields = append(fields, imapAtom(cap))
+		}
+		c.setCaps(fields)
+	}
+}
+
+func (c *IMAPClient) setCaps(fields []any) {
+	c.caps = map[string]bool{}
+	for _, f := range fields {
+		c.caps[strings.ToUpper(atomString(f))] = true
+	}
+}
+
+// whether the server announced capability, eg. "MOVE" or "UIDPLUS"
+func (c *IMAPClient) Has(capability string) bool {
+	return c.caps[strings.ToUpper(capability)]
+}
+
+// the mailboxes matching pattern, where * matches anything and % anything
+// but the hierarchy delimiter; "*" lists them all
+func (c *IMAPClient) List(pattern string) ([]MailboxInfo, error) {
+	resp, err := c.execute("LIST", imapString(""), imapString(encodeMailbox(pattern)))
+	if err != nil {
+		return nil, fmt.Errorf("LIST failed: %w", err)
+	}
+	var boxes []MailboxInfo
+	for _, data := range resp.data {
+		if data.name != "LIST" || len(data.fields) < 3 {
+			continue
+		}
+		boxes = append(boxes, MailboxInfo{
+			Attributes: atomList(data.fields[0]),
+			Delimiter:  atomString(data.fields[1]),
+			Name:       decodeMailbox(atomString(data.fields[2])),
+		})
+	}
+	return boxes, nil
+}
+
+// open a mailbox to work on its messages
+func (c *IMAPClient) Select(name string) (*MailboxStatus, error) {
+	return c.open("SELECT", name)
+}
+
+// open a mailbox read-only, fetching doesn't mark messages seen
+func (c *IMAPClient) Examine(name string) (*MailboxStatus, error) {
+	return c.open("EXAMINE", name)
+}
+
+func (c *IMAPClient) open(command, name string) (*MailboxStatus, error) {
+	c.Mailbox = nil
+	resp, err := c.execute(command, imapString(encodeMailbox(name)))
+	if err != nil {
+		return nil, fmt.Errorf("%s %s failed: %w", command, name, err)
+	}
+	status := &MailboxStatus{Name: name, ReadOnly: strings.HasPrefix(resp.code, "READ-ONLY")}
+	for _, data := range resp.data {
+		switch data.name {
+		case "FLAGS":
+			if len(data.fields) > 0 {
+				status.Flags = atomList(data.fields[0])
+			}
+		case "EXISTS":
+			status.Exists = data.number
+		case "RECENT":
+			status.Recent = data.number
+		case "OK":
+			key, value, _ := strings.Cut(data.code, " ")
+			n, _ := strconv.ParseUint(value, 10, 32)
+			switch key {
+			case "UNSEEN":
+				status.Unseen = uint32(n)
+			case "UIDVALIDITY":
+				status.UIDValidity = uint32(n)
+			case "UIDNEXT":
+				status.UIDNext = uint32(n)
+			}
+		}
+	}
+	c.Mailbox = status
+	return status, nil
+}
+
+// SearchCriteria selects messages for Search; the set fields must all
+// match. Text fields match substrings, case-insensitively.
+type SearchCriteria struct {
+	From, To, Subject string
+	Text              string // anywhere in the header or body
+	Header            map[string]string
+
+	Since  time.Time // received on or after this day
+	Before time.Time // received before this day
+
+	Seen   bool
+	Unseen bool
+
+	Raw string // more IMAP search keys as they are, eg. "FLAGGED LARGER 100000"
+}
+
+// UIDs of the selected mailbox's messages matching criteria, ascending
+func (c *IMAPClient) Search(criteria SearchCriteria) ([]uint32, error) {
+	var args []any
+	add := func(key, value string) {
+		if value != "" {
+			args = append(args, imapAtom(key), imapString(value))
+		}
+	}
+	add("FROM", criteria.From)
+	add("TO", criteria.To)
+	add("SUBJECT", criteria.Subject)
+	add("TEXT", criteria.Text)
+	names := make([]string, 0, len(criteria.Header))
+	for name := range criteria.Header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		args = append(args, imapAtom("HEADER"), imapString(name), imapString(criteria.Header[name]))
+	}
+	if !criteria.Since.IsZero() {
+		args = append(args, imapAtom("SINCE "+criteria.Since.Format("2-Jan-2006")))
+	}
+	if !criteria.Before.IsZero() {
+		args = append(args, imapAtom("BEFORE "+criteria.Before.Format("2-Jan-2006")))
+	}
+	if criteria.Seen {
+		args = append(args, imapAtom("SEEN"))
+	}
+	if criteria.Unseen {
+		args = append(args, imapAtom("UNSEEN"))
+	}
+	if criteria.Raw != "" {
+		args = append(args, imapAtom(criteria.Raw))
+	}
+	if len(args) == 0 {
+		args = append(args, imapAtom("ALL"))
+	}
+
+	command := "UID SEARCH"
+	for _, arg := range args {
+		if s, ok := arg.(imapString); ok && !isASCII(string(s)) {
+			command = "UID SEARCH CHARSET UTF-8"
+			break
+		}
+	}
+	resp, err := c.execute(command, args...)
+	if err != nil {
+		return nil, fmt.Errorf("SEARCH failed: %w", err)
+	}
+	var uids []uint32
+	for _, data := range resp.data {
+		if data.name == "SEARCH" {
+			for _, f := range data.fields {
+				uids = append(uids, atomNumber(f))
+			}
+		}
+	}
+	sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+	return uids, nil
+}
+
+// the headers, flags, dates and sizes of messages, without marking them
+// seen
+func (c *IMAPClient) FetchHeaders(uids ...uint32) ([]*Message, error) {
+	return c.fetch(uids, "BODY.PEEK[HEADER]")
+}
+
+// whole messages; in a mailbox opened with Select, fetching marks them
+// seen unless peek is set
+func (c *IMAPClient) FetchMessages(peek bool, uids ...uint32) ([]*Message, error) {
+	if peek {
+		return c.fetch(uids, "BODY.PEEK[]")
+	}
+	return c.fetch(uids, "BODY[]")
+}
+
+func (c *IMAPClient) fetch(uids []uint32, section string) ([]*Message, error) {
+	if len(uids) == 0 {
+		return nil, nil
+	}
+	resp, err := c.execute("UID FETCH", imapAtom(uidSet(uids)), imapAtom("(UID FLAGS INTERNALDATE RFC822.SIZE "+section+")"))
+	if err != nil {
+		return nil, fmt.Errorf("FETCH failed: %w", err)
+	}
+
+	byUID := map[uint32]*Message{}
+	for _, data := range resp.data {
+		if data.name != "FETCH" || len(data.fields) == 0 {
+			continue
+		}
+		items, _ := data.fields[0].([]any)
+		msg := &Message{}
+		for i := 0; i+1 < len(items); i += 2 {
+			key, value := strings.ToUpper(atomString(items[i])), items[i+1]
+			switch {
+			case key == "UID":
+				msg.UID = atomNumber(value)
+			case key == "FLAGS":
+				msg.Flags = atomList(value)
+			case key == "INTERNALDATE":
+				msg.InternalDate, _ = time.Parse("2-Jan-2006 15:04:05 -0700", strings.TrimSpace(atomString(value)))
+			case key == "RFC822.SIZE":
+				msg.Size = int(atomNumber(value))
+			case strings.HasPrefix(key, "BODY["):
+				msg.Raw = []byte(atomString(value))
+			}
+		}
+		if msg.UID == 0 || msg.Raw == nil {
+			continue // an unsolicited flag update
+		}
+		if parsed, err := mail.ReadMessage(bytes.NewReader(msg.Raw)); err == nil {
+			msg.Header = parsed.Header
+		}
+		byUID[msg.UID] = msg
+	}
+
+	// in the order asked for
+	msgs := make([]*Message, 0, len(byUID))
+	for _, uid := range uids {
+		if msg, ok := byUID[uid]; ok {
+			msgs = append(msgs, msg)
+			delete(byUID, uid)
+		}
+	}
+	return msgs, nil
+}
+
+// add flags such as \Seen, \Flagged or \Deleted to messages
+func (c *IMAPClient) AddFlags(uids []uint32, flags ...string) error {
+	return c.store(uids, "+FLAGS.SILENT", flags)
+}
+
+func (c *IMAPClient) RemoveFlags(uids []uint32, flags ...string) error {
+	return c.store(uids, "-FLAGS.SILENT", flags)
+}
+
+func (c *IMAPClient) MarkSeen(uids ...uint32) error {
+	return c.AddFlags(uids, `\Seen`)
+}
+
+func (c *IMAPClient) store(uids []uint32, item string, flags []string) error {
+	if len(uids) == 0 {
+		return nil
+	}
+	_, err := c.execute("UID STORE", imapAtom(uidSet(uids)), imapAtom(item), imapAtom("("+strings.Join(flags, " ")+")"))
+	if err != nil {
+		return fmt.Errorf("STORE failed: %w", err)
+	}
+	return nil
+}
+
+// move messages to another mailbox: MOVE (RFC 6851) where the server has
+// it, COPY, \Deleted and expunge otherwise. Without UIDPLUS the expunge
+// also removes other messages marked \Deleted.
+func (c *IMAPClient) Move(mailbox string, uids ...uint32) error {
+	if len(uids) == 0 {
+		return nil
+	}
+	set, dest := imapAtom(uidSet(uids)), imapString(encodeMailbox(mailbox))
+	if c.Has("MOVE") {
+		if _, err := c.execute("UID MOVE", set, dest); err != nil {
+			return fmt.Errorf("MOVE failed: %w", err)
+		}
+		return nil
+	}
+	if _, err := c.execute("UID COPY", set, dest); err != nil {
+		return fmt.Errorf("COPY failed: %w", err)
+	}
+	if err := c.AddFlags(uids, `\Deleted`); err != nil {
+		return err
+	}
+	var err error
+	if c.Has("UIDPLUS") {
+		_, err = c.execute("UID EXPUNGE", set)
+	} else {
+		_, err = c.execute("EXPUNGE")
+	}
+	if err != nil {
+		return fmt.Errorf("EXPUNGE failed: %w", err)
+	}
+	return nil
+}
+
+// end the session and close the connection
+func (c *IMAPClient) Logout() error {
+	_, err := c.execute("LOGOUT")
+	if closeErr := c.conn.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// close the connection without logging out
+func (c *IMAPClient) Close() error {
+	return c.conn.Close()
+}
+
+// command arguments other than atoms: an astring, sent quoted or as a
+// literal, and the line sent in answer to a continuation request
+type (
+	imapString       string
+	imapContinuation string
+)
+
+// what a command got back: its completion and the untagged responses
+// before it
+type imapResult struct {
+	*imapResponse
+	data []*imapResponse
+}
+
+// the error of a NO or BAD completion
+type IMAPError struct {
+	Status string // NO or BAD
+	Code   string // response code, eg. "AUTHENTICATIONFAILED" (RFC 5530)
+	Text   string
+}
+
+func (e *IMAPError) Error() string {
+	if e.Code != "" {
+		return fmt.Sprintf("%s [%s] %s", e.Status, e.Code, e.Text)
+	}
+	return e.Status + " " + e.Text
+}
+
+// send a command and read until its completion. A NO or BAD completion
+// is an *IMAPError.
+func (c *IMAPClient) execute(command string, args ...any) (*imapResult, error) {
+	c.setDeadline()
+	defer c.conn.SetDeadline(time.Time{})
+
+	c.tag++
+	tag := fmt.Sprintf("A%03d", c.tag)
+	c.w.WriteString(tag + " " + command)
+	for _, arg := range args {
+		switch arg := arg.(type) {
+		case imapAtom:
+			c.w.WriteString(" " + string(arg))
+		case imapString:
+			if err := c.writeString(string(arg)); err != nil {
+				return nil, err
+			}
+		case imapContinuation:
+			// sent when the server asks for it, below
+		}
+	}
+	c.w.WriteString("\r\n")
+	if err := c.w.Flush(); err != nil {
+		return nil, err
+	}
+
+	result := &imapResult{}
+	for {
+		resp, err := c.r.readResponse()
+		if err != nil {
+			return nil, err
+		}
+		switch resp.tag {
+		case tag:
+			result.imapResponse = resp
+			if resp.name != "OK" {
+				return result, &IMAPError{Status: resp.name, Code: resp.code, Text: resp.text}
+			}
+			return result, nil
+		case "+":
+			// an AUTHENTICATE exchange; cancel anything else
+			answer := "*"
+			for _, arg := range args {
+				if cont, ok := arg.(imapContinuation); ok {
+					answer = string(cont)
+				}
+			}
+			c.w.WriteString(answer + "\r\n")
+			if err := c.w.Flush(); err != nil {
+				return nil, err
+			}
+		default:
+			if resp.name == "BYE" && command != "LOGOUT" {
+				return nil, fmt.Errorf("imap: server closed the connection: %s", resp.text)
+			}
+			result.data = append(result.data, resp)
+		}
+	}
+}
+
+func (c *IMAPClient) setDeadline() {
+	deadline := time.Now().Add(c.timeout)
+	if !c.limit.IsZero() && c.limit.Before(deadline) {
+		deadline = c.limit
+	}
+	c.conn.SetDeadline(deadline)
+}
+
+// an astring argument: quoted if it can be, a literal otherwise, which
+// waits for the server's go-ahead unless it has LITERAL+
+func (c *IMAPClient) writeString(s string) error {
+	if isASCII(s) && !strings.ContainsAny(s, "\r\n") {
+		c.w.WriteString(` "` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`)
+		return nil
+	}
+	if c.Has("LITERAL+") {
+		fmt.Fprintf(c.w, " {%d+}\r\n%s", len(s), s)
+		return nil
+	}
+	fmt.Fprintf(c.w, " {%d}\r\n", len(s))
+	if err := c.w.Flush(); err != nil {
+		return err
+	}
+	resp, err := c.r.readResponse()
+	if err != nil {
+		return err
+	}
+	if resp.tag != "+" {
+		return &IMAPError{Status: resp.name, Code: resp.code, Text: resp.text}
+	}
+	c.w.WriteString(s)
+	return nil
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
+
+// 1:3,7,9:10
+func uidSet(uids []uint32) string {
+	sorted := append([]uint32(nil), uids...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	var parts []string
+	for i := 0; i < len(sorted); {
+		j := i
+		for j+1 < len(sorted) && sorted[j+1] <= sorted[j]+1 {
+			j++
+		}
+		if sorted[i] == sorted[j] {
+			parts = append(parts, strconv.FormatUint(uint64(sorted[i]), 10))
+		} else {
+			parts = append(parts, fmt.Sprintf("%d:%d", sorted[i], sorted[j]))
+		}
+		i = j + 1
+	}
+	return strings.Join(parts, ",")
+}
+
+// mailbox names are modified UTF-7 (RFC 3501 5.1.3): printable ASCII as
+// is, & as "&-", anything else as UTF-16 in base64 with , for / between
+// & and -
+var mailboxBase64 = base64.NewEncoding("ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+,").WithPadding(base64.NoPadding)
+
+func encodeMailbox(name string) string {
+	var b strings.Builder
+	var pending []rune
+	flush := func() {
+		if len(pending) == 0 {
+			return
+		}
+		units := utf16.Encode(pending)
+		data := make([]byte, 0, 2*len(units))
+		for _, u := range units {
+			data = append(data, byte(u>>8), byte(u))
+		}
+		b.WriteString("&" + mailboxBase64.EncodeToString(data) + "-")
+		pending = nil
+	}
+	for _, r := range name {
+		if r >= 0x20 && r <= 0x7e {
+			flush()
+			if r == '&' {
+				b.WriteString("&-")
+			} else {
+				b.WriteRune(r)
+			}
+			continue
+		}
+		pending = append(pending, r)
+	}
+	flush()
+	return b.String()
+}
+
+// the name as it is when it isn't valid modified UTF-7
+func decodeMailbox(name string) string {
+	var b strings.Builder
+	for rest := name; rest != ""; {
+		i := strings.IndexByte(rest, '&')
+		if i < 0 {
+			b.WriteString(rest)
+			break
+		}
+		b.WriteString(rest[:i])
+		j := strings.IndexByte(rest[i:], '-')
+		if j < 0 {
+			return name
+		}
+		encoded := rest[i+1 : i+j]
+		rest = rest[i+j+1:]
+		if encoded == "" {
+			b.WriteByte('&')
+			continue
+		}
+		data, err := mailboxBase64.DecodeString(encoded)
+		if err != nil || len(data)%2 != 0 {
+			return name
+		}
+		units := make([]uint16, len(data)/2)
+		for k := range units {
+			units[k] = uint16(data[2*k])<<8 | uint16(data[2*k+1])
+		}
+		b.WriteString(string(utf16.Decode(units)))
+	}
+	return b.String()
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// one server response line (RFC 3501 7), literals included
+type imapResponse struct {
+	tag    string // "*" untagged, "+" continuation, or the command's tag
+	number uint32 // message number of "* 12 FETCH" and the like
+	name   string // upper case: OK, NO, BAD, BYE, PREAUTH, CAPABILITY, LIST, FETCH, ...
+	fields []any  // the data after name, see readValue
+	code   string // response code of a status response, eg. "UIDVALIDITY 3857529045"
+	text   string // human readable text of a status and a continuation response
+}
+
+func (r *imapResponse) status() bool {
+	switch r.name {
+	case "OK", "NO", "BAD", "BYE", "PREAUTH":
+		return true
+	}
+	return false
+}
+
+// an IMAP atom, as opposed to a quoted string or literal, which are strings
+type imapAtom string
+
+// what a server response may hold, so a broken or hostile server can't
+// make the client allocate without bound
+const (
+	maxLiteral = 64 << 20 // default for IMAPConfig.MaxLiteral
+	maxToken   = 64 << 10 // atoms, quoted strings and status lines
+	maxDepth   = 32       // nested parenthesized lists
+)
+
+// reads responses straight from the connection. Values are imapAtom,
+// string, nil for NIL, and []any for parenthesized lists.
+type imapReader struct {
+	r          *bufio.Reader
+	maxLiteral int // default maxLiteral
+}
+
+func (p *imapReader) readResponse() (*imapResponse, error) {
+	tag, err := p.readWord()
+	if err != nil {
+		return nil, err
+	}
+	resp := &imapResponse{tag: tag}
+	if tag == "+" {
+		resp.text, err = p.readLine()
+		return resp, err
+	}
+
+	name, err := p.readWord()
+	if err != nil {
+		return nil, err
+	}
+	if n, err := strconv.ParseUint(name, 10, 32); err == nil && tag == "*" {
+		resp.number = uint32(n)
+		if name, err = p.readWord(); err != nil {
+			return nil, err
+		}
+	}
+	resp.name = strings.ToUpper(name)
+
+	if resp.status() {
+		line, err := p.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if rest, ok := strings.CutPrefix(line, "["); ok {
+			if i := strings.IndexByte(rest, ']'); i >= 0 {
+				resp.code, line = rest[:i], strings.TrimPrefix(rest[i+1:], " ")
+			}
+		}
+		resp.text = line
+		return resp, nil
+	}
+
+	for {
+		value, end, err := p.readValue(0)
+		if err != nil {
+			return nil, err
+		}
+		if end == '\n' {
+			return resp, nil
+		}
+		if end == ')' {
+			return nil, errors.New("imap: unbalanced ) in response")
+		}
+		resp.fields = append(resp.fields, value)
+	}
+}
+
+// up to the next space, which is consumed; a word at the end of the line
+// leaves the line ending for the next read
+func (p *imapReader) readWord() (string, error) {
+	var b strings.Builder
+	for {
+		c, err := p.r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		switch c {
+		case ' ':
+			return b.String(), nil
+		case '\r', '\n':
+			p.r.UnreadByte()
+			return b.String(), nil
+		}
+		if b.Len() >= maxToken {
+			return "", errTooLong("word")
+		}
+		b.WriteByte(c)
+	}
+}
+
+// the rest of the line without its CRLF
+func (p *imapReader) readLine() (string, error) {
+	var line []byte
+	for {
+		chunk, err := p.r.ReadSlice('\n')
+		if len(line)+len(chunk) > maxToken {
+			return "", errTooLong("line")
+		}
+		line = append(line, chunk...)
+		if err != bufio.ErrBufferFull {
+			if err != nil {
+				return "", err
+			}
+			return strings.TrimRight(string(line), "\r\n"), nil
+		}
+	}
+}
+
+func errTooLong(what string) error {
+	return fmt.Errorf("imap: %s longer than %d bytes in response", what, maxToken)
+}
+
+// the next value; end is ')' or '\n' instead when a list or the line ends.
+// depth is the number of lists the value is in.
+func (p *imapReader) readValue(depth int) (value any, end byte, err error) {
+	c, err := p.r.ReadByte()
+	for err == nil && c == ' ' {
+		c, err = p.r.ReadByte()
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	switch c {
+	case '\r':
+		if c, err = p.r.ReadByte(); err != nil {
+			return nil, 0, err
+		}
+		if c != '\n' {
+			return nil, 0, errors.New("imap: CR without LF")
+		}
+		return nil, '\n', nil
+	case '\n', ')':
+		return nil, c, nil
+	case '(':
+		if depth >= maxDepth {
+			return nil, 0, fmt.Errorf("imap: lists nested more than %d deep in response", maxDepth)
+		}
+		list := []any{}
+		for {
+			v, end, err := p.readValue(depth + 1)
+			if err != nil {
+				return nil, 0, err
+			}
+			if end == ')' {
+				return list, 0, nil
+			}
+			if end == '\n' {
+				return nil, 0, errors.New("imap: unterminated list")
+			}
+			list = append(list, v)
+		}
+	case '"':
+		s, err := p.readQuoted()
+		return s, 0, err
+	case '{':
+		s, err := p.readLiteral()
+		return s, 0, err
+	}
+
+	p.r.UnreadByte()
+	atom, err := p.readAtom()
+	if err != nil {
+		return nil, 0, err
+	}
+	if strings.EqualFold(atom, "NIL") {
+		return nil, 0, nil
+	}
+	return imapAtom(atom), 0, nil
+}
+
+func (p *imapReader) readQuoted() (string, error) {
+	var b strings.Builder
+	for {
+		c, err := p.r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		switch c {
+		case '"':
+			return b.String(), nil
+		case '\\':
+			if c, err = p.r.ReadByte(); err != nil {
+				return "", err
+			}
+		case '\r', '\n':
+			return "", errors.New("imap: line break in quoted string")
+		}
+		if b.Len() >= maxToken {
+			return "", errTooLong("quoted string")
+		}
+		b.WriteByte(c)
+	}
+}
+
+// {n} CRLF and n octets
+func (p *imapReader) readLiteral() (string, error) {
+	line, err := p.readLine()
+	if err != nil {
+		return "", err
+	}
+	digits, ok := strings.CutSuffix(line, "}")
+	size, err := strconv.Atoi(digits)
+	if !ok || err != nil || size < 0 {
+		return "", fmt.Errorf("imap: invalid literal size %q", line)
+	}
+	limit := p.maxLiteral
+	if limit <= 0 {
+		limit = maxLiteral
+	}
+	if size > limit {
+		return "", fmt.Errorf("imap: literal of %d bytes exceeds the limit of %d", size, limit)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(p.r, data); err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// an atom, where a section such as BODY[HEADER.FIELDS (FROM TO)] counts as
+// part of it
+func (p *imapReader) readAtom() (string, error) {
+	var b strings.Builder
+	depth := 0
+	for {
+		c, err := p.r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		switch {
+		case c == '[':
+			depth++
+		case c == ']' && depth > 0:
+			depth--
+		case depth == 0 && (c == ' ' || c == '(' || c == ')' || c == '\r' || c == '\n'):
+			p.r.UnreadByte()
+			return b.String(), nil
+		}
+		if b.Len() >= maxToken {
+			return "", errTooLong("atom")
+		}
+		b.WriteByte(c)
+	}
+}
+
+// helpers for reading the values of a response
+
+func atomString(v any) string {
+	switch v := v.(type) {
+	case imapAtom:
+		return string(v)
+	case string:
+		return v
+	}
+	return ""
+}
+
+func atomNumber(v any) uint32 {
+	n, _ := strconv.ParseUint(atomString(v), 10, 32)
+	return uint32(n)
+}
+
+func atomList(v any) []string {
+	list, _ := v.([]any)
+	strs := make([]string, 0, len(list))
+	for _, item := range list {
+		strs = append(strs, atomString(item))
+	}
+	return strs
+}
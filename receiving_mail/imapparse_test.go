@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bufio"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadResponse(t *testing.T) {
+	input := "* 12 FETCH (UID 7 FLAGS (\\Seen) BODY[HEADER.FIELDS (FROM)] {11}\r\nFrom: a@b\r\n)\r\n" +
+		"A1 OK [READ-WRITE] SELECT completed\r\n"
+	p := &imapReader{r: bufio.NewReader(strings.NewReader(input))}
+
+	resp, err := p.readResponse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []any{[]any{
+		imapAtom("UID"), imapAtom("7"),
+		imapAtom("FLAGS"), []any{imapAtom(`\Seen`)},
+		imapAtom("BODY[HEADER.FIELDS (FROM)]"), "From: a@b\r\n",
+	}}
+	if resp.tag != "*" || resp.number != 12 || resp.name != "FETCH" || !reflect.DeepEqual(resp.fields, want) {
+		t.Errorf("got %+v", resp)
+	}
+
+	resp, err = p.readResponse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.tag != "A1" || resp.name != "OK" || resp.code != "READ-WRITE" || resp.text != "SELECT completed" {
+		t.Errorf("got %+v", resp)
+	}
+}
+
+func TestReadResponseMalformed(t *testing.T) {
+	long := strings.Repeat("x", maxToken+1)
+	tests := []struct {
+		name  string
+		input string
+		want  string // in the error
+	}{
+		{"huge literal", "* 1 FETCH (BODY[] {999999999999}\r\n", "exceeds the limit"},
+		{"literal over the limit", "* 1 FETCH (BODY[] {1025}\r\n", "exceeds the limit"},
+		{"negative literal", "* 1 FETCH (BODY[] {-1}\r\n", "invalid literal size"},
+		{"literal without brace", "* 1 FETCH (BODY[] {12\r\n", "invalid literal size"},
+		{"short literal", "* 1 FETCH (BODY[] {10}\r\nabc", "EOF"},
+		{"long atom", "* 1 FETCH (X" + long + ")\r\n", "atom longer"},
+		{"long quoted", "* LIST () \"/\" \"" + long + "\"\r\n", "quoted string longer"},
+		{"unterminated quoted", "* LIST () \"/\" \"INBOX\r\n", "line break in quoted string"},
+		{"long section", "* 1 FETCH (BODY[" + long, "atom longer"},
+		{"long word", "* " + long + " x\r\n", "word longer"},
+		{"long status", "A1 OK " + long + "\r\n", "line longer"},
+		{"deep lists", "* 1 FETCH " + strings.Repeat("(", maxDepth+1) + "\r\n", "nested"},
+		{"unterminated list", "* 1 FETCH (UID 7\r\n", "unterminated list"},
+		{"unbalanced", "* 1 FETCH UID 7)\r\n", "unbalanced"},
+		{"bare CR", "* 1 FETCH (UID 7)\rx", "CR without LF"},
+		{"eof", "* 1 FETCH (UID", "EOF"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &imapReader{r: bufio.NewReader(strings.NewReader(tt.input)), maxLiteral: 1024}
+			_, err := p.readResponse()
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got %v, want an error with %q", err, tt.want)
+			}
+		})
+	}
+}
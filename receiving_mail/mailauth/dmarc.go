@@ -0,0 +1,174 @@
+package mailauth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/publicsuffix"
+
+	"internet_services/sending_mail/dkim"
+)
+
+// what CheckDMARC found out about a message
+type DMARCVerdict struct {
+	Result dkim.Result
+	Domain string // of the From header
+	Policy string // the domain's policy, "none", "quarantine" or "reject"
+
+	// what to do with the message: the policy for a fail, unless pct=
+	// picked it to be spared, "none" otherwise
+	Disposition string
+
+	SPFAligned  bool // SPF passed for a domain aligned with From
+	DKIMAligned bool // a signature of an aligned domain verified
+	Err         error
+}
+
+// the parts of a _dmarc record CheckDMARC uses (RFC 7489 6.3)
+type dmarcRecord struct {
+	policy, subdomainPolicy string
+	strictDKIM, strictSPF   bool
+	percent                 int
+}
+
+// CheckDMARC applies the DMARC policy of the From domain (RFC 7489) to the
+// results of the other checks: the SPF result for spfDomain, the MAIL FROM
+// domain or the helo name of a bounce, and the DKIM verdicts. The message
+// passes when either passed for a domain aligned with From. dns nil
+// iterates from the root servers with a resolver.Client.
+func CheckDMARC(ctx context.Context, dns Resolver, from string, spf SPFResult, spfDomain string, signatures []dkim.Verdict) DMARCVerdict {
+	dns = defaultResolver(dns)
+	verdict := DMARCVerdict{Domain: from, Disposition: "none"}
+	if at := strings.LastIndexByte(from, '@'); at >= 0 {
+		verdict.Domain = from[at+1:]
+	}
+	verdict.Domain = strings.ToLower(strings.TrimSuffix(verdict.Domain, "."))
+	if verdict.Domain == "" {
+		verdict.Result, verdict.Err = dkim.PermError, errors.New("dmarc: no From domain")
+		return verdict
+	}
+	orgDomain := organizationalDomain(verdict.Domain)
+
+	// the record of the domain, or else of its organizational domain, whose
+	// sp= is for subdomains
+	record, err := lookupDMARC(ctx, dns, verdict.Domain)
+	policy := record.policy
+	if err == nil && record.policy == "" && orgDomain != verdict.Domain {
+		record, err = lookupDMARC(ctx, dns, orgDomain)
+		policy = record.subdomainPolicy
+	}
+	switch {
+	case err != nil:
+		var dnsErr *net.DNSError
+		verdict.Result, verdict.Err = dkim.PermError, err
+		if errors.As(err, &dnsErr) {
+			verdict.Result = dkim.TempError
+		}
+		return verdict
+	case record.policy == "":
+		verdict.Result = dkim.None
+		return verdict
+	}
+	verdict.Policy = policy
+
+	aligned := func(domain string, strict bool) bool {
+		domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+		if strict {
+			return domain == verdict.Domain
+		}
+		return organizationalDomain(domain) == orgDomain
+	}
+	verdict.SPFAligned = spf == SPFPass && aligned(spfDomain, record.strictSPF)
+	for _, d := range signatures {
+		if d.Result == dkim.Pass && aligned(d.Domain, record.strictDKIM) {
+			verdict.DKIMAligned = true
+		}
+	}
+	if verdict.SPFAligned || verdict.DKIMAligned {
+		verdict.Result = dkim.Pass
+		return verdict
+	}
+
+	verdict.Result = dkim.Fail
+	verdict.Disposition = policy
+	if record.percent < 100 {
+		// the same message gets the same treatment at every delivery
+		h := fnv.New32a()
+		fmt.Fprintf(h, "%s %v", from, signatures)
+		if int(h.Sum32()%100) >= record.percent {
+			// RFC 7489 6.6.4: one step milder
+			verdict.Disposition = map[string]string{"reject": "quarantine", "quarantine": "none"}[policy]
+			if verdict.Disposition == "" {
+				verdict.Disposition = "none"
+			}
+		}
+	}
+	return verdict
+}
+
+// the _dmarc record of domain, zero when there is none
+func lookupDMARC(ctx context.Context, dns Resolver, domain string) (dmarcRecord, error) {
+	txts, err := dns.LookupTXT(ctx, "_dmarc."+domain)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return dmarcRecord{}, nil
+		}
+		return dmarcRecord{}, err
+	}
+	var records []string
+	for _, txt := range txts {
+		if strings.HasPrefix(txt, "v=DMARC1") {
+			records = append(records, txt)
+		}
+	}
+	// RFC 7489 6.6.3: none, or more than one, is no policy
+	if len(records) != 1 {
+		return dmarcRecord{}, nil
+	}
+	tags, err := dkim.ParseTagList(records[0])
+	if err != nil {
+		return dmarcRecord{}, fmt.Errorf("dmarc: record of %s: %w", domain, err)
+	}
+	record := dmarcRecord{
+		policy:     strings.ToLower(tags["p"]),
+		strictDKIM: strings.EqualFold(tags["adkim"], "s"),
+		strictSPF:  strings.EqualFold(tags["aspf"], "s"),
+		percent:    100,
+	}
+	switch record.policy {
+	case "none", "quarantine", "reject":
+	default:
+		// RFC 7489 6.6.3: a record with rua= but no valid p= counts as none
+		if _, ok := tags["rua"]; ok {
+			record.policy = "none"
+		} else {
+			return dmarcRecord{}, nil
+		}
+	}
+	record.subdomainPolicy = record.policy
+	switch sp := strings.ToLower(tags["sp"]); sp {
+	case "none", "quarantine", "reject":
+		record.subdomainPolicy = sp
+	}
+	if pct, ok := tags["pct"]; ok {
+		if n, err := strconv.Atoi(pct); err == nil && n >= 0 && n <= 100 {
+			record.percent = n
+		}
+	}
+	return record, nil
+}
+
+// the registered domain, eg. example.co.uk for mail.example.co.uk
+func organizationalDomain(domain string) string {
+	org, err := publicsuffix.EffectiveTLDPlusOne(domain)
+	if err != nil {
+		return domain
+	}
+	return org
+}
@@ -0,0 +1,559 @@
+// Package mailauth checks where received mail comes from: whether the
+// client may send for the envelope sender's domain (SPF, RFC 7208), and
+// whether the From domain's DMARC policy (RFC 7489) lets the message pass
+// on its SPF and DKIM results. The lookups go through the repo's DNS
+// resolver unless another Resolver is given.
+package mailauth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"internet_services/dns_lookup/resolver"
+)
+
+// the lookups of the checks, a *resolver.Client or a *net.Resolver
+type Resolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupIP(ctx context.Context, network, host string) ([]net.IP, error)
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+}
+
+// a Resolver iterating from the root servers, for a nil one
+func defaultResolver(dns Resolver) Resolver {
+	if dns == nil {
+		return resolver.New()
+	}
+	return dns
+}
+
+// the outcome of an SPF check (RFC 7208 2.6)
+type SPFResult string
+
+const (
+	SPFNone      SPFResult = "none"      // the domain publishes no record
+	SPFNeutral   SPFResult = "neutral"   // the record makes no statement about the IP
+	SPFPass      SPFResult = "pass"      // the IP may send for the domain
+	SPFFail      SPFResult = "fail"      // it may not
+	SPFSoftFail  SPFResult = "softfail"  // probably not
+	SPFTempError SPFResult = "temperror" // DNS trouble, try again later
+	SPFPermError SPFResult = "permerror" // the record is broken
+)
+
+// RFC 7208 4.6.4
+const (
+	spfLookupLimit = 10
+	spfVoidLimit   = 2
+)
+
+// CheckSPF tells whether ip may send mail from sender, the MAIL FROM
+// address, according to the SPF record of its domain. An empty sender, a
+// bounce, is checked as postmaster of the helo name. The error explains
+// a permerror or temperror. dns nil iterates from the root servers with
+// a resolver.Client.
+func CheckSPF(ctx context.Context, dns Resolver, ip net.IP, helo, sender string) (SPFResult, error) {
+	if sender == "" {
+		sender = "postmaster@" + helo
+	}
+	local, domain, found := strings.Cut(sender, "@")
+	if !found {
+		local, domain = "postmaster", sender
+	}
+	if local == "" {
+		local = "postmaster"
+	}
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+	check := &spfCheck{
+		resolver: defaultResolver(dns),
+		ip:       ip,
+		helo:     helo,
+		sender:   local + "@" + domain,
+		local:    local,
+		domain:   domain,
+	}
+	return check.checkHost(ctx, strings.TrimSuffix(domain, "."), 0)
+}
+
+// one evaluation, its lookup counts shared by the includes and redirects
+type spfCheck struct {
+	resolver Resolver
+	ip       net.IP
+	helo     string
+	sender   string
+	local    string
+	domain   string // of the sender
+	lookups  int
+	voids    int
+}
+
+// RFC 7208 4: the check_host() function
+func (c *spfCheck) checkHost(ctx context.Context, domain string, depth int) (SPFResult, error) {
+	if !validSPFDomain(domain) {
+		return SPFNone, nil
+	}
+	record, err := c.record(ctx, domain)
+	if record == "" || err != nil {
+		if err == nil {
+			return SPFNone, nil
+		}
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) {
+			return SPFTempError, err
+		}
+		return SPFPermError, err
+	}
+
+	var redirect string
+	terms := strings.Fields(record)[1:]
+	for _, term := range terms {
+		if name, value, ok := strings.Cut(term, "="); ok && spfModifier(name) {
+			if strings.EqualFold(name, "redirect") {
+				if redirect != "" {
+					return SPFPermError, fmt.Errorf("spf: %s: redirect twice", domain)
+				}
+				redirect = value
+			}
+			continue
+		}
+
+		result := SPFPass
+		switch term[0] {
+		case '+', '-', '~', '?':
+			result = map[byte]SPFResult{'+': SPFPass, '-': SPFFail, '~': SPFSoftFail, '?': SPFNeutral}[term[0]]
+			term = term[1:]
+		}
+		match, err := c.mechanism(ctx, domain, term, depth)
+		if err != nil {
+			var temp spfTempError
+			if errors.As(err, &temp) {
+				return SPFTempError, err
+			}
+			return SPFPermError, err
+		}
+		if match {
+			return result, nil
+		}
+	}
+
+	if redirect == "" {
+		return SPFNeutral, nil
+	}
+	target, err := c.expand(redirect, domain)
+	if err != nil {
+		return SPFPermError, err
+	}
+	if err := c.count(); err != nil {
+		return SPFPermError, err
+	}
+	if depth >= spfLookupLimit {
+		return SPFPermError, fmt.Errorf("spf: %s: redirects nest too deep", domain)
+	}
+	result, err := c.checkHost(ctx, target, depth+1)
+	if result == SPFNone {
+		return SPFPermError, fmt.Errorf("spf: redirect to %s, which has no record", target)
+	}
+	return result, err
+}
+
+// the v=spf1 record of domain, "" if there is none
+func (c *spfCheck) record(ctx context.Context, domain string) (string, error) {
+	txts, err := c.resolver.LookupTXT(ctx, domain)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return "", nil
+		}
+		return "", err
+	}
+	var records []string
+	for _, txt := range txts {
+		if strings.EqualFold(txt, "v=spf1") || len(txt) > 7 && strings.EqualFold(txt[:7], "v=spf1 ") {
+			records = append(records, txt)
+		}
+	}
+	switch len(records) {
+	case 0:
+		return "", nil
+	case 1:
+		return records[0], nil
+	}
+	return "", fmt.Errorf("spf: %s has %d records", domain, len(records))
+}
+
+// a temporary DNS failure in a mechanism
+type spfTempError struct{ error }
+
+func (c *spfCheck) mechanism(ctx context.Context, domain, term string, depth int) (bool, error) {
+	name, arg, hasArg := strings.Cut(term, ":")
+	if !hasArg {
+		name, arg, _ = strings.Cut(term, "/")
+		if arg != "" {
+			arg = "/" + arg
+		}
+	}
+
+	switch strings.ToLower(name) {
+	case "all":
+		return true, nil
+
+	case "ip4", "ip6":
+		prefix := arg
+		if !strings.Contains(prefix, "/") {
+			prefix += map[string]string{"ip4": "/32", "ip6": "/128"}[strings.ToLower(name)]
+		}
+		_, network, err := net.ParseCIDR(prefix)
+		if err != nil || !hasArg {
+			return false, fmt.Errorf("spf: %s: invalid %s", domain, term)
+		}
+		return network.Contains(c.ip), nil
+
+	case "include":
+		if err := c.count(); err != nil {
+			return false, err
+		}
+		target, err := c.expand(arg, domain)
+		if err != nil || !hasArg {
+			return false, fmt.Errorf("spf: %s: invalid %s", domain, term)
+		}
+		if depth >= spfLookupLimit {
+			return false, fmt.Errorf("spf: %s: includes nest too deep", domain)
+		}
+		result, err := c.checkHost(ctx, target, depth+1)
+		switch result {
+		case SPFPass:
+			return true, nil
+		case SPFTempError:
+			return false, spfTempError{err}
+		case SPFNone:
+			return false, fmt.Errorf("spf: include of %s, which has no record", target)
+		case SPFPermError:
+			return false, err
+		}
+		return false, nil
+
+	case "a", "mx":
+		if err := c.count(); err != nil {
+			return false, err
+		}
+		target, v4Bits, v6Bits, err := c.targetAndCIDR(arg, domain)
+		if err != nil {
+			return false, err
+		}
+		hosts := []string{target}
+		if strings.EqualFold(name, "mx") {
+			mxs, err := c.resolver.LookupMX(ctx, target)
+			if err := c.lookupError(err); err != nil {
+				return false, err
+			}
+			if len(mxs) > spfLookupLimit {
+				return false, fmt.Errorf("spf: %s has more than %d MX records", target, spfLookupLimit)
+			}
+			hosts = hosts[:0]
+			for _, mx := range mxs {
+				hosts = append(hosts, mx.Host)
+			}
+		}
+		for _, host := range hosts {
+			ips, err := c.lookupIP(ctx, host)
+			if err != nil {
+				return false, err
+			}
+			for _, ip := range ips {
+				if c.inNetwork(ip, v4Bits, v6Bits) {
+					return true, nil
+				}
+			}
+		}
+		return false, nil
+
+	case "ptr":
+		if err := c.count(); err != nil {
+			return false, err
+		}
+		target := domain
+		if hasArg {
+			var err error
+			if target, err = c.expand(arg, domain); err != nil {
+				return false, err
+			}
+		}
+		return c.validatedPTR(ctx, target), nil
+
+	case "exists":
+		if err := c.count(); err != nil {
+			return false, err
+		}
+		target, err := c.expand(arg, domain)
+		if err != nil || !hasArg {
+			return false, fmt.Errorf("spf: %s: invalid %s", domain, term)
+		}
+		// an A lookup whatever the connection's address family
+		ips, err := c.resolver.LookupIP(ctx, "ip4", target)
+		if err := c.lookupError(err); err != nil {
+			return false, err
+		}
+		return len(ips) > 0, nil
+	}
+	return false, fmt.Errorf("spf: %s: unknown mechanism %q", domain, term)
+}
+
+// the domain-spec and dual-cidr-length of an a or mx mechanism, eg.
+// "example.com/24//64"
+func (c *spfCheck) targetAndCIDR(arg, domain string) (target string, v4Bits, v6Bits int, err error) {
+	v4Bits, v6Bits = 32, 128
+	spec := arg
+	if i := strings.Index(spec, "//"); i >= 0 {
+		if v6Bits, err = strconv.Atoi(spec[i+2:]); err != nil || v6Bits < 0 || v6Bits > 128 {
+			return "", 0, 0, fmt.Errorf("spf: %s: invalid cidr length in %q", domain, arg)
+		}
+		spec = spec[:i]
+	}
+	if i := strings.LastIndexByte(spec, '/'); i >= 0 && isDigits(spec[i+1:]) {
+		if v4Bits, err = strconv.Atoi(spec[i+1:]); err != nil || v4Bits > 32 {
+			return "", 0, 0, fmt.Errorf("spf: %s: invalid cidr length in %q", domain, arg)
+		}
+		spec = spec[:i]
+	}
+	target = domain
+	if spec != "" {
+		if target, err = c.expand(spec, domain); err != nil {
+			return "", 0, 0, err
+		}
+	}
+	return target, v4Bits, v6Bits, nil
+}
+
+func isDigits(s string) bool {
+	return s != "" && strings.Trim(s, "0123456789") == ""
+}
+
+// the addresses of host in the client's address family
+func (c *spfCheck) lookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	network := "ip6"
+	if c.ip.To4() != nil {
+		network = "ip4"
+	}
+	ips, err := c.resolver.LookupIP(ctx, network, host)
+	if err := c.lookupError(err); err != nil {
+		return nil, err
+	}
+	return ips, nil
+}
+
+// counts a lookup without an answer against the void limit; other DNS
+// failures are temporary
+func (c *spfCheck) lookupError(err error) error {
+	if err == nil {
+		return nil
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		c.voids++
+		if c.voids > spfVoidLimit {
+			return fmt.Errorf("spf: more than %d void lookups", spfVoidLimit)
+		}
+		return nil
+	}
+	return spfTempError{err}
+}
+
+// RFC 7208 5.5: a name of the client's IP, confirmed by a forward
+// lookup, in target or below it
+func (c *spfCheck) validatedPTR(ctx context.Context, target string) bool {
+	names, err := c.resolver.LookupAddr(ctx, c.ip.String())
+	if err != nil {
+		return false
+	}
+	target = strings.ToLower(strings.TrimSuffix(target, "."))
+	for i, name := range names {
+		if i == spfLookupLimit {
+			break
+		}
+		name = strings.ToLower(strings.TrimSuffix(name, "."))
+		if name != target && !strings.HasSuffix(name, "."+target) {
+			continue
+		}
+		ips, _ := c.lookupIP(ctx, name)
+		for _, ip := range ips {
+			if ip.Equal(c.ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (c *spfCheck) inNetwork(ip net.IP, v4Bits, v6Bits int) bool {
+	if v4 := ip.To4(); v4 != nil {
+		return c.ip.To4() != nil && v4.Mask(net.CIDRMask(v4Bits, 32)).Equal(c.ip.Mask(net.CIDRMask(v4Bits, 32)))
+	}
+	return c.ip.To4() == nil && ip.Mask(net.CIDRMask(v6Bits, 128)).Equal(c.ip.Mask(net.CIDRMask(v6Bits, 128)))
+}
+
+func (c *spfCheck) count() error {
+	c.lookups++
+	if c.lookups > spfLookupLimit {
+		return fmt.Errorf("spf: more than %d DNS lookups", spfLookupLimit)
+	}
+	return nil
+}
+
+// RFC 7208 7: expand the macros of a domain-spec, eg. "%{ir}.%{v}._spf.%{d}"
+func (c *spfCheck) expand(spec, domain string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(spec); i++ {
+		if spec[i] != '%' {
+			b.WriteByte(spec[i])
+			continue
+		}
+		i++
+		if i == len(spec) {
+			return "", fmt.Errorf("spf: %% at the end of %q", spec)
+		}
+		switch spec[i] {
+		case '%':
+			b.WriteByte('%')
+			continue
+		case '_':
+			b.WriteByte(' ')
+			continue
+		case '-':
+			b.WriteString("%20")
+			continue
+		case '{':
+		default:
+			return "", fmt.Errorf("spf: invalid macro in %q", spec)
+		}
+		end := strings.IndexByte(spec[i:], '}')
+		if end < 2 {
+			return "", fmt.Errorf("spf: invalid macro in %q", spec)
+		}
+		macro := spec[i+1 : i+end]
+		i += end
+
+		value, ok := c.macroValue(macro[0]|0x20, domain)
+		if !ok {
+			return "", fmt.Errorf("spf: unknown macro %%{%s}", macro)
+		}
+		value, err := transformMacro(value, macro[1:])
+		if err != nil {
+			return "", fmt.Errorf("spf: invalid macro %%{%s}", macro)
+		}
+		if macro[0] >= 'A' && macro[0] <= 'Z' {
+			value = url.PathEscape(value)
+		}
+		b.WriteString(value)
+	}
+
+	// RFC 7208 7.3: left labels dropped to fit 253 characters
+	expanded := strings.TrimSuffix(b.String(), ".")
+	for len(expanded) > 253 {
+		_, rest, found := strings.Cut(expanded, ".")
+		if !found {
+			break
+		}
+		expanded = rest
+	}
+	return expanded, nil
+}
+
+func (c *spfCheck) macroValue(letter byte, domain string) (string, bool) {
+	switch letter {
+	case 's':
+		return c.sender, true
+	case 'l':
+		return c.local, true
+	case 'o':
+		return c.domain, true
+	case 'd':
+		return domain, true
+	case 'h':
+		return c.helo, true
+	case 'v':
+		if c.ip.To4() != nil {
+			return "in-addr", true
+		}
+		return "ip6", true
+	case 'i':
+		if c.ip.To4() != nil {
+			return c.ip.String(), true
+		}
+		// dot separated nibbles
+		nibbles := make([]string, 0, 32)
+		for _, b := range c.ip.To16() {
+			nibbles = append(nibbles, strconv.FormatUint(uint64(b>>4), 16), strconv.FormatUint(uint64(b&15), 16))
+		}
+		return strings.Join(nibbles, "."), true
+	case 'p':
+		// RFC 7208 5.7 discourages it; the validated name costs lookups
+		return "unknown", true
+	}
+	return "", false
+}
+
+// the transformers after the macro letter: a number of labels to keep
+// from the right, r to reverse, and the delimiters to split on
+func transformMacro(value, transformers string) (string, error) {
+	digits := len(transformers) - len(strings.TrimLeft(transformers, "0123456789"))
+	keep := 0
+	if digits > 0 {
+		n, err := strconv.Atoi(transformers[:digits])
+		if err != nil || n == 0 {
+			return "", errors.New("invalid digits")
+		}
+		keep = n
+	}
+	rest := transformers[digits:]
+	reverse := false
+	if rest != "" && (rest[0] == 'r' || rest[0] == 'R') {
+		reverse, rest = true, rest[1:]
+	}
+	delimiters := "."
+	if rest != "" {
+		if strings.Trim(rest, ".-+,/_=") != "" {
+			return "", errors.New("invalid delimiter")
+		}
+		delimiters = rest
+	}
+
+	parts := strings.FieldsFunc(value, func(r rune) bool { return strings.ContainsRune(delimiters, r) })
+	if reverse {
+		for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+			parts[i], parts[j] = parts[j], parts[i]
+		}
+	}
+	if keep > 0 && keep < len(parts) {
+		parts = parts[len(parts)-keep:]
+	}
+	return strings.Join(parts, "."), nil
+}
+
+// name=value terms; a mechanism such as "a:host=x" can't be one, as
+// modifier names are letters, digits, -, _ and .
+func spfModifier(name string) bool {
+	if name == "" || !(name[0]|0x20 >= 'a' && name[0]|0x20 <= 'z') {
+		return false
+	}
+	return strings.Trim(strings.ToLower(name), "abcdefghijklmnopqrstuvwxyz0123456789-_.") == ""
+}
+
+// a domain check_host can look up: dotted, labels of 1 to 63 octets
+func validSPFDomain(domain string) bool {
+	if len(domain) == 0 || len(domain) > 253 || !strings.Contains(domain, ".") {
+		return false
+	}
+	for _, label := range strings.Split(domain, ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,145 @@
+package mailauth
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"internet_services/dns_lookup/fakedns"
+	"internet_services/dns_lookup/resolver"
+)
+
+// a fake name server for example.com and a resolver that asks it
+func startFakeDNS(t *testing.T, records ...dnsmessage.Resource) *resolver.Client {
+	t.Helper()
+	server := &fakedns.Server{IP: "127.0.0.1", Zones: []fakedns.Zone{{Origin: "example.com.", Records: append([]dnsmessage.Resource{
+		fakedns.SOA("example.com.", "ns.example.com.", 300),
+	}, records...)}}}
+	h, err := fakedns.Start(server)
+	if err != nil {
+		t.Fatalf("failed to start fake name server: %v", err)
+	}
+	t.Cleanup(h.Close)
+
+	dns := resolver.New()
+	dns.Server = server.IP
+	dns.Port = strconv.Itoa(h.Port)
+	dns.Timeout = time.Second
+	return dns
+}
+
+// the examples of RFC 7208 7.4
+func TestSPFExpand(t *testing.T) {
+	tests := []struct {
+		spec string
+		ip   string
+		want string // "" for an error
+	}{
+		{spec: "%{s}", want: "strong-bad@email.example.com"},
+		{spec: "%{o}", want: "email.example.com"},
+		{spec: "%{d}", want: "email.example.com"},
+		{spec: "%{d4}", want: "email.example.com"},
+		{spec: "%{d3}", want: "email.example.com"},
+		{spec: "%{d2}", want: "example.com"},
+		{spec: "%{d1}", want: "com"},
+		{spec: "%{dr}", want: "com.example.email"},
+		{spec: "%{d2r}", want: "example.email"},
+		{spec: "%{l}", want: "strong-bad"},
+		{spec: "%{l-}", want: "strong.bad"},
+		{spec: "%{lr}", want: "strong-bad"},
+		{spec: "%{lr-}", want: "bad.strong"},
+		{spec: "%{l1r-}", want: "strong"},
+		{spec: "%{ir}.%{v}._spf.%{d2}", want: "3.2.0.192.in-addr._spf.example.com"},
+		{spec: "%{lr-}.lp._spf.%{d2}", want: "bad.strong.lp._spf.example.com"},
+		{spec: "%{lr-}.lp.%{ir}.%{v}._spf.%{d2}", want: "bad.strong.lp.3.2.0.192.in-addr._spf.example.com"},
+		{spec: "%{ir}.%{v}.%{l1r-}.lp._spf.%{d2}", want: "3.2.0.192.in-addr.strong.lp._spf.example.com"},
+		{spec: "%{ir}.%{v}._spf.%{d2}", ip: "2001:db8::cb01", want: "1.0.b.c.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6._spf.example.com"},
+		{spec: "%%%_%-", want: "% %20"},
+		{spec: "%{h}.", want: "mx.example.org"},
+		{spec: strings.Repeat("a.", 130) + "%{d}", want: strings.Repeat("a.", 118) + "email.example.com"},
+		{spec: "%"},
+		{spec: "%a"},
+		{spec: "%{"},
+		{spec: "%{x}"},
+		{spec: "%{d0}"},
+		{spec: "%{d!}"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			ip := net.ParseIP("192.0.2.3").To4()
+			if tt.ip != "" {
+				ip = net.ParseIP(tt.ip)
+			}
+			c := &spfCheck{ip: ip, helo: "mx.example.org", sender: "strong-bad@email.example.com", local: "strong-bad", domain: "email.example.com"}
+			got, err := c.expand(tt.spec, "email.example.com")
+			if tt.want == "" {
+				if err == nil {
+					t.Fatalf("expanded to %q, want an error", got)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Fatalf("got %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+// the lookup limits of RFC 7208 4.6.4 make a record that needs more a
+// permerror
+func TestCheckSPFLimits(t *testing.T) {
+	terms := func(format string, n int) string {
+		var b strings.Builder
+		for i := 1; i <= n; i++ {
+			fmt.Fprintf(&b, " "+format, i)
+		}
+		return b.String()
+	}
+	records := []dnsmessage.Resource{
+		fakedns.TXT("ten.example.com.", 300, "v=spf1"+terms("a:h%d.example.com", 10)+" ip4:192.0.2.3 -all"),
+		fakedns.TXT("eleven.example.com.", 300, "v=spf1"+terms("a:h%d.example.com", 11)+" ip4:192.0.2.3 -all"),
+		fakedns.TXT("nested.example.com.", 300, "v=spf1"+terms("a:h%d.example.com", 9)+" include:inner.example.com -all"),
+		fakedns.TXT("inner.example.com.", 300, "v=spf1 a:h10.example.com ip4:192.0.2.3 -all"),
+		fakedns.TXT("loop.example.com.", 300, "v=spf1 include:loop.example.com -all"),
+		fakedns.TXT("twovoid.example.com.", 300, "v=spf1 a:void1.example.com mx:void2.example.com ip4:192.0.2.3 -all"),
+		fakedns.TXT("threevoid.example.com.", 300, "v=spf1 a:void1.example.com mx:void2.example.com exists:void3.example.com ip4:192.0.2.3 -all"),
+		fakedns.TXT("twice.example.com.", 300, "v=spf1 -all"),
+		fakedns.TXT("twice.example.com.", 300, "v=spf1 +all"),
+	}
+	for i := 1; i <= 11; i++ {
+		records = append(records, fakedns.A(fmt.Sprintf("h%d.example.com.", i), "198.51.100.1", 300))
+	}
+	dns := startFakeDNS(t, records...)
+
+	tests := []struct {
+		domain string
+		want   SPFResult
+		err    string
+	}{
+		{domain: "ten.example.com", want: SPFPass},
+		{domain: "eleven.example.com", want: SPFPermError, err: "more than 10 DNS lookups"},
+		{domain: "nested.example.com", want: SPFPermError, err: "more than 10 DNS lookups"},
+		{domain: "loop.example.com", want: SPFPermError, err: "more than 10 DNS lookups"},
+		{domain: "twovoid.example.com", want: SPFPass},
+		{domain: "threevoid.example.com", want: SPFPermError, err: "more than 2 void lookups"},
+		{domain: "twice.example.com", want: SPFPermError, err: "2 records"},
+		{domain: "none.example.com", want: SPFNone},
+	}
+	for _, tt := range tests {
+		t.Run(tt.domain, func(t *testing.T) {
+			got, err := CheckSPF(context.Background(), dns, net.ParseIP("192.0.2.3"), "mx.example.org", "user@"+tt.domain)
+			if got != tt.want {
+				t.Fatalf("got %s (%v), want %s", got, err, tt.want)
+			}
+			if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Errorf("error %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"log"
+	"mime"
+	"os"
+	"strconv"
+	"time"
+
+	"internet_services/receiving_mail/message"
+	"internet_services/receiving_mail/smtpd"
+	"internet_services/receiving_mail/storage"
+)
+
+func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "imap":
+			runIMAP(os.Args[2:])
+			return
+		case "pop3":
+			runPOP3(os.Args[2:])
+			return
+		case "smtp":
+			runSMTP(os.Args[2:])
+			return
+		}
+	}
+	fmt.Println("usage: receiving_mail imap|pop3|smtp [flags] command [args]")
+	os.Exit(2)
+}
+
+// receiving_mail imap [flags] list | headers [n] | search text | fetch uid | seen uid... | move mailbox uid...
+func runIMAP(args []string) {
+	fs := flag.NewFlagSet("imap", flag.ExitOnError)
+	host := fs.String("host", "", "IMAP server, eg. imap.gmail.com")
+	port := fs.String("port", "", "port, default 993, or 143 with -starttls or -plaintext")
+	user := fs.String("user", "", "login name")
+	pass := fs.String("pass", os.Getenv("IMAP_PASSWORD"), "password, default $IMAP_PASSWORD")
+	startTLS := fs.Bool("starttls", false, "connect in plaintext and upgrade with STARTTLS")
+	plaintext := fs.Bool("plaintext", false, "no TLS at all, for local test servers")
+	insecure := fs.Bool("insecure", false, "don't verify the server certificate")
+	mailbox := fs.String("mailbox", "INBOX", "mailbox to work on")
+	fs.Parse(args)
+
+	if *host == "" || fs.NArg() == 0 {
+		fmt.Println("usage: receiving_mail imap -host host -user name [flags] list | headers [n] | search text | fetch uid | seen uid... | move mailbox uid...")
+		os.Exit(2)
+	}
+
+	config := IMAPConfig{Host: *host, Port: *port, Username: *user, Password: *pass}
+	switch {
+	case *plaintext:
+		config.TLSMode = NoTLS
+	case *startTLS:
+		config.TLSMode = StartTLS
+	}
+	if *insecure {
+		config.TLS = &tls.Config{ServerName: *host, InsecureSkipVerify: true}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	client, err := DialIMAP(ctx, config)
+	if err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+	defer client.Logout()
+
+	command, rest := fs.Arg(0), fs.Args()[1:]
+	if command == "list" {
+		boxes, err := client.List("*")
+		if err != nil {
+			fmt.Println("Error:", err)
+			os.Exit(1)
+		}
+		for _, box := range boxes {
+			fmt.Printf("%-30s %v\n", box.Name, box.Attributes)
+		}
+		return
+	}
+
+	status, err := client.Select(*mailbox)
+	if err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+
+	switch command {
+	case "headers", "search":
+		criteria := SearchCriteria{}
+		if command == "search" && len(rest) > 0 {
+			criteria.Text = rest[0]
+		}
+		uids, err := client.Search(criteria)
+		if err != nil {
+			fmt.Println("Error:", err)
+			os.Exit(1)
+		}
+		n := 20
+		if command == "headers" && len(rest) > 0 {
+			n, _ = strconv.Atoi(rest[0])
+		}
+		if len(uids) > n {
+			uids = uids[len(uids)-n:]
+		}
+		fmt.Printf("%s: %d messages, showing %d\n", status.Name, status.Exists, len(uids))
+		msgs, err := client.FetchHeaders(uids...)
+		if err != nil {
+			fmt.Println("Error:", err)
+			os.Exit(1)
+		}
+		var dec mime.WordDecoder
+		for _, msg := range msgs {
+			from, _ := dec.DecodeHeader(msg.Header.Get("From"))
+			subject, _ := dec.DecodeHeader(msg.Header.Get("Subject"))
+			fmt.Printf("%6d  %s  %-30.30s  %s\n", msg.UID, msg.InternalDate.Format("2006-01-02 15:04"), from, subject)
+		}
+	case "fetch":
+		msgs, err := client.FetchMessages(true, parseUIDs(rest)...)
+		if err != nil {
+			fmt.Println("Error:", err)
+			os.Exit(1)
+		}
+		for _, msg := range msgs {
+			os.Stdout.Write(msg.Raw)
+		}
+	case "seen":
+		if err := client.MarkSeen(parseUIDs(rest)...); err != nil {
+			fmt.Println("Error:", err)
+			os.Exit(1)
+		}
+	case "move":
+		if len(rest) < 2 {
+			fmt.Println("usage: receiving_mail imap [flags] move mailbox uid...")
+			os.Exit(2)
+		}
+		if err := client.Move(rest[0], parseUIDs(rest[1:])...); err != nil {
+			fmt.Println("Error:", err)
+			os.Exit(1)
+		}
+	default:
+		fmt.Println("unknown command:", command)
+		os.Exit(2)
+	}
+}
+
+// receiving_mail pop3 [flags] list | fetch n | delete n...
+func runPOP3(args []string) {
+	fs := flag.NewFlagSet("pop3", flag.ExitOnError)
+	host := fs.String("host", "", "POP3 server, eg. pop.gmail.com")
+	port := fs.String("port", "", "port, default 995, or 110 with -starttls or -plaintext")
+	user := fs.String("user", "", "login name")
+	pass := fs.String("pass", os.Getenv("POP3_PASSWORD"), "password, default $POP3_PASSWORD")
+	startTLS := fs.Bool("starttls", false, "connect in plaintext and upgrade with STLS")
+	plaintext := fs.Bool("plaintext", false, "no TLS at all, for local test servers")
+	insecure := fs.Bool("insecure", false, "don't verify the server certificate")
+	fs.Parse(args)
+
+	if *host == "" || fs.NArg() == 0 {
+		fmt.Println("usage: receiving_mail pop3 -host host -user name [flags] list | fetch n | delete n...")
+		os.Exit(2)
+	}
+
+	config := POP3Config{Host: *host, Port: *port, Username: *user, Password: *pass}
+	switch {
+	case *plaintext:
+		config.TLSMode = NoTLS
+	case *startTLS:
+		config.TLSMode = StartTLS
+	}
+	if *insecure {
+		config.TLS = &tls.Config{ServerName: *host, InsecureSkipVerify: true}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	client, err := DialPOP3(ctx, config)
+	if err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+
+	command, rest := fs.Arg(0), fs.Args()[1:]
+	switch command {
+	case "list":
+		msgs, err := client.List()
+		if err != nil {
+			fmt.Println("Error:", err)
+			os.Exit(1)
+		}
+		// UIDL is optional, numbers and sizes do without it
+		uids := map[int]string{}
+		if list, err := client.UIDL(); err == nil {
+			for _, msg := range list {
+				uids[msg.Number] = msg.UID
+			}
+		}
+		for _, msg := range msgs {
+			fmt.Printf("%6d  %10d  %s\n", msg.Number, msg.Size, uids[msg.Number])
+		}
+	case "fetch":
+		for _, n := range parseNumbers(rest) {
+			raw, err := client.Retr(n)
+			if err != nil {
+				fmt.Println("Error:", err)
+				os.Exit(1)
+			}
+			os.Stdout.Write(raw)
+		}
+	case "delete":
+		for _, n := range parseNumbers(rest) {
+			if err := client.Dele(n); err != nil {
+				fmt.Println("Error:", err)
+				os.Exit(1)
+			}
+		}
+	default:
+		fmt.Println("unknown command:", command)
+		os.Exit(2)
+	}
+	if err := client.Quit(); err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+}
+
+// receiving_mail smtp -listen :2525 [-maildir dir [-rules file] | -webhook url | -lmtp addr]
+func runSMTP(args []string) {
+	fs := flag.NewFlagSet("smtp", flag.ExitOnError)
+	listen := fs.String("listen", ":2525", "address to receive mail on")
+	maildir := fs.String("maildir", "", "store the messages in this Maildir")
+	rulesFile := fs.String("rules", "", "with -maildir, file the messages by the rules in this file")
+	webhook := fs.String("webhook", "", "POST the messages as JSON to this URL instead of storing them")
+	lmtp := fs.String("lmtp", "", "hand the messages to this LMTP socket or host:port, eg. /var/run/dovecot/lmtp")
+	fs.Parse(args)
+
+	var rules *storage.Rules
+	if *rulesFile != "" {
+		if *maildir == "" {
+			log.Fatal("-rules needs -maildir")
+		}
+		list, err := storage.LoadRules(*rulesFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		rules = &storage.Rules{Rules: list, Mailbox: storage.Maildir{Dir: *maildir}}
+	}
+	server := &smtpd.Server{SPF: true, Handler: smtpd.DeliveryFunc(func(ctx context.Context, d *smtpd.Delivery) error {
+		var subject string
+		if msg, err := message.Parse(bytes.NewReader(d.Data)); err == nil {
+			subject = msg.Subject
+		}
+		log.Printf("received %s from <%s> for %v, SPF %s, %d bytes: %q", d.ID, d.From, d.To, d.SPF, len(d.Data), subject)
+		if *webhook != "" {
+			return smtpd.Webhook{URL: *webhook, MaxRetries: 2}.Deliver(ctx, d)
+		}
+		if rules != nil {
+			return rules.Deliver(ctx, d)
+		}
+		if *maildir != "" {
+			return storage.Maildir{Dir: *maildir}.Deliver(ctx, d)
+		}
+		return nil
+	})}
+	if *lmtp != "" {
+		// as the handler itself, to refuse unknown mailboxes at RCPT time
+		server.Handler = storage.LMTP{Addr: *lmtp, CheckRecipients: true}
+	}
+	log.Fatal(server.ListenAndServe(*listen))
+}
+
+func parseNumbers(args []string) []int {
+	var numbers []int
+	for _, arg := range args {
+		n, err := strconv.Atoi(arg)
+		if err != nil || n <= 0 {
+			fmt.Println("invalid message number:", arg)
+			os.Exit(2)
+		}
+		numbers = append(numbers, n)
+	}
+	return numbers
+}
+
+func parseUIDs(args []string) []uint32 {
+	var uids []uint32
+	for _, arg := range args {
+		uid, err := strconv.ParseUint(arg, 10, 32)
+		if err != nil {
+			fmt.Println("invalid UID:", arg)
+			os.Exit(2)
+		}
+		uids = append(uids, uint32(uid))
+	}
+	return uids
+}
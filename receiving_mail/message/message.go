@@ -0,0 +1,234 @@
+// Package message reads raw RFC 5322 messages, as a server or a mailbox
+// hands them over, into their addresses, text, html and attachments.
+package message
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strings"
+
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+// a parsed message
+type Message struct {
+	From    mail.Address
+	To      []mail.Address
+	Cc      []mail.Address
+	Bcc     []mail.Address
+	Subject string
+	Text    string // the first text/plain part
+	HTML    string // the first text/html part
+
+	Attachments []Attachment
+	Headers     map[string]string // the other fields, see Parse
+}
+
+// a part that is neither the text nor the html
+type Attachment struct {
+	Filename    string
+	ContentType string // as the part gave it, parameters and all
+	Data        []byte // transfer encoding undone
+	Inline      bool   // shown in the html, referenced as cid:ContentID
+	ContentID   string // without angle brackets
+}
+
+// Parse reads a raw RFC 5322 message, as a server or a mailbox hands it
+// over: addresses and the Subject decoded, the first text/plain and
+// text/html parts as Text and HTML, everything else an attachment. Nested multiparts are walked, base64 and quoted-printable
+// decoded, and text in any charset of the WHATWG encoding standard
+// converted to UTF-8; unknown charsets are left as they are.
+//
+// Header fields without a Message field of their own, except trace and
+// MIME fields, go to Headers, decoded, the first one where a field
+// repeats. So does an address field that doesn't parse, as it is.
+func Parse(r io.Reader) (*Message, error) {
+	msg, err := mail.ReadMessage(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read message: %w", err)
+	}
+
+	m := &Message{Headers: map[string]string{}}
+	dec := mime.WordDecoder{CharsetReader: charsetReader}
+	addressParser := mail.AddressParser{WordDecoder: &dec}
+	for key, values := range msg.Header {
+		var list *[]mail.Address
+		switch key {
+		case "From":
+			addrs, err := addressParser.ParseList(values[0])
+			if err != nil || len(addrs) == 0 {
+				m.Headers[key] = values[0]
+				continue
+			}
+			m.From = *addrs[0]
+			continue
+		case "To":
+			list = &m.To
+		case "Cc":
+			list = &m.Cc
+		case "Bcc":
+			list = &m.Bcc
+		case "Subject":
+			m.Subject = decodeHeaderValue(&dec, values[0])
+			continue
+		case "Received", "Return-Path", "Mime-Version", "Content-Type", "Content-Transfer-Encoding", "Content-Disposition":
+			continue
+		default:
+			m.Headers[key] = decodeHeaderValue(&dec, values[0])
+			continue
+		}
+		addrs, err := addressParser.ParseList(values[0])
+		if err != nil {
+			m.Headers[key] = values[0]
+			continue
+		}
+		for _, addr := range addrs {
+			*list = append(*list, *addr)
+		}
+	}
+
+	if err := parsePart(m, textproto.MIMEHeader(msg.Header), msg.Body); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// the text of an encoded-word header, the value as it is if it has
+// a charset the decoder doesn't know
+func decodeHeaderValue(dec *mime.WordDecoder, value string) string {
+	decoded, err := dec.DecodeHeader(value)
+	if err != nil {
+		return value
+	}
+	return decoded
+}
+
+// one MIME entity: a multipart is walked part by part, anything else
+// becomes a body or an attachment
+func parsePart(m *Message, header textproto.MIMEHeader, body io.Reader) error {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		// RFC 2045 5.2: no or an invalid Content-Type is plain text
+		mediaType, params = "text/plain", map[string]string{}
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		reader := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := reader.NextRawPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("failed to read %s part: %w", mediaType, err)
+			}
+			if err := parsePart(m, part.Header, part); err != nil {
+				return err
+			}
+		}
+	}
+
+	data, err := io.ReadAll(DecodeTransfer(header.Get("Content-Transfer-Encoding"), body))
+	if err != nil {
+		return fmt.Errorf("failed to decode %s part: %w", mediaType, err)
+	}
+
+	disposition, dispParams, _ := mime.ParseMediaType(header.Get("Content-Disposition"))
+	filename := dispParams["filename"]
+	if filename == "" {
+		filename = params["name"]
+	}
+	dec := mime.WordDecoder{CharsetReader: charsetReader}
+	filename = decodeHeaderValue(&dec, filename)
+
+	if disposition != "attachment" && filename == "" {
+		switch {
+		case mediaType == "text/plain" && m.Text == "":
+			m.Text = decodeCharset(params["charset"], data)
+			return nil
+		case mediaType == "text/html" && m.HTML == "":
+			m.HTML = decodeCharset(params["charset"], data)
+			return nil
+		}
+	}
+
+	att := Attachment{
+		Filename:    filename,
+		ContentType: header.Get("Content-Type"),
+		Data:        data,
+		ContentID:   strings.Trim(header.Get("Content-Id"), "<> "),
+	}
+	att.Inline = disposition == "inline" || disposition == "" && att.ContentID != ""
+	if att.ContentType == "" {
+		att.ContentType = mediaType
+	}
+	m.Attachments = append(m.Attachments, att)
+	return nil
+}
+
+// text of a body part in UTF-8, as it is when the charset is unknown.
+// Charset names are looked up the way browsers do, so ISO-8859-1 and
+// US-ASCII are read as their superset windows-1252.
+func decodeCharset(charset string, data []byte) string {
+	if charset == "" {
+		return string(data)
+	}
+	enc, err := htmlindex.Get(charset)
+	if err != nil {
+		return string(data)
+	}
+	decoded, err := enc.NewDecoder().Bytes(data)
+	if err != nil {
+		return string(data)
+	}
+	return string(decoded)
+}
+
+// for encoded words in charsets other than UTF-8 and ISO-8859-1
+func charsetReader(charset string, input io.Reader) (io.Reader, error) {
+	enc, err := htmlindex.Get(charset)
+	if err != nil {
+		return nil, err
+	}
+	return enc.NewDecoder().Reader(input), nil
+}
+
+// DecodeTransfer undoes a base64 or quoted-printable transfer encoding.
+// Parts from multipart.Reader.NextPart have their quoted-printable
+// decoded already and the header field removed.
+func DecodeTransfer(encoding string, body io.Reader) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, &lineStripper{r: body})
+	case "quoted-printable":
+		return quotedprintable.NewReader(body)
+	}
+	return body
+}
+
+// drops CR and LF so base64 lines read as one stream
+type lineStripper struct {
+	r io.Reader
+}
+
+func (l *lineStripper) Read(p []byte) (int, error) {
+	for {
+		n, err := l.r.Read(p)
+		kept := 0
+		for _, c := range p[:n] {
+			if c != '\r' && c != '\n' {
+				p[kept] = c
+				kept++
+			}
+		}
+		if kept > 0 || err != nil {
+			return kept, err
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package message
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseCharsets(t *testing.T) {
+	tests := []struct {
+		name    string
+		charset string
+		body    string // raw bytes in charset
+		want    string
+	}{
+		{"utf-8", "utf-8", "Grüße", "Grüße"},
+		{"latin1", "ISO-8859-1", "Gr\xfc\xdfe", "Grüße"},
+		{"windows-1252", "windows-1252", "\x93quoted\x94 \x80", "“quoted” €"},
+		{"latin2", "iso-8859-2", "\xb3\xf3d\xbc", "łódź"},
+		{"koi8-r", "koi8-r", "\xf0\xd2\xc9\xd7\xc5\xd4", "Привет"},
+		{"shift_jis", "Shift_JIS", "\x82\xb1\x82\xf1\x82\xc9\x82\xbf\x82\xcd", "こんにちは"},
+		{"alias", "latin1", "caf\xe9", "café"},
+		{"unknown charset", "x-unknown", "as \xffis", "as \xffis"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw := "From: a@example.com\r\nContent-Type: text/plain; charset=" + tt.charset + "\r\n\r\n" + tt.body
+			msg, err := Parse(strings.NewReader(raw))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if msg.Text != tt.want {
+				t.Errorf("got %q, want %q", msg.Text, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseEncodedWords(t *testing.T) {
+	raw := "From: =?windows-1251?B?yOLg7Q==?= <ivan@example.com>\r\n" +
+		"To: =?koi8-r?Q?=F0=C5=D4=D2?= <petr@example.com>\r\n" +
+		"Subject: =?iso-2022-jp?B?GyRCJDMkcyRLJEEkTxsoQg==?=\r\n" +
+		"X-Note: =?iso-8859-2?Q?=B3=F3d=BC?=\r\n" +
+		"\r\nbody"
+	msg, err := Parse(strings.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.From.Name != "Иван" || msg.From.Address != "ivan@example.com" {
+		t.Errorf("From %+v", msg.From)
+	}
+	if len(msg.To) != 1 || msg.To[0].Name != "Петр" {
+		t.Errorf("To %+v", msg.To)
+	}
+	if msg.Subject != "こんにちは" {
+		t.Errorf("Subject %q", msg.Subject)
+	}
+	if got := msg.Headers["X-Note"]; got != "łódź" {
+		t.Errorf("X-Note %q", got)
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type POP3Config struct {
+	Host     string
+	Port     string // default 995, or 110 without implicit TLS
+	Username string
+	Password string
+	TLSMode  TLSMode     // default implicit TLS, StartTLS sends STLS
+	TLS      *tls.Config // nil for the system roots and Host as server name
+
+	Timeout time.Duration // per command, default 1 minute
+}
+
+func (c POP3Config) addr() string {
+	port := c.Port
+	if port == "" {
+		port = "995"
+		if c.TLSMode != ImplicitTLS {
+			port = "110"
+		}
+	}
+	return net.JoinHostPort(c.Host, port)
+}
+
+func (c POP3Config) tlsConfig() *tls.Config {
+	if c.TLS != nil {
+		return c.TLS
+	}
+	return &tls.Config{ServerName: c.Host, MinVersion: tls.VersionTLS12}
+}
+
+// POP3Client is a POP3 (RFC 1939) session on a single maildrop: list the
+// messages, retrieve and delete them. Messages are addressed by their
+// number, which stays valid for the session; UIDL gives ids that survive
+// it. Deletions only take effect on Quit. Not safe for concurrent use.
+type POP3Client struct {
+	conn    net.Conn
+	text    *textproto.Conn
+	timeout time.Duration
+	limit   time.Time // no command runs past it, when set
+}
+
+// a message in the maildrop, from List or UIDL
+type POP3Message struct {
+	Number int
+	Size   int    // octets, from List
+	UID    string // unique id, from UIDL
+}
+
+// the error of a -ERR reply
+type POP3Error struct {
+	Command string
+	Text    string
+}
+
+func (e *POP3Error) Error() string {
+	return fmt.Sprintf("pop3: %s: -ERR %s", e.Command, e.Text)
+}
+
+// connect and log in with USER and PASS
+func DialPOP3(ctx context.Context, config POP3Config) (*POP3Client, error) {
+	var dialer net.Dialer
+	var conn net.Conn
+	var err error
+	if config.TLSMode == ImplicitTLS {
+		tlsDialer := tls.Dialer{NetDialer: &dialer, Config: config.tlsConfig()}
+		conn, err = tlsDialer.DialContext(ctx, "tcp", config.addr())
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", config.addr())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial POP3 server: %w", err)
+	}
+
+	c := newPOP3Client(conn, config.Timeout)
+	c.limit, _ = ctx.Deadline()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	err = c.setup(config)
+	if !stop() {
+		err = ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	c.limit = time.Time{}
+	return c, nil
+}
+
+func newPOP3Client(conn net.Conn, timeout time.Duration) *POP3Client {
+	if timeout <= 0 {
+		timeout = time.Minute
+	}
+	return &POP3Client{conn: conn, text: textproto.NewConn(conn), timeout: timeout}
+}
+
+// greeting, STLS, USER and PASS
+func (c *POP3Client) setup(config POP3Config) error {
+	c.setDeadline()
+	if _, err := c.readReply("greeting"); err != nil {
+		return err
+	}
+
+	if config.TLSMode == StartTLS {
+		// RFC 2595 4
+		if _, err := c.cmd("STLS"); err != nil {
+			return fmt.Errorf("failed to start TLS: %w", err)
+		}
+		tlsConn := tls.Client(c.conn, config.tlsConfig())
+		if err := tlsConn.Handshake(); err != nil {
+			return fmt.Errorf("failed to start TLS: %w", err)
+		}
+		c.conn = tlsConn
+		c.text = textproto.NewConn(tlsConn)
+	}
+
+	if strings.ContainsAny(config.Username+config.Password, "\r\n") {
+		return errors.New("pop3: line break in username or password")
+	}
+	if _, err := c.cmd("USER " + config.Username); err != nil {
+		return fmt.Errorf("failed to log in: %w", err)
+	}
+	if _, err := c.cmd("PASS " + config.Password); err != nil {
+		return fmt.Errorf("failed to log in: %w", err)
+	}
+	return nil
+}
+
+// number of messages and their total size
+func (c *POP3Client) Stat() (count, size int, err error) {
+	line, err := c.cmd("STAT")
+	if err != nil {
+		return 0, 0, err
+	}
+	if _, err := fmt.Sscan(line, &count, &size); err != nil {
+		return 0, 0, fmt.Errorf("pop3: invalid STAT reply %q", line)
+	}
+	return count, size, nil
+}
+
+// the messages and their sizes
+func (c *POP3Client) List() ([]POP3Message, error) {
+	lines, err := c.multiline("LIST")
+	if err != nil {
+		return nil, err
+	}
+	msgs := make([]POP3Message, 0, len(lines))
+	for _, line := range lines {
+		var msg POP3Message
+		if _, err := fmt.Sscan(line, &msg.Number, &msg.Size); err != nil {
+			return nil, fmt.Errorf("pop3: invalid LIST line %q", line)
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, nil
+}
+
+// the messages and their unique ids
+func (c *POP3Client) UIDL() ([]POP3Message, error) {
+	lines, err := c.multiline("UIDL")
+	if err != nil {
+		return nil, err
+	}
+	msgs := make([]POP3Message, 0, len(lines))
+	for _, line := range lines {
+		number, uid, ok := strings.Cut(line, " ")
+		n, err := strconv.Atoi(number)
+		if !ok || err != nil {
+			return nil, fmt.Errorf("pop3: invalid UIDL line %q", line)
+		}
+		msgs = append(msgs, POP3Message{Number: n, UID: uid})
+	}
+	return msgs, nil
+}
+
+// the whole message, with LF line endings
+func (c *POP3Client) Retr(number int) ([]byte, error) {
+	if _, err := c.cmd(fmt.Sprintf("RETR %d", number)); err != nil {
+		return nil, err
+	}
+	c.setDeadline()
+	defer c.conn.SetDeadline(time.Time{})
+	return c.text.ReadDotBytes()
+}
+
+// mark a message deleted; it goes when the session ends with Quit
+func (c *POP3Client) Dele(number int) error {
+	_, err := c.cmd(fmt.Sprintf("DELE %d", number))
+	return err
+}
+
+// unmark the messages Dele marked
+func (c *POP3Client) Reset() error {
+	_, err := c.cmd("RSET")
+	return err
+}
+
+// end the session, deleting the messages marked for deletion
+func (c *POP3Client) Quit() error {
+	_, err := c.cmd("QUIT")
+	if closeErr := c.conn.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// close without QUIT, which keeps every message
+func (c *POP3Client) Close() error {
+	return c.conn.Close()
+}
+
+// send a command and read its single line reply, the text after +OK
+func (c *POP3Client) cmd(command string) (string, error) {
+	c.setDeadline()
+	defer c.conn.SetDeadline(time.Time{})
+	if err := c.text.PrintfLine("%s", command); err != nil {
+		return "", err
+	}
+	name, _, _ := strings.Cut(command, " ")
+	return c.readReply(name)
+}
+
+// a command with a multi-line reply, the lines without the +OK line
+func (c *POP3Client) multiline(command string) ([]string, error) {
+	if _, err := c.cmd(command); err != nil {
+		return nil, err
+	}
+	c.setDeadline()
+	defer c.conn.SetDeadline(time.Time{})
+	return c.text.ReadDotLines()
+}
+
+func (c *POP3Client) readReply(command string) (string, error) {
+	line, err := c.text.ReadLine()
+	if err != nil {
+		return "", err
+	}
+	status, text, _ := strings.Cut(line, " ")
+	switch status {
+	case "+OK":
+		return text, nil
+	case "-ERR":
+		return "", &POP3Error{Command: command, Text: text}
+	}
+	return "", fmt.Errorf("pop3: unexpected reply %q", line)
+}
+
+func (c *POP3Client) setDeadline() {
+	deadline := time.Now().Add(c.timeout)
+	if !c.limit.IsZero() && c.limit.Before(deadline) {
+		deadline = c.limit
+	}
+	c.conn.SetDeadline(deadline)
+}
@@ -0,0 +1,141 @@
+package smtpd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/mail"
+	"strings"
+	"time"
+
+	"internet_services/receiving_mail/mailauth"
+	"internet_services/sending_mail/dkim"
+)
+
+// the DKIM and DMARC checks of a delivery from an unauthenticated client,
+// SPF having been checked at MAIL
+func (c *serverSession) verify(d *Delivery, data []byte) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	d.DKIM = dkim.Verify(ctx, c.s.resolver(), data)
+	if !c.s.DMARC {
+		return
+	}
+	from, err := headerFromAddress(data)
+	if err != nil {
+		d.DMARC = mailauth.DMARCVerdict{Result: dkim.PermError, Disposition: "none", Err: err}
+		return
+	}
+	spfDomain := d.Helo
+	if at := strings.LastIndexByte(d.From, '@'); at >= 0 {
+		spfDomain = d.From[at+1:]
+	}
+	d.DMARC = mailauth.CheckDMARC(ctx, c.s.resolver(), from, d.SPF, spfDomain, d.DKIM)
+}
+
+// the one address of the From header, which DMARC is about
+func headerFromAddress(data []byte) (string, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return "", fmt.Errorf("dmarc: %w", err)
+	}
+	froms := msg.Header["From"]
+	if len(froms) != 1 {
+		return "", fmt.Errorf("dmarc: %d From headers", len(froms))
+	}
+	addrs, err := mail.ParseAddressList(froms[0])
+	if err != nil {
+		return "", fmt.Errorf("dmarc: From: %w", err)
+	}
+	if len(addrs) != 1 {
+		return "", errors.New("dmarc: From with more than one address")
+	}
+	return addrs[0].Address, nil
+}
+
+// the Authentication-Results field (RFC 8601) of the checks that ran,
+// with the trailing CRLF
+func authenticationResults(authservID string, d *Delivery, dkimChecked bool) string {
+	var results []string
+	if d.SPF != "" {
+		if d.From == "" {
+			results = append(results, fmt.Sprintf("spf=%s smtp.helo=%s", d.SPF, d.Helo))
+		} else {
+			results = append(results, fmt.Sprintf("spf=%s smtp.mailfrom=%s", d.SPF, d.From))
+		}
+	}
+	if dkimChecked {
+		if len(d.DKIM) == 0 {
+			results = append(results, "dkim=none")
+		}
+		for _, v := range d.DKIM {
+			result := fmt.Sprintf("dkim=%s", v.Result)
+			if v.Err != nil {
+				result += " (" + strings.NewReplacer("(", "", ")", "").Replace(v.Err.Error()) + ")"
+			}
+			result += fmt.Sprintf(" header.d=%s header.s=%s", v.Domain, v.Selector)
+			if v.Signature != "" {
+				result += " header.b=" + v.Signature
+			}
+			results = append(results, result)
+		}
+	}
+	if d.DMARC.Result != "" {
+		result := fmt.Sprintf("dmarc=%s", d.DMARC.Result)
+		if d.DMARC.Policy != "" {
+			result += fmt.Sprintf(" (p=%s dis=%s)", d.DMARC.Policy, d.DMARC.Disposition)
+		}
+		if d.DMARC.Domain != "" {
+			result += " header.from=" + d.DMARC.Domain
+		}
+		results = append(results, result)
+	}
+	if len(results) == 0 {
+		return ""
+	}
+	return "Authentication-Results: " + authservID + ";\r\n\t" + strings.Join(results, ";\r\n\t") + "\r\n"
+}
+
+// the message without the Authentication-Results fields that claim to be
+// from authservID, which only this server may write (RFC 8601 5)
+func stripAuthResults(data []byte, authservID string) []byte {
+	header, body, found := bytes.Cut(data, []byte("\r\n\r\n"))
+	if !found {
+		return data
+	}
+	var out bytes.Buffer
+	for _, field := range splitHeaderFields(header) {
+		if strings.EqualFold(fieldName(field), "Authentication-Results") {
+			_, value, _ := strings.Cut(field, ":")
+			id, _, _ := strings.Cut(value, ";")
+			id = strings.TrimSpace(strings.ReplaceAll(id, "\r\n", ""))
+			if id, _, _ = strings.Cut(id, " "); strings.EqualFold(id, authservID) {
+				continue
+			}
+		}
+		out.WriteString(field)
+		out.WriteString("\r\n")
+	}
+	out.WriteString("\r\n")
+	out.Write(body)
+	return out.Bytes()
+}
+
+// header fields with their continuation lines, without the final CRLF
+func splitHeaderFields(header []byte) []string {
+	var fields []string
+	for _, line := range strings.Split(string(header), "\r\n") {
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(fields) > 0 {
+			fields[len(fields)-1] += "\r\n" + line
+			continue
+		}
+		fields = append(fields, line)
+	}
+	return fields
+}
+
+func fieldName(field string) string {
+	name, _, _ := strings.Cut(field, ":")
+	return strings.TrimSpace(name)
+}
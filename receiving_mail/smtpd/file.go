@@ -0,0 +1,31 @@
+package smtpd
+
+import (
+	"io"
+	"os"
+)
+
+// write a file under the temporary name tmp, on the same file system as
+// path, then rename it to path: a half-written file is never mistaken for
+// a whole one, and a crash leaves at most a stray tmp. The data is synced
+// before the rename so the file is complete once it has its name.
+func writeFileAtomic(tmp, path string, write func(io.Writer) error) error {
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	err = write(file)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
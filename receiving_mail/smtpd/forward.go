@@ -0,0 +1,115 @@
+package smtpd
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"os"
+
+	"internet_services/sending_mail/dkim"
+)
+
+// Forwarder passes the deliveries of a Server on to another server, as
+// they are, to the delivery's recipients or To. Put it behind SealARC so
+// the next receiver can tell where a message that fails SPF or DKIM after
+// forwarding came from.
+//
+// A refusal of the other server is a *textproto.Error in the chain, which
+// the Server passes on to its client.
+type Forwarder struct {
+	Addr string      // host:port of the server, eg. smtp.example.com:587
+	Helo string      // the name to greet it with, default os.Hostname
+	TLS  *tls.Config // for STARTTLS, used when the server offers it; default one for Addr's host
+	Auth smtp.Auth   // nil for none
+	To   []string    // the recipients instead of the delivery's, eg. a list's members
+}
+
+// implements DeliveryHandler
+func (f Forwarder) Deliver(ctx context.Context, d *Delivery) (err error) {
+	defer func() { err = contextError(ctx, err) }()
+	rcpts := d.To
+	if len(f.To) > 0 {
+		rcpts = f.To
+	}
+	host, _, err := net.SplitHostPort(f.Addr)
+	if err != nil {
+		return fmt.Errorf("forward: %w", err)
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", f.Addr)
+	if err != nil {
+		return fmt.Errorf("forward: %w", err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("forward: %w", err)
+	}
+	defer client.Close()
+
+	helo := f.Helo
+	if helo == "" {
+		helo, _ = os.Hostname()
+	}
+	if helo != "" {
+		if err := client.Hello(helo); err != nil {
+			return fmt.Errorf("forward: EHLO failed: %w", err)
+		}
+	}
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		config := f.TLS
+		if config == nil {
+			config = &tls.Config{ServerName: host}
+		}
+		if err := client.StartTLS(config); err != nil {
+			return fmt.Errorf("forward: STARTTLS failed: %w", err)
+		}
+	}
+	if f.Auth != nil {
+		if err := client.Auth(f.Auth); err != nil {
+			return fmt.Errorf("forward: AUTH failed: %w", err)
+		}
+	}
+	if err := client.Mail(d.From); err != nil {
+		return fmt.Errorf("forward: MAIL command failed: %w", err)
+	}
+	for _, rcpt := range rcpts {
+		if err := client.Rcpt(rcpt); err != nil {
+			return fmt.Errorf("forward: RCPT command for %s failed: %w", rcpt, err)
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return fmt.Errorf("forward: DATA command failed: %w", err)
+	}
+	if _, err := w.Write(d.Data); err != nil {
+		return fmt.Errorf("forward: DATA write failed: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("forward: %w", err)
+	}
+	client.Quit()
+	return nil
+}
+
+// a DeliveryHandler sealing each delivery with sealer (RFC 8617) before
+// next gets it, eg. a Forwarder. A message that can't be sealed goes on
+// as it is.
+func SealARC(sealer dkim.ARCSealer, next DeliveryHandler) DeliveryHandler {
+	return DeliveryFunc(func(ctx context.Context, d *Delivery) error {
+		sealed, err := sealer.Seal(ctx, d.Data)
+		if err != nil {
+			log.Printf("arc: delivery %s not sealed: %v", d.ID, err)
+			return next.Deliver(ctx, d)
+		}
+		copied := *d
+		copied.Data = sealed
+		return next.Deliver(ctx, &copied)
+	})
+}
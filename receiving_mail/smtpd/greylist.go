@@ -0,0 +1,163 @@
+package smtpd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Greylist turns away mail from a client, sender and recipient it hasn't
+// seen before with a temporary error, and takes it when the client tries
+// again after Delay, as real mail servers do and most spam software
+// doesn't. Once a triplet has passed it isn't delayed again for Pass.
+// Clients are grouped by network, /24 and /64, since large senders retry
+// from another host of the same pool.
+//
+// The triplets are kept in a JSON file at Path, if set, so a restart
+// doesn't delay everyone again.
+type Greylist struct {
+	Path   string
+	Delay  time.Duration // before a retry is accepted, default 5 minutes
+	Expire time.Duration // a first attempt not retried this long is forgotten, default 2 days
+	Pass   time.Duration // a passed triplet is let through for this long after its last mail, default 35 days
+
+	// clients never delayed, eg. the networks of large providers that
+	// retry from far apart addresses
+	Exempt []netip.Prefix
+
+	mu      sync.Mutex
+	entries map[string]*greyEntry
+	loaded  bool
+}
+
+type greyEntry struct {
+	First  time.Time `json:"first"`
+	Last   time.Time `json:"last"`
+	Passed bool      `json:"passed,omitempty"`
+}
+
+// whether mail from ip, with the envelope sender from, for rcpt is let
+// through now, and if not how long the client should wait
+func (g *Greylist) Check(ip net.IP, from, rcpt string) (bool, time.Duration) {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return true, 0
+	}
+	addr = addr.Unmap()
+	for _, prefix := range g.Exempt {
+		if prefix.Contains(addr) {
+			return true, 0
+		}
+	}
+	bits := 24
+	if addr.Is6() {
+		bits = 64
+	}
+	network, _ := addr.Prefix(bits)
+	key := network.String() + " " + strings.ToLower(from) + " " + strings.ToLower(rcpt)
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if err := g.load(); err != nil {
+		log.Printf("greylist: %v", err)
+	}
+	now := time.Now()
+	entry := g.entries[key]
+	switch {
+	case entry != nil && entry.Passed && now.Sub(entry.Last) <= g.pass():
+		// more mail of a known conversation, saved with the next change
+		entry.Last = now
+		return true, 0
+	case entry == nil || now.Sub(entry.Last) > g.expire() || entry.Passed:
+		g.entries[key] = &greyEntry{First: now, Last: now}
+		g.save()
+		return false, g.delay()
+	case now.Sub(entry.First) < g.delay():
+		entry.Last = now
+		return false, g.delay() - now.Sub(entry.First)
+	}
+	entry.Last, entry.Passed = now, true
+	g.save()
+	return true, 0
+}
+
+func (g *Greylist) delay() time.Duration {
+	if g.Delay <= 0 {
+		return 5 * time.Minute
+	}
+	return g.Delay
+}
+
+func (g *Greylist) expire() time.Duration {
+	if g.Expire <= 0 {
+		return 48 * time.Hour
+	}
+	return g.Expire
+}
+
+func (g *Greylist) pass() time.Duration {
+	if g.Pass <= 0 {
+		return 35 * 24 * time.Hour
+	}
+	return g.Pass
+}
+
+// read the file on first use; g.mu is held
+func (g *Greylist) load() error {
+	if g.loaded {
+		return nil
+	}
+	g.entries = map[string]*greyEntry{}
+	g.loaded = true
+	if g.Path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(g.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", g.Path, err)
+	}
+	if err := json.Unmarshal(data, &g.entries); err != nil {
+		// start over rather than refuse all mail
+		g.entries = map[string]*greyEntry{}
+		return fmt.Errorf("failed to read %s: %w", g.Path, err)
+	}
+	return nil
+}
+
+// drop what has expired and write the rest; g.mu is held. A failed write
+// only costs delays after a restart, it is logged.
+func (g *Greylist) save() {
+	now := time.Now()
+	for key, entry := range g.entries {
+		if entry.Passed && now.Sub(entry.Last) > g.pass() || !entry.Passed && now.Sub(entry.Last) > g.expire() {
+			delete(g.entries, key)
+		}
+	}
+	if g.Path == "" {
+		return
+	}
+	data, err := json.Marshal(g.entries)
+	if err == nil {
+		tmp := filepath.Join(filepath.Dir(g.Path), "."+filepath.Base(g.Path)+".tmp")
+		os.Remove(tmp) // left over from a crash in an earlier save
+		err = writeFileAtomic(tmp, g.Path, func(w io.Writer) error {
+			_, err := w.Write(data)
+			return err
+		})
+	}
+	if err != nil {
+		log.Printf("greylist: failed to save %s: %v", g.Path, err)
+	}
+}
@@ -0,0 +1,225 @@
+package smtpd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// a connection read through a bufio.Reader, for the bytes the reader took
+// in past the PROXY header
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// whether the peer of conn may speak for other clients, with a PROXY header
+// or XCLIENT
+func (s *Server) trusted(conn net.Conn) bool {
+	ip, ok := netip.AddrFromSlice(remoteIP(conn))
+	if !ok {
+		return false
+	}
+	ip = ip.Unmap()
+	for _, prefix := range s.TrustedProxies {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+var errProxyHeader = errors.New("invalid PROXY protocol header")
+
+// the client address of the HAProxy PROXY protocol header, version 1 or 2,
+// at the start of r. It is nil when the proxy doesn't know it, eg. for its
+// own health checks.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	sig, err := r.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(sig, proxyV2Signature) {
+		return readProxyV2(r)
+	}
+	if !bytes.HasPrefix(sig, []byte("PROXY ")) {
+		return nil, errProxyHeader
+	}
+	return readProxyV1(r)
+}
+
+// "PROXY TCP4 192.0.2.1 198.51.100.1 56324 25\r\n", 107 bytes at most
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	fields := strings.Fields(strings.TrimSuffix(string(line), "\r\n"))
+	if !bytes.HasSuffix(line, []byte("\r\n")) || len(fields) < 2 {
+		return nil, errProxyHeader
+	}
+	switch fields[1] {
+	case "UNKNOWN":
+		return nil, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, errProxyHeader
+	}
+	if len(fields) != 6 {
+		return nil, errProxyHeader
+	}
+	ip, err := netip.ParseAddr(fields[2])
+	if err != nil || ip.Is4() != (fields[1] == "TCP4") {
+		return nil, errProxyHeader
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, errProxyHeader
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, uint16(port))), nil
+}
+
+// the binary form: signature, version and command, family, length, then
+// the addresses and TLVs, which are skipped
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	var header [16]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	if header[12]>>4 != 2 {
+		return nil, errProxyHeader
+	}
+	body := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	switch command := header[12] & 0xf; command {
+	case 0: // LOCAL, the proxy's own connection
+		return nil, nil
+	case 1: // PROXY
+	default:
+		return nil, errProxyHeader
+	}
+
+	var ipLen int
+	switch header[13] >> 4 {
+	case 1:
+		ipLen = 4
+	case 2:
+		ipLen = 16
+	default:
+		return nil, nil // a unix socket or unspecified
+	}
+	if len(body) < 2*ipLen+4 {
+		return nil, errProxyHeader
+	}
+	ip, _ := netip.AddrFromSlice(body[:ipLen])
+	port := binary.BigEndian.Uint16(body[2*ipLen:])
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, port)), nil
+}
+
+// XCLIENT (Postfix): a trusted proxy or filter names the client it speaks
+// for, "XCLIENT ADDR=192.0.2.1 HELO=mail.example.com". The session starts
+// over as if that client had connected, with a new greeting.
+func (c *serverSession) xclient(arg string) bool {
+	switch {
+	case !c.proxy:
+		return c.reply(550, "5.7.0 insufficient authorization")
+	case c.mail:
+		return c.reply(503, "5.5.1 XCLIENT not allowed during a mail transaction")
+	case arg == "":
+		return c.reply(501, "5.5.4 syntax: XCLIENT attribute=value ...")
+	}
+
+	tcp, _ := c.remote.(*net.TCPAddr)
+	var addr netip.AddrPort
+	if tcp != nil {
+		addr = tcp.AddrPort()
+	}
+	helo, username := c.helo, c.username
+	for _, attr := range strings.Fields(arg) {
+		name, value, ok := strings.Cut(attr, "=")
+		if !ok {
+			return c.reply(501, "5.5.4 bad XCLIENT attribute %q", attr)
+		}
+		value, err := decodeXtext(value)
+		if err != nil {
+			return c.reply(501, "5.5.4 bad XCLIENT attribute %q", attr)
+		}
+		// unknown to the proxy: keep what there is
+		if value == "[UNAVAILABLE]" || value == "[TEMPUNAVAIL]" {
+			continue
+		}
+		switch strings.ToUpper(name) {
+		case "ADDR":
+			ip, err := netip.ParseAddr(strings.TrimPrefix(strings.ToLower(value), "ipv6:"))
+			if err != nil {
+				return c.reply(501, "5.5.4 bad XCLIENT address %q", value)
+			}
+			addr = netip.AddrPortFrom(ip, addr.Port())
+		case "PORT":
+			port, err := strconv.ParseUint(value, 10, 16)
+			if err != nil {
+				return c.reply(501, "5.5.4 bad XCLIENT port %q", value)
+			}
+			addr = netip.AddrPortFrom(addr.Addr(), uint16(port))
+		case "HELO":
+			helo = value
+		case "LOGIN":
+			username = value
+		case "NAME", "PROTO", "DESTADDR", "DESTPORT":
+			// not used by the server
+		default:
+			return c.reply(501, "5.5.4 unknown XCLIENT attribute %q", name)
+		}
+	}
+
+	c.reset()
+	if addr.Addr().IsValid() {
+		c.remote = net.TCPAddrFromAddrPort(addr)
+	}
+	// the proxy's own EHLO that follows doesn't replace it
+	c.helo, c.clientHelo, c.username = helo, helo, username
+	return c.reply(220, "%s ESMTP ready", c.hostname)
+}
+
+// the value of an xtext (RFC 3461 4), see xtext
+func decodeXtext(s string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '+' {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i+3 > len(s) {
+			return "", fmt.Errorf("truncated xtext %q", s)
+		}
+		n, err := strconv.ParseUint(s[i+1:i+3], 16, 8)
+		if err != nil {
+			return "", fmt.Errorf("invalid xtext %q", s)
+		}
+		b.WriteByte(byte(n))
+		i += 2
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,105 @@
+package smtpd
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+)
+
+// a version 2 header: command, family and protocol, then body
+func proxyV2(command, family byte, body ...byte) string {
+	var length [2]byte
+	binary.BigEndian.PutUint16(length[:], uint16(len(body)))
+	return string(proxyV2Signature) + string([]byte{0x20 | command, family}) + string(length[:]) + string(body)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	// source and destination address, then port
+	v4 := []byte{192, 0, 2, 1, 198, 51, 100, 1, 0xdc, 0x04, 0, 25}
+	v6 := append(append(net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2")...), 0x0f, 0xa0, 0, 25)
+
+	tests := []struct {
+		name   string
+		header string
+		want   string // the client address, "" for none
+		err    bool
+	}{
+		{name: "v1 tcp4", header: "PROXY TCP4 192.0.2.1 198.51.100.1 56324 25\r\n", want: "192.0.2.1:56324"},
+		{name: "v1 tcp6", header: "PROXY TCP6 2001:db8::1 2001:db8::2 4000 25\r\n", want: "[2001:db8::1]:4000"},
+		{name: "v1 unknown", header: "PROXY UNKNOWN\r\n"},
+		{name: "v1 unknown with addresses", header: "PROXY UNKNOWN 192.0.2.1 198.51.100.1 56324 25\r\n"},
+		{name: "v1 family mismatch", header: "PROXY TCP4 2001:db8::1 2001:db8::2 4000 25\r\n", err: true},
+		{name: "v1 bad port", header: "PROXY TCP4 192.0.2.1 198.51.100.1 65536 25\r\n", err: true},
+		{name: "v1 missing field", header: "PROXY TCP4 192.0.2.1 198.51.100.1 56324\r\n", err: true},
+		{name: "v1 bare LF", header: "PROXY TCP4 192.0.2.1 198.51.100.1 56324 25\n", err: true},
+		{name: "v1 unknown protocol", header: "PROXY UDP4 192.0.2.1 198.51.100.1 56324 25\r\n", err: true},
+		{name: "v1 too long", header: "PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n", err: true},
+		{name: "no header", header: "EHLO client.example.org\r\n", err: true},
+		{name: "v2 tcp4", header: proxyV2(1, 0x11, v4...), want: "192.0.2.1:56324"},
+		{name: "v2 tcp6", header: proxyV2(1, 0x21, v6...), want: "[2001:db8::1]:4000"},
+		{name: "v2 with TLVs", header: proxyV2(1, 0x11, append(v4, 0x04, 0, 0)...), want: "192.0.2.1:56324"},
+		{name: "v2 local", header: proxyV2(0, 0x00)},
+		{name: "v2 unix socket", header: proxyV2(1, 0x31, make([]byte, 216)...)},
+		{name: "v2 short addresses", header: proxyV2(1, 0x11, v4[:8]...), err: true},
+		{name: "v2 unknown command", header: proxyV2(2, 0x11, v4...), err: true},
+		{name: "v2 version 1", header: strings.Replace(proxyV2(1, 0x11, v4...), "\x21", "\x11", 1), err: true},
+		{name: "v2 truncated", header: proxyV2(1, 0x11, v4...)[:14] + "\xff\xff" + string(v4), err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bufio.NewReader(strings.NewReader(tt.header + "EHLO proxy.example.org\r\n"))
+			addr, err := readProxyHeader(r)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("got %v, want an error", addr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := fmt.Sprint(addr); tt.want == "" && addr != nil || tt.want != "" && got != tt.want {
+				t.Fatalf("got %s, want %q", got, tt.want)
+			}
+			// the session goes on right after the header
+			if line, _ := r.ReadString('\n'); line != "EHLO proxy.example.org\r\n" {
+				t.Errorf("read %q after the header", line)
+			}
+		})
+	}
+}
+
+func TestDecodeXtext(t *testing.T) {
+	tests := []struct {
+		xtext string
+		want  string
+		err   bool
+	}{
+		{xtext: "", want: ""},
+		{xtext: "mail.example.com", want: "mail.example.com"},
+		{xtext: "a+2Bb", want: "a+b"},
+		{xtext: "+5BUNAVAILABLE+5D", want: "[UNAVAILABLE]"},
+		{xtext: "user+3Dname+20x", want: "user=name x"},
+		{xtext: "a+2", err: true},
+		{xtext: "a+", err: true},
+		{xtext: "+zz", err: true},
+		{xtext: "+-1", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.xtext, func(t *testing.T) {
+			got, err := decodeXtext(tt.xtext)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("got %q, want an error", got)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Fatalf("got %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,933 @@
+// Package smtpd is the receiving side of SMTP: a Server that takes mail
+// as an MX or a submission server, checks SPF, DKIM and DMARC on the way
+// in, and hands each message to a DeliveryHandler.
+package smtpd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/net/idna"
+
+	"internet_services/dns_lookup/resolver"
+	"internet_services/receiving_mail/mailauth"
+	"internet_services/sending_mail/dkim"
+)
+
+// Server receives mail over SMTP, as an MX on port 25 or, with
+// RequireAuth, as a submission server on 587: EHLO, STARTTLS, AUTH PLAIN
+// and LOGIN, recipients limited to Domains, SPF, DKIM and DMARC checks,
+// and every accepted message handed to Handler. Where the messages go
+// from there, a mailbox, a queue or another server, is up to the
+// handler. For implicit TLS (port 465) pass a tls.NewListener to Serve.
+// Greylist and Limits keep spam and floods out on the way in.
+//
+// Behind a load balancer the clients' addresses, for SPF and Received,
+// come from a PROXY protocol header or from XCLIENT, accepted only from
+// TrustedProxies.
+type Server struct {
+	Hostname string      // in the greeting, EHLO and Received, default os.Hostname
+	TLS      *tls.Config // offers STARTTLS when set
+	Handler  DeliveryHandler
+
+	// Auth checks a login; AUTH is only offered when it is set, and only
+	// after STARTTLS unless AllowInsecureAuth. Authenticated clients may
+	// send to any domain.
+	Auth              func(username, password string) bool
+	AllowInsecureAuth bool
+	RequireAuth       bool // MAIL only after AUTH, for submission
+	RequireTLS        bool // MAIL only after STARTTLS
+
+	// the recipient domains mail is accepted for, any domain when empty
+	Domains []string
+
+	// check SPF for the MAIL FROM domain of unauthenticated clients, and
+	// refuse the mail when it fails
+	SPF           bool
+	RejectSPFFail bool
+	Resolver      mailauth.Resolver // for SPF, DKIM and DMARC, default a resolver.Client from the root servers
+
+	// verify the DKIM signatures of mail from unauthenticated clients, and
+	// with DMARC apply the From domain's policy to them and SPF; the
+	// verdicts go to the handler and into an Authentication-Results header
+	DKIM        bool
+	DMARC       bool
+	RejectDMARC bool // refuse mail the policy says to reject
+
+	MaxSize       int64         // of a message, default 25 MiB
+	MaxRecipients int           // per message, default 100
+	Timeout       time.Duration // per command, default 5 minutes (RFC 5321 4.5.3.2)
+
+	// greylisting of unauthenticated clients, nil for none
+	Greylist *Greylist
+	// per client address, nil for no limits
+	Limits *ClientLimits
+
+	// the load balancers and filters that may name the client they pass
+	// on, with a PROXY header or XCLIENT
+	TrustedProxies []netip.Prefix
+	// every connection starts with a HAProxy PROXY header, version 1 or
+	// 2; connections from outside TrustedProxies, when set, are dropped.
+	// Not with a tls.NewListener, the header comes before TLS.
+	ProxyProtocol bool
+
+	mu     sync.Mutex
+	ln     net.Listener
+	conns  map[net.Conn]bool
+	closed bool
+	dns    mailauth.Resolver // Resolver or the default, shared by the sessions
+}
+
+// what the server hands to the handler: the envelope, the client and the
+// message with a Received header on top
+type Delivery struct {
+	ID         string
+	Received   time.Time
+	RemoteAddr net.Addr // the client, as a trusted proxy named it
+	Helo       string
+	TLS        bool
+	Username   string // from AUTH, empty for unauthenticated clients
+
+	From     string   // envelope sender, empty for bounces
+	To       []string // envelope recipients
+	SMTPUTF8 bool     // the addresses and headers may be UTF-8 (RFC 6531)
+	Data     []byte   // the message, CRLF line endings
+
+	SPF    mailauth.SPFResult // empty when it wasn't checked
+	SPFErr error              // what went wrong with a temperror or permerror
+
+	DKIM  []dkim.Verdict        // one per signature
+	DMARC mailauth.DMARCVerdict // Result empty when it wasn't checked
+}
+
+// DeliveryHandler takes the messages the server accepted. An error
+// refuses the message: a *textproto.Error, as net/smtp returns them, with
+// its code and text, anything else with 451. The server only says 250 once Deliver returned, so a handler that
+// queues must have the message safe by then.
+type DeliveryHandler interface {
+	Deliver(ctx context.Context, d *Delivery) error
+}
+
+// a DeliveryHandler that can tell at RCPT time whether it will take mail
+// for a recipient, eg. LMTP asking the delivery agent; the server refuses
+// the recipient with the error then, the way Deliver's are
+type RecipientChecker interface {
+	CheckRecipient(ctx context.Context, from, rcpt string) error
+}
+
+type DeliveryFunc func(ctx context.Context, d *Delivery) error
+
+func (f DeliveryFunc) Deliver(ctx context.Context, d *Delivery) error {
+	return f(ctx, d)
+}
+
+// a handler that passes the deliveries on to ch, for a consumer in
+// another goroutine. A full channel holds up the client until it has
+// room or the command times out.
+func DeliveryChannel(ch chan<- *Delivery) DeliveryHandler {
+	return DeliveryFunc(func(ctx context.Context, d *Delivery) error {
+		select {
+		case ch <- d:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+}
+
+var ErrServerClosed = errors.New("smtp: server closed")
+
+// listen on addr, eg. ":25", and serve until Close
+func (s *Server) ListenAndServe(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen: %w", err)
+	}
+	return s.Serve(ln)
+}
+
+// accept connections on ln until Close, which makes it return
+// ErrServerClosed
+func (s *Server) Serve(ln net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		ln.Close()
+		return ErrServerClosed
+	}
+	s.ln = ln
+	s.conns = map[net.Conn]bool{}
+	s.mu.Unlock()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				log.Printf("smtp server: %v", err)
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		s.mu.Lock()
+		s.conns[conn] = true
+		s.mu.Unlock()
+		go s.serve(conn)
+	}
+}
+
+// the address the server listens on, nil before Serve
+func (s *Server) Addr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ln == nil {
+		return nil
+	}
+	return s.ln.Addr()
+}
+
+// stop listening and drop the open connections
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for conn := range s.conns {
+		conn.Close()
+	}
+	if s.ln == nil {
+		return nil
+	}
+	return s.ln.Close()
+}
+
+func (s *Server) hostname() string {
+	if s.Hostname != "" {
+		return s.Hostname
+	}
+	if name, err := os.Hostname(); err == nil {
+		return name
+	}
+	return "localhost"
+}
+
+func (s *Server) maxSize() int64 {
+	if s.MaxSize > 0 {
+		return s.MaxSize
+	}
+	return 25 << 20
+}
+
+func (s *Server) timeout() time.Duration {
+	if s.Timeout > 0 {
+		return s.Timeout
+	}
+	return 5 * time.Minute
+}
+
+// the Resolver, or one resolver.Client for every session so they share
+// its cache
+func (s *Server) resolver() mailauth.Resolver {
+	if s.Resolver != nil {
+		return s.Resolver
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.dns == nil {
+		s.dns = resolver.New()
+	}
+	return s.dns
+}
+
+// whether mail for address is taken without AUTH
+func (s *Server) acceptsDomain(address string) bool {
+	if len(s.Domains) == 0 {
+		return true
+	}
+	at := strings.LastIndexByte(address, '@')
+	if at < 0 {
+		// RFC 5321 4.5.1: postmaster without a domain
+		return strings.EqualFold(address, "postmaster")
+	}
+	// a Unicode domain matches its A-label either way round
+	domain, err := asciiDomain(strings.TrimSuffix(address[at+1:], "."))
+	if err != nil {
+		return false
+	}
+	for _, d := range s.Domains {
+		if ascii, err := asciiDomain(d); err == nil && strings.EqualFold(domain, ascii) {
+			return true
+		}
+	}
+	return false
+}
+
+// one SMTP session
+type serverSession struct {
+	s        *Server
+	conn     net.Conn
+	text     *textproto.Conn
+	hostname string
+	remote   net.Addr // the client, the peer of conn unless a proxy says otherwise
+	proxy    bool     // the peer is one of TrustedProxies
+
+	helo       string
+	clientHelo string // from XCLIENT
+	esmtp      bool
+	tls        bool
+	username   string
+
+	// the transaction, between MAIL and the end of DATA
+	mail   bool
+	from   string
+	rcpts  []string
+	utf8   bool // MAIL had SMTPUTF8
+	spf    mailauth.SPFResult
+	spfErr error
+}
+
+func (s *Server) serve(conn net.Conn) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+
+	session := &serverSession{s: s, hostname: s.hostname(), remote: conn.RemoteAddr(), proxy: s.trusted(conn)}
+	named := false // by a PROXY header
+	if s.ProxyProtocol {
+		if !session.proxy && len(s.TrustedProxies) > 0 {
+			log.Printf("smtp server: PROXY connection from untrusted %s", conn.RemoteAddr())
+			return
+		}
+		conn.SetDeadline(time.Now().Add(s.timeout()))
+		r := bufio.NewReader(conn)
+		remote, err := readProxyHeader(r)
+		if err != nil {
+			log.Printf("smtp server: %s: %v", conn.RemoteAddr(), err)
+			return
+		}
+		if remote != nil {
+			session.remote, named = remote, true
+		}
+		session.conn = bufferedConn{Conn: conn, r: r}
+	} else {
+		session.conn = conn
+	}
+	session.text = textproto.NewConn(session.conn)
+
+	// a proxy that names its clients with XCLIENT is only one client here
+	if s.Limits != nil && (named || !session.proxy) {
+		ip := addrIP(session.remote)
+		if !s.Limits.connect(ip) {
+			session.reply(421, "4.7.0 %s too many connections from your address, try again later", session.hostname)
+			return
+		}
+		defer s.Limits.disconnect(ip)
+	}
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn.SetDeadline(time.Now().Add(s.timeout()))
+		if err := tlsConn.Handshake(); err != nil {
+			return
+		}
+		session.tls = true
+	}
+	if !session.reply(220, "%s ESMTP ready", session.hostname) {
+		return
+	}
+	for {
+		conn.SetDeadline(time.Now().Add(s.timeout()))
+		line, err := session.readCommand()
+		if err != nil {
+			if errors.Is(err, errLineTooLong) {
+				session.reply(500, "5.5.2 Line too long")
+			}
+			return
+		}
+		if !session.command(line) {
+			return
+		}
+	}
+}
+
+// reply with a code and a text, which for codes past the greeting starts
+// with an enhanced status; false when the session is over
+func (c *serverSession) reply(code int, format string, args ...any) bool {
+	return c.text.PrintfLine("%d %s", code, fmt.Sprintf(format, args...)) == nil
+}
+
+// the lines of a multi-line reply
+func (c *serverSession) replyLines(code int, lines ...string) bool {
+	for i, line := range lines {
+		sep := "-"
+		if i == len(lines)-1 {
+			sep = " "
+		}
+		if c.text.PrintfLine("%d%s%s", code, sep, line) != nil {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *serverSession) reset() {
+	c.mail, c.from, c.rcpts, c.utf8, c.spf, c.spfErr = false, "", nil, false, "", nil
+}
+
+// handle one command line; false ends the session
+func (c *serverSession) command(line string) bool {
+	verb, arg, _ := strings.Cut(line, " ")
+	arg = strings.TrimSpace(arg)
+	switch strings.ToUpper(verb) {
+	case "EHLO", "HELO":
+		if arg == "" {
+			return c.reply(501, "5.5.4 syntax: %s hostname", strings.ToUpper(verb))
+		}
+		c.reset()
+		c.helo, c.esmtp = arg, strings.EqualFold(verb, "EHLO")
+		if c.clientHelo != "" {
+			c.helo = c.clientHelo
+		}
+		if !c.esmtp {
+			return c.reply(250, "%s", c.hostname)
+		}
+		lines := []string{
+			c.hostname + " greets " + arg,
+			"PIPELINING",
+			"SIZE " + strconv.FormatInt(c.s.maxSize(), 10),
+			"8BITMIME",
+			"ENHANCEDSTATUSCODES",
+			"SMTPUTF8",
+		}
+		if c.s.TLS != nil && !c.tls {
+			lines = append(lines, "STARTTLS")
+		}
+		if c.authAllowed() {
+			lines = append(lines, "AUTH PLAIN LOGIN")
+		}
+		if c.proxy {
+			lines = append(lines, "XCLIENT ADDR PORT HELO LOGIN NAME PROTO DESTADDR DESTPORT")
+		}
+		return c.replyLines(250, lines...)
+
+	case "STARTTLS":
+		if c.s.TLS == nil || c.tls {
+			return c.reply(502, "5.5.1 STARTTLS not available")
+		}
+		if !c.reply(220, "2.0.0 ready to start TLS") {
+			return false
+		}
+		tlsConn := tls.Server(c.conn, c.s.TLS)
+		if err := tlsConn.Handshake(); err != nil {
+			return false
+		}
+		// RFC 3207 4.2: forget everything the client said before
+		c.conn, c.text, c.tls = tlsConn, textproto.NewConn(tlsConn), true
+		c.helo, c.username = "", ""
+		c.reset()
+		return true
+
+	case "AUTH":
+		switch {
+		case !c.authAllowed():
+			return c.reply(502, "5.5.1 AUTH not available")
+		case c.username != "":
+			return c.reply(503, "5.5.1 already authenticated")
+		case c.mail:
+			return c.reply(503, "5.5.1 AUTH not allowed during a mail transaction")
+		}
+		username, password, err := c.readAuth(arg)
+		if errors.Is(err, errLineTooLong) {
+			c.reply(500, "5.5.2 Line too long")
+			return false
+		}
+		if err != nil {
+			if errors.Is(err, errAuthCanceled) {
+				return c.reply(501, "5.0.0 authentication canceled")
+			}
+			return c.reply(501, "5.5.2 %v", err)
+		}
+		if !c.s.Auth(username, password) {
+			return c.reply(535, "5.7.8 authentication credentials invalid")
+		}
+		c.username = username
+		return c.reply(235, "2.7.0 authentication successful")
+
+	case "XCLIENT":
+		return c.xclient(arg)
+
+	case "MAIL":
+		return c.mailFrom(arg)
+
+	case "RCPT":
+		return c.rcptTo(arg)
+
+	case "DATA":
+		return c.data()
+
+	case "RSET":
+		c.reset()
+		return c.reply(250, "2.0.0 ok")
+
+	case "NOOP":
+		return c.reply(250, "2.0.0 ok")
+
+	case "VRFY":
+		return c.reply(252, "2.5.0 cannot verify, but will take the message")
+
+	case "QUIT":
+		c.reply(221, "2.0.0 %s closing connection", c.hostname)
+		return false
+	}
+	return c.reply(500, "5.5.2 command not recognized")
+}
+
+// the longest lines a client may send, CRLF included: commands per RFC
+// 5321 4.5.3.1.4, and AUTH with its initial response and the answers to
+// its challenges per RFC 4954 4
+const (
+	maxCommandLine = 512
+	maxAuthLine    = 12288
+)
+
+var errLineTooLong = errors.New("line too long")
+
+// the next command line
+func (c *serverSession) readCommand() (string, error) {
+	line, err := readLine(c.text.R, maxAuthLine)
+	if err == nil && len(line)+2 > maxCommandLine {
+		if verb, _, _ := strings.Cut(line, " "); !strings.EqualFold(verb, "AUTH") {
+			return "", errLineTooLong
+		}
+	}
+	return line, err
+}
+
+func (c *serverSession) authAllowed() bool {
+	return c.s.Auth != nil && (c.tls || c.s.AllowInsecureAuth)
+}
+
+var errAuthCanceled = errors.New("authentication canceled")
+
+// the credentials of an AUTH PLAIN or LOGIN exchange
+func (c *serverSession) readAuth(arg string) (username, password string, err error) {
+	mechanism, initial, _ := strings.Cut(arg, " ")
+	challenge := func(prompt string) (string, error) {
+		if !c.reply(334, "%s", base64.StdEncoding.EncodeToString([]byte(prompt))) {
+			return "", io.ErrUnexpectedEOF
+		}
+		line, err := readLine(c.text.R, maxAuthLine)
+		if err != nil {
+			return "", err
+		}
+		if line == "*" {
+			return "", errAuthCanceled
+		}
+		decoded, err := base64.StdEncoding.DecodeString(line)
+		if err != nil {
+			return "", errors.New("invalid base64")
+		}
+		return string(decoded), nil
+	}
+	decodeInitial := func(prompt string) (string, error) {
+		switch initial {
+		case "":
+			return challenge(prompt)
+		case "=":
+			return "", nil
+		}
+		decoded, err := base64.StdEncoding.DecodeString(initial)
+		if err != nil {
+			return "", errors.New("invalid base64")
+		}
+		return string(decoded), nil
+	}
+
+	switch strings.ToUpper(mechanism) {
+	case "PLAIN":
+		// authzid NUL authcid NUL password
+		response, err := decodeInitial("")
+		if err != nil {
+			return "", "", err
+		}
+		parts := strings.Split(response, "\x00")
+		if len(parts) != 3 {
+			return "", "", errors.New("malformed PLAIN response")
+		}
+		return parts[1], parts[2], nil
+	case "LOGIN":
+		if username, err = decodeInitial("Username:"); err != nil {
+			return "", "", err
+		}
+		password, err = challenge("Password:")
+		return username, password, err
+	}
+	return "", "", fmt.Errorf("unsupported mechanism %q", mechanism)
+}
+
+func (c *serverSession) mailFrom(arg string) bool {
+	switch {
+	case c.helo == "":
+		return c.reply(503, "5.5.1 EHLO first")
+	case c.mail:
+		return c.reply(503, "5.5.1 nested MAIL command")
+	case c.s.RequireTLS && !c.tls:
+		return c.reply(530, "5.7.0 must issue a STARTTLS command first")
+	case c.s.RequireAuth && c.username == "":
+		return c.reply(530, "5.7.0 authentication required")
+	}
+	from, found := cutPath(arg, "FROM:")
+	if !found {
+		return c.reply(501, "5.5.4 syntax: MAIL FROM:<address>")
+	}
+	smtputf8 := false
+	for _, param := range mailParams(arg) {
+		name, value, _ := strings.Cut(param, "=")
+		if strings.EqualFold(name, "SMTPUTF8") {
+			smtputf8 = true
+		}
+		if strings.EqualFold(name, "SIZE") {
+			size, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return c.reply(501, "5.5.4 invalid SIZE")
+			}
+			if size > c.s.maxSize() {
+				return c.reply(552, "5.3.4 message size exceeds fixed maximum message size")
+			}
+		}
+	}
+
+	if !smtputf8 && !isASCII(from) {
+		// RFC 6531 3.4
+		return c.reply(553, "5.6.7 non-ASCII address without SMTPUTF8")
+	}
+
+	if c.s.Limits != nil && !c.s.Limits.message(addrIP(c.remote)) {
+		return c.reply(451, "4.7.1 too many messages from your address, try again later")
+	}
+
+	if (c.s.SPF || c.s.DMARC) && c.username == "" {
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+		c.spf, c.spfErr = mailauth.CheckSPF(ctx, c.s.resolver(), addrIP(c.remote), c.helo, from)
+		cancel()
+		if c.spf == mailauth.SPFFail && c.s.RejectSPFFail {
+			return c.reply(550, "5.7.23 SPF validation failed for %s", addrIP(c.remote))
+		}
+	}
+	c.mail, c.from, c.utf8 = true, from, smtputf8
+	return c.reply(250, "2.1.0 sender ok")
+}
+
+// the parameters after the path of MAIL FROM or RCPT TO, eg. SIZE=1024
+func mailParams(arg string) []string {
+	if end := strings.IndexByte(arg, '>'); end >= 0 {
+		return strings.Fields(arg[end+1:])
+	}
+	fields := strings.Fields(arg)
+	if len(fields) < 2 {
+		return nil
+	}
+	return fields[1:]
+}
+
+func (c *serverSession) rcptTo(arg string) bool {
+	if !c.mail {
+		return c.reply(503, "5.5.1 MAIL first")
+	}
+	to, found := cutPath(arg, "TO:")
+	if !found || to == "" {
+		return c.reply(501, "5.5.4 syntax: RCPT TO:<address>")
+	}
+	if !strings.Contains(to, "@") && !strings.EqualFold(to, "postmaster") {
+		return c.reply(553, "5.1.3 invalid recipient address")
+	}
+	if !c.utf8 && !isASCII(to) {
+		return c.reply(553, "5.6.7 non-ASCII address without SMTPUTF8")
+	}
+	if c.username == "" && !c.s.acceptsDomain(to) {
+		return c.reply(550, "5.7.1 relaying denied")
+	}
+	maxRecipients := c.s.MaxRecipients
+	if maxRecipients <= 0 {
+		maxRecipients = 100
+	}
+	if len(c.rcpts) >= maxRecipients {
+		return c.reply(452, "4.5.3 too many recipients")
+	}
+	if c.s.Greylist != nil && c.username == "" {
+		if ok, wait := c.s.Greylist.Check(addrIP(c.remote), c.from, to); !ok {
+			return c.reply(451, "4.7.1 greylisted, try again in %d seconds", int(wait.Seconds()+0.5))
+		}
+	}
+	if checker, ok := c.s.Handler.(RecipientChecker); ok {
+		ctx, cancel := context.WithTimeout(context.Background(), c.s.timeout())
+		err := checker.CheckRecipient(ctx, c.from, to)
+		cancel()
+		if err != nil {
+			return c.replyError(err, "recipient check for "+to)
+		}
+	}
+	c.rcpts = append(c.rcpts, to)
+	return c.reply(250, "2.1.5 recipient ok")
+}
+
+func (c *serverSession) data() bool {
+	if !c.mail || len(c.rcpts) == 0 {
+		return c.reply(503, "5.5.1 RCPT first")
+	}
+	if !c.reply(354, "end data with <CR><LF>.<CR><LF>") {
+		return false
+	}
+	data, err := readMessageData(c.text.R, c.s.maxSize())
+	switch {
+	case errors.Is(err, errMessageTooBig):
+		c.reset()
+		return c.reply(552, "5.3.4 message size exceeds fixed maximum message size")
+	case errors.Is(err, errBareLF):
+		c.reset()
+		return c.reply(550, "5.5.2 bare LF in message data")
+	case err != nil:
+		return false
+	}
+
+	d := &Delivery{
+		ID:         newDeliveryID(),
+		Received:   time.Now(),
+		RemoteAddr: c.remote,
+		Helo:       c.helo,
+		TLS:        c.tls,
+		Username:   c.username,
+		From:       c.from,
+		To:         c.rcpts,
+		SMTPUTF8:   c.utf8,
+		SPF:        c.spf,
+		SPFErr:     c.spfErr,
+	}
+	c.reset()
+	checked := (c.s.DKIM || c.s.DMARC) && d.Username == ""
+	if checked {
+		c.verify(d, data)
+		if c.s.RejectDMARC && d.DMARC.Disposition == "reject" {
+			return c.reply(550, "5.7.1 rejected by the DMARC policy of %s", d.DMARC.Domain)
+		}
+	}
+	d.Data = append(c.traceHeaders(d, checked), stripAuthResults(data, c.hostname)...)
+
+	if c.s.Handler == nil {
+		return c.reply(451, "4.3.0 no delivery handler configured")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), c.s.timeout())
+	defer cancel()
+	if err := c.s.Handler.Deliver(ctx, d); err != nil {
+		return c.replyError(err, "delivery "+d.ID)
+	}
+	return c.reply(250, "2.0.0 ok: queued as %s", d.ID)
+}
+
+// the reply in a handler's error, or 451 for an error without one, which
+// is logged instead: it is nothing for the client to see
+func (c *serverSession) replyError(err error, what string) bool {
+	var reply *textproto.Error
+	if errors.As(err, &reply) {
+		// a reply passed on from another server may have several lines
+		return c.replyLines(reply.Code, strings.Split(reply.Msg, "\n")...)
+	}
+	log.Printf("smtp server: %s failed: %v", what, err)
+	return c.reply(451, "4.3.0 local error in processing")
+}
+
+// Received (RFC 5321 4.4) and, when SPF was checked, Received-SPF
+// (RFC 7208 9.1), then Authentication-Results
+func (c *serverSession) traceHeaders(d *Delivery, dkimChecked bool) []byte {
+	protocol := "SMTP"
+	if c.esmtp {
+		protocol = "ESMTP"
+		if d.SMTPUTF8 {
+			// RFC 6531 4.3
+			protocol = "UTF8SMTP"
+		}
+		if d.TLS {
+			protocol += "S"
+		}
+		if d.Username != "" {
+			protocol += "A"
+		}
+	}
+	ip := addrIP(d.RemoteAddr)
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "Received: from %s ([%s])\r\n\tby %s with %s id %s", d.Helo, ip, c.hostname, protocol, d.ID)
+	if len(d.To) == 1 {
+		fmt.Fprintf(&b, "\r\n\tfor <%s>", d.To[0])
+	}
+	fmt.Fprintf(&b, "; %s\r\n", d.Received.Format(time.RFC1123Z))
+	if d.SPF != "" {
+		fmt.Fprintf(&b, "Received-SPF: %s (%s) client-ip=%s; envelope-from=\"%s\"; helo=%s;\r\n",
+			d.SPF, c.hostname, ip, d.From, d.Helo)
+	}
+	b.WriteString(authenticationResults(c.hostname, d, dkimChecked))
+	return b.Bytes()
+}
+
+var (
+	errMessageTooBig = errors.New("message too big")
+	errBareLF        = errors.New("bare LF in message data")
+)
+
+// the message after DATA, up to the line with the single dot, dot
+// stuffing undone. Only CRLF ends a line: a bare LF is refused rather
+// than guessed at, so "\n.\n" can't smuggle a second message past the
+// server (CVE-2023-51766). The rest of an oversized message is read and
+// dropped to keep the session in step.
+func readMessageData(r *bufio.Reader, maxSize int64) ([]byte, error) {
+	var data bytes.Buffer
+	var tooBig, bareLF bool
+	start := true // at the start of a line
+	var last byte // of the previous piece of a long line
+	for {
+		piece, err := r.ReadSlice('\n')
+		if err != nil && err != bufio.ErrBufferFull {
+			return nil, err
+		}
+		complete := err == nil
+		if complete {
+			beforeLF := last
+			if len(piece) >= 2 {
+				beforeLF = piece[len(piece)-2]
+			}
+			if beforeLF != '\r' {
+				bareLF = true
+			}
+		}
+		if start && string(piece) == ".\r\n" {
+			break
+		}
+		last = piece[len(piece)-1]
+		if start && piece[0] == '.' {
+			piece = piece[1:]
+		}
+		if int64(data.Len()+len(piece)) > maxSize {
+			tooBig = true
+		}
+		if !tooBig && !bareLF {
+			data.Write(piece)
+		}
+		start = complete
+	}
+	switch {
+	case tooBig:
+		return nil, errMessageTooBig
+	case bareLF:
+		return nil, errBareLF
+	}
+	return data.Bytes(), nil
+}
+
+// a line without its line ending, read no further than limit octets: a
+// longer one is errLineTooLong, the session can't be kept in step after it
+func readLine(r *bufio.Reader, limit int) (string, error) {
+	var line []byte
+	for {
+		piece, err := r.ReadSlice('\n')
+		if err != nil && err != bufio.ErrBufferFull {
+			return "", err
+		}
+		if len(line)+len(piece) > limit {
+			return "", errLineTooLong
+		}
+		line = append(line, piece...)
+		if err == nil {
+			break
+		}
+	}
+	line = bytes.TrimSuffix(line, []byte("\n"))
+	line = bytes.TrimSuffix(line, []byte("\r"))
+	return string(line), nil
+}
+
+func remoteIP(conn net.Conn) net.IP {
+	return addrIP(conn.RemoteAddr())
+}
+
+func addrIP(addr net.Addr) net.IP {
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		return tcp.IP
+	}
+	host, _, _ := net.SplitHostPort(addr.String())
+	return net.ParseIP(host)
+}
+
+func newDeliveryID() string {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		log.Printf("Error generating delivery ID: %v", err)
+	}
+	return strings.ToUpper(hex.EncodeToString(b[:]))
+}
+
+// the address of "FROM:<a@example.com> SIZE=123", parameters dropped
+func cutPath(arg, prefix string) (string, bool) {
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		return "", false
+	}
+	path := strings.TrimSpace(arg[len(prefix):])
+	if end := strings.IndexByte(path, '>'); strings.HasPrefix(path, "<") && end > 0 {
+		return path[1:end], true
+	}
+	path, _, _ = strings.Cut(path, " ")
+	return path, true
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// the domain as an A-label; ASCII domains and address literals as they
+// are
+func asciiDomain(domain string) (string, error) {
+	if isASCII(domain) || strings.HasPrefix(domain, "[") {
+		return domain, nil
+	}
+	ascii, err := idna.Lookup.ToASCII(domain)
+	if err != nil {
+		return "", fmt.Errorf("invalid domain %q: %w", domain, err)
+	}
+	return ascii, nil
+}
+
+// a timeout caused by ctx reports ctx's error as well
+func contextError(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() != nil && !errors.Is(err, ctx.Err()) {
+		return fmt.Errorf("%w: %w", ctx.Err(), err)
+	}
+	return err
+}
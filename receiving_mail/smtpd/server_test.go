@@ -0,0 +1,150 @@
+package smtpd
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+// a session with s over a pipe, the greeting read
+func dialPipe(t *testing.T, s *Server) *textproto.Conn {
+	t.Helper()
+	client, server := net.Pipe()
+	go s.serve(server)
+	t.Cleanup(func() { client.Close() })
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	text := textproto.NewConn(client)
+	if _, _, err := text.ReadResponse(220); err != nil {
+		t.Fatalf("greeting: %v", err)
+	}
+	return text
+}
+
+// send a command and read a reply with code, returning its text
+func expect(t *testing.T, text *textproto.Conn, code int, format string, args ...any) string {
+	t.Helper()
+	id, err := text.Cmd(format, args...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	text.StartResponse(id)
+	defer text.EndResponse(id)
+	_, msg, err := text.ReadResponse(code)
+	if err != nil {
+		t.Fatalf("%s: %v", strings.Fields(fmt.Sprintf(format, args...))[0], err)
+	}
+	return msg
+}
+
+// write a line too long to read in one go, which the server stops
+// reading partway through; the reply comes while it is still being sent
+func expectTooLong(t *testing.T, text *textproto.Conn, line string) {
+	t.Helper()
+	go text.PrintfLine("%s", line)
+	_, msg, err := text.ReadResponse(500)
+	if err != nil || msg != "5.5.2 Line too long" {
+		t.Fatalf("got %q, %v, want 500 Line too long", msg, err)
+	}
+	if _, err := text.ReadLine(); err == nil {
+		t.Error("the session went on after an overlong line")
+	}
+}
+
+func testServer(deliveries chan *Delivery) *Server {
+	return &Server{
+		Hostname:          "mx.example.com",
+		Domains:           []string{"example.com"},
+		AllowInsecureAuth: true,
+		Auth: func(username, password string) bool {
+			return username == "user" && password == "secret"
+		},
+		Handler: DeliveryChannel(deliveries),
+	}
+}
+
+func plain(username, password string) string {
+	return base64.StdEncoding.EncodeToString([]byte("\x00" + username + "\x00" + password))
+}
+
+func TestServerSession(t *testing.T) {
+	deliveries := make(chan *Delivery, 2)
+	text := dialPipe(t, testServer(deliveries))
+
+	if ext := expect(t, text, 250, "EHLO client.example.org"); !strings.Contains(ext, "AUTH PLAIN LOGIN") {
+		t.Errorf("AUTH not offered: %q", ext)
+	}
+
+	// unauthenticated: only the server's own domains
+	expect(t, text, 250, "MAIL FROM:<sender@example.org>")
+	if msg := expect(t, text, 550, "RCPT TO:<someone@elsewhere.example>"); msg != "5.7.1 relaying denied" {
+		t.Errorf("relay refused with %q", msg)
+	}
+	expect(t, text, 250, "RCPT TO:<postmaster@Example.COM>")
+	expect(t, text, 354, "DATA")
+	dw := text.DotWriter()
+	fmt.Fprintf(dw, "Subject: local\r\n\r\nhello\r\n")
+	dw.Close()
+	if _, _, err := text.ReadResponse(250); err != nil {
+		t.Fatal(err)
+	}
+	d := <-deliveries
+	if d.Username != "" || strings.Join(d.To, ",") != "postmaster@Example.COM" || !strings.HasSuffix(string(d.Data), "\r\n\r\nhello\r\n") {
+		t.Errorf("delivered %+v", d)
+	}
+
+	if msg := expect(t, text, 535, "AUTH PLAIN %s", plain("user", "wrong")); !strings.HasPrefix(msg, "5.7.8") {
+		t.Errorf("bad password refused with %q", msg)
+	}
+	expect(t, text, 334, "AUTH LOGIN")
+	expect(t, text, 334, "%s", base64.StdEncoding.EncodeToString([]byte("user")))
+	expect(t, text, 235, "%s", base64.StdEncoding.EncodeToString([]byte("secret")))
+	expect(t, text, 503, "AUTH PLAIN %s", plain("user", "secret"))
+
+	// authenticated: anywhere
+	expect(t, text, 250, "MAIL FROM:<user@example.com>")
+	expect(t, text, 250, "RCPT TO:<someone@elsewhere.example>")
+	expect(t, text, 354, "DATA")
+	dw = text.DotWriter()
+	fmt.Fprintf(dw, "Subject: relayed\r\n\r\n.leading dot\r\n")
+	dw.Close()
+	if _, _, err := text.ReadResponse(250); err != nil {
+		t.Fatal(err)
+	}
+	d = <-deliveries
+	if d.Username != "user" || strings.Join(d.To, ",") != "someone@elsewhere.example" || !strings.HasSuffix(string(d.Data), "\r\n\r\n.leading dot\r\n") {
+		t.Errorf("delivered %+v", d)
+	}
+	if !strings.Contains(string(d.Data), "with ESMTPA id "+d.ID) {
+		t.Errorf("Received without the authenticated protocol: %q", d.Data)
+	}
+	expect(t, text, 221, "QUIT")
+}
+
+// RFC 5321 4.5.3.1.4: 512 octets a command line, and RFC 4954 4: 12288
+// for AUTH and the answers to its challenges
+func TestServerLineLimits(t *testing.T) {
+	t.Run("command", func(t *testing.T) {
+		text := dialPipe(t, testServer(nil))
+		noop := "NOOP " + strings.Repeat("x", maxCommandLine-len("NOOP ")-2)
+		expect(t, text, 250, "%s", noop)
+		expectTooLong(t, text, noop+"x")
+	})
+	t.Run("AUTH", func(t *testing.T) {
+		text := dialPipe(t, testServer(nil))
+		expect(t, text, 250, "EHLO client.example.org")
+		// a long initial response is fine
+		password := strings.Repeat("x", 8000)
+		expect(t, text, 535, "AUTH PLAIN %s", plain("user", password))
+		expectTooLong(t, text, "AUTH PLAIN "+strings.Repeat("A", maxAuthLine))
+	})
+	t.Run("AUTH challenge", func(t *testing.T) {
+		text := dialPipe(t, testServer(nil))
+		expect(t, text, 250, "EHLO client.example.org")
+		expect(t, text, 334, "AUTH LOGIN")
+		expectTooLong(t, text, strings.Repeat("A", maxAuthLine))
+	})
+}
@@ -0,0 +1,135 @@
+package smtpd
+
+import (
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// ClientLimits caps what one client address may do at the Server, against
+// a client that hogs it or floods the mailboxes. IPv6 clients count per
+// /64, which one host usually has to itself. Zero fields don't limit.
+type ClientLimits struct {
+	Connections       int // open at the same time
+	ConnectionsPerMin int // new connections a minute
+	MessagesPerHour   int
+
+	mu       sync.Mutex
+	open     map[netip.Addr]int
+	connRate map[netip.Addr]*bucket
+	msgRate  map[netip.Addr]*bucket
+	pruned   time.Time
+}
+
+// count a new connection from ip; false when it is over a limit
+func (l *ClientLimits) connect(ip net.IP) bool {
+	key, ok := clientKey(ip)
+	if !ok {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.prune()
+	if l.Connections > 0 && l.open[key] >= l.Connections {
+		return false
+	}
+	if !l.take(&l.connRate, key, l.ConnectionsPerMin, time.Minute) {
+		return false
+	}
+	if l.open == nil {
+		l.open = map[netip.Addr]int{}
+	}
+	l.open[key]++
+	return true
+}
+
+// a connection from ip that connect counted has closed
+func (l *ClientLimits) disconnect(ip net.IP) {
+	key, ok := clientKey(ip)
+	if !ok {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.open[key]--; l.open[key] <= 0 {
+		delete(l.open, key)
+	}
+}
+
+// count a message from ip; false when it is over the limit
+func (l *ClientLimits) message(ip net.IP) bool {
+	key, ok := clientKey(ip)
+	if !ok {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.prune()
+	return l.take(&l.msgRate, key, l.MessagesPerHour, time.Hour)
+}
+
+// a token from the bucket of key in buckets; l.mu is held
+func (l *ClientLimits) take(buckets *map[netip.Addr]*bucket, key netip.Addr, rate int, per time.Duration) bool {
+	if rate <= 0 {
+		return true
+	}
+	if *buckets == nil {
+		*buckets = map[netip.Addr]*bucket{}
+	}
+	b := (*buckets)[key]
+	if b == nil {
+		b = &bucket{tokens: float64(rate), last: time.Now()}
+		(*buckets)[key] = b
+	}
+	return b.take(rate, per)
+}
+
+// forget the buckets of clients quiet for an hour, which are full again
+// anyway; l.mu is held
+func (l *ClientLimits) prune() {
+	if time.Since(l.pruned) < time.Minute {
+		return
+	}
+	l.pruned = time.Now()
+	for _, buckets := range []map[netip.Addr]*bucket{l.connRate, l.msgRate} {
+		for key, b := range buckets {
+			if time.Since(b.last) > time.Hour {
+				delete(buckets, key)
+			}
+		}
+	}
+}
+
+// a token bucket of one client, holding up to rate tokens and refilled
+// with rate of them per period; guarded by the ClientLimits' mu
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take a token if there is one
+func (b *bucket) take(rate int, per time.Duration) bool {
+	now := time.Now()
+	b.tokens = min(float64(rate), b.tokens+float64(now.Sub(b.last))*float64(rate)/float64(per))
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// the address a client is counted under
+func clientKey(ip net.IP) (netip.Addr, bool) {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return netip.Addr{}, false
+	}
+	addr = addr.Unmap()
+	if addr.Is6() {
+		prefix, _ := addr.Prefix(64)
+		return prefix.Addr(), true
+	}
+	return addr, true
+}
@@ -0,0 +1,250 @@
+package smtpd
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"internet_services/receiving_mail/mailauth"
+	"internet_services/receiving_mail/message"
+)
+
+// Webhook hands the deliveries of a Server to a web application, the way
+// inbound parse services do: each message is POSTed to URL as JSON, see
+// WebhookMessage, with its text and html decoded and its attachments
+// either in the JSON, base64, or stored in AttachmentDir for the
+// application to fetch from AttachmentURL.
+//
+// With a Secret, each request carries
+//
+//	X-Webhook-Timestamp: 1700000000
+//	X-Webhook-Signature: sha256=<hex HMAC-SHA256 of "timestamp.body">
+//
+// which the application should check, along with the timestamp being
+// recent. X-Webhook-Id is the delivery ID, the same on every retry.
+type Webhook struct {
+	URL    string
+	Secret []byte
+
+	// store attachments in AttachmentDir/<delivery ID>/ instead of sending
+	// them, and give their URL under AttachmentURL, eg.
+	// https://files.example.com/inbound/
+	AttachmentDir string
+	AttachmentURL string
+
+	// retries of network errors, 408, 429 and 5xx answers, after
+	// RetryDelay and twice as long before each next one. When they are
+	// used up the client is told to try again later.
+	MaxRetries int
+	RetryDelay time.Duration // default 1 second
+
+	Client *http.Client // default one with a 30 second timeout
+}
+
+// the JSON a Webhook posts
+type WebhookMessage struct {
+	ID       string    `json:"id"`
+	Received time.Time `json:"received"`
+
+	// the envelope and the checks of the server
+	Helo     string             `json:"helo"`
+	Remote   string             `json:"remote,omitempty"`
+	TLS      bool               `json:"tls"`
+	Sender   string             `json:"sender"`
+	Rcpts    []string           `json:"recipients"`
+	SPF      mailauth.SPFResult `json:"spf,omitempty"`
+	DKIM     []string           `json:"dkim,omitempty"` // "pass example.com", one per signature
+	DMARC    string             `json:"dmarc,omitempty"`
+	Username string             `json:"username,omitempty"`
+
+	// the message, decoded
+	From        *mail.Address       `json:"from,omitempty"`
+	To          []mail.Address      `json:"to,omitempty"`
+	Cc          []mail.Address      `json:"cc,omitempty"`
+	Subject     string              `json:"subject"`
+	Text        string              `json:"text,omitempty"`
+	HTML        string              `json:"html,omitempty"`
+	Headers     map[string][]string `json:"headers"` // as they are, encoded words and all
+	Attachments []WebhookAttachment `json:"attachments,omitempty"`
+	Size        int                 `json:"size"`
+}
+
+type WebhookAttachment struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	Size        int    `json:"size"`
+	Inline      bool   `json:"inline,omitempty"`
+	ContentID   string `json:"content_id,omitempty"`
+	Content     []byte `json:"content,omitempty"` // base64 in the JSON
+	URL         string `json:"url,omitempty"`     // where it was stored instead
+}
+
+// implements DeliveryHandler
+func (w Webhook) Deliver(ctx context.Context, d *Delivery) (err error) {
+	msg, err := w.message(d)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	defer func() { err = contextError(ctx, err) }()
+	delay := w.RetryDelay
+	if delay <= 0 {
+		delay = time.Second
+	}
+	for retry := 0; ; retry++ {
+		var retryable bool
+		retryable, err = w.post(ctx, d.ID, body)
+		if err == nil || !retryable || retry >= w.MaxRetries || ctx.Err() != nil {
+			return err
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		}
+		delay *= 2
+	}
+}
+
+// the delivery as JSON; attachments are stored at this point if they are
+// to be
+func (w Webhook) message(d *Delivery) (*WebhookMessage, error) {
+	msg := &WebhookMessage{
+		ID:       d.ID,
+		Received: d.Received,
+		Helo:     d.Helo,
+		TLS:      d.TLS,
+		Sender:   d.From,
+		Rcpts:    d.To,
+		SPF:      d.SPF,
+		DMARC:    string(d.DMARC.Result),
+		Username: d.Username,
+		Size:     len(d.Data),
+	}
+	if d.RemoteAddr != nil {
+		msg.Remote = d.RemoteAddr.String()
+	}
+	for _, v := range d.DKIM {
+		msg.DKIM = append(msg.DKIM, fmt.Sprintf("%s %s", v.Result, v.Domain))
+	}
+
+	parsed, err := mail.ReadMessage(bytes.NewReader(d.Data))
+	if err != nil {
+		return nil, fmt.Errorf("webhook: %w", err)
+	}
+	msg.Headers = parsed.Header
+	decoded, err := message.Parse(bytes.NewReader(d.Data))
+	if err != nil {
+		return nil, fmt.Errorf("webhook: %w", err)
+	}
+	if decoded.From.Address != "" {
+		msg.From = &decoded.From
+	}
+	msg.To, msg.Cc = decoded.To, decoded.Cc
+	msg.Subject, msg.Text, msg.HTML = decoded.Subject, decoded.Text, decoded.HTML
+
+	for i, att := range decoded.Attachments {
+		attachment := WebhookAttachment{
+			Filename:    att.Filename,
+			ContentType: att.ContentType,
+			Size:        len(att.Data),
+			Inline:      att.Inline,
+			ContentID:   att.ContentID,
+		}
+		if w.AttachmentDir == "" {
+			attachment.Content = att.Data
+		} else if attachment.URL, err = w.store(d.ID, i, att); err != nil {
+			return nil, err
+		}
+		msg.Attachments = append(msg.Attachments, attachment)
+	}
+	return msg, nil
+}
+
+// store attachment i of delivery id and return its URL
+func (w Webhook) store(id string, i int, att message.Attachment) (string, error) {
+	// the sender picks the filename, only its base is used and numbered so
+	// two of the same name don't collide
+	name := strconv.Itoa(i+1) + "-attachment"
+	if base := path.Base(strings.ReplaceAll(att.Filename, `\`, "/")); base != "." && base != "/" {
+		name = strconv.Itoa(i+1) + "-" + strings.Map(func(r rune) rune {
+			if r < ' ' || strings.ContainsRune(`/\:*?"<>|`, r) {
+				return '_'
+			}
+			return r
+		}, base)
+	}
+	dir := filepath.Join(w.AttachmentDir, id)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", fmt.Errorf("webhook: %w", err)
+	}
+	err := writeFileAtomic(filepath.Join(dir, "."+name+".tmp"), filepath.Join(dir, name), func(out io.Writer) error {
+		_, err := out.Write(att.Data)
+		return err
+	})
+	if err != nil {
+		return "", fmt.Errorf("webhook: failed to store attachment: %w", err)
+	}
+	return strings.TrimSuffix(w.AttachmentURL, "/") + "/" + url.PathEscape(id) + "/" + url.PathEscape(name), nil
+}
+
+// one attempt; retryable tells whether another could go better
+func (w Webhook) post(ctx context.Context, id string, body []byte) (retryable bool, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, fmt.Errorf("webhook: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Id", id)
+	if len(w.Secret) > 0 {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set("X-Webhook-Timestamp", timestamp)
+		req.Header.Set("X-Webhook-Signature", "sha256="+webhookSignature(w.Secret, timestamp, body))
+	}
+
+	client := w.Client
+	if client == nil {
+		client = &http.Client{Timeout: 30 * time.Second}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return true, fmt.Errorf("webhook: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+	switch {
+	case resp.StatusCode/100 == 2:
+		return false, nil
+	case resp.StatusCode == http.StatusRequestTimeout, resp.StatusCode == http.StatusTooManyRequests, resp.StatusCode >= 500:
+		return true, fmt.Errorf("webhook: %s", resp.Status)
+	}
+	return false, fmt.Errorf("webhook: %s", resp.Status)
+}
+
+// hex HMAC-SHA256 of "timestamp.body"
+func webhookSignature(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
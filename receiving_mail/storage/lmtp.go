@@ -0,0 +1,283 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/textproto"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"internet_services/receiving_mail/smtpd"
+)
+
+// LMTP hands the messages to a local delivery agent, Dovecot's or Cyrus'
+// LMTP service, over a unix socket or TCP (RFC 2033). Unlike SMTP the agent
+// answers the message data once per recipient, as it files it into each
+// mailbox, so a full mailbox fails only its own recipient.
+//
+// When every recipient failed, Deliver returns the agent's reply, which
+// the Server passes on: the client bounces a permanent failure and retries
+// a temporary one. When only some did, the others have the message
+// already. The failed ones go to Failed, eg. a Maildir to keep them
+// somewhere or a handler that queues them; without it a temporary failure
+// fails the whole message, a retry delivers a duplicate to the others
+// rather than lose it (RFC 5321 6.1), and a permanent one is logged.
+//
+// With CheckRecipients the Server asks the agent about each recipient at
+// RCPT time, so that mail for a mailbox that doesn't exist is refused
+// there instead of accepted and lost.
+type LMTP struct {
+	Network string        // "unix" or "tcp", default unix for an Addr with a slash and tcp otherwise
+	Addr    string        // eg. /var/run/dovecot/lmtp or 127.0.0.1:24
+	LHLO    string        // the name to greet the agent with, default os.Hostname
+	Timeout time.Duration // per connection, default 1 minute
+
+	CheckRecipients bool
+	Failed          smtpd.DeliveryHandler
+}
+
+// implements smtpd.DeliveryHandler
+func (l LMTP) Deliver(ctx context.Context, d *smtpd.Delivery) error {
+	rcptErrs, err := l.deliver(ctx, d)
+	if err != nil {
+		return fmt.Errorf("LMTP delivery to %s failed: %w", l.Addr, err)
+	}
+
+	var failed []string
+	var firstErr, temporary error
+	for i, rcpt := range d.To {
+		err := rcptErrs[i]
+		if err == nil {
+			continue
+		}
+		failed = append(failed, rcpt)
+		if firstErr == nil {
+			firstErr = err
+		}
+		var reply *textproto.Error
+		if temporary == nil && (!errors.As(err, &reply) || reply.Code/100 == 4) {
+			temporary = err
+		}
+	}
+	switch {
+	case len(failed) == 0:
+		return nil
+	case len(failed) == len(d.To):
+		// a permanent reply only when no recipient could succeed later
+		if temporary != nil {
+			return temporary
+		}
+		return firstErr
+	case l.Failed != nil:
+		partial := *d
+		partial.To = failed
+		return l.Failed.Deliver(ctx, &partial)
+	case temporary != nil:
+		log.Printf("lmtp: %s delivered to %d of %d recipients, failing it for a retry: %v",
+			d.ID, len(d.To)-len(failed), len(d.To), temporary)
+		return temporary
+	}
+	log.Printf("lmtp: %s not delivered to %v: %v", d.ID, failed, firstErr)
+	return nil
+}
+
+// CheckRecipient asks the agent whether it takes mail for rcpt, when
+// CheckRecipients is set; the Server calls it for each RCPT.
+func (l LMTP) CheckRecipient(ctx context.Context, from, rcpt string) error {
+	if !l.CheckRecipients {
+		return nil
+	}
+	c, err := l.dial(ctx)
+	if err != nil {
+		return fmt.Errorf("LMTP recipient check with %s failed: %w", l.Addr, err)
+	}
+	defer c.close()
+	if err := c.cmd(250, "MAIL FROM:<%s>", from); err != nil {
+		return err
+	}
+	if err := c.cmd(25, "RCPT TO:<%s>", rcpt); err != nil {
+		return err
+	}
+	return nil
+}
+
+// an LMTP session with the agent
+type lmtpConn struct {
+	conn       net.Conn
+	text       *textproto.Conn
+	extensions map[string]string
+}
+
+func (l LMTP) dial(ctx context.Context) (*lmtpConn, error) {
+	timeout := l.Timeout
+	if timeout <= 0 {
+		timeout = time.Minute
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	network := l.Network
+	if network == "" {
+		network = "tcp"
+		if strings.Contains(l.Addr, "/") {
+			network = "unix"
+		}
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, l.Addr)
+	if err != nil {
+		return nil, err
+	}
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+
+	c := &lmtpConn{conn: conn, text: textproto.NewConn(conn), extensions: map[string]string{}}
+	if _, _, err := c.text.ReadResponse(220); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("no greeting: %w", err)
+	}
+	name := l.LHLO
+	if name == "" {
+		name, _ = os.Hostname()
+	}
+	if name == "" {
+		name = "localhost"
+	}
+	id, err := c.text.Cmd("LHLO %s", name)
+	if err == nil {
+		var msg string
+		c.text.StartResponse(id)
+		_, msg, err = c.text.ReadResponse(250)
+		c.text.EndResponse(id)
+		for _, line := range strings.Split(msg, "\n")[1:] {
+			keyword, params, _ := strings.Cut(line, " ")
+			c.extensions[strings.ToUpper(keyword)] = params
+		}
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("LHLO failed: %w", err)
+	}
+	return c, nil
+}
+
+func (c *lmtpConn) cmd(expectCode int, format string, args ...any) error {
+	line := fmt.Sprintf(format, args...)
+	if err := checkLine(line); err != nil {
+		return err
+	}
+	id, err := c.text.Cmd("%s", line)
+	if err != nil {
+		return err
+	}
+	c.text.StartResponse(id)
+	defer c.text.EndResponse(id)
+	_, _, err = c.text.ReadResponse(expectCode)
+	return err
+}
+
+// QUIT, without waiting long for the reply
+func (c *lmtpConn) close() {
+	c.conn.SetDeadline(time.Now().Add(time.Second))
+	c.cmd(221, "QUIT")
+	c.conn.Close()
+}
+
+// the transaction, with an error for each recipient the agent didn't take
+func (l LMTP) deliver(ctx context.Context, d *smtpd.Delivery) ([]error, error) {
+	c, err := l.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer c.close()
+
+	mail := "MAIL FROM:<" + d.From + ">"
+	if _, ok := c.extensions["8BITMIME"]; ok {
+		mail += " BODY=8BITMIME"
+	}
+	if _, ok := c.extensions["SMTPUTF8"]; ok && d.SMTPUTF8 {
+		mail += " SMTPUTF8"
+	} else if d.SMTPUTF8 && !isASCII(d.From+strings.Join(d.To, "")) {
+		return nil, errors.New("the agent doesn't support SMTPUTF8 for the UTF-8 addresses")
+	}
+	if err := c.cmd(250, "%s", mail); err != nil {
+		return nil, fmt.Errorf("MAIL command failed: %w", err)
+	}
+
+	rcptErrs := make([]error, len(d.To))
+	var accepted []int
+	for i, rcpt := range d.To {
+		rcptErrs[i] = c.cmd(25, "RCPT TO:<%s>", rcpt)
+		if isConnectionError(rcptErrs[i]) {
+			return nil, fmt.Errorf("RCPT command failed: %w", rcptErrs[i])
+		}
+		if rcptErrs[i] == nil {
+			accepted = append(accepted, i)
+		}
+	}
+	if len(accepted) == 0 {
+		return rcptErrs, nil
+	}
+
+	if err := c.cmd(354, "DATA"); err != nil {
+		if isConnectionError(err) {
+			return nil, err
+		}
+		for _, i := range accepted {
+			rcptErrs[i] = err
+		}
+		return rcptErrs, nil
+	}
+	w := c.text.DotWriter()
+	if _, err := w.Write(d.Data); err != nil {
+		return nil, fmt.Errorf("DATA write failed: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("DATA write failed: %w", err)
+	}
+	// a reply for each recipient RCPT accepted, in their order
+	for _, i := range accepted {
+		_, _, err := c.text.ReadResponse(250)
+		if isConnectionError(err) {
+			// the ones without a reply may or may not have it
+			return nil, fmt.Errorf("no reply for %s: %w", d.To[i], err)
+		}
+		rcptErrs[i] = err
+	}
+	return rcptErrs, nil
+}
+
+func checkLine(line string) error {
+	if strings.ContainsAny(line, "\r\n") {
+		return errors.New("lmtp: a line must not contain CR or LF")
+	}
+	return nil
+}
+
+// whether err ended the session rather than refused a command
+func isConnectionError(err error) bool {
+	var netErr net.Error
+	var reply *textproto.Error
+	switch {
+	case errors.Is(err, io.EOF), errors.Is(err, net.ErrClosed), errors.As(err, &netErr):
+		return true
+	case errors.As(err, &reply):
+		return reply.Code == 421
+	}
+	return false
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,261 @@
+// Package storage is where the deliveries of an smtpd.Server end up:
+// Maildir directories, a local delivery agent over LMTP, or the folders
+// Rules file them into. It also reads mbox files.
+package storage
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"internet_services/receiving_mail/smtpd"
+)
+
+// Maildir is a mail directory in the format of qmail and Dovecot: new
+// messages are written to tmp and renamed into new, where a reader moves
+// them to cur once seen, flags in the file name. No locks are needed, the
+// rename is atomic. Subfolders are Maildir++ directories such as ".Spam".
+// As an smtpd.DeliveryHandler it files every delivery, with a Return-Path
+// on top.
+type Maildir struct {
+	Dir string
+}
+
+// a message in a Maildir
+type MaildirMessage struct {
+	Key   string // the unique part of the file name, stable across flag changes
+	New   bool   // still in new, not seen by any reader
+	Flags string // Maildir info flags in ASCII order, eg. "RS": replied, seen
+	Size  int64
+	path  string
+}
+
+// the cur, new and tmp directories, created if missing
+func (m Maildir) Init() error {
+	for _, sub := range []string{"cur", "new", "tmp"} {
+		if err := os.MkdirAll(filepath.Join(m.Dir, sub), 0o700); err != nil {
+			return fmt.Errorf("failed to create maildir: %w", err)
+		}
+	}
+	return nil
+}
+
+// the Maildir++ subfolder name, eg. "Spam" or "Lists.go-nuts", created on
+// first use
+func (m Maildir) Folder(name string) Maildir {
+	return Maildir{Dir: filepath.Join(m.Dir, "."+strings.ReplaceAll(name, "/", "."))}
+}
+
+// store a message in new and return its key
+func (m Maildir) Add(data []byte) (string, error) {
+	return m.add(func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// write a message to tmp, sync it and rename it into new with its size:
+// a reader never sees a part of a message, and what a failed write left
+// in tmp is removed
+func (m Maildir) add(write func(io.Writer) error) (string, error) {
+	if err := m.Init(); err != nil {
+		return "", err
+	}
+	key, err := newMaildirKey()
+	if err != nil {
+		return "", err
+	}
+	tmp := filepath.Join(m.Dir, "tmp", key)
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return "", fmt.Errorf("failed to store message: %w", err)
+	}
+	err = write(file)
+	if err == nil {
+		err = file.Sync()
+	}
+	var info os.FileInfo
+	if err == nil {
+		info, err = file.Stat()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, filepath.Join(m.Dir, "new", key+",S="+strconv.FormatInt(info.Size(), 10)))
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return "", fmt.Errorf("failed to store message: %w", err)
+	}
+	return key, nil
+}
+
+// implements smtpd.DeliveryHandler: the message with the envelope sender
+// as Return-Path (RFC 5321 4.4), the mark of final delivery
+func (m Maildir) Deliver(ctx context.Context, d *smtpd.Delivery) error {
+	_, err := m.add(func(w io.Writer) error {
+		fmt.Fprintf(w, "Return-Path: <%s>\r\n", d.From)
+		_, err := w.Write(d.Data)
+		return err
+	})
+	return err
+}
+
+// MaildirPerRecipient delivers each recipient a copy in its own Maildir,
+// root/user@example.com, for a server with more than one mailbox
+func MaildirPerRecipient(root string) smtpd.DeliveryHandler {
+	return smtpd.DeliveryFunc(func(ctx context.Context, d *smtpd.Delivery) error {
+		for _, rcpt := range d.To {
+			rcpt = strings.ToLower(rcpt)
+			if rcpt == "" || strings.ContainsAny(rcpt, `/\`) || strings.HasPrefix(rcpt, ".") {
+				return fmt.Errorf("recipient %q can't be a directory name", rcpt)
+			}
+			_, err := (Maildir{Dir: filepath.Join(root, rcpt)}).add(func(w io.Writer) error {
+				fmt.Fprintf(w, "Return-Path: <%s>\r\nDelivered-To: %s\r\n", d.From, rcpt)
+				_, err := w.Write(d.Data)
+				return err
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// the messages in new and cur, oldest first
+func (m Maildir) Messages() ([]MaildirMessage, error) {
+	var msgs []MaildirMessage
+	for _, sub := range []string{"new", "cur"} {
+		entries, err := os.ReadDir(filepath.Join(m.Dir, sub))
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return nil, fmt.Errorf("failed to read maildir: %w", err)
+		}
+		for _, entry := range entries {
+			if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+				continue
+			}
+			info, err := entry.Info()
+			if err != nil {
+				continue // moved by another reader meanwhile
+			}
+			key, flags := splitMaildirName(entry.Name())
+			msgs = append(msgs, MaildirMessage{
+				Key:   key,
+				New:   sub == "new",
+				Flags: flags,
+				Size:  info.Size(),
+				path:  filepath.Join(m.Dir, sub, entry.Name()),
+			})
+		}
+	}
+	// keys start with the delivery time
+	sort.SliceStable(msgs, func(i, j int) bool { return maildirTime(msgs[i].Key) < maildirTime(msgs[j].Key) })
+	return msgs, nil
+}
+
+// the content of the message with key
+func (m Maildir) Read(key string) ([]byte, error) {
+	msg, err := m.find(key)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadFile(msg.path)
+}
+
+// move the message to cur with flags, eg. "S" to mark it seen
+func (m Maildir) SetFlags(key, flags string) error {
+	msg, err := m.find(key)
+	if err != nil {
+		return err
+	}
+	sorted := []byte(flags)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	name := filepath.Base(msg.path)
+	if i := strings.Index(name, ":2,"); i >= 0 {
+		name = name[:i]
+	}
+	return os.Rename(msg.path, filepath.Join(m.Dir, "cur", name+":2,"+string(sorted)))
+}
+
+// delete the message with key
+func (m Maildir) Remove(key string) error {
+	msg, err := m.find(key)
+	if err != nil {
+		return err
+	}
+	return os.Remove(msg.path)
+}
+
+func (m Maildir) find(key string) (MaildirMessage, error) {
+	msgs, err := m.Messages()
+	if err != nil {
+		return MaildirMessage{}, err
+	}
+	for _, msg := range msgs {
+		if msg.Key == key {
+			return msg, nil
+		}
+	}
+	return MaildirMessage{}, fmt.Errorf("maildir: no message %s: %w", key, os.ErrNotExist)
+}
+
+var maildirCounter atomic.Int64
+
+// a name no other delivery, in this process or another, on this host or
+// another sharing the directory, picks: time, process, counter, random
+// and host, eg. 1700000000.M123456P4242Q1R8f3a9c01.mx1
+func newMaildirKey() (string, error) {
+	var b [4]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		host = "localhost"
+	}
+	// / and : would break the name, see the Maildir specification
+	host = strings.NewReplacer("/", `\057`, ":", `\072`).Replace(host)
+	now := time.Now()
+	return fmt.Sprintf("%d.M%dP%dQ%dR%s.%s", now.Unix(), now.Nanosecond()/1000, os.Getpid(),
+		maildirCounter.Add(1), hex.EncodeToString(b[:]), host), nil
+}
+
+// the key and the flags of a file name such as "key,S=1234:2,RS"
+func splitMaildirName(name string) (key, flags string) {
+	name, info, _ := strings.Cut(name, ":")
+	if rest, ok := strings.CutPrefix(info, "2,"); ok {
+		flags = rest
+	}
+	key, _, _ = strings.Cut(name, ",")
+	return key, flags
+}
+
+// microseconds since 1970 of a key "seconds.Mmicroseconds...", just the
+// seconds for keys of other programs
+func maildirTime(key string) int64 {
+	seconds, rest, _ := strings.Cut(key, ".")
+	n, _ := strconv.ParseInt(seconds, 10, 64)
+	var micros int64
+	if rest, ok := strings.CutPrefix(rest, "M"); ok {
+		end := strings.IndexFunc(rest, func(r rune) bool { return r < '0' || r > '9' })
+		if end > 0 {
+			micros, _ = strconv.ParseInt(rest[:end], 10, 64)
+		}
+	}
+	return n*1e6 + micros
+}
@@ -0,0 +1,136 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"internet_services/receiving_mail/smtpd"
+)
+
+// the names of the files in dir
+func dirNames(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	return names
+}
+
+func TestMaildirDeliver(t *testing.T) {
+	m := Maildir{Dir: t.TempDir()}
+	d := &smtpd.Delivery{ID: "1", From: "sender@example.org", To: []string{"user@example.com"}, Data: []byte("Subject: hi\r\n\r\nhello\r\n")}
+	if err := m.Deliver(context.Background(), d); err != nil {
+		t.Fatal(err)
+	}
+
+	// written to tmp, then moved to new under its size
+	if names := dirNames(t, filepath.Join(m.Dir, "tmp")); len(names) != 0 {
+		t.Errorf("left in tmp: %v", names)
+	}
+	want := "Return-Path: <sender@example.org>\r\nSubject: hi\r\n\r\nhello\r\n"
+	size := fmt.Sprintf(",S=%d", len(want))
+	names := dirNames(t, filepath.Join(m.Dir, "new"))
+	if len(names) != 1 || !strings.HasSuffix(names[0], size) {
+		t.Fatalf("new has %v, want one message of %d bytes", names, len(want))
+	}
+
+	msgs, err := m.Messages()
+	if err != nil || len(msgs) != 1 {
+		t.Fatalf("messages %v, %v", msgs, err)
+	}
+	if msgs[0].Key != strings.TrimSuffix(names[0], size) || !msgs[0].New || msgs[0].Size != int64(len(want)) {
+		t.Errorf("got %+v", msgs[0])
+	}
+	if data, err := m.Read(msgs[0].Key); err != nil || string(data) != want {
+		t.Errorf("read %q, %v", data, err)
+	}
+
+	if err := m.SetFlags(msgs[0].Key, "SR"); err != nil {
+		t.Fatal(err)
+	}
+	msgs, _ = m.Messages()
+	if len(msgs) != 1 || msgs[0].New || msgs[0].Flags != "RS" {
+		t.Errorf("after SetFlags: %+v", msgs)
+	}
+	if names := dirNames(t, filepath.Join(m.Dir, "cur")); len(names) != 1 || !strings.HasSuffix(names[0], size+":2,RS") {
+		t.Errorf("cur has %v", names)
+	}
+}
+
+// deliveries at the same time, in the same second, never share a name
+func TestMaildirUniqueKeys(t *testing.T) {
+	m := Maildir{Dir: t.TempDir()}
+	const n = 200
+	keys := make(chan string, n)
+	var wg sync.WaitGroup
+	for range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			key, err := m.Add([]byte("Subject: same\r\n\r\nsame\r\n"))
+			if err != nil {
+				t.Error(err)
+			}
+			keys <- key
+		}()
+	}
+	wg.Wait()
+	close(keys)
+
+	seen := map[string]bool{}
+	for key := range keys {
+		if seen[key] {
+			t.Errorf("key %s twice", key)
+		}
+		seen[key] = true
+	}
+	if names := dirNames(t, filepath.Join(m.Dir, "new")); len(names) != n {
+		t.Errorf("%d messages in new, want %d", len(names), n)
+	}
+}
+
+// a write that fails halfway leaves nothing behind, in new or in tmp
+func TestMaildirPartialWrite(t *testing.T) {
+	m := Maildir{Dir: t.TempDir()}
+	errDisk := errors.New("disk full")
+	_, err := m.add(func(w io.Writer) error {
+		io.WriteString(w, "Subject: half\r\n\r\nthe first ha")
+		return errDisk
+	})
+	if !errors.Is(err, errDisk) {
+		t.Fatalf("got %v, want the write's error", err)
+	}
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if names := dirNames(t, filepath.Join(m.Dir, sub)); len(names) != 0 {
+			t.Errorf("%s has %v", sub, names)
+		}
+	}
+	if msgs, err := m.Messages(); err != nil || len(msgs) != 0 {
+		t.Errorf("messages %v, %v", msgs, err)
+	}
+
+	// and a delivery for several mailboxes stops at the first that fails
+	root := t.TempDir()
+	d := &smtpd.Delivery{ID: "2", From: "sender@example.org", To: []string{"a@example.com", "../b@example.com"}, Data: []byte("\r\nbody\r\n")}
+	if err := MaildirPerRecipient(root).Deliver(context.Background(), d); err == nil {
+		t.Fatal("a recipient outside root was delivered")
+	}
+	if names := dirNames(t, filepath.Join(root, "a@example.com", "new")); len(names) != 1 {
+		t.Errorf("a@example.com has %v", names)
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(root), "b@example.com")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("b@example.com written outside root: %v", err)
+	}
+}
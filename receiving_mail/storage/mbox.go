@@ -0,0 +1,99 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"time"
+)
+
+// a message from an mbox file
+type MboxMessage struct {
+	From string    // envelope sender from the From_ line
+	Date time.Time // delivery time from the From_ line, zero if it has none
+	Data []byte    // the message with the quoting of From lines undone
+}
+
+// MboxReader iterates over the messages of an mbox file, each starting
+// with a "From sender date" line. Lines quoted as ">From " lose one ">",
+// as in the mboxrd format most tools write today.
+type MboxReader struct {
+	r    *bufio.Reader
+	next string // the From_ line of the next message
+	err  error
+}
+
+func NewMboxReader(r io.Reader) *MboxReader {
+	return &MboxReader{r: bufio.NewReader(r)}
+}
+
+var ErrNotMbox = errors.New("mbox: file doesn't start with a From line")
+
+// the next message; io.EOF after the last one
+func (m *MboxReader) Next() (*MboxMessage, error) {
+	if m.err != nil {
+		return nil, m.err
+	}
+	if m.next == "" {
+		line, err := m.r.ReadString('\n')
+		if err != nil && line == "" {
+			m.err = err
+			return nil, err
+		}
+		if !strings.HasPrefix(line, "From ") {
+			m.err = ErrNotMbox
+			return nil, m.err
+		}
+		m.next = line
+	}
+
+	msg := parseFromLine(m.next)
+	m.next = ""
+	var data bytes.Buffer
+	for {
+		line, err := m.r.ReadString('\n')
+		if strings.HasPrefix(line, "From ") {
+			m.next = line
+			break
+		}
+		if quoted := strings.TrimLeft(line, ">"); len(quoted) < len(line) && strings.HasPrefix(quoted, "From ") {
+			line = line[1:]
+		}
+		data.WriteString(line)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			m.err = err
+			return nil, err
+		}
+	}
+
+	// the blank line a writer puts between messages isn't part of either
+	msg.Data = data.Bytes()
+	if bytes.HasSuffix(msg.Data, []byte("\r\n\r\n")) {
+		msg.Data = msg.Data[:len(msg.Data)-2]
+	} else if bytes.HasSuffix(msg.Data, []byte("\n\n")) {
+		msg.Data = msg.Data[:len(msg.Data)-1]
+	}
+	if m.next == "" {
+		m.err = io.EOF
+	}
+	return msg, nil
+}
+
+// "From sender@example.com Thu Nov  2 10:00:00 2023"
+func parseFromLine(line string) *MboxMessage {
+	line = strings.TrimRight(strings.TrimPrefix(line, "From "), "\r\n")
+	sender, date, _ := strings.Cut(line, " ")
+	msg := &MboxMessage{From: sender}
+	if t, err := time.Parse(time.ANSIC, strings.TrimSpace(date)); err == nil {
+		msg.Date = t
+	}
+	if sender == "MAILER-DAEMON" {
+		msg.From = ""
+	}
+	return msg
+}
@@ -0,0 +1,542 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"internet_services/receiving_mail/smtpd"
+)
+
+// Rules files incoming mail the way Sieve scripts do: each delivery is
+// run through the rules in order, and the actions of every rule that
+// matches are carried out, until one says stop. A delivery no rule files
+// somewhere, forwards, rejects or discards is kept in Mailbox. Use it as
+// the smtpd.Server's Handler.
+//
+// Rules can be written in Go or in a small language, see ParseRules:
+//
+//	subject contains "[SPAM]" -> fileinto "Spam", stop
+//	header "List-Id" contains "golang-nuts" -> fileinto "Lists/go-nuts"
+//	from is "boss@example.com" and subject contains "urgent" -> forward "me@example.org", keep
+//	size over 20M -> reject "message too large for this mailbox"
+type Rules struct {
+	Rules   []Rule
+	Mailbox Maildir // keep stores here, fileinto in its Maildir++ folders
+
+	Forward smtpd.Forwarder // the server forward sends through, its To the action's
+	Webhook smtpd.Webhook   // the settings of webhook, its URL the action's
+}
+
+type Rule struct {
+	If   Condition
+	Then []Action
+}
+
+// a test of a message
+type Condition func(m *RuleMessage) bool
+
+// a delivery as the conditions see it
+type RuleMessage struct {
+	*smtpd.Delivery
+	Header mail.Header // of the message, nil if it doesn't parse
+}
+
+type ActionType string
+
+const (
+	ActionKeep     ActionType = "keep"     // store in Mailbox
+	ActionFileInto ActionType = "fileinto" // store in the folder Arg
+	ActionForward  ActionType = "forward"  // send on to the address Arg
+	ActionReject   ActionType = "reject"   // refuse with the reason Arg, nothing else is done
+	ActionDiscard  ActionType = "discard"  // accept and drop
+	ActionWebhook  ActionType = "webhook"  // POST it to the URL Arg, see smtpd.Webhook
+	ActionStop     ActionType = "stop"     // skip the rules that follow
+)
+
+type Action struct {
+	Type ActionType
+	Arg  string
+}
+
+// implements smtpd.DeliveryHandler. Rejects and store errors go back to the
+// client. Forwards and webhooks that fail are retried by the client too,
+// unless the message is stored already: then they are only logged, a
+// retry would store it twice.
+func (r *Rules) Deliver(ctx context.Context, d *smtpd.Delivery) error {
+	msg := &RuleMessage{Delivery: d}
+	if parsed, err := mail.ReadMessage(bytes.NewReader(d.Data)); err == nil {
+		msg.Header = parsed.Header
+	}
+
+	var actions []Action
+	filed := false // implicit keep canceled (RFC 5228 2.10.2)
+	for _, rule := range r.Rules {
+		if rule.If != nil && !rule.If(msg) {
+			continue
+		}
+		stop := false
+		for _, action := range rule.Then {
+			switch action.Type {
+			case ActionStop:
+				stop = true
+			case ActionReject:
+				return &textproto.Error{Code: 550, Msg: "5.7.1 " + action.Arg}
+			case ActionKeep:
+				actions = append(actions, action)
+			default:
+				actions = append(actions, action)
+				filed = true
+			}
+		}
+		if stop {
+			break
+		}
+	}
+	if !filed {
+		actions = append(actions, Action{Type: ActionKeep})
+	}
+
+	// local copies first: until one is made, a failure is the client's to
+	// retry
+	stored := false
+	folders := map[string]bool{}
+	for _, action := range actions {
+		var box Maildir
+		switch action.Type {
+		case ActionKeep:
+			box = r.Mailbox
+		case ActionFileInto:
+			box = r.Mailbox.Folder(action.Arg)
+		default:
+			continue
+		}
+		if folders[box.Dir] {
+			continue // one copy per folder
+		}
+		folders[box.Dir] = true
+		if err := box.Deliver(ctx, d); err != nil {
+			return err
+		}
+		stored = true
+	}
+
+	for _, action := range actions {
+		var err error
+		switch action.Type {
+		case ActionForward:
+			forward := r.Forward
+			forward.To = []string{action.Arg}
+			err = forward.Deliver(ctx, d)
+		case ActionWebhook:
+			webhook := r.Webhook
+			webhook.URL = action.Arg
+			err = webhook.Deliver(ctx, d)
+		default:
+			continue
+		}
+		if err != nil && !stored {
+			return err
+		}
+		if err != nil {
+			log.Printf("rules: delivery %s: %s %s: %v", d.ID, action.Type, action.Arg, err)
+		}
+	}
+	return nil
+}
+
+// LoadRules reads the rules of a file, see ParseRules
+func LoadRules(path string) ([]Rule, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	rules, err := ParseRules(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s:%w", path, err)
+	}
+	return rules, nil
+}
+
+// ParseRules reads rules, one a line, "tests -> actions"; # starts a
+// comment. Tests are joined with "and" and "or", and binds tighter, and
+// each may start with "not":
+//
+//	from|to|subject|sender|recipient is|contains|matches|regex "value"
+//	header "Name" is|contains|matches|regex "value"
+//	size over|under 100K
+//	all
+//
+// from is any address in From, to any in To and Cc, sender the envelope
+// sender, recipient any envelope recipient. Comparisons ignore case,
+// except regex; matches takes * and ? wildcards. Actions, separated by
+// commas: keep, fileinto "Folder", forward "address", reject "reason",
+// discard, webhook "url", stop.
+func ParseRules(r io.Reader) ([]Rule, error) {
+	var rules []Rule
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		tokens, err := ruleTokens(scanner.Text())
+		if err != nil {
+			return nil, fmt.Errorf("%d: %w", line, err)
+		}
+		if len(tokens) == 0 {
+			continue
+		}
+		rule, err := parseRule(tokens)
+		if err != nil {
+			return nil, fmt.Errorf("%d: %w", line, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, scanner.Err()
+}
+
+// a token of the rule language; quoted is set for "strings"
+type ruleToken struct {
+	text   string
+	quoted bool
+}
+
+// the words, "strings", "," and "->" of a line, up to a #
+func ruleTokens(line string) ([]ruleToken, error) {
+	var tokens []ruleToken
+	for i := 0; i < len(line); {
+		c := line[i]
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+		case c == '#':
+			return tokens, nil
+		case c == ',':
+			tokens = append(tokens, ruleToken{text: ","})
+			i++
+		case strings.HasPrefix(line[i:], "->"):
+			tokens = append(tokens, ruleToken{text: "->"})
+			i += 2
+		case c == '"':
+			var b strings.Builder
+			i++
+			for ; i < len(line) && line[i] != '"'; i++ {
+				if line[i] == '\\' && i+1 < len(line) {
+					i++
+				}
+				b.WriteByte(line[i])
+			}
+			if i == len(line) {
+				return nil, errors.New("unterminated string")
+			}
+			tokens = append(tokens, ruleToken{text: b.String(), quoted: true})
+			i++
+		default:
+			end := strings.IndexAny(line[i:], " \t,\"#")
+			if end < 0 {
+				end = len(line) - i
+			}
+			word := line[i : i+end]
+			if arrow := strings.Index(word, "->"); arrow > 0 {
+				word = word[:arrow]
+			}
+			tokens = append(tokens, ruleToken{text: word})
+			i += len(word)
+		}
+	}
+	return tokens, nil
+}
+
+func parseRule(tokens []ruleToken) (Rule, error) {
+	arrow := -1
+	for i, t := range tokens {
+		if t.text == "->" && !t.quoted {
+			arrow = i
+			break
+		}
+	}
+	if arrow < 0 {
+		return Rule{}, errors.New("no -> between tests and actions")
+	}
+	cond, err := parseConditions(tokens[:arrow])
+	if err != nil {
+		return Rule{}, err
+	}
+	actions, err := parseActions(tokens[arrow+1:])
+	if err != nil {
+		return Rule{}, err
+	}
+	return Rule{If: cond, Then: actions}, nil
+}
+
+// tests joined by "or" of tests joined by "and"
+func parseConditions(tokens []ruleToken) (Condition, error) {
+	var any []Condition
+	var all []Condition
+	for len(tokens) > 0 {
+		cond, rest, err := parseTest(tokens)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, cond)
+		tokens = rest
+		if len(tokens) == 0 {
+			break
+		}
+		switch word := strings.ToLower(tokens[0].text); {
+		case tokens[0].quoted:
+			return nil, fmt.Errorf("unexpected %q", tokens[0].text)
+		case word == "and":
+		case word == "or":
+			any, all = append(any, allOf(all)), nil
+		default:
+			return nil, fmt.Errorf("want and or or, not %q", tokens[0].text)
+		}
+		tokens = tokens[1:]
+		if len(tokens) == 0 {
+			return nil, errors.New("test missing at the end")
+		}
+	}
+	if len(all) == 0 {
+		return nil, errors.New("no test, use all for every message")
+	}
+	any = append(any, allOf(all))
+	if len(any) == 1 {
+		return any[0], nil
+	}
+	return func(m *RuleMessage) bool {
+		for _, cond := range any {
+			if cond(m) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+func allOf(conds []Condition) Condition {
+	if len(conds) == 1 {
+		return conds[0]
+	}
+	return func(m *RuleMessage) bool {
+		for _, cond := range conds {
+			if !cond(m) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// one test and the tokens after it
+func parseTest(tokens []ruleToken) (Condition, []ruleToken, error) {
+	word := func(i int) string {
+		if i >= len(tokens) || tokens[i].quoted {
+			return ""
+		}
+		return strings.ToLower(tokens[i].text)
+	}
+	str := func(i int) (string, error) {
+		if i >= len(tokens) || !tokens[i].quoted {
+			return "", errors.New(`want a "string"`)
+		}
+		return tokens[i].text, nil
+	}
+
+	if word(0) == "not" {
+		cond, rest, err := parseTest(tokens[1:])
+		if err != nil {
+			return nil, nil, err
+		}
+		return func(m *RuleMessage) bool { return !cond(m) }, rest, nil
+	}
+
+	switch field := word(0); field {
+	case "all":
+		return func(*RuleMessage) bool { return true }, tokens[1:], nil
+
+	case "size":
+		if len(tokens) < 3 || tokens[2].quoted {
+			return nil, nil, errors.New("want size over|under number")
+		}
+		limit, err := parseSize(tokens[2].text)
+		if err != nil {
+			return nil, nil, err
+		}
+		switch word(1) {
+		case "over":
+			return func(m *RuleMessage) bool { return int64(len(m.Data)) > limit }, tokens[3:], nil
+		case "under":
+			return func(m *RuleMessage) bool { return int64(len(m.Data)) < limit }, tokens[3:], nil
+		}
+		return nil, nil, fmt.Errorf("want size over or under, not %q", tokens[1].text)
+
+	case "header", "from", "to", "subject", "sender", "recipient":
+		i := 1
+		var name string
+		if field == "header" {
+			var err error
+			if name, err = str(1); err != nil {
+				return nil, nil, fmt.Errorf("header name: %w", err)
+			}
+			i = 2
+		}
+		value, err := str(i + 1)
+		if err != nil {
+			return nil, nil, err
+		}
+		match, err := ruleMatcher(word(i), value)
+		if err != nil {
+			return nil, nil, err
+		}
+		values := ruleValues(field, name)
+		return func(m *RuleMessage) bool {
+			for _, v := range values(m) {
+				if match(v) {
+					return true
+				}
+			}
+			return false
+		}, tokens[i+2:], nil
+	}
+	if len(tokens) == 0 {
+		return nil, nil, errors.New("test missing")
+	}
+	return nil, nil, fmt.Errorf("unknown test %q", tokens[0].text)
+}
+
+// the strings a test of field looks at
+func ruleValues(field, name string) func(m *RuleMessage) []string {
+	addresses := func(m *RuleMessage, names ...string) []string {
+		var list []string
+		for _, name := range names {
+			addrs, err := m.Header.AddressList(name)
+			if err != nil {
+				// not an address list, compare the raw value
+				list = append(list, m.Header.Get(name))
+				continue
+			}
+			for _, addr := range addrs {
+				list = append(list, addr.Address)
+			}
+		}
+		return list
+	}
+	switch field {
+	case "from":
+		return func(m *RuleMessage) []string { return addresses(m, "From") }
+	case "to":
+		return func(m *RuleMessage) []string { return addresses(m, "To", "Cc") }
+	case "sender":
+		return func(m *RuleMessage) []string { return []string{m.From} }
+	case "recipient":
+		return func(m *RuleMessage) []string { return m.To }
+	case "subject":
+		name = "Subject"
+	}
+	return func(m *RuleMessage) []string {
+		var list []string
+		for _, v := range m.Header[textproto.CanonicalMIMEHeaderKey(name)] {
+			if decoded, err := new(mime.WordDecoder).DecodeHeader(v); err == nil {
+				v = decoded
+			}
+			list = append(list, v)
+		}
+		return list
+	}
+}
+
+// the comparison of a test
+func ruleMatcher(op, value string) (func(string) bool, error) {
+	lower := strings.ToLower(value)
+	switch op {
+	case "is":
+		return func(s string) bool { return strings.EqualFold(s, value) }, nil
+	case "contains":
+		return func(s string) bool { return strings.Contains(strings.ToLower(s), lower) }, nil
+	case "matches":
+		// path.Match treats / as a separator, which a subject may contain
+		pattern := strings.ReplaceAll(lower, "/", "\x00")
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", value, err)
+		}
+		return func(s string) bool {
+			ok, _ := path.Match(pattern, strings.ReplaceAll(strings.ToLower(s), "/", "\x00"))
+			return ok
+		}, nil
+	case "regex":
+		re, err := regexp.Compile(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex %q: %w", value, err)
+		}
+		return re.MatchString, nil
+	}
+	return nil, fmt.Errorf("want is, contains, matches or regex, not %q", op)
+}
+
+// 100, 100K, 10M, 1G
+func parseSize(s string) (int64, error) {
+	multiplier := int64(1)
+	switch strings.ToUpper(s[len(s)-1:]) {
+	case "K":
+		multiplier = 1 << 10
+	case "M":
+		multiplier = 1 << 20
+	case "G":
+		multiplier = 1 << 30
+	}
+	if multiplier > 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * multiplier, nil
+}
+
+func parseActions(tokens []ruleToken) ([]Action, error) {
+	var actions []Action
+	for len(tokens) > 0 {
+		if tokens[0].quoted {
+			return nil, fmt.Errorf("want an action, not %q", tokens[0].text)
+		}
+		action := Action{Type: ActionType(strings.ToLower(tokens[0].text))}
+		tokens = tokens[1:]
+		switch action.Type {
+		case ActionKeep, ActionDiscard, ActionStop:
+		case ActionFileInto, ActionForward, ActionReject, ActionWebhook:
+			if len(tokens) == 0 || !tokens[0].quoted {
+				return nil, fmt.Errorf(`%s wants a "string"`, action.Type)
+			}
+			action.Arg, tokens = tokens[0].text, tokens[1:]
+		default:
+			return nil, fmt.Errorf("unknown action %q", action.Type)
+		}
+		actions = append(actions, action)
+
+		if len(tokens) > 0 {
+			if tokens[0].text != "," || tokens[0].quoted {
+				return nil, fmt.Errorf("want , between actions, not %q", tokens[0].text)
+			}
+			tokens = tokens[1:]
+			if len(tokens) == 0 {
+				return nil, errors.New("action missing after ,")
+			}
+		}
+	}
+	if len(actions) == 0 {
+		return nil, errors.New("no action after ->")
+	}
+	return actions, nil
+}
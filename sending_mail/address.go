@@ -0,0 +1,456 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/smtp"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"internet_services/dns_lookup/resolver"
+)
+
+// how an AddressValidator judges an address
+type AddressStatus int
+
+const (
+	AddressValid   AddressStatus = iota
+	AddressInvalid               // bad syntax, no such domain, a domain that takes no mail, or the server rejected it
+	AddressRisky                 // deliverable but disposable, or the domain accepts any address
+	AddressUnknown               // could not be checked, eg. a DNS or probe timeout
+)
+
+func (s AddressStatus) String() string {
+	switch s {
+	case AddressValid:
+		return "valid"
+	case AddressInvalid:
+		return "invalid"
+	case AddressRisky:
+		return "risky"
+	case AddressUnknown:
+		return "unknown"
+	}
+	return fmt.Sprintf("AddressStatus(%d)", int(s))
+}
+
+// AddressVerdict is what an AddressValidator found out about an address
+type AddressVerdict struct {
+	Address string // with the domain in lower case
+	Status  AddressStatus
+	Reason  string // why it isn't valid
+
+	Syntax     bool     // RFC 5321 mailbox syntax
+	Domain     string   // lower case, an A-label for a Unicode domain
+	MXHosts    []string // by preference, the domain itself for an implicit MX
+	Disposable bool     // a throwaway mailbox provider
+
+	// with AddressValidator.Probe
+	Probed   bool
+	Accepted bool   // the MX accepted RCPT TO
+	CatchAll bool   // it accepted a made-up address at the domain as well
+	Reply    string // the reply to RCPT TO if it wasn't accepted
+}
+
+// Resolver is the DNS lookups address validation needs. The repo's
+// *resolver.Client satisfies it, and so does *net.Resolver for the
+// system resolver.
+type Resolver interface {
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// AddressValidator checks addresses before they go on a mailing list:
+// syntax, a domain that receives mail and, with Probe, the verdict of the
+// domain's MX, which is asked RCPT TO without sending anything.
+//
+// Probing connects to port 25, which many networks block, and servers may
+// slow down or blocklist hosts that probe a lot; it is off by default.
+type AddressValidator struct {
+	Resolver   Resolver // default a resolver.Client iterating from the root servers
+	Disposable []string // more throwaway domains besides the built-in ones
+
+	Probe     bool
+	ProbeFrom string        // MAIL FROM for probes, default the null sender
+	HeloName  string        // name announced in EHLO, default the detected one
+	Port      int           // default 25
+	Timeout   time.Duration // per probe, default 30 seconds
+}
+
+// Validate with the default AddressValidator, without probing
+func ValidateAddress(ctx context.Context, address string) AddressVerdict {
+	return AddressValidator{}.Validate(ctx, address)
+}
+
+func (v AddressValidator) Validate(ctx context.Context, address string) AddressVerdict {
+	verdict := AddressVerdict{Address: address}
+	local, domain, err := parseMailbox(address)
+	if err != nil {
+		return verdict.invalid(err.Error())
+	}
+	verdict.Syntax = true
+	verdict.Address = local + "@" + strings.ToLower(domain)
+	// DNS knows a Unicode domain by its A-label; parseMailbox checked it
+	verdict.Domain, _ = asciiDomain(strings.ToLower(domain))
+	verdict.Disposable = v.disposable(verdict.Domain)
+
+	if strings.HasPrefix(domain, "[") {
+		// an address literal needs no DNS
+		verdict.MXHosts = []string{strings.TrimPrefix(strings.Trim(domain, "[]"), "IPv6:")}
+	} else {
+		hosts, err := v.mxHosts(ctx, verdict.Domain)
+		var dnsErr *net.DNSError
+		switch {
+		case errors.As(err, &dnsErr) && dnsErr.IsNotFound:
+			return verdict.invalid("domain does not exist")
+		case errors.Is(err, errNullMX):
+			return verdict.invalid("domain does not accept mail (null MX)")
+		case err != nil:
+			verdict.Status = AddressUnknown
+			verdict.Reason = err.Error()
+			return verdict
+		}
+		verdict.MXHosts = hosts
+	}
+
+	if v.Probe {
+		v.probe(ctx, &verdict)
+		if verdict.Status != AddressValid {
+			return verdict
+		}
+	}
+	switch {
+	case verdict.Disposable:
+		verdict.Status = AddressRisky
+		verdict.Reason = "disposable address"
+	case verdict.CatchAll:
+		verdict.Status = AddressRisky
+		verdict.Reason = "the domain accepts any address"
+	}
+	return verdict
+}
+
+func (v AddressVerdict) invalid(reason string) AddressVerdict {
+	v.Status = AddressInvalid
+	v.Reason = reason
+	return v
+}
+
+// local part and domain of a bare RFC 5321 mailbox: a dot-atom or quoted
+// local part, and a host name or address literal
+func parseMailbox(address string) (local, domain string, err error) {
+	at := strings.LastIndex(address, "@")
+	if at < 0 {
+		return "", "", errors.New("no @ in address")
+	}
+	local, domain = address[:at], address[at+1:]
+	if len(address) > 254 {
+		return "", "", errors.New("address longer than 254 characters")
+	}
+	if local == "" {
+		return "", "", errors.New("empty local part")
+	}
+	if len(local) > 64 {
+		return "", "", errors.New("local part longer than 64 characters")
+	}
+	if !utf8.ValidString(local) {
+		return "", "", errors.New("local part is not valid UTF-8")
+	}
+	if strings.HasPrefix(local, `"`) {
+		if err := checkQuotedLocal(local); err != nil {
+			return "", "", err
+		}
+	} else {
+		for _, atom := range strings.Split(local, ".") {
+			if atom == "" {
+				return "", "", errors.New("empty atom in local part, leading, trailing or double dot")
+			}
+			for i := 0; i < len(atom); i++ {
+				// UTF-8 as in RFC 6531 3.3, for SMTPUTF8
+				if !isAtext(atom[i]) && atom[i] < utf8.RuneSelf {
+					return "", "", fmt.Errorf("character %q not allowed in local part", atom[i])
+				}
+			}
+		}
+	}
+
+	if strings.HasPrefix(domain, "[") {
+		return local, domain, checkAddressLiteral(domain)
+	}
+	return local, domain, checkDomainName(domain)
+}
+
+// RFC 5322 atext
+func isAtext(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+		strings.IndexByte("!#$%&'*+-/=?^_`{|}~", c) >= 0
+}
+
+func checkQuotedLocal(local string) error {
+	if len(local) < 2 || !strings.HasSuffix(local, `"`) {
+		return errors.New("unterminated quoted local part")
+	}
+	inner := local[1 : len(local)-1]
+	for i := 0; i < len(inner); i++ {
+		c := inner[i]
+		switch {
+		case c == '\\':
+			i++
+			if i == len(inner) || inner[i] < ' ' || inner[i] > '~' {
+				return errors.New("invalid escape in quoted local part")
+			}
+		case c == '"':
+			return errors.New("unescaped quote in quoted local part")
+		case c < ' ' || c == 0x7f:
+			return fmt.Errorf("character %q not allowed in quoted local part", c)
+		}
+	}
+	return nil
+}
+
+func checkAddressLiteral(domain string) error {
+	if !strings.HasSuffix(domain, "]") {
+		return errors.New("unterminated address literal")
+	}
+	literal := domain[1 : len(domain)-1]
+	if ip, ok := strings.CutPrefix(literal, "IPv6:"); ok {
+		if addr, err := netip.ParseAddr(ip); err != nil || !addr.Is6() {
+			return fmt.Errorf("invalid IPv6 address literal %q", literal)
+		}
+		return nil
+	}
+	if addr, err := netip.ParseAddr(literal); err != nil || !addr.Is4() {
+		return fmt.Errorf("invalid address literal %q", literal)
+	}
+	return nil
+}
+
+// letters, digits and hyphens, in at least two labels
+func checkDomainName(domain string) error {
+	if domain == "" {
+		return errors.New("empty domain")
+	}
+	// a Unicode domain is checked as its A-label
+	ascii, err := asciiDomain(domain)
+	if err != nil {
+		return err
+	}
+	domain = ascii
+	if len(domain) > 253 {
+		return errors.New("domain longer than 253 characters")
+	}
+	labels := strings.Split(domain, ".")
+	if len(labels) < 2 {
+		return fmt.Errorf("domain %q is not fully qualified", domain)
+	}
+	for _, label := range labels {
+		if label == "" || len(label) > 63 {
+			return fmt.Errorf("invalid domain %q", domain)
+		}
+		if label[0] == '-' || label[len(label)-1] == '-' {
+			return fmt.Errorf("domain label %q starts or ends with a hyphen", label)
+		}
+		for i := 0; i < len(label); i++ {
+			c := label[i]
+			if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-') {
+				return fmt.Errorf("character %q not allowed in domain", c)
+			}
+		}
+	}
+	if tld := labels[len(labels)-1]; strings.Trim(tld, "0123456789") == "" {
+		return fmt.Errorf("domain %q has a numeric top level domain", domain)
+	}
+	return nil
+}
+
+// throwaway mailbox providers, the widely used ones
+var disposableDomains = map[string]bool{
+	"10minutemail.com":       true,
+	"20minutemail.com":       true,
+	"discard.email":          true,
+	"dispostable.com":        true,
+	"emailondeck.com":        true,
+	"fakeinbox.com":          true,
+	"getairmail.com":         true,
+	"getnada.com":            true,
+	"guerrillamail.com":      true,
+	"guerrillamail.net":      true,
+	"guerrillamail.org":      true,
+	"guerrillamailblock.com": true,
+	"mailcatch.com":          true,
+	"maildrop.cc":            true,
+	"mailinator.com":         true,
+	"mailinator.net":         true,
+	"mailnesia.com":          true,
+	"mintemail.com":          true,
+	"mohmal.com":             true,
+	"mytemp.email":           true,
+	"sharklasers.com":        true,
+	"spamgourmet.com":        true,
+	"temp-mail.org":          true,
+	"tempail.com":            true,
+	"tempmail.net":           true,
+	"tempmailo.com":          true,
+	"throwawaymail.com":      true,
+	"trashmail.com":          true,
+	"trashmail.de":           true,
+	"yopmail.com":            true,
+	"yopmail.fr":             true,
+}
+
+// domain or one of its parents is a throwaway provider
+func (v AddressValidator) disposable(domain string) bool {
+	for {
+		if disposableDomains[domain] {
+			return true
+		}
+		for _, d := range v.Disposable {
+			if strings.EqualFold(d, domain) {
+				return true
+			}
+		}
+		_, parent, ok := strings.Cut(domain, ".")
+		if !ok || !strings.Contains(parent, ".") {
+			return false
+		}
+		domain = parent
+	}
+}
+
+var errNullMX = errors.New("null MX")
+
+// like lookupMXHosts, but a missing domain is an error instead of its own
+// implicit MX, which needs an address record
+func (v AddressValidator) mxHosts(ctx context.Context, domain string) ([]string, error) {
+	dns := v.Resolver
+	if dns == nil {
+		dns = resolver.New()
+	}
+	records, err := dns.LookupMX(ctx, domain)
+	var dnsErr *net.DNSError
+	if err != nil && !(errors.As(err, &dnsErr) && dnsErr.IsNotFound) {
+		return nil, fmt.Errorf("MX lookup failed: %w", err)
+	}
+	if len(records) == 0 {
+		// RFC 5321 5.1: no MX, the domain's own address is the implicit MX
+		if _, err := dns.LookupIPAddr(ctx, domain); err != nil {
+			return nil, err
+		}
+		return []string{domain}, nil
+	}
+
+	sort.SliceStable(records, func(i, j int) bool { return records[i].Pref < records[j].Pref })
+	hosts := make([]string, 0, len(records))
+	for _, mx := range records {
+		host := strings.TrimSuffix(mx.Host, ".")
+		if host == "" {
+			return nil, errNullMX
+		}
+		hosts = append(hosts, host)
+	}
+	return hosts, nil
+}
+
+// RCPT TO at the first MX that answers, and then a made-up address at the
+// same domain to find catch-all servers. Nothing is sent, the session ends
+// with RSET and QUIT.
+func (v AddressValidator) probe(ctx context.Context, verdict *AddressVerdict) {
+	timeout := v.Timeout
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var lastErr error
+	for _, host := range verdict.MXHosts {
+		lastErr = contextError(ctx, v.probeMX(ctx, host, verdict))
+		if lastErr == nil || ctx.Err() != nil {
+			break
+		}
+	}
+	if lastErr != nil {
+		verdict.Status = AddressUnknown
+		verdict.Reason = fmt.Sprintf("probe failed: %v", lastErr)
+	}
+}
+
+func (v AddressValidator) probeMX(ctx context.Context, host string, verdict *AddressVerdict) error {
+	port := v.Port
+	if port == 0 {
+		port = 25
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		return fmt.Errorf("failed to dial %s: %w", host, err)
+	}
+	c := &smtpClient{conn: conn}
+	defer c.watch(ctx)()
+
+	c.Client, err = smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("failed to create SMTP client: %w", err)
+	}
+	defer c.Close()
+	helo := v.HeloName
+	if helo == "" {
+		helo = detectHeloName(ctx, conn)
+	}
+	if err := c.Hello(helo); err != nil {
+		return fmt.Errorf("EHLO failed: %w", err)
+	}
+	// a UTF-8 local part can only be asked of a server with SMTPUTF8
+	rcpt, err := c.envelopeAddress(verdict.Address)
+	if err != nil {
+		return err
+	}
+	mail := "MAIL FROM:<" + v.ProbeFrom + ">"
+	if ok, _ := c.Extension("SMTPUTF8"); ok && !isASCII(verdict.Address+v.ProbeFrom) {
+		mail += " SMTPUTF8"
+	}
+	if err := c.cmd(250, mail); err != nil {
+		return fmt.Errorf("MAIL command failed: %w", err)
+	}
+
+	err = c.cmd(25, "RCPT TO:<"+rcpt+">")
+	var protoErr *textproto.Error
+	switch {
+	case err == nil:
+		verdict.Probed, verdict.Accepted = true, true
+	case errors.As(err, &protoErr) && protoErr.Code >= 500:
+		verdict.Probed = true
+		verdict.Reply = strconv.Itoa(protoErr.Code) + " " + protoErr.Msg
+		verdict.Status = AddressInvalid
+		verdict.Reason = "rejected by " + host + ": " + protoErr.Msg
+	case errors.As(err, &protoErr):
+		// greylisting or a busy server: no answer yet
+		verdict.Probed = true
+		verdict.Reply = strconv.Itoa(protoErr.Code) + " " + protoErr.Msg
+		verdict.Status = AddressUnknown
+		verdict.Reason = "deferred by " + host + ": " + protoErr.Msg
+	default:
+		return err
+	}
+
+	if verdict.Accepted {
+		random := make([]byte, 12)
+		rand.Read(random)
+		if c.cmd(25, "RCPT TO:<"+hex.EncodeToString(random)+"@"+verdict.Domain+">") == nil {
+			verdict.CatchAll = true
+		}
+	}
+	c.Reset()
+	c.Quit()
+	return nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"internet_services/dns_lookup/fakedns"
+	"internet_services/dns_lookup/resolver"
+)
+
+// a fake name server for example.com and a resolver that asks it
+func startFakeDNS(t *testing.T, records ...dnsmessage.Resource) (*fakedns.Server, *resolver.Client) {
+	t.Helper()
+	server := &fakedns.Server{IP: "127.0.0.1", Zones: []fakedns.Zone{{Origin: "example.com.", Records: append([]dnsmessage.Resource{
+		fakedns.SOA("example.com.", "ns.example.com.", 300),
+	}, records...)}}}
+	h, err := fakedns.Start(server)
+	if err != nil {
+		t.Fatalf("failed to start fake name server: %v", err)
+	}
+	t.Cleanup(h.Close)
+
+	dns := resolver.New()
+	dns.Server = server.IP
+	dns.Port = strconv.Itoa(h.Port)
+	dns.Timeout = time.Second
+	return server, dns
+}
+
+func TestValidateAddress(t *testing.T) {
+	_, dns := startFakeDNS(t,
+		fakedns.MX("example.com.", 20, "mx2.example.com.", 300),
+		fakedns.MX("example.com.", 10, "mx1.example.com.", 300),
+		fakedns.A("implicit.example.com.", "192.0.2.1", 300),
+		fakedns.MX("nullmx.example.com.", 0, ".", 300),
+	)
+	v := AddressValidator{Resolver: dns}
+
+	tests := []struct {
+		address string
+		status  AddressStatus
+		reason  string
+		mx      string // MXHosts joined
+	}{
+		{address: "user@Example.com", status: AddressValid, mx: "mx1.example.com mx2.example.com"},
+		{address: "user@implicit.example.com", status: AddressValid, mx: "implicit.example.com"},
+		{address: "user@[192.0.2.1]", status: AddressValid, mx: "192.0.2.1"},
+		{address: "user@nullmx.example.com", status: AddressInvalid, reason: "null MX"},
+		{address: "user@nope.example.com", status: AddressInvalid, reason: "domain does not exist"},
+		{address: "user@@example.com", status: AddressInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.address, func(t *testing.T) {
+			got := v.Validate(context.Background(), tt.address)
+			if got.Status != tt.status || !strings.Contains(got.Reason, tt.reason) {
+				t.Fatalf("got %s (%s), want %s (%s)", got.Status, got.Reason, tt.status, tt.reason)
+			}
+			if hosts := strings.Join(got.MXHosts, " "); hosts != tt.mx {
+				t.Errorf("MX hosts %q, want %q", hosts, tt.mx)
+			}
+		})
+	}
+}
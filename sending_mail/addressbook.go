@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/mail"
+	"strings"
+	"sync"
+)
+
+// AddressBook holds contacts and named groups of them, eg. "team-ops",
+// so an Email can name a group or a contact's nickname where an address
+// goes, mail.Address{Address: "team-ops"}, and Expand, or a sender
+// wrapped with Wrap, puts the addresses in its place. A name is anything
+// without an @; groups may hold other groups. Names ignore case.
+type AddressBook struct {
+	mu       sync.RWMutex
+	contacts map[string]mail.Address // by nickname
+	groups   map[string][]string     // members: addresses, nicknames or groups
+}
+
+type Contact struct {
+	Name     string
+	Email    string
+	Nickname string   // optional, to name the contact without its address
+	Groups   []string // the groups the contact is in
+}
+
+func NewAddressBook() *AddressBook {
+	return &AddressBook{contacts: map[string]mail.Address{}, groups: map[string][]string{}}
+}
+
+// add a contact, and it to its groups
+func (b *AddressBook) Add(c Contact) error {
+	if _, _, err := parseMailbox(c.Email); err != nil {
+		return fmt.Errorf("contact %q: invalid address %q: %w", c.Name, c.Email, err)
+	}
+	if strings.Contains(c.Nickname, "@") {
+		return fmt.Errorf("contact %q: nickname %q has an @", c.Name, c.Nickname)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if c.Nickname != "" {
+		b.contacts[strings.ToLower(c.Nickname)] = mail.Address{Name: c.Name, Address: c.Email}
+	}
+	for _, group := range c.Groups {
+		key := strings.ToLower(strings.TrimSpace(group))
+		if key != "" {
+			b.groups[key] = append(b.groups[key], mailboxString(c.Name, c.Email))
+		}
+	}
+	return nil
+}
+
+// add members to a group, creating it: addresses, "Name <address>",
+// nicknames or other groups
+func (b *AddressBook) AddGroup(name string, members ...string) error {
+	if name == "" || strings.Contains(name, "@") {
+		return fmt.Errorf("invalid group name %q", name)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	key := strings.ToLower(name)
+	b.groups[key] = append(b.groups[key], members...)
+	return nil
+}
+
+// the addresses of list, its group names and nicknames replaced by the
+// addresses they stand for; an address that comes up twice is kept once
+func (b *AddressBook) Expand(list []mail.Address) ([]mail.Address, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	var expanded []mail.Address
+	seen := map[string]bool{}
+	var errs []error
+	for _, addr := range list {
+		if err := b.expand(addr, &expanded, seen, nil); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return expanded, errors.Join(errs...)
+}
+
+// addr, or what it names, appended to out; path holds the groups being
+// expanded, to catch a group in itself. b.mu is held.
+func (b *AddressBook) expand(addr mail.Address, out *[]mail.Address, seen map[string]bool, path []string) error {
+	if strings.Contains(addr.Address, "@") {
+		if key := strings.ToLower(addr.Address); !seen[key] {
+			seen[key] = true
+			*out = append(*out, addr)
+		}
+		return nil
+	}
+	key := strings.ToLower(strings.TrimSpace(addr.Address))
+	if contact, ok := b.contacts[key]; ok {
+		return b.expand(contact, out, seen, path)
+	}
+	members, ok := b.groups[key]
+	if !ok {
+		return fmt.Errorf("%q is no address, contact or group", addr.Address)
+	}
+	for _, group := range path {
+		if group == key {
+			return fmt.Errorf("group %q contains itself", addr.Address)
+		}
+	}
+	path = append(path, key)
+	for _, member := range members {
+		parsed, err := mail.ParseAddress(member)
+		if err != nil {
+			// a name, or a bare address ParseAddress takes too
+			parsed = &mail.Address{Address: strings.TrimSpace(member)}
+		}
+		if err := b.expand(*parsed, out, seen, path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// a Middleware expanding the To, Cc and Bcc of every email; a name the
+// book doesn't know fails the send
+func (b *AddressBook) Wrap(sender EmailSender) EmailSender {
+	return HookedSender{Sender: sender, BeforeSend: func(_ context.Context, _ SMTPConfig, email *Email) error {
+		for _, list := range []*[]mail.Address{&email.To, &email.Cc, &email.Bcc} {
+			expanded, err := b.Expand(*list)
+			if err != nil {
+				return err
+			}
+			*list = expanded
+		}
+		return nil
+	}}
+}
+
+func mailboxString(name, address string) string {
+	if name == "" {
+		return address
+	}
+	return (&mail.Address{Name: name, Address: address}).String()
+}
+
+// LoadCSV adds the contacts of a CSV file with a header row naming the
+// columns: email, and any of name, nickname and groups. Groups are
+// separated by ; or ,. Other columns are ignored, so most address book
+// exports load as they are.
+func (b *AddressBook) LoadCSV(r io.Reader) error {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil {
+		return fmt.Errorf("contacts: %w", err)
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))
+		switch name {
+		case "e-mail", "email address", "e-mail address", "mail":
+			name = "email"
+		case "group", "categories":
+			name = "groups"
+		case "full name", "display name":
+			name = "name"
+		}
+		if _, ok := columns[name]; !ok {
+			columns[name] = i
+		}
+	}
+	if _, ok := columns["email"]; !ok {
+		return errors.New("contacts: no email column")
+	}
+	field := func(record []string, name string) string {
+		if i, ok := columns[name]; ok && i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("contacts: %w", err)
+		}
+		contact := Contact{
+			Name:     field(record, "name"),
+			Email:    field(record, "email"),
+			Nickname: field(record, "nickname"),
+			Groups:   strings.FieldsFunc(field(record, "groups"), func(r rune) bool { return r == ';' || r == ',' }),
+		}
+		if contact.Email == "" {
+			continue
+		}
+		if err := b.Add(contact); err != nil {
+			line, _ := reader.FieldPos(0)
+			return fmt.Errorf("contacts:%d: %w", line, err)
+		}
+	}
+}
+
+// LoadVCard adds the contacts of vCard data (RFC 6350, also 3.0): FN is
+// the name, NICKNAME the nickname, CATEGORIES the groups and the first
+// EMAIL, or the one marked preferred, the address. Cards without an
+// address are skipped.
+func (b *AddressBook) LoadVCard(r io.Reader) error {
+	var contact *Contact
+	preferred := false
+	lines, err := unfoldVCard(r)
+	if err != nil {
+		return fmt.Errorf("vcard: %w", err)
+	}
+	for n, line := range lines {
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		params := strings.Split(name, ";")
+		property := strings.ToUpper(params[0])
+		if dot := strings.LastIndexByte(property, '.'); dot >= 0 {
+			// grouped, item1.EMAIL
+			property = property[dot+1:]
+		}
+		switch {
+		case property == "BEGIN" && strings.EqualFold(value, "VCARD"):
+			contact, preferred = &Contact{}, false
+		case contact == nil:
+		case property == "END" && strings.EqualFold(value, "VCARD"):
+			if contact.Email != "" {
+				if err := b.Add(*contact); err != nil {
+					return fmt.Errorf("vcard:%d: %w", n+1, err)
+				}
+			}
+			contact = nil
+		case property == "FN":
+			contact.Name = unescapeVCard(value)
+		case property == "NICKNAME":
+			// the first of a list
+			contact.Nickname = strings.TrimSpace(splitVCard(value)[0])
+		case property == "CATEGORIES":
+			contact.Groups = append(contact.Groups, splitVCard(value)...)
+		case property == "EMAIL":
+			// PREF=1 in 4.0, TYPE=PREF in 3.0
+			pref := strings.Contains(strings.ToUpper(strings.Join(params[1:], ";")), "PREF")
+			if contact.Email == "" || pref && !preferred {
+				contact.Email = strings.TrimSpace(unescapeVCard(value))
+				preferred = pref
+			}
+		}
+	}
+	return nil
+}
+
+// the logical lines of vCard data, folded lines joined (RFC 6350 3.2)
+func unfoldVCard(r io.Reader) ([]string, error) {
+	var lines []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines, scanner.Err()
+}
+
+// a comma separated vCard value split and unescaped
+func splitVCard(value string) []string {
+	var parts []string
+	var part strings.Builder
+	for i := 0; i < len(value); i++ {
+		switch {
+		case value[i] == '\\' && i+1 < len(value):
+			i++
+			part.WriteString(unescapeVCard(value[i-1 : i+1]))
+		case value[i] == ',':
+			parts = append(parts, part.String())
+			part.Reset()
+		default:
+			part.WriteByte(value[i])
+		}
+	}
+	return append(parts, part.String())
+}
+
+func unescapeVCard(value string) string {
+	return strings.NewReplacer(`\n`, "\n", `\N`, "\n", `\,`, ",", `\;`, ";", `\\`, `\`).Replace(value)
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"internet_services/sending_mail/dkim"
+)
+
+// Archiver keeps an exact copy of every message a server accepted, the
+// bytes as they went over the wire: encoded, DKIM signed and, with S/MIME
+// or PGP, encrypted, to settle what was really sent. Set one as
+// SMTPConfig.Archive. ArchiveDir keeps the copies in a directory,
+// S3Archive in an S3 compatible bucket. The message is out by the time
+// Archive is called, a failure is only logged.
+type Archiver interface {
+	Archive(ctx context.Context, record ArchiveRecord, msg []byte) error
+}
+
+// what the index of an archive says about one copy
+type ArchiveRecord struct {
+	ID        string    `json:"id"` // unique, and the name of the copy
+	Time      time.Time `json:"time"`
+	Server    string    `json:"server"` // the address it went to
+	From      string    `json:"from"`   // MAIL FROM
+	To        []string  `json:"to"`     // the recipients the server accepted
+	Rejected  []string  `json:"rejected,omitempty"`
+	QueueID   string    `json:"queue_id,omitempty"` // the server's, from its reply
+	MessageID string    `json:"message_id,omitempty"`
+	DKIM      []string  `json:"dkim,omitempty"` // the signatures, as domain/selector
+	Size      int       `json:"size"`
+	SHA256    string    `json:"sha256"` // hex, of the copy, to show it is unchanged
+}
+
+func newArchiveRecord(env envelope, results []RecipientResult, receipt Receipt, msg []byte) (ArchiveRecord, error) {
+	id, err := newQueueID()
+	if err != nil {
+		return ArchiveRecord{}, err
+	}
+	sum := sha256.Sum256(msg)
+	record := ArchiveRecord{
+		ID:      id,
+		Time:    time.Now().UTC(),
+		Server:  receipt.Server,
+		From:    env.From,
+		QueueID: receipt.QueueID,
+		Size:    len(msg),
+		SHA256:  hex.EncodeToString(sum[:]),
+	}
+	for _, r := range results {
+		if r.Status == Accepted {
+			record.To = append(record.To, r.Address)
+		} else {
+			record.Rejected = append(record.Rejected, r.Address)
+		}
+	}
+	if parsed, err := mail.ReadMessage(bytes.NewReader(msg)); err == nil {
+		record.MessageID = parsed.Header.Get("Message-Id")
+		for _, field := range parsed.Header["Dkim-Signature"] {
+			if tags, err := dkim.ParseTagList(field); err == nil {
+				record.DKIM = append(record.DKIM, tags["d"]+"/"+tags["s"])
+			}
+		}
+	}
+	return record, nil
+}
+
+// archive the message c just sent; the send has succeeded whatever
+// happens here
+func (c *smtpClient) archiveCopy(env envelope, results []RecipientResult, receipt Receipt, msg []byte) {
+	record, err := newArchiveRecord(env, results, receipt, msg)
+	if err == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		err = c.archive.Archive(ctx, record, msg)
+		cancel()
+	}
+	if err != nil {
+		log.Printf("archive: message from <%s> to %v: %v", env.From, env.To, err)
+	}
+}
+
+// a day's copies together, 2006/01/02/id
+func archiveName(record ArchiveRecord) string {
+	return record.Time.Format("2006/01/02") + "/" + record.ID
+}
+
+// ArchiveDir keeps the copies as .eml files in dated directories under
+// Dir, 2006/01/02/id.eml, and a record of each in Dir/index.jsonl, one
+// JSON object per line.
+type ArchiveDir struct {
+	Dir string
+
+	mu sync.Mutex // for the index
+}
+
+func (a *ArchiveDir) Archive(_ context.Context, record ArchiveRecord, msg []byte) error {
+	name := filepath.FromSlash(archiveName(record)) + ".eml"
+	file := filepath.Join(a.Dir, name)
+	if err := os.MkdirAll(filepath.Dir(file), 0o700); err != nil {
+		return fmt.Errorf("failed to create archive directory: %w", err)
+	}
+	tmp := filepath.Join(filepath.Dir(file), "."+record.ID+".tmp")
+	err := writeFileAtomic(tmp, file, func(w io.Writer) error {
+		_, err := w.Write(msg)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write archive copy: %w", err)
+	}
+
+	line, err := json.Marshal(struct {
+		ArchiveRecord
+		File string `json:"file"`
+	}{record, filepath.ToSlash(name)})
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	index, err := os.OpenFile(filepath.Join(a.Dir, "index.jsonl"), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open archive index: %w", err)
+	}
+	_, err = index.Write(append(line, '\n'))
+	if closeErr := index.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write archive index: %w", err)
+	}
+	return nil
+}
+
+// S3Archive keeps the copies in a bucket of Amazon S3 or a compatible
+// store such as MinIO: Prefix+"2006/01/02/id.eml" for the message and
+// Prefix+"index/2006/01/02/id.json" for its record, so listing the index
+// prefix of a day lists what was sent that day. Requests are signed with
+// AWS Signature Version 4 and address the bucket by path,
+// Endpoint/Bucket/key.
+type S3Archive struct {
+	Endpoint     string // eg. https://s3.eu-central-1.amazonaws.com or http://minio:9000
+	Region       string // default us-east-1
+	Bucket       string
+	Prefix       string // eg. "mail/"
+	AccessKey    string
+	SecretKey    string
+	SessionToken string       // for temporary credentials
+	Client       *http.Client // default http.DefaultClient
+}
+
+func (a S3Archive) Archive(ctx context.Context, record ArchiveRecord, msg []byte) error {
+	name := a.Prefix + archiveName(record)
+	if err := a.put(ctx, name+".eml", "message/rfc822", msg); err != nil {
+		return err
+	}
+	index, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return a.put(ctx, a.Prefix+"index/"+archiveName(record)+".json", "application/json", index)
+}
+
+func (a S3Archive) put(ctx context.Context, key, contentType string, body []byte) error {
+	endpoint, err := url.Parse(strings.TrimSuffix(a.Endpoint, "/"))
+	if err != nil {
+		return fmt.Errorf("invalid S3 endpoint: %w", err)
+	}
+	endpoint.Path = path.Join(endpoint.Path, a.Bucket, key)
+	endpoint.RawPath = s3Escape(endpoint.Path)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, endpoint.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	a.sign(req, body, time.Now().UTC())
+
+	client := a.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("S3 upload of %s failed: %w", key, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("S3 upload of %s failed: %s: %s", key, resp.Status, strings.TrimSpace(string(detail)))
+	}
+	return nil
+}
+
+// the Authorization header of AWS Signature Version 4, with the payload
+// hash signed as well
+func (a S3Archive) sign(req *http.Request, body []byte, now time.Time) {
+	region := a.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+	payloadHash := sha256.Sum256(body)
+	stamp := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", stamp)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+	if a.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", a.SessionToken)
+	}
+
+	signed := map[string]string{"host": req.URL.Host}
+	for key, values := range req.Header {
+		if lower := strings.ToLower(key); strings.HasPrefix(lower, "x-amz-") {
+			signed[lower] = strings.TrimSpace(values[0])
+		}
+	}
+	names := make([]string, 0, len(signed))
+	for name := range signed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var headers strings.Builder
+	for _, name := range names {
+		headers.WriteString(name + ":" + signed[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		headers.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+	canonicalHash := sha256.Sum256([]byte(canonical))
+	scope := day + "/" + region + "/s3/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + stamp + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+
+	key := []byte("AWS4" + a.SecretKey)
+	for _, part := range []string{day, region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		a.AccessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// a path escaped as S3 signs it: everything but the unreserved characters
+// of RFC 3986 and the slashes
+func s3Escape(p string) string {
+	var b strings.Builder
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.IndexByte("-_.~/", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
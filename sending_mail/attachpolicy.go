@@ -0,0 +1,203 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// what AttachmentPolicy does with an attachment whose extension is blocked
+type BlockedAction int
+
+const (
+	BlockReject BlockedAction = iota // fail the send with an error
+	BlockZip                         // put it in the zip archive
+	BlockWarn                        // log a warning and send it as it is
+)
+
+// the extensions Gmail refuses, also inside archives, and most other
+// providers with it
+var DefaultBlockedExtensions = []string{
+	".ade", ".adp", ".apk", ".appx", ".appxbundle", ".bat", ".cab", ".chm", ".cmd", ".com", ".cpl",
+	".diagcab", ".diagcfg", ".diagpack", ".dll", ".dmg", ".ex", ".ex_", ".exe", ".hta", ".img", ".ins",
+	".iso", ".isp", ".jar", ".jnlp", ".js", ".jse", ".lib", ".lnk", ".mde", ".msc", ".msi", ".msix",
+	".msixbundle", ".msp", ".mst", ".nsh", ".pif", ".ps1", ".scr", ".sct", ".shb", ".sys", ".vb", ".vbe",
+	".vbs", ".vhd", ".vxd", ".wsc", ".wsf", ".wsh", ".xll",
+}
+
+// AttachmentPolicy checks and reshapes the attachments of an email before
+// it is sent, so a provider doesn't refuse it halfway through the send:
+// blocked extensions, many files that go better in one zip, and a size
+// limit. Use Apply directly or Wrap a sender with it.
+type AttachmentPolicy struct {
+	// limit of the attachments together, inline images included, after
+	// zipping; 0 for none. Base64 makes them a third bigger on the wire,
+	// so 18 MB of attachments is about what a 25 MB limit allows.
+	MaxTotal int64
+
+	// bundle the attachments, inline images aside, into one zip archive
+	// when there are two or more
+	Zip     bool
+	ZipName string // default "attachments.zip"
+
+	Blocked       []string // extensions such as ".exe", nil for DefaultBlockedExtensions
+	BlockedAction BlockedAction
+}
+
+// the error of a send AttachmentPolicy stopped
+type AttachmentError struct {
+	Filename string // the blocked attachment, empty for the size limit
+	Size     int64  // total size of the attachments, for the size limit
+	Limit    int64
+}
+
+func (e *AttachmentError) Error() string {
+	if e.Filename != "" {
+		return fmt.Sprintf("attachment %s: file type is blocked by most mail providers", e.Filename)
+	}
+	return fmt.Sprintf("attachments of %d bytes exceed the limit of %d", e.Size, e.Limit)
+}
+
+// never: the attachments are refused again, see IsTransient
+func (e *AttachmentError) Temporary() bool {
+	return false
+}
+
+// the email with the policy applied; its attachments slice is a new one
+func (p AttachmentPolicy) Apply(email Email) (Email, error) {
+	var keep, bundle []Attachment
+	for _, att := range email.Attachments {
+		toZip := p.Zip && !att.Inline
+		if p.blocked(att.Filename) {
+			switch p.BlockedAction {
+			case BlockReject:
+				return email, &AttachmentError{Filename: att.Filename}
+			case BlockZip:
+				toZip = true
+			case BlockWarn:
+				log.Printf("attachment %s: file type is blocked by most mail providers, sending it anyway", att.Filename)
+			}
+		}
+		if toZip {
+			bundle = append(bundle, att)
+		} else {
+			keep = append(keep, att)
+		}
+	}
+
+	// a single attachment is only zipped when it has to be
+	if len(bundle) == 1 && !p.blocked(bundle[0].Filename) {
+		keep, bundle = append(keep, bundle[0]), nil
+	}
+	if len(bundle) > 0 {
+		archive, err := p.zip(bundle)
+		if err != nil {
+			return email, err
+		}
+		keep = append(keep, archive)
+	}
+
+	if p.MaxTotal > 0 {
+		var total int64
+		for _, att := range keep {
+			total += int64(len(att.Data))
+		}
+		if total > p.MaxTotal {
+			return email, &AttachmentError{Size: total, Limit: p.MaxTotal}
+		}
+	}
+	email.Attachments = keep
+	return email, nil
+}
+
+// a Middleware applying the policy to every email
+func (p AttachmentPolicy) Wrap(sender EmailSender) EmailSender {
+	return HookedSender{Sender: sender, BeforeSend: func(_ context.Context, _ SMTPConfig, email *Email) error {
+		applied, err := p.Apply(*email)
+		if err != nil {
+			return err
+		}
+		*email = applied
+		return nil
+	}}
+}
+
+func (p AttachmentPolicy) blocked(filename string) bool {
+	list := p.Blocked
+	if list == nil {
+		list = DefaultBlockedExtensions
+	}
+	ext := strings.ToLower(path.Ext(filename))
+	for _, blocked := range list {
+		if ext == strings.ToLower(blocked) {
+			return true
+		}
+	}
+	return false
+}
+
+// one zip of the attachments; files that are compressed already are
+// stored as they are, the rest deflated
+func (p AttachmentPolicy) zip(atts []Attachment) (Attachment, error) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	seen := map[string]int{}
+	now := time.Now()
+	for i, att := range atts {
+		name := att.Filename
+		if name == "" {
+			name = "attachment-" + strconv.Itoa(i+1)
+		}
+		name = path.Base(strings.ReplaceAll(name, `\`, "/"))
+		// two files of the same name can't both be extracted
+		key := strings.ToLower(name)
+		if n := seen[key]; n > 0 {
+			ext := path.Ext(name)
+			name = fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(name, ext), n+1, ext)
+		}
+		seen[key]++
+
+		method := zip.Deflate
+		if compressedType(att.contentType(), name) {
+			method = zip.Store
+		}
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: method, Modified: now})
+		if err != nil {
+			return Attachment{}, fmt.Errorf("failed to zip attachments: %w", err)
+		}
+		if _, err := w.Write(att.Data); err != nil {
+			return Attachment{}, fmt.Errorf("failed to zip attachments: %w", err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return Attachment{}, fmt.Errorf("failed to zip attachments: %w", err)
+	}
+
+	name := p.ZipName
+	if name == "" {
+		name = "attachments.zip"
+	}
+	return Attachment{Filename: name, ContentType: "application/zip", Data: buf.Bytes()}, nil
+}
+
+// deflate wouldn't make these any smaller
+func compressedType(contentType, filename string) bool {
+	mediaType, _, _ := strings.Cut(strings.ToLower(contentType), ";")
+	switch strings.TrimSpace(mediaType) {
+	case "image/jpeg", "image/png", "image/gif", "image/webp", "application/zip", "application/gzip",
+		"application/x-7z-compressed", "application/vnd.rar", "audio/mpeg", "video/mp4":
+		return true
+	}
+	switch strings.ToLower(path.Ext(filename)) {
+	case ".jpg", ".jpeg", ".png", ".gif", ".webp", ".zip", ".gz", ".tgz", ".7z", ".rar", ".mp3", ".mp4",
+		".docx", ".xlsx", ".pptx", ".odt", ".ods":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/smtp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// picks the SASL mechanism and credentials for a connection
+type Authenticator interface {
+	Auth(host string) (smtp.Auth, error)
+}
+
+// username and password, the default when SMTPConfig.Auth is nil. The
+// mechanism is picked from what the server advertises in EHLO unless
+// Mechanism forces one.
+type PasswordAuthenticator struct {
+	Username  string
+	Password  string
+	Mechanism string // CRAM-MD5, PLAIN or LOGIN, empty to negotiate
+}
+
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// strongest first, PLAIN and LOGIN are equally weak but PLAIN is the
+// standardized one
+var passwordMechanisms = []string{"CRAM-MD5", "PLAIN", "LOGIN"}
+
+func (p PasswordAuthenticator) Auth(host string) (smtp.Auth, error) {
+	if p.Mechanism != "" && !containsFold(passwordMechanisms, p.Mechanism) {
+		return nil, fmt.Errorf("unsupported auth mechanism %q (want %s)", p.Mechanism, strings.Join(passwordMechanisms, ", "))
+	}
+	return &passwordAuth{PasswordAuthenticator: p, host: host}, nil
+}
+
+// decides on the mechanism once the server's list is known
+type passwordAuth struct {
+	PasswordAuthenticator
+	host   string
+	chosen smtp.Auth
+}
+
+func (a *passwordAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	mechanism := strings.ToUpper(a.Mechanism)
+	if mechanism == "" {
+		for _, candidate := range passwordMechanisms {
+			if containsFold(server.Auth, candidate) {
+				mechanism = candidate
+				break
+			}
+		}
+		if mechanism == "" {
+			return "", nil, fmt.Errorf("server offers none of %s (offers %s)",
+				strings.Join(passwordMechanisms, ", "), strings.Join(server.Auth, ", "))
+		}
+	}
+
+	switch mechanism {
+	case "CRAM-MD5":
+		a.chosen = smtp.CRAMMD5Auth(a.Username, a.Password)
+	case "PLAIN":
+		a.chosen = smtp.PlainAuth("", a.Username, a.Password, a.host)
+	default:
+		a.chosen = &loginAuth{username: a.Username, password: a.Password, host: a.host}
+	}
+	return a.chosen.Start(server)
+}
+
+func (a *passwordAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	return a.chosen.Next(fromServer, more)
+}
+
+// the non-standard but widespread LOGIN mechanism: username and password
+// in answer to "Username:" and "Password:" prompts
+type loginAuth struct {
+	username string
+	password string
+	host     string
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS && !isLocalhost(a.host) {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	return "LOGIN", nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	switch strings.ToLower(strings.TrimSpace(string(fromServer))) {
+	case "username:", "user name":
+		return []byte(a.username), nil
+	case "password:":
+		return []byte(a.password), nil
+	}
+	return nil, fmt.Errorf("unexpected LOGIN challenge %q", fromServer)
+}
+
+func isLocalhost(host string) bool {
+	return host == "localhost" || host == "127.0.0.1" || host == "::1"
+}
+
+// XOAUTH2 bearer tokens as used by Gmail and Microsoft 365. Refresh is
+// called whenever the cached token is missing, about to expire, or was
+// rejected by the server.
+type XOAuth2 struct {
+	Username string
+	Refresh  func() (token string, expiry time.Time, err error)
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+func (x *XOAuth2) Auth(host string) (smtp.Auth, error) {
+	token, err := x.currentToken()
+	if err != nil {
+		return nil, err
+	}
+	return &xoauth2Auth{owner: x, username: x.Username, token: token, host: host}, nil
+}
+
+func (x *XOAuth2) currentToken() (string, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	// refresh a minute early so the token doesn't expire mid-session
+	if x.token != "" && time.Until(x.expiry) > time.Minute {
+		return x.token, nil
+	}
+	if x.Refresh == nil {
+		return "", errors.New("XOAUTH2: no token refresh callback")
+	}
+	token, expiry, err := x.Refresh()
+	if err != nil {
+		return "", err
+	}
+	x.token, x.expiry = token, expiry
+	return token, nil
+}
+
+func (x *XOAuth2) invalidate() {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.token = ""
+}
+
+type xoauth2Auth struct {
+	owner    *XOAuth2
+	username string
+	token    string
+	host     string
+}
+
+func (a *xoauth2Auth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	// same rule as net/smtp's PLAIN: never hand out the token unencrypted
+	if !server.TLS && !isLocalhost(a.host) {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	resp := "user=" + a.username + "\x01auth=Bearer " + a.token + "\x01\x01"
+	return "XOAUTH2", []byte(resp), nil
+}
+
+// on failure the server sends a JSON error as a challenge and expects an
+// empty response before the final error reply
+func (a *xoauth2Auth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if more {
+		a.owner.invalidate()
+		return []byte{}, nil
+	}
+	return nil, nil
+}
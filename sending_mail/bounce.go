@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"strconv"
+	"strings"
+
+	"internet_services/receiving_mail/message"
+)
+
+// a parsed RFC 3464 delivery status notification
+type Bounce struct {
+	EnvelopeID   string // ENVID of the original message, see DSNOptions
+	ReportingMTA string
+	Recipients   []BounceRecipient
+}
+
+type BounceRecipient struct {
+	Address    string // Original-Recipient if given, Final-Recipient otherwise
+	Action     string // failed, delayed, delivered, relayed or expanded
+	Status     string // RFC 3463 status, eg. 5.1.1
+	Code       int    // SMTP reply code from Diagnostic-Code, 0 if there is none
+	Diagnostic string
+}
+
+// a failure that won't go away by itself, the address should be suppressed
+func (r BounceRecipient) Permanent() bool {
+	return r.Action == "failed" || strings.HasPrefix(r.Status, "5.")
+}
+
+// the recipients the message could not be delivered to
+func (b *Bounce) Failed() []BounceRecipient {
+	var failed []BounceRecipient
+	for _, r := range b.Recipients {
+		if r.Permanent() {
+			failed = append(failed, r)
+		}
+	}
+	return failed
+}
+
+var ErrNotBounce = errors.New("not a delivery status notification")
+
+// parse a bounce message: the multipart/report with its message/delivery-status
+// part, also when it is wrapped in another multipart
+func ParseBounce(r io.Reader) (*Bounce, error) {
+	msg, err := mail.ReadMessage(r)
+	if err != nil {
+		return nil, err
+	}
+	status, err := findDeliveryStatus(textproto.MIMEHeader(msg.Header), msg.Body)
+	if err != nil {
+		return nil, err
+	}
+	if status == nil {
+		return nil, ErrNotBounce
+	}
+	return parseDeliveryStatus(status)
+}
+
+// the decoded delivery-status part, nil if there is none
+func findDeliveryStatus(header textproto.MIMEHeader, body io.Reader) (io.Reader, error) {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		return nil, nil
+	}
+	body = message.DecodeTransfer(header.Get("Content-Transfer-Encoding"), body)
+
+	switch {
+	case mediaType == "message/delivery-status", mediaType == "message/global-delivery-status":
+		return body, nil
+	case strings.HasPrefix(mediaType, "multipart/"):
+		reader := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := reader.NextPart()
+			if err == io.EOF {
+				return nil, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			status, err := findDeliveryStatus(part.Header, part)
+			if status != nil || err != nil {
+				return status, err
+			}
+		}
+	}
+	return nil, nil
+}
+
+// the per-message fields, then one block of fields per recipient, each
+// block ended by a blank line
+func parseDeliveryStatus(r io.Reader) (*Bounce, error) {
+	reader := textproto.NewReader(bufio.NewReader(r))
+	perMessage, err := reader.ReadMIMEHeader()
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	bounce := &Bounce{
+		EnvelopeID:   perMessage.Get("Original-Envelope-Id"),
+		ReportingMTA: typedValue(perMessage.Get("Reporting-Mta")),
+	}
+
+	for err != io.EOF {
+		var fields textproto.MIMEHeader
+		fields, err = reader.ReadMIMEHeader()
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if len(fields) == 0 {
+			continue
+		}
+
+		rcpt := BounceRecipient{
+			Address:    typedValue(fields.Get("Original-Recipient")),
+			Action:     strings.ToLower(strings.TrimSpace(fields.Get("Action"))),
+			Status:     strings.TrimSpace(fields.Get("Status")),
+			Diagnostic: typedValue(fields.Get("Diagnostic-Code")),
+		}
+		if rcpt.Address == "" {
+			rcpt.Address = typedValue(fields.Get("Final-Recipient"))
+		}
+		if code, _, ok := strings.Cut(rcpt.Diagnostic, " "); ok {
+			rcpt.Code, _ = strconv.Atoi(code)
+		}
+		bounce.Recipients = append(bounce.Recipients, rcpt)
+	}
+
+	if len(bounce.Recipients) == 0 {
+		return nil, ErrNotBounce
+	}
+	return bounce, nil
+}
+
+// "rfc822; user@example.com" without the type
+func typedValue(field string) string {
+	if _, value, ok := strings.Cut(field, ";"); ok {
+		return strings.TrimSpace(value)
+	}
+	return strings.TrimSpace(field)
+}
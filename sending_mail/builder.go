@@ -0,0 +1,247 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"net/textproto"
+	"regexp"
+	"strings"
+)
+
+// EmailBuilder puts an Email together step by step and checks the result
+// in Build, where a struct literal would only fail once it is sent:
+//
+//	email, err := NewEmail().
+//		From("Sender <sender@example.com>").
+//		To("john@example.com", "Doe <doe@example.com>").
+//		Subject("Report").
+//		HTML(html).Text(text).
+//		AttachFile("report.pdf").
+//		Header("Reply-To", "support@example.com").
+//		Build()
+//
+// Errors of the steps, such as an address that doesn't parse or a file
+// that can't be read, are kept and returned by Build together.
+type EmailBuilder struct {
+	email Email
+	errs  []error
+}
+
+func NewEmail() *EmailBuilder {
+	return &EmailBuilder{}
+}
+
+// the sender, "Name <address>" or a bare address
+func (b *EmailBuilder) From(address string) *EmailBuilder {
+	if addr, ok := b.parse("From", address); ok {
+		b.email.From = addr
+	}
+	return b
+}
+
+func (b *EmailBuilder) To(addresses ...string) *EmailBuilder {
+	b.email.To = append(b.email.To, b.parseList("To", addresses)...)
+	return b
+}
+
+func (b *EmailBuilder) Cc(addresses ...string) *EmailBuilder {
+	b.email.Cc = append(b.email.Cc, b.parseList("Cc", addresses)...)
+	return b
+}
+
+func (b *EmailBuilder) Bcc(addresses ...string) *EmailBuilder {
+	b.email.Bcc = append(b.email.Bcc, b.parseList("Bcc", addresses)...)
+	return b
+}
+
+func (b *EmailBuilder) Subject(subject string) *EmailBuilder {
+	b.email.Subject = subject
+	return b
+}
+
+// the html body
+func (b *EmailBuilder) HTML(html string) *EmailBuilder {
+	b.email.Body = html
+	return b
+}
+
+// the plain text body, or alternative to the html one
+func (b *EmailBuilder) Text(text string) *EmailBuilder {
+	b.email.TextBody = text
+	return b
+}
+
+func (b *EmailBuilder) Attach(atts ...Attachment) *EmailBuilder {
+	b.email.Attachments = append(b.email.Attachments, atts...)
+	return b
+}
+
+// attach a file, see NewAttachmentFromFile
+func (b *EmailBuilder) AttachFile(path string) *EmailBuilder {
+	att, err := NewAttachmentFromFile(path)
+	if err != nil {
+		b.errs = append(b.errs, fmt.Errorf("attachment %s: %w", path, err))
+		return b
+	}
+	return b.Attach(att)
+}
+
+// an image for the html body, shown with <img src="cid:contentID">
+func (b *EmailBuilder) InlineFile(path, contentID string) *EmailBuilder {
+	att, err := NewInlineAttachmentFromFile(path, contentID)
+	if err != nil {
+		b.errs = append(b.errs, fmt.Errorf("inline image %s: %w", path, err))
+		return b
+	}
+	return b.Attach(att)
+}
+
+// an extra header field; a second value for the same name replaces the
+// first. The addresses, the subject and the MIME structure have their own
+// methods and can't be set here.
+func (b *EmailBuilder) Header(name, value string) *EmailBuilder {
+	switch key := textproto.CanonicalMIMEHeaderKey(name); {
+	case key == "From" || key == "To" || key == "Cc" || key == "Bcc" || key == "Subject":
+		b.errs = append(b.errs, fmt.Errorf("header %s: use the %s method", name, key))
+		return b
+	case key == "Mime-Version" || strings.HasPrefix(key, "Content-"):
+		b.errs = append(b.errs, fmt.Errorf("header %s: set by the message writer", name))
+		return b
+	}
+	if b.email.Headers == nil {
+		b.email.Headers = map[string]string{}
+	}
+	// Headers keys are matched case-insensitively when the message is written
+	for existing := range b.email.Headers {
+		if strings.EqualFold(existing, name) {
+			delete(b.email.Headers, existing)
+		}
+	}
+	b.email.Headers[name] = value
+	return b
+}
+
+// the MAIL FROM address, where bounces go
+func (b *EmailBuilder) EnvelopeFrom(address string) *EmailBuilder {
+	b.email.EnvelopeFrom = address
+	return b
+}
+
+// ask for a read receipt to address, see Email.ReadReceipt
+func (b *EmailBuilder) ReadReceipt(address string) *EmailBuilder {
+	if addr, ok := b.parse("Disposition-Notification-To", address); ok {
+		b.email.ReadReceipt = &addr
+	}
+	return b
+}
+
+// X-Priority and Importance, see Email.Priority
+func (b *EmailBuilder) Priority(p Priority) *EmailBuilder {
+	b.email.Priority = p
+	return b
+}
+
+// the Sensitivity header field, see Email.Sensitivity
+func (b *EmailBuilder) Sensitivity(s Sensitivity) *EmailBuilder {
+	b.email.Sensitivity = s
+	return b
+}
+
+// the email, or every problem found in it: the errors of the earlier
+// steps, a missing sender or recipients, addresses that aren't valid
+// mailboxes, inline images the html doesn't fit, and whatever
+// Email.Validate rejects
+func (b *EmailBuilder) Build() (Email, error) {
+	errs := append([]error(nil), b.errs...)
+	email := b.email
+
+	if email.From.Address == "" {
+		errs = append(errs, errors.New("no sender, see From"))
+	}
+	if len(email.To)+len(email.Cc)+len(email.Bcc) == 0 {
+		errs = append(errs, errors.New("no recipients, see To, Cc and Bcc"))
+	}
+	if email.EnvelopeFrom != "" {
+		if _, _, err := parseMailbox(email.EnvelopeFrom); err != nil {
+			errs = append(errs, fmt.Errorf("EnvelopeFrom: invalid address %q: %w", email.EnvelopeFrom, err))
+		}
+	}
+	if email.Body == "" && email.TextBody == "" && email.Invite == nil {
+		errs = append(errs, errors.New("no body, see HTML and Text"))
+	}
+	errs = append(errs, checkInline(email)...)
+
+	if err := email.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := errors.Join(errs...); err != nil {
+		return Email{}, err
+	}
+	return email, nil
+}
+
+func (b *EmailBuilder) parse(field, address string) (mail.Address, bool) {
+	addr, err := mail.ParseAddress(address)
+	if err != nil {
+		b.errs = append(b.errs, fmt.Errorf("%s: invalid address %q: %w", field, address, err))
+		return mail.Address{}, false
+	}
+	// ParseAddress takes some forms SMTP doesn't, eg. comments in the domain
+	if _, _, err := parseMailbox(addr.Address); err != nil {
+		b.errs = append(b.errs, fmt.Errorf("%s: invalid address %q: %w", field, address, err))
+		return mail.Address{}, false
+	}
+	return *addr, true
+}
+
+// each argument may be a single address or a comma separated list
+func (b *EmailBuilder) parseList(field string, addresses []string) []mail.Address {
+	var list []mail.Address
+	for _, address := range addresses {
+		addrs, err := mail.ParseAddressList(address)
+		if err != nil {
+			b.errs = append(b.errs, fmt.Errorf("%s: invalid address %q: %w", field, address, err))
+			continue
+		}
+		for _, addr := range addrs {
+			if _, _, err := parseMailbox(addr.Address); err != nil {
+				b.errs = append(b.errs, fmt.Errorf("%s: invalid address %q: %w", field, addr.Address, err))
+				continue
+			}
+			list = append(list, *addr)
+		}
+	}
+	return list
+}
+
+var cidReference = regexp.MustCompile(`(?i)["'(]cid:([^"')\s]+)`)
+
+// inline images only work in an html body that refers to them, by a
+// Content-ID no other image has; a reference to none shows a broken image
+func checkInline(email Email) []error {
+	var errs []error
+	ids := map[string]bool{}
+	for _, att := range email.Attachments {
+		if !att.Inline {
+			continue
+		}
+		switch id := strings.ToLower(att.ContentID); {
+		case id == "":
+			errs = append(errs, fmt.Errorf("inline attachment %s: no content ID", att.Filename))
+		case ids[id]:
+			errs = append(errs, fmt.Errorf("inline attachment %s: content ID %q used twice", att.Filename, att.ContentID))
+		default:
+			ids[id] = true
+		}
+	}
+	if len(ids) > 0 && email.Body == "" {
+		errs = append(errs, errors.New("inline attachments without an html body to show them"))
+	}
+	for _, m := range cidReference.FindAllStringSubmatch(email.Body, -1) {
+		if !ids[strings.ToLower(m[1])] {
+			errs = append(errs, fmt.Errorf("html refers to cid:%s, which no inline attachment has", m[1]))
+		}
+	}
+	return errs
+}
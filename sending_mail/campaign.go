@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Campaign sends a templated message to a list of recipients, one
+// personalized copy each. With a StateFile every result is recorded as it
+// happens, so a campaign run again after a crash or a cancel skips the
+// recipients that were already accepted or permanently rejected and retries
+// only the rest.
+type Campaign struct {
+	Template   TemplatedEmail
+	Recipients []TemplateRecipient
+	Sender     EmailSender // default a PooledSender
+	Config     SMTPConfig
+
+	PerMinute   int    // messages per minute across all workers, 0 for no limit
+	Concurrency int    // parallel sends, default 4
+	StateFile   string // per-recipient results as JSON lines, empty to keep them in memory only
+
+	// called after every recipient, never concurrently
+	Progress func(CampaignProgress)
+}
+
+type CampaignProgress struct {
+	Total    int
+	Accepted int
+	Rejected int
+	Deferred int
+	Last     RecipientResult
+}
+
+// send to every recipient that doesn't have a final result yet and return
+// all results, in recipient order. Rendering and delivery failures end up
+// in the results, the error is for the campaign itself.
+func (c *Campaign) Run(ctx context.Context) ([]RecipientResult, error) {
+	state, err := c.loadState()
+	if err != nil {
+		return nil, err
+	}
+	var stateFile *os.File
+	if c.StateFile != "" {
+		stateFile, err = os.OpenFile(c.StateFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open campaign state: %w", err)
+		}
+		defer stateFile.Close()
+	}
+
+	sender := c.Sender
+	if sender == nil {
+		pooled := &PooledSender{}
+		defer pooled.Close()
+		sender = pooled
+	}
+	concurrency := c.Concurrency
+	if concurrency <= 0 {
+		concurrency = 4
+	}
+
+	// one tick per message, shared by the workers
+	var ticks <-chan time.Time
+	if c.PerMinute > 0 {
+		ticker := time.NewTicker(time.Minute / time.Duration(c.PerMinute))
+		defer ticker.Stop()
+		ticks = ticker.C
+	}
+
+	var mu sync.Mutex
+	var saveErr error
+	progress := CampaignProgress{Total: len(c.Recipients)}
+	record := func(result RecipientResult) {
+		mu.Lock()
+		defer mu.Unlock()
+		state[result.Address] = result
+		if err := saveResult(stateFile, result); err != nil && saveErr == nil {
+			saveErr = err
+		}
+		progress.count(result)
+		progress.Last = result
+		if c.Progress != nil {
+			c.Progress(progress)
+		}
+	}
+
+	var pending []TemplateRecipient
+	for _, rcpt := range c.Recipients {
+		if result, ok := state[rcpt.Address.Address]; ok && result.Status != Deferred {
+			progress.count(result)
+			continue
+		}
+		pending = append(pending, rcpt)
+	}
+
+	jobs := make(chan TemplateRecipient)
+	var wg sync.WaitGroup
+	for range concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for rcpt := range jobs {
+				record(c.send(ctx, sender, rcpt))
+			}
+		}()
+	}
+
+feed:
+	for _, rcpt := range pending {
+		if ticks != nil {
+			select {
+			case <-ticks:
+			case <-ctx.Done():
+				break feed
+			}
+		}
+		select {
+		case jobs <- rcpt:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	results := make([]RecipientResult, 0, len(c.Recipients))
+	for _, rcpt := range c.Recipients {
+		if result, ok := state[rcpt.Address.Address]; ok {
+			results = append(results, result)
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return results, err
+	}
+	return results, saveErr
+}
+
+func (c *Campaign) send(ctx context.Context, sender EmailSender, rcpt TemplateRecipient) RecipientResult {
+	addr := rcpt.Address.Address
+	email, err := c.Template.Render(rcpt)
+	if err != nil {
+		// the same data will fail the same way next time
+		return RecipientResult{Address: addr, Status: Rejected, Message: err.Error()}
+	}
+
+	err = sender.Send(ctx, c.Config, email)
+	var delivery *DeliveryError
+	if errors.As(err, &delivery) && len(delivery.Results) == 1 {
+		return delivery.Results[0]
+	}
+	return recipientResult(addr, err)
+}
+
+func (p *CampaignProgress) count(result RecipientResult) {
+	switch result.Status {
+	case Accepted:
+		p.Accepted++
+	case Rejected:
+		p.Rejected++
+	case Deferred:
+		p.Deferred++
+	}
+}
+
+// results of an earlier run by address, a later line for the same address
+// replaces an earlier one
+func (c *Campaign) loadState() (map[string]RecipientResult, error) {
+	state := map[string]RecipientResult{}
+	if c.StateFile == "" {
+		return state, nil
+	}
+	file, err := os.Open(c.StateFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read campaign state: %w", err)
+	}
+	defer file.Close()
+
+	decoder := json.NewDecoder(file)
+	for {
+		good := decoder.InputOffset()
+		var result RecipientResult
+		err := decoder.Decode(&result)
+		if err == io.EOF {
+			return state, nil
+		}
+		if err != nil {
+			// a line cut short by a crash: everything before it counts, and
+			// it has to go before new lines are appended after it
+			log.Printf("campaign: dropping unreadable end of state file: %v", err)
+			if err := os.Truncate(c.StateFile, good); err != nil {
+				return nil, fmt.Errorf("failed to repair campaign state: %w", err)
+			}
+			return state, nil
+		}
+		state[result.Address] = result
+	}
+}
+
+// one line per result, appended so a crash loses at most the last one
+func saveResult(file *os.File, result RecipientResult) error {
+	if file == nil {
+		return nil
+	}
+	data, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to save campaign state: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// size of one BDAT chunk
+const bdatChunkSize = 1 << 20
+
+// DATA, or BDAT when the server supports CHUNKING (RFC 3030). BDAT sends the
+// message as counted chunks, so nothing is dot-stuffed and there is no end
+// marker to scan for.
+func (c *smtpClient) dataWriter() (io.WriteCloser, error) {
+	if ok, _ := c.Extension("CHUNKING"); ok {
+		return &bdatWriter{c: c}, nil
+	}
+	return c.data()
+}
+
+// buffers up to a chunk and sends it as soon as it is full, the rest goes
+// out with BDAT LAST on Close
+type bdatWriter struct {
+	c   *smtpClient
+	buf []byte
+	err error
+}
+
+func (w *bdatWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	n := len(p)
+	for len(p) > 0 {
+		k := min(len(p), bdatChunkSize-len(w.buf))
+		w.buf = append(w.buf, p[:k]...)
+		p = p[k:]
+		if len(w.buf) == bdatChunkSize {
+			if err := w.flush(false); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return n, nil
+}
+
+func (w *bdatWriter) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+	return w.flush(true)
+}
+
+func (w *bdatWriter) flush(last bool) error {
+	line := fmt.Sprintf("BDAT %d", len(w.buf))
+	if last {
+		line += " LAST"
+	}
+
+	text := w.c.Text
+	id, err := text.Cmd("%s", line)
+	if err == nil {
+		_, err = text.W.Write(w.buf)
+		if err == nil {
+			err = text.W.Flush()
+		}
+		switch {
+		case err == nil && last:
+			text.StartResponse(id)
+			err = w.c.readFinal()
+			text.EndResponse(id)
+		case err == nil:
+			err = w.c.response(id, 250)
+		default:
+			// give up the reply's turn, the connection is broken anyway
+			text.StartResponse(id)
+			text.EndResponse(id)
+		}
+	}
+	w.buf = w.buf[:0]
+	w.err = err
+	return err
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// the settings of a profile, by key
+type configSection map[string]string
+
+// the keys a profile may set; each has an environment variable, SMTP_ and
+// the key in upper case, which overrides it
+var configKeys = []string{"provider", "region", "host", "port", "username", "password", "helo_name", "tls", "auth_mechanism"}
+
+// a mail service a profile can start from, with its provider key: the
+// server to submit to and the port, with STARTTLS on all of them
+type configProvider struct {
+	host func(region string) string
+	port string
+}
+
+var configProviders = map[string]configProvider{
+	"gmail": {host: func(string) string { return "smtp.gmail.com" }, port: "587"},
+	// SES has an endpoint in each region, us-east-1 by default; the
+	// username and password are SMTP credentials, not the IAM keys
+	"ses": {host: func(region string) string {
+		if region == "" {
+			region = "us-east-1"
+		}
+		return "email-smtp." + region + ".amazonaws.com"
+	}, port: "587"},
+	// region "eu" for domains in Mailgun's EU region
+	"mailgun": {host: func(region string) string {
+		if strings.EqualFold(region, "eu") {
+			return "smtp.eu.mailgun.org"
+		}
+		return "smtp.mailgun.org"
+	}, port: "587"},
+}
+
+// LoadConfig reads the settings of profile from the config file at path
+// and the environment, and checks that they are complete: a host, and a
+// username and password together or neither.
+//
+// The file is TOML, or YAML if its name ends in .yaml or .yml, with a
+// table or mapping of strings and numbers per profile. Keys at the top
+// apply to every profile, and "profile" there names the one to use by
+// default:
+//
+//	profile = "work"
+//	helo_name = "laptop.example.com"
+//
+//	[work]
+//	provider = "gmail"
+//	username = "me@example.com"
+//
+//	[newsletter]
+//	provider = "ses"
+//	region = "eu-west-1"
+//	username = "AKIA..."
+//
+// The keys are provider, region, host, port, username, password, helo_name,
+// tls (starttls, tls, none or opportunistic) and auth_mechanism. provider
+// fills in the server of gmail, ses or mailgun; a profile named after one
+// uses it without saying so. SMTP_HOST, SMTP_PORT, SMTP_USERNAME,
+// SMTP_PASSWORD and so on, each key in upper case, override the file, which
+// keeps passwords out of it. An empty path means the file in SMTP_CONFIG, or
+// none; an empty profile the one in SMTP_PROFILE, then the file's default.
+func LoadConfig(path, profile string) (SMTPConfig, error) {
+	if path == "" {
+		path = os.Getenv("SMTP_CONFIG")
+	}
+	sections := map[string]configSection{"": {}}
+	if path != "" {
+		file, err := os.Open(path)
+		if err != nil {
+			return SMTPConfig{}, fmt.Errorf("failed to open config: %w", err)
+		}
+		defer file.Close()
+		var parsed configFile
+		ext := strings.ToLower(filepath.Ext(path))
+		if ext == ".yaml" || ext == ".yml" {
+			parsed, err = parseYAMLConfig(file)
+		} else {
+			parsed, err = parseTOMLConfig(file)
+		}
+		if err != nil {
+			return SMTPConfig{}, fmt.Errorf("%s: %w", path, err)
+		}
+		sections = parsed.sections()
+	}
+
+	top := sections[""]
+	if profile == "" {
+		profile = os.Getenv("SMTP_PROFILE")
+	}
+	if profile == "" {
+		profile = top["profile"]
+	}
+	settings := configSection{}
+	for key, value := range top {
+		settings[key] = value
+	}
+	if profile != "" {
+		section, ok := sections[profile]
+		_, provider := configProviders[profile]
+		if !ok && !provider {
+			return SMTPConfig{}, fmt.Errorf("unknown profile %q", profile)
+		}
+		if provider {
+			settings["provider"] = profile
+		}
+		for key, value := range section {
+			settings[key] = value
+		}
+	}
+	for _, key := range configKeys {
+		if value, ok := os.LookupEnv("SMTP_" + strings.ToUpper(key)); ok {
+			settings[key] = value
+		}
+	}
+
+	config, err := settings.config()
+	if err != nil {
+		if profile != "" {
+			return SMTPConfig{}, fmt.Errorf("profile %s: %w", profile, err)
+		}
+		return SMTPConfig{}, err
+	}
+	return config, nil
+}
+
+// the SMTPConfig the settings describe, if it is complete
+func (s configSection) config() (SMTPConfig, error) {
+	var errs []error
+	for key := range s {
+		if key != "profile" && !slices.Contains(configKeys, key) {
+			errs = append(errs, fmt.Errorf("unknown key %q", key))
+		}
+	}
+
+	config := SMTPConfig{
+		Host:          s["host"],
+		Port:          s["port"],
+		Username:      s["username"],
+		Password:      s["password"],
+		HeloName:      s["helo_name"],
+		AuthMechanism: strings.ToUpper(s["auth_mechanism"]),
+	}
+	if name := strings.ToLower(s["provider"]); name != "" {
+		provider, ok := configProviders[name]
+		if !ok {
+			errs = append(errs, fmt.Errorf("unknown provider %q, want gmail, ses or mailgun", s["provider"]))
+		} else {
+			if config.Host == "" {
+				config.Host = provider.host(s["region"])
+			}
+			if config.Port == "" {
+				config.Port = provider.port
+			}
+			// the services only relay for their accounts
+			if config.Username == "" && config.Password == "" {
+				errs = append(errs, fmt.Errorf("%s needs a username and password (SMTP_USERNAME, SMTP_PASSWORD)", name))
+			}
+		}
+	}
+
+	switch strings.ToLower(s["tls"]) {
+	case "", "starttls":
+		config.TLSMode = StartTLS
+	case "tls", "implicit":
+		config.TLSMode = ImplicitTLS
+	case "none":
+		config.TLSMode = NoTLS
+	case "opportunistic":
+		config.TLSMode = OpportunisticTLS
+	default:
+		errs = append(errs, fmt.Errorf("invalid tls %q, want starttls, tls, none or opportunistic", s["tls"]))
+	}
+
+	if config.Host == "" {
+		errs = append(errs, errors.New("no host (host, SMTP_HOST or a provider)"))
+	}
+	if config.Port != "" {
+		if port, err := strconv.Atoi(config.Port); err != nil || port < 1 || port > 65535 {
+			errs = append(errs, fmt.Errorf("invalid port %q", config.Port))
+		}
+	}
+	if (config.Username == "") != (config.Password == "") {
+		errs = append(errs, errors.New("a username needs a password and a password a username"))
+	}
+	switch config.AuthMechanism {
+	case "", "CRAM-MD5", "PLAIN", "LOGIN":
+	default:
+		errs = append(errs, fmt.Errorf("invalid auth_mechanism %q, want CRAM-MD5, PLAIN or LOGIN", s["auth_mechanism"]))
+	}
+	if config.HeloName != "" {
+		if err := checkHeloName(config.HeloName); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return config, errors.Join(errs...)
+}
+
+// a setting as a file has it, a string or a number such as a port
+type configValue string
+
+func (v *configValue) UnmarshalText(text []byte) error {
+	*v = configValue(text)
+	return nil
+}
+
+// the keys of a profile, see configKeys
+type configProfile struct {
+	Provider      configValue `toml:"provider" yaml:"provider"`
+	Region        configValue `toml:"region" yaml:"region"`
+	Host          configValue `toml:"host" yaml:"host"`
+	Port          configValue `toml:"port" yaml:"port"`
+	Username      configValue `toml:"username" yaml:"username"`
+	Password      configValue `toml:"password" yaml:"password"`
+	HeloName      configValue `toml:"helo_name" yaml:"helo_name"`
+	TLS           configValue `toml:"tls" yaml:"tls"`
+	AuthMechanism configValue `toml:"auth_mechanism" yaml:"auth_mechanism"`
+}
+
+// a config file: the keys at the top, and the profiles' tables or
+// mappings by name
+type configFile struct {
+	Profile       string `toml:"profile" yaml:"profile"`
+	configProfile `yaml:",inline"`
+	Profiles      map[string]configProfile `toml:"-" yaml:",inline"`
+}
+
+func parseTOMLConfig(r io.Reader) (configFile, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return configFile{}, err
+	}
+	// the keys at the top, then the tables; a profile is named by the
+	// file, which a struct can't have a field for
+	var file configFile
+	top, err := toml.Decode(string(data), &file)
+	if err != nil {
+		return configFile{}, err
+	}
+	var tables map[string]toml.Primitive
+	md, err := toml.Decode(string(data), &tables)
+	if err != nil {
+		return configFile{}, err
+	}
+	file.Profiles = map[string]configProfile{}
+	for _, key := range top.Undecoded() {
+		if len(key) != 1 {
+			continue
+		}
+		name := key[0]
+		if md.Type(name) != "Hash" {
+			return configFile{}, fmt.Errorf("unknown key %q", name)
+		}
+		var profile configProfile
+		if err := md.PrimitiveDecode(tables[name], &profile); err != nil {
+			return configFile{}, fmt.Errorf("[%s]: %w", name, err)
+		}
+		file.Profiles[name] = profile
+	}
+	for _, key := range md.Undecoded() {
+		if len(key) > 1 {
+			return configFile{}, fmt.Errorf("[%s]: unknown key %q", key[0], strings.Join(key[1:], "."))
+		}
+	}
+	return file, nil
+}
+
+func parseYAMLConfig(r io.Reader) (configFile, error) {
+	var file configFile
+	decoder := yaml.NewDecoder(r)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&file); err != nil && err != io.EOF {
+		return configFile{}, err
+	}
+	return file, nil
+}
+
+// the settings of the file, "" for the keys at the top
+func (f configFile) sections() map[string]configSection {
+	sections := map[string]configSection{"": f.configProfile.section()}
+	if f.Profile != "" {
+		sections[""]["profile"] = f.Profile
+	}
+	for name, profile := range f.Profiles {
+		sections[name] = profile.section()
+	}
+	return sections
+}
+
+// the keys the profile sets
+func (p configProfile) section() configSection {
+	s := configSection{}
+	for key, value := range map[string]configValue{
+		"provider":       p.Provider,
+		"region":         p.Region,
+		"host":           p.Host,
+		"port":           p.Port,
+		"username":       p.Username,
+		"password":       p.Password,
+		"helo_name":      p.HeloName,
+		"tls":            p.TLS,
+		"auth_mechanism": p.AuthMechanism,
+	} {
+		if value != "" {
+			s[key] = string(value)
+		}
+	}
+	return s
+}
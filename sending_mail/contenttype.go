@@ -0,0 +1,48 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+// the Content-Type att goes out with: its own, or else the one its file
+// name suggests, or else what its first 512 bytes look like (the WHATWG
+// MIME sniffing http.DetectContentType does), so that only data nothing is
+// known about is application/octet-stream. Text gets a charset: Charset if
+// set, the one the type names, or utf-8 when the data is valid UTF-8.
+// Text that isn't goes without one rather than with a wrong one.
+func (att Attachment) contentType() string {
+	contentType := att.ContentType
+	if contentType == "" {
+		contentType = mime.TypeByExtension(filepath.Ext(att.Filename))
+	}
+	if contentType == "" {
+		contentType = http.DetectContentType(att.Data[:min(len(att.Data), 512)])
+	}
+
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil || !strings.HasPrefix(mediaType, "text/") {
+		return contentType
+	}
+	charset := strings.ToLower(params["charset"])
+	switch {
+	case att.Charset != "":
+		params["charset"] = att.Charset
+	case att.ContentType != "" && charset != "":
+		// the caller's word for it
+		return contentType
+	case charset != "" && charset != "utf-8":
+		// eg. UTF-16, sniffed from the byte order mark
+		return contentType
+	case utf8.Valid(att.Data):
+		params["charset"] = "utf-8"
+	default:
+		// mime.TypeByExtension and http.DetectContentType say utf-8 for
+		// any text
+		delete(params, "charset")
+	}
+	return mime.FormatMediaType(mediaType, params)
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const typeTLSA dnsmessage.Type = 52
+
+// RFC 6698 TLSA record. For SMTP (RFC 7672) only DANE-TA(2) and DANE-EE(3)
+// usages count, the web PKI usages are ignored.
+type TLSARecord struct {
+	Usage        uint8
+	Selector     uint8 // 0 full certificate, 1 SubjectPublicKeyInfo
+	MatchingType uint8 // 0 exact, 1 SHA-256, 2 SHA-512
+	Data         []byte
+}
+
+// TLSA records for an MX host's SMTP port. Records only count when the
+// resolver vouches for them with the AD bit, so this relies on a local
+// validating resolver; insecure answers are returned as no records.
+func LookupTLSA(ctx context.Context, host string, port int) ([]TLSARecord, error) {
+	name, err := dnsmessage.NewName(fmt.Sprintf("_%d._tcp.%s.", port, strings.TrimSuffix(host, ".")))
+	if err != nil {
+		return nil, err
+	}
+
+	servers, err := systemNameservers()
+	if err != nil {
+		return nil, err
+	}
+
+	var lastErr error
+	for _, server := range servers {
+		records, err := queryTLSA(ctx, server, name)
+		if err == nil {
+			return records, nil
+		}
+		lastErr = err
+	}
+	return nil, fmt.Errorf("TLSA lookup failed: %w", lastErr)
+}
+
+func queryTLSA(ctx context.Context, server string, name dnsmessage.Name) ([]TLSARecord, error) {
+	// an unpredictable ID, together with the question, is all that tells a
+	// spoofed udp reply from the real one
+	var id [2]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, err
+	}
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:               binary.BigEndian.Uint16(id[:]),
+			RecursionDesired: true,
+			AuthenticData:    true, // RFC 6840 5.7: ask for the AD bit in the reply
+		},
+		Questions: []dnsmessage.Question{{Name: name, Type: typeTLSA, Class: dnsmessage.ClassINET}},
+	}
+	var opt dnsmessage.ResourceHeader
+	if err := opt.SetEDNS0(4096, dnsmessage.RCodeSuccess, true); err != nil {
+		return nil, err
+	}
+	msg.Additionals = []dnsmessage.Resource{{Header: opt, Body: &dnsmessage.OPTResource{}}}
+	query, err := msg.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	reply, err := exchangeDNS(ctx, "udp", server, query, msg)
+	if err == nil && reply.Truncated {
+		// the records didn't fit a datagram, ask again over tcp
+		reply, err = exchangeDNS(ctx, "tcp", server, query, msg)
+	}
+	if err != nil {
+		return nil, err
+	}
+	switch reply.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("server replied %v", reply.RCode)
+	}
+	if !reply.AuthenticData {
+		return nil, nil
+	}
+
+	var records []TLSARecord
+	for _, answer := range reply.Answers {
+		unknown, ok := answer.Body.(*dnsmessage.UnknownResource)
+		if answer.Header.Type != typeTLSA || !ok || len(unknown.Data) < 3 {
+			continue
+		}
+		records = append(records, TLSARecord{
+			Usage:        unknown.Data[0],
+			Selector:     unknown.Data[1],
+			MatchingType: unknown.Data[2],
+			Data:         unknown.Data[3:],
+		})
+	}
+	return records, nil
+}
+
+// send a packed query and return the reply to it. Over udp, datagrams that
+// don't answer the query are skipped, they may be late or spoofed.
+func exchangeDNS(ctx context.Context, network, server string, query []byte, msg dnsmessage.Message) (dnsmessage.Message, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, server)
+	if err != nil {
+		return dnsmessage.Message{}, err
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+
+	var reply dnsmessage.Message
+	if network == "tcp" {
+		// RFC 1035 4.2.2: messages are prefixed with their length
+		if _, err := conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(query))), query...)); err != nil {
+			return dnsmessage.Message{}, err
+		}
+		var length [2]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return dnsmessage.Message{}, err
+		}
+		buf := make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return dnsmessage.Message{}, err
+		}
+		if err := reply.Unpack(buf); err != nil {
+			return dnsmessage.Message{}, err
+		}
+		if !isReplyTo(reply, msg) {
+			return dnsmessage.Message{}, errors.New("reply does not match the query")
+		}
+		return reply, nil
+	}
+
+	if _, err := conn.Write(query); err != nil {
+		return dnsmessage.Message{}, err
+	}
+	buf := make([]byte, 4096)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return dnsmessage.Message{}, err
+		}
+		if reply.Unpack(buf[:n]) == nil && isReplyTo(reply, msg) {
+			return reply, nil
+		}
+	}
+}
+
+// whether reply answers query: same ID and question
+func isReplyTo(reply, query dnsmessage.Message) bool {
+	if !reply.Response || reply.ID != query.ID || len(reply.Questions) != 1 {
+		return false
+	}
+	q, r := query.Questions[0], reply.Questions[0]
+	return r.Type == q.Type && r.Class == q.Class && strings.EqualFold(r.Name.String(), q.Name.String())
+}
+
+// nameserver lines from /etc/resolv.conf, the local resolver if there are none
+func systemNameservers() ([]string, error) {
+	file, err := os.Open("/etc/resolv.conf")
+	if errors.Is(err, os.ErrNotExist) {
+		return []string{"127.0.0.1:53"}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var servers []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			servers = append(servers, net.JoinHostPort(fields[1], "53"))
+		}
+	}
+	if len(servers) == 0 {
+		servers = []string{"127.0.0.1:53"}
+	}
+	return servers, scanner.Err()
+}
+
+// RFC 7672 3.1: DANE-EE pins the server's own certificate or key, name and
+// expiry don't matter; DANE-TA pins a CA in the presented chain, which must
+// then issue a certificate for host
+func verifyDANE(records []TLSARecord, chain []*x509.Certificate, host string) error {
+	if len(chain) == 0 {
+		return errors.New("DANE: server sent no certificate")
+	}
+
+	for _, record := range records {
+		switch record.Usage {
+		case 3:
+			if record.matches(chain[0]) {
+				return nil
+			}
+		case 2:
+			for i, cert := range chain[1:] {
+				if !record.matches(cert) {
+					continue
+				}
+				roots := x509.NewCertPool()
+				roots.AddCert(cert)
+				intermediates := x509.NewCertPool()
+				for _, c := range chain[1 : i+1] {
+					intermediates.AddCert(c)
+				}
+				_, err := chain[0].Verify(x509.VerifyOptions{
+					DNSName:       strings.TrimSuffix(host, "."),
+					Roots:         roots,
+					Intermediates: intermediates,
+				})
+				if err == nil {
+					return nil
+				}
+			}
+		}
+	}
+	return fmt.Errorf("DANE: no TLSA record matches the certificate of %s", host)
+}
+
+func (r TLSARecord) matches(cert *x509.Certificate) bool {
+	var data []byte
+	switch r.Selector {
+	case 0:
+		data = cert.Raw
+	case 1:
+		data = cert.RawSubjectPublicKeyInfo
+	default:
+		return false
+	}
+
+	switch r.MatchingType {
+	case 0:
+		return bytes.Equal(data, r.Data)
+	case 1:
+		sum := sha256.Sum256(data)
+		return bytes.Equal(sum[:], r.Data)
+	case 2:
+		sum := sha512.Sum512(data)
+		return bytes.Equal(sum[:], r.Data)
+	}
+	return false
+}
+
+// usable records, DANE applies only when at least one is left
+func usableTLSA(records []TLSARecord) []TLSARecord {
+	var usable []TLSARecord
+	for _, r := range records {
+		if (r.Usage == 2 || r.Usage == 3) && r.Selector <= 1 && r.MatchingType <= 2 {
+			usable = append(usable, r)
+		}
+	}
+	return usable
+}
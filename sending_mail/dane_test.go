@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"internet_services/dns_lookup/fakedns"
+)
+
+const testTLSAName = "_25._tcp.mx.example.com."
+
+func TestQueryTLSATruncated(t *testing.T) {
+	server, dns := startFakeDNS(t, fakedns.Raw(testTLSAName, typeTLSA, 300, []byte{3, 1, 1, 0xab}))
+	server.Truncate.Store(true)
+	server.AuthenticData.Store(true)
+
+	records, err := queryTLSA(context.Background(), net.JoinHostPort(dns.Server, dns.Port), dnsmessage.MustNewName(testTLSAName))
+	if err != nil || len(records) != 1 || records[0].Usage != 3 {
+		t.Errorf("got %+v, %v", records, err)
+	}
+	if server.Queries.Load() != 2 {
+		t.Errorf("%d queries, want udp then tcp", server.Queries.Load())
+	}
+}
+
+// replies with the wrong ID or question are skipped, the matching one that
+// follows them is used
+func TestQueryTLSAMismatch(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go func() {
+		buf := make([]byte, 512)
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		var query dnsmessage.Message
+		if query.Unpack(buf[:n]) != nil {
+			return
+		}
+		reply := func(edit func(*dnsmessage.Message), usage byte) {
+			res := dnsmessage.Message{
+				Header:    dnsmessage.Header{ID: query.ID, Response: true, AuthenticData: true},
+				Questions: query.Questions,
+				Answers:   []dnsmessage.Resource{fakedns.Raw(testTLSAName, typeTLSA, 300, []byte{usage, 1, 1, 0xab})},
+			}
+			edit(&res)
+			packed, _ := res.Pack()
+			conn.WriteTo(packed, from)
+		}
+		reply(func(res *dnsmessage.Message) { res.ID++ }, 1)
+		reply(func(res *dnsmessage.Message) {
+			res.Questions = []dnsmessage.Question{{Name: dnsmessage.MustNewName("_25._tcp.evil.example."), Type: typeTLSA, Class: dnsmessage.ClassINET}}
+		}, 2)
+		reply(func(*dnsmessage.Message) {}, 3)
+	}()
+
+	records, err := queryTLSA(context.Background(), conn.LocalAddr().String(), dnsmessage.MustNewName(testTLSAName))
+	if err != nil || len(records) != 1 || records[0].Usage != 3 {
+		t.Errorf("got %+v, %v", records, err)
+	}
+}
@@ -0,0 +1,459 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DebugServer is an SMTP server for testing the senders without a real
+// relay, in the spirit of MailHog: it takes any login, accepts every
+// recipient and keeps the messages in memory. They can be read through
+// Messages and Wait, or over HTTP, as a page at / and JSON at /messages.
+// There is no TLS, configure senders with NoTLS.
+type DebugServer struct {
+	Hostname string // announced in the greeting, default "localhost"
+
+	mu       sync.Mutex
+	ln       net.Listener
+	conns    map[net.Conn]bool
+	messages []ReceivedMessage
+	nextID   int
+	changed  chan struct{} // closed and replaced on every new message
+}
+
+// a message as the DebugServer received it
+type ReceivedMessage struct {
+	ID       int       `json:"id"`
+	Received time.Time `json:"received"`
+	Username string    `json:"username,omitempty"` // from AUTH, if the client logged in
+	From     string    `json:"from"`               // envelope sender
+	To       []string  `json:"to"`                 // envelope recipients
+	Data     []byte    `json:"data"`               // the message, with CRLF line endings
+}
+
+// the Subject header, empty if the message has none or doesn't parse
+func (m ReceivedMessage) Subject() string {
+	msg, err := mail.ReadMessage(bytes.NewReader(m.Data))
+	if err != nil {
+		return ""
+	}
+	subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil {
+		return msg.Header.Get("Subject")
+	}
+	return subject
+}
+
+// the message parsed, see ParseEmail
+func (m ReceivedMessage) Email() (*Email, error) {
+	return ParseEmail(bytes.NewReader(m.Data))
+}
+
+// listen on addr, eg. "127.0.0.1:0" for any free port, and serve SMTP in
+// the background until Close
+func (s *DebugServer) Start(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen: %w", err)
+	}
+	s.mu.Lock()
+	s.ln = ln
+	s.conns = map[net.Conn]bool{}
+	s.mu.Unlock()
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					log.Printf("debug server: %v", err)
+				}
+				return
+			}
+			s.mu.Lock()
+			s.conns[conn] = true
+			s.mu.Unlock()
+			go s.serve(conn)
+		}
+	}()
+	return nil
+}
+
+// the address the server listens on
+func (s *DebugServer) Addr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ln.Addr()
+}
+
+// an SMTPConfig that sends to this server
+func (s *DebugServer) Config() SMTPConfig {
+	_, port, _ := net.SplitHostPort(s.Addr().String())
+	return SMTPConfig{Host: "localhost", Port: port, Username: "debug@localhost", Password: "debug", TLSMode: NoTLS}
+}
+
+// stop listening and drop the open connections
+func (s *DebugServer) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	return s.ln.Close()
+}
+
+// the messages received so far, oldest first
+func (s *DebugServer) Messages() []ReceivedMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]ReceivedMessage(nil), s.messages...)
+}
+
+// forget every message
+func (s *DebugServer) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.messages = nil
+}
+
+// block until at least n messages have arrived and return them
+func (s *DebugServer) Wait(ctx context.Context, n int) ([]ReceivedMessage, error) {
+	for {
+		s.mu.Lock()
+		if len(s.messages) >= n {
+			messages := append([]ReceivedMessage(nil), s.messages...)
+			s.mu.Unlock()
+			return messages, nil
+		}
+		if s.changed == nil {
+			s.changed = make(chan struct{})
+		}
+		changed := s.changed
+		s.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (s *DebugServer) store(msg ReceivedMessage) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextID++
+	msg.ID = s.nextID
+	msg.Received = time.Now()
+	s.messages = append(s.messages, msg)
+	if s.changed != nil {
+		close(s.changed)
+		s.changed = nil
+	}
+	return msg.ID
+}
+
+// one SMTP session. Commands are read one line at a time, so pipelined
+// commands just queue up in the reader.
+func (s *DebugServer) serve(conn net.Conn) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+	text := textproto.NewConn(conn)
+	hostname := s.Hostname
+	if hostname == "" {
+		hostname = "localhost"
+	}
+
+	var username string
+	var msg *ReceivedMessage // the transaction, nil outside MAIL ... DATA
+	reply := func(format string, args ...any) bool {
+		return text.PrintfLine(format, args...) == nil
+	}
+	if !reply("220 %s ESMTP debug server", hostname) {
+		return
+	}
+
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		ok := true
+		switch strings.ToUpper(verb) {
+		case "EHLO":
+			msg = nil
+			ok = reply("250-%s", hostname) &&
+				reply("250-PIPELINING") &&
+				reply("250-8BITMIME") &&
+				reply("250-SMTPUTF8") &&
+				reply("250 AUTH PLAIN LOGIN CRAM-MD5 XOAUTH2")
+		case "HELO":
+			msg = nil
+			ok = reply("250 %s", hostname)
+		case "AUTH":
+			username, err = debugAuth(text, arg)
+			if err != nil {
+				return
+			}
+			ok = reply("235 2.7.0 authentication successful")
+		case "MAIL":
+			from, found := cutPath(arg, "FROM:")
+			if !found {
+				ok = reply("501 5.5.4 syntax: MAIL FROM:<address>")
+				break
+			}
+			msg = &ReceivedMessage{Username: username, From: from}
+			ok = reply("250 2.1.0 ok")
+		case "RCPT":
+			to, found := cutPath(arg, "TO:")
+			switch {
+			case msg == nil:
+				ok = reply("503 5.5.1 MAIL first")
+			case !found || to == "":
+				ok = reply("501 5.5.4 syntax: RCPT TO:<address>")
+			default:
+				msg.To = append(msg.To, to)
+				ok = reply("250 2.1.5 ok")
+			}
+		case "DATA":
+			if msg == nil || len(msg.To) == 0 {
+				ok = reply("503 5.5.1 RCPT first")
+				break
+			}
+			if !reply("354 end data with <CR><LF>.<CR><LF>") {
+				return
+			}
+			data, err := io.ReadAll(text.DotReader())
+			if err != nil {
+				return
+			}
+			msg.Data = bytes.ReplaceAll(data, []byte("\n"), []byte("\r\n"))
+			id := s.store(*msg)
+			msg = nil
+			ok = reply("250 2.0.0 ok: queued as %d", id)
+		case "RSET":
+			msg = nil
+			ok = reply("250 2.0.0 ok")
+		case "NOOP":
+			ok = reply("250 2.0.0 ok")
+		case "VRFY":
+			ok = reply("252 2.1.5 cannot verify, but will accept")
+		case "QUIT":
+			reply("221 2.0.0 bye")
+			return
+		default:
+			ok = reply("502 5.5.2 command not implemented")
+		}
+		if !ok {
+			return
+		}
+	}
+}
+
+// read the rest of an AUTH exchange and return the username. Every
+// credential is accepted, so only what is needed to name the user is
+// decoded.
+func debugAuth(text *textproto.Conn, arg string) (string, error) {
+	mechanism, initial, _ := strings.Cut(arg, " ")
+	challenge := func(prompt string) (string, error) {
+		if err := text.PrintfLine("334 %s", base64.StdEncoding.EncodeToString([]byte(prompt))); err != nil {
+			return "", err
+		}
+		line, err := text.ReadLine()
+		if err != nil {
+			return "", err
+		}
+		decoded, _ := base64.StdEncoding.DecodeString(line)
+		return string(decoded), nil
+	}
+	decodeInitial := func(prompt string) (string, error) {
+		if initial == "" {
+			return challenge(prompt)
+		}
+		decoded, _ := base64.StdEncoding.DecodeString(initial)
+		return string(decoded), nil
+	}
+
+	switch strings.ToUpper(mechanism) {
+	case "PLAIN":
+		// authzid NUL authcid NUL password
+		response, err := decodeInitial("")
+		parts := strings.Split(response, "\x00")
+		if len(parts) < 2 {
+			return "", err
+		}
+		return parts[1], err
+	case "LOGIN":
+		username, err := decodeInitial("Username:")
+		if err != nil {
+			return "", err
+		}
+		_, err = challenge("Password:")
+		return username, err
+	case "CRAM-MD5":
+		response, err := challenge("<" + strconv.FormatInt(time.Now().UnixNano(), 10) + "@debug>")
+		username, _, _ := strings.Cut(response, " ")
+		return username, err
+	case "XOAUTH2":
+		// user=someone\x01auth=Bearer token\x01\x01
+		response, err := decodeInitial("")
+		for _, field := range strings.Split(response, "\x01") {
+			if user, ok := strings.CutPrefix(field, "user="); ok {
+				return user, err
+			}
+		}
+		return "", err
+	}
+	return decodeInitial("")
+}
+
+// the address of "FROM:<a@example.com> SIZE=123", parameters dropped
+func cutPath(arg, prefix string) (string, bool) {
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		return "", false
+	}
+	path := strings.TrimSpace(arg[len(prefix):])
+	if end := strings.IndexByte(path, '>'); strings.HasPrefix(path, "<") && end > 0 {
+		return path[1:end], true
+	}
+	path, _, _ = strings.Cut(path, " ")
+	return path, true
+}
+
+// the web view of the received messages:
+//
+//	GET    /                   page listing the messages
+//	GET    /messages           the messages as JSON, without their data
+//	GET    /messages/{id}      one message as JSON, data included
+//	GET    /messages/{id}/raw  one message as it was received, eg. to save as .eml
+//	DELETE /messages           forget every message
+func (s *DebugServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", s.handleIndex)
+	mux.HandleFunc("GET /messages", s.handleList)
+	mux.HandleFunc("DELETE /messages", func(w http.ResponseWriter, r *http.Request) {
+		s.Reset()
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("GET /messages/{id}", func(w http.ResponseWriter, r *http.Request) {
+		msg, ok := s.message(r.PathValue("id"))
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(msg)
+	})
+	mux.HandleFunc("GET /messages/{id}/raw", func(w http.ResponseWriter, r *http.Request) {
+		msg, ok := s.message(r.PathValue("id"))
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "message/rfc822")
+		w.Write(msg.Data)
+	})
+	return mux
+}
+
+func (s *DebugServer) message(id string) (ReceivedMessage, bool) {
+	n, err := strconv.Atoi(id)
+	if err != nil {
+		return ReceivedMessage{}, false
+	}
+	for _, msg := range s.Messages() {
+		if msg.ID == n {
+			return msg, true
+		}
+	}
+	return ReceivedMessage{}, false
+}
+
+// what the list shows of a message
+type messageSummary struct {
+	ID       int       `json:"id"`
+	Received time.Time `json:"received"`
+	From     string    `json:"from"`
+	To       []string  `json:"to"`
+	Subject  string    `json:"subject"`
+	Size     int       `json:"size"`
+}
+
+func (s *DebugServer) summaries() []messageSummary {
+	messages := s.Messages()
+	summaries := make([]messageSummary, len(messages))
+	for i, msg := range messages {
+		summaries[i] = messageSummary{
+			ID:       msg.ID,
+			Received: msg.Received,
+			From:     msg.From,
+			To:       msg.To,
+			Subject:  msg.Subject(),
+			Size:     len(msg.Data),
+		}
+	}
+	return summaries
+}
+
+func (s *DebugServer) handleList(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.summaries())
+}
+
+func (s *DebugServer) handleIndex(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	debugInbox.Execute(w, s.summaries())
+}
+
+var debugInbox = template.Must(template.New("inbox").Parse(`<!DOCTYPE html>
+<html>
+<head>
+    <meta http-equiv="refresh" content="5">
+    <title>debug SMTP server</title>
+    <style>
+        body { font-family: monospace; margin: 20px; }
+        table { border-collapse: collapse; }
+        td, th { border: 1px solid #ccc; padding: 4px 8px; text-align: left; }
+    </style>
+</head>
+<body>
+    <h1>Received messages</h1>
+    <table>
+        <tr><th>#</th><th>Received</th><th>From</th><th>To</th><th>Subject</th><th>Size</th></tr>
+        {{range .}}
+        <tr>
+            <td><a href="/messages/{{.ID}}/raw">{{.ID}}</a></td>
+            <td>{{.Received.Format "15:04:05"}}</td>
+            <td>{{.From}}</td>
+            <td>{{range $i, $to := .To}}{{if $i}}, {{end}}{{$to}}{{end}}</td>
+            <td>{{.Subject}}</td>
+            <td>{{.Size}}</td>
+        </tr>
+        {{else}}
+        <tr><td colspan="6">nothing yet</td></tr>
+        {{end}}
+    </table>
+</body>
+</html>
+`))
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DirectSender delivers straight to the recipient domains' MX hosts instead
+// of handing the message to a relay. TLS follows the domain's published
+// requirements: DANE TLSA records pin the certificate, an MTA-STS policy in
+// enforce mode demands a valid certificate for a listed MX, and without
+// either STARTTLS is used opportunistically.
+//
+// Host, Port and the credentials in SMTPConfig are ignored. Username is only
+// the envelope sender, DKIM signs, and TLS.RootCAs and TLS.MinVersion apply to
+// the certificate checks.
+type DirectSender struct {
+	HeloName string        // name announced in EHLO, default SMTPConfig.HeloName or the detected one
+	Port     int           // default 25
+	Timeout  time.Duration // per connection attempt, default 1 minute
+}
+
+// implements the EmailSender interface
+func (d DirectSender) Send(ctx context.Context, config SMTPConfig, email Email) error {
+	if err := email.Validate(); err != nil {
+		return err
+	}
+	msg, err := config.sign(buildMessage(email))
+	if err != nil {
+		return err
+	}
+
+	domains := map[string][]string{}
+	var order []string
+	for _, rcpt := range email.Recipients() {
+		at := strings.LastIndex(rcpt, "@")
+		if at < 0 {
+			return fmt.Errorf("recipient %q has no domain", rcpt)
+		}
+		domain := strings.ToLower(rcpt[at+1:])
+		if _, ok := domains[domain]; !ok {
+			order = append(order, domain)
+		}
+		domains[domain] = append(domains[domain], rcpt)
+	}
+
+	// one result set across all domains
+	var results []RecipientResult
+	for _, domain := range order {
+		err := d.deliverDomain(ctx, config, domain, email.envelope(config.Username, domains[domain]), msg)
+		var delivery *DeliveryError
+		if errors.As(err, &delivery) {
+			results = append(results, delivery.Results...)
+			continue
+		}
+		if err != nil {
+			err = fmt.Errorf("delivery to %s failed: %w", domain, err)
+		}
+		for _, rcpt := range domains[domain] {
+			results = append(results, recipientResult(rcpt, err))
+		}
+	}
+	return deliveryError(results)
+}
+
+// try the MX hosts in preference order until one accepts the message
+func (d DirectSender) deliverDomain(ctx context.Context, config SMTPConfig, domain string, env envelope, msg []byte) error {
+	hosts, err := lookupMXHosts(ctx, domain)
+	if err != nil {
+		return err
+	}
+
+	policy, err := LookupMTASTS(ctx, domain)
+	if err != nil {
+		// RFC 8461 5: an unreachable policy is treated like no policy
+		log.Printf("direct: %s: %v", domain, err)
+	}
+
+	var lastErr error
+	for _, host := range hosts {
+		if policy != nil && policy.Mode != "none" && !policy.allowsMX(host) {
+			if policy.enforced() {
+				lastErr = fmt.Errorf("MX %s is not listed in the MTA-STS policy", host)
+				continue
+			}
+			log.Printf("direct: %s: MX %s is not listed in the MTA-STS policy (testing mode)", domain, host)
+		}
+
+		lastErr = contextError(ctx, d.deliverMX(ctx, config, host, policy, env, msg))
+		if lastErr == nil {
+			return nil
+		}
+		// per-recipient answers or a 5xx reply are the domain's answer,
+		// another MX won't say otherwise
+		var protoErr *textproto.Error
+		var delivery *DeliveryError
+		if errors.As(lastErr, &delivery) || errors.As(lastErr, &protoErr) && protoErr.Code >= 500 {
+			return lastErr
+		}
+		if ctx.Err() != nil {
+			return lastErr
+		}
+	}
+	return lastErr
+}
+
+// MX hosts by preference, the domain itself when it has no MX records
+func lookupMXHosts(ctx context.Context, domain string) ([]string, error) {
+	records, err := net.DefaultResolver.LookupMX(ctx, domain)
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return []string{domain}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("MX lookup failed: %w", err)
+	}
+	if len(records) == 0 {
+		return []string{domain}, nil
+	}
+
+	sort.SliceStable(records, func(i, j int) bool { return records[i].Pref < records[j].Pref })
+	hosts := make([]string, 0, len(records))
+	for _, mx := range records {
+		host := strings.TrimSuffix(mx.Host, ".")
+		if host == "" {
+			// RFC 7505 null MX: the domain accepts no mail
+			return nil, &textproto.Error{Code: 556, Msg: fmt.Sprintf("5.1.10 %s does not accept mail (null MX)", domain)}
+		}
+		hosts = append(hosts, host)
+	}
+	return hosts, nil
+}
+
+func (d DirectSender) deliverMX(ctx context.Context, config SMTPConfig, host string, policy *MTASTSPolicy, env envelope, msg []byte) error {
+	port := d.Port
+	if port == 0 {
+		port = 25
+	}
+	timeout := d.Timeout
+	if timeout <= 0 {
+		timeout = time.Minute
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	tlsa, err := LookupTLSA(ctx, host, port)
+	if err != nil {
+		// the records may exist, delivering without them could be a downgrade
+		return err
+	}
+	tlsa = usableTLSA(tlsa)
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		return fmt.Errorf("failed to dial %s: %w", host, err)
+	}
+	c := &smtpClient{conn: conn, helo: d.HeloName, progress: config.Progress, archive: config.Archive, accepted: config.OnAccepted}
+	if c.helo == "" {
+		c.helo = config.HeloName
+	}
+	if c.helo == "" {
+		c.helo = detectHeloName(ctx, conn)
+	}
+	defer c.watch(ctx)()
+
+	if config.Transcript != nil {
+		c.transcript = newTranscriptConn(conn, config.Transcript, net.JoinHostPort(host, strconv.Itoa(port)))
+		conn = c.transcript
+	}
+	c.Client, err = smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("failed to create SMTP client: %w", err)
+	}
+	// c.Client is replaced by STARTTLS with a transcript
+	defer func() { c.Close() }()
+
+	if err := c.Hello(c.helo); err != nil {
+		return fmt.Errorf("EHLO failed: %w", err)
+	}
+
+	tlsConfig := &tls.Config{ServerName: host, MinVersion: tls.VersionTLS12}
+	if config.TLS.MinVersion != 0 {
+		tlsConfig.MinVersion = config.TLS.MinVersion
+	}
+	required := ""
+	switch {
+	case len(tlsa) > 0:
+		// the TLSA records replace the web PKI check
+		required = "DANE"
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+			return verifyDANE(tlsa, state.PeerCertificates, host)
+		}
+	case policy.enforced():
+		required = "MTA-STS"
+		tlsConfig.RootCAs = config.TLS.RootCAs
+	default:
+		// opportunistic, any encryption beats plaintext
+		tlsConfig.InsecureSkipVerify = true
+	}
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.startTLS(tlsConfig); err != nil {
+			return fmt.Errorf("failed to start TLS with %s: %w", host, err)
+		}
+	} else if required != "" {
+		return fmt.Errorf("%s does not offer STARTTLS, refusing plaintext delivery required by %s", host, required)
+	}
+
+	if err := c.sendMessage(env, msg); err != nil {
+		return err
+	}
+	// the server has the message, a failed QUIT changes nothing; an error
+	// here would only get it delivered twice
+	c.Quit()
+	return nil
+}
@@ -0,0 +1,298 @@
+package dkim
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"internet_services/dns_lookup/resolver"
+)
+
+// what VerifyARC found out about the ARC chain of a message (RFC 8617)
+type ARCResult struct {
+	Result   Result // none without ARC sets, pass or fail
+	Instance int    // the number of sets
+	Err      error  // why it failed
+}
+
+// the header fields of one ARC set, by index
+type arcSet struct {
+	results, signature, seal int
+	has                      int // bitmask of the three
+}
+
+const arcMaxInstance = 50
+
+// VerifyARC checks the ARC chain of msg: sets numbered from 1 without
+// gaps, every seal valid, and the message signature of the latest set. A
+// pass means the hops that sealed it vouch for the Authentication-Results
+// they saw, read them from the ARC-Authentication-Results fields. dns
+// nil iterates from the root servers with a resolver.Client.
+func VerifyARC(ctx context.Context, dns Resolver, msg []byte) ARCResult {
+	if dns == nil {
+		dns = resolver.New()
+	}
+	msg = normalizeCRLF(msg)
+	header, body, ok := bytes.Cut(msg, []byte("\r\n\r\n"))
+	if !ok {
+		header, body = bytes.TrimSuffix(msg, []byte("\r\n")), nil
+	}
+	fields := splitHeaderFields(header)
+	sets, err := arcSets(fields)
+	result := ARCResult{Instance: len(sets)}
+	if err != nil {
+		result.Result, result.Err = Fail, err
+		return result
+	}
+	if len(sets) == 0 {
+		result.Result = None
+		return result
+	}
+	fail := func(format string, args ...any) ARCResult {
+		result.Result, result.Err = Fail, fmt.Errorf("arc: "+format, args...)
+		return result
+	}
+
+	for i := 1; i <= len(sets); i++ {
+		tags, err := arcTags(fields[sets[i].seal])
+		if err != nil {
+			return fail("ARC-Seal i=%d: %v", i, err)
+		}
+		want := "pass"
+		if i == 1 {
+			want = "none"
+		}
+		if cv := strings.ToLower(tags["cv"]); cv != want {
+			return fail("ARC-Seal i=%d has cv=%s", i, cv)
+		}
+	}
+
+	latest := verifySignature(ctx, dns, fields, sets[len(sets)].signature, body, true)
+	if latest.Result != Pass {
+		return fail("ARC-Message-Signature i=%d: %v", len(sets), latest.Err)
+	}
+	for i := len(sets); i >= 1; i-- {
+		if err := verifyARCSeal(ctx, dns, fields, sets, i); err != nil {
+			return fail("ARC-Seal i=%d: %v", i, err)
+		}
+	}
+	result.Result = Pass
+	return result
+}
+
+// the ARC sets of a header by instance, each complete
+func arcSets(fields []string) (map[int]*arcSet, error) {
+	sets := map[int]*arcSet{}
+	for index, field := range fields {
+		var bit int
+		switch strings.ToLower(fieldName(field)) {
+		case "arc-authentication-results":
+			bit = 1
+		case "arc-message-signature":
+			bit = 2
+		case "arc-seal":
+			bit = 4
+		default:
+			continue
+		}
+		instance, err := arcInstance(field)
+		if err != nil {
+			return nil, err
+		}
+		set := sets[instance]
+		if set == nil {
+			set = &arcSet{}
+			sets[instance] = set
+		}
+		if set.has&bit != 0 {
+			return nil, fmt.Errorf("arc: two %s fields with i=%d", fieldName(field), instance)
+		}
+		set.has |= bit
+		switch bit {
+		case 1:
+			set.results = index
+		case 2:
+			set.signature = index
+		case 4:
+			set.seal = index
+		}
+	}
+	if len(sets) > arcMaxInstance {
+		return nil, fmt.Errorf("arc: more than %d sets", arcMaxInstance)
+	}
+	for i := 1; i <= len(sets); i++ {
+		if sets[i] == nil || sets[i].has != 7 {
+			return nil, fmt.Errorf("arc: set i=%d is missing or incomplete", i)
+		}
+	}
+	return sets, nil
+}
+
+// the i= of an ARC field; the first thing in its value
+func arcInstance(field string) (int, error) {
+	_, value, _ := strings.Cut(field, ":")
+	first, _, _ := strings.Cut(value, ";")
+	name, n, _ := strings.Cut(first, "=")
+	instance, err := strconv.Atoi(strings.TrimSpace(n))
+	if strings.TrimSpace(name) != "i" || err != nil || instance < 1 || instance > arcMaxInstance {
+		return 0, fmt.Errorf("arc: invalid instance in %s", fieldName(field))
+	}
+	return instance, nil
+}
+
+func arcTags(field string) (map[string]string, error) {
+	_, value, _ := strings.Cut(field, ":")
+	return ParseTagList(value)
+}
+
+// the fields an ARC-Seal signs: the sets 1 to i in order, each results,
+// message signature and seal, the last seal without its b= value
+// (RFC 8617 5.1.1)
+func arcSealData(sets [][3]string) string {
+	var b strings.Builder
+	for n, set := range sets {
+		for k, field := range set {
+			if n == len(sets)-1 && k == 2 {
+				b.WriteString(relaxedHeader(withoutSignature(field)))
+				break
+			}
+			b.WriteString(relaxedHeader(field))
+			b.WriteString("\r\n")
+		}
+	}
+	return b.String()
+}
+
+func verifyARCSeal(ctx context.Context, dns Resolver, fields []string, sets map[int]*arcSet, instance int) error {
+	tags, err := arcTags(fields[sets[instance].seal])
+	if err != nil {
+		return err
+	}
+	for _, tag := range []string{"a", "b", "d", "s", "cv"} {
+		if _, ok := tags[tag]; !ok {
+			return fmt.Errorf("no %s= tag", tag)
+		}
+	}
+	if _, ok := tags["h"]; ok {
+		return errors.New("h= is not allowed in a seal")
+	}
+	var keyType string
+	switch strings.ToLower(tags["a"]) {
+	case "rsa-sha256":
+		keyType = "rsa"
+	case "ed25519-sha256":
+		keyType = "ed25519"
+	default:
+		return fmt.Errorf("unsupported algorithm %q", tags["a"])
+	}
+	var chain [][3]string
+	for i := 1; i <= instance; i++ {
+		chain = append(chain, [3]string{fields[sets[i].results], fields[sets[i].signature], fields[sets[i].seal]})
+	}
+	domain := strings.ToLower(strings.TrimSuffix(tags["d"], "."))
+	_, err = checkHash(ctx, dns, tags["s"], domain, keyType, tags["b"], arcSealData(chain))
+	return err
+}
+
+// ARCSealer adds an ARC set to messages passing through, so that a
+// receiver further on can trust the SPF, DKIM and DMARC results of this
+// host when forwarding breaks them, eg. a mailing list that changes the
+// subject or a forward from another address (RFC 8617). The results
+// sealed are those of the Authentication-Results field of AuthServID,
+// such as the one an smtpd.Server adds.
+type ARCSealer struct {
+	Signer     Signer   // the domain, selector and key to seal with
+	AuthServID string   // whose Authentication-Results, eg. the server's hostname
+	Resolver   Resolver // for checking the chain so far, default a resolver.Client
+}
+
+// msg with a new ARC set on top; line endings are normalized to CRLF. A
+// chain that failed at an earlier hop, or is malformed, isn't sealed
+// again, that is an error.
+func (a ARCSealer) Seal(ctx context.Context, msg []byte) ([]byte, error) {
+	msg = normalizeCRLF(msg)
+	header, body, ok := bytes.Cut(msg, []byte("\r\n\r\n"))
+	if !ok {
+		header, body = msg, nil
+	}
+	fields := splitHeaderFields(header)
+
+	chain := VerifyARC(ctx, a.Resolver, msg)
+	sets, err := arcSets(fields)
+	if err != nil {
+		// no instance number to go on with
+		return nil, err
+	}
+	for i := 1; i <= len(sets); i++ {
+		if tags, _ := arcTags(fields[sets[i].seal]); strings.EqualFold(tags["cv"], "fail") {
+			return nil, fmt.Errorf("arc: chain failed at i=%d, not sealing", i)
+		}
+	}
+	instance := chain.Instance + 1
+	if instance > arcMaxInstance {
+		return nil, fmt.Errorf("arc: chain has %d sets already", chain.Instance)
+	}
+	if chain.Result == Fail {
+		// the sets that are there can't be trusted, but the seal says so
+		log.Printf("arc: sealing a failed chain: %v", chain.Err)
+		sets = nil
+	}
+
+	results := a.AuthServID + "; none"
+	for _, field := range fields {
+		if !strings.EqualFold(fieldName(field), "Authentication-Results") {
+			continue
+		}
+		_, value, _ := strings.Cut(field, ":")
+		id, _, _ := strings.Cut(value, ";")
+		if id, _, _ = strings.Cut(strings.TrimSpace(id), " "); strings.EqualFold(id, a.AuthServID) {
+			results = strings.TrimSpace(value)
+			break
+		}
+	}
+	resultsField := fmt.Sprintf("ARC-Authentication-Results: i=%d; %s", instance, results)
+
+	signature, err := a.Signer.signature(fmt.Sprintf("ARC-Message-Signature: i=%d; ", instance), fields, body)
+	if err != nil {
+		return nil, err
+	}
+
+	algorithm, err := a.Signer.algorithm()
+	if err != nil {
+		return nil, err
+	}
+	cv := "none"
+	if chain.Result == Pass {
+		cv = "pass"
+	} else if chain.Result == Fail {
+		cv = "fail"
+	}
+	seal := fmt.Sprintf("ARC-Seal: i=%d; a=%s; t=%d; cv=%s; d=%s; s=%s; b=",
+		instance, algorithm, time.Now().Unix(), cv, a.Signer.Domain, a.Signer.Selector)
+	var data [][3]string
+	if cv == "pass" {
+		for i := 1; i < instance; i++ {
+			data = append(data, [3]string{fields[sets[i].results], fields[sets[i].signature], fields[sets[i].seal]})
+		}
+	}
+	data = append(data, [3]string{resultsField, signature, seal})
+	sealSignature, err := a.Signer.sign([]byte(arcSealData(data)))
+	if err != nil {
+		return nil, err
+	}
+	seal += foldBase64(base64.StdEncoding.EncodeToString(sealSignature))
+
+	var sealed bytes.Buffer
+	for _, field := range []string{seal, signature, resultsField} {
+		sealed.WriteString(field)
+		sealed.WriteString("\r\n")
+	}
+	sealed.Write(msg)
+	return sealed.Bytes(), nil
+}
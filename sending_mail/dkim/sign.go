@@ -0,0 +1,243 @@
+// Package dkim signs messages with DKIM (RFC 6376) and verifies the
+// signatures of received ones, and checks and adds the ARC sets of
+// forwarded mail (RFC 8617), which are DKIM signatures by other names.
+package dkim
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// header fields signed when present, From always is (RFC 6376 5.4)
+var defaultHeaders = []string{
+	"From", "Reply-To", "Subject", "Date", "To", "Cc", "Message-ID",
+	"In-Reply-To", "References", "MIME-Version", "Content-Type",
+	"List-Unsubscribe", "List-Unsubscribe-Post",
+}
+
+// signs outgoing messages for Domain with relaxed/relaxed canonicalization
+type Signer struct {
+	Domain     string
+	Selector   string
+	PrivateKey crypto.Signer // *rsa.PrivateKey or ed25519.PrivateKey
+	Headers    []string      // header fields to sign, default defaultHeaders
+}
+
+// load a PEM encoded RSA (PKCS #1 or #8) or Ed25519 (PKCS #8) private key
+func ParseKey(pemData []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(pemData)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key: %w", err)
+	}
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		return key, nil
+	case ed25519.PrivateKey:
+		return key, nil
+	}
+	return nil, fmt.Errorf("unsupported DKIM key type %T", key)
+}
+
+// return msg with a DKIM-Signature header in front, line endings are
+// normalized to CRLF first so the signed and the sent bytes agree
+func (d Signer) Sign(msg []byte) ([]byte, error) {
+	msg = normalizeCRLF(msg)
+	header, body, ok := bytes.Cut(msg, []byte("\r\n\r\n"))
+	if !ok {
+		header, body = msg, nil
+	}
+	sig, err := d.signature("DKIM-Signature: v=1; ", splitHeaderFields(header), body)
+	if err != nil {
+		return nil, err
+	}
+
+	var signed bytes.Buffer
+	signed.WriteString(sig)
+	signed.WriteString("\r\n")
+	signed.Write(msg)
+	return signed.Bytes(), nil
+}
+
+// the signature field of the message, its name and first tags in prefix;
+// ARC-Message-Signature is a DKIM-Signature by another name (RFC 8617 4.1.2)
+func (d Signer) signature(prefix string, fields []string, body []byte) (string, error) {
+	algorithm, err := d.algorithm()
+	if err != nil {
+		return "", err
+	}
+	bodyHash := sha256.Sum256(relaxedBody(body))
+
+	// header instances are used bottom up when a name repeats (RFC 6376 5.4.2)
+	names := d.Headers
+	if len(names) == 0 {
+		names = defaultHeaders
+	}
+	used := map[int]bool{}
+	var signedNames []string
+	var signedData bytes.Buffer
+	for _, name := range names {
+		for i := len(fields) - 1; i >= 0; i-- {
+			if used[i] || !strings.EqualFold(fieldName(fields[i]), name) {
+				continue
+			}
+			used[i] = true
+			signedNames = append(signedNames, strings.ToLower(name))
+			signedData.WriteString(relaxedHeader(fields[i]))
+			signedData.WriteString("\r\n")
+			break
+		}
+	}
+	if !containsFold(signedNames, "from") {
+		return "", errors.New("message has no From header to sign")
+	}
+
+	sigHeader := prefix + fmt.Sprintf("a=%s; c=relaxed/relaxed; d=%s; s=%s; t=%d; h=%s; bh=%s; b=",
+		algorithm, d.Domain, d.Selector, time.Now().Unix(), strings.Join(signedNames, ":"),
+		base64.StdEncoding.EncodeToString(bodyHash[:]))
+	signedData.WriteString(relaxedHeader(sigHeader)) // no trailing CRLF for the signature itself
+
+	signature, err := d.sign(signedData.Bytes())
+	if err != nil {
+		return "", err
+	}
+	return sigHeader + foldBase64(base64.StdEncoding.EncodeToString(signature)), nil
+}
+
+// the a= tag for the key
+func (d Signer) algorithm() (string, error) {
+	switch d.PrivateKey.(type) {
+	case *rsa.PrivateKey:
+		return "rsa-sha256", nil
+	case ed25519.PrivateKey:
+		return "ed25519-sha256", nil // RFC 8463
+	}
+	return "", fmt.Errorf("unsupported DKIM key type %T", d.PrivateKey)
+}
+
+// the signature of the SHA-256 hash of data
+func (d Signer) sign(data []byte) ([]byte, error) {
+	var signature []byte
+	var err error
+	hashed := sha256.Sum256(data)
+	if _, ok := d.PrivateKey.(*rsa.PrivateKey); ok {
+		signature, err = d.PrivateKey.Sign(rand.Reader, hashed[:], crypto.SHA256)
+	} else {
+		// Ed25519 signs the SHA-256 hash as its message
+		signature, err = d.PrivateKey.Sign(rand.Reader, hashed[:], crypto.Hash(0))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("DKIM signing failed: %w", err)
+	}
+	return signature, nil
+}
+
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// whitespace inside b= is ignored by verifiers, break it up to keep lines short
+func foldBase64(s string) string {
+	var b strings.Builder
+	for len(s) > 72 {
+		b.WriteString(s[:72])
+		b.WriteString("\r\n\t")
+		s = s[72:]
+	}
+	b.WriteString(s)
+	return b.String()
+}
+
+func normalizeCRLF(msg []byte) []byte {
+	msg = bytes.ReplaceAll(msg, []byte("\r\n"), []byte("\n"))
+	return bytes.ReplaceAll(msg, []byte("\n"), []byte("\r\n"))
+}
+
+// header fields with their continuation lines, without the final CRLF
+func splitHeaderFields(header []byte) []string {
+	var fields []string
+	for _, line := range strings.Split(string(header), "\r\n") {
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(fields) > 0 {
+			fields[len(fields)-1] += "\r\n" + line
+			continue
+		}
+		fields = append(fields, line)
+	}
+	return fields
+}
+
+func fieldName(field string) string {
+	name, _, _ := strings.Cut(field, ":")
+	return strings.TrimSpace(name)
+}
+
+// RFC 6376 3.4.2: lowercase name, unfold, collapse whitespace, no
+// whitespace around the colon or at the end
+func relaxedHeader(field string) string {
+	name, value, _ := strings.Cut(field, ":")
+	value = strings.ReplaceAll(value, "\r\n", "")
+	value = strings.Join(strings.FieldsFunc(value, isWSP), " ")
+	return strings.ToLower(strings.TrimSpace(name)) + ":" + value
+}
+
+// RFC 6376 3.4.4: collapse whitespace, strip it at line ends, drop empty
+// lines at the end of the body
+func relaxedBody(body []byte) []byte {
+	lines := strings.Split(string(body), "\r\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(collapseWSP(line), " ")
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
+
+func collapseWSP(line string) string {
+	var b strings.Builder
+	inSpace := false
+	for i := 0; i < len(line); i++ {
+		if isWSP(rune(line[i])) {
+			inSpace = true
+			continue
+		}
+		if inSpace {
+			b.WriteByte(' ')
+			inSpace = false
+		}
+		b.WriteByte(line[i])
+	}
+	if inSpace {
+		b.WriteByte(' ')
+	}
+	return b.String()
+}
+
+func isWSP(r rune) bool {
+	return r == ' ' || r == '\t'
+}
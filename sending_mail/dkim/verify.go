@@ -0,0 +1,341 @@
+package dkim
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"internet_services/dns_lookup/resolver"
+)
+
+// the outcome of a DKIM, ARC or DMARC check (RFC 8601 2.7)
+type Result string
+
+const (
+	None      Result = "none"      // no signature, no DMARC record
+	Pass      Result = "pass"      // verified, or aligned
+	Fail      Result = "fail"      // a bad signature, or no aligned pass
+	Neutral   Result = "neutral"   // a signature that can't be checked, eg. an unknown algorithm
+	Policy    Result = "policy"    // valid, but refused by the verifier's rules, eg. rsa-sha1
+	TempError Result = "temperror" // DNS trouble, try again later
+	PermError Result = "permerror" // a broken signature or key record
+)
+
+// where the public keys are looked up, a *resolver.Client or a
+// *net.Resolver
+type Resolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// what Verify found out about one DKIM-Signature
+type Verdict struct {
+	Result    Result
+	Domain    string // d=, the signing domain
+	Selector  string // s=
+	Identity  string // i=, default "@" + Domain
+	Signature string // the start of b=, for telling several signatures apart
+	Err       error  // why it didn't pass
+}
+
+// Verify checks every DKIM-Signature of msg (RFC 6376), fetching the
+// public keys from DNS; a message without any gives no verdicts. Both
+// canonicalizations, rsa-sha256 and ed25519-sha256 are supported; rsa-sha1
+// signatures and RSA keys under 1024 bits aren't trusted (RFC 8301).
+// dns nil iterates from the root servers with a resolver.Client.
+func Verify(ctx context.Context, dns Resolver, msg []byte) []Verdict {
+	if dns == nil {
+		dns = resolver.New()
+	}
+	msg = normalizeCRLF(msg)
+	header, body, ok := bytes.Cut(msg, []byte("\r\n\r\n"))
+	if !ok {
+		header, body = bytes.TrimSuffix(msg, []byte("\r\n")), nil
+	}
+	fields := splitHeaderFields(header)
+
+	var verdicts []Verdict
+	for i, field := range fields {
+		if strings.EqualFold(fieldName(field), "DKIM-Signature") {
+			verdicts = append(verdicts, verifySignature(ctx, dns, fields, i, body, false))
+		}
+	}
+	return verdicts
+}
+
+// the DKIM-Signature fields[index] or, with arc, an ARC-Message-Signature,
+// which has i= for the instance instead of v= and the identity
+func verifySignature(ctx context.Context, dns Resolver, fields []string, index int, body []byte, arc bool) Verdict {
+	sigField := fields[index]
+	_, value, _ := strings.Cut(sigField, ":")
+	tags, err := ParseTagList(value)
+	verdict := Verdict{Domain: tags["d"], Selector: tags["s"], Identity: tags["i"]}
+	if b := strings.Join(strings.Fields(tags["b"]), ""); len(b) > 8 {
+		verdict.Signature = b[:8]
+	}
+	fail := func(result Result, format string, args ...any) Verdict {
+		verdict.Result, verdict.Err = result, fmt.Errorf("dkim: "+format, args...)
+		return verdict
+	}
+	if err != nil {
+		return fail(PermError, "%v", err)
+	}
+
+	// RFC 6376 6.1.1
+	required := []string{"v", "a", "b", "bh", "d", "h", "s"}
+	if arc {
+		required[0] = "i"
+	}
+	for _, tag := range required {
+		if _, ok := tags[tag]; !ok {
+			return fail(PermError, "signature has no %s= tag", tag)
+		}
+	}
+	domain := strings.ToLower(strings.TrimSuffix(verdict.Domain, "."))
+	if !arc {
+		if tags["v"] != "1" {
+			return fail(PermError, "unsupported version %q", tags["v"])
+		}
+		if verdict.Identity == "" {
+			verdict.Identity = "@" + verdict.Domain
+		}
+		_, identityDomain, _ := strings.Cut(verdict.Identity, "@")
+		identityDomain = strings.ToLower(strings.TrimSuffix(identityDomain, "."))
+		if identityDomain != domain && !strings.HasSuffix(identityDomain, "."+domain) {
+			return fail(PermError, "i=%s is not in d=%s", verdict.Identity, verdict.Domain)
+		}
+	}
+	signedNames := strings.Split(tags["h"], ":")
+	for i := range signedNames {
+		signedNames[i] = strings.TrimSpace(signedNames[i])
+	}
+	if !containsFold(signedNames, "From") {
+		return fail(PermError, "From is not signed")
+	}
+	if x := tags["x"]; x != "" {
+		expires, err := strconv.ParseInt(x, 10, 64)
+		if err != nil {
+			return fail(PermError, "invalid x=%s", x)
+		}
+		if time.Now().Unix() > expires {
+			return fail(Fail, "signature expired at %s", time.Unix(expires, 0).UTC().Format(time.RFC3339))
+		}
+	}
+
+	var keyType string
+	switch strings.ToLower(tags["a"]) {
+	case "rsa-sha256":
+		keyType = "rsa"
+	case "ed25519-sha256":
+		keyType = "ed25519"
+	case "rsa-sha1":
+		return fail(Policy, "rsa-sha1 signatures are not trusted")
+	default:
+		return fail(Neutral, "unknown algorithm %q", tags["a"])
+	}
+	headerCanon, bodyCanon, _ := strings.Cut(strings.ToLower(tags["c"]), "/")
+	if headerCanon == "" {
+		headerCanon = "simple"
+	}
+	if bodyCanon == "" {
+		bodyCanon = "simple"
+	}
+	if headerCanon != "simple" && headerCanon != "relaxed" || bodyCanon != "simple" && bodyCanon != "relaxed" {
+		return fail(PermError, "unknown canonicalization %q", tags["c"])
+	}
+
+	// the body, as long as l= says
+	canonBody := simpleBody(body)
+	if bodyCanon == "relaxed" {
+		canonBody = relaxedBody(body)
+	}
+	if l := tags["l"]; l != "" {
+		length, err := strconv.ParseInt(l, 10, 64)
+		if err != nil || length < 0 || length > int64(len(canonBody)) {
+			return fail(PermError, "invalid body length l=%s", l)
+		}
+		canonBody = canonBody[:length]
+	}
+	bodyHash := sha256.Sum256(canonBody)
+	wantHash, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(tags["bh"]), ""))
+	if err != nil {
+		return fail(PermError, "invalid bh=")
+	}
+	if !bytes.Equal(bodyHash[:], wantHash) {
+		return fail(Fail, "body hash doesn't match, the body was changed")
+	}
+
+	// the signed header fields, bottom up for repeated names, then the
+	// signature field without its b= value
+	canon := func(field string) string {
+		if headerCanon == "relaxed" {
+			return relaxedHeader(field)
+		}
+		return field
+	}
+	used := map[int]bool{}
+	var signed strings.Builder
+	for _, name := range signedNames {
+		for i := len(fields) - 1; i >= 0; i-- {
+			if i == index || used[i] || !strings.EqualFold(fieldName(fields[i]), name) {
+				continue
+			}
+			used[i] = true
+			signed.WriteString(canon(fields[i]))
+			signed.WriteString("\r\n")
+			break
+		}
+	}
+	signed.WriteString(canon(withoutSignature(sigField)))
+
+	if result, err := checkHash(ctx, dns, verdict.Selector, domain, keyType, tags["b"], signed.String()); err != nil {
+		return fail(result, "%v", err)
+	}
+	verdict.Result = Pass
+	return verdict
+}
+
+// check b=, the signature of data with the key of selector at domain
+func checkHash(ctx context.Context, dns Resolver, selector, domain, keyType, b, data string) (Result, error) {
+	key, err := publicKey(ctx, dns, selector, domain, keyType)
+	if err != nil {
+		var temp tempError
+		if errors.As(err, &temp) {
+			return TempError, err
+		}
+		return PermError, err
+	}
+	signature, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(b), ""))
+	if err != nil {
+		return PermError, errors.New("invalid b=")
+	}
+	hashed := sha256.Sum256([]byte(data))
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		err = rsa.VerifyPKCS1v15(key, crypto.SHA256, hashed[:], signature)
+	case ed25519.PublicKey:
+		if !ed25519.Verify(key, hashed[:], signature) {
+			err = errors.New("invalid signature")
+		}
+	}
+	if err != nil {
+		return Fail, errors.New("signature doesn't verify, the header was changed")
+	}
+	return Pass, nil
+}
+
+// a DNS failure worth trying again
+type tempError struct{ error }
+
+// the key of selector._domainkey.domain (RFC 6376 3.6.1)
+func publicKey(ctx context.Context, dns Resolver, selector, domain, keyType string) (crypto.PublicKey, error) {
+	name := selector + "._domainkey." + domain
+	txts, err := dns.LookupTXT(ctx, name)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return nil, fmt.Errorf("no key at %s", name)
+		}
+		return nil, tempError{fmt.Errorf("key lookup: %w", err)}
+	}
+	if len(txts) != 1 {
+		return nil, fmt.Errorf("%d key records at %s", len(txts), name)
+	}
+	tags, err := ParseTagList(txts[0])
+	if err != nil {
+		return nil, fmt.Errorf("key record at %s: %w", name, err)
+	}
+	if v, ok := tags["v"]; ok && v != "DKIM1" {
+		return nil, fmt.Errorf("key record at %s: unsupported version %q", name, v)
+	}
+	if k := tags["k"]; k != "" && !strings.EqualFold(k, keyType) || k == "" && keyType != "rsa" {
+		return nil, fmt.Errorf("key at %s is not for %s", name, keyType)
+	}
+	if h := tags["h"]; h != "" && !containsFold(strings.Split(h, ":"), "sha256") {
+		return nil, fmt.Errorf("key at %s is not for sha256", name)
+	}
+	p := strings.Join(strings.Fields(tags["p"]), "")
+	if p == "" {
+		return nil, fmt.Errorf("key at %s was revoked", name)
+	}
+	data, err := base64.StdEncoding.DecodeString(p)
+	if err != nil {
+		return nil, fmt.Errorf("key at %s: invalid base64", name)
+	}
+	if keyType == "ed25519" {
+		// RFC 8463 4.2: the bare 32 bytes
+		if len(data) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("key at %s: invalid ed25519 key", name)
+		}
+		return ed25519.PublicKey(data), nil
+	}
+	// SubjectPublicKeyInfo, or bare PKCS #1 as some publish
+	var key *rsa.PublicKey
+	if parsed, err := x509.ParsePKIXPublicKey(data); err == nil {
+		key, _ = parsed.(*rsa.PublicKey)
+	} else {
+		key, _ = x509.ParsePKCS1PublicKey(data)
+	}
+	if key == nil {
+		return nil, fmt.Errorf("key at %s: invalid RSA key", name)
+	}
+	if key.N.BitLen() < 1024 {
+		return nil, fmt.Errorf("key at %s: %d bit RSA key is too short", name, key.N.BitLen())
+	}
+	return key, nil
+}
+
+// ParseTagList reads "v=1; a=rsa-sha256; ..." into a map, values with
+// folding whitespace trimmed at the ends (RFC 6376 3.2). DKIM signatures
+// and key records, ARC fields and DMARC records are written this way.
+func ParseTagList(list string) (map[string]string, error) {
+	tags := map[string]string{}
+	for _, spec := range strings.Split(list, ";") {
+		if strings.TrimSpace(spec) == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(spec, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("malformed tag %q", strings.TrimSpace(spec))
+		}
+		if _, dup := tags[name]; dup {
+			return nil, fmt.Errorf("duplicate tag %s=", name)
+		}
+		tags[name] = strings.TrimSpace(strings.ReplaceAll(value, "\r\n", ""))
+	}
+	return tags, nil
+}
+
+// the DKIM-Signature field with the value of its b= tag removed, as it
+// was signed
+func withoutSignature(field string) string {
+	name, value, _ := strings.Cut(field, ":")
+	specs := strings.Split(value, ";")
+	for i, spec := range specs {
+		tag, _, ok := strings.Cut(spec, "=")
+		if ok && strings.TrimSpace(tag) == "b" {
+			specs[i] = spec[:strings.IndexByte(spec, '=')+1]
+		}
+	}
+	return name + ":" + strings.Join(specs, ";")
+}
+
+// RFC 6376 3.4.3: the body as it is, without empty lines at the end, and
+// CRLF for an empty body
+func simpleBody(body []byte) []byte {
+	for bytes.HasSuffix(body, []byte("\r\n")) {
+		body = body[:len(body)-2]
+	}
+	return append(append([]byte(nil), body...), "\r\n"...)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// RFC 3461 delivery status notification request, sent along with the
+// envelope when the server advertises DSN and silently dropped otherwise
+type DSNOptions struct {
+	Notify     []string // SUCCESS, FAILURE and/or DELAY, or NEVER alone; empty leaves it to the server
+	Return     string   // FULL or HDRS: how much of the message a bounce includes
+	EnvelopeID string   // ENVID, echoed back in the notifications
+}
+
+func (d *DSNOptions) validate() error {
+	if d == nil {
+		return nil
+	}
+	for _, notify := range d.Notify {
+		switch strings.ToUpper(notify) {
+		case "SUCCESS", "FAILURE", "DELAY":
+		case "NEVER":
+			if len(d.Notify) > 1 {
+				return errors.New("DSN: NEVER can't be combined with other NOTIFY values")
+			}
+		default:
+			return fmt.Errorf("DSN: invalid NOTIFY value %q", notify)
+		}
+	}
+	switch strings.ToUpper(d.Return) {
+	case "", "FULL", "HDRS":
+	default:
+		return fmt.Errorf("DSN: invalid RET value %q", d.Return)
+	}
+	if len(d.EnvelopeID) > 100 {
+		return errors.New("DSN: ENVID longer than 100 characters")
+	}
+	for i := 0; i < len(d.EnvelopeID); i++ {
+		if d.EnvelopeID[i] < 32 || d.EnvelopeID[i] > 126 {
+			return errors.New("DSN: ENVID must be printable ASCII")
+		}
+	}
+	return nil
+}
+
+// RET and ENVID for MAIL FROM
+func (d *DSNOptions) mailParams() []string {
+	var params []string
+	if d.Return != "" {
+		params = append(params, "RET="+strings.ToUpper(d.Return))
+	}
+	if d.EnvelopeID != "" {
+		params = append(params, "ENVID="+xtext(d.EnvelopeID))
+	}
+	return params
+}
+
+// NOTIFY and ORCPT for RCPT TO
+func (d *DSNOptions) rcptParams(rcpt string) []string {
+	var params []string
+	if len(d.Notify) > 0 {
+		params = append(params, "NOTIFY="+strings.ToUpper(strings.Join(d.Notify, ",")))
+	}
+	// the original recipient, reported in the notification even after
+	// forwarding has rewritten the address
+	return append(params, "ORCPT=rfc822;"+xtext(rcpt))
+}
+
+// RFC 3461 4: "+", "=" and anything outside printable ASCII as +XX
+func xtext(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c < 33 || c > 126 || c == '+' || c == '=' {
+			fmt.Fprintf(&b, "+%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
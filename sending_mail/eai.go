@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/idna"
+)
+
+// Internationalized email (RFC 6530): addresses may have a UTF-8 local
+// part, and a domain in Unicode, which DNS knows by its A-label,
+// bücher.example as xn--bcher-kva.example. A server that announces
+// SMTPUTF8 takes them as they are. One that doesn't gets the domains as
+// A-labels, but a UTF-8 local part has no ASCII form, mail to or from one
+// can only go through a server with SMTPUTF8.
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// the domain as an A-label; ASCII domains and address literals as they
+// are
+func asciiDomain(domain string) (string, error) {
+	if isASCII(domain) || strings.HasPrefix(domain, "[") {
+		return domain, nil
+	}
+	ascii, err := idna.Lookup.ToASCII(domain)
+	if err != nil {
+		return "", fmt.Errorf("invalid domain %q: %w", domain, err)
+	}
+	return ascii, nil
+}
+
+// the address with an A-label domain, for a server without SMTPUTF8
+func asciiAddress(address string) (string, error) {
+	at := strings.LastIndexByte(address, '@')
+	if at < 0 {
+		return address, nil
+	}
+	if !isASCII(address[:at]) {
+		// the reply a server without SMTPUTF8 would give (RFC 6531 3.7.4.1)
+		return "", newSMTPError(&textproto.Error{
+			Code: 553,
+			Msg:  fmt.Sprintf("5.6.7 %s has a non-ASCII local part, which needs SMTPUTF8 the server doesn't have", address),
+		})
+	}
+	domain, err := asciiDomain(address[at+1:])
+	if err != nil {
+		return "", newSMTPError(&textproto.Error{Code: 553, Msg: "5.1.2 " + err.Error()})
+	}
+	return address[:at+1] + domain, nil
+}
+
+// addr for a header: with the domain as an A-label, so the header stays
+// ASCII, unless the local part needs SMTPUTF8 anyway
+func headerAddress(addr mail.Address) string {
+	if at := strings.LastIndexByte(addr.Address, '@'); at >= 0 && isASCII(addr.Address[:at]) {
+		if domain, err := asciiDomain(addr.Address[at+1:]); err == nil {
+			addr.Address = addr.Address[:at+1] + domain
+		}
+	}
+	return addr.String()
+}
+
+// the envelope address as the server can take it
+func (c *smtpClient) envelopeAddress(address string) (string, error) {
+	if ok, _ := c.Extension("SMTPUTF8"); ok || isASCII(address) {
+		return address, nil
+	}
+	return asciiAddress(address)
+}
+
+// an address that isn't ASCII must be UTF-8 with a domain IDNA takes;
+// the rest of its syntax is left to the server
+func checkUnicodeAddress(address string) error {
+	if isASCII(address) {
+		return nil
+	}
+	if !utf8.ValidString(address) {
+		return fmt.Errorf("address %q is not valid UTF-8", address)
+	}
+	if at := strings.LastIndexByte(address, '@'); at >= 0 {
+		if _, err := asciiDomain(address[at+1:]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
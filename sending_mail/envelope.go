@@ -0,0 +1,191 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"net/mail"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+// the SMTP envelope of one transaction
+type envelope struct {
+	From string
+	To   []string
+	DSN  *DSNOptions
+	Size int64 // message size in bytes, 0 if unknown
+}
+
+// from is the sender's default for MAIL FROM when EnvelopeFrom is empty
+func (e Email) envelope(from string, rcpts []string) envelope {
+	if e.EnvelopeFrom != "" {
+		from = e.EnvelopeFrom
+	}
+	return envelope{From: from, To: rcpts, DSN: e.DSN}
+}
+
+// the message for some of its envelope recipients only, the To and Cc
+// headers still show the original lists
+func (e Email) onlyTo(rcpts []string) Email {
+	keep := map[string]bool{}
+	for _, rcpt := range rcpts {
+		keep[rcpt] = true
+	}
+	filter := func(list []mail.Address) []mail.Address {
+		var kept []mail.Address
+		for _, addr := range list {
+			if keep[addr.Address] {
+				kept = append(kept, addr)
+			}
+		}
+		return kept
+	}
+
+	headers := map[string]string{}
+	if len(e.To) > 0 && !hasHeader(e.Headers, "To") {
+		headers["To"] = joinAddresses(e.To)
+	}
+	if len(e.Cc) > 0 && !hasHeader(e.Headers, "Cc") {
+		headers["Cc"] = joinAddresses(e.Cc)
+	}
+	maps.Copy(headers, e.Headers)
+
+	e.Headers = headers
+	e.To, e.Cc, e.Bcc = filter(e.To), filter(e.Cc), filter(e.Bcc)
+	return e
+}
+
+// MAIL FROM and RCPT TO for the whole envelope. With PIPELINING (RFC 2920)
+// all commands go out before the first reply is read, one round trip
+// instead of one per recipient.
+// A server without SMTPUTF8 gets the domains as A-labels; a recipient with
+// a UTF-8 local part fails without a command.
+func (c *smtpClient) sendEnvelope(env envelope) (mailErr error, rcptErrs []error) {
+	from, err := c.envelopeAddress(env.From)
+	if err != nil {
+		return err, nil
+	}
+	lines := []string{c.mailLine(env, from)}
+	rcptErrs = make([]error, len(env.To))
+	sent := []int{} // the recipients with a line, by index in env.To
+	for i, rcpt := range env.To {
+		address, err := c.envelopeAddress(rcpt)
+		if err != nil {
+			rcptErrs[i] = err
+			continue
+		}
+		lines = append(lines, c.rcptLine(env, rcpt, address))
+		sent = append(sent, i)
+	}
+	for _, line := range lines {
+		if err := checkLine(line); err != nil {
+			return err, nil
+		}
+	}
+
+	if ok, _ := c.Extension("PIPELINING"); !ok {
+		if err := c.cmd(250, lines[0]); err != nil {
+			return err, nil
+		}
+		for i, line := range lines[1:] {
+			rcptErrs[sent[i]] = c.cmd(25, line)
+			if isConnectionError(rcptErrs[sent[i]]) {
+				break
+			}
+		}
+		return nil, rcptErrs
+	}
+
+	ids := make([]uint, len(lines))
+	for i, line := range lines {
+		id, err := c.Text.Cmd("%s", line)
+		if err != nil {
+			return err, nil
+		}
+		ids[i] = id
+	}
+	// every reply has to be read, even after MAIL failed
+	mailErr = c.response(ids[0], 250)
+	for i, id := range ids[1:] {
+		rcptErrs[sent[i]] = c.response(id, 25)
+	}
+	return mailErr, rcptErrs
+}
+
+// RFC 1870: refuse before MAIL FROM what the server would only reject after
+// the whole message has been transferred
+func (c *smtpClient) checkSize(size int64) error {
+	ok, param := c.Extension("SIZE")
+	if !ok {
+		return nil
+	}
+	limit, err := strconv.ParseInt(param, 10, 64)
+	if err != nil || limit <= 0 || size <= limit {
+		return nil
+	}
+	// the reply the server would send, so the error classifies as permanent
+	return newSMTPError(&textproto.Error{
+		Code: 552,
+		Msg:  fmt.Sprintf("5.3.4 message is %d bytes, server accepts at most %d", size, limit),
+	})
+}
+
+// MAIL FROM with the ESMTP parameters net/smtp has no way to pass
+func (c *smtpClient) mailLine(env envelope, from string) string {
+	line := "MAIL FROM:<" + from + ">"
+	// the same parameters smtp.Client.Mail adds on its own
+	if ok, _ := c.Extension("8BITMIME"); ok {
+		line += " BODY=8BITMIME"
+	}
+	if ok, _ := c.Extension("SMTPUTF8"); ok {
+		line += " SMTPUTF8"
+	}
+	if ok, _ := c.Extension("SIZE"); ok && env.Size > 0 {
+		line += " SIZE=" + strconv.FormatInt(env.Size, 10)
+	}
+	if ok, _ := c.Extension("DSN"); ok && env.DSN != nil {
+		for _, param := range env.DSN.mailParams() {
+			line += " " + param
+		}
+	}
+	return line
+}
+
+// address is rcpt as the server takes it, ORCPT keeps rcpt
+func (c *smtpClient) rcptLine(env envelope, rcpt, address string) string {
+	line := "RCPT TO:<" + address + ">"
+	if ok, _ := c.Extension("DSN"); ok && env.DSN != nil {
+		for _, param := range env.DSN.rcptParams(rcpt) {
+			line += " " + param
+		}
+	}
+	return line
+}
+
+// a command with its reply, like smtp.Client does internally
+func (c *smtpClient) cmd(expectCode int, line string) error {
+	if err := checkLine(line); err != nil {
+		return err
+	}
+	id, err := c.Text.Cmd("%s", line)
+	if err != nil {
+		return err
+	}
+	return c.response(id, expectCode)
+}
+
+func (c *smtpClient) response(id uint, expectCode int) error {
+	c.Text.StartResponse(id)
+	defer c.Text.EndResponse(id)
+	_, _, err := c.Text.ReadResponse(expectCode)
+	return smtpError(err)
+}
+
+func checkLine(line string) error {
+	if strings.ContainsAny(line, "\r\n") {
+		return errors.New("smtp: A line must not contain CR or LF")
+	}
+	return nil
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// one of the accounts a FailoverSender sends through
+type Account struct {
+	Config SMTPConfig
+	Weight int // share of the messages with RoundRobin, default 1
+}
+
+// FailoverSender sends through several SMTP accounts. Normally the first
+// account gets every message and the next one only takes over when it
+// can't be reached, refuses the login or answers with a temporary failure;
+// with RoundRobin the messages are spread over the accounts by weight and
+// fail over the same way. An account that failed is tried last until its
+// Cooldown has passed.
+//
+// The SMTPConfig passed to Send is ignored, every account has its own.
+type FailoverSender struct {
+	Accounts   []Account
+	Sender     EmailSender   // default an AdvancedSender
+	RoundRobin bool          // spread messages over the accounts instead of using them in order
+	Cooldown   time.Duration // how long a failed account is avoided, default 1 minute
+
+	mu     sync.Mutex
+	health []AccountHealth
+	credit []int // smooth weighted round robin state
+}
+
+// what a FailoverSender has seen of one account
+type AccountHealth struct {
+	Host      string
+	Username  string
+	Sent      int       // messages the account took
+	Failures  int       // failures since the last message it took
+	LastError string    // of the last failure
+	DownUntil time.Time // avoided until then, zero when healthy
+}
+
+func (h AccountHealth) Healthy() bool {
+	return time.Now().After(h.DownUntil)
+}
+
+// implements the EmailSender interface
+func (f *FailoverSender) Send(ctx context.Context, _ SMTPConfig, email Email) error {
+	if err := email.Validate(); err != nil {
+		return err
+	}
+	if len(f.Accounts) == 0 {
+		return errors.New("no SMTP accounts configured")
+	}
+	sender := f.Sender
+	if sender == nil {
+		sender = AdvancedSender{}
+	}
+
+	rcpts := email.Recipients()
+	// the latest result per recipient, across accounts
+	final := map[string]RecipientResult{}
+	var err error
+	for _, i := range f.order() {
+		err = sender.Send(ctx, f.Accounts[i].Config, email)
+		if err == nil {
+			f.succeeded(i)
+			break
+		}
+
+		var delivery *DeliveryError
+		if errors.As(err, &delivery) {
+			for _, r := range delivery.Results {
+				final[r.Address] = r
+			}
+			deferred := delivery.with(Deferred)
+			if len(delivery.with(Accepted)) > 0 {
+				f.succeeded(i)
+			} else if len(deferred) > 0 {
+				f.failed(i, err)
+			}
+			if len(deferred) == 0 {
+				break
+			}
+			// the rest stays with the recipients this account deferred
+			left := make([]string, len(deferred))
+			for j, r := range deferred {
+				left[j] = r.Address
+			}
+			email = email.onlyTo(left)
+			continue
+		}
+
+		if ctx.Err() != nil || !failsOver(err) {
+			break
+		}
+		f.failed(i, err)
+	}
+
+	return mergeResults(rcpts, final, email.Recipients(), err)
+}
+
+// the state of every account, in Accounts order
+func (f *FailoverSender) Health() []AccountHealth {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.init()
+	return append([]AccountHealth(nil), f.health...)
+}
+
+// account indexes to try for one message: healthy accounts first, the
+// round robin pick or the configured order, then the failed ones by how
+// soon they come back
+func (f *FailoverSender) order() []int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.init()
+
+	var healthy, down []int
+	for i, h := range f.health {
+		if h.Healthy() {
+			healthy = append(healthy, i)
+		} else {
+			down = append(down, i)
+		}
+	}
+	sort.SliceStable(down, func(a, b int) bool {
+		return f.health[down[a]].DownUntil.Before(f.health[down[b]].DownUntil)
+	})
+
+	if f.RoundRobin && len(healthy) > 1 {
+		// smooth weighted round robin: every account earns its weight, the
+		// richest is picked and pays the total
+		total, pick := 0, 0
+		for j, i := range healthy {
+			weight := max(f.Accounts[i].Weight, 1)
+			total += weight
+			f.credit[i] += weight
+			if f.credit[i] > f.credit[healthy[pick]] {
+				pick = j
+			}
+		}
+		f.credit[healthy[pick]] -= total
+		healthy = append(healthy[pick:], healthy[:pick]...)
+	}
+	return append(healthy, down...)
+}
+
+// health entries for the configured accounts
+func (f *FailoverSender) init() {
+	if len(f.health) == len(f.Accounts) {
+		return
+	}
+	f.health = make([]AccountHealth, len(f.Accounts))
+	f.credit = make([]int, len(f.Accounts))
+	for i, account := range f.Accounts {
+		f.health[i] = AccountHealth{Host: account.Config.Host, Username: account.Config.Username}
+	}
+}
+
+func (f *FailoverSender) succeeded(i int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	h := &f.health[i]
+	h.Sent++
+	h.Failures = 0
+	h.DownUntil = time.Time{}
+}
+
+func (f *FailoverSender) failed(i int, err error) {
+	cooldown := f.Cooldown
+	if cooldown <= 0 {
+		cooldown = time.Minute
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	h := &f.health[i]
+	h.Failures++
+	h.LastError = err.Error()
+	h.DownUntil = time.Now().Add(cooldown)
+}
+
+// worth trying another account: the server is unreachable, refused the
+// login or answered with a temporary failure. A 5xx reply is about the
+// message and another account would get the same answer.
+func failsOver(err error) bool {
+	if errors.Is(err, ErrAuthFailed) {
+		return true
+	}
+	if smtpErr := AsSMTPError(err); smtpErr != nil {
+		return !smtpErr.Permanent()
+	}
+	return true
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/mail"
+	"testing"
+)
+
+func TestFailoverSender(t *testing.T) {
+	mock := &MockSender{}
+	f := &FailoverSender{
+		Accounts: []Account{
+			{Config: SMTPConfig{Host: "primary.example.com"}},
+			{Config: SMTPConfig{Host: "backup.example.com"}},
+		},
+		Sender: mock,
+	}
+	email := Email{
+		From:    mail.Address{Address: "sender@example.com"},
+		To:      []mail.Address{{Address: "a@example.com"}, {Address: "b@example.com"}},
+		Subject: "Report",
+		Body:    "<p>report</p>",
+	}
+
+	// a temporary failure moves the message to the next account
+	mock.FailNext(SMTPFailure(421, "4.3.2 try again later"))
+	if err := f.Send(context.Background(), SMTPConfig{}, email); err != nil {
+		t.Fatal(err)
+	}
+	mock.AssertCount(t, 1)
+	mock.AssertLastSubject(t, "Report")
+	if last, _ := mock.Last(); last.Config.Host != "backup.example.com" {
+		t.Errorf("sent through %s, want the backup", last.Config.Host)
+	}
+	if health := f.Health(); health[0].Healthy() || health[0].Failures != 1 {
+		t.Errorf("primary health %+v after a failure", health[0])
+	}
+
+	// a recipient refused for good isn't tried on the next account
+	mock.Reset()
+	mock.FailRecipient("b@example.com", SMTPFailure(550, "5.1.1 no such user"))
+	err := f.Send(context.Background(), SMTPConfig{}, email)
+	var delivery *DeliveryError
+	if !errors.As(err, &delivery) || len(delivery.with(Rejected)) != 1 {
+		t.Fatalf("got %v, want b@example.com rejected", err)
+	}
+	mock.AssertCount(t, 1)
+	mock.AssertSentTo(t, "a@example.com")
+	mock.AssertNotSentTo(t, "b@example.com")
+	mock.LastMessageBodyContains(t, "report")
+}
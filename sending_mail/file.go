@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// FileSender is a dry run: instead of connecting anywhere it writes each
+// message to Dir as an .eml file, exactly as it would have gone over the
+// wire, DKIM signature included. Mail clients open .eml files, so the
+// output can be checked before sending for real. Only the connection
+// settings in SMTPConfig are unused; Bcc recipients, which never appear in
+// the message, are not in the file either.
+type FileSender struct {
+	Dir string // created if missing, default the working directory
+}
+
+// implements the EmailSender interface
+func (s FileSender) Send(ctx context.Context, config SMTPConfig, email Email) error {
+	if err := email.Validate(); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	msg, err := config.payload(email, Email.WriteTo)
+	if err != nil {
+		return err
+	}
+
+	dir := s.Dir
+	if dir == "" {
+		dir = "."
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return fmt.Errorf("failed to create message directory: %w", err)
+	}
+	name, err := newQueueID()
+	if err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(dir, "."+name+".tmp")
+	if err := writeFileAtomic(tmp, filepath.Join(dir, name+".eml"), msg.write); err != nil {
+		return fmt.Errorf("failed to write message: %w", err)
+	}
+	return nil
+}
+
+// write a file under the temporary name tmp, on the same file system as
+// path, then rename it to path: a half-written file is never mistaken for
+// a whole one, and a crash leaves at most a stray tmp. The data is synced
+// before the rename so the file is complete once it has its name.
+func writeFileAtomic(tmp, path string, write func(io.Writer) error) error {
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	err = write(file)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// detected EHLO names by local address
+var heloNames sync.Map
+
+// the name to announce in EHLO on conn when none is configured. Receivers
+// check it: many refuse "localhost" or a bare host name, and some want it
+// to resolve. In order of preference the host name if it is fully
+// qualified, its canonical name in DNS or /etc/hosts, the reverse DNS name
+// of the address the connection comes from, and that address as a literal
+// (RFC 5321 4.1.3), which is always acceptable.
+func detectHeloName(ctx context.Context, conn net.Conn) string {
+	local, _ := netip.ParseAddrPort(conn.LocalAddr().String())
+	ip := local.Addr().Unmap()
+	if name, ok := heloNames.Load(ip); ok {
+		return name.(string)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	name := fqdnHostname(ctx)
+	if name == "" && ip.IsValid() && !ip.IsLoopback() {
+		if names, err := net.DefaultResolver.LookupAddr(ctx, ip.String()); err == nil && len(names) > 0 {
+			name = strings.TrimSuffix(names[0], ".")
+		}
+	}
+	switch {
+	case name != "":
+	case !ip.IsValid():
+		return "localhost"
+	case ip.Is4():
+		name = "[" + ip.String() + "]"
+	default:
+		name = "[IPv6:" + ip.String() + "]"
+	}
+	heloNames.Store(ip, name)
+	return name
+}
+
+// the host name if it is fully qualified or DNS knows it by one, "" if not
+func fqdnHostname(ctx context.Context) string {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		return ""
+	}
+	qualified := func(name string) bool {
+		name = strings.ToLower(strings.TrimSuffix(name, "."))
+		return strings.Contains(name, ".") && name != "localhost.localdomain" && !strings.HasSuffix(name, ".local")
+	}
+	if qualified(hostname) {
+		return strings.ToLower(hostname)
+	}
+	if cname, err := net.DefaultResolver.LookupCNAME(ctx, hostname); err == nil && qualified(cname) {
+		return strings.ToLower(strings.TrimSuffix(cname, "."))
+	}
+	return ""
+}
+
+func checkHeloName(name string) error {
+	if name == "" || strings.ContainsAny(name, " \t\r\n") {
+		return fmt.Errorf("invalid EHLO name %q", name)
+	}
+	return nil
+}
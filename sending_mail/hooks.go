@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// a func as EmailSender
+type SenderFunc func(ctx context.Context, config SMTPConfig, email Email) error
+
+func (f SenderFunc) Send(ctx context.Context, config SMTPConfig, email Email) error {
+	return f(ctx, config, email)
+}
+
+// Middleware adds behavior around a sender: counting, logging, changing
+// the email on its way out. See HookedSender for writing one from
+// callbacks.
+type Middleware func(EmailSender) EmailSender
+
+// sender wrapped in the middlewares, the first one outermost, eg.
+// Chain(AdvancedSender{}, metrics.Wrap, WithFooter(text, html))
+func Chain(sender EmailSender, middlewares ...Middleware) EmailSender {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		sender = middlewares[i](sender)
+	}
+	return sender
+}
+
+// one send as the hooks see it
+type SendEvent struct {
+	Config   SMTPConfig
+	Email    Email         // after BeforeSend
+	Err      error         // nil when every recipient took the message
+	Duration time.Duration // how long Sender took
+}
+
+// HookedSender calls its hooks around each send of Sender. Hooks that are
+// nil are skipped; they must be safe for concurrent use when the sender is.
+type HookedSender struct {
+	Sender EmailSender
+
+	// before the send, may change the email, eg. add a footer; slices and
+	// maps are the caller's, replace them instead of modifying them. An
+	// error cancels the send and is returned as is.
+	BeforeSend func(ctx context.Context, config SMTPConfig, email *Email) error
+
+	AfterSend func(ctx context.Context, event SendEvent) // after every send, failed or not
+	OnError   func(ctx context.Context, event SendEvent) // after a failed send, before AfterSend
+}
+
+// implements the EmailSender interface
+func (s HookedSender) Send(ctx context.Context, config SMTPConfig, email Email) error {
+	if s.BeforeSend != nil {
+		if err := s.BeforeSend(ctx, config, &email); err != nil {
+			return err
+		}
+	}
+	start := time.Now()
+	err := s.Sender.Send(ctx, config, email)
+	event := SendEvent{Config: config, Email: email, Err: err, Duration: time.Since(start)}
+	if err != nil && s.OnError != nil {
+		s.OnError(ctx, event)
+	}
+	if s.AfterSend != nil {
+		s.AfterSend(ctx, event)
+	}
+	return err
+}
+
+// SendMetrics counts the sends going through Wrap. It is an expvar.Var,
+// expvar.Publish("mail", metrics) shows the counters on /debug/vars.
+type SendMetrics struct {
+	mu    sync.Mutex
+	stats SendStats
+}
+
+type SendStats struct {
+	Messages int           // sends attempted
+	Failures int           // sends that returned an error
+	Accepted int           // recipients
+	Rejected int           // recipients, permanently
+	Deferred int           // recipients, temporarily or not tried at all
+	Duration time.Duration // spent sending, in total
+}
+
+// a Middleware
+func (m *SendMetrics) Wrap(sender EmailSender) EmailSender {
+	return HookedSender{Sender: sender, AfterSend: func(_ context.Context, event SendEvent) {
+		m.count(event)
+	}}
+}
+
+func (m *SendMetrics) count(event SendEvent) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.stats.Messages++
+	m.stats.Duration += event.Duration
+	if event.Err == nil {
+		m.stats.Accepted += len(event.Email.Recipients())
+		return
+	}
+	m.stats.Failures++
+	var deliveryErr *DeliveryError
+	if !errors.As(event.Err, &deliveryErr) {
+		m.stats.Deferred += len(event.Email.Recipients())
+		return
+	}
+	for _, result := range deliveryErr.Results {
+		switch result.Status {
+		case Accepted:
+			m.stats.Accepted++
+		case Rejected:
+			m.stats.Rejected++
+		default:
+			m.stats.Deferred++
+		}
+	}
+}
+
+// the counters so far
+func (m *SendMetrics) Stats() SendStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.stats
+}
+
+// the counters as JSON, for expvar
+func (m *SendMetrics) String() string {
+	data, _ := json.Marshal(m.Stats())
+	return string(data)
+}
+
+// a Middleware logging every send to logger, the standard logger if nil:
+// subject, recipient count, server, duration and the error if any
+func LogSends(logger *log.Logger) Middleware {
+	if logger == nil {
+		logger = log.Default()
+	}
+	return func(sender EmailSender) EmailSender {
+		return HookedSender{Sender: sender, AfterSend: func(_ context.Context, event SendEvent) {
+			n := len(event.Email.Recipients())
+			if event.Err != nil {
+				logger.Printf("send %q to %d recipients via %s failed after %v: %v", event.Email.Subject, n, event.Config.Host, event.Duration, event.Err)
+				return
+			}
+			logger.Printf("sent %q to %d recipients via %s in %v", event.Email.Subject, n, event.Config.Host, event.Duration)
+		}}
+	}
+}
+
+// a Middleware appending a footer to every email: text to the plain text
+// body, html to the html body before </body>. An empty one leaves its
+// body alone.
+func WithFooter(text, html string) Middleware {
+	return func(sender EmailSender) EmailSender {
+		return HookedSender{Sender: sender, BeforeSend: func(_ context.Context, _ SMTPConfig, email *Email) error {
+			if text != "" && email.TextBody != "" {
+				email.TextBody = strings.TrimRight(email.TextBody, "\n") + "\n\n" + text + "\n"
+			}
+			if html != "" && email.Body != "" {
+				i := len(email.Body) - len("</body>")
+				for i >= 0 && !strings.EqualFold(email.Body[i:i+len("</body>")], "</body>") {
+					i--
+				}
+				if i >= 0 {
+					email.Body = email.Body[:i] + html + email.Body[i:]
+				} else {
+					email.Body += html
+				}
+			}
+			return nil
+		}}
+	}
+}
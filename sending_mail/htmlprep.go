@@ -0,0 +1,540 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// HTMLPreprocessor readies html bodies for mail clients. Most of them
+// ignore <style> blocks, or some of their rules, so InlineCSS copies the
+// rules into the style attributes of the elements they select; the rules
+// that can't be, such as :hover and @media, stay in a <style> block for
+// the clients that read it. Sanitize drops what no client runs and some
+// filters count against a message: scripts, frames, forms, event handler
+// attributes and javascript: links. It is worth it for templates that come
+// from users, or from a web page. Text fills in the plain text body of an
+// email that has only an html one, see HTMLToText.
+type HTMLPreprocessor struct {
+	InlineCSS bool
+	Sanitize  bool
+	Text      bool
+}
+
+// the body processed; an empty body stays empty
+func (p HTMLPreprocessor) Process(body string) (string, error) {
+	if body == "" || !p.InlineCSS && !p.Sanitize {
+		return body, nil
+	}
+	// a whole document is rendered as one, a fragment, as templates often
+	// are, as a fragment
+	document := strings.Contains(strings.ToLower(body), "<html")
+	var root *html.Node
+	if document {
+		doc, err := html.Parse(strings.NewReader(body))
+		if err != nil {
+			return "", fmt.Errorf("html: %w", err)
+		}
+		root = doc
+	} else {
+		root = &html.Node{Type: html.ElementNode, Data: "body", DataAtom: atom.Body}
+		fragment, err := html.ParseFragment(strings.NewReader(body), root)
+		if err != nil {
+			return "", fmt.Errorf("html: %w", err)
+		}
+		// parented, so the selectors have an element above them to match
+		for _, node := range fragment {
+			root.AppendChild(node)
+		}
+	}
+
+	if p.Sanitize {
+		sanitizeNode(root)
+	}
+	if p.InlineCSS {
+		inlineStyles(root)
+	}
+
+	var out strings.Builder
+	if document {
+		if err := html.Render(&out, root); err != nil {
+			return "", err
+		}
+		return out.String(), nil
+	}
+	for node := root.FirstChild; node != nil; node = node.NextSibling {
+		if err := html.Render(&out, node); err != nil {
+			return "", err
+		}
+	}
+	return out.String(), nil
+}
+
+// a Middleware processing the html body of every email, and with Text
+// deriving its plain text body
+func (p HTMLPreprocessor) Wrap(sender EmailSender) EmailSender {
+	return HookedSender{Sender: sender, BeforeSend: func(_ context.Context, _ SMTPConfig, email *Email) error {
+		body, err := p.Process(email.Body)
+		if err != nil {
+			return err
+		}
+		email.Body = body
+		if p.Text && email.TextBody == "" && body != "" {
+			if email.TextBody, err = HTMLToText(body); err != nil {
+				return err
+			}
+		}
+		return nil
+	}}
+}
+
+// the elements Sanitize removes, content and all
+var unsafeElements = map[atom.Atom]bool{
+	atom.Script: true, atom.Noscript: true, atom.Iframe: true, atom.Frame: true, atom.Frameset: true,
+	atom.Object: true, atom.Embed: true, atom.Applet: true, atom.Base: true, atom.Link: true,
+	atom.Form: true, atom.Input: true, atom.Button: true, atom.Select: true, atom.Textarea: true,
+	atom.Svg: true, atom.Math: true,
+}
+
+// the attributes that hold a URL
+var urlAttributes = map[string]bool{
+	"href": true, "src": true, "action": true, "formaction": true, "background": true,
+	"poster": true, "xlink:href": true, "lowsrc": true, "dynsrc": true, "cite": true,
+}
+
+func sanitizeNode(n *html.Node) {
+	for child := n.FirstChild; child != nil; {
+		next := child.NextSibling
+		switch {
+		case child.Type == html.ElementNode && (unsafeElements[child.DataAtom] || child.DataAtom == atom.Meta && hasAttr(child, "http-equiv")):
+			n.RemoveChild(child)
+		case child.Type == html.CommentNode && strings.Contains(strings.ToLower(child.Data), "<script"):
+			// conditional comments for Outlook are kept, unless they hide a
+			// script
+			n.RemoveChild(child)
+		case child.Type == html.ElementNode:
+			child.Attr = slices.DeleteFunc(child.Attr, unsafeAttr)
+			sanitizeNode(child)
+		}
+		child = next
+	}
+}
+
+func unsafeAttr(attr html.Attribute) bool {
+	key := strings.ToLower(attr.Key)
+	value := strings.ToLower(strings.Join(strings.Fields(attr.Val), ""))
+	switch {
+	case strings.HasPrefix(key, "on"), key == "srcdoc":
+		return true
+	case urlAttributes[key]:
+		// images may be data: URLs, everything else may not
+		return strings.HasPrefix(value, "javascript:") || strings.HasPrefix(value, "vbscript:") ||
+			strings.HasPrefix(value, "data:") && (key != "src" || !strings.HasPrefix(value, "data:image/"))
+	case key == "style":
+		return strings.Contains(value, "expression(") || strings.Contains(value, "javascript:") ||
+			strings.Contains(value, "behavior:") || strings.Contains(value, "-moz-binding")
+	}
+	return false
+}
+
+func hasAttr(n *html.Node, key string) bool {
+	_, ok := getAttr(n, key)
+	return ok
+}
+
+func getAttr(n *html.Node, key string) (string, bool) {
+	for _, attr := range n.Attr {
+		if strings.EqualFold(attr.Key, key) {
+			return attr.Val, true
+		}
+	}
+	return "", false
+}
+
+func setAttr(n *html.Node, key, value string) {
+	for i, attr := range n.Attr {
+		if strings.EqualFold(attr.Key, key) {
+			n.Attr[i].Val = value
+			return
+		}
+	}
+	n.Attr = append(n.Attr, html.Attribute{Key: key, Val: value})
+}
+
+// a rule of a style block
+type cssRule struct {
+	selector    []cssCompound // the last one is the element's, the others above it
+	specificity [3]int        // ids, classes and attributes, types
+	order       int
+	decls       []cssDeclaration
+}
+
+// eg. td.note[align] with > before it: a child of the one before
+type cssCompound struct {
+	tag     string // "" or "*" for any
+	id      string
+	classes []string
+	attrs   [][2]string // name and value, value "" for present
+	child   bool
+}
+
+type cssDeclaration struct {
+	property, value string
+	important       bool
+}
+
+// move the rules of the style blocks into style attributes, leaving the
+// rest in their blocks and dropping the blocks that end up empty
+func inlineStyles(root *html.Node) {
+	var rules []cssRule
+	var blocks []*html.Node
+	walkElements(root, func(n *html.Node) {
+		if n.DataAtom != atom.Style || n.FirstChild == nil || n.FirstChild.Type != html.TextNode {
+			return
+		}
+		if media, ok := getAttr(n, "media"); ok && !strings.EqualFold(strings.TrimSpace(media), "all") && !strings.EqualFold(strings.TrimSpace(media), "screen") {
+			return // for print, or some screens: not for every element
+		}
+		inlinable, rest := parseStylesheet(n.FirstChild.Data, len(rules))
+		rules = append(rules, inlinable...)
+		n.FirstChild.Data = rest
+		blocks = append(blocks, n)
+	})
+	if len(rules) == 0 {
+		return
+	}
+
+	walkElements(root, func(n *html.Node) {
+		switch n.DataAtom {
+		case atom.Style, atom.Head, atom.Title, atom.Meta, atom.Script:
+			return
+		}
+		var matched []cssRule
+		for _, rule := range rules {
+			if matchSelector(n, rule.selector) {
+				matched = append(matched, rule)
+			}
+		}
+		if len(matched) == 0 {
+			return
+		}
+		// the cascade: !important first, then specificity, then order; the
+		// style attribute beats every rule but an !important one
+		sort.SliceStable(matched, func(i, j int) bool {
+			a, b := matched[i], matched[j]
+			if a.specificity != b.specificity {
+				return slices.Compare(a.specificity[:], b.specificity[:]) < 0
+			}
+			return a.order < b.order
+		})
+		var values []string
+		byProperty := map[string]int{}
+		important := map[string]bool{}
+		set := func(d cssDeclaration) {
+			i, ok := byProperty[d.property]
+			if ok && important[d.property] && !d.important {
+				return
+			}
+			value := d.property + ": " + d.value
+			if d.important {
+				value += " !important"
+				important[d.property] = true
+			}
+			if ok {
+				values[i] = value
+				return
+			}
+			byProperty[d.property] = len(values)
+			values = append(values, value)
+		}
+		for _, rule := range matched {
+			for _, d := range rule.decls {
+				set(d)
+			}
+		}
+		if style, ok := getAttr(n, "style"); ok {
+			for _, d := range parseDeclarations(style) {
+				set(d)
+			}
+		}
+		setAttr(n, "style", strings.Join(values, "; "))
+	})
+
+	for _, block := range blocks {
+		if strings.TrimSpace(block.FirstChild.Data) == "" {
+			block.Parent.RemoveChild(block)
+		}
+	}
+}
+
+func walkElements(n *html.Node, f func(*html.Node)) {
+	for child := n.FirstChild; child != nil; child = child.NextSibling {
+		if child.Type == html.ElementNode {
+			f(child)
+			walkElements(child, f)
+		}
+	}
+}
+
+// the rules of a style block that can be inlined, numbered from order,
+// and the text of the others: at-rules, and selectors with pseudo-classes
+// or sibling combinators
+func parseStylesheet(css string, order int) ([]cssRule, string) {
+	css = stripCSSComments(css)
+	var rules []cssRule
+	var rest strings.Builder
+	for {
+		css = strings.TrimSpace(css)
+		if css == "" {
+			break
+		}
+		open := strings.IndexByte(css, '{')
+		if strings.HasPrefix(css, "@") {
+			// @import and @charset end at ;, blocks like @media at their
+			// closing brace
+			if semi := strings.IndexByte(css, ';'); semi >= 0 && (open < 0 || semi < open) {
+				rest.WriteString(css[:semi+1] + "\n")
+				css = css[semi+1:]
+				continue
+			}
+		}
+		if open < 0 {
+			break
+		}
+		end := matchingBrace(css, open)
+		prelude, body := strings.TrimSpace(css[:open]), css[open+1:end]
+		block := css[:min(end+1, len(css))]
+		css = css[min(end+1, len(css)):]
+		if strings.HasPrefix(prelude, "@") {
+			rest.WriteString(block + "\n")
+			continue
+		}
+
+		decls := parseDeclarations(body)
+		var kept []string
+		for _, selector := range strings.Split(prelude, ",") {
+			selector = strings.TrimSpace(selector)
+			compounds, specificity, ok := parseSelector(selector)
+			if !ok {
+				kept = append(kept, selector)
+				continue
+			}
+			rules = append(rules, cssRule{selector: compounds, specificity: specificity, order: order, decls: decls})
+			order++
+		}
+		if len(kept) > 0 {
+			rest.WriteString(strings.Join(kept, ", ") + " {" + body + "}\n")
+		}
+	}
+	return rules, rest.String()
+}
+
+func stripCSSComments(css string) string {
+	for {
+		start := strings.Index(css, "/*")
+		if start < 0 {
+			return css
+		}
+		end := strings.Index(css[start+2:], "*/")
+		if end < 0 {
+			return css[:start]
+		}
+		css = css[:start] + " " + css[start+2+end+2:]
+	}
+}
+
+// the index of the brace closing the one at open, len(s) if none does
+func matchingBrace(s string, open int) int {
+	depth := 0
+	for i := open; i < len(s); i++ {
+		switch s[i] {
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return len(s)
+}
+
+// "color: red; font: 12px 'A;B' !important", split where quotes and
+// parentheses allow
+func parseDeclarations(s string) []cssDeclaration {
+	var decls []cssDeclaration
+	var quote byte
+	depth, start := 0, 0
+	for i := 0; i <= len(s); i++ {
+		if i < len(s) {
+			switch c := s[i]; {
+			case quote != 0:
+				if c == quote {
+					quote = 0
+				}
+				continue
+			case c == '"' || c == '\'':
+				quote = c
+				continue
+			case c == '(':
+				depth++
+				continue
+			case c == ')':
+				depth--
+				continue
+			case c != ';' || depth > 0:
+				continue
+			}
+		}
+		property, value, ok := strings.Cut(s[start:i], ":")
+		start = i + 1
+		property = strings.ToLower(strings.TrimSpace(property))
+		value = strings.TrimSpace(value)
+		if !ok || property == "" || value == "" {
+			continue
+		}
+		d := cssDeclaration{property: property, value: value}
+		if lower := strings.ToLower(value); strings.HasSuffix(lower, "!important") {
+			d.value = strings.TrimSpace(value[:len(value)-len("!important")])
+			d.important = true
+		}
+		decls = append(decls, d)
+	}
+	return decls
+}
+
+// the compounds of a selector, if it can be matched against an element
+// without knowing its state or its siblings
+func parseSelector(selector string) ([]cssCompound, [3]int, bool) {
+	var specificity [3]int
+	if selector == "" || strings.ContainsAny(selector, ":+~|\\") {
+		return nil, specificity, false
+	}
+	selector = strings.ReplaceAll(selector, ">", " > ")
+	var compounds []cssCompound
+	child := false
+	for _, part := range strings.Fields(selector) {
+		if part == ">" {
+			if child || len(compounds) == 0 {
+				return nil, specificity, false
+			}
+			child = true
+			continue
+		}
+		compound, ok := parseCompound(part, &specificity)
+		if !ok {
+			return nil, specificity, false
+		}
+		compound.child, child = child, false
+		compounds = append(compounds, compound)
+	}
+	if child || len(compounds) == 0 {
+		return nil, specificity, false
+	}
+	return compounds, specificity, true
+}
+
+// eg. td.note#main[align=center]
+func parseCompound(s string, specificity *[3]int) (cssCompound, bool) {
+	var c cssCompound
+	i := strings.IndexAny(s, ".#[")
+	if i < 0 {
+		i = len(s)
+	}
+	c.tag = strings.ToLower(s[:i])
+	if c.tag != "" && c.tag != "*" {
+		specificity[2]++
+	}
+	s = s[i:]
+	for s != "" {
+		kind := s[0]
+		s = s[1:]
+		if kind == '[' {
+			end := strings.IndexByte(s, ']')
+			if end < 0 {
+				return c, false
+			}
+			name, value, _ := strings.Cut(s[:end], "=")
+			if strings.ContainsAny(name, "^$*") {
+				return c, false
+			}
+			c.attrs = append(c.attrs, [2]string{strings.ToLower(strings.TrimSpace(name)), strings.Trim(strings.TrimSpace(value), `"'`)})
+			specificity[1]++
+			s = s[end+1:]
+			continue
+		}
+		end := strings.IndexAny(s, ".#[")
+		if end < 0 {
+			end = len(s)
+		}
+		if end == 0 {
+			return c, false
+		}
+		switch kind {
+		case '.':
+			c.classes = append(c.classes, s[:end])
+			specificity[1]++
+		case '#':
+			c.id = s[:end]
+			specificity[0]++
+		default:
+			return c, false
+		}
+		s = s[end:]
+	}
+	return c, true
+}
+
+// whether n is the element selector, its compounds outermost first,
+// selects
+func matchSelector(n *html.Node, selector []cssCompound) bool {
+	last := len(selector) - 1
+	if !matchCompound(n, selector[last]) {
+		return false
+	}
+	if last == 0 {
+		return true
+	}
+	for parent := n.Parent; parent != nil && parent.Type == html.ElementNode; parent = parent.Parent {
+		if matchSelector(parent, selector[:last]) {
+			return true
+		}
+		if selector[last].child {
+			return false
+		}
+	}
+	return false
+}
+
+func matchCompound(n *html.Node, c cssCompound) bool {
+	if c.tag != "" && c.tag != "*" && c.tag != n.Data {
+		return false
+	}
+	if c.id != "" {
+		if id, _ := getAttr(n, "id"); id != c.id {
+			return false
+		}
+	}
+	if len(c.classes) > 0 {
+		class, _ := getAttr(n, "class")
+		classes := strings.Fields(class)
+		for _, want := range c.classes {
+			if !slices.Contains(classes, want) {
+				return false
+			}
+		}
+	}
+	for _, attr := range c.attrs {
+		value, ok := getAttr(n, attr[0])
+		if !ok || attr[1] != "" && value != attr[1] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// HTMLToText renders an html body as readable plain text for the
+// text/plain alternative: paragraphs and list items on lines of their
+// own, headings underlined or marked with #, quotes with >, and links as
+// numbered footnotes, "the docs[1]" with "[1] https://..." at the end.
+func HTMLToText(body string) (string, error) {
+	doc, err := html.Parse(strings.NewReader(body))
+	if err != nil {
+		return "", fmt.Errorf("html: %w", err)
+	}
+	r := &textRenderer{}
+	r.render(doc)
+	text := strings.TrimSpace(r.out.String())
+	if len(r.links) > 0 {
+		text += "\n\n"
+		for i, link := range r.links {
+			text += fmt.Sprintf("[%d] %s\n", i+1, link)
+		}
+	}
+	return strings.TrimRight(text, "\n") + "\n", nil
+}
+
+type textRenderer struct {
+	out      strings.Builder
+	links    []string
+	newlines int    // at the end of out, 0 in the middle of a line
+	pending  int    // newlines wanted before the next text
+	space    bool   // whitespace to write before the next word
+	quote    string // "> " per blockquote
+	pre      int    // inside <pre>, whitespace is kept
+	list     []int  // per open list, the number of the next item, -1 for bullets
+}
+
+// the next text on a line of its own, or with a blank line before it
+// when blank; nothing at the start of the text
+func (r *textRenderer) block(blank bool) {
+	if r.out.Len() == 0 {
+		return
+	}
+	want := 1
+	if blank {
+		want = 2
+	}
+	r.pending = max(r.pending, want)
+	r.space = false
+}
+
+// the pending newlines written
+func (r *textRenderer) flush() {
+	for ; r.newlines < r.pending; r.newlines++ {
+		if r.newlines > 0 {
+			// a blank line, inside a quote if the text after it is
+			r.out.WriteString(strings.TrimRight(r.quote, " "))
+		}
+		r.out.WriteString("\n")
+	}
+	r.pending = 0
+}
+
+func (r *textRenderer) write(s string) {
+	if s == "" {
+		return
+	}
+	r.flush()
+	if r.newlines > 0 || r.out.Len() == 0 {
+		r.out.WriteString(r.quote)
+	} else if r.space {
+		r.out.WriteString(" ")
+	}
+	r.out.WriteString(s)
+	r.newlines, r.space = 0, false
+}
+
+func (r *textRenderer) text(s string) {
+	if r.pre > 0 {
+		for i, line := range strings.Split(s, "\n") {
+			if i > 0 {
+				r.out.WriteString("\n")
+				r.newlines++
+			}
+			if line != "" {
+				r.write(line)
+			}
+		}
+		return
+	}
+	if s != "" && strings.TrimLeft(s, " \t\r\n\f") != s {
+		r.space = true
+	}
+	words := strings.Fields(s)
+	for i, word := range words {
+		if i > 0 {
+			r.space = true
+		}
+		r.write(word)
+	}
+	if len(words) > 0 && strings.TrimRight(s, " \t\r\n\f") != s {
+		r.space = true
+	}
+}
+
+// the text of n, to underline a heading
+func nodeText(n *html.Node) string {
+	var b strings.Builder
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.TextNode {
+			b.WriteString(n.Data)
+		}
+		for child := n.FirstChild; child != nil; child = child.NextSibling {
+			walk(child)
+		}
+	}
+	walk(n)
+	return strings.Join(strings.Fields(b.String()), " ")
+}
+
+func (r *textRenderer) children(n *html.Node) {
+	for child := n.FirstChild; child != nil; child = child.NextSibling {
+		r.render(child)
+	}
+}
+
+func (r *textRenderer) render(n *html.Node) {
+	switch n.Type {
+	case html.TextNode:
+		r.text(n.Data)
+		return
+	case html.DocumentNode:
+		r.children(n)
+		return
+	case html.ElementNode:
+	default:
+		return
+	}
+
+	switch n.DataAtom {
+	case atom.Head, atom.Style, atom.Script, atom.Title, atom.Noscript, atom.Template:
+	case atom.Br:
+		r.out.WriteString("\n")
+		r.newlines++
+		r.space = false
+	case atom.Hr:
+		r.block(true)
+		r.write(strings.Repeat("-", 40))
+		r.block(true)
+	case atom.H1, atom.H2:
+		r.block(true)
+		text := nodeText(n)
+		underline := "="
+		if n.DataAtom == atom.H2 {
+			underline = "-"
+		}
+		r.write(text)
+		r.block(false)
+		r.write(strings.Repeat(underline, max(len([]rune(text)), 3)))
+		r.block(true)
+	case atom.H3, atom.H4, atom.H5, atom.H6:
+		r.block(true)
+		level, _ := strconv.Atoi(n.Data[1:])
+		r.write(strings.Repeat("#", level))
+		r.space = true
+		r.children(n)
+		r.block(true)
+	case atom.P, atom.Div, atom.Table, atom.Section, atom.Article, atom.Header, atom.Footer, atom.Address, atom.Center:
+		blank := n.DataAtom != atom.Div
+		r.block(blank)
+		r.children(n)
+		r.block(blank)
+	case atom.Tr:
+		r.block(false)
+		r.children(n)
+		r.block(false)
+	case atom.Td, atom.Th:
+		r.space = true
+		r.children(n)
+		r.space = true
+	case atom.Ul, atom.Ol:
+		r.block(len(r.list) == 0)
+		number := -1
+		if n.DataAtom == atom.Ol {
+			number = 1
+			if start, err := strconv.Atoi(attrValue(n, "start")); err == nil {
+				number = start
+			}
+		}
+		r.list = append(r.list, number)
+		r.children(n)
+		r.list = r.list[:len(r.list)-1]
+		r.block(len(r.list) == 0)
+	case atom.Li:
+		r.block(false)
+		indent := strings.Repeat("  ", max(len(r.list)-1, 0))
+		marker := "*"
+		if len(r.list) > 0 && r.list[len(r.list)-1] >= 0 {
+			marker = strconv.Itoa(r.list[len(r.list)-1]) + "."
+			r.list[len(r.list)-1]++
+		}
+		r.write(indent + marker)
+		r.space = true
+		r.children(n)
+		r.block(false)
+	case atom.Blockquote:
+		r.block(true)
+		r.flush()
+		r.quote += "> "
+		r.children(n)
+		r.block(false)
+		r.quote = r.quote[:len(r.quote)-2]
+		r.block(true)
+	case atom.Pre:
+		r.block(true)
+		r.pre++
+		r.children(n)
+		r.pre--
+		r.block(true)
+	case atom.A:
+		r.children(n)
+		r.link(n)
+	case atom.Img:
+		if alt := strings.TrimSpace(attrValue(n, "alt")); alt != "" {
+			r.write("[" + alt + "]")
+		}
+	default:
+		r.children(n)
+	}
+}
+
+// the footnote of a link, after its text; a link that reads the same as
+// its text, and one to an anchor in the page, has none
+func (r *textRenderer) link(n *html.Node) {
+	href := strings.TrimSpace(attrValue(n, "href"))
+	text := nodeText(n)
+	switch {
+	case href == "" || strings.HasPrefix(href, "#"):
+		return
+	case strings.HasPrefix(strings.ToLower(href), "mailto:"):
+		if address, _, _ := strings.Cut(href[len("mailto:"):], "?"); address != text {
+			r.space = true
+			r.write("<" + address + ">")
+		}
+		return
+	case href == text || strings.TrimSuffix(href, "/") == text:
+		return
+	}
+	if text == "" {
+		r.write(href)
+		return
+	}
+	r.links = append(r.links, href)
+	space := r.space
+	r.space = false
+	r.write(fmt.Sprintf("[%d]", len(r.links)))
+	r.space = space
+}
+
+func attrValue(n *html.Node, key string) string {
+	value, _ := getAttr(n, key)
+	return value
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// SentKeys remembers the idempotency keys of the emails sent lately, in a
+// JSON file, so an email sent a second time with the same
+// Email.IdempotencyKey is skipped: application code that retries after a
+// timeout, or runs twice after a crash, can't send an invoice twice. An
+// email counts as sent once any recipient accepted it; the ones that
+// didn't get it are the sender's retries to take care of, not the
+// application's.
+//
+// Keys are kept for TTL. The file belongs to one process, two processes
+// sharing it would overwrite each other's keys.
+type SentKeys struct {
+	Path string        // the JSON file, "" to keep the keys in memory only
+	TTL  time.Duration // default 7 days
+
+	mu      sync.Mutex
+	keys    map[string]sentKey
+	pending map[string]chan struct{} // keys being sent right now
+	loaded  bool
+}
+
+type sentKey struct {
+	Sent time.Time `json:"sent"`
+	ID   string    `json:"id,omitempty"` // the Queue ID it went out under
+}
+
+// a Middleware skipping emails with a key that was sent already; emails
+// without a key pass as they are
+func (s *SentKeys) Wrap(sender EmailSender) EmailSender {
+	return SenderFunc(func(ctx context.Context, config SMTPConfig, email Email) error {
+		return s.once(ctx, email.IdempotencyKey, func() error {
+			return sender.Send(ctx, config, email)
+		})
+	})
+}
+
+// whether key was sent within TTL
+func (s *SentKeys) Sent(key string) bool {
+	_, ok := s.lookup(key)
+	return ok
+}
+
+func (s *SentKeys) lookup(key string) (sentKey, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		log.Printf("idempotency keys: %v", err)
+	}
+	entry, ok := s.keys[key]
+	if ok && time.Since(entry.Sent) > s.ttl() {
+		return sentKey{}, false
+	}
+	return entry, ok
+}
+
+// send unless key was sent already. A send of the same key that is under
+// way is waited for, and the second one goes ahead only if the first one
+// failed.
+func (s *SentKeys) once(ctx context.Context, key string, send func() error) error {
+	if key == "" {
+		return send()
+	}
+	for {
+		s.mu.Lock()
+		if err := s.load(); err != nil {
+			// sending twice is what the keys are for, better not to send
+			s.mu.Unlock()
+			return err
+		}
+		if entry, ok := s.keys[key]; ok && time.Since(entry.Sent) <= s.ttl() {
+			s.mu.Unlock()
+			log.Printf("idempotency keys: skipping %q, sent at %s", key, entry.Sent.Format(time.RFC3339))
+			return nil
+		}
+		done, busy := s.pending[key]
+		if !busy {
+			break // still locked
+		}
+		s.mu.Unlock()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	done := make(chan struct{})
+	s.pending[key] = done
+	s.mu.Unlock()
+
+	err := send()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.pending, key)
+	close(done)
+	if anyAccepted(err) {
+		if err := s.add(key, ""); err != nil {
+			log.Printf("idempotency keys: %q sent but not saved: %v", key, err)
+		}
+	}
+	return err
+}
+
+// record key as sent, under the Queue ID id
+func (s *SentKeys) record(key, id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.add(key, id); err != nil {
+		log.Printf("idempotency keys: %q sent but not saved: %v", key, err)
+	}
+}
+
+// record key as sent; s.mu is held
+func (s *SentKeys) add(key, id string) error {
+	if err := s.load(); err != nil {
+		return err
+	}
+	s.keys[key] = sentKey{Sent: time.Now(), ID: id}
+	return s.save()
+}
+
+// whether a send that returned err reached at least one recipient
+func anyAccepted(err error) bool {
+	if err == nil {
+		return true
+	}
+	var delivery *DeliveryError
+	return errors.As(err, &delivery) && len(delivery.with(Accepted)) > 0
+}
+
+func (s *SentKeys) ttl() time.Duration {
+	if s.TTL <= 0 {
+		return 7 * 24 * time.Hour
+	}
+	return s.TTL
+}
+
+// read the file on first use; s.mu is held
+func (s *SentKeys) load() error {
+	if s.loaded {
+		return nil
+	}
+	s.keys = map[string]sentKey{}
+	s.pending = map[string]chan struct{}{}
+	if s.Path != "" {
+		data, err := os.ReadFile(s.Path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to read %s: %w", s.Path, err)
+		}
+		if len(data) > 0 {
+			if err := json.Unmarshal(data, &s.keys); err != nil {
+				return fmt.Errorf("failed to read %s: %w", s.Path, err)
+			}
+		}
+	}
+	s.loaded = true
+	return nil
+}
+
+// write the keys still within TTL; s.mu is held
+func (s *SentKeys) save() error {
+	for key, entry := range s.keys {
+		if time.Since(entry.Sent) > s.ttl() {
+			delete(s.keys, key)
+		}
+	}
+	if s.Path == "" {
+		return nil
+	}
+	data, err := json.Marshal(s.keys)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(filepath.Dir(s.Path), "."+filepath.Base(s.Path)+".tmp")
+	os.Remove(tmp) // left over from a crash in an earlier save
+	return writeFileAtomic(tmp, s.Path, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
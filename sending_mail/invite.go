@@ -0,0 +1,306 @@
+package main
+
+import (
+	"fmt"
+	"net/mail"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Invite makes an Email a meeting invitation: a text/calendar part
+// (RFC 5545, with the iTIP method of RFC 5546) next to the text and html
+// bodies, which Outlook, Gmail and Apple Mail show with their accept and
+// decline buttons. Clients without calendar support show the text.
+//
+// An update is the same UID with a higher Sequence, a cancellation the
+// same UID with Method "CANCEL".
+type Invite struct {
+	UID         string // stable across updates, generated when empty
+	Sequence    int
+	Method      string // REQUEST (default), CANCEL or PUBLISH
+	Summary     string
+	Description string
+	Location    string
+
+	// the times keep their time.Location: an event in Europe/Berlin is sent
+	// with that TZID and its rules, UTC and Local times are sent as UTC
+	Start  time.Time
+	End    time.Time
+	AllDay bool // Start and End are dates, End is the last day
+
+	Organizer mail.Address
+	Attendees []mail.Address // default the To and Cc addresses
+
+	stamp time.Time // DTSTAMP, fixed so both passes of a send agree
+}
+
+func (i *Invite) method() string {
+	if i.Method == "" {
+		return "REQUEST"
+	}
+	return strings.ToUpper(i.Method)
+}
+
+func (i *Invite) validate() error {
+	if i == nil {
+		return nil
+	}
+	switch i.method() {
+	case "REQUEST", "CANCEL", "PUBLISH":
+	default:
+		return fmt.Errorf("invite: unsupported method %q", i.Method)
+	}
+	if i.Organizer.Address == "" && i.method() != "PUBLISH" {
+		return fmt.Errorf("invite: no organizer")
+	}
+	if i.Start.IsZero() {
+		return fmt.Errorf("invite: no start time")
+	}
+	if i.End.Before(i.Start) {
+		return fmt.Errorf("invite: end %v before start %v", i.End, i.Start)
+	}
+	for _, addr := range append([]mail.Address{i.Organizer}, i.Attendees...) {
+		if strings.ContainsAny(addr.Name, "\"\r\n") || strings.ContainsAny(addr.Address, "\"\r\n:;,") {
+			return fmt.Errorf("invite: invalid participant %q", addr.String())
+		}
+	}
+	return nil
+}
+
+// UID and DTSTAMP filled in, so every rendering of the email, and every
+// retry of a queued one, is the same invitation
+func (e Email) withFixedInvite() Email {
+	if e.Invite == nil || e.Invite.UID != "" && !e.Invite.stamp.IsZero() {
+		return e
+	}
+	invite := *e.Invite
+	if invite.UID == "" {
+		invite.UID = strings.Trim(newMessageID(invite.Organizer.Address), "<>")
+	}
+	if invite.stamp.IsZero() {
+		invite.stamp = time.Now()
+	}
+	e.Invite = &invite
+	return e
+}
+
+// multipart/alternative with the plain text, the html if there is some,
+// and the calendar last as the richest version (RFC 2046 5.1.4)
+func writeInvite(buf *messageWriter, email Email) {
+	boundary := newBoundary("alt", email.mimeText()...)
+	fmt.Fprintf(buf, "Content-Type: multipart/alternative; boundary=%s\r\n", boundary)
+	fmt.Fprintf(buf, "\r\n")
+
+	text := email.TextBody
+	if text == "" {
+		text = email.Invite.text()
+	}
+	fmt.Fprintf(buf, "--%s\r\n", boundary)
+	writeTextPart(buf, "text/plain", text)
+	buf.WriteString("\r\n")
+	if email.Body != "" {
+		fmt.Fprintf(buf, "--%s\r\n", boundary)
+		writeTextPart(buf, "text/html", email.Body)
+		buf.WriteString("\r\n")
+	}
+	fmt.Fprintf(buf, "--%s\r\n", boundary)
+	fmt.Fprintf(buf, "Content-Type: text/calendar; charset=UTF-8; method=%s\r\n", email.Invite.method())
+	writeTextContent(buf, email.Invite.calendar(email))
+	fmt.Fprintf(buf, "--%s--\r\n", boundary)
+}
+
+// the fallback for clients that don't read calendars
+func (i *Invite) text() string {
+	var b strings.Builder
+	if i.method() == "CANCEL" {
+		b.WriteString("Cancelled: ")
+	}
+	b.WriteString(i.Summary + "\n\n")
+	if i.AllDay {
+		fmt.Fprintf(&b, "When: %s", i.Start.Format("Mon Jan 2, 2006"))
+		if !sameDay(i.Start, i.End) {
+			fmt.Fprintf(&b, " - %s", i.End.Format("Mon Jan 2, 2006"))
+		}
+		b.WriteString("\n")
+	} else {
+		end := i.End.In(i.Start.Location())
+		endLayout := "15:04 MST"
+		if !sameDay(i.Start, end) {
+			endLayout = "Mon Jan 2, 2006 15:04 MST"
+		}
+		fmt.Fprintf(&b, "When: %s - %s\n", i.Start.Format("Mon Jan 2, 2006 15:04 MST"), end.Format(endLayout))
+	}
+	if i.Location != "" {
+		fmt.Fprintf(&b, "Where: %s\n", i.Location)
+	}
+	if i.Organizer.Address != "" {
+		fmt.Fprintf(&b, "Organizer: %s\n", i.Organizer.String())
+	}
+	if i.Description != "" {
+		b.WriteString("\n" + i.Description + "\n")
+	}
+	return b.String()
+}
+
+func sameDay(a, b time.Time) bool {
+	ay, am, ad := a.Date()
+	by, bm, bd := b.Date()
+	return ay == by && am == bm && ad == bd
+}
+
+// the VCALENDAR object, CRLF line endings and folded lines
+func (i *Invite) calendar(email Email) string {
+	var lines []string
+	add := func(line string) { lines = append(lines, line) }
+
+	add("BEGIN:VCALENDAR")
+	add("VERSION:2.0")
+	add("PRODID:-//go_internet_services//sending_mail//EN")
+	add("CALSCALE:GREGORIAN")
+	add("METHOD:" + i.method())
+
+	tzid := ""
+	if !i.AllDay {
+		if loc := i.Start.Location(); loc != time.UTC && loc != time.Local && loc.String() != "" {
+			tzid = loc.String()
+			lines = append(lines, vtimezone(loc, i.Start, i.End)...)
+		}
+	}
+
+	add("BEGIN:VEVENT")
+	add("UID:" + escapeICal(i.UID))
+	add(fmt.Sprintf("SEQUENCE:%d", i.Sequence))
+	stamp := i.stamp
+	if stamp.IsZero() {
+		stamp = time.Now()
+	}
+	add("DTSTAMP:" + stamp.UTC().Format("20060102T150405Z"))
+	switch {
+	case i.AllDay:
+		add("DTSTART;VALUE=DATE:" + i.Start.Format("20060102"))
+		add("DTEND;VALUE=DATE:" + i.End.AddDate(0, 0, 1).Format("20060102")) // exclusive
+	case tzid != "":
+		add("DTSTART;TZID=" + tzid + ":" + i.Start.Format("20060102T150405"))
+		add("DTEND;TZID=" + tzid + ":" + i.End.In(i.Start.Location()).Format("20060102T150405"))
+	default:
+		add("DTSTART:" + i.Start.UTC().Format("20060102T150405Z"))
+		add("DTEND:" + i.End.UTC().Format("20060102T150405Z"))
+	}
+	add("SUMMARY:" + escapeICal(i.Summary))
+	if i.Description != "" {
+		add("DESCRIPTION:" + escapeICal(i.Description))
+	}
+	if i.Location != "" {
+		add("LOCATION:" + escapeICal(i.Location))
+	}
+	if i.Organizer.Address != "" {
+		add("ORGANIZER" + icalName(i.Organizer) + ":mailto:" + i.Organizer.Address)
+	}
+	attendees := i.Attendees
+	if attendees == nil {
+		attendees = append(append([]mail.Address(nil), email.To...), email.Cc...)
+	}
+	for _, attendee := range attendees {
+		add("ATTENDEE" + icalName(attendee) + ";ROLE=REQ-PARTICIPANT;PARTSTAT=NEEDS-ACTION;RSVP=TRUE:mailto:" + attendee.Address)
+	}
+	if i.method() == "CANCEL" {
+		add("STATUS:CANCELLED")
+	} else {
+		add("STATUS:CONFIRMED")
+	}
+	add("END:VEVENT")
+	add("END:VCALENDAR")
+
+	var b strings.Builder
+	for _, line := range lines {
+		b.WriteString(foldICal(line))
+	}
+	return b.String()
+}
+
+// the observances of loc around the event, one per offset change from the
+// one in force at start through end, instead of recurrence rules that
+// time.Location doesn't expose
+func vtimezone(loc *time.Location, start, end time.Time) []string {
+	lines := []string{"BEGIN:VTIMEZONE", "TZID:" + loc.String()}
+	t := start
+	for {
+		zoneStart, zoneEnd := t.ZoneBounds()
+		name, offset := t.Zone()
+		prevOffset := offset
+		if !zoneStart.IsZero() {
+			_, prevOffset = zoneStart.Add(-time.Second).Zone()
+		}
+		kind := "STANDARD"
+		if t.IsDST() {
+			kind = "DAYLIGHT"
+		}
+		// an observance starts at local time in the offset it replaces
+		begin := time.Date(1970, 1, 1, 0, 0, 0, 0, time.UTC)
+		if !zoneStart.IsZero() {
+			begin = zoneStart.UTC().Add(time.Duration(prevOffset) * time.Second)
+		}
+		lines = append(lines,
+			"BEGIN:"+kind,
+			"DTSTART:"+begin.Format("20060102T150405"),
+			"TZOFFSETFROM:"+icalOffset(prevOffset),
+			"TZOFFSETTO:"+icalOffset(offset),
+			"TZNAME:"+name,
+			"END:"+kind,
+		)
+		if zoneEnd.IsZero() || zoneEnd.After(end) {
+			break
+		}
+		t = zoneEnd.In(loc)
+	}
+	return append(lines, "END:VTIMEZONE")
+}
+
+// seconds east of UTC as +hhmm
+func icalOffset(seconds int) string {
+	sign := "+"
+	if seconds < 0 {
+		sign, seconds = "-", -seconds
+	}
+	return fmt.Sprintf("%s%02d%02d", sign, seconds/3600, seconds%3600/60)
+}
+
+// ;CN="Name" for a participant that has a name
+func icalName(addr mail.Address) string {
+	// RFC 5545 3.1: a quoted parameter value can't hold DQUOTE or control
+	// characters, and there is no escaping them
+	name := strings.Map(func(r rune) rune {
+		if r == '"' || unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, addr.Name)
+	if name == "" {
+		return ""
+	}
+	return `;CN="` + name + `"`
+}
+
+// RFC 5545 3.3.11 TEXT escaping
+func escapeICal(s string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`, "\r", `\n`).Replace(s)
+}
+
+// RFC 5545 3.1: lines longer than 75 octets continue on the next line
+// after a space, without splitting a UTF-8 sequence
+func foldICal(line string) string {
+	var b strings.Builder
+	limit := 75
+	for len(line) > limit {
+		cut := limit
+		for cut > 0 && line[cut]&0xc0 == 0x80 {
+			cut--
+		}
+		b.WriteString(line[:cut] + "\r\n ")
+		line = line[cut:]
+		limit = 74 // the leading space counts
+	}
+	b.WriteString(line + "\r\n")
+	return b.String()
+}
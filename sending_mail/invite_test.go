@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInviteNames(t *testing.T) {
+	invite := &Invite{
+		UID:       "test@example.com",
+		Summary:   "Planning",
+		Start:     time.Date(2026, 3, 2, 10, 0, 0, 0, time.UTC),
+		End:       time.Date(2026, 3, 2, 11, 0, 0, 0, time.UTC),
+		Organizer: mail.Address{Name: "Ann \"The Boss\"", Address: "ann@example.com"},
+		Attendees: []mail.Address{
+			{Name: "Bob\";ROLE=CHAIR:mailto:eve@example.com\r\nX-EVIL:1", Address: "bob@example.com"},
+			{Name: "\"\x01", Address: "carol@example.com"},
+		},
+	}
+	calendar := invite.calendar(Email{})
+
+	for _, want := range []string{
+		`ORGANIZER;CN="Ann The Boss":mailto:ann@example.com`,
+		`ATTENDEE;CN="Bob;ROLE=CHAIR:mailto:eve@example.comX-EVIL:1";ROLE=REQ-PARTICIPANT`,
+		"ATTENDEE;ROLE=REQ-PARTICIPANT;PARTSTAT=NEEDS-ACTION;RSVP=TRUE:mailto:carol@example.com",
+	} {
+		// undo the folding of long lines
+		if !strings.Contains(strings.ReplaceAll(calendar, "\r\n ", ""), want) {
+			t.Errorf("missing %s in\n%s", want, calendar)
+		}
+	}
+	if strings.Contains(calendar, "\r\nX-EVIL") {
+		t.Errorf("a name started a property of its own:\n%s", calendar)
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// MockSender is an EmailSender for the tests of the senders and
+// middlewares that wrap another one. It connects nowhere: every message is validated and built like a real send
+// and then recorded. Failures can be programmed for the next sends or for
+// particular recipients, and the Assert helpers check what was sent.
+type MockSender struct {
+	mu       sync.Mutex
+	sent     []SentEmail
+	failNext []error
+	failRcpt map[string]error
+}
+
+// a message a MockSender took
+type SentEmail struct {
+	Config     SMTPConfig
+	Email      Email
+	Recipients []string // the envelope recipients that accepted it
+	Message    []byte   // as it would have been sent, DKIM signature included
+}
+
+// an SMTP reply for programming failures, eg. SMTPFailure(550, "5.1.1 no such user")
+func SMTPFailure(code int, msg string) error {
+	return &textproto.Error{Code: code, Msg: msg}
+}
+
+// the next sends fail with errs, one each, before any recipient is tried
+func (m *MockSender) FailNext(errs ...error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.failNext = append(m.failNext, errs...)
+}
+
+// addr is refused with err in every send until Reset, the other recipients
+// still get the message and Send returns a *DeliveryError
+func (m *MockSender) FailRecipient(addr string, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.failRcpt == nil {
+		m.failRcpt = map[string]error{}
+	}
+	m.failRcpt[strings.ToLower(addr)] = err
+}
+
+// implements the EmailSender interface
+func (m *MockSender) Send(ctx context.Context, config SMTPConfig, email Email) error {
+	if err := email.Validate(); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	msg, err := config.payload(email, Email.WriteTo)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := msg.write(&buf); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.failNext) > 0 {
+		err := m.failNext[0]
+		m.failNext = m.failNext[1:]
+		return err
+	}
+
+	rcpts := email.Recipients()
+	results := make([]RecipientResult, len(rcpts))
+	var accepted []string
+	for i, rcpt := range rcpts {
+		results[i] = recipientResult(rcpt, m.failRcpt[strings.ToLower(rcpt)])
+		if results[i].Status == Accepted {
+			accepted = append(accepted, rcpt)
+		}
+	}
+	if len(accepted) > 0 {
+		m.sent = append(m.sent, SentEmail{Config: config, Email: email, Recipients: accepted, Message: buf.Bytes()})
+	}
+	return deliveryError(results)
+}
+
+// the messages taken so far, oldest first
+func (m *MockSender) Sent() []SentEmail {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]SentEmail(nil), m.sent...)
+}
+
+// the latest message taken, false if there is none
+func (m *MockSender) Last() (SentEmail, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.sent) == 0 {
+		return SentEmail{}, false
+	}
+	return m.sent[len(m.sent)-1], true
+}
+
+// forget the sent messages and the programmed failures
+func (m *MockSender) Reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sent = nil
+	m.failNext = nil
+	m.failRcpt = nil
+}
+
+// fails t unless exactly n messages were taken
+func (m *MockSender) AssertCount(t testing.TB, n int) {
+	t.Helper()
+	if sent := m.Sent(); len(sent) != n {
+		t.Errorf("sent %d emails, want %d", len(sent), n)
+	}
+}
+
+// fails t unless some message was accepted for addr
+func (m *MockSender) AssertSentTo(t testing.TB, addr string) {
+	t.Helper()
+	for _, sent := range m.Sent() {
+		for _, rcpt := range sent.Recipients {
+			if strings.EqualFold(rcpt, addr) {
+				return
+			}
+		}
+	}
+	t.Errorf("no email sent to %s", addr)
+}
+
+// fails t if any message was accepted for addr
+func (m *MockSender) AssertNotSentTo(t testing.TB, addr string) {
+	t.Helper()
+	for _, sent := range m.Sent() {
+		for _, rcpt := range sent.Recipients {
+			if strings.EqualFold(rcpt, addr) {
+				t.Errorf("email %q was sent to %s", sent.Email.Subject, addr)
+				return
+			}
+		}
+	}
+}
+
+// fails t unless the latest message has subject as its Subject
+func (m *MockSender) AssertLastSubject(t testing.TB, subject string) {
+	t.Helper()
+	last, ok := m.Last()
+	if !ok {
+		t.Errorf("no email sent, want subject %q", subject)
+		return
+	}
+	if last.Email.Subject != subject {
+		t.Errorf("last email subject %q, want %q", last.Email.Subject, subject)
+	}
+}
+
+// fails t unless the HTML or the plain text body of the latest message
+// contains substr
+func (m *MockSender) LastMessageBodyContains(t testing.TB, substr string) {
+	t.Helper()
+	last, ok := m.Last()
+	if !ok {
+		t.Errorf("no email sent, want a body containing %q", substr)
+		return
+	}
+	if !strings.Contains(last.Email.Body, substr) && !strings.Contains(last.Email.TextBody, substr) {
+		t.Errorf("last email %q has no %q in its body", last.Email.Subject, substr)
+	}
+}
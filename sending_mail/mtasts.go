@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RFC 8461 policy published by a recipient domain
+type MTASTSPolicy struct {
+	ID     string // from the _mta-sts TXT record, changes with the policy
+	Mode   string // enforce, testing or none
+	MX     []string
+	MaxAge time.Duration
+
+	fetched time.Time
+}
+
+func (p *MTASTSPolicy) enforced() bool {
+	return p != nil && p.Mode == "enforce"
+}
+
+// an MX host is allowed when it matches one of the policy's mx patterns,
+// "*.example.net" covers exactly one extra label
+func (p *MTASTSPolicy) allowsMX(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, pattern := range p.MX {
+		pattern = strings.ToLower(strings.TrimSuffix(pattern, "."))
+		if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+			label, rest, found := strings.Cut(host, ".")
+			if found && label != "" && rest == suffix {
+				return true
+			}
+		} else if host == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// policies are cached for their max_age, a new TXT id triggers a refetch
+var mtaSTSCache = struct {
+	sync.Mutex
+	policies map[string]*MTASTSPolicy
+}{policies: map[string]*MTASTSPolicy{}}
+
+// current MTA-STS policy of domain, nil when it has none
+func LookupMTASTS(ctx context.Context, domain string) (*MTASTSPolicy, error) {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+
+	id, err := mtaSTSRecordID(ctx, domain)
+	if err != nil {
+		return nil, err
+	}
+
+	mtaSTSCache.Lock()
+	cached := mtaSTSCache.policies[domain]
+	mtaSTSCache.Unlock()
+
+	if id == "" {
+		// RFC 8461 5.1: a cached policy outlives a vanished TXT record
+		if cached != nil && time.Since(cached.fetched) < cached.MaxAge {
+			return cached, nil
+		}
+		return nil, nil
+	}
+	if cached != nil && cached.ID == id && time.Since(cached.fetched) < cached.MaxAge {
+		return cached, nil
+	}
+
+	policy, err := fetchMTASTS(ctx, domain)
+	if err != nil {
+		if cached != nil && time.Since(cached.fetched) < cached.MaxAge {
+			return cached, nil
+		}
+		return nil, err
+	}
+	policy.ID = id
+
+	mtaSTSCache.Lock()
+	mtaSTSCache.policies[domain] = policy
+	mtaSTSCache.Unlock()
+	return policy, nil
+}
+
+// id of the "v=STSv1; id=..." record at _mta-sts.domain, empty if there is none
+func mtaSTSRecordID(ctx context.Context, domain string) (string, error) {
+	records, err := net.DefaultResolver.LookupTXT(ctx, "_mta-sts."+domain)
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("MTA-STS record lookup failed: %w", err)
+	}
+
+	for _, record := range records {
+		fields := strings.Split(record, ";")
+		if strings.TrimSpace(fields[0]) != "v=STSv1" {
+			continue
+		}
+		for _, field := range fields[1:] {
+			if id, ok := strings.CutPrefix(strings.TrimSpace(field), "id="); ok {
+				return id, nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// the policy file must come from https://mta-sts.domain with a valid certificate
+func fetchMTASTS(ctx context.Context, domain string) (*MTASTSPolicy, error) {
+	httpClient := http.Client{
+		Timeout: 30 * time.Second,
+		// RFC 8461 3.3: redirects must not be followed
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://mta-sts."+domain+"/.well-known/mta-sts.txt", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("MTA-STS policy fetch failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("MTA-STS policy fetch failed: %s", resp.Status)
+	}
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		return nil, fmt.Errorf("MTA-STS policy has content type %q, want text/plain", ct)
+	}
+	return parseMTASTS(io.LimitReader(resp.Body, 64*1024))
+}
+
+func parseMTASTS(r io.Reader) (*MTASTSPolicy, error) {
+	policy := &MTASTSPolicy{fetched: time.Now()}
+	version := ""
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch strings.TrimSpace(key) {
+		case "version":
+			version = value
+		case "mode":
+			policy.Mode = value
+		case "mx":
+			policy.MX = append(policy.MX, value)
+		case "max_age":
+			seconds, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid MTA-STS max_age %q", value)
+			}
+			policy.MaxAge = time.Duration(min(seconds, 31557600)) * time.Second
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if version != "STSv1" {
+		return nil, fmt.Errorf("unsupported MTA-STS version %q", version)
+	}
+	switch policy.Mode {
+	case "enforce", "testing":
+		if len(policy.MX) == 0 {
+			return nil, errors.New("MTA-STS policy lists no mx hosts")
+		}
+	case "none":
+	default:
+		return nil, fmt.Errorf("invalid MTA-STS mode %q", policy.Mode)
+	}
+	return policy, nil
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/mail"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+)
+
+// The OpenPGP (RFC 4880) side of PGP/MIME, on ProtonMail's go-crypto.
+// Reading a certificate verifies its self-signatures: a user ID without a
+// valid one, or a subkey without a valid binding signature, makes the
+// certificate unreadable and it is skipped, so a key from a keyring or a
+// WKD server is only used for the addresses its owner signed.
+
+// an OpenPGP certificate, a primary key with its user IDs and subkeys
+type PGPPublicKey struct {
+	UserIDs []string
+	entity  *openpgp.Entity
+}
+
+// a secret key able to sign, the primary key or a signing subkey
+type PGPPrivateKey struct {
+	UserIDs []string
+	entity  *openpgp.Entity
+}
+
+// signatures over SHA-256, as micalg=pgp-sha256 says, and encryption to
+// AES-256
+var pgpConfig = &packet.Config{
+	DefaultHash:   crypto.SHA256,
+	DefaultCipher: packet.CipherAES256,
+}
+
+// the primary key's fingerprint, in hex
+func (k *PGPPublicKey) Fingerprint() string {
+	return strings.ToUpper(hex.EncodeToString(k.entity.PrimaryKey.Fingerprint))
+}
+
+// whether a user ID names addr
+func (k *PGPPublicKey) HasAddress(addr string) bool {
+	for _, uid := range k.UserIDs {
+		if strings.EqualFold(userIDAddress(uid), addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// the address of a user ID such as "Some One <someone@example.com>"
+func userIDAddress(uid string) string {
+	if parsed, err := mail.ParseAddress(uid); err == nil {
+		return parsed.Address
+	}
+	if start, end := strings.LastIndex(uid, "<"), strings.LastIndex(uid, ">"); start >= 0 && end > start {
+		return uid[start+1 : end]
+	}
+	return strings.TrimSpace(uid)
+}
+
+// an error if the certificate has no key to encrypt to: every one
+// revoked, expired or for signing only
+func (k *PGPPublicKey) checkEncryptionKey() error {
+	if _, ok := k.entity.EncryptionKey(time.Now()); !ok {
+		return fmt.Errorf("OpenPGP key %s has no usable encryption key", k.Fingerprint())
+	}
+	return nil
+}
+
+// the user IDs of a certificate whose self-signatures held, revoked ones
+// left out
+func pgpUserIDs(entity *openpgp.Entity) []string {
+	var uids []string
+	for name, identity := range entity.Identities {
+		if !identity.Revoked(time.Now()) {
+			uids = append(uids, name)
+		}
+	}
+	sort.Strings(uids)
+	return uids
+}
+
+// read every certificate in an exported keyring, armored or binary, eg.
+// the output of gpg --export. Certificates whose self-signatures don't
+// verify are left out, an error if that leaves none.
+func ReadPGPKeyring(r io.Reader) ([]*PGPPublicKey, error) {
+	entities, err := readPGPEntities(r)
+	if err != nil {
+		return nil, err
+	}
+	var keys []*PGPPublicKey
+	for _, entity := range entities {
+		keys = append(keys, &PGPPublicKey{UserIDs: pgpUserIDs(entity), entity: entity})
+	}
+	return keys, nil
+}
+
+// read a secret key, eg. the output of gpg --export-secret-keys, and
+// unlock it with passphrase
+func ReadPGPPrivateKey(r io.Reader, passphrase []byte) (*PGPPrivateKey, error) {
+	entities, err := readPGPEntities(r)
+	if err != nil {
+		return nil, err
+	}
+	entity := entities[0] // only the first certificate
+	if entity.PrivateKey == nil {
+		return nil, errors.New("no OpenPGP secret key found")
+	}
+	if err := entity.DecryptPrivateKeys(passphrase); err != nil {
+		return nil, fmt.Errorf("failed to unlock OpenPGP secret key: %w", err)
+	}
+	// a signing subkey is what gpg signs with, the primary key otherwise
+	if key, ok := entity.SigningKey(time.Now()); !ok || key.PrivateKey == nil || key.PrivateKey.Dummy() {
+		return nil, errors.New("OpenPGP secret key has no usable signing key")
+	}
+	return &PGPPrivateKey{UserIDs: pgpUserIDs(entity), entity: entity}, nil
+}
+
+// the signing key's fingerprint, in hex
+func (k *PGPPrivateKey) Fingerprint() string {
+	key, _ := k.entity.SigningKey(time.Now())
+	return strings.ToUpper(hex.EncodeToString(key.PublicKey.Fingerprint))
+}
+
+// the certificates in binary data or in every armored block of it
+func readPGPEntities(r io.Reader) (openpgp.EntityList, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Contains(data, []byte("-----BEGIN PGP")) {
+		return openpgp.ReadKeyRing(bytes.NewReader(data))
+	}
+
+	var entities openpgp.EntityList
+	var lastErr error
+	in := bytes.NewReader(data)
+	for {
+		block, err := armor.Decode(in)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid armor: %w", err)
+		}
+		list, err := openpgp.ReadKeyRing(block.Body)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		entities = append(entities, list...)
+	}
+	if len(entities) == 0 {
+		if lastErr != nil {
+			return nil, lastErr
+		}
+		return nil, errors.New("no OpenPGP keys found")
+	}
+	return entities, nil
+}
+
+// a detached binary signature (type 0x00) over data
+func (k *PGPPrivateKey) sign(data []byte) ([]byte, error) {
+	var sig bytes.Buffer
+	if err := openpgp.DetachSign(&sig, k.entity, bytes.NewReader(data), pgpConfig); err != nil {
+		return nil, err
+	}
+	return sig.Bytes(), nil
+}
+
+// data encrypted to every recipient's encryption key
+func pgpEncrypt(data []byte, recipients []*PGPPublicKey) ([]byte, error) {
+	to := make([]*openpgp.Entity, len(recipients))
+	for i, recipient := range recipients {
+		to[i] = recipient.entity
+	}
+	var out bytes.Buffer
+	w, err := openpgp.Encrypt(&out, to, nil, &openpgp.FileHints{IsBinary: true}, pgpConfig)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// ASCII armor (RFC 4880 6) with CRLF line endings
+func pgpArmor(blockType string, data []byte) (string, error) {
+	var b strings.Builder
+	w, err := armor.Encode(&b, "PGP "+blockType, nil)
+	if err != nil {
+		return "", err
+	}
+	if _, err := w.Write(data); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	return strings.ReplaceAll(strings.TrimSuffix(b.String(), "\n"), "\n", "\r\n") + "\r\n", nil
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+)
+
+// testdata/pgp-*.asc were made with GnuPG 2.2: Alice has an Ed25519 key
+// with a Curve25519 encryption subkey, her secret key locked with
+// "test passphrase", Bob an RSA 2048 key with an RSA encryption subkey.
+// pgp-gpg-signature.asc is gpg --detach-sign by Alice of gpgSigned.
+const (
+	aliceFingerprint = "5B5BC604DE7D6C4F60FCF5C753CE4624B07F73C0"
+	bobFingerprint   = "98A7064C6C93CF0BFDAD0E79D003241B6270E29C"
+	alicePassphrase  = "test passphrase"
+	gpgSigned        = "Content-Type: text/plain\r\n\r\nsigned by gpg\r\n"
+)
+
+func readTestKeyring(t *testing.T) []*PGPPublicKey {
+	t.Helper()
+	f, err := os.Open("testdata/pgp-public.asc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	keys, err := ReadPGPKeyring(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func readTestPrivateKey(t *testing.T) *PGPPrivateKey {
+	t.Helper()
+	f, err := os.Open("testdata/pgp-alice-secret.asc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	key, err := ReadPGPPrivateKey(f, []byte(alicePassphrase))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// the binary packets of an armored file
+func dearmor(t *testing.T, file string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := armor.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	packets, err := io.ReadAll(block.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return packets
+}
+
+func TestReadPGPKeyring(t *testing.T) {
+	keys := readTestKeyring(t)
+	if len(keys) != 2 {
+		t.Fatalf("got %d keys, want 2", len(keys))
+	}
+
+	tests := []struct {
+		fingerprint string
+		userID      string
+		address     string
+	}{
+		{aliceFingerprint, "Alice <alice@example.com>", "ALICE@example.com"},
+		{bobFingerprint, "Bob <bob@example.org>", "bob@example.org"},
+	}
+	for i, tt := range tests {
+		key := keys[i]
+		if got := key.Fingerprint(); got != tt.fingerprint {
+			t.Errorf("key %d: fingerprint %s, want %s", i, got, tt.fingerprint)
+		}
+		if len(key.UserIDs) != 1 || key.UserIDs[0] != tt.userID {
+			t.Errorf("key %d: user IDs %q, want %q", i, key.UserIDs, tt.userID)
+		}
+		if !key.HasAddress(tt.address) {
+			t.Errorf("key %d: no address %s", i, tt.address)
+		}
+		if err := key.checkEncryptionKey(); err != nil {
+			t.Errorf("key %d: %v", i, err)
+		}
+	}
+
+	// binary, as gpg --export without --armor writes it
+	binary, err := ReadPGPKeyring(bytes.NewReader(dearmor(t, "testdata/pgp-public.asc")))
+	if err != nil || len(binary) != 2 || binary[1].Fingerprint() != bobFingerprint {
+		t.Errorf("binary keyring: %v, %v", binary, err)
+	}
+}
+
+// a certificate whose signatures don't hold, as a WKD server or a keyring
+// could serve it, isn't used; the others in the keyring still are
+func TestReadPGPKeyringForged(t *testing.T) {
+	packets := dearmor(t, "testdata/pgp-public.asc")
+
+	// Bob's encryption subkey, to be swapped for another under his
+	// binding signature
+	entities, err := openpgp.ReadKeyRing(bytes.NewReader(packets))
+	if err != nil {
+		t.Fatal(err)
+	}
+	modulus := entities[1].Subkeys[0].PublicKey.PublicKey.(*rsa.PublicKey).N.Bytes()
+
+	tests := []struct {
+		name   string
+		forge  func([]byte) []byte
+		forged string // fingerprint of the certificate that must be gone
+		kept   string
+	}{
+		{"user ID its key never signed", func(b []byte) []byte {
+			return bytes.Replace(b, []byte("alice@example.com"), []byte("evil1@example.com"), 1)
+		}, aliceFingerprint, bobFingerprint},
+		{"subkey without a binding signature", func(b []byte) []byte {
+			i := bytes.Index(b, modulus)
+			b[i+len(modulus)-1] ^= 1
+			return b
+		}, bobFingerprint, aliceFingerprint},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys, err := ReadPGPKeyring(bytes.NewReader(tt.forge(bytes.Clone(packets))))
+			if err != nil || len(keys) != 1 || keys[0].Fingerprint() != tt.kept {
+				var got []string
+				for _, key := range keys {
+					got = append(got, key.Fingerprint())
+				}
+				t.Errorf("got %v, %v, want only %s and not %s", got, err, tt.kept, tt.forged)
+			}
+		})
+	}
+}
+
+func TestReadPGPPrivateKey(t *testing.T) {
+	key := readTestPrivateKey(t)
+	if len(key.UserIDs) != 1 || key.UserIDs[0] != "Alice <alice@example.com>" {
+		t.Errorf("user IDs %q", key.UserIDs)
+	}
+	// Alice's primary key is her only signing key
+	if got := key.Fingerprint(); got != aliceFingerprint {
+		t.Errorf("signing key %s, want %s", got, aliceFingerprint)
+	}
+
+	f, err := os.Open("testdata/pgp-alice-secret.asc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := ReadPGPPrivateKey(f, []byte("wrong")); err == nil {
+		t.Error("unlocked with the wrong passphrase")
+	}
+}
+
+// gpg's signature checks out against the key read from gpg's export, and
+// one made here against that key too
+func TestPGPSignature(t *testing.T) {
+	keys := readTestKeyring(t)
+	keyring := openpgp.EntityList{keys[0].entity}
+
+	gpgSignature, err := os.ReadFile("testdata/pgp-gpg-signature.asc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openpgp.CheckArmoredDetachedSignature(keyring, strings.NewReader(gpgSigned), bytes.NewReader(gpgSignature), nil); err != nil {
+		t.Errorf("gpg's signature: %v", err)
+	}
+
+	key := readTestPrivateKey(t)
+	entity := []byte("Content-Type: text/plain\r\n\r\nsigned here\r\n")
+	signature, err := key.sign(entity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openpgp.CheckDetachedSignature(keyring, bytes.NewReader(entity), bytes.NewReader(signature), nil); err != nil {
+		t.Errorf("signature made here: %v", err)
+	}
+	if _, err := openpgp.CheckDetachedSignature(keyring, strings.NewReader("something else"), bytes.NewReader(signature), nil); err == nil {
+		t.Error("signature holds for other data")
+	}
+}
+
+func TestPGPEncrypt(t *testing.T) {
+	keys := readTestKeyring(t)
+	private := readTestPrivateKey(t)
+
+	data := []byte("Content-Type: text/plain\r\n\r\nfor Alice and Bob\r\n")
+	encrypted, err := pgpEncrypt(data, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	md, err := openpgp.ReadMessage(bytes.NewReader(encrypted), openpgp.EntityList{private.entity}, nil, nil)
+	if err != nil {
+		t.Fatalf("Alice can't read it: %v", err)
+	}
+	got, err := io.ReadAll(md.UnverifiedBody)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("decrypted %q, %v", got, err)
+	}
+}
+
+// the PGP/MIME message as GnuPG sees it, when it is installed
+func TestPGPMIMEWithGnuPG(t *testing.T) {
+	if _, err := exec.LookPath("gpg"); err != nil {
+		t.Skip("gpg not installed")
+	}
+	home := t.TempDir()
+	// the agent gpg starts for the secret key
+	t.Cleanup(func() { exec.Command("gpgconf", "--homedir", home, "--kill", "gpg-agent").Run() })
+	// gpg's output, and what it had to say about it
+	gpg := func(stdin []byte, args ...string) ([]byte, string, error) {
+		cmd := exec.Command("gpg", append([]string{"--homedir", home, "--batch", "--quiet", "--pinentry-mode", "loopback", "--passphrase", alicePassphrase}, args...)...)
+		cmd.Stdin = bytes.NewReader(stdin)
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		out, err := cmd.Output()
+		return out, stderr.String(), err
+	}
+	if _, stderr, err := gpg(nil, "--import", "testdata/pgp-alice-secret.asc", "testdata/pgp-public.asc"); err != nil {
+		t.Fatalf("gpg --import: %v\n%s", err, stderr)
+	}
+
+	key := readTestPrivateKey(t)
+	entity := []byte("Content-Type: text/plain\r\n\r\nchecked by gpg\r\n")
+	signed, err := (&PGPOptions{SignWith: key}).sign(entity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := bytes.Index(signed, []byte("-----BEGIN PGP SIGNATURE-----"))
+	end := bytes.Index(signed, []byte("-----END PGP SIGNATURE-----"))
+	if start < 0 || end < 0 {
+		t.Fatalf("no armored signature in\n%s", signed)
+	}
+	signature := filepath.Join(t.TempDir(), "signature.asc")
+	if err := os.WriteFile(signature, signed[start:end+len("-----END PGP SIGNATURE-----\r\n")], 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, stderr, err := gpg(entity, "--verify", signature, "-"); err != nil {
+		t.Errorf("gpg --verify: %v\n%s", err, stderr)
+	}
+
+	encrypted, err := pgpEncrypt(entity, readTestKeyring(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	armored, err := pgpArmor("MESSAGE", encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, stderr, err := gpg([]byte(armored), "--decrypt")
+	if err != nil || !bytes.Equal(out, entity) {
+		t.Errorf("gpg --decrypt: %q, %v\n%s", out, err, stderr)
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"io"
+
+	"internet_services/receiving_mail/message"
+)
+
+// ParseEmail reads a raw RFC 5322 message, as a server or a mailbox hands
+// it over, into an Email, eg. to Reply to or forward it; see
+// message.Parse for how the parts and fields are read.
+func ParseEmail(r io.Reader) (*Email, error) {
+	msg, err := message.Parse(r)
+	if err != nil {
+		return nil, err
+	}
+	email := &Email{
+		From:     msg.From,
+		To:       msg.To,
+		Cc:       msg.Cc,
+		Bcc:      msg.Bcc,
+		Subject:  msg.Subject,
+		Body:     msg.HTML,
+		TextBody: msg.Text,
+		Headers:  msg.Headers,
+	}
+	for _, att := range msg.Attachments {
+		email.Attachments = append(email.Attachments, Attachment{
+			Filename:    att.Filename,
+			ContentType: att.ContentType,
+			Data:        att.Data,
+			Inline:      att.Inline,
+			ContentID:   att.ContentID,
+		})
+	}
+	return email, nil
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// PGP/MIME (RFC 3156) for one message: signed with SignWith, encrypted to
+// the Encrypt keys, or both, in which case the signed message is what gets
+// encrypted. Like S/MIME only the body is protected, the Subject and the
+// other header fields stay readable.
+type PGPOptions struct {
+	SignWith *PGPPrivateKey // nil to not sign
+
+	// recipients' keys, include the sender's own to be able to read the
+	// sent copy; nil to not encrypt. See PGPKeyring to find them.
+	Encrypt []*PGPPublicKey
+}
+
+func (o *PGPOptions) validate() error {
+	if o == nil {
+		return nil
+	}
+	if o.SignWith == nil && len(o.Encrypt) == 0 {
+		return errors.New("PGP: neither a signing key nor recipient keys")
+	}
+	for _, key := range o.Encrypt {
+		if err := key.checkEncryptionKey(); err != nil {
+			return fmt.Errorf("PGP: %w", err)
+		}
+	}
+	return nil
+}
+
+func (o *PGPOptions) protect(entity []byte) ([]byte, error) {
+	var err error
+	if o.SignWith != nil {
+		if entity, err = o.sign(entity); err != nil {
+			return nil, err
+		}
+	}
+	if len(o.Encrypt) > 0 {
+		if entity, err = o.encrypt(entity); err != nil {
+			return nil, err
+		}
+	}
+	return entity, nil
+}
+
+// multipart/signed with a detached signature over the entity as sent
+// (RFC 3156 5)
+func (o *PGPOptions) sign(entity []byte) ([]byte, error) {
+	signature, err := o.SignWith.sign(entity)
+	if err != nil {
+		return nil, fmt.Errorf("PGP signing failed: %w", err)
+	}
+	armored, err := pgpArmor("SIGNATURE", signature)
+	if err != nil {
+		return nil, fmt.Errorf("PGP signing failed: %w", err)
+	}
+
+	var buf bytes.Buffer
+	boundary := newBoundary("pgp-signed", string(entity))
+	fmt.Fprintf(&buf, "Content-Type: multipart/signed; micalg=pgp-sha256; protocol=\"application/pgp-signature\"; boundary=%s\r\n", boundary)
+	buf.WriteString("\r\n")
+	fmt.Fprintf(&buf, "--%s\r\n", boundary)
+	buf.Write(entity)
+	fmt.Fprintf(&buf, "\r\n--%s\r\n", boundary)
+	buf.WriteString("Content-Type: application/pgp-signature; name=signature.asc\r\n")
+	buf.WriteString("Content-Description: OpenPGP digital signature\r\n")
+	buf.WriteString("Content-Disposition: attachment; filename=signature.asc\r\n")
+	buf.WriteString("\r\n")
+	buf.WriteString(armored)
+	fmt.Fprintf(&buf, "--%s--\r\n", boundary)
+	return buf.Bytes(), nil
+}
+
+// multipart/encrypted with the version part and the armored message
+// (RFC 3156 4)
+func (o *PGPOptions) encrypt(entity []byte) ([]byte, error) {
+	encrypted, err := pgpEncrypt(entity, o.Encrypt)
+	if err != nil {
+		return nil, fmt.Errorf("PGP encryption failed: %w", err)
+	}
+	armored, err := pgpArmor("MESSAGE", encrypted)
+	if err != nil {
+		return nil, fmt.Errorf("PGP encryption failed: %w", err)
+	}
+
+	var buf bytes.Buffer
+	boundary := newBoundary("pgp-encrypted")
+	fmt.Fprintf(&buf, "Content-Type: multipart/encrypted; protocol=\"application/pgp-encrypted\"; boundary=%s\r\n", boundary)
+	buf.WriteString("\r\n")
+	fmt.Fprintf(&buf, "--%s\r\n", boundary)
+	buf.WriteString("Content-Type: application/pgp-encrypted\r\n")
+	buf.WriteString("Content-Description: PGP/MIME version identification\r\n")
+	buf.WriteString("\r\n")
+	buf.WriteString("Version: 1\r\n")
+	buf.WriteString("\r\n")
+	fmt.Fprintf(&buf, "--%s\r\n", boundary)
+	buf.WriteString("Content-Type: application/octet-stream; name=encrypted.asc\r\n")
+	buf.WriteString("Content-Description: OpenPGP encrypted message\r\n")
+	buf.WriteString("Content-Disposition: inline; filename=encrypted.asc\r\n")
+	buf.WriteString("\r\n")
+	buf.WriteString(armored)
+	fmt.Fprintf(&buf, "--%s--\r\n", boundary)
+	return buf.Bytes(), nil
+}
+
+var ErrNoPGPKey = errors.New("no OpenPGP key found")
+
+// PGPKeyring finds recipients' public keys, in Keys first and then, if
+// WKD is set, in the Web Key Directory of the recipient's domain
+type PGPKeyring struct {
+	Keys []*PGPPublicKey
+	WKD  bool
+}
+
+// a keyring from an exported key file, eg. gpg --export --armor > keys.asc
+func LoadPGPKeyring(file string) (*PGPKeyring, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read keyring: %w", err)
+	}
+	defer f.Close()
+	keys, err := ReadPGPKeyring(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read keyring: %w", err)
+	}
+	return &PGPKeyring{Keys: keys}, nil
+}
+
+// the key for addr, ErrNoPGPKey if there is none
+func (k *PGPKeyring) Lookup(ctx context.Context, addr string) (*PGPPublicKey, error) {
+	for _, key := range k.Keys {
+		if key.HasAddress(addr) {
+			if err := key.checkEncryptionKey(); err == nil {
+				return key, nil
+			}
+		}
+	}
+	if !k.WKD {
+		return nil, fmt.Errorf("%w for %s", ErrNoPGPKey, addr)
+	}
+	return LookupWKD(ctx, addr)
+}
+
+// the keys for every recipient of email, for PGPOptions.Encrypt
+func (k *PGPKeyring) LookupRecipients(ctx context.Context, email Email) ([]*PGPPublicKey, error) {
+	var keys []*PGPPublicKey
+	for _, rcpt := range email.Recipients() {
+		key, err := k.Lookup(ctx, rcpt)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// fetch the key for addr from the Web Key Directory of its domain
+// (draft-koch-openpgp-webkey-service): the advanced method on the
+// openpgpkey subdomain if that exists, the direct method otherwise
+func LookupWKD(ctx context.Context, addr string) (*PGPPublicKey, error) {
+	at := strings.LastIndex(addr, "@")
+	if at <= 0 {
+		return nil, fmt.Errorf("invalid address %q", addr)
+	}
+	local, domain := addr[:at], strings.ToLower(addr[at+1:])
+	sum := sha1.Sum([]byte(strings.ToLower(local)))
+	path := "/hu/" + zbase32(sum[:]) + "?l=" + url.QueryEscape(local)
+
+	keys, err := fetchWKD(ctx, "https://openpgpkey."+domain+"/.well-known/openpgpkey/"+domain+path)
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		keys, err = fetchWKD(ctx, "https://"+domain+"/.well-known/openpgpkey"+path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// the directory may return more than one key, only the one for addr counts
+	for _, key := range keys {
+		if key.HasAddress(addr) {
+			if err := key.checkEncryptionKey(); err == nil {
+				return key, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("%w for %s", ErrNoPGPKey, addr)
+}
+
+func fetchWKD(ctx context.Context, url string) ([]*PGPPublicKey, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	httpClient := http.Client{Timeout: 30 * time.Second}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("WKD lookup failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrNoPGPKey
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("WKD lookup failed: %s", resp.Status)
+	}
+	return ReadPGPKeyring(io.LimitReader(resp.Body, 1<<20))
+}
+
+// z-base-32, the encoding WKD uses for the hashed local part
+func zbase32(data []byte) string {
+	const alphabet = "ybndrfg8ejkmcpqxot1uwisza345h769"
+	var b strings.Builder
+	var buffer, bits uint
+	for _, c := range data {
+		buffer = buffer<<8 | uint(c)
+		bits += 8
+		for bits >= 5 {
+			bits -= 5
+			b.WriteByte(alphabet[buffer>>bits&31])
+		}
+	}
+	if bits > 0 {
+		b.WriteByte(alphabet[buffer<<(5-bits)&31])
+	}
+	return b.String()
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// OutboundPolicy is what may leave: how many recipients and how big a
+// message, which attachments, the footer every message must carry, and
+// content that must not go out at all (data loss prevention). Check
+// reports every rule an email breaks at once, in a *PolicyError; Wrap a
+// sender with it to enforce it. To add a footer rather than require it,
+// put WithFooter in front of the policy:
+//
+//	Chain(AdvancedSender{}, WithFooter(footer, ""), policy.Wrap)
+type OutboundPolicy struct {
+	MaxRecipients int   // To, Cc and Bcc together, 0 for no limit
+	MaxSize       int64 // of the message as written, before any signing, 0 for no limit
+
+	// attachment types that may not go out: media types, "video/*" for a
+	// whole kind, or extensions such as ".exe"
+	BannedTypes []string
+
+	// text the plain text and the html body must contain, whitespace
+	// aside, eg. a legal disclaimer
+	RequiredFooter string
+
+	// words and phrases, matched without regard to case at word
+	// boundaries, and patterns that must not appear in the subject, the
+	// bodies or text attachments
+	Keywords []string
+	Patterns []DLPRule
+}
+
+// DLPRule is content to keep from going out, eg. CreditCardNumbers
+type DLPRule struct {
+	Name    string // for the violation, eg. "credit card number"
+	Pattern *regexp.Regexp
+	// tells real matches from look-alikes, eg. by a checksum; nil takes
+	// every match
+	Valid func(match string) bool
+}
+
+// card numbers of 13 to 19 digits, spaces and dashes between them
+// allowed, that pass the Luhn check
+var CreditCardNumbers = DLPRule{
+	Name:    "credit card number",
+	Pattern: regexp.MustCompile(`\b\d(?:[ -]?\d){12,18}\b`),
+	Valid:   luhnValid,
+}
+
+// the rule of an OutboundPolicy a violation breaks
+type PolicyRule int
+
+const (
+	PolicyRecipients PolicyRule = iota // MaxRecipients
+	PolicySize                         // MaxSize
+	PolicyAttachment                   // BannedTypes
+	PolicyFooter                       // RequiredFooter
+	PolicyContent                      // Keywords and Patterns
+)
+
+func (r PolicyRule) String() string {
+	switch r {
+	case PolicyRecipients:
+		return "recipients"
+	case PolicySize:
+		return "size"
+	case PolicyAttachment:
+		return "attachment"
+	case PolicyFooter:
+		return "footer"
+	case PolicyContent:
+		return "content"
+	}
+	return fmt.Sprintf("PolicyRule(%d)", int(r))
+}
+
+// one thing an email does that the policy doesn't allow
+type PolicyViolation struct {
+	Rule   PolicyRule
+	Detail string // what and where; content matches are not repeated
+}
+
+// the error of a send OutboundPolicy stopped, with every violation
+type PolicyError struct {
+	Violations []PolicyViolation
+}
+
+func (e *PolicyError) Error() string {
+	parts := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		parts[i] = v.Rule.String() + ": " + v.Detail
+	}
+	return "outbound policy violated: " + strings.Join(parts, "; ")
+}
+
+// never: the same email breaks the policy again, see IsTransient
+func (e *PolicyError) Temporary() bool {
+	return false
+}
+
+// whether the email broke rule
+func (e *PolicyError) Has(rule PolicyRule) bool {
+	for _, v := range e.Violations {
+		if v.Rule == rule {
+			return true
+		}
+	}
+	return false
+}
+
+// a Middleware checking every email against the policy
+func (p OutboundPolicy) Wrap(sender EmailSender) EmailSender {
+	return HookedSender{Sender: sender, BeforeSend: func(_ context.Context, _ SMTPConfig, email *Email) error {
+		return p.Check(*email)
+	}}
+}
+
+// nil if the email keeps to the policy, a *PolicyError otherwise
+func (p OutboundPolicy) Check(email Email) error {
+	var violations []PolicyViolation
+	violate := func(rule PolicyRule, format string, args ...any) {
+		violations = append(violations, PolicyViolation{Rule: rule, Detail: fmt.Sprintf(format, args...)})
+	}
+
+	if n := len(email.Recipients()); p.MaxRecipients > 0 && n > p.MaxRecipients {
+		violate(PolicyRecipients, "%d recipients, at most %d allowed", n, p.MaxRecipients)
+	}
+	if p.MaxSize > 0 {
+		if size, err := email.WriteTo(io.Discard); err == nil && size > p.MaxSize {
+			violate(PolicySize, "message of %d bytes, at most %d allowed", size, p.MaxSize)
+		}
+	}
+	for _, att := range email.Attachments {
+		if banned := p.banned(att); banned != "" {
+			violate(PolicyAttachment, "%s is %s", att.Filename, banned)
+		}
+	}
+
+	if p.RequiredFooter != "" {
+		footer := strings.Join(strings.Fields(p.RequiredFooter), " ")
+		if email.TextBody != "" && !strings.Contains(strings.Join(strings.Fields(email.TextBody), " "), footer) {
+			violate(PolicyFooter, "the text body lacks the required footer")
+		}
+		if email.Body != "" {
+			text, _ := HTMLToText(email.Body)
+			if !strings.Contains(strings.Join(strings.Fields(text), " "), footer) {
+				violate(PolicyFooter, "the html body lacks the required footer")
+			}
+		}
+	}
+
+	if len(p.Keywords) > 0 || len(p.Patterns) > 0 {
+		for _, part := range policyText(email) {
+			for _, found := range p.scan(part.text) {
+				violate(PolicyContent, "%s in %s", found, part.name)
+			}
+		}
+	}
+
+	if len(violations) > 0 {
+		return &PolicyError{Violations: violations}
+	}
+	return nil
+}
+
+// why BannedTypes has att, "" if it doesn't
+func (p OutboundPolicy) banned(att Attachment) string {
+	mediaType, _, _ := mime.ParseMediaType(att.contentType())
+	ext := strings.ToLower(path.Ext(att.Filename))
+	for _, banned := range p.BannedTypes {
+		banned = strings.ToLower(banned)
+		switch {
+		case strings.HasPrefix(banned, "."):
+			if ext == banned {
+				return "a banned file type (" + banned + ")"
+			}
+		case strings.HasSuffix(banned, "/*"):
+			if strings.HasPrefix(mediaType, strings.TrimSuffix(banned, "*")) {
+				return "a banned type (" + mediaType + ")"
+			}
+		case mediaType == banned:
+			return "a banned type (" + mediaType + ")"
+		}
+	}
+	return ""
+}
+
+type policyPart struct {
+	name, text string
+}
+
+// the text of the email DLP looks at
+func policyText(email Email) []policyPart {
+	parts := []policyPart{{"the subject", email.Subject}, {"the text body", email.TextBody}}
+	if email.Body != "" {
+		text, err := HTMLToText(email.Body)
+		if err != nil {
+			text = email.Body
+		}
+		parts = append(parts, policyPart{"the html body", text})
+	}
+	for _, att := range email.Attachments {
+		if mediaType, _, _ := mime.ParseMediaType(att.contentType()); strings.HasPrefix(mediaType, "text/") {
+			parts = append(parts, policyPart{"attachment " + att.Filename, string(att.Data)})
+		}
+	}
+	return parts
+}
+
+// the names of the keywords and rules text matches, each once
+func (p OutboundPolicy) scan(text string) []string {
+	var found []string
+	lower := strings.ToLower(text)
+	for _, keyword := range p.Keywords {
+		if containsWord(lower, strings.ToLower(keyword)) {
+			found = append(found, fmt.Sprintf("keyword %q", keyword))
+		}
+	}
+	for _, rule := range p.Patterns {
+		for _, match := range rule.Pattern.FindAllString(text, -1) {
+			if rule.Valid == nil || rule.Valid(match) {
+				found = append(found, rule.Name)
+				break
+			}
+		}
+	}
+	return found
+}
+
+// word somewhere in text with no letter or digit right before or after it
+func containsWord(text, word string) bool {
+	if word == "" {
+		return false
+	}
+	isWordByte := func(b byte) bool {
+		return b >= 'a' && b <= 'z' || b >= '0' && b <= '9' || b == '_' || b >= 0x80
+	}
+	for i := 0; ; {
+		j := strings.Index(text[i:], word)
+		if j < 0 {
+			return false
+		}
+		start, end := i+j, i+j+len(word)
+		if (start == 0 || !isWordByte(text[start-1])) && (end == len(text) || !isWordByte(text[end])) {
+			return true
+		}
+		i = start + 1
+	}
+}
+
+// the Luhn checksum of a card number, spaces and dashes ignored
+func luhnValid(number string) bool {
+	sum, n := 0, 0
+	for i := len(number) - 1; i >= 0; i-- {
+		c := number[i]
+		if c == ' ' || c == '-' {
+			continue
+		}
+		d := int(c - '0')
+		if n%2 == 1 {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		n++
+	}
+	return n >= 13 && sum%10 == 0
+}
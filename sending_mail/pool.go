@@ -0,0 +1,482 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// PooledSender keeps authenticated connections open between messages, for
+// sending many mails to the same server. It is safe for concurrent use.
+type PooledSender struct {
+	MaxConns           int           // open connections per server, default 4
+	MaxMessagesPerConn int           // reconnect after this many messages, 0 for no limit
+	IdleTimeout        time.Duration // close connections unused this long, default 1 minute
+
+	// attempts after a transient failure, see IsTransient, waiting
+	// RetryDelay before the first and twice as long before each next one;
+	// only the deferred recipients are tried again
+	MaxRetries int
+	RetryDelay time.Duration // default 1 second
+
+	// skip emails whose IdempotencyKey was sent already, nil for no check
+	Keys *SentKeys
+
+	mu    sync.Mutex
+	pools map[poolKey]*senderPool
+}
+
+// connections to one server with one set of credentials
+type senderPool struct {
+	busy chan struct{} // one slot per connection in use
+	mu   sync.Mutex
+	idle []*pooledConn
+}
+
+type pooledConn struct {
+	client   *smtpClient
+	sent     int
+	lastUsed time.Time
+}
+
+// implements the EmailSender interface
+func (p *PooledSender) Send(ctx context.Context, config SMTPConfig, email Email) error {
+	if err := email.Validate(); err != nil {
+		return err
+	}
+	if p.Keys != nil {
+		return p.Keys.once(ctx, email.IdempotencyKey, func() error {
+			return p.sendRetrying(ctx, config, email)
+		})
+	}
+	return p.sendRetrying(ctx, config, email)
+}
+
+// what SendAll did with one email
+type BatchResult struct {
+	Err        error             // nil when every recipient took it, a *DeliveryError when some did
+	Recipients []RecipientResult // one per envelope recipient
+}
+
+// SendAll sends emails concurrently over the connections to config's
+// server, MaxConns of them at a time, and returns their results in the
+// order of emails. An email that isn't valid is rejected for all its
+// recipients, and the ones still waiting when ctx is done are deferred
+// with ctx's error. The error tells how many emails failed, or is ctx's.
+func (p *PooledSender) SendAll(ctx context.Context, config SMTPConfig, emails []Email) ([]BatchResult, error) {
+	workers := p.MaxConns
+	if workers <= 0 {
+		workers = 4
+	}
+	results := make([]BatchResult, len(emails))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for range min(workers, len(emails)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				results[i] = p.sendOne(ctx, config, emails[i])
+			}
+		}()
+	}
+
+	next := 0
+feed:
+	for ; next < len(emails); next++ {
+		select {
+		case jobs <- next:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	for i := next; i < len(emails); i++ {
+		results[i] = batchResult(emails[i], ctx.Err())
+	}
+
+	if err := ctx.Err(); err != nil {
+		return results, err
+	}
+	failed := 0
+	for _, r := range results {
+		if r.Err != nil {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return results, fmt.Errorf("%d of %d emails failed", failed, len(emails))
+	}
+	return results, nil
+}
+
+func (p *PooledSender) sendOne(ctx context.Context, config SMTPConfig, email Email) BatchResult {
+	if err := email.Validate(); err != nil {
+		// the same email fails the same way next time
+		result := BatchResult{Err: err}
+		for _, rcpt := range email.Recipients() {
+			result.Recipients = append(result.Recipients, RecipientResult{Address: rcpt, Status: Rejected, Message: err.Error()})
+		}
+		return result
+	}
+	return batchResult(email, p.Send(ctx, config, email))
+}
+
+func batchResult(email Email, err error) BatchResult {
+	var delivery *DeliveryError
+	if errors.As(err, &delivery) {
+		return BatchResult{Err: err, Recipients: delivery.Results}
+	}
+	result := BatchResult{Err: err}
+	for _, rcpt := range email.Recipients() {
+		result.Recipients = append(result.Recipients, recipientResult(rcpt, err))
+	}
+	return result
+}
+
+// Send with MaxRetries retries
+func (p *PooledSender) sendRetrying(ctx context.Context, config SMTPConfig, email Email) (err error) {
+	msg, err := config.sign(buildMessage(email))
+	if err != nil {
+		return err
+	}
+
+	defer func() { err = contextError(ctx, err) }()
+
+	rcpts := email.Recipients()
+	left := rcpts
+	// the answers of earlier attempts for the recipients no longer tried
+	final := map[string]RecipientResult{}
+	delay := p.RetryDelay
+	if delay <= 0 {
+		delay = time.Second
+	}
+	for retry := 0; ; retry++ {
+		err = p.send(ctx, config, email.envelope(config.Username, left), msg)
+		if retry >= p.MaxRetries || !IsTransient(err) || ctx.Err() != nil {
+			break
+		}
+		var delivery *DeliveryError
+		if errors.As(err, &delivery) {
+			left = nil
+			for _, r := range delivery.Results {
+				if r.Status == Deferred {
+					left = append(left, r.Address)
+				} else {
+					final[r.Address] = r
+				}
+			}
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return mergeResults(rcpts, final, left, err)
+		}
+		delay *= 2
+	}
+	return mergeResults(rcpts, final, left, err)
+}
+
+// one attempt on a pooled connection
+func (p *PooledSender) send(ctx context.Context, config SMTPConfig, env envelope, msg []byte) error {
+	pool := p.pool(config)
+	select {
+	case pool.busy <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-pool.busy }()
+
+	for attempt := 0; ; attempt++ {
+		conn, reused, err := p.get(ctx, pool, config)
+		if err != nil {
+			return err
+		}
+
+		// the connection may have come from a config with other callbacks
+		conn.client.progress, conn.client.archive, conn.client.accepted = config.Progress, config.Archive, config.OnAccepted
+		release := conn.client.watch(ctx)
+		err = conn.client.sendMessage(env, msg)
+		release()
+		if err == nil {
+			conn.sent++
+			p.put(ctx, pool, conn)
+			return nil
+		}
+
+		if conn.client.usable() {
+			// the server refused this message, the connection is fine
+			p.put(ctx, pool, conn)
+			return err
+		}
+		conn.client.Close()
+		if !isConnectionError(err) {
+			return err
+		}
+
+		// an idle connection the server has dropped in the meantime
+		if !reused || attempt > 0 {
+			return err
+		}
+	}
+}
+
+// quit all idle connections
+func (p *PooledSender) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var firstErr error
+	for _, pool := range p.pools {
+		pool.mu.Lock()
+		for _, conn := range pool.idle {
+			if err := conn.client.Quit(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		pool.idle = nil
+		pool.mu.Unlock()
+	}
+	return firstErr
+}
+
+func (p *PooledSender) pool(config SMTPConfig) *senderPool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	key := newPoolKey(config)
+	if p.pools == nil {
+		p.pools = map[poolKey]*senderPool{}
+	}
+	pool, ok := p.pools[key]
+	if !ok {
+		maxConns := p.MaxConns
+		if maxConns <= 0 {
+			maxConns = 4
+		}
+		pool = &senderPool{busy: make(chan struct{}, maxConns)}
+		p.pools[key] = pool
+	}
+	return pool
+}
+
+// what a pooled session was set up with, so a connection is only reused for
+// a config that would have opened the same one: the server, the login, the
+// EHLO name, TLS and the transcript. The callbacks run per message and are
+// taken from the config of each send.
+type poolKey struct {
+	addr, username, password string
+	heloName, authMechanism  string
+	tlsMode                  TLSMode
+	minVersion               uint16
+	rootCAs                  *x509.CertPool
+	certificates             string // the slice's array, compared by identity
+	insecureSkipVerify       bool
+	auth, transcript         any
+}
+
+func newPoolKey(config SMTPConfig) poolKey {
+	return poolKey{
+		addr:               config.addr(),
+		username:           config.Username,
+		password:           config.Password,
+		heloName:           config.HeloName,
+		authMechanism:      config.AuthMechanism,
+		tlsMode:            config.TLSMode,
+		minVersion:         config.TLS.MinVersion,
+		rootCAs:            config.TLS.RootCAs,
+		certificates:       fmt.Sprintf("%p/%d", config.TLS.Certificates, len(config.TLS.Certificates)),
+		insecureSkipVerify: config.TLS.InsecureSkipVerify,
+		auth:               mapKey(config.Auth),
+		transcript:         mapKey(config.Transcript),
+	}
+}
+
+// v when it can be a map key, eg. a pointer, its type and value as text
+// otherwise, eg. for a TranscriptFunc, which prints as its address
+func mapKey(v any) any {
+	if v == nil || reflect.ValueOf(v).Comparable() {
+		return v
+	}
+	return fmt.Sprintf("%T %v", v, v)
+}
+
+// an idle connection if there is a fresh one, a new one otherwise
+func (p *PooledSender) get(ctx context.Context, pool *senderPool, config SMTPConfig) (*pooledConn, bool, error) {
+	idleTimeout := p.IdleTimeout
+	if idleTimeout <= 0 {
+		idleTimeout = time.Minute
+	}
+
+	pool.mu.Lock()
+	for len(pool.idle) > 0 {
+		conn := pool.idle[len(pool.idle)-1]
+		pool.idle = pool.idle[:len(pool.idle)-1]
+		if time.Since(conn.lastUsed) < idleTimeout {
+			pool.mu.Unlock()
+			return conn, true, nil
+		}
+		go conn.client.Quit()
+	}
+	pool.mu.Unlock()
+
+	client, err := NewSMTPClient(ctx, config)
+	if err != nil {
+		return nil, false, err
+	}
+	return &pooledConn{client: client}, false, nil
+}
+
+// reset and back to the idle list, or quit once the message limit is reached
+func (p *PooledSender) put(ctx context.Context, pool *senderPool, conn *pooledConn) {
+	release := conn.client.watch(ctx)
+	if p.MaxMessagesPerConn > 0 && conn.sent >= p.MaxMessagesPerConn {
+		conn.client.Quit()
+		release()
+		return
+	}
+	err := conn.client.Reset()
+	release()
+	if err != nil {
+		conn.client.Close()
+		return
+	}
+
+	conn.lastUsed = time.Now()
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	pool.idle = append(pool.idle, conn)
+}
+
+// MAIL, RCPT and DATA for one message
+func (c *smtpClient) sendMessage(env envelope, msg []byte) error {
+	env.Size = int64(len(msg))
+	return c.send(env, func(w io.Writer) error {
+		_, err := w.Write(msg)
+		return err
+	})
+}
+
+// one transaction. Rejected recipients don't stop the others from getting
+// the message, they are reported in a *DeliveryError instead.
+func (c *smtpClient) send(env envelope, write func(io.Writer) error) error {
+	if c.state != sessionReady {
+		return fmt.Errorf("smtp: can't start a transaction on a session that is %s", c.state)
+	}
+	if err := c.checkSize(env.Size); err != nil {
+		return err
+	}
+
+	var sent *bytes.Buffer // a copy for the archive
+	if c.archive != nil {
+		sent = &bytes.Buffer{}
+		writeMessage := write
+		write = func(w io.Writer) error { return writeMessage(io.MultiWriter(w, sent)) }
+	}
+
+	mailErr, rcptErrs := c.sendEnvelope(env)
+	if mailErr != nil {
+		c.fail(mailErr)
+		return fmt.Errorf("MAIL command failed: %w", mailErr)
+	}
+	c.state = sessionMail
+
+	rcpts := env.To
+	results := make([]RecipientResult, len(rcpts))
+	var accepted []int
+	for i, rcpt := range rcpts {
+		err := rcptErrs[i]
+		if err != nil && isConnectionError(err) {
+			c.fail(err)
+			return fmt.Errorf("RCPT command failed for %s: %w", rcpt, err)
+		}
+		results[i] = recipientResult(rcpt, err)
+		if err == nil {
+			accepted = append(accepted, i)
+		}
+	}
+	if len(accepted) == 0 {
+		return deliveryError(results)
+	}
+
+	// a failed DATA fails every recipient the server had accepted
+	failData := func(err error) error {
+		if isConnectionError(err) {
+			c.fail(err)
+			return err
+		}
+		for _, i := range accepted {
+			results[i] = recipientResult(rcpts[i], err)
+		}
+		return &DeliveryError{Results: results}
+	}
+
+	writer, err := c.dataWriter()
+	if err != nil {
+		err = smtpError(err)
+		return failData(fmt.Errorf("DATA command failed: %w", err))
+	}
+	c.state = sessionData
+	if c.progress != nil {
+		writer = newProgressWriter(writer, env.Size, c.progress)
+	}
+	if err := write(writer); err != nil {
+		// BDAT gets a reply per chunk, the server may refuse midway and
+		// the transaction is over
+		var protoErr *textproto.Error
+		if errors.As(err, &protoErr) {
+			c.state = sessionMail
+			return failData(fmt.Errorf("message not accepted: %w", err))
+		}
+		// ending the data now would hand the server a truncated message,
+		// the connection goes instead
+		c.state = sessionBroken
+		c.Close()
+		return fmt.Errorf("DATA write failed: %w", err)
+	}
+	c.final = Receipt{}
+	if err := writer.Close(); err != nil {
+		c.state = sessionReady
+		return failData(fmt.Errorf("message not accepted: %w", smtpError(err)))
+	}
+	c.state = sessionReady
+
+	receipt := c.final
+	receipt.Server = c.conn.RemoteAddr().String()
+	for _, i := range accepted {
+		results[i].Code, results[i].Enhanced, results[i].Message = receipt.Code, receipt.Enhanced, receipt.Message
+		receipt.Recipients = append(receipt.Recipients, rcpts[i])
+	}
+	if sent != nil {
+		c.archiveCopy(env, results, receipt, sent.Bytes())
+	}
+	if c.accepted != nil {
+		c.accepted(receipt)
+	}
+	return deliveryError(results)
+}
+
+// the connection is gone or the server is shutting it down (421)
+func isConnectionError(err error) bool {
+	var netErr net.Error
+	var protoErr *textproto.Error
+	switch {
+	case errors.Is(err, io.EOF), errors.Is(err, net.ErrClosed), errors.As(err, &netErr):
+		return true
+	case errors.As(err, &protoErr):
+		return protoErr.Code == 421
+	}
+	return false
+}
@@ -0,0 +1,39 @@
+package main
+
+import "testing"
+
+func TestPoolKey(t *testing.T) {
+	base := SMTPConfig{Host: "smtp.example.com", Username: "user", Password: "secret"}
+	p := &PooledSender{}
+	pool := p.pool(base)
+	if p.pool(base) != pool {
+		t.Fatal("the same config got another pool")
+	}
+
+	logf := TranscriptFunc(func(conn, line string) {})
+	for name, change := range map[string]func(*SMTPConfig){
+		"password":       func(c *SMTPConfig) { c.Password = "other" },
+		"helo name":      func(c *SMTPConfig) { c.HeloName = "client.example.com" },
+		"auth mechanism": func(c *SMTPConfig) { c.AuthMechanism = "PLAIN" },
+		"auth":           func(c *SMTPConfig) { c.Auth = &XOAuth2{Username: "user"} },
+		"tls mode":       func(c *SMTPConfig) { c.TLSMode = NoTLS },
+		"tls options":    func(c *SMTPConfig) { c.TLS.InsecureSkipVerify = true },
+		"transcript":     func(c *SMTPConfig) { c.Transcript = logf },
+	} {
+		config := base
+		change(&config)
+		if p.pool(config) == pool {
+			t.Errorf("a config with another %s shares the pool", name)
+		}
+		if p.pool(config) != p.pool(config) {
+			t.Errorf("a config with another %s gets a new pool each time", name)
+		}
+	}
+
+	// per-message callbacks don't change the session
+	config := base
+	config.OnAccepted = func(Receipt) {}
+	if p.pool(config) != pool {
+		t.Error("OnAccepted split the pool")
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import "fmt"
+
+// how urgent an email is; clients show high priority mail with a flag and
+// may sort by it
+type Priority int
+
+const (
+	PriorityNormal Priority = iota // no header fields, what clients assume anyway
+	PriorityHigh
+	PriorityLow
+)
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityNormal:
+		return "normal"
+	case PriorityHigh:
+		return "high"
+	case PriorityLow:
+		return "low"
+	}
+	return fmt.Sprintf("Priority(%d)", int(p))
+}
+
+// X-Priority for Outlook, Thunderbird and most others, and Importance
+// (RFC 2156) for Exchange; empty for normal priority
+func (p Priority) headers() (xPriority, importance string) {
+	switch p {
+	case PriorityHigh:
+		return "1 (Highest)", "high"
+	case PriorityLow:
+		return "5 (Lowest)", "low"
+	}
+	return "", ""
+}
+
+// how a client should treat an email's content (RFC 2156 Sensitivity);
+// Outlook marks it and won't let a private message be changed when it is
+// forwarded
+type Sensitivity int
+
+const (
+	SensitivityNormal Sensitivity = iota // no header field
+	SensitivityPersonal
+	SensitivityPrivate
+	SensitivityConfidential
+)
+
+func (s Sensitivity) String() string {
+	switch s {
+	case SensitivityNormal:
+		return "normal"
+	case SensitivityPersonal:
+		return "personal"
+	case SensitivityPrivate:
+		return "private"
+	case SensitivityConfidential:
+		return "confidential"
+	}
+	return fmt.Sprintf("Sensitivity(%d)", int(s))
+}
+
+// the Sensitivity value, empty for normal
+func (s Sensitivity) header() string {
+	switch s {
+	case SensitivityPersonal:
+		return "Personal"
+	case SensitivityPrivate:
+		return "Private"
+	case SensitivityConfidential:
+		return "Company-Confidential"
+	}
+	return ""
+}
+
+func (p Priority) validate() error {
+	if p < PriorityNormal || p > PriorityLow {
+		return fmt.Errorf("invalid priority %d", int(p))
+	}
+	return nil
+}
+
+func (s Sensitivity) validate() error {
+	if s < SensitivityNormal || s > SensitivityConfidential {
+		return fmt.Errorf("invalid sensitivity %d", int(s))
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"io"
+	"time"
+)
+
+// how far the message data of one transaction has got, for
+// SMTPConfig.Progress
+type DataProgress struct {
+	Written int64         // bytes of the message handed to the connection
+	Total   int64         // the message size, 0 when it isn't known
+	Elapsed time.Duration // since DATA or the first BDAT
+	Done    bool          // the server took the message, the last report
+}
+
+// the share written, 0 to 1, or -1 when the size isn't known
+func (p DataProgress) Fraction() float64 {
+	if p.Total <= 0 {
+		return -1
+	}
+	return min(float64(p.Written)/float64(p.Total), 1)
+}
+
+// the average transfer speed so far
+func (p DataProgress) BytesPerSecond() float64 {
+	if p.Elapsed <= 0 {
+		return 0
+	}
+	return float64(p.Written) / p.Elapsed.Seconds()
+}
+
+// bytes between two progress reports; the message writers write a line
+// at a time, a report per write would be one per header field
+const progressStep = 64 << 10
+
+// reports the data written through it to report
+type progressWriter struct {
+	io.WriteCloser
+	report   func(DataProgress)
+	progress DataProgress
+	start    time.Time
+	reported int64 // Written at the last report
+}
+
+func newProgressWriter(w io.WriteCloser, total int64, report func(DataProgress)) *progressWriter {
+	pw := &progressWriter{WriteCloser: w, report: report, start: time.Now()}
+	pw.progress.Total = total
+	pw.send()
+	return pw
+}
+
+// a message written at once goes out in steps, to report between them
+func (w *progressWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n, err := w.WriteCloser.Write(p[:min(len(p), progressStep)])
+		written += n
+		w.progress.Written += int64(n)
+		if w.progress.Written-w.reported >= progressStep || w.progress.Written == w.progress.Total {
+			w.send()
+		}
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// the final report once the server has replied to the end of the data
+func (w *progressWriter) Close() error {
+	err := w.WriteCloser.Close()
+	if err == nil {
+		w.progress.Done = true
+		w.send()
+	}
+	return err
+}
+
+func (w *progressWriter) send() {
+	w.progress.Elapsed = time.Since(w.start)
+	w.reported = w.progress.Written
+	w.report(w.progress)
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Queue spools messages to disk and delivers them through Sender, retrying
+// temporary failures with exponential backoff. Pending messages survive a
+// restart: Run picks up whatever is left in Dir. EnqueueAt holds a message
+// back until a given time, Cancel withdraws it while it is still queued.
+// An email with an IdempotencyKey that is queued or was sent already isn't
+// queued again.
+type Queue struct {
+	Dir    string
+	Sender EmailSender
+	Config SMTPConfig
+
+	MinBackoff time.Duration // first retry delay, default 1 minute
+	MaxBackoff time.Duration // longest retry delay, default 1 hour
+	MaxAge     time.Duration // give up on a message after this long, default 48 hours
+	Interval   time.Duration // how often the spool is scanned, default 10 seconds
+
+	// how long one delivery attempt may take, default 10 minutes; one
+	// that takes longer counts as a temporary failure
+	AttemptTimeout time.Duration
+
+	// the IdempotencyKeys sent, NewQueue keeps them in Dir; nil to check
+	// only the messages still queued
+	Keys *SentKeys
+
+	mu        sync.Mutex               // guards sending and the spool files of the messages in it
+	sending   map[string]chan struct{} // the messages being sent, closed when done
+	enqueueMu sync.Mutex               // held while a key is looked up and its message spooled
+}
+
+// a spooled message, one JSON file per message
+type queuedMessage struct {
+	ID          string    `json:"id"`
+	Email       Email     `json:"email"`
+	Created     time.Time `json:"created"`
+	Attempts    int       `json:"attempts"`
+	SendAt      time.Time `json:"send_at,omitempty"` // not before, see EnqueueAt
+	NextAttempt time.Time `json:"next_attempt"`
+	LastError   string    `json:"last_error,omitempty"`
+}
+
+func NewQueue(dir string, sender EmailSender, config SMTPConfig) (*Queue, error) {
+	if err := os.MkdirAll(filepath.Join(dir, "failed"), 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create queue directory: %w", err)
+	}
+	// not .json, the spool files are
+	keys := &SentKeys{Path: filepath.Join(dir, "sent-keys")}
+	return &Queue{Dir: dir, Sender: sender, Config: config, Keys: keys}, nil
+}
+
+var ErrNotQueued = errors.New("message is not in the queue")
+
+// spool email for delivery and return its queue ID. For an email whose
+// IdempotencyKey is queued or was sent already the ID is the one of that
+// message, and nothing is spooled.
+func (q *Queue) Enqueue(email Email) (string, error) {
+	return q.EnqueueAt(email, time.Time{})
+}
+
+// spool email to be sent at sendAt, or right away when that is zero or
+// past. MaxAge counts from sendAt. The time is an instant, so a message
+// for 9:00 in Berlin is EnqueueAt(email, time.Date(..., 9, 0, 0, 0,
+// berlin)), see SendTime.
+func (q *Queue) EnqueueAt(email Email, sendAt time.Time) (string, error) {
+	if err := email.Validate(); err != nil {
+		return "", err
+	}
+	// keys don't belong in the spool
+	if email.SMIME != nil || email.PGP != nil {
+		return "", errors.New("S/MIME and PGP messages can't be queued")
+	}
+	if key := email.IdempotencyKey; key != "" {
+		q.enqueueMu.Lock()
+		defer q.enqueueMu.Unlock()
+		if id, ok, err := q.findKey(key); err != nil || ok {
+			return id, err
+		}
+	}
+	id, err := newQueueID()
+	if err != nil {
+		return "", err
+	}
+	// a fixed Message-ID, retries must not look like new messages
+	if !hasHeader(email.Headers, "Message-ID") {
+		headers := map[string]string{"Message-ID": newMessageID(email.From.Address)}
+		maps.Copy(headers, email.Headers)
+		email.Headers = headers
+	}
+	email = email.withFixedInvite()
+
+	now := time.Now()
+	msg := queuedMessage{ID: id, Email: email, Created: now, NextAttempt: now}
+	if sendAt.After(now) {
+		// no Date header yet: the message is dated when it goes out
+		msg.SendAt, msg.NextAttempt = sendAt, sendAt
+	}
+	if err := q.save(q.Dir, msg); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// SendTime is the instant of a wall clock time in a time zone, for
+// EnqueueAt: SendTime("2026-03-09 09:00", "America/New_York"). value is
+// "2006-01-02 15:04", with optional seconds, or a date for midnight; zone
+// an IANA name, "Local" or "" for UTC. A time that doesn't exist because
+// the clocks skip it is moved on by the gap, one that happens twice is
+// the first.
+func SendTime(value, zone string) (time.Time, error) {
+	loc, err := time.LoadLocation(zone)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time zone: %w", err)
+	}
+	for _, layout := range []string{"2006-01-02 15:04", "2006-01-02 15:04:05", "2006-01-02T15:04", "2006-01-02T15:04:05", "2006-01-02"} {
+		wall, err := time.Parse(layout, value)
+		if err != nil {
+			continue
+		}
+		t := time.Date(wall.Year(), wall.Month(), wall.Day(), wall.Hour(), wall.Minute(), wall.Second(), 0, loc)
+		if t.Hour() != wall.Hour() || t.Minute() != wall.Minute() {
+			// in a gap, which time.Date may resolve either way: read it
+			// with the offset from before the change
+			_, before := t.Add(-12 * time.Hour).Zone()
+			t = time.Date(wall.Year(), wall.Month(), wall.Day(), wall.Hour(), wall.Minute(), wall.Second(), 0, time.FixedZone("", before)).In(loc)
+		}
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid send time %q, want eg. 2006-01-02 15:04", value)
+}
+
+// the ID of the message with the idempotency key, sent or queued
+func (q *Queue) findKey(key string) (string, bool, error) {
+	if q.Keys != nil {
+		if entry, ok := q.Keys.lookup(key); ok {
+			return entry.ID, true, nil
+		}
+	}
+	msgs, err := q.load()
+	if err != nil {
+		return "", false, err
+	}
+	for _, msg := range msgs {
+		if msg.Email.IdempotencyKey == key {
+			return msg.ID, true, nil
+		}
+	}
+	return "", false, nil
+}
+
+func newQueueID() (string, error) {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return time.Now().UTC().Format("20060102T150405") + "-" + hex.EncodeToString(b[:]), nil
+}
+
+// remove a message that hasn't been sent yet, scheduled or waiting for a
+// retry. A message being sent right now is waited for; if it goes out,
+// the result is ErrNotQueued.
+func (q *Queue) Cancel(id string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for {
+		done, ok := q.sending[filepath.Base(id)]
+		if !ok {
+			break
+		}
+		q.mu.Unlock()
+		<-done
+		q.mu.Lock()
+	}
+	err := os.Remove(q.path(q.Dir, filepath.Base(id)))
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("%s: %w", id, ErrNotQueued)
+	}
+	return err
+}
+
+// deliver due messages until stop is closed. The spool is scanned every
+// Interval, and in between whenever the next scheduled message is due.
+func (q *Queue) Run(stop <-chan struct{}) {
+	interval := q.Interval
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+
+	for {
+		wait := interval
+		if next := q.flush(); !next.IsZero() {
+			wait = min(wait, max(time.Until(next), 0))
+		}
+		timer.Reset(wait)
+		select {
+		case <-stop:
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// one pass over the spool, delivering every message that is due
+func (q *Queue) Flush() {
+	q.flush()
+}
+
+// Flush, returning when the next message that isn't due yet will be,
+// zero if there is none
+func (q *Queue) flush() time.Time {
+	msgs, err := q.load()
+	if err != nil {
+		log.Printf("queue: %v", err)
+		return time.Time{}
+	}
+	var next time.Time
+	for _, msg := range msgs {
+		if time.Now().Before(msg.NextAttempt) {
+			if next.IsZero() || msg.NextAttempt.Before(next) {
+				next = msg.NextAttempt
+			}
+			continue
+		}
+		q.deliver(msg)
+	}
+	return next
+}
+
+func (q *Queue) deliver(msg queuedMessage) {
+	q.mu.Lock()
+	// canceled since load, or sent by another Flush meanwhile; the lock
+	// isn't held while sending, Cancel waits for done instead
+	if !q.stillDue(&msg) {
+		q.mu.Unlock()
+		return
+	}
+	if q.sending == nil {
+		q.sending = map[string]chan struct{}{}
+	}
+	done := make(chan struct{})
+	q.sending[msg.ID] = done
+	q.mu.Unlock()
+
+	msg.Attempts++
+	timeout := q.AttemptTimeout
+	if timeout <= 0 {
+		timeout = 10 * time.Minute
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	err := q.Sender.Send(ctx, q.Config, msg.Email)
+	cancel()
+
+	q.mu.Lock()
+	defer func() {
+		delete(q.sending, msg.ID)
+		close(done)
+		q.mu.Unlock()
+	}()
+	if key := msg.Email.IdempotencyKey; key != "" && q.Keys != nil && anyAccepted(err) {
+		q.Keys.record(key, msg.ID)
+	}
+	if err == nil {
+		if err := os.Remove(q.path(q.Dir, msg.ID)); err != nil {
+			log.Printf("queue: %s sent but not removed: %v", msg.ID, err)
+		}
+		return
+	}
+
+	msg.LastError = err.Error()
+	maxAge := q.MaxAge
+	if maxAge <= 0 {
+		maxAge = 48 * time.Hour
+	}
+	transient := IsTransient(err)
+
+	// retry only the recipients that were deferred
+	var delivery *DeliveryError
+	if errors.As(err, &delivery) && transient {
+		deferred := delivery.with(Deferred)
+		rcpts := make([]string, len(deferred))
+		for i, r := range deferred {
+			rcpts[i] = r.Address
+		}
+		msg.Email = msg.Email.onlyTo(rcpts)
+	}
+
+	start := msg.Created
+	if msg.SendAt.After(start) {
+		start = msg.SendAt
+	}
+	if !transient || time.Since(start) > maxAge {
+		log.Printf("queue: giving up on %s after %d attempts: %v", msg.ID, msg.Attempts, err)
+		q.fail(msg)
+		return
+	}
+
+	msg.NextAttempt = time.Now().Add(q.backoff(msg.Attempts))
+	if err := q.save(q.Dir, msg); err != nil {
+		log.Printf("queue: %v", err)
+	}
+}
+
+// whether msg is still spooled and due, with msg updated to the spooled
+// copy; q.mu is held
+func (q *Queue) stillDue(msg *queuedMessage) bool {
+	if _, ok := q.sending[msg.ID]; ok {
+		return false
+	}
+	data, err := os.ReadFile(q.path(q.Dir, msg.ID))
+	if err != nil {
+		return false
+	}
+	var spooled queuedMessage
+	if err := json.Unmarshal(data, &spooled); err != nil || time.Now().Before(spooled.NextAttempt) {
+		return false
+	}
+	*msg = spooled
+	return true
+}
+
+// MinBackoff doubled per attempt, capped at MaxBackoff
+func (q *Queue) backoff(attempts int) time.Duration {
+	delay, limit := q.MinBackoff, q.MaxBackoff
+	if delay <= 0 {
+		delay = time.Minute
+	}
+	if limit <= 0 {
+		limit = time.Hour
+	}
+	for i := 1; i < attempts && delay < limit; i++ {
+		delay *= 2
+	}
+	return min(delay, limit)
+}
+
+// move a message to the failed directory
+func (q *Queue) fail(msg queuedMessage) {
+	if err := q.save(filepath.Join(q.Dir, "failed"), msg); err != nil {
+		log.Printf("queue: %v", err)
+		return
+	}
+	os.Remove(q.path(q.Dir, msg.ID))
+}
+
+// pending messages, oldest first
+func (q *Queue) load() ([]queuedMessage, error) {
+	entries, err := os.ReadDir(q.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read queue: %w", err)
+	}
+
+	var msgs []queuedMessage
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(q.Dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var msg queuedMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			log.Printf("queue: skipping unreadable %s: %v", entry.Name(), err)
+			continue
+		}
+		msgs = append(msgs, msg)
+	}
+	sort.Slice(msgs, func(i, j int) bool { return msgs[i].Created.Before(msgs[j].Created) })
+	return msgs, nil
+}
+
+// write to a temporary file and rename, a crash never leaves half a message
+func (q *Queue) save(dir string, msg queuedMessage) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(dir, "."+msg.ID+".tmp")
+	os.Remove(tmp) // left over from a crash in an earlier save
+	err = writeFileAtomic(tmp, q.path(dir, msg.ID), func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to spool message: %w", err)
+	}
+	return nil
+}
+
+func (q *Queue) path(dir, id string) string {
+	return filepath.Join(dir, id+".json")
+}
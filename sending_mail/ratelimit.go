@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// RateLimiter paces sending. Wait blocks until a message to n recipients
+// may go out; providers count recipients, not messages, against quotas.
+type RateLimiter interface {
+	Wait(ctx context.Context, n int) error
+}
+
+// TokenBucket allows Burst recipients at once and refills at Rate per Per,
+// eg. Rate 500, Per 24h, Burst 500 for a daily quota.
+type TokenBucket struct {
+	Rate  int
+	Per   time.Duration
+	Burst int // default Rate
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func NewTokenBucket(rate int, per time.Duration, burst int) *TokenBucket {
+	return &TokenBucket{Rate: rate, Per: per, Burst: burst}
+}
+
+func (b *TokenBucket) Wait(ctx context.Context, n int) error {
+	return MultiLimiter{b}.Wait(ctx, n)
+}
+
+// Reservation is tokens taken from a TokenBucket ahead of time. They may be
+// spent once Delay has passed, or handed back with Cancel.
+type Reservation struct {
+	bucket *TokenBucket // nil for an unlimited bucket
+	n      int
+	at     time.Time // when the refill has covered the tokens
+}
+
+// Reserve takes n tokens, borrowing from the refill when there aren't enough.
+// It fails only when n is more than the bucket ever holds.
+func (b *TokenBucket) Reserve(n int) (*Reservation, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	burst, perToken, limited := b.limits()
+	if !limited {
+		return &Reservation{}, nil
+	}
+	if n > burst {
+		return nil, fmt.Errorf("%d recipients exceed the rate limit burst of %d", n, burst)
+	}
+	now := time.Now()
+	b.refill(now, burst, perToken)
+	b.tokens -= float64(n)
+	at := now
+	if b.tokens < 0 {
+		at = now.Add(time.Duration(-b.tokens * float64(perToken)))
+	}
+	return &Reservation{bucket: b, n: n, at: at}, nil
+}
+
+// Delay is how long to wait before acting on the reservation.
+func (r *Reservation) Delay() time.Duration {
+	return max(time.Until(r.at), 0)
+}
+
+// Cancel returns the tokens to the bucket, for when the action they were
+// reserved for is given up.
+func (r *Reservation) Cancel() {
+	if r.bucket == nil || r.n == 0 {
+		return
+	}
+	b := r.bucket
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	burst, perToken, _ := b.limits()
+	b.refill(time.Now(), burst, perToken)
+	b.tokens = min(float64(burst), b.tokens+float64(r.n))
+	r.n = 0
+}
+
+// take n tokens if they are there now, without borrowing
+func (b *TokenBucket) allow(n int) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	burst, perToken, limited := b.limits()
+	if !limited {
+		return true
+	}
+	b.refill(time.Now(), burst, perToken)
+	if b.tokens < float64(n) {
+		return false
+	}
+	b.tokens -= float64(n)
+	return true
+}
+
+// the bucket size and refill interval; false when there is no limit.
+// b.mu is held
+func (b *TokenBucket) limits() (burst int, perToken time.Duration, limited bool) {
+	if b.Rate <= 0 || b.Per <= 0 {
+		return 0, 0, false
+	}
+	burst = b.Burst
+	if burst <= 0 {
+		burst = b.Rate
+	}
+	return burst, b.Per / time.Duration(b.Rate), true
+}
+
+// add the tokens that came in since the last call, a new bucket starts
+// full; b.mu is held
+func (b *TokenBucket) refill(now time.Time, burst int, perToken time.Duration) {
+	if b.last.IsZero() {
+		b.tokens = float64(burst)
+	} else {
+		b.tokens = min(float64(burst), b.tokens+float64(now.Sub(b.last))/float64(perToken))
+	}
+	b.last = now
+}
+
+// every bucket has to agree, eg. a per-second rate and a daily quota
+type MultiLimiter []*TokenBucket
+
+// Wait reserves the tokens of every bucket up front and waits for the
+// slowest, so that when ctx ends first all of them can be handed back.
+func (m MultiLimiter) Wait(ctx context.Context, n int) error {
+	var reservations []*Reservation
+	cancel := func() {
+		for _, r := range reservations {
+			r.Cancel()
+		}
+	}
+
+	var delay time.Duration
+	for _, bucket := range m {
+		r, err := bucket.Reserve(n)
+		if err != nil {
+			cancel()
+			return err
+		}
+		reservations = append(reservations, r)
+		delay = max(delay, r.Delay())
+	}
+	if delay == 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		cancel()
+		return ctx.Err()
+	}
+}
+
+// provider presets, a little under the published limits so that messages
+// sent by other means the same day don't tip the account over
+func GmailLimiter() RateLimiter {
+	// consumer accounts: 500 recipients a day, and a per-minute cap
+	// against bursts that trigger temporary blocks
+	return MultiLimiter{
+		NewTokenBucket(20, time.Minute, 20),
+		NewTokenBucket(450, 24*time.Hour, 450),
+	}
+}
+
+func GoogleWorkspaceLimiter() RateLimiter {
+	// 2000 recipients a day
+	return MultiLimiter{
+		NewTokenBucket(60, time.Minute, 60),
+		NewTokenBucket(1800, 24*time.Hour, 1800),
+	}
+}
+
+func Office365Limiter() RateLimiter {
+	// 30 a minute and 10000 recipients a day
+	return MultiLimiter{
+		NewTokenBucket(27, time.Minute, 27),
+		NewTokenBucket(9000, 24*time.Hour, 9000),
+	}
+}
+
+// Amazon SES quotas differ per account, see the console's sending limits
+func SESLimiter(perSecond, perDay int) RateLimiter {
+	return MultiLimiter{
+		NewTokenBucket(perSecond, time.Second, perSecond),
+		NewTokenBucket(perDay, 24*time.Hour, perDay),
+	}
+}
+
+// RateLimitedSender waits for Limiter before handing each message to Sender
+type RateLimitedSender struct {
+	Sender  EmailSender
+	Limiter RateLimiter
+}
+
+// implements the EmailSender interface
+func (s RateLimitedSender) Send(ctx context.Context, config SMTPConfig, email Email) error {
+	if err := s.Limiter.Wait(ctx, len(email.Recipients())); err != nil {
+		return err
+	}
+	return s.Sender.Send(ctx, config, email)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// a wait cancelled on the daily quota hands the per-minute tokens back
+func TestMultiLimiterCancel(t *testing.T) {
+	perMinute := NewTokenBucket(10, time.Minute, 10)
+	daily := NewTokenBucket(5, 24*time.Hour, 5)
+	limiter := MultiLimiter{perMinute, daily}
+
+	if err := limiter.Wait(context.Background(), 5); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := limiter.Wait(ctx, 5); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("wait on an empty daily quota: %v", err)
+	}
+
+	r, err := perMinute.Reserve(5)
+	if err != nil || r.Delay() != 0 {
+		t.Errorf("per-minute tokens lost: delay %v, %v", r.Delay(), err)
+	}
+	r, err = daily.Reserve(1)
+	if err != nil || r.Delay() < time.Hour {
+		t.Errorf("daily quota refilled: delay %v, %v", r.Delay(), err)
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	b := NewTokenBucket(100, time.Second, 2)
+	if err := b.Wait(context.Background(), 3); err == nil {
+		t.Error("more recipients than the burst were let through")
+	}
+
+	start := time.Now()
+	for range 4 {
+		if err := b.Wait(context.Background(), 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// two tokens at once, then 10ms each
+	if elapsed := time.Since(start); elapsed < 15*time.Millisecond {
+		t.Errorf("4 tokens in %v", elapsed)
+	}
+
+	if !NewTokenBucket(0, time.Second, 0).allow(1000) {
+		t.Error("a bucket without a rate limited")
+	}
+}
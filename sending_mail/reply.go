@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"net/mail"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// Reply starts a reply to original, eg. a message from ParseEmail: to its
+// Reply-To or From address, with the subject prefixed by "Re: ", threaded
+// under it by In-Reply-To and References (RFC 5322 3.6.4), and with the
+// original quoted below an attribution line, in the text body and, if the
+// original has one, the html body. The inline images of the original go
+// along for the quoted html. From is left for the caller, as is the reply
+// itself, which goes before the quote:
+//
+//	reply := Reply(*original)
+//	reply.From = me
+//	reply.TextBody = "Thanks, done.\n" + reply.TextBody
+func Reply(original Email) Email {
+	reply := Email{
+		To:      replyTo(original),
+		Subject: replySubject(original.Subject),
+		Headers: map[string]string{},
+	}
+	if id := strings.TrimSpace(headerValue(original.Headers, "Message-ID")); id != "" {
+		reply.Headers["In-Reply-To"] = id
+		// the parent's references, or its parent when it has none, and then
+		// the parent itself
+		references := strings.Fields(headerValue(original.Headers, "References"))
+		if len(references) == 0 {
+			references = strings.Fields(headerValue(original.Headers, "In-Reply-To"))
+			if len(references) != 1 {
+				references = nil
+			}
+		}
+		reply.Headers["References"] = strings.Join(append(references, id), " ")
+	}
+
+	attribution := replyAttribution(original)
+	text := original.TextBody
+	if text == "" && original.Body != "" {
+		text, _ = HTMLToText(original.Body)
+	}
+	reply.TextBody = "\n\n" + attribution + "\n" + quoteText(text)
+	if original.Body != "" {
+		reply.Body = "<p></p>\n<p>" + html.EscapeString(attribution) + "</p>\n" +
+			`<blockquote type="cite" style="margin:0 0 0 .8ex;border-left:1px solid #ccc;padding-left:1ex">` + "\n" +
+			htmlBodyContent(original.Body) + "\n</blockquote>\n"
+		for _, att := range original.Attachments {
+			if att.Inline {
+				reply.Attachments = append(reply.Attachments, att)
+			}
+		}
+	}
+	return reply
+}
+
+// Reply-To if the original has a valid one, From otherwise
+func replyTo(original Email) []mail.Address {
+	if list, err := mail.ParseAddressList(headerValue(original.Headers, "Reply-To")); err == nil && len(list) > 0 {
+		to := make([]mail.Address, len(list))
+		for i, addr := range list {
+			to[i] = *addr
+		}
+		return to
+	}
+	if original.From.Address == "" {
+		return nil
+	}
+	return []mail.Address{original.From}
+}
+
+// "Re: " once, however many replies deep
+func replySubject(subject string) string {
+	subject = strings.TrimSpace(subject)
+	if len(subject) >= 3 && strings.EqualFold(subject[:3], "re:") {
+		return subject
+	}
+	return "Re: " + subject
+}
+
+// "On Mon, 2 Jan 2006 at 15:04, Name <address> wrote:"
+func replyAttribution(original Email) string {
+	from := original.From.Address
+	if original.From.Name != "" {
+		from = original.From.Name + " <" + original.From.Address + ">"
+	}
+	if date, err := mail.ParseDate(headerValue(original.Headers, "Date")); err == nil {
+		return fmt.Sprintf("On %s, %s wrote:", date.Format("Mon, 2 Jan 2006 at 15:04"), from)
+	}
+	return from + " wrote:"
+}
+
+// every line with "> ", or ">" before a line that is quoted already
+func quoteText(text string) string {
+	text = strings.TrimRight(strings.ReplaceAll(text, "\r\n", "\n"), "\n")
+	var b strings.Builder
+	for _, line := range strings.Split(text, "\n") {
+		switch {
+		case line == "":
+			b.WriteString(">\n")
+		case strings.HasPrefix(line, ">"):
+			b.WriteString(">" + line + "\n")
+		default:
+			b.WriteString("> " + line + "\n")
+		}
+	}
+	return b.String()
+}
+
+// what is inside <body>, to nest the html of a message in another; the
+// style sheets in its head are inlined first, they would be lost
+func htmlBodyContent(body string) string {
+	if inlined, err := (HTMLPreprocessor{InlineCSS: true}).Process(body); err == nil {
+		body = inlined
+	}
+	doc, err := html.Parse(strings.NewReader(body))
+	if err != nil {
+		return body
+	}
+	var find func(*html.Node) *html.Node
+	find = func(n *html.Node) *html.Node {
+		if n.Type == html.ElementNode && n.DataAtom == atom.Body {
+			return n
+		}
+		for child := n.FirstChild; child != nil; child = child.NextSibling {
+			if found := find(child); found != nil {
+				return found
+			}
+		}
+		return nil
+	}
+	bodyNode := find(doc)
+	if bodyNode == nil {
+		return body
+	}
+	var b strings.Builder
+	for child := bodyNode.FirstChild; child != nil; child = child.NextSibling {
+		if err := html.Render(&b, child); err != nil {
+			return body
+		}
+	}
+	return strings.TrimSpace(b.String())
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// what happened to one envelope recipient
+type RecipientStatus int
+
+const (
+	Accepted RecipientStatus = iota
+	Rejected                 // permanent failure, 5xx
+	Deferred                 // temporary failure, 4xx or no answer, worth retrying
+)
+
+func (s RecipientStatus) String() string {
+	switch s {
+	case Accepted:
+		return "accepted"
+	case Rejected:
+		return "rejected"
+	case Deferred:
+		return "deferred"
+	}
+	return fmt.Sprintf("RecipientStatus(%d)", int(s))
+}
+
+type RecipientResult struct {
+	Address  string
+	Status   RecipientStatus
+	Code     int    // SMTP reply code, 0 when the server never answered
+	Enhanced string // RFC 3463 status such as "5.1.1", if the server sent one
+	Message  string
+}
+
+// returned by Send when some recipients did not get the message; the
+// accepted ones did, so only the failed ones need another attempt
+type DeliveryError struct {
+	Results []RecipientResult // every recipient, in envelope order
+}
+
+func (e *DeliveryError) Error() string {
+	failed := e.Failed()
+	parts := make([]string, len(failed))
+	for i, r := range failed {
+		parts[i] = fmt.Sprintf("%s %s (%s)", r.Address, r.Status, r.Message)
+	}
+	return fmt.Sprintf("%d of %d recipients failed: %s", len(failed), len(e.Results), strings.Join(parts, "; "))
+}
+
+// the rejected and deferred recipients
+func (e *DeliveryError) Failed() []RecipientResult {
+	return e.with(Rejected, Deferred)
+}
+
+func (e *DeliveryError) with(statuses ...RecipientStatus) []RecipientResult {
+	var results []RecipientResult
+	for _, r := range e.Results {
+		for _, status := range statuses {
+			if r.Status == status {
+				results = append(results, r)
+			}
+		}
+	}
+	return results
+}
+
+var enhancedCodePattern = regexp.MustCompile(`^[245]\.\d{1,3}\.\d{1,3}\b`)
+
+// the result for addr after err, nil meaning accepted
+func recipientResult(addr string, err error) RecipientResult {
+	result := RecipientResult{Address: addr}
+	if err == nil {
+		return result
+	}
+
+	smtpErr := AsSMTPError(err)
+	if smtpErr == nil {
+		result.Status = Deferred
+		result.Message = err.Error()
+		return result
+	}
+
+	result.Code = smtpErr.Code
+	result.Message = smtpErr.Message
+	result.Enhanced = smtpErr.Enhanced
+	result.Status = Deferred
+	if smtpErr.Permanent() {
+		result.Status = Rejected
+	}
+	return result
+}
+
+// a DeliveryError if any result is a failure, nil otherwise
+func deliveryError(results []RecipientResult) error {
+	for _, r := range results {
+		if r.Status != Accepted {
+			return &DeliveryError{Results: results}
+		}
+	}
+	return nil
+}
+
+// the results of a send that took several attempts, in rcpts order: the
+// ones in final, and for the recipients left in the last attempt its err
+func mergeResults(rcpts []string, final map[string]RecipientResult, left []string, err error) error {
+	if len(final) == 0 {
+		return err
+	}
+	var delivery *DeliveryError
+	if errors.As(err, &delivery) {
+		for _, r := range delivery.Results {
+			final[r.Address] = r
+		}
+	} else {
+		for _, rcpt := range left {
+			final[rcpt] = recipientResult(rcpt, err) // accepted when err is nil
+		}
+	}
+	results := make([]RecipientResult, 0, len(rcpts))
+	for _, rcpt := range rcpts {
+		if r, ok := final[rcpt]; ok {
+			results = append(results, r)
+			delete(final, rcpt)
+		}
+	}
+	return deliveryError(results)
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// where the session on a connection is. smtpClient moves through these as
+// it sends, so that Quit, Close and Reset know what is left to do and the
+// pool only takes back connections that can carry another message.
+type sessionState int
+
+const (
+	sessionReady  sessionState = iota // greeted, no transaction open
+	sessionMail                       // MAIL accepted, the transaction wants RSET or DATA
+	sessionData                       // in the message data, until the server's final reply
+	sessionBroken                     // the connection failed or the data was cut off; only Close is left
+	sessionClosed
+)
+
+func (s sessionState) String() string {
+	switch s {
+	case sessionReady:
+		return "ready"
+	case sessionMail:
+		return "in a transaction"
+	case sessionData:
+		return "in the message data"
+	case sessionBroken:
+		return "broken"
+	case sessionClosed:
+		return "closed"
+	}
+	return fmt.Sprintf("sessionState(%d)", int(s))
+}
+
+// a transaction can start once the session is ready, or after RSET
+func (c *smtpClient) usable() bool {
+	return c.state == sessionReady || c.state == sessionMail
+}
+
+// after err from a command: a connection that failed is broken
+func (c *smtpClient) fail(err error) {
+	if isConnectionError(err) {
+		c.state = sessionBroken
+	}
+}
+
+// QUIT, then close the connection, which is closed whatever the server
+// answers. A session that can't take a command, in the middle of the
+// message data or after a connection error, is only closed: the server
+// discards what it got of an unfinished message. Quit after Quit or Close
+// does nothing.
+func (c *smtpClient) Quit() error {
+	switch c.state {
+	case sessionClosed:
+		return nil
+	case sessionData, sessionBroken:
+		return c.Close()
+	}
+	err := c.Client.Quit() // closes the connection only when the server replied 221
+	c.Client.Close()
+	c.state = sessionClosed
+	return smtpError(err)
+}
+
+// closes the connection without QUIT
+func (c *smtpClient) Close() error {
+	if c.state == sessionClosed {
+		return nil
+	}
+	c.state = sessionClosed
+	return c.Client.Close()
+}
+
+// RSET, which ends an open transaction and readies the session for the next
+func (c *smtpClient) Reset() error {
+	if !c.usable() {
+		return fmt.Errorf("smtp: RSET on a session that is %s", c.state)
+	}
+	if err := c.Client.Reset(); err != nil {
+		c.fail(err)
+		return smtpError(err)
+	}
+	c.state = sessionReady
+	return nil
+}
+
+// DATA, with a writer that reads the server's final reply on Close;
+// smtp.Client.Data's would drop its text, and the queue ID with it
+func (c *smtpClient) data() (io.WriteCloser, error) {
+	if err := c.cmd(354, "DATA"); err != nil {
+		return nil, err
+	}
+	return &dotWriter{WriteCloser: c.Text.DotWriter(), c: c}, nil
+}
+
+type dotWriter struct {
+	io.WriteCloser
+	c *smtpClient
+}
+
+// ends the data with the final dot and waits for the server to take it
+func (w *dotWriter) Close() error {
+	if err := w.WriteCloser.Close(); err != nil {
+		return err
+	}
+	return w.c.readFinal()
+}
+
+// the reply to the end of the message data, kept for the Receipt
+func (c *smtpClient) readFinal() error {
+	code, msg, err := c.Text.ReadResponse(250)
+	if err != nil {
+		return smtpError(err)
+	}
+	c.final = newReceipt(code, msg)
+	return nil
+}
+
+// what a server said when it took a message: the final reply to the data,
+// which usually names the ID the message is queued under there, the one to
+// quote to its postmaster when it went missing. Set SMTPConfig.OnAccepted
+// to get one for each message sent.
+type Receipt struct {
+	Server     string   // the address of the server, host:port
+	Recipients []string // the ones the server accepted
+	Code       int      // 250
+	Enhanced   string   // RFC 3463 status such as "2.0.0", if the server sent one
+	Message    string   // the reply's text, after the enhanced status
+	QueueID    string   // from Message, "" if its form isn't known
+}
+
+// the queue IDs as the common MTAs put them in the final reply
+var queueIDPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)\bqueued as ([0-9A-Za-z][0-9A-Za-z-]*)`),       // Postfix, smtpd.Server
+	regexp.MustCompile(`\bid=([0-9A-Za-z-]+)`),                             // Exim
+	regexp.MustCompile(`\bInternalId=(\d+)`),                               // Microsoft Exchange
+	regexp.MustCompile(`(?i)^OK\s+\d+\s+(\S+)\s+-\s+gsmtp$`),               // Gmail
+	regexp.MustCompile(`^([0-9A-Za-z]{8,}) Message accepted for delivery`), // Sendmail
+	regexp.MustCompile(`(?i)^OK ([0-9a-f]{16,}-[0-9a-f-]+)$`),              // Amazon SES
+}
+
+// the final reply to the data as a Receipt, without the server and
+// recipients
+func newReceipt(code int, msg string) Receipt {
+	receipt := Receipt{Code: code, Message: msg}
+	if enhanced := enhancedCodePattern.FindString(msg); enhanced != "" {
+		receipt.Enhanced = enhanced
+		receipt.Message = strings.TrimSpace(msg[len(enhanced):])
+	}
+	// a multiline reply has the ID on any of its lines
+	for _, line := range strings.Split(receipt.Message, "\n") {
+		line = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(line), receipt.Enhanced))
+		for _, pattern := range queueIDPatterns {
+			if m := pattern.FindStringSubmatch(line); m != nil {
+				receipt.QueueID = m[1]
+				return receipt
+			}
+		}
+	}
+	return receipt
+}
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// S/MIME (RFC 8551) for one message: signed with Certificate and Key,
+// encrypted to the Encrypt certificates, or both, in which case the signed
+// message is what gets encrypted. Only the MIME body is protected, the
+// header fields above it stay readable.
+type SMIMEOptions struct {
+	Certificate *x509.Certificate   // signer, nil to not sign
+	Key         crypto.Signer       // RSA or ECDSA key of Certificate
+	Chain       []*x509.Certificate // intermediates sent along with Certificate
+
+	// recipients' RSA certificates, include the sender's own to be able to
+	// read the sent copy; nil to not encrypt
+	Encrypt []*x509.Certificate
+}
+
+// signing certificate, chain and key from PEM files, eg. the ones issued
+// for an S/MIME certificate
+func LoadSMIMEKeyPair(certFile, keyFile string) (*SMIMEOptions, error) {
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load S/MIME key pair: %w", err)
+	}
+	key, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported S/MIME key type %T", pair.PrivateKey)
+	}
+	opts := &SMIMEOptions{Key: key}
+	for i, der := range pair.Certificate {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse S/MIME certificate: %w", err)
+		}
+		if i == 0 {
+			opts.Certificate = cert
+		} else {
+			opts.Chain = append(opts.Chain, cert)
+		}
+	}
+	return opts, nil
+}
+
+// every certificate in a PEM file, eg. recipients' certificates for Encrypt
+func LoadSMIMECertificates(file string) ([]*x509.Certificate, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read certificates: %w", err)
+	}
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse certificate: %w", err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("no certificates found")
+	}
+	return certs, nil
+}
+
+func (o *SMIMEOptions) validate() error {
+	if o == nil {
+		return nil
+	}
+	if o.Certificate == nil && len(o.Encrypt) == 0 {
+		return errors.New("S/MIME: neither a signing certificate nor recipient certificates")
+	}
+	if o.Certificate != nil {
+		if o.Key == nil {
+			return errors.New("S/MIME: signing certificate without a key")
+		}
+		if _, err := signatureAlgorithm(o.Key); err != nil {
+			return err
+		}
+	}
+	for _, cert := range o.Encrypt {
+		if _, ok := cert.PublicKey.(*rsa.PublicKey); !ok {
+			return fmt.Errorf("S/MIME: can only encrypt to RSA certificates, %s has %T", cert.Subject, cert.PublicKey)
+		}
+	}
+	return nil
+}
+
+// the MIME entity below the top-level header fields, signed and encrypted
+// as the email asks
+func (e Email) writeContent(mw *messageWriter, entity func(*messageWriter, Email)) {
+	var protect func([]byte) ([]byte, error)
+	switch {
+	case e.SMIME != nil:
+		protect = e.SMIME.protect
+	case e.PGP != nil:
+		protect = e.PGP.protect
+	default:
+		entity(mw, e)
+		return
+	}
+	var buf bytes.Buffer
+	entity(&messageWriter{w: &buf}, e)
+	content, err := protect(buf.Bytes())
+	if err != nil {
+		if mw.err == nil {
+			mw.err = err
+		}
+		return
+	}
+	mw.Write(content)
+}
+
+func (o *SMIMEOptions) protect(entity []byte) ([]byte, error) {
+	var err error
+	if o.Certificate != nil {
+		if entity, err = o.sign(entity); err != nil {
+			return nil, err
+		}
+	}
+	if len(o.Encrypt) > 0 {
+		if entity, err = o.encrypt(entity); err != nil {
+			return nil, err
+		}
+	}
+	return entity, nil
+}
+
+// multipart/signed with a detached signature (RFC 8551 3.5.3); entity is
+// signed exactly as it is sent, CRLFs included
+func (o *SMIMEOptions) sign(entity []byte) ([]byte, error) {
+	signature, err := o.signedData(entity)
+	if err != nil {
+		return nil, fmt.Errorf("S/MIME signing failed: %w", err)
+	}
+
+	var buf bytes.Buffer
+	boundary := newBoundary("signed", string(entity))
+	fmt.Fprintf(&buf, "Content-Type: multipart/signed; protocol=\"application/pkcs7-signature\"; micalg=sha-256; boundary=%s\r\n", boundary)
+	buf.WriteString("\r\n")
+	fmt.Fprintf(&buf, "--%s\r\n", boundary)
+	buf.Write(entity)
+	fmt.Fprintf(&buf, "\r\n--%s\r\n", boundary)
+	buf.WriteString("Content-Type: application/pkcs7-signature; name=smime.p7s\r\n")
+	buf.WriteString("Content-Transfer-Encoding: base64\r\n")
+	buf.WriteString("Content-Disposition: attachment; filename=smime.p7s\r\n")
+	buf.WriteString("\r\n")
+	buf.WriteString(base64Lines(signature))
+	fmt.Fprintf(&buf, "--%s--\r\n", boundary)
+	return buf.Bytes(), nil
+}
+
+// application/pkcs7-mime enveloped-data (RFC 8551 3.3)
+func (o *SMIMEOptions) encrypt(entity []byte) ([]byte, error) {
+	enveloped, err := encryptContent(entity, o.Encrypt)
+	if err != nil {
+		return nil, fmt.Errorf("S/MIME encryption failed: %w", err)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("Content-Type: application/pkcs7-mime; smime-type=enveloped-data; name=smime.p7m\r\n")
+	buf.WriteString("Content-Transfer-Encoding: base64\r\n")
+	buf.WriteString("Content-Disposition: attachment; filename=smime.p7m\r\n")
+	buf.WriteString("\r\n")
+	buf.WriteString(base64Lines(enveloped))
+	return buf.Bytes(), nil
+}
+
+// base64 in lines of 76 characters, each ended by CRLF
+func base64Lines(data []byte) string {
+	var b strings.Builder
+	writeBase64(&b, data)
+	return b.String()
+}
+
+// CMS (RFC 5652) structures, as far as S/MIME needs them
+
+var (
+	oidData          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidSignedData    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidEnvelopedData = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 3}
+
+	oidContentType   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 3}
+	oidMessageDigest = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	oidSigningTime   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 5}
+
+	oidSHA256          = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidRSAEncryption   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+	oidECDSAWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+	oidAES256CBC       = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+)
+
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue // [0] EXPLICIT
+}
+
+type signedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	EncapContentInfo struct {
+		EContentType asn1.ObjectIdentifier // no eContent, the signature is detached
+	}
+	Certificates asn1.RawValue `asn1:"optional,tag:0"`
+	SignerInfos  []signerInfo  `asn1:"set"`
+}
+
+type issuerAndSerialNumber struct {
+	Issuer       asn1.RawValue
+	SerialNumber *big.Int
+}
+
+type signerInfo struct {
+	Version            int
+	SID                issuerAndSerialNumber
+	DigestAlgorithm    pkix.AlgorithmIdentifier
+	SignedAttrs        asn1.RawValue `asn1:"optional,tag:0"`
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          []byte
+}
+
+type attribute struct {
+	Type   asn1.ObjectIdentifier
+	Values []asn1.RawValue `asn1:"set"`
+}
+
+type envelopedData struct {
+	Version              int
+	RecipientInfos       []keyTransRecipientInfo `asn1:"set"`
+	EncryptedContentInfo encryptedContentInfo
+}
+
+type keyTransRecipientInfo struct {
+	Version                int
+	RID                    issuerAndSerialNumber
+	KeyEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedKey           []byte
+}
+
+type encryptedContentInfo struct {
+	ContentType                asn1.ObjectIdentifier
+	ContentEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedContent           []byte `asn1:"optional,tag:0"`
+}
+
+func signatureAlgorithm(key crypto.Signer) (pkix.AlgorithmIdentifier, error) {
+	switch key.Public().(type) {
+	case *rsa.PublicKey:
+		return pkix.AlgorithmIdentifier{Algorithm: oidRSAEncryption, Parameters: asn1.NullRawValue}, nil
+	case *ecdsa.PublicKey:
+		return pkix.AlgorithmIdentifier{Algorithm: oidECDSAWithSHA256}, nil
+	}
+	return pkix.AlgorithmIdentifier{}, fmt.Errorf("S/MIME: unsupported signing key type %T", key.Public())
+}
+
+// a detached SignedData over content, with the content type, digest and
+// signing time as signed attributes and the certificates included
+func (o *SMIMEOptions) signedData(content []byte) ([]byte, error) {
+	sigAlg, err := signatureAlgorithm(o.Key)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256(content)
+
+	contentType, _ := asn1.Marshal(oidData)
+	messageDigest, _ := asn1.Marshal(digest[:])
+	signingTime, err := asn1.Marshal(time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	var attrs [][]byte
+	for _, attr := range []attribute{
+		{Type: oidContentType, Values: []asn1.RawValue{{FullBytes: contentType}}},
+		{Type: oidMessageDigest, Values: []asn1.RawValue{{FullBytes: messageDigest}}},
+		{Type: oidSigningTime, Values: []asn1.RawValue{{FullBytes: signingTime}}},
+	} {
+		der, err := asn1.Marshal(attr)
+		if err != nil {
+			return nil, err
+		}
+		attrs = append(attrs, der)
+	}
+	// DER orders a SET OF by encoding
+	sort.Slice(attrs, func(i, j int) bool { return bytes.Compare(attrs[i], attrs[j]) < 0 })
+	attrBytes := bytes.Join(attrs, nil)
+
+	// the attributes are signed as a SET, but sent as [0] IMPLICIT
+	signedAttrs, err := asn1.Marshal(asn1.RawValue{Tag: asn1.TagSet, IsCompound: true, Bytes: attrBytes})
+	if err != nil {
+		return nil, err
+	}
+	attrDigest := sha256.Sum256(signedAttrs)
+	signature, err := o.Key.Sign(rand.Reader, attrDigest[:], crypto.SHA256)
+	if err != nil {
+		return nil, err
+	}
+
+	var certs []byte
+	for _, cert := range append([]*x509.Certificate{o.Certificate}, o.Chain...) {
+		certs = append(certs, cert.Raw...)
+	}
+	sha256Alg := pkix.AlgorithmIdentifier{Algorithm: oidSHA256}
+	sd := signedData{
+		Version:          1,
+		DigestAlgorithms: []pkix.AlgorithmIdentifier{sha256Alg},
+		Certificates:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: certs},
+		SignerInfos: []signerInfo{{
+			Version:            1,
+			SID:                issuerAndSerial(o.Certificate),
+			DigestAlgorithm:    sha256Alg,
+			SignedAttrs:        asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: attrBytes},
+			SignatureAlgorithm: sigAlg,
+			Signature:          signature,
+		}},
+	}
+	sd.EncapContentInfo.EContentType = oidData
+	return wrapContentInfo(oidSignedData, sd)
+}
+
+// content encrypted with a fresh AES-256-CBC key, the key encrypted to each
+// recipient with RSA PKCS #1 v1.5, which every S/MIME client reads
+func encryptContent(content []byte, recipients []*x509.Certificate) ([]byte, error) {
+	key := make([]byte, 32)
+	iv := make([]byte, aes.BlockSize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	padding := aes.BlockSize - len(content)%aes.BlockSize
+	plain := append(bytes.Clone(content), bytes.Repeat([]byte{byte(padding)}, padding)...)
+	encrypted := make([]byte, len(plain))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(encrypted, plain)
+
+	ed := envelopedData{}
+	for _, cert := range recipients {
+		pub, ok := cert.PublicKey.(*rsa.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("can only encrypt to RSA certificates, %s has %T", cert.Subject, cert.PublicKey)
+		}
+		encryptedKey, err := rsa.EncryptPKCS1v15(rand.Reader, pub, key)
+		if err != nil {
+			return nil, err
+		}
+		ed.RecipientInfos = append(ed.RecipientInfos, keyTransRecipientInfo{
+			RID:                    issuerAndSerial(cert),
+			KeyEncryptionAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidRSAEncryption, Parameters: asn1.NullRawValue},
+			EncryptedKey:           encryptedKey,
+		})
+	}
+	ivParam, _ := asn1.Marshal(iv)
+	ed.EncryptedContentInfo = encryptedContentInfo{
+		ContentType:                oidData,
+		ContentEncryptionAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidAES256CBC, Parameters: asn1.RawValue{FullBytes: ivParam}},
+		EncryptedContent:           encrypted,
+	}
+	return wrapContentInfo(oidEnvelopedData, ed)
+}
+
+func issuerAndSerial(cert *x509.Certificate) issuerAndSerialNumber {
+	return issuerAndSerialNumber{Issuer: asn1.RawValue{FullBytes: cert.RawIssuer}, SerialNumber: cert.SerialNumber}
+}
+
+func wrapContentInfo(contentType asn1.ObjectIdentifier, content any) ([]byte, error) {
+	inner, err := asn1.Marshal(content)
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(contentInfo{
+		ContentType: contentType,
+		Content:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: inner},
+	})
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testdata/smime-*.pem were made with OpenSSL 3.0: a CA, Alice with an RSA
+// key for signing and encryption, Bob with an ECDSA P-256 key for signing
+// only, each certificate file followed by the CA as its chain.
+// smime-openssl-signature.pem is openssl smime -sign -binary by Alice of
+// opensslSigned.
+const opensslSigned = "Content-Type: text/plain\r\n\r\nsigned by openssl\r\n"
+
+func loadTestSMIME(t *testing.T, name string) *SMIMEOptions {
+	t.Helper()
+	opts, err := LoadSMIMEKeyPair("testdata/smime-"+name+".pem", "testdata/smime-"+name+"-key.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return opts
+}
+
+// the CA the test certificates chain to
+func testSMIMERoots(t *testing.T) *x509.CertPool {
+	t.Helper()
+	certs, err := LoadSMIMECertificates("testdata/smime-ca.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(certs[0])
+	return roots
+}
+
+// the signer of a detached SignedData over content, once its signature
+// over the signed attributes, their digest of content and its chain to
+// roots hold
+func checkSMIMESignature(content, der []byte, roots *x509.CertPool) (*x509.Certificate, error) {
+	var ci contentInfo
+	if _, err := asn1.Unmarshal(der, &ci); err != nil {
+		return nil, err
+	}
+	if !ci.ContentType.Equal(oidSignedData) {
+		return nil, fmt.Errorf("content type %v, not signed data", ci.ContentType)
+	}
+	var sd signedData
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &sd); err != nil {
+		return nil, err
+	}
+	certs, err := x509.ParseCertificates(sd.Certificates.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	if len(sd.SignerInfos) != 1 {
+		return nil, fmt.Errorf("%d signers", len(sd.SignerInfos))
+	}
+	si := sd.SignerInfos[0]
+
+	var signer *x509.Certificate
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs {
+		if bytes.Equal(cert.RawIssuer, si.SID.Issuer.FullBytes) && cert.SerialNumber.Cmp(si.SID.SerialNumber) == 0 {
+			signer = cert
+		} else {
+			intermediates.AddCert(cert)
+		}
+	}
+	if signer == nil {
+		return nil, errors.New("no certificate of the signer")
+	}
+
+	digest := sha256.Sum256(content)
+	var digestOK, typeOK bool
+	for rest := si.SignedAttrs.Bytes; len(rest) > 0; {
+		var attr attribute
+		var err error
+		if rest, err = asn1.Unmarshal(rest, &attr); err != nil {
+			return nil, err
+		}
+		switch {
+		case attr.Type.Equal(oidMessageDigest):
+			var got []byte
+			asn1.Unmarshal(attr.Values[0].FullBytes, &got)
+			digestOK = bytes.Equal(got, digest[:])
+		case attr.Type.Equal(oidContentType):
+			var got asn1.ObjectIdentifier
+			asn1.Unmarshal(attr.Values[0].FullBytes, &got)
+			typeOK = got.Equal(oidData)
+		}
+	}
+	if !digestOK || !typeOK {
+		return nil, fmt.Errorf("message digest matches %v, content type is data %v", digestOK, typeOK)
+	}
+
+	// signed as a SET, not as the [0] IMPLICIT it is sent as
+	signed := bytes.Clone(si.SignedAttrs.FullBytes)
+	signed[0] = 0x31
+	algorithm := x509.SHA256WithRSA
+	if si.SignatureAlgorithm.Algorithm.Equal(oidECDSAWithSHA256) {
+		algorithm = x509.ECDSAWithSHA256
+	}
+	if err := signer.CheckSignature(algorithm, signed, si.Signature); err != nil {
+		return nil, err
+	}
+	_, err = signer.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageEmailProtection},
+	})
+	return signer, err
+}
+
+// the content of an EnvelopedData, with the key encrypted to cert
+func decryptSMIME(der []byte, cert *x509.Certificate, key *rsa.PrivateKey) ([]byte, error) {
+	var ci contentInfo
+	if _, err := asn1.Unmarshal(der, &ci); err != nil {
+		return nil, err
+	}
+	if !ci.ContentType.Equal(oidEnvelopedData) {
+		return nil, fmt.Errorf("content type %v, not enveloped data", ci.ContentType)
+	}
+	var ed envelopedData
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &ed); err != nil {
+		return nil, err
+	}
+	var encryptedKey []byte
+	for _, ri := range ed.RecipientInfos {
+		if bytes.Equal(ri.RID.Issuer.FullBytes, cert.RawIssuer) && ri.RID.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+			encryptedKey = ri.EncryptedKey
+		}
+	}
+	if encryptedKey == nil {
+		return nil, errors.New("not encrypted to the certificate")
+	}
+	contentKey, err := rsa.DecryptPKCS1v15(nil, key, encryptedKey)
+	if err != nil {
+		return nil, err
+	}
+
+	eci := ed.EncryptedContentInfo
+	if !eci.ContentEncryptionAlgorithm.Algorithm.Equal(oidAES256CBC) {
+		return nil, fmt.Errorf("content encrypted with %v", eci.ContentEncryptionAlgorithm.Algorithm)
+	}
+	var iv []byte
+	if _, err := asn1.Unmarshal(eci.ContentEncryptionAlgorithm.Parameters.FullBytes, &iv); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(contentKey)
+	if err != nil {
+		return nil, err
+	}
+	encrypted := eci.EncryptedContent
+	if len(encrypted) == 0 || len(encrypted)%aes.BlockSize != 0 || len(iv) != aes.BlockSize {
+		return nil, errors.New("bad encrypted content")
+	}
+	plain := make([]byte, len(encrypted))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plain, encrypted)
+	padding := int(plain[len(plain)-1])
+	if padding == 0 || padding > aes.BlockSize || !bytes.Equal(plain[len(plain)-padding:], bytes.Repeat([]byte{byte(padding)}, padding)) {
+		return nil, errors.New("bad padding")
+	}
+	return plain[:len(plain)-padding], nil
+}
+
+// the signed entity and the signature of a multipart/signed message
+func splitSigned(t *testing.T, msg []byte) (entity, signature []byte) {
+	t.Helper()
+	m, err := mail.ReadMessage(bytes.NewReader(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mediaType, params, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/signed" || params["protocol"] != "application/pkcs7-signature" || params["micalg"] != "sha-256" {
+		t.Fatalf("Content-Type %q, %v", m.Header.Get("Content-Type"), err)
+	}
+	body, err := io.ReadAll(m.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// signed as it is between the boundaries, CRLFs and all
+	delimiter := "--" + params["boundary"] + "\r\n"
+	start := bytes.Index(body, []byte(delimiter))
+	end := bytes.Index(body, []byte("\r\n"+delimiter))
+	if start < 0 || end < start {
+		t.Fatalf("no signed part in\n%s", body)
+	}
+	entity = body[start+len(delimiter) : end]
+
+	mr := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	mr.NextPart()
+	part, err := mr.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ct := part.Header.Get("Content-Type"); !strings.HasPrefix(ct, "application/pkcs7-signature") {
+		t.Fatalf("signature part is %s", ct)
+	}
+	signature, err = io.ReadAll(base64.NewDecoder(base64.StdEncoding, part))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entity, signature
+}
+
+// the EnvelopedData of an application/pkcs7-mime message
+func envelopedContent(t *testing.T, msg []byte) []byte {
+	t.Helper()
+	m, err := mail.ReadMessage(bytes.NewReader(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mediaType, params, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/pkcs7-mime" || params["smime-type"] != "enveloped-data" {
+		t.Fatalf("Content-Type %q, %v", m.Header.Get("Content-Type"), err)
+	}
+	der, err := io.ReadAll(base64.NewDecoder(base64.StdEncoding, m.Body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+func TestLoadSMIME(t *testing.T) {
+	alice := loadTestSMIME(t, "alice")
+	if alice.Certificate.Subject.CommonName != "Alice" || len(alice.Chain) != 1 || alice.Chain[0].Subject.CommonName != "Test SMIME CA" {
+		t.Errorf("certificate %s, chain %v", alice.Certificate.Subject, alice.Chain)
+	}
+	if err := alice.validate(); err != nil {
+		t.Error(err)
+	}
+
+	certs, err := LoadSMIMECertificates("testdata/smime-bob.pem")
+	if err != nil || len(certs) != 2 || certs[0].EmailAddresses[0] != "bob@example.org" {
+		t.Errorf("got %v, %v", certs, err)
+	}
+	if _, err := LoadSMIMECertificates("testdata/smime-bob-key.pem"); err == nil {
+		t.Error("certificates read from a key file")
+	}
+
+	// Bob's ECDSA key signs, but isn't one to encrypt to
+	bob := loadTestSMIME(t, "bob")
+	if err := bob.validate(); err != nil {
+		t.Error(err)
+	}
+	if err := (&SMIMEOptions{Encrypt: certs}).validate(); err == nil {
+		t.Error("encryption to an ECDSA certificate accepted")
+	}
+	if err := (&SMIMEOptions{}).validate(); err == nil {
+		t.Error("neither signing nor encrypting accepted")
+	}
+}
+
+// OpenSSL's signature checks out with the helper the tests below use on
+// signatures made here
+func TestCheckSMIMESignature(t *testing.T) {
+	data, err := os.ReadFile("testdata/smime-openssl-signature.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		t.Fatal("no PEM block")
+	}
+	roots := testSMIMERoots(t)
+	signer, err := checkSMIMESignature([]byte(opensslSigned), block.Bytes, roots)
+	if err != nil || signer.Subject.CommonName != "Alice" {
+		t.Errorf("got %v, %v", signer, err)
+	}
+	if _, err := checkSMIMESignature([]byte("something else"), block.Bytes, roots); err == nil {
+		t.Error("signature holds for other content")
+	}
+}
+
+func TestSMIMESign(t *testing.T) {
+	roots := testSMIMERoots(t)
+	entity := []byte("Content-Type: text/plain; charset=utf-8\r\n\r\nsigned here\r\n")
+
+	for _, name := range []string{"alice", "bob"} {
+		t.Run(name, func(t *testing.T) {
+			opts := loadTestSMIME(t, name)
+			msg, err := opts.protect(entity)
+			if err != nil {
+				t.Fatal(err)
+			}
+			signed, signature := splitSigned(t, msg)
+			if !bytes.Equal(signed, entity) {
+				t.Errorf("signed part %q, want %q", signed, entity)
+			}
+			signer, err := checkSMIMESignature(signed, signature, roots)
+			if err != nil || !signer.Equal(opts.Certificate) {
+				t.Errorf("got %v, %v", signer, err)
+			}
+			if _, err := checkSMIMESignature([]byte("something else"), signature, roots); err == nil {
+				t.Error("signature holds for other content")
+			}
+		})
+	}
+}
+
+func TestSMIMEEncrypt(t *testing.T) {
+	alice := loadTestSMIME(t, "alice")
+	key := alice.Key.(*rsa.PrivateKey)
+	entity := []byte("Content-Type: text/plain\r\n\r\nfor Alice\r\n")
+
+	// encrypted only
+	msg, err := (&SMIMEOptions{Encrypt: []*x509.Certificate{alice.Certificate}}).protect(entity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := decryptSMIME(envelopedContent(t, msg), alice.Certificate, key)
+	if err != nil || !bytes.Equal(got, entity) {
+		t.Errorf("decrypted %q, %v", got, err)
+	}
+
+	// signed, then the signed message encrypted
+	alice.Encrypt = []*x509.Certificate{alice.Certificate}
+	msg, err = alice.protect(entity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inner, err := decryptSMIME(envelopedContent(t, msg), alice.Certificate, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, signature := splitSigned(t, inner)
+	if _, err := checkSMIMESignature(signed, signature, testSMIMERoots(t)); err != nil || !bytes.Equal(signed, entity) {
+		t.Errorf("signed part %q, %v", signed, err)
+	}
+}
+
+// the S/MIME messages as OpenSSL sees them, when it is installed
+func TestSMIMEWithOpenSSL(t *testing.T) {
+	if _, err := exec.LookPath("openssl"); err != nil {
+		t.Skip("openssl not installed")
+	}
+	dir := t.TempDir()
+	openssl := func(msg []byte, args ...string) ([]byte, string, error) {
+		file := filepath.Join(dir, "message.eml")
+		if err := os.WriteFile(file, msg, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		cmd := exec.Command("openssl", append([]string{"smime", "-in", file}, args...)...)
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		out, err := cmd.Output()
+		return out, stderr.String(), err
+	}
+	entity := []byte("Content-Type: text/plain\r\n\r\nchecked by openssl\r\n")
+
+	for _, name := range []string{"alice", "bob"} {
+		msg, err := loadTestSMIME(t, name).protect(entity)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, stderr, err := openssl(msg, "-verify", "-binary", "-CAfile", "testdata/smime-ca.pem", "-purpose", "smimesign")
+		if err != nil || !bytes.Equal(out, entity) {
+			t.Errorf("%s: openssl smime -verify: %q, %v\n%s", name, out, err, stderr)
+		}
+	}
+
+	alice := loadTestSMIME(t, "alice")
+	alice.Encrypt = []*x509.Certificate{alice.Certificate}
+	msg, err := alice.protect(entity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, stderr, err := openssl(msg, "-decrypt", "-binary", "-recip", "testdata/smime-alice.pem", "-inkey", "testdata/smime-alice-key.pem")
+	if err != nil {
+		t.Fatalf("openssl smime -decrypt: %v\n%s", err, stderr)
+	}
+	out, stderr, err := openssl(signed, "-verify", "-binary", "-CAfile", "testdata/smime-ca.pem", "-purpose", "smimesign")
+	if err != nil || !bytes.Equal(out, entity) {
+		t.Errorf("openssl smime -verify of the decrypted message: %q, %v\n%s", out, err, stderr)
+	}
+}
@@ -5,17 +5,31 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/rand"
 	"crypto/tls"
 	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
+	"maps"
 	"mime"
+	"mime/quotedprintable"
 	"net"
 	"net/mail"
 	"net/smtp"
+	"net/textproto"
 	"os"
 	"path/filepath"
+	"slices"
+	"sort"
 	"strings"
+	"time"
+
+	"internet_services/sending_mail/dkim"
 )
 
 type SMTPConfig struct {
@@ -23,196 +37,753 @@ type SMTPConfig struct {
 	Port     string
 	Username string
 	Password string
+	HeloName string        // announced in EHLO, default the host's FQDN, its reverse DNS name or its address
+	Auth     Authenticator // default Username and Password with a negotiated mechanism
+	DKIM     *dkim.Signer  // sign outgoing messages when set
+
+	AuthMechanism string  // force CRAM-MD5, PLAIN or LOGIN for the password login
+	TLSMode       TLSMode // default STARTTLS
+	TLS           TLSOptions
+
+	Transcript TranscriptLogger // log the SMTP dialogue, eg. TranscriptWriter(os.Stderr)
+
+	// called while the message data goes out, every 64 KiB and once the
+	// server took it, eg. for an upload progress bar
+	Progress func(DataProgress)
+
+	// keep a copy of every message a server accepted, exactly as sent
+	Archive Archiver
+
+	// called with the server's reply for each message it accepted, which
+	// names its queue ID there
+	OnAccepted func(Receipt)
+}
+
+// how the connection to the server is secured
+type TLSMode int
+
+// With STARTTLS the policy is StartTLS, the default, which fails without
+// TLS, OpportunisticTLS, which uses it when it can, or NoTLS.
+const (
+	StartTLS    TLSMode = iota // plaintext connect, then STARTTLS (submission, port 587)
+	ImplicitTLS                // TLS from the first byte (SMTPS, port 465)
+	NoTLS                      // plaintext only, for local relays and test servers
+	// STARTTLS if the server offers it, plaintext if it doesn't or TLS
+	// fails, for legacy relays on a trusted network. Anyone on the path
+	// can strip the offer, so don't send passwords this way.
+	OpportunisticTLS
+)
+
+// host:port, the port defaults to 465 for implicit TLS and 587 otherwise
+func (c SMTPConfig) addr() string {
+	port := c.Port
+	if port == "" {
+		port = "587"
+		if c.TLSMode == ImplicitTLS {
+			port = "465"
+		}
+	}
+	return net.JoinHostPort(c.Host, port)
+}
+
+func (c SMTPConfig) auth() (smtp.Auth, error) {
+	if c.Auth == nil {
+		return PasswordAuthenticator{Username: c.Username, Password: c.Password, Mechanism: c.AuthMechanism}.Auth(c.Host)
+	}
+	return c.Auth.Auth(c.Host)
+}
+
+// DKIM sign msg if the config asks for it
+func (c SMTPConfig) sign(msg []byte) ([]byte, error) {
+	if c.DKIM == nil {
+		return msg, nil
+	}
+	return c.DKIM.Sign(msg)
 }
 
 // an email message
 type Email struct {
-	From mail.Address
-	To   []mail.Address
-	// can add cc, bcc and append them to recipient list
+	From        mail.Address
+	To          []mail.Address
+	Cc          []mail.Address
+	Bcc         []mail.Address // only in the envelope, never in headers
 	Subject     string
-	Body        string
+	Body        string // html
+	TextBody    string // plain text alternative to Body
 	Attachments []Attachment
+	DSN         *DSNOptions // ask for delivery status notifications
+
+	// ask for a read receipt to this address (Disposition-Notification-To,
+	// RFC 8098); the reader's client asks the reader before it sends one
+	ReadReceipt *mail.Address
+
+	// X-Priority and Importance, and Sensitivity header fields; the zero
+	// values add none
+	Priority    Priority
+	Sensitivity Sensitivity
+
+	ListUnsubscribe *ListUnsubscribe // for bulk mail
+	SMIME           *SMIMEOptions    `json:"-"` // sign and/or encrypt the body
+	PGP             *PGPOptions      `json:"-"` // the same with OpenPGP
+	Invite          *Invite          // a meeting invitation, see Invite
+
+	// extra header fields, or replacements for generated ones such as
+	// Date and Message-ID; non-ASCII values are RFC 2047 encoded
+	Headers map[string]string
+
+	// MAIL FROM, where bounces go, eg. a VERP address; empty for the
+	// sender's default, the login name for the authenticated senders
+	EnvelopeFrom string
+
+	// the same key on two emails makes them one: a sender or queue with
+	// SentKeys sends the second one only if the first never went out, eg.
+	// "invoice-2024-0042". Not part of the message.
+	IdempotencyKey string
+}
+
+// envelope recipients: To, Cc and Bcc addresses
+func (e Email) Recipients() []string {
+	var rcpts []string
+	for _, list := range [][]mail.Address{e.To, e.Cc, e.Bcc} {
+		for _, addr := range list {
+			rcpts = append(rcpts, addr.Address)
+		}
+	}
+	return rcpts
 }
 
 // interface for sending emails
+// implementations give up when ctx is canceled or its deadline passes,
+// whichever phase of the SMTP session they are in
 type EmailSender interface {
-	Send(config SMTPConfig, email Email) error
+	Send(ctx context.Context, config SMTPConfig, email Email) error
 }
 
 // smtp.Client wrapper
 type smtpClient struct {
 	*smtp.Client
+	conn net.Conn
+
+	transcript *transcriptConn    // when SMTPConfig.Transcript is set
+	helo       string             // the EHLO name if not smtp.Client's default
+	progress   func(DataProgress) // SMTPConfig.Progress
+	archive    Archiver           // SMTPConfig.Archive
+	accepted   func(Receipt)      // SMTPConfig.OnAccepted
+
+	state sessionState
+	final Receipt // the reply to the last message data
 }
 
-func NewSMTPClient(config SMTPConfig) (*smtpClient, error) {
-	conn, err := net.Dial("tcp", net.JoinHostPort(config.Host, config.Port))
+// the server or the local configuration refused the credentials
+var ErrAuthFailed = errors.New("authentication failed")
+
+func NewSMTPClient(ctx context.Context, config SMTPConfig) (*smtpClient, error) {
+	var dialer net.Dialer
+	var conn net.Conn
+	var err error
+	if config.TLSMode == ImplicitTLS {
+		tlsDialer := tls.Dialer{NetDialer: &dialer, Config: config.tlsConfig()}
+		conn, err = tlsDialer.DialContext(ctx, "tcp", config.addr())
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", config.addr())
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to dial SMTP server: %w", err)
 	}
 
-	client, err := smtp.NewClient(conn, config.Host)
+	c := &smtpClient{conn: conn, progress: config.Progress, archive: config.Archive, accepted: config.OnAccepted}
+	defer c.watch(ctx)()
+
+	if config.Transcript != nil {
+		c.transcript = newTranscriptConn(conn, config.Transcript, config.addr())
+		c.transcript.secure = config.TLSMode == ImplicitTLS
+		conn = c.transcript
+	}
+	c.Client, err = smtp.NewClient(conn, config.Host)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create SMTP client: %w", err)
+		conn.Close()
+		return nil, fmt.Errorf("failed to create SMTP client: %w", smtpError(err))
+	}
+	c.helo = config.HeloName
+	if c.helo == "" {
+		c.helo = detectHeloName(ctx, c.conn)
+	}
+	if err := checkHeloName(c.helo); err != nil {
+		c.Close()
+		return nil, err
+	}
+	if err := c.Hello(c.helo); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("EHLO failed: %w", smtpError(err))
 	}
 
-	if err = client.StartTLS(&tls.Config{ServerName: config.Host}); err != nil {
-		return nil, fmt.Errorf("failed to start TLS: %w", err)
+	switch config.TLSMode {
+	case StartTLS:
+		if err = c.startTLS(config.tlsConfig()); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("failed to start TLS: %w", smtpError(err))
+		}
+	case OpportunisticTLS:
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			break
+		}
+		err = c.startTLS(config.tlsConfig())
+		var protoErr *textproto.Error
+		switch {
+		case err == nil:
+		case errors.As(err, &protoErr):
+			// STARTTLS refused, the session goes on in plaintext
+			log.Printf("smtp: %s refused STARTTLS, continuing without TLS: %v", config.addr(), smtpError(err))
+		default:
+			// a failed handshake leaves the connection unusable
+			c.Close()
+			log.Printf("smtp: TLS with %s failed, reconnecting without TLS: %v", config.addr(), err)
+			config.TLSMode = NoTLS
+			return NewSMTPClient(ctx, config)
+		}
+	}
+
+	// a relay that takes mail without a login
+	if config.Auth == nil && config.Username == "" {
+		return c, nil
+	}
+	auth, err := config.auth()
+	if err != nil {
+		c.Close()
+		return nil, fmt.Errorf("%w: %w", ErrAuthFailed, err)
 	}
+	if c.transcript != nil && c.transcript.secure {
+		auth = secureAuth{auth}
+	}
+	if err = c.Auth(auth); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("%w: %w", ErrAuthFailed, smtpError(err))
+	}
+	return c, nil
+}
 
-	auth := smtp.PlainAuth("", config.Username, config.Password, config.Host)
-	if err = client.Auth(auth); err != nil {
-		return nil, fmt.Errorf("authentication failed: %w", err)
+// until the returned func is called, reads and writes on the connection
+// fail once ctx is done or its deadline has passed
+func (c *smtpClient) watch(ctx context.Context) (release func()) {
+	deadline, _ := ctx.Deadline() // zero, no deadline, if there is none
+	c.conn.SetDeadline(deadline)
+	stop := context.AfterFunc(ctx, func() {
+		c.conn.SetDeadline(time.Unix(1, 0))
+	})
+	return func() {
+		// a canceled connection stays unusable, it is closed anyway
+		if stop() {
+			c.conn.SetDeadline(time.Time{})
+		}
 	}
+}
 
-	return &smtpClient{client}, nil
+// a timeout caused by ctx reports ctx's error as well
+func contextError(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() != nil && !errors.Is(err, ctx.Err()) {
+		return fmt.Errorf("%w: %w", ctx.Err(), err)
+	}
+	return err
 }
 
 type SimpleSender struct{}
 
-// implements EmailSender interface
-func (s SimpleSender) Send(config SMTPConfig, email Email) error {
-	auth := smtp.PlainAuth("", config.Username, config.Password, config.Host)
-	msg := buildEmailMessage(email)
-
-	to := make([]string, len(email.To))
-	for i, addr := range email.To {
-		to[i] = addr.Address
+// implements EmailSender interface with the From address as the envelope
+// sender. smtp.SendMail would do, but it always says EHLO localhost, which
+// many servers refuse.
+func (s SimpleSender) Send(ctx context.Context, config SMTPConfig, email Email) error {
+	if email.EnvelopeFrom == "" {
+		email.EnvelopeFrom = email.From.Address
 	}
-
-	return smtp.SendMail(
-		net.JoinHostPort(config.Host, config.Port),
-		auth,
-		email.From.Address,
-		to,
-		msg,
-	)
+	return AdvancedSender{}.Send(ctx, config, email)
 }
 
 type AdvancedSender struct{}
 
 // implement EmailSender interface with manual SMTP commands
-func (s AdvancedSender) Send(config SMTPConfig, email Email) error {
-	client, err := NewSMTPClient(config)
+func (s AdvancedSender) Send(ctx context.Context, config SMTPConfig, email Email) (err error) {
+	if err := email.Validate(); err != nil {
+		return err
+	}
+	defer func() { err = contextError(ctx, err) }()
+
+	msg, err := config.payload(email, Email.WriteTo)
+	if err != nil {
+		return err
+	}
+
+	client, err := NewSMTPClient(ctx, config)
 	if err != nil {
 		return err
 	}
-	defer client.Close()
+	defer client.watch(ctx)()
+	// QUIT and close, or only close if the session broke; a failed QUIT
+	// doesn't matter once the server has the message
 	defer client.Quit()
 
-	if err = client.Mail(config.Username); err != nil {
-		return fmt.Errorf("MAIL command failed: %w", err)
+	env := email.envelope(config.Username, email.Recipients())
+	env.Size = msg.size
+	return client.send(env, msg.write)
+}
+
+// WriteTo writes the email as an RFC 5322 message, eg. into client.Data()
+// or an .eml file. The multipart/mixed form is used only when there are
+// files to attach.
+func (e Email) WriteTo(w io.Writer) (int64, error) {
+	for _, att := range e.Attachments {
+		if !att.Inline {
+			return e.writeMultipart(w)
+		}
 	}
 
-	for _, to := range email.To {
-		if err = client.Rcpt(to.Address); err != nil {
-			return fmt.Errorf("RCPT command failed for %s: %w", to.Address, err)
+	mw := &messageWriter{w: w}
+	writeHeaders(mw, e)
+	e.writeContent(mw, writeBody)
+	return mw.n, mw.err
+}
+
+// the whole message in memory, for DKIM signing and smtp.SendMail
+func buildMessage(email Email) []byte {
+	var buf bytes.Buffer
+	email.WriteTo(&buf)
+	return buf.Bytes()
+}
+
+// a message ready for DATA, with its size for the SIZE extension
+type payload struct {
+	size  int64
+	write func(io.Writer) error
+}
+
+// the message streamed, or buffered when it has to be signed or encrypted.
+// Other messages are written twice, once to count them, so Date and
+// Message-ID are fixed first to make both passes produce the same bytes.
+func (c SMTPConfig) payload(email Email, write func(Email, io.Writer) (int64, error)) (payload, error) {
+	if c.DKIM == nil && email.SMIME == nil && email.PGP == nil {
+		email = email.withFixedHeaders()
+		size, err := write(email, io.Discard)
+		if err != nil {
+			return payload{}, err
 		}
+		return payload{size: size, write: func(w io.Writer) error {
+			_, err := write(email, w)
+			return err
+		}}, nil
 	}
 
-	writer, err := client.Data()
+	var buf bytes.Buffer
+	if _, err := write(email, &buf); err != nil {
+		return payload{}, err
+	}
+	msg, err := c.sign(buf.Bytes())
 	if err != nil {
-		return fmt.Errorf("DATA command failed: %w", err)
+		return payload{}, err
 	}
-	defer writer.Close()
+	return payload{size: int64(len(msg)), write: func(w io.Writer) error {
+		_, err := w.Write(msg)
+		return err
+	}}, nil
+}
 
-	msg := buildEmailMessage(email)
-	_, err = writer.Write(msg)
-	return err
+// Date and Message-ID moved into Headers unless they are set there already
+func (e Email) withFixedHeaders() Email {
+	headers := map[string]string{}
+	if !hasHeader(e.Headers, "Date") {
+		headers["Date"] = time.Now().Format(time.RFC1123Z)
+	}
+	if !hasHeader(e.Headers, "Message-ID") {
+		headers["Message-ID"] = newMessageID(e.From.Address)
+	}
+	maps.Copy(headers, e.Headers)
+	e.Headers = headers
+	return e.withFixedInvite()
 }
 
-// construct email message
-func buildEmailMessage(email Email) []byte {
-	var buf bytes.Buffer
+// counts the bytes written and keeps the first error, so the builders can
+// write line after line without checking each one
+type messageWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (m *messageWriter) Write(p []byte) (int, error) {
+	if m.err != nil {
+		return 0, m.err
+	}
+	n, err := m.w.Write(p)
+	m.n += int64(n)
+	m.err = err
+	return n, err
+}
 
-	fmt.Fprintf(&buf, "From: %s\r\n", email.From.String())
-	fmt.Fprintf(&buf, "To: %s\r\n", joinAddresses(email.To))
-	fmt.Fprintf(&buf, "Subject: %s\r\n", email.Subject)
-	fmt.Fprintf(&buf, "MIME-Version: 1.0\r\n")
-	fmt.Fprintf(&buf, "Content-Type: text/html; charset=UTF-8\r\n")
-	fmt.Fprintf(&buf, "\r\n")
-	buf.WriteString(email.Body)
+func (m *messageWriter) WriteString(s string) (int, error) {
+	return m.Write([]byte(s))
+}
 
-	return buf.Bytes()
+// the top-level header fields up to MIME-Version, Headers entries replace
+// generated fields of the same name and the rest follow in sorted order
+func writeHeaders(buf *messageWriter, email Email) {
+	xPriority, importance := email.Priority.headers()
+	fields := [][2]string{
+		{"From", headerAddress(email.From)},
+		{"To", joinAddresses(email.To)},
+		{"Cc", joinAddresses(email.Cc)},
+		{"Subject", encodeHeader(email.Subject)},
+		{"Date", time.Now().Format(time.RFC1123Z)},
+		{"Message-ID", newMessageID(email.From.Address)},
+		{"Disposition-Notification-To", readReceiptHeader(email.ReadReceipt)},
+		{"X-Priority", xPriority},
+		{"Importance", importance},
+		{"Sensitivity", email.Sensitivity.header()},
+		{"List-Unsubscribe", email.ListUnsubscribe.header()},
+		{"List-Unsubscribe-Post", email.ListUnsubscribe.postHeader()},
+		{"MIME-Version", "1.0"},
+	}
+
+	overrides := map[string]string{}
+	var extra []string
+	for name, value := range email.Headers {
+		key := textproto.CanonicalMIMEHeaderKey(name)
+		overrides[key] = encodeHeaderValue(key, value)
+		extra = append(extra, key)
+	}
+	sort.Strings(extra)
+
+	for _, field := range fields {
+		key := textproto.CanonicalMIMEHeaderKey(field[0])
+		if value, ok := overrides[key]; ok {
+			field[1] = value
+			delete(overrides, key)
+		}
+		if field[1] == "" {
+			continue
+		}
+		// MIME-Version closes the block so Content-Type can follow it
+		if field[0] == "MIME-Version" {
+			for _, key := range extra {
+				if value, ok := overrides[key]; ok {
+					fmt.Fprintf(buf, "%s: %s\r\n", key, value)
+				}
+			}
+		}
+		fmt.Fprintf(buf, "%s: %s\r\n", field[0], field[1])
+	}
+}
+
+func readReceiptHeader(addr *mail.Address) string {
+	if addr == nil {
+		return ""
+	}
+	return headerAddress(*addr)
+}
+
+// address fields are parsed and rendered like the generated ones, so only
+// the display names get encoded
+func encodeHeaderValue(key, value string) string {
+	switch key {
+	case "From", "Sender", "To", "Cc", "Reply-To", "Disposition-Notification-To":
+		if addrs, err := mail.ParseAddressList(value); err == nil {
+			list := make([]mail.Address, len(addrs))
+			for i, addr := range addrs {
+				list[i] = *addr
+			}
+			return joinAddresses(list)
+		}
+	}
+	return encodeHeader(value)
+}
+
+func hasHeader(headers map[string]string, name string) bool {
+	for key := range headers {
+		if strings.EqualFold(key, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// the value of name in headers, its case ignored
+func headerValue(headers map[string]string, name string) string {
+	for key, value := range headers {
+		if strings.EqualFold(key, name) {
+			return value
+		}
+	}
+	return ""
+}
+
+// <random.timestamp@domain> with the domain of the From address
+func newMessageID(from string) string {
+	domain := "localhost"
+	if at := strings.LastIndex(from, "@"); at >= 0 && at < len(from)-1 {
+		domain = from[at+1:]
+		if ascii, err := asciiDomain(domain); err == nil {
+			domain = ascii
+		}
+	}
+	var b [12]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		log.Printf("Error generating Message-ID: %v", err)
+	}
+	return fmt.Sprintf("<%s.%d@%s>", hex.EncodeToString(b[:]), time.Now().UnixNano(), domain)
+}
+
+// a multipart boundary, random so it differs in every message and a body
+// can't be made to contain it; drawn again in the unlikely case one of
+// parts does. The "_" keeps it out of base64 output. Its length is fixed,
+// so a message written twice, to count its size and then to send it, or
+// again on a retry, comes out the same size.
+func newBoundary(prefix string, parts ...string) string {
+	for {
+		var b [12]byte
+		if _, err := rand.Read(b[:]); err != nil {
+			log.Printf("Error generating boundary: %v", err)
+		}
+		boundary := prefix + "_" + hex.EncodeToString(b[:])
+		if !slices.ContainsFunc(parts, func(part string) bool { return strings.Contains(part, boundary) }) {
+			return boundary
+		}
+	}
+}
+
+// what the message writers copy into the message as it is, which
+// boundaries must not occur in
+func (e Email) mimeText() []string {
+	parts := []string{e.TextBody, e.Body}
+	if e.Invite != nil {
+		parts = append(parts, e.Invite.text(), e.Invite.calendar(e))
+	}
+	for _, att := range e.Attachments {
+		parts = append(parts, att.Filename, att.contentType(), att.ContentID)
+	}
+	return parts
+}
+
+// Content-Type header and content of the message body: the text, wrapped
+// in multipart/related together with inline images when there are any
+// (RFC 2387), so cid: references in the html resolve inside the message
+func writeBody(buf *messageWriter, email Email) {
+	var inline []Attachment
+	for _, att := range email.Attachments {
+		if att.Inline {
+			inline = append(inline, att)
+		}
+	}
+	if len(inline) == 0 {
+		writeText(buf, email)
+		return
+	}
+
+	boundary := newBoundary("rel", email.mimeText()...)
+	fmt.Fprintf(buf, "Content-Type: multipart/related; boundary=%s\r\n", boundary)
+	fmt.Fprintf(buf, "\r\n")
+
+	fmt.Fprintf(buf, "--%s\r\n", boundary)
+	writeText(buf, email)
+	buf.WriteString("\r\n")
+	for _, att := range inline {
+		fmt.Fprintf(buf, "--%s\r\n", boundary)
+		writeAttachment(buf, att)
+	}
+	fmt.Fprintf(buf, "--%s--\r\n", boundary)
+}
+
+// html, plain text, or both as multipart/alternative with html last as the
+// preferred part (RFC 2046 5.1.4)
+func writeText(buf *messageWriter, email Email) {
+	switch {
+	case email.Invite != nil:
+		writeInvite(buf, email)
+	case email.TextBody == "":
+		writeTextPart(buf, "text/html", email.Body)
+	case email.Body == "":
+		writeTextPart(buf, "text/plain", email.TextBody)
+	default:
+		boundary := newBoundary("alt", email.mimeText()...)
+		fmt.Fprintf(buf, "Content-Type: multipart/alternative; boundary=%s\r\n", boundary)
+		fmt.Fprintf(buf, "\r\n")
+
+		fmt.Fprintf(buf, "--%s\r\n", boundary)
+		writeTextPart(buf, "text/plain", email.TextBody)
+		buf.WriteString("\r\n")
+		fmt.Fprintf(buf, "--%s\r\n", boundary)
+		writeTextPart(buf, "text/html", email.Body)
+		buf.WriteString("\r\n")
+		fmt.Fprintf(buf, "--%s--\r\n", boundary)
+	}
+}
+
+func writeTextPart(buf *messageWriter, contentType, text string) {
+	fmt.Fprintf(buf, "Content-Type: %s; charset=UTF-8\r\n", contentType)
+	writeTextContent(buf, canonicalLines(text))
+}
+
+// the longest line SMTP carries, CRLF not counted (RFC 5321 4.5.3.1.6)
+const maxLineLength = 998
+
+// Content-Transfer-Encoding and text in CRLF lines: as it is when it is
+// 7bit (RFC 2045 2.7), quoted-printable (RFC 2045 6.7) when it has 8-bit
+// octets, which need 8BITMIME along the whole way, or lines too long to
+// send
+func writeTextContent(buf *messageWriter, text string) {
+	if is7bit(text) {
+		fmt.Fprintf(buf, "Content-Transfer-Encoding: 7bit\r\n")
+		fmt.Fprintf(buf, "\r\n")
+		buf.WriteString(text)
+		return
+	}
+	fmt.Fprintf(buf, "Content-Transfer-Encoding: quoted-printable\r\n")
+	fmt.Fprintf(buf, "\r\n")
+	// write errors stay in buf
+	qp := quotedprintable.NewWriter(buf)
+	qp.Write([]byte(text))
+	qp.Close()
+}
+
+// ASCII without NULs in lines of at most maxLineLength octets
+func is7bit(text string) bool {
+	line := 0
+	for i := 0; i < len(text); i++ {
+		switch c := text[i]; {
+		case c == 0 || c >= 0x80:
+			return false
+		case c == '\n':
+			line = 0
+		case c != '\r':
+			if line++; line > maxLineLength {
+				return false
+			}
+		}
+	}
+	return true
 }
 
 type Attachment struct {
 	Filename    string
 	ContentType string
 	Data        []byte
+	Inline      bool   // shown in the html body, referenced as cid:ContentID
+	ContentID   string // without angle brackets
+	Charset     string // of a text attachment, eg. "iso-8859-1", default utf-8 if the data is valid UTF-8
 }
 
-type EliteSender struct{}
+func writeAttachment(buf *messageWriter, att Attachment) {
+	fmt.Fprintf(buf, "Content-Type: %s\r\n", att.contentType())
+	fmt.Fprintf(buf, "Content-Transfer-Encoding: base64\r\n")
+	disposition := "attachment"
+	if att.Inline {
+		disposition = "inline"
+	}
+	// non-ASCII filenames become filename*=utf-8''... (RFC 2231)
+	fmt.Fprintf(buf, "Content-Disposition: %s\r\n", mime.FormatMediaType(disposition, map[string]string{"filename": att.Filename}))
+	if att.ContentID != "" {
+		fmt.Fprintf(buf, "Content-ID: <%s>\r\n", att.ContentID)
+	}
+	fmt.Fprintf(buf, "\r\n")
 
-// implements the EmailSender interface with attachment support
-func (s EliteSender) Send(config SMTPConfig, email Email) error {
-	client, err := NewSMTPClient(config)
-	if err != nil {
-		return err
+	if err := writeBase64(buf, att.Data); err != nil {
+		log.Printf("Error encoding attachment %s: %v", att.Filename, err)
 	}
-	defer client.Close()
-	defer client.Quit()
+}
 
-	if err = client.Mail(config.Username); err != nil {
-		return fmt.Errorf("MAIL command failed: %w", err)
+// data in base64 lines of 76 characters, each ended by CRLF (RFC 2045 6.8)
+func writeBase64(w io.Writer, data []byte) error {
+	encoder := base64.NewEncoder(base64.StdEncoding, &lineWrapper{w: w, width: 76})
+	if _, err := encoder.Write(data); err != nil {
+		return err
+	}
+	if err := encoder.Close(); err != nil {
+		return err
 	}
+	_, err := io.WriteString(w, "\r\n")
+	return err
+}
 
-	for _, to := range email.To {
-		if err = client.Rcpt(to.Address); err != nil {
-			return fmt.Errorf("RCPT command failed for %s: %w", to.Address, err)
+// a CRLF after every width bytes written through it
+type lineWrapper struct {
+	w      io.Writer
+	width  int
+	column int
+}
+
+func (l *lineWrapper) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if l.column == l.width {
+			if _, err := io.WriteString(l.w, "\r\n"); err != nil {
+				return written, err
+			}
+			l.column = 0
+		}
+		n := min(len(p), l.width-l.column)
+		n, err := l.w.Write(p[:n])
+		written += n
+		l.column += n
+		if err != nil {
+			return written, err
 		}
+		p = p[n:]
 	}
+	return written, nil
+}
 
-	writer, err := client.Data()
+type EliteSender struct{}
+
+// implements the EmailSender interface with attachment support
+func (s EliteSender) Send(ctx context.Context, config SMTPConfig, email Email) (err error) {
+	if err := email.Validate(); err != nil {
+		return err
+	}
+	defer func() { err = contextError(ctx, err) }()
+
+	msg, err := config.payload(email, Email.writeMultipart)
 	if err != nil {
-		return fmt.Errorf("DATA command failed: %w", err)
+		return err
 	}
-	defer writer.Close()
 
-	msg := buildMultipartMessage(email)
-	_, err = writer.Write(msg)
-	return err
+	client, err := NewSMTPClient(ctx, config)
+	if err != nil {
+		return err
+	}
+	defer client.watch(ctx)()
+	// QUIT and close, or only close if the session broke; a failed QUIT
+	// doesn't matter once the server has the message
+	defer client.Quit()
+
+	env := email.envelope(config.Username, email.Recipients())
+	env.Size = msg.size
+	return client.send(env, msg.write)
 }
 
-// construct MIME multipart message
-func buildMultipartMessage(email Email) []byte {
-	var buf bytes.Buffer
-	boundary := fmt.Sprintf("%d", os.Getpid())
-
-	fmt.Fprintf(&buf, "From: %s\r\n", email.From.String())
-	fmt.Fprintf(&buf, "To: %s\r\n", joinAddresses(email.To))
-	fmt.Fprintf(&buf, "Subject: %s\r\n", email.Subject)
-	fmt.Fprintf(&buf, "MIME-Version: 1.0\r\n")
-	fmt.Fprintf(&buf, "Content-Type: multipart/mixed; boundary=%s\r\n", boundary)
-	fmt.Fprintf(&buf, "\r\n")
-
-	fmt.Fprintf(&buf, "--%s\r\n", boundary)
-	fmt.Fprintf(&buf, "Content-Type: text/html; charset=UTF-8\r\n")
-	fmt.Fprintf(&buf, "Content-Transfer-Encoding: 7bit\r\n")
-	fmt.Fprintf(&buf, "\r\n")
-	buf.WriteString(email.Body)
-	buf.WriteString("\r\n")
+// MIME multipart message
+func (e Email) writeMultipart(w io.Writer) (int64, error) {
+	mw := &messageWriter{w: w}
+	writeHeaders(mw, e)
+	e.writeContent(mw, writeMixed)
+	return mw.n, mw.err
+}
 
-	for _, att := range email.Attachments {
-		fmt.Fprintf(&buf, "--%s\r\n", boundary)
-		fmt.Fprintf(&buf, "Content-Type: %s\r\n", att.ContentType)
-		fmt.Fprintf(&buf, "Content-Transfer-Encoding: base64\r\n")
-		fmt.Fprintf(&buf, "Content-Disposition: attachment; filename=\"%s\"\r\n", att.Filename)
-		fmt.Fprintf(&buf, "\r\n")
-
-		// encode attachment in base64
-		encoder := base64.NewEncoder(base64.StdEncoding, &buf)
-		_, err := encoder.Write(att.Data)
-		if err != nil {
-			log.Printf("Error encoding attachment %s: %v", att.Filename, err)
+// the body followed by the attachments, as multipart/mixed
+func writeMixed(mw *messageWriter, e Email) {
+	boundary := newBoundary("mixed", e.mimeText()...)
+	fmt.Fprintf(mw, "Content-Type: multipart/mixed; boundary=%s\r\n", boundary)
+	fmt.Fprintf(mw, "\r\n")
+
+	fmt.Fprintf(mw, "--%s\r\n", boundary)
+	writeBody(mw, e)
+	mw.WriteString("\r\n")
+
+	// inline attachments are part of the body
+	for _, att := range e.Attachments {
+		if att.Inline {
+			continue
 		}
-		encoder.Close()
-		buf.WriteString("\r\n")
+		fmt.Fprintf(mw, "--%s\r\n", boundary)
+		writeAttachment(mw, att)
 	}
 
-	fmt.Fprintf(&buf, "--%s--\r\n", boundary)
-
-	return buf.Bytes()
+	fmt.Fprintf(mw, "--%s--\r\n", boundary)
 }
 
 // create attachment from a file path
@@ -222,35 +793,84 @@ func NewAttachmentFromFile(filePath string) (Attachment, error) {
 		return Attachment{}, fmt.Errorf("failed to read file: %w", err)
 	}
 
-	contentType := mime.TypeByExtension(filepath.Ext(filePath))
-	if contentType == "" {
-		contentType = "application/octet-stream"
+	att := Attachment{Filename: filepath.Base(filePath), Data: data}
+	att.ContentType = att.contentType()
+	return att, nil
+}
+
+// create an image shown in the html body with <img src="cid:contentID">
+func NewInlineAttachmentFromFile(filePath, contentID string) (Attachment, error) {
+	att, err := NewAttachmentFromFile(filePath)
+	if err != nil {
+		return Attachment{}, err
 	}
+	att.Inline = true
+	att.ContentID = contentID
+	return att, nil
+}
 
-	return Attachment{
-		Filename:    filepath.Base(filePath),
-		ContentType: contentType,
-		Data:        data,
-	}, nil
+// RFC 2047 encoded-words for non-ASCII text, folded between the words so
+// long subjects stay within the line length limit. Display names need no
+// help, mail.Address.String already encodes them.
+func encodeHeader(value string) string {
+	encoded := mime.QEncoding.Encode("UTF-8", value)
+	if encoded == value {
+		return value
+	}
+	return strings.ReplaceAll(encoded, "?= =?", "?=\r\n =?")
 }
 
-// []mail.Address to a comma separated string
+// []mail.Address to a comma separated string, Unicode domains as A-labels
 func joinAddresses(addrs []mail.Address) string {
 	var result []string
 	for _, addr := range addrs {
-		result = append(result, addr.String())
+		result = append(result, headerAddress(addr))
 	}
 	return strings.Join(result, ", ")
 }
 
 func main() {
-	config := SMTPConfig{
-		Host:     "", // eg. smtp.gmail.com
-		Port:     "", // usually 587
-		Username: "", // eg. someone@gmail.com
-		Password: "", // eg. google's app password
+	if len(os.Args) > 1 && os.Args[1] == "smtp-probe" {
+		runSMTPProbe(os.Args[2:])
+		return
+	}
+
+	dryRun := flag.String("dry-run", "", "write the messages as .eml files to this directory instead of sending them")
+	verbose := flag.Bool("v", false, "log the SMTP dialogue to stderr")
+	progress := flag.Bool("progress", false, "show the upload of the message data on stderr")
+	archive := flag.String("archive", "", "keep a copy of every message sent in this directory")
+	configFile := flag.String("config", "", "read the SMTP settings from this TOML or YAML file, default $SMTP_CONFIG")
+	profile := flag.String("profile", "", "the profile of the config file to use, eg. gmail, default $SMTP_PROFILE")
+	flag.Parse()
+
+	// eg. SMTP_PROFILE=gmail SMTP_USERNAME=someone@gmail.com
+	// SMTP_PASSWORD=<google's app password>
+	config, err := LoadConfig(*configFile, *profile)
+	if err != nil && *dryRun == "" {
+		log.Fatal(err)
+	}
+	if *verbose {
+		config.Transcript = TranscriptWriter(os.Stderr)
+	}
+	config.OnAccepted = func(r Receipt) {
+		log.Printf("%s accepted the message for %v: %d %s", r.Server, r.Recipients, r.Code, r.Message)
+	}
+	if *archive != "" {
+		config.Archive = &ArchiveDir{Dir: *archive}
+	}
+	if *progress {
+		config.Progress = func(p DataProgress) {
+			fmt.Fprintf(os.Stderr, "\r%d of %d bytes, %.1f KiB/s", p.Written, p.Total, p.BytesPerSecond()/1024)
+			if p.Done {
+				fmt.Fprintf(os.Stderr, ", sent in %v\n", p.Elapsed.Round(time.Millisecond))
+			}
+		}
 	}
 
+	// give up on a server that stops responding
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
 	recipients := []mail.Address{
 		{Name: "Recipient Name 1", Address: "john@gmail.com"},
 		{Name: "Recipient Name 2", Address: "doe@example.com"},
@@ -270,54 +890,59 @@ func main() {
 	    </div>
 	</body>
 	</html>`,
+		TextBody: "This is a heading\n\nThis is a paragraph\nThis is a styled paragraph\n",
+	}
+
+	var simpleSender, advancedSender, sender EmailSender = SimpleSender{}, AdvancedSender{}, EliteSender{}
+	if *dryRun != "" {
+		files := FileSender{Dir: *dryRun}
+		simpleSender, advancedSender, sender = files, files, files
 	}
 
 	// SimpleSender
-	simpleSender := SimpleSender{}
-	if err := simpleSender.Send(config, email); err != nil {
+	if err := simpleSender.Send(ctx, config, email); err != nil {
 		log.Printf("failed to send simple mail: %v", err)
 	} else {
 		log.Println("simple mail sent")
 	}
 
 	// Using AdvancedSender
-	advancedSender := AdvancedSender{}
-	if err := advancedSender.Send(config, email); err != nil {
+	if err := advancedSender.Send(ctx, config, email); err != nil {
 		log.Printf("failed to send advanced mail: %v", err)
 	} else {
 		log.Println("advanced mail sent")
 	}
 
-	// Create some example attachments
-	attachment1, err := NewAttachmentFromFile("photo.jpg")
-	if err != nil {
-		log.Printf("failed to create attachment: %v", err)
-	}
-
-	attachment2 := Attachment{
-		Filename:    "test.txt",
-		ContentType: "text/plain",
-		Data:        []byte("This is a test attachment content"),
-	}
-
-	emailElite := Email{
-		From:    mail.Address{Name: "Sender Name", Address: config.Username},
-		To:      recipients,
-		Subject: "Email with Attachments",
-		Body: `<!DOCTYPE html>
+	// the builder checks the email before anything is sent
+	emailElite, err := NewEmail().
+		From("Sender Name <"+config.Username+">").
+		To("Recipient Name 1 <john@gmail.com>", "Recipient Name 2 <doe@example.com>").
+		Subject("Email with Attachments").
+		HTML(`<!DOCTYPE html>
 <html>
 <body>
     <div style="border: 2px solid black; padding: 10px;">
+        <img src="cid:logo" alt="logo">
         <h1>Important Message</h1>
         <p>Please find the attached files below.</p>
     </div>
 </body>
-</html>`,
-		Attachments: []Attachment{attachment1, attachment2},
+</html>`).
+		Text("Important Message\n\nPlease find the attached files below.\n").
+		InlineFile("logo.png", "logo").
+		AttachFile("photo.jpg").
+		Attach(Attachment{
+			Filename:    "test.txt",
+			ContentType: "text/plain",
+			Data:        []byte("This is a test attachment content"),
+		}).
+		Build()
+	if err != nil {
+		log.Printf("failed to build elite mail: %v", err)
+		return
 	}
 
-	sender := EliteSender{}
-	if err := sender.Send(config, emailElite); err != nil {
+	if err := sender.Send(ctx, config, emailElite); err != nil {
 		log.Printf("failed to send elite mail: %v", err)
 	} else {
 		log.Println("elite mail sent")
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"mime/quotedprintable"
+	"net/mail"
+	"strings"
+	"testing"
+)
+
+func TestWriteTextPart(t *testing.T) {
+	long := strings.Repeat("x", maxLineLength)
+	tests := []struct {
+		name     string
+		text     string
+		encoding string
+		want     string // the decoded body
+	}{
+		{"ascii", "Hello\nthere\n", "7bit", "Hello\r\nthere\r\n"},
+		{"longest line", long + "\r\n", "7bit", long + "\r\n"},
+		{"utf-8", "Grüße, 世界\n", "quoted-printable", "Grüße, 世界\r\n"},
+		{"line too long", long + "x\nshort\n", "quoted-printable", long + "x\r\nshort\r\n"},
+		{"nul", "a\x00b", "quoted-printable", "a\x00b"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			writeTextPart(&messageWriter{w: &buf}, "text/plain", tt.text)
+
+			for _, line := range strings.Split(buf.String(), "\r\n") {
+				if len(line) > maxLineLength || strings.ContainsAny(line, "\r\n") {
+					t.Fatalf("line of %d octets or with a bare line break: %q", len(line), line)
+				}
+			}
+			if tt.encoding == "quoted-printable" && !is7bit(buf.String()) {
+				t.Errorf("quoted-printable part isn't 7bit:\n%s", buf.String())
+			}
+
+			m, err := mail.ReadMessage(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := m.Header.Get("Content-Transfer-Encoding"); got != tt.encoding {
+				t.Errorf("Content-Transfer-Encoding %s, want %s", got, tt.encoding)
+			}
+			var body io.Reader = m.Body
+			if tt.encoding == "quoted-printable" {
+				body = quotedprintable.NewReader(body)
+			}
+			got, err := io.ReadAll(body)
+			if err != nil || string(got) != tt.want {
+				t.Errorf("body %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// SMTPError is a reply of a server that refused a command. It wraps the
+// *textproto.Error of net/smtp, errors.As finds either; AsSMTPError turns
+// any of them in an error chain into an SMTPError.
+type SMTPError struct {
+	Code     int    // the reply code, eg. 450 or 550
+	Enhanced string // RFC 3463 status such as "5.1.1", if the server sent one
+	Message  string // the reply text, the enhanced status included
+
+	reply *textproto.Error
+}
+
+func newSMTPError(reply *textproto.Error) *SMTPError {
+	return &SMTPError{
+		Code:     reply.Code,
+		Enhanced: enhancedCodePattern.FindString(reply.Msg),
+		Message:  reply.Msg,
+		reply:    reply,
+	}
+}
+
+func (e *SMTPError) Error() string {
+	return fmt.Sprintf("%03d %s", e.Code, e.Message)
+}
+
+func (e *SMTPError) Unwrap() error {
+	if e.reply == nil {
+		return nil
+	}
+	return e.reply
+}
+
+// a 4xx reply: the same command may succeed later
+func (e *SMTPError) Temporary() bool {
+	return e.Code >= 400 && e.Code < 500
+}
+
+// a 5xx reply: it won't
+func (e *SMTPError) Permanent() bool {
+	return e.Code >= 500
+}
+
+// the subject of the enhanced status: 1 addressing, 2 mailbox, 3 mail
+// system, 4 network and routing, 5 protocol, 6 content, 7 security or
+// policy; 0 without an enhanced status
+func (e *SMTPError) Subject() int {
+	_, rest, _ := strings.Cut(e.Enhanced, ".")
+	subject, _, _ := strings.Cut(rest, ".")
+	n, _ := strconv.Atoi(subject)
+	return n
+}
+
+// the server's reply in err, nil if err has none
+func AsSMTPError(err error) *SMTPError {
+	var smtpErr *SMTPError
+	if errors.As(err, &smtpErr) {
+		return smtpErr
+	}
+	var reply *textproto.Error
+	if errors.As(err, &reply) {
+		return newSMTPError(reply)
+	}
+	return nil
+}
+
+// a reply in err as an *SMTPError, for the errors of net/smtp
+func smtpError(err error) error {
+	if reply, ok := err.(*textproto.Error); ok {
+		return newSMTPError(reply)
+	}
+	return err
+}
+
+// IsTransient tells whether a failed send is worth another attempt later:
+// 4xx replies, deferred recipients, timeouts and network trouble are.
+// Anything else is permanent, 5xx replies, header injection and the
+// policies' refusals among it, so that an error nobody classified doesn't
+// keep a message in the queue until it expires.
+func IsTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+	var delivery *DeliveryError
+	if errors.As(err, &delivery) {
+		return len(delivery.with(Deferred)) > 0
+	}
+	if smtpErr := AsSMTPError(err); smtpErr != nil {
+		return smtpErr.Temporary()
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		// a domain without mail servers stays without
+		return !dnsErr.IsNotFound
+	}
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		// a refused or reset connection as much as a timeout
+		return true
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+	// errors that say for themselves, the policies' among them
+	var temporary interface{ Temporary() bool }
+	if errors.As(err, &temporary) {
+		return temporary.Temporary()
+	}
+	return false
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// what ProbeServer found out about an SMTP server
+type ServerProbe struct {
+	Addr     string
+	Banner   string   // the greeting, without the code
+	EHLO     string   // the server's reply to EHLO, its first line
+	HELOOnly bool     // EHLO was refused, the server is from before ESMTP
+	Extended []string // the extensions as advertised, eg. "SIZE 35882577"
+
+	// after STARTTLS, or from the start with implicit TLS
+	TLS         *tls.ConnectionState
+	VerifyErr   error    // the certificate chain or name did not verify
+	TLSExtended []string // the extensions advertised over TLS
+	TLSErr      error    // STARTTLS was offered but failed
+
+	Timings []ProbeTiming // in the order of the dialogue
+}
+
+// how long one step of the dialogue took
+type ProbeTiming struct {
+	Step     string
+	Duration time.Duration
+}
+
+// ProbeOptions says how ProbeServer talks to the server
+type ProbeOptions struct {
+	HeloName    string // default the detected name
+	ImplicitTLS bool   // TLS from the first byte, for port 465
+	NoTLS       bool   // don't STARTTLS
+	ServerName  string // to verify the certificate for, default the host of the address
+}
+
+// ProbeServer connects to the SMTP server at addr, greets it and lists
+// what it offers, then, if it can, switches to TLS and does so again,
+// timing each step. Nothing is sent: the session ends with QUIT after the
+// second EHLO. The certificate is checked but a failure doesn't stop the
+// probe, it is reported in VerifyErr; the error return is for a server
+// that couldn't be talked to at all.
+func ProbeServer(ctx context.Context, addr string, options ProbeOptions) (*ServerProbe, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if options.ServerName == "" {
+		options.ServerName = host
+	}
+	probe := &ServerProbe{Addr: addr}
+	timed := func(step string, f func() error) error {
+		start := time.Now()
+		err := f()
+		probe.Timings = append(probe.Timings, ProbeTiming{step, time.Since(start)})
+		return err
+	}
+
+	var conn net.Conn
+	err = timed("connect", func() (err error) {
+		conn, err = (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	// the certificate is verified after the handshake, to report on it
+	// whether or not it is valid
+	tlsConfig := &tls.Config{ServerName: options.ServerName, InsecureSkipVerify: true}
+	handshake := func(step string) error {
+		tlsConn := tls.Client(conn, tlsConfig)
+		if err := timed(step, func() error { return tlsConn.HandshakeContext(ctx) }); err != nil {
+			return err
+		}
+		state := tlsConn.ConnectionState()
+		probe.TLS = &state
+		probe.VerifyErr = verifyProbeChain(state, options.ServerName)
+		conn = tlsConn
+		return nil
+	}
+	if options.ImplicitTLS {
+		if err := handshake("TLS handshake"); err != nil {
+			return nil, fmt.Errorf("TLS handshake failed: %w", err)
+		}
+	}
+
+	text := textproto.NewConn(conn)
+	err = timed("banner", func() (err error) {
+		_, probe.Banner, err = text.ReadResponse(220)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("no greeting: %w", err)
+	}
+
+	helo := options.HeloName
+	if helo == "" {
+		helo = detectHeloName(ctx, conn)
+	}
+	ehlo := func(step string) ([]string, error) {
+		var reply string
+		err := timed(step, func() (err error) {
+			reply, err = probeCommand(text, 250, "EHLO %s", helo)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		lines := strings.Split(reply, "\n")
+		probe.EHLO = lines[0]
+		return lines[1:], nil
+	}
+	probe.Extended, err = ehlo("EHLO")
+	if err != nil {
+		probe.HELOOnly = true
+		err = timed("HELO", func() (err error) {
+			_, err = probeCommand(text, 250, "HELO %s", helo)
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("HELO refused: %w", err)
+		}
+	}
+
+	if !options.ImplicitTLS && !options.NoTLS && probeHasExtension(probe.Extended, "STARTTLS") {
+		probe.TLSErr = timed("STARTTLS", func() error {
+			_, err := probeCommand(text, 220, "STARTTLS")
+			return err
+		})
+		if probe.TLSErr == nil {
+			probe.TLSErr = handshake("TLS handshake")
+		}
+		if probe.TLSErr != nil {
+			// the session is in an unknown state after a failed STARTTLS
+			return probe, nil
+		}
+		text = textproto.NewConn(conn)
+		if probe.TLSExtended, err = ehlo("EHLO over TLS"); err != nil {
+			return probe, fmt.Errorf("EHLO over TLS failed: %w", err)
+		}
+	} else if options.ImplicitTLS {
+		probe.TLSExtended = probe.Extended
+	}
+
+	timed("QUIT", func() error {
+		_, err := probeCommand(text, 221, "QUIT")
+		return err
+	})
+	return probe, nil
+}
+
+func probeCommand(text *textproto.Conn, expect int, format string, args ...any) (string, error) {
+	id, err := text.Cmd(format, args...)
+	if err != nil {
+		return "", err
+	}
+	text.StartResponse(id)
+	defer text.EndResponse(id)
+	_, msg, err := text.ReadResponse(expect)
+	return msg, err
+}
+
+// the chain against the system roots and the name, with the
+// intermediates the server sent
+func verifyProbeChain(state tls.ConnectionState, name string) error {
+	if len(state.PeerCertificates) == 0 {
+		return errors.New("no certificate")
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range state.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := state.PeerCertificates[0].Verify(x509.VerifyOptions{DNSName: name, Intermediates: intermediates})
+	return err
+}
+
+func probeHasExtension(extensions []string, name string) bool {
+	_, ok := probeExtension(extensions, name)
+	return ok
+}
+
+// the parameters of an extension, eg. the mechanisms of AUTH
+func probeExtension(extensions []string, name string) (string, bool) {
+	for _, ext := range extensions {
+		keyword, params, _ := strings.Cut(ext, " ")
+		if strings.EqualFold(keyword, name) {
+			return params, true
+		}
+	}
+	return "", false
+}
+
+// writes the probe as a report for a person
+func (p *ServerProbe) WriteReport(w io.Writer) {
+	fmt.Fprintf(w, "server   %s\n", p.Addr)
+	fmt.Fprintf(w, "banner   %s\n", p.Banner)
+	if p.HELOOnly {
+		fmt.Fprintln(w, "EHLO     refused, HELO only: no extensions, no STARTTLS")
+	} else {
+		fmt.Fprintf(w, "EHLO     %s\n", p.EHLO)
+		writeProbeExtensions(w, p.Extended)
+	}
+
+	switch {
+	case p.TLSErr != nil:
+		fmt.Fprintf(w, "\nSTARTTLS failed: %v\n", p.TLSErr)
+	case p.TLS == nil && probeHasExtension(p.Extended, "STARTTLS"):
+		fmt.Fprintln(w, "\nTLS      offered, not tried")
+	case p.TLS == nil:
+		fmt.Fprintln(w, "\nTLS      not offered, mail to this server goes in plaintext")
+	default:
+		fmt.Fprintf(w, "\nTLS      %s, %s\n", tls.VersionName(p.TLS.Version), tls.CipherSuiteName(p.TLS.CipherSuite))
+		for i, cert := range p.TLS.PeerCertificates {
+			fmt.Fprintf(w, "cert %d   %s\n", i, cert.Subject)
+			fmt.Fprintf(w, "  issuer   %s\n", cert.Issuer)
+			if len(cert.DNSNames) > 0 {
+				fmt.Fprintf(w, "  names    %s\n", strings.Join(cert.DNSNames, ", "))
+			}
+			days := int(time.Until(cert.NotAfter).Hours() / 24)
+			fmt.Fprintf(w, "  valid    %s to %s, %d days left\n",
+				cert.NotBefore.Format(time.DateOnly), cert.NotAfter.Format(time.DateOnly), days)
+		}
+		if p.VerifyErr != nil {
+			fmt.Fprintf(w, "verify   FAILED: %v\n", p.VerifyErr)
+		} else {
+			fmt.Fprintln(w, "verify   ok")
+		}
+		if p.TLSExtended != nil && !slices.EqualFunc(p.TLSExtended, p.Extended, strings.EqualFold) {
+			fmt.Fprintln(w, "over TLS")
+			writeProbeExtensions(w, p.TLSExtended)
+		}
+	}
+
+	fmt.Fprintln(w, "\ntimings")
+	for _, t := range p.Timings {
+		fmt.Fprintf(w, "  %-14s %v\n", t.Step, t.Duration.Round(time.Microsecond))
+	}
+}
+
+// the extensions that matter for delivery first, explained, then the rest
+func writeProbeExtensions(w io.Writer, extensions []string) {
+	yesNo := func(name string) string {
+		if probeHasExtension(extensions, name) {
+			return "yes"
+		}
+		return "no"
+	}
+	fmt.Fprintf(w, "  STARTTLS    %s\n", yesNo("STARTTLS"))
+	if size, ok := probeExtension(extensions, "SIZE"); ok {
+		limit, err := strconv.ParseInt(size, 10, 64)
+		switch {
+		case err != nil || limit == 0:
+			fmt.Fprintf(w, "  SIZE        no limit given\n")
+		default:
+			fmt.Fprintf(w, "  SIZE        %d bytes (%.1f MB)\n", limit, float64(limit)/1e6)
+		}
+	} else {
+		fmt.Fprintf(w, "  SIZE        not advertised\n")
+	}
+	fmt.Fprintf(w, "  PIPELINING  %s\n", yesNo("PIPELINING"))
+	if mechanisms, ok := probeExtension(extensions, "AUTH"); ok {
+		fmt.Fprintf(w, "  AUTH        %s\n", mechanisms)
+	} else {
+		fmt.Fprintf(w, "  AUTH        none\n")
+	}
+
+	var others []string
+	for _, ext := range extensions {
+		keyword, _, _ := strings.Cut(ext, " ")
+		switch strings.ToUpper(keyword) {
+		case "STARTTLS", "SIZE", "PIPELINING", "AUTH":
+		default:
+			others = append(others, ext)
+		}
+	}
+	sort.Strings(others)
+	if len(others) > 0 {
+		fmt.Fprintf(w, "  also        %s\n", strings.Join(others, ", "))
+	}
+}
+
+// sending_mail smtp-probe [flags] host[:port]
+func runSMTPProbe(args []string) {
+	fs := flag.NewFlagSet("smtp-probe", flag.ExitOnError)
+	helo := fs.String("helo", "", "name to announce in EHLO, default this host's")
+	implicit := fs.Bool("tls", false, "TLS from the first byte, as on port 465")
+	noTLS := fs.Bool("no-starttls", false, "don't switch to TLS")
+	serverName := fs.String("servername", "", "name to verify the certificate for, default the host")
+	timeout := fs.Duration("timeout", 30*time.Second, "give up on the server after this long")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fmt.Println("usage: sending_mail smtp-probe [flags] host[:port]")
+		os.Exit(2)
+	}
+	addr := fs.Arg(0)
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		port := "25"
+		if *implicit {
+			port = "465"
+		}
+		addr = net.JoinHostPort(strings.Trim(addr, "[]"), port)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	probe, err := ProbeServer(ctx, addr, ProbeOptions{HeloName: *helo, ImplicitTLS: *implicit, NoTLS: *noTLS, ServerName: *serverName})
+	if probe != nil {
+		probe.WriteReport(os.Stdout)
+	}
+	if err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"net/http"
+	"net/mail"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"internet_services/receiving_mail/smtpd"
+)
+
+// why an address is suppressed
+const (
+	SuppressBounce      = "bounce"      // the address doesn't exist or is disabled
+	SuppressUnsubscribe = "unsubscribe" // the recipient asked to get no more mail
+	SuppressManual      = "manual"
+)
+
+// an address mail must not go to
+type Suppression struct {
+	Address string    `json:"address"`
+	Reason  string    `json:"reason"`           // SuppressBounce, SuppressUnsubscribe, ...
+	Detail  string    `json:"detail,omitempty"` // eg. the server's answer to a bounce
+	Added   time.Time `json:"added"`
+}
+
+// SuppressionStore keeps the suppressed addresses; SuppressionList keeps
+// them in memory or a file, implement it on a database table to share them
+// between senders. Addresses are compared ignoring case.
+type SuppressionStore interface {
+	Lookup(ctx context.Context, address string) (*Suppression, error) // nil if it isn't suppressed
+	Add(ctx context.Context, s Suppression) error
+	Remove(ctx context.Context, address string) error
+}
+
+// SuppressionList is a SuppressionStore in memory, saved to a JSON file
+// at Path if that is set. The file belongs to one process.
+type SuppressionList struct {
+	Path string
+
+	mu      sync.Mutex
+	entries map[string]Suppression
+	loaded  bool
+}
+
+func (l *SuppressionList) Lookup(_ context.Context, address string) (*Suppression, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.load(); err != nil {
+		return nil, err
+	}
+	s, ok := l.entries[strings.ToLower(address)]
+	if !ok {
+		return nil, nil
+	}
+	return &s, nil
+}
+
+// suppress s.Address, replacing what the list had on it; Added defaults
+// to now
+func (l *SuppressionList) Add(_ context.Context, s Suppression) error {
+	if s.Added.IsZero() {
+		s.Added = time.Now()
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.load(); err != nil {
+		return err
+	}
+	l.entries[strings.ToLower(s.Address)] = s
+	return l.save()
+}
+
+func (l *SuppressionList) Remove(_ context.Context, address string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.load(); err != nil {
+		return err
+	}
+	delete(l.entries, strings.ToLower(address))
+	return l.save()
+}
+
+// every suppression, by address
+func (l *SuppressionList) All() ([]Suppression, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.load(); err != nil {
+		return nil, err
+	}
+	list := make([]Suppression, 0, len(l.entries))
+	for _, s := range l.entries {
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, j int) bool { return strings.ToLower(list[i].Address) < strings.ToLower(list[j].Address) })
+	return list, nil
+}
+
+// read the file on first use; l.mu is held. Unlike a greylist, a list
+// that can't be read isn't started over, the addresses on it would get
+// mail again.
+func (l *SuppressionList) load() error {
+	if l.loaded {
+		return nil
+	}
+	entries := map[string]Suppression{}
+	if l.Path != "" {
+		data, err := os.ReadFile(l.Path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to read suppression list: %w", err)
+		}
+		if err == nil {
+			if err := json.Unmarshal(data, &entries); err != nil {
+				return fmt.Errorf("failed to read suppression list %s: %w", l.Path, err)
+			}
+		}
+	}
+	l.entries, l.loaded = entries, true
+	return nil
+}
+
+// l.mu is held
+func (l *SuppressionList) save() error {
+	if l.Path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(l.entries, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(filepath.Dir(l.Path), "."+filepath.Base(l.Path)+".tmp")
+	os.Remove(tmp) // left over from a crash in an earlier save
+	err = writeFileAtomic(tmp, l.Path, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save suppression list: %w", err)
+	}
+	return nil
+}
+
+// whether a permanent failure says the address is bad, not the message:
+// 5.1.x for a mailbox that doesn't exist, 5.2.1 for a disabled one, or
+// without an enhanced status the codes for no such user. Rejections for
+// spam or size are left alone.
+func addressFailure(code int, enhanced string) bool {
+	if enhanced != "" {
+		return strings.HasPrefix(enhanced, "5.1.") || enhanced == "5.2.1"
+	}
+	return code == 550 || code == 551 || code == 553
+}
+
+// SuppressRecipients is a Middleware that leaves the suppressed addresses
+// out of every email, reporting them as rejected in a DeliveryError
+// without trying them, and suppresses the recipients the server rejects
+// as not existing. A Queue with a sender wrapped in it gives up on those
+// at the next attempt. The addresses are removed from the To and Cc
+// headers too.
+func SuppressRecipients(store SuppressionStore) Middleware {
+	return func(sender EmailSender) EmailSender {
+		return SenderFunc(func(ctx context.Context, config SMTPConfig, email Email) error {
+			rcpts := email.Recipients()
+			final := map[string]RecipientResult{}
+			var lookupErr error
+			filter := func(list []mail.Address) []mail.Address {
+				var kept []mail.Address
+				for _, addr := range list {
+					s, err := store.Lookup(ctx, addr.Address)
+					if err != nil {
+						lookupErr = err
+					}
+					if s == nil {
+						kept = append(kept, addr)
+						continue
+					}
+					message := "suppressed: " + s.Reason
+					if s.Detail != "" {
+						message += " (" + s.Detail + ")"
+					}
+					final[addr.Address] = RecipientResult{Address: addr.Address, Status: Rejected, Message: message}
+				}
+				return kept
+			}
+			email.To, email.Cc, email.Bcc = filter(email.To), filter(email.Cc), filter(email.Bcc)
+			if lookupErr != nil {
+				return fmt.Errorf("suppression list: %w", lookupErr)
+			}
+
+			left := email.Recipients()
+			var err error
+			if len(left) > 0 {
+				err = sender.Send(ctx, config, email)
+			}
+
+			var rejected []RecipientResult
+			var delivery *DeliveryError
+			if errors.As(err, &delivery) {
+				rejected = delivery.with(Rejected)
+			} else if smtpErr := AsSMTPError(err); smtpErr != nil && smtpErr.Permanent() && len(left) == 1 {
+				rejected = append(rejected, recipientResult(left[0], err))
+			}
+			for _, r := range rejected {
+				if !addressFailure(r.Code, r.Enhanced) {
+					continue
+				}
+				s := Suppression{Address: r.Address, Reason: SuppressBounce, Detail: fmt.Sprintf("%d %s", r.Code, r.Message)}
+				if err := store.Add(ctx, s); err != nil {
+					log.Printf("suppression list: %v", err)
+				}
+			}
+			return mergeResults(rcpts, final, left, err)
+		})
+	}
+}
+
+// SuppressBounces is the smtpd.DeliveryHandler for the mailbox bounces come
+// back to: the addresses a delivery status notification reports as not
+// existing are suppressed. Other messages are logged and dropped.
+func SuppressBounces(store SuppressionStore) smtpd.DeliveryHandler {
+	return smtpd.DeliveryFunc(func(ctx context.Context, d *smtpd.Delivery) error {
+		bounce, err := ParseBounce(bytes.NewReader(d.Data))
+		if err != nil {
+			log.Printf("suppression list: delivery %s from <%s>: %v", d.ID, d.From, err)
+			return nil
+		}
+		for _, r := range bounce.Failed() {
+			if !addressFailure(r.Code, r.Status) {
+				continue
+			}
+			detail := strings.TrimSpace(r.Status + " " + r.Diagnostic)
+			if err := store.Add(ctx, Suppression{Address: r.Address, Reason: SuppressBounce, Detail: detail}); err != nil {
+				// the bounce comes again later
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// UnsubscribeMail is the smtpd.DeliveryHandler for a List-Unsubscribe mailto
+// address: the From address of every message to it is unsubscribed.
+func UnsubscribeMail(store SuppressionStore) smtpd.DeliveryHandler {
+	return smtpd.DeliveryFunc(func(ctx context.Context, d *smtpd.Delivery) error {
+		msg, err := mail.ReadMessage(bytes.NewReader(d.Data))
+		if err != nil {
+			return &textproto.Error{Code: 550, Msg: "5.6.0 malformed message"}
+		}
+		from, err := msg.Header.AddressList("From")
+		if err != nil || len(from) == 0 {
+			return &textproto.Error{Code: 550, Msg: "5.6.0 no From address to unsubscribe"}
+		}
+		for _, addr := range from {
+			if err := store.Add(ctx, Suppression{Address: addr.Address, Reason: SuppressUnsubscribe, Detail: "mail " + d.ID}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// the one-click unsubscribe URL of address (RFC 8058) for an
+// UnsubscribeHandler served at base with the same secret, to use as
+// ListUnsubscribe.URL
+func UnsubscribeURL(base string, secret []byte, address string) string {
+	query := url.Values{"address": {address}, "sig": {unsubscribeSignature(secret, address)}}
+	separator := "?"
+	if strings.Contains(base, "?") {
+		separator = "&"
+	}
+	return base + separator + query.Encode()
+}
+
+func unsubscribeSignature(secret []byte, address string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(strings.ToLower(address)))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// UnsubscribeHandler unsubscribes the address of an UnsubscribeURL on a
+// POST, as mail clients send for one-click unsubscribe. A GET, a reader
+// following the link, gets a page with a button to confirm: link scanners
+// fetch links too, and must not unsubscribe anyone.
+func UnsubscribeHandler(store SuppressionStore, secret []byte) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		address := r.URL.Query().Get("address")
+		sig := r.URL.Query().Get("sig")
+		if len(secret) == 0 || address == "" || !hmac.Equal([]byte(sig), []byte(unsubscribeSignature(secret, address))) {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+			fmt.Fprintf(w, `<!DOCTYPE html><form method="post"><p>Stop sending mail to %s?</p><button>Unsubscribe</button></form>`, html.EscapeString(address))
+		case http.MethodPost:
+			if err := store.Add(r.Context(), Suppression{Address: address, Reason: SuppressUnsubscribe, Detail: "one-click"}); err != nil {
+				log.Printf("suppression list: %v", err)
+				http.Error(w, "try again later", http.StatusServiceUnavailable)
+				return
+			}
+			fmt.Fprintf(w, `<!DOCTYPE html><p>%s is unsubscribed.</p>`, html.EscapeString(address))
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
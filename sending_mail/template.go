@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	htmltemplate "html/template"
+	"net/mail"
+	"sync"
+	texttemplate "text/template"
+)
+
+// TemplatedEmail is an Email whose subject and bodies are templates,
+// rendered once per recipient. HTML uses html/template so recipient data is
+// escaped, Subject and Text use text/template. A missing key in the data
+// is an error rather than "<no value>" in someone's inbox.
+type TemplatedEmail struct {
+	From        mail.Address
+	Subject     string
+	HTML        string
+	Text        string
+	Attachments []Attachment
+	Headers     map[string]string
+
+	// text/templates for per-recipient List-Unsubscribe methods, eg.
+	// "https://example.com/unsubscribe?id={{.ID}}"
+	UnsubscribeMailto string
+	UnsubscribeURL    string
+}
+
+// one recipient of a templated send and the data their copy is rendered with
+type TemplateRecipient struct {
+	Address mail.Address
+	Data    map[string]any
+}
+
+// the message for one recipient. The data also gets the recipient as
+// .Recipient unless it has a key of that name already.
+func (t TemplatedEmail) Render(rcpt TemplateRecipient) (Email, error) {
+	data := map[string]any{"Recipient": rcpt.Address}
+	for key, value := range rcpt.Data {
+		data[key] = value
+	}
+
+	subject, err := renderText(t.Subject, data)
+	if err != nil {
+		return Email{}, err
+	}
+	text, err := renderText(t.Text, data)
+	if err != nil {
+		return Email{}, err
+	}
+	html, err := renderHTML(t.HTML, data)
+	if err != nil {
+		return Email{}, err
+	}
+
+	var unsubscribe *ListUnsubscribe
+	if t.UnsubscribeMailto != "" || t.UnsubscribeURL != "" {
+		unsubscribe = &ListUnsubscribe{}
+		if unsubscribe.Mailto, err = renderText(t.UnsubscribeMailto, data); err != nil {
+			return Email{}, err
+		}
+		if unsubscribe.URL, err = renderText(t.UnsubscribeURL, data); err != nil {
+			return Email{}, err
+		}
+	}
+
+	return Email{
+		From:        t.From,
+		To:          []mail.Address{rcpt.Address},
+		Subject:     subject,
+		Body:        html,
+		TextBody:    text,
+		Attachments: t.Attachments,
+		Headers:     t.Headers,
+
+		ListUnsubscribe: unsubscribe,
+	}, nil
+}
+
+// one message per recipient, stopping at the first that fails to render
+func (t TemplatedEmail) RenderAll(rcpts []TemplateRecipient) ([]Email, error) {
+	emails := make([]Email, 0, len(rcpts))
+	for _, rcpt := range rcpts {
+		email, err := t.Render(rcpt)
+		if err != nil {
+			return nil, err
+		}
+		emails = append(emails, email)
+	}
+	return emails, nil
+}
+
+// parsed templates by source, shared by all TemplatedEmails so a campaign
+// parses each template once
+var templateCache = struct {
+	sync.Mutex
+	text map[string]*texttemplate.Template
+	html map[string]*htmltemplate.Template
+}{
+	text: map[string]*texttemplate.Template{},
+	html: map[string]*htmltemplate.Template{},
+}
+
+func renderText(source string, data any) (string, error) {
+	if source == "" {
+		return "", nil
+	}
+	templateCache.Lock()
+	tmpl, ok := templateCache.text[source]
+	if !ok {
+		var err error
+		tmpl, err = texttemplate.New("").Option("missingkey=error").Parse(source)
+		if err != nil {
+			templateCache.Unlock()
+			return "", err
+		}
+		templateCache.text[source] = tmpl
+	}
+	templateCache.Unlock()
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+func renderHTML(source string, data any) (string, error) {
+	if source == "" {
+		return "", nil
+	}
+	templateCache.Lock()
+	tmpl, ok := templateCache.html[source]
+	if !ok {
+		var err error
+		tmpl, err = htmltemplate.New("").Option("missingkey=error").Parse(source)
+		if err != nil {
+			templateCache.Unlock()
+			return "", err
+		}
+		templateCache.html[source] = tmpl
+	}
+	templateCache.Unlock()
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// TLS settings for the connection to the SMTP server
+type TLSOptions struct {
+	MinVersion   uint16            // eg. tls.VersionTLS13, default TLS 1.2
+	RootCAs      *x509.CertPool    // trusted CAs, default the system pool
+	Certificates []tls.Certificate // client certificates for servers that ask for one
+
+	// skip certificate verification, only ever for lab servers with
+	// self-signed certificates
+	InsecureSkipVerify bool
+}
+
+// options beyond the defaults, which smtp.SendMail can't apply
+func (o TLSOptions) custom() bool {
+	return o.MinVersion != 0 || o.RootCAs != nil || len(o.Certificates) > 0 || o.InsecureSkipVerify
+}
+
+func (c SMTPConfig) tlsConfig() *tls.Config {
+	config := &tls.Config{
+		ServerName:         c.Host,
+		MinVersion:         tls.VersionTLS12,
+		RootCAs:            c.TLS.RootCAs,
+		Certificates:       c.TLS.Certificates,
+		InsecureSkipVerify: c.TLS.InsecureSkipVerify,
+	}
+	if c.TLS.MinVersion != 0 {
+		config.MinVersion = c.TLS.MinVersion
+	}
+	return config
+}
+
+// pool with the PEM certificates from file, eg. a private CA
+func LoadRootCAs(file string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA file: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, errors.New("no certificates found in CA file")
+	}
+	return pool, nil
+}
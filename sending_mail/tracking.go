@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"html"
+	"log"
+	"maps"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Tracker reports when the html body of an email is opened and its links
+// are clicked: Instrument adds a one pixel image and points the links at
+// Handler, which records the event and serves the pixel or redirects to
+// the link. Images are often blocked or fetched by a proxy ahead of the
+// reader, so an open is a hint, not proof, and many readers object to
+// being tracked; a read receipt, see Email.ReadReceipt, is the polite way
+// to ask.
+type Tracker struct {
+	BaseURL string // where Handler is served, eg. https://t.example.com/track/
+	Secret  []byte // signs the links, so Handler redirects only to links it made; required
+
+	// called for every event, concurrently from the requests that come
+	// in; default logging it
+	Record func(TrackingEvent)
+}
+
+type TrackingEvent struct {
+	Type       string // "open" or "click"
+	ID         string // of the email, see Instrument
+	URL        string // the link clicked
+	Time       time.Time
+	RemoteAddr string
+	UserAgent  string
+}
+
+// the <a href> of an html body
+var trackedLink = regexp.MustCompile(`(?is)(<a\b[^>]*?\shref\s*=\s*)("[^"]*"|'[^']*')`)
+
+// a 1x1 transparent GIF
+var trackingPixel = []byte("GIF89a\x01\x00\x01\x00\x80\x00\x00\x00\x00\x00\xff\xff\xff!\xf9\x04\x01\x00\x00\x00\x00,\x00\x00\x00\x00\x01\x00\x01\x00\x00\x02\x02D\x01\x00;")
+
+// the html with its http and https links going through the tracker and a
+// tracking pixel at the end of the body; id names the email in the events
+func (t Tracker) Instrument(body, id string) string {
+	body = trackedLink.ReplaceAllStringFunc(body, func(match string) string {
+		m := trackedLink.FindStringSubmatch(match)
+		link := html.UnescapeString(m[2][1 : len(m[2])-1])
+		lower := strings.ToLower(strings.TrimSpace(link))
+		if !strings.HasPrefix(lower, "http://") && !strings.HasPrefix(lower, "https://") || strings.HasPrefix(link, t.BaseURL) {
+			return match
+		}
+		return m[1] + `"` + html.EscapeString(t.url("click", id, strings.TrimSpace(link))) + `"`
+	})
+
+	pixel := `<img src="` + html.EscapeString(t.url("open", id, "")) + `" width="1" height="1" alt="" style="border:0">`
+	if end := strings.LastIndex(strings.ToLower(body), "</body>"); end >= 0 {
+		return body[:end] + pixel + body[end:]
+	}
+	return body + pixel
+}
+
+// a Middleware instrumenting the html body of every email, with its
+// Message-ID, generated here if there is none, as the ID. To tell the
+// recipients of an email apart send them a copy each, as Campaign does.
+func (t Tracker) Wrap(sender EmailSender) EmailSender {
+	return HookedSender{Sender: sender, BeforeSend: func(_ context.Context, _ SMTPConfig, email *Email) error {
+		if email.Body == "" {
+			return nil
+		}
+		var id string
+		for key, value := range email.Headers {
+			if strings.EqualFold(key, "Message-ID") {
+				id = value
+			}
+		}
+		if id == "" {
+			id = newMessageID(email.From.Address)
+			headers := maps.Clone(email.Headers)
+			if headers == nil {
+				headers = map[string]string{}
+			}
+			headers["Message-ID"] = id
+			email.Headers = headers
+		}
+		email.Body = t.Instrument(email.Body, id)
+		return nil
+	}}
+}
+
+// BaseURL/kind with the id, the link and their signature
+func (t Tracker) url(kind, id, link string) string {
+	query := url.Values{"id": {id}}
+	if link != "" {
+		query.Set("url", link)
+	}
+	query.Set("sig", t.sign(kind, id, link))
+	return strings.TrimSuffix(t.BaseURL, "/") + "/" + kind + "?" + query.Encode()
+}
+
+func (t Tracker) sign(kind, id, link string) string {
+	mac := hmac.New(sha256.New, t.Secret)
+	mac.Write([]byte(kind + "\x00" + id + "\x00" + link))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// the handler of BaseURL/open and BaseURL/click
+func (t Tracker) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(t.Secret) == 0 {
+			http.Error(w, "tracker has no secret", http.StatusInternalServerError)
+			return
+		}
+		kind := r.URL.Path[strings.LastIndexByte(r.URL.Path, '/')+1:]
+		query := r.URL.Query()
+		id, link := query.Get("id"), query.Get("url")
+		valid := hmac.Equal([]byte(query.Get("sig")), []byte(t.sign(kind, id, link)))
+
+		switch {
+		case kind == "open":
+			w.Header().Set("Content-Type", "image/gif")
+			w.Header().Set("Cache-Control", "no-store, private")
+			w.Write(trackingPixel)
+		case kind == "click" && valid:
+			http.Redirect(w, r, link, http.StatusFound)
+		default:
+			// a link of someone else's making, no open redirect
+			http.NotFound(w, r)
+			return
+		}
+		if !valid {
+			return
+		}
+
+		event := TrackingEvent{
+			Type:       kind,
+			ID:         id,
+			URL:        link,
+			Time:       time.Now(),
+			RemoteAddr: r.RemoteAddr,
+			UserAgent:  r.UserAgent(),
+		}
+		if t.Record != nil {
+			t.Record(event)
+			return
+		}
+		log.Printf("tracking: %s of %s %s from %s", event.Type, event.ID, event.URL, event.RemoteAddr)
+	})
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TranscriptLogger gets the SMTP dialogue of every connection opened with
+// SMTPConfig.Transcript set, one line at a time: "C: " and what the client
+// sent, or "S: " and a reply line of the server. Credentials are redacted
+// and message data shows up as its size only. conn names the connection,
+// the server address and a sequence number, to tell apart the lines of
+// concurrent connections.
+type TranscriptLogger interface {
+	LogSMTP(conn, line string)
+}
+
+// a func as TranscriptLogger, eg. one calling log.Printf
+type TranscriptFunc func(conn, line string)
+
+func (f TranscriptFunc) LogSMTP(conn, line string) {
+	f(conn, line)
+}
+
+// a TranscriptLogger writing time-stamped lines to w, eg. os.Stderr
+func TranscriptWriter(w io.Writer) TranscriptLogger {
+	return &transcriptWriter{w: w}
+}
+
+type transcriptWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (t *transcriptWriter) LogSMTP(conn, line string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	fmt.Fprintf(t.w, "%s %s %s\n", time.Now().Format("15:04:05.000"), conn, line)
+}
+
+var transcriptSeq atomic.Int64
+
+// logs the lines going through it. net/smtp never shows the dialogue, so
+// the logging happens beneath the smtp.Client, on its connection.
+type transcriptConn struct {
+	net.Conn
+	logger TranscriptLogger
+	name   string
+	secure bool // TLS beneath, see startTLS
+
+	greeting []byte // read by a new smtp.Client after STARTTLS, not logged
+	in, out  []byte // partial lines
+
+	challenge bool  // the next client line answers a 334 and is redacted
+	data      bool  // between the 354 reply and the final dot
+	chunk     int64 // BDAT data still to come
+	size      int64 // message data sent
+}
+
+func newTranscriptConn(conn net.Conn, logger TranscriptLogger, addr string) *transcriptConn {
+	return &transcriptConn{
+		Conn:   conn,
+		logger: logger,
+		name:   fmt.Sprintf("%s#%d", addr, transcriptSeq.Add(1)),
+	}
+}
+
+func (c *transcriptConn) Read(p []byte) (int, error) {
+	if len(c.greeting) > 0 {
+		n := copy(p, c.greeting)
+		c.greeting = c.greeting[n:]
+		return n, nil
+	}
+	n, err := c.Conn.Read(p)
+	c.in = append(c.in, p[:n]...)
+	for {
+		i := bytes.IndexByte(c.in, '\n')
+		if i < 0 {
+			break
+		}
+		c.serverLine(strings.TrimSuffix(string(c.in[:i]), "\r"))
+		c.in = c.in[i+1:]
+	}
+	return n, err
+}
+
+func (c *transcriptConn) Write(p []byte) (int, error) {
+	for rest := p; len(rest) > 0; {
+		if c.chunk > 0 {
+			n := min(int64(len(rest)), c.chunk)
+			c.chunk -= n
+			c.size += n
+			rest = rest[n:]
+			if c.chunk == 0 {
+				c.logger.LogSMTP(c.name, fmt.Sprintf("C: [%d bytes of message data]", c.size))
+			}
+			continue
+		}
+		i := bytes.IndexByte(rest, '\n')
+		if i < 0 {
+			c.out = append(c.out, rest...)
+			break
+		}
+		c.out = append(c.out, rest[:i]...)
+		c.clientLine(strings.TrimSuffix(string(c.out), "\r"))
+		c.out = c.out[:0]
+		rest = rest[i+1:]
+	}
+	return c.Conn.Write(p)
+}
+
+func (c *transcriptConn) serverLine(line string) {
+	c.logger.LogSMTP(c.name, "S: "+line)
+	if len(line) > 3 && line[3] == '-' {
+		return // more lines of the reply to come
+	}
+	switch {
+	case strings.HasPrefix(line, "334"):
+		c.challenge = true
+	case strings.HasPrefix(line, "354"):
+		c.data = true
+		c.size = 0
+	}
+}
+
+func (c *transcriptConn) clientLine(line string) {
+	fields := strings.Fields(line)
+	command := ""
+	if len(fields) > 0 {
+		command = strings.ToUpper(fields[0])
+	}
+	switch {
+	case c.data:
+		if line != "." {
+			c.size += int64(len(line)) + 2
+			return
+		}
+		c.data = false
+		c.logger.LogSMTP(c.name, fmt.Sprintf("C: [%d bytes of message data]", c.size))
+	case c.challenge:
+		// a username, password, token or the response to CRAM-MD5
+		c.challenge = false
+		if line != "*" {
+			line = "[redacted]"
+		}
+	case command == "AUTH" && len(fields) > 2:
+		line = fields[0] + " " + fields[1] + " [redacted]"
+	case command == "BDAT" && len(fields) > 1:
+		c.chunk, _ = strconv.ParseInt(fields[1], 10, 64)
+		c.size = 0
+	}
+	c.logger.LogSMTP(c.name, "C: "+line)
+}
+
+// STARTTLS. net/smtp would put TLS on top of the transcriptConn, which then
+// only saw ciphertext. With a transcript the handshake happens beneath it
+// instead, and a new smtp.Client continues on the encrypted connection.
+func (c *smtpClient) startTLS(config *tls.Config) error {
+	if c.transcript == nil {
+		return c.StartTLS(config)
+	}
+	c.Extension("STARTTLS") // EHLO first, like smtp.Client.StartTLS
+	if err := c.cmd(220, "STARTTLS"); err != nil {
+		return err
+	}
+	tlsConn := tls.Client(c.transcript.Conn, config)
+	if err := tlsConn.Handshake(); err != nil {
+		return err
+	}
+	c.transcript.Conn = tlsConn
+	c.transcript.secure = true
+
+	// a new smtp.Client reads a greeting first
+	c.transcript.greeting = []byte("220 " + config.ServerName + "\r\n")
+	client, err := smtp.NewClient(c.transcript, config.ServerName)
+	if err != nil {
+		return err
+	}
+	if c.helo != "" {
+		if err := client.Hello(c.helo); err != nil {
+			return err
+		}
+	}
+	c.Client = client
+	return nil
+}
+
+// an smtp.Client on a transcriptConn doesn't know about the TLS beneath it
+// and would refuse the password mechanisms
+type secureAuth struct {
+	smtp.Auth
+}
+
+func (a secureAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	info := *server
+	info.TLS = true
+	return a.Auth.Start(&info)
+}
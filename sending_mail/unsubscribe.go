@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// RFC 2369 List-Unsubscribe, and RFC 8058 one-click unsubscribe when URL is
+// set. Large mailbox providers require both from bulk senders; DKIM signs
+// the headers by default, which one-click needs.
+type ListUnsubscribe struct {
+	Mailto string // address that unsubscribes on receiving any mail
+	URL    string // https URL that unsubscribes on a POST
+}
+
+// the List-Unsubscribe value, empty without any method
+func (u *ListUnsubscribe) header() string {
+	if u == nil {
+		return ""
+	}
+	var methods []string
+	if u.Mailto != "" {
+		methods = append(methods, "<mailto:"+u.Mailto+"?subject=unsubscribe>")
+	}
+	if u.URL != "" {
+		methods = append(methods, "<"+u.URL+">")
+	}
+	return strings.Join(methods, ", ")
+}
+
+// the List-Unsubscribe-Post value, only with an https URL to post to
+func (u *ListUnsubscribe) postHeader() string {
+	if u == nil || u.URL == "" {
+		return ""
+	}
+	return "List-Unsubscribe=One-Click"
+}
+
+func (u *ListUnsubscribe) validate() error {
+	if u == nil {
+		return nil
+	}
+	if err := checkHeaderValue("List-Unsubscribe", u.Mailto+u.URL); err != nil {
+		return err
+	}
+	if strings.ContainsAny(u.Mailto, "<>?, ") {
+		return fmt.Errorf("List-Unsubscribe: invalid mailto address %q", u.Mailto)
+	}
+	if u.URL != "" {
+		parsed, err := url.Parse(u.URL)
+		if err != nil {
+			return fmt.Errorf("List-Unsubscribe: %w", err)
+		}
+		// RFC 8058 3.1: one-click only over https
+		if parsed.Scheme != "https" || parsed.Host == "" || strings.ContainsAny(u.URL, "<>, ") {
+			return fmt.Errorf("List-Unsubscribe: %q is not an https URL", u.URL)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"net/mail"
+	"strings"
+)
+
+// a header value or address that would end its line and start a new header
+// field, eg. a Subject of "hi\r\nBcc: someone@example.com"
+var ErrHeaderInjection = errors.New("line break in header field")
+
+// reject anything that could smuggle header fields into the message. The
+// senders call this before building the message, the builders themselves
+// write values as given.
+func (e Email) Validate() error {
+	addrs := map[string][]mail.Address{
+		"From": {e.From},
+		"To":   e.To,
+		"Cc":   e.Cc,
+		"Bcc":  e.Bcc,
+	}
+	if e.ReadReceipt != nil {
+		addrs["Disposition-Notification-To"] = []mail.Address{*e.ReadReceipt}
+	}
+	for field, list := range addrs {
+		for _, addr := range list {
+			if err := checkHeaderValue(field, addr.Name); err != nil {
+				return err
+			}
+			if err := checkHeaderValue(field, addr.Address); err != nil {
+				return err
+			}
+			if strings.ContainsAny(addr.Address, "<>") {
+				return fmt.Errorf("%s: invalid address %q", field, addr.Address)
+			}
+			if err := checkUnicodeAddress(addr.Address); err != nil {
+				return fmt.Errorf("%s: %w", field, err)
+			}
+		}
+	}
+
+	if err := checkHeaderValue("EnvelopeFrom", e.EnvelopeFrom); err != nil {
+		return err
+	}
+	if strings.ContainsAny(e.EnvelopeFrom, "<> ") {
+		return fmt.Errorf("EnvelopeFrom: invalid address %q", e.EnvelopeFrom)
+	}
+	if err := checkUnicodeAddress(e.EnvelopeFrom); err != nil {
+		return fmt.Errorf("EnvelopeFrom: %w", err)
+	}
+	if err := checkHeaderValue("Subject", e.Subject); err != nil {
+		return err
+	}
+	if err := e.Priority.validate(); err != nil {
+		return err
+	}
+	if err := e.Sensitivity.validate(); err != nil {
+		return err
+	}
+	if err := e.DSN.validate(); err != nil {
+		return err
+	}
+	if err := e.ListUnsubscribe.validate(); err != nil {
+		return err
+	}
+	if err := e.SMIME.validate(); err != nil {
+		return err
+	}
+	if err := e.PGP.validate(); err != nil {
+		return err
+	}
+	if err := e.Invite.validate(); err != nil {
+		return err
+	}
+	if e.SMIME != nil && e.PGP != nil {
+		return errors.New("both S/MIME and PGP requested")
+	}
+	for name, value := range e.Headers {
+		if !validFieldName(name) {
+			return fmt.Errorf("invalid header field name %q", name)
+		}
+		if err := checkHeaderValue(name, value); err != nil {
+			return err
+		}
+	}
+
+	for _, att := range e.Attachments {
+		for field, value := range map[string]string{
+			"attachment filename":     att.Filename,
+			"attachment content type": att.ContentType,
+			"attachment content ID":   att.ContentID,
+			"attachment charset":      att.Charset,
+		} {
+			if err := checkHeaderValue(field, value); err != nil {
+				return err
+			}
+		}
+		if _, _, err := mime.ParseMediaType(att.ContentType); att.ContentType != "" && err != nil {
+			return fmt.Errorf("attachment %s: invalid content type %q: %w", att.Filename, att.ContentType, err)
+		}
+		if att.Charset != "" {
+			mediaType, _, _ := mime.ParseMediaType(att.contentType())
+			if !strings.HasPrefix(mediaType, "text/") {
+				return fmt.Errorf("attachment %s: charset %q for %s, which isn't text", att.Filename, att.Charset, mediaType)
+			}
+			if strings.ContainsAny(att.Charset, " \t\"();,:/=<>?@[]\\") {
+				return fmt.Errorf("attachment %s: invalid charset %q", att.Filename, att.Charset)
+			}
+		}
+		if strings.ContainsAny(att.ContentID, "<> ") {
+			return fmt.Errorf("attachment %s: invalid content ID %q", att.Filename, att.ContentID)
+		}
+	}
+	return nil
+}
+
+func checkHeaderValue(field, value string) error {
+	if strings.ContainsAny(value, "\r\n\x00") {
+		return fmt.Errorf("%s: %w", field, ErrHeaderInjection)
+	}
+	return nil
+}
+
+// printable ASCII except the colon (RFC 5322 2.2)
+func validFieldName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if name[i] < 33 || name[i] > 126 || name[i] == ':' {
+			return false
+		}
+	}
+	return true
+}
+
+// every line ending as CRLF. Bare CR or LF in the body could otherwise be
+// read as the end of DATA by a lenient server (SMTP smuggling); the DATA
+// writer from net/smtp dot-stuffs lines starting with "." on top of this.
+func canonicalLines(text string) string {
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	text = strings.ReplaceAll(text, "\r", "\n")
+	return strings.ReplaceAll(text, "\n", "\r\n")
+}
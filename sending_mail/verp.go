@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// VERP (variable envelope return path) bounce address for one recipient:
+// bounce@example.com and user@example.net give
+// bounce+user=example.net@example.com, so a bounce arriving there names
+// the failed recipient even when its content doesn't
+func VERPAddress(bounce, rcpt string) (string, error) {
+	local, domain, ok := strings.Cut(bounce, "@")
+	if !ok || strings.Contains(domain, "@") {
+		return "", fmt.Errorf("invalid bounce address %q", bounce)
+	}
+	at := strings.LastIndex(rcpt, "@")
+	if at <= 0 || at == len(rcpt)-1 {
+		return "", fmt.Errorf("invalid recipient address %q", rcpt)
+	}
+	return local + "+" + rcpt[:at] + "=" + rcpt[at+1:] + "@" + domain, nil
+}
+
+// the recipient encoded in a VERP address made from bounce, the address a
+// bounce was delivered to
+func ParseVERP(bounce, addr string) (string, bool) {
+	local, domain, ok := strings.Cut(bounce, "@")
+	if !ok {
+		return "", false
+	}
+	at := strings.LastIndex(addr, "@")
+	if at < 0 || !strings.EqualFold(addr[at+1:], domain) {
+		return "", false
+	}
+	encoded, ok := strings.CutPrefix(addr[:at], local+"+")
+	if !ok {
+		return "", false
+	}
+	eq := strings.LastIndex(encoded, "=")
+	if eq <= 0 || eq == len(encoded)-1 {
+		return "", false
+	}
+	return encoded[:eq] + "@" + encoded[eq+1:], true
+}
+
+// one message per envelope recipient, each with its own VERP EnvelopeFrom;
+// the headers still show every To and Cc address
+func SplitVERP(email Email, bounce string) ([]Email, error) {
+	var emails []Email
+	seen := map[string]bool{}
+	for _, rcpt := range email.Recipients() {
+		if seen[rcpt] {
+			continue
+		}
+		seen[rcpt] = true
+		from, err := VERPAddress(bounce, rcpt)
+		if err != nil {
+			return nil, err
+		}
+		single := email.onlyTo([]string{rcpt})
+		single.EnvelopeFrom = from
+		emails = append(emails, single)
+	}
+	return emails, nil
+}
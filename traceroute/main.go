@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/netip"
+	"os"
+	"strings"
+	"time"
+
+	"internet_services/dns_lookup/resolver"
+)
+
+func main() {
+	mode := flag.String("mode", probeUDP, "probe with udp, icmp (echo) or tcp (SYN)")
+	port := flag.Int("port", 0, "destination port: the first one for udp (default 33434), the one to SYN for tcp (default 80)")
+	maxHops := flag.Int("max-hops", 30, "give up after this many hops")
+	queries := flag.Int("queries", 3, "probes per hop")
+	wait := flag.Duration("wait", 2*time.Second, "how long to wait for each probe's reply")
+	noResolve := flag.Bool("n", false, "print hop addresses without looking up their names")
+	server := flag.String("server", "", "recursive DNS server for the name lookups (default: iterate from the root servers)")
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		fmt.Println("usage: traceroute [flags] host")
+		os.Exit(2)
+	}
+	switch *mode {
+	case probeUDP, probeICMP, probeTCP:
+	default:
+		fmt.Printf("Error: unknown probe mode %q (want udp, icmp or tcp)\n", *mode)
+		os.Exit(2)
+	}
+	if *port == 0 {
+		*port = tracerouteBasePort
+		if *mode == probeTCP {
+			*port = 80
+		}
+	}
+
+	dns := resolver.New()
+	dns.Server = *server
+	dst, err := resolveIPv4(dns, flag.Arg(0))
+	if err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+	t, err := newTracer(*mode, dst, *port, *wait)
+	if err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+	defer t.close()
+
+	fmt.Printf("traceroute to %s (%s), %d hops max, %s probes\n", flag.Arg(0), dst, *maxHops, *mode)
+	names := map[netip.Addr]string{}
+	for ttl := 1; ttl <= *maxHops; ttl++ {
+		hop := t.hop(ttl, *queries)
+		fmt.Printf("%2d  %s\n", ttl, hop.format(func(addr netip.Addr) string {
+			if *noResolve {
+				return addr.String()
+			}
+			name, ok := names[addr]
+			if !ok {
+				name = reverseName(dns, addr)
+				names[addr] = name
+			}
+			if name == "" {
+				return addr.String()
+			}
+			return fmt.Sprintf("%s (%s)", name, addr)
+		}))
+		if hop.done {
+			return
+		}
+	}
+}
+
+// the IPv4 address of host
+func resolveIPv4(dns *resolver.Client, host string) (netip.Addr, error) {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		if !addr.Is4() {
+			return netip.Addr{}, errors.New("only IPv4 destinations are supported")
+		}
+		return addr, nil
+	}
+	addrs, err := dns.LookupNetIP(context.Background(), "ip4", host)
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("failed to resolve %s: %w", host, err)
+	}
+	return addrs[0], nil
+}
+
+// the PTR name of addr, "" if it has none or the lookup failed
+func reverseName(dns *resolver.Client, addr netip.Addr) string {
+	names, err := dns.LookupAddr(context.Background(), addr.String())
+	if err != nil || len(names) == 0 {
+		return ""
+	}
+	return strings.TrimSuffix(names[0], ".")
+}
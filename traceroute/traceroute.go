@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+// probe modes
+const (
+	probeUDP  = "udp"  // datagrams to unlikely ports, answered by port unreachable
+	probeICMP = "icmp" // echo requests, answered by echo replies
+	probeTCP  = "tcp"  // SYNs to an open port, answered by SYN-ACK or RST
+)
+
+// the first destination port of udp probes, each probe takes the next one
+const tracerouteBasePort = 33434
+
+// what came back for a probe
+type probeResult struct {
+	from    netip.Addr
+	rtt     time.Duration
+	timeout bool
+	reached bool   // the destination itself answered
+	mark    string // why it is unreachable, eg. !H, "" when it isn't
+}
+
+// the probes of one TTL
+type hopResult struct {
+	probes []probeResult
+	done   bool // the destination answered or said it can't be reached
+}
+
+// the responders in order, their times, and min/avg/max/stddev and loss
+func (h hopResult) format(name func(netip.Addr) string) string {
+	var parts []string
+	var last netip.Addr
+	var rtts []float64
+	for _, p := range h.probes {
+		if p.timeout {
+			parts = append(parts, "*")
+			continue
+		}
+		if p.from != last {
+			parts = append(parts, name(p.from))
+			last = p.from
+		}
+		ms := float64(p.rtt.Microseconds()) / 1000
+		rtts = append(rtts, ms)
+		parts = append(parts, fmt.Sprintf("%.3f ms", ms)+p.mark)
+	}
+	line := strings.Join(parts, "  ")
+	if len(rtts) == 0 {
+		return line
+	}
+	minRTT, maxRTT, sum := rtts[0], rtts[0], 0.0
+	for _, rtt := range rtts {
+		minRTT, maxRTT, sum = math.Min(minRTT, rtt), math.Max(maxRTT, rtt), sum+rtt
+	}
+	avg := sum / float64(len(rtts))
+	variance := 0.0
+	for _, rtt := range rtts {
+		variance += (rtt - avg) * (rtt - avg)
+	}
+	stddev := math.Sqrt(variance / float64(len(rtts)))
+	loss := 100 * (len(h.probes) - len(rtts)) / len(h.probes)
+	return fmt.Sprintf("%s   [min/avg/max/sd %.3f/%.3f/%.3f/%.3f ms, %d%% loss]", line, minRTT, avg, maxRTT, stddev, loss)
+}
+
+// an ICMP error or echo reply, with the key of the probe it answers
+type icmpReply struct {
+	key     uint32
+	from    netip.Addr
+	at      time.Time
+	reached bool
+	mark    string
+}
+
+// sends probes one at a time and matches the ICMP that comes back. Each
+// probe has a key found again in the reply: the udp destination port, the
+// echo sequence, or the local port of the tcp connection attempt.
+type tracer struct {
+	mode string
+	dst  netip.Addr
+	port int
+	wait time.Duration
+
+	icmp    *icmp.PacketConn
+	udp     *ipv4.PacketConn // udp mode
+	echoID  int              // icmp mode
+	seq     int              // probes sent
+	replies chan icmpReply
+}
+
+func newTracer(mode string, dst netip.Addr, port int, wait time.Duration) (*tracer, error) {
+	conn, err := icmp.ListenPacket("ip4:icmp", "0.0.0.0")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open a raw ICMP socket, traceroute needs root or CAP_NET_RAW: %w", err)
+	}
+	t := &tracer{mode: mode, dst: dst, port: port, wait: wait, icmp: conn,
+		echoID: os.Getpid() & 0xffff, replies: make(chan icmpReply, 16)}
+	if mode == probeUDP {
+		udp, err := net.ListenPacket("udp4", ":0")
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		t.udp = ipv4.NewPacketConn(udp)
+	}
+	go t.read()
+	return t, nil
+}
+
+func (t *tracer) close() {
+	t.icmp.Close()
+	if t.udp != nil {
+		t.udp.Close()
+	}
+}
+
+// the ICMP messages that are about our probes, to t.replies
+func (t *tracer) read() {
+	buf := make([]byte, 1500)
+	for {
+		n, peer, err := t.icmp.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		at := time.Now()
+		msg, err := icmp.ParseMessage(1, buf[:n])
+		if err != nil {
+			continue
+		}
+		from, _ := netip.AddrFromSlice(peer.(*net.IPAddr).IP)
+		reply := icmpReply{from: from.Unmap(), at: at}
+		switch body := msg.Body.(type) {
+		case *icmp.Echo:
+			if msg.Type != ipv4.ICMPTypeEchoReply || t.mode != probeICMP || body.ID != t.echoID {
+				continue
+			}
+			reply.key, reply.reached = uint32(body.Seq), true
+		case *icmp.TimeExceeded:
+			key, ok := t.quotedKey(body.Data)
+			if !ok {
+				continue
+			}
+			reply.key = key
+		case *icmp.DstUnreach:
+			key, ok := t.quotedKey(body.Data)
+			if !ok {
+				continue
+			}
+			reply.key, reply.reached, reply.mark = key, reply.from == t.dst, unreachableMark(msg.Code)
+			if t.mode == probeUDP && msg.Code == 3 {
+				// port unreachable: the destination got the datagram
+				reply.mark = ""
+			}
+		default:
+			continue
+		}
+		t.replies <- reply
+	}
+}
+
+// the key of the probe an ICMP error quotes: its IP header and the first 8
+// bytes of its payload; false if it isn't one of ours
+func (t *tracer) quotedKey(data []byte) (uint32, bool) {
+	if len(data) < 20 {
+		return 0, false
+	}
+	ihl := int(data[0]&0x0f) * 4
+	if len(data) < ihl+8 || netip.AddrFrom4([4]byte(data[16:20])) != t.dst {
+		return 0, false
+	}
+	proto, payload := data[9], data[ihl:]
+	switch t.mode {
+	case probeUDP:
+		if proto == 17 {
+			return uint32(binary.BigEndian.Uint16(payload[2:4])), true
+		}
+	case probeICMP:
+		if proto == 1 && payload[0] == 8 && int(binary.BigEndian.Uint16(payload[4:6])) == t.echoID {
+			return uint32(binary.BigEndian.Uint16(payload[6:8])), true
+		}
+	case probeTCP:
+		if proto == 6 {
+			return uint32(binary.BigEndian.Uint16(payload[0:2])), true
+		}
+	}
+	return 0, false
+}
+
+// the traceroute(8) marks of the destination unreachable codes
+func unreachableMark(code int) string {
+	switch code {
+	case 0:
+		return " !N"
+	case 1:
+		return " !H"
+	case 2:
+		return " !P"
+	case 4:
+		return " !F"
+	case 9, 10, 13:
+		return " !X"
+	}
+	return fmt.Sprintf(" !<%d>", code)
+}
+
+// probes of one TTL, one after the other
+func (t *tracer) hop(ttl, queries int) hopResult {
+	var hop hopResult
+	for range queries {
+		p := t.probe(ttl)
+		hop.probes = append(hop.probes, p)
+		if p.reached || p.mark != "" {
+			hop.done = true
+		}
+	}
+	return hop
+}
+
+func (t *tracer) probe(ttl int) probeResult {
+	t.seq++
+	deadline := time.Now().Add(t.wait)
+	var key uint32
+	var sent time.Time
+	var err error
+	switch t.mode {
+	case probeUDP:
+		port := t.port + t.seq - 1
+		key, sent = uint32(port&0xffff), time.Now()
+		if err = t.udp.SetTTL(ttl); err == nil {
+			_, err = t.udp.WriteTo([]byte("traceroute"), nil, &net.UDPAddr{IP: t.dst.AsSlice(), Port: port})
+		}
+	case probeICMP:
+		key = uint32(t.seq & 0xffff)
+		msg := icmp.Message{Type: ipv4.ICMPTypeEcho, Body: &icmp.Echo{ID: t.echoID, Seq: int(key), Data: []byte("traceroute")}}
+		var b []byte
+		if b, err = msg.Marshal(nil); err == nil {
+			if err = t.icmp.IPv4PacketConn().SetTTL(ttl); err == nil {
+				sent = time.Now()
+				_, err = t.icmp.WriteTo(b, &net.IPAddr{IP: t.dst.AsSlice()})
+			}
+		}
+	case probeTCP:
+		key, sent, err = t.syn(ttl, deadline)
+	}
+	if err != nil {
+		return probeResult{timeout: true}
+	}
+
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	for {
+		select {
+		case reply := <-t.replies:
+			// late replies to earlier probes are dropped
+			if reply.key != key || reply.at.Before(sent) {
+				continue
+			}
+			return probeResult{from: reply.from, rtt: reply.at.Sub(sent), reached: reply.reached, mark: reply.mark}
+		case <-timer.C:
+			return probeResult{timeout: true}
+		}
+	}
+}
+
+// a tcp connection attempt with ttl, its SYN quoted in a time exceeded
+// reply by its local port; the destination's SYN-ACK or RST comes to
+// t.replies as if it were ICMP
+func (t *tracer) syn(ttl int, deadline time.Time) (uint32, time.Time, error) {
+	bound := make(chan int, 1)
+	dialer := net.Dialer{Control: func(network, address string, c syscall.RawConn) error {
+		var port int
+		var err error
+		c.Control(func(fd uintptr) {
+			port, err = bindWithTTL(fd, ttl)
+		})
+		if err == nil {
+			bound <- port
+		}
+		return err
+	}}
+	done := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithDeadline(context.Background(), deadline)
+		defer cancel()
+		conn, err := dialer.DialContext(ctx, "tcp4", netip.AddrPortFrom(t.dst, uint16(t.port)).String())
+		at := time.Now()
+		if conn != nil {
+			conn.Close()
+		}
+		done <- err
+		// a RST is an answer of the destination as well as a SYN-ACK
+		if err == nil || errors.Is(err, syscall.ECONNREFUSED) {
+			t.replies <- icmpReply{key: uint32(<-bound), from: t.dst, at: at, reached: true}
+		}
+	}()
+
+	// the socket is bound just before the SYN goes out
+	select {
+	case port := <-bound:
+		// for the reply above
+		bound <- port
+		return uint32(port), time.Now(), nil
+	case err := <-done:
+		return 0, time.Time{}, err
+	}
+}
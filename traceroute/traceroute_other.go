@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+import "errors"
+
+func bindWithTTL(fd uintptr, ttl int) (int, error) {
+	return 0, errors.New("tcp probes are not supported on this platform")
+}
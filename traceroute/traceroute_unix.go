@@ -0,0 +1,21 @@
+//go:build unix
+
+package main
+
+import "syscall"
+
+// set the TTL of a tcp socket before it connects, and bind it so that its
+// local port is known
+func bindWithTTL(fd uintptr, ttl int) (int, error) {
+	if err := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TTL, ttl); err != nil {
+		return 0, err
+	}
+	if err := syscall.Bind(int(fd), &syscall.SockaddrInet4{}); err != nil {
+		return 0, err
+	}
+	sa, err := syscall.Getsockname(int(fd))
+	if err != nil {
+		return 0, err
+	}
+	return sa.(*syscall.SockaddrInet4).Port, nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"os/signal"
+	"time"
+)
+
+// the client: stdin a line a message, what comes back on stdout, and a
+// clean close on end of input or interrupt
+func runClient(args []string) {
+	fs := flag.NewFlagSet("client", flag.ExitOnError)
+	name := fs.String("name", "", "chat name, sent as ?name=")
+	pingInterval := fs.Duration("ping", 30*time.Second, "keepalive ping interval; a server silent for two is given up on")
+	timeout := fs.Duration("timeout", 10*time.Second, "for the handshake")
+	verbose := fs.Bool("v", false, "print the round trip time of each keepalive ping")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fmt.Println("usage: websocket client [flags] ws://host:port/path")
+		os.Exit(2)
+	}
+	target := fs.Arg(0)
+	if *name != "" {
+		u, err := url.Parse(target)
+		if err != nil {
+			fmt.Println("Error:", err)
+			os.Exit(2)
+		}
+		query := u.Query()
+		query.Set("name", *name)
+		u.RawQuery = query.Encode()
+		target = u.String()
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	dialCtx, cancel := context.WithTimeout(ctx, *timeout)
+	conn, err := Dial(dialCtx, target, nil)
+	cancel()
+	if err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stderr, "* connected to %s\n", conn.RemoteAddr())
+	if *verbose {
+		conn.OnPong = func(payload []byte) {
+			if sent, ok := pingTime(payload); ok {
+				fmt.Fprintf(os.Stderr, "* pong in %s\n", time.Since(sent).Round(time.Microsecond))
+			}
+		}
+	}
+	conn.KeepAlive(*pingInterval)
+
+	readErr := make(chan error, 1)
+	go func() {
+		for {
+			messageType, data, err := conn.ReadMessage()
+			if err != nil {
+				readErr <- err
+				return
+			}
+			if messageType == BinaryMessage {
+				fmt.Printf("[%d bytes binary]\n", len(data))
+				continue
+			}
+			fmt.Println(string(data))
+		}
+	}()
+	inputDone := make(chan error, 1)
+	go func() {
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			if err := conn.WriteMessage(TextMessage, scanner.Bytes()); err != nil {
+				inputDone <- err
+				return
+			}
+		}
+		inputDone <- scanner.Err()
+	}()
+
+	var end error
+	select {
+	case end = <-readErr:
+		// the server closed, or the connection was lost
+	case err := <-inputDone:
+		if err != nil && !errors.Is(err, ErrClosed) && !errors.Is(err, net.ErrClosed) {
+			fmt.Println("Error:", err)
+		}
+		conn.Close(CloseNormal, "")
+		end = <-readErr
+	case <-ctx.Done():
+		conn.Close(CloseGoingAway, "interrupted")
+		end = <-readErr
+	}
+
+	var closeErr *CloseError
+	switch {
+	case errors.As(end, &closeErr):
+		if closeErr.Reason != "" {
+			fmt.Fprintf(os.Stderr, "* closed: %d, %s\n", closeErr.Code, closeErr.Reason)
+		} else {
+			fmt.Fprintf(os.Stderr, "* closed: %d\n", closeErr.Code)
+		}
+		if closeErr.Code != CloseNormal && closeErr.Code != CloseGoingAway {
+			os.Exit(1)
+		}
+	case errors.Is(end, net.ErrClosed):
+		// closed here, the server didn't answer in time, or KeepAlive
+		// gave up on it
+		fmt.Println("Error: closed without the server's close frame")
+		os.Exit(1)
+	default:
+		fmt.Println("Error:", end)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,451 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+// the message types of ReadMessage and WriteMessage
+const (
+	TextMessage   = 0x1
+	BinaryMessage = 0x2
+)
+
+// the other opcodes, RFC 6455 section 5.2
+const (
+	opContinuation = 0x0
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xa
+)
+
+// close codes, RFC 6455 section 7.4.1
+const (
+	CloseNormal          = 1000
+	CloseGoingAway       = 1001
+	CloseProtocolError   = 1002
+	CloseUnsupportedData = 1003
+	CloseNoStatus        = 1005 // a close frame without a code, never sent
+	CloseAbnormal        = 1006 // no close frame at all, never sent
+	CloseInvalidPayload  = 1007
+	ClosePolicyViolation = 1008
+	CloseTooBig          = 1009
+	CloseInternalError   = 1011
+)
+
+// CloseError is the close frame ReadMessage got, the end of the
+// connection
+type CloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	if e.Reason == "" {
+		return fmt.Sprintf("websocket closed with %d", e.Code)
+	}
+	return fmt.Sprintf("websocket closed with %d: %s", e.Code, e.Reason)
+}
+
+var (
+	// ErrProtocol is what ReadMessage fails with when the peer breaks
+	// RFC 6455; the connection is closed with a code saying so
+	ErrProtocol = errors.New("websocket protocol error")
+	// ErrClosed is what writing fails with once a close frame went out
+	ErrClosed = errors.New("websocket closed")
+)
+
+// Conn is a websocket connection, the framing of RFC 6455 over what the
+// handshake, Upgrade or Dial, left. One goroutine may read and any number
+// write: ReadMessage answers pings and close frames itself, so it has to
+// be running for the connection to be kept alive and closed cleanly.
+// Messages go out in one frame each; extensions such as
+// permessage-deflate are never negotiated.
+type Conn struct {
+	MaxMessageSize int64         // default 1 MiB; a larger message closes the connection with 1009
+	WriteTimeout   time.Duration // of a frame, default 10 seconds
+	// called from ReadMessage with the payload of each pong
+	OnPong func(payload []byte)
+
+	conn   net.Conn
+	br     *bufio.Reader
+	client bool // masks what it sends, and expects what it reads unmasked
+
+	writeMu   sync.Mutex
+	closeSent bool
+
+	peerClosed     chan struct{} // closed when the peer's close frame is read
+	peerClosedOnce sync.Once
+	done           chan struct{} // closed with conn
+	doneOnce       sync.Once
+	lastRead       atomic.Int64 // unix nanoseconds of the last frame read
+}
+
+func newConn(conn net.Conn, br *bufio.Reader, client bool) *Conn {
+	c := &Conn{
+		conn:       conn,
+		br:         br,
+		client:     client,
+		peerClosed: make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	c.lastRead.Store(time.Now().UnixNano())
+	return c
+}
+
+// the address of the peer
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// ReadMessage returns the next text or binary message, put together from
+// its fragments. It fails with a *CloseError once the peer closed, having
+// answered the close frame if this side hadn't sent one, with an error
+// wrapping ErrProtocol when the peer broke the protocol, and with the
+// network's error when the connection was lost or closed.
+func (c *Conn) ReadMessage() (int, []byte, error) {
+	maxSize := c.MaxMessageSize
+	if maxSize <= 0 {
+		maxSize = 1 << 20
+	}
+	var (
+		messageType int
+		message     []byte
+	)
+	for {
+		f, err := c.readFrame(maxSize - int64(len(message)))
+		if err != nil {
+			return 0, nil, err
+		}
+		switch f.op {
+		case opPing:
+			// a pong after the close frame would break the protocol
+			if err := c.writeFrame(opPong, f.payload); err != nil && !errors.Is(err, ErrClosed) {
+				return 0, nil, err
+			}
+			continue
+		case opPong:
+			if c.OnPong != nil {
+				c.OnPong(f.payload)
+			}
+			continue
+		case opClose:
+			return 0, nil, c.closeReceived(f.payload)
+		case TextMessage, BinaryMessage:
+			if messageType != 0 {
+				return 0, nil, c.fail(CloseProtocolError, "a new message before the last one's final fragment")
+			}
+			messageType, message = int(f.op), f.payload
+		case opContinuation:
+			if messageType == 0 {
+				return 0, nil, c.fail(CloseProtocolError, "a continuation frame without a message")
+			}
+			message = append(message, f.payload...)
+		default:
+			return 0, nil, c.fail(CloseProtocolError, fmt.Sprintf("reserved opcode %#x", f.op))
+		}
+		if !f.fin {
+			continue
+		}
+		if messageType == TextMessage && !utf8.Valid(message) {
+			return 0, nil, c.fail(CloseInvalidPayload, "text message is not UTF-8")
+		}
+		return messageType, message, nil
+	}
+}
+
+// WriteMessage sends a text or binary message
+func (c *Conn) WriteMessage(messageType int, data []byte) error {
+	if messageType != TextMessage && messageType != BinaryMessage {
+		return fmt.Errorf("invalid message type %d", messageType)
+	}
+	return c.writeFrame(byte(messageType), data)
+}
+
+// Ping sends a ping, up to 125 bytes; the pong it gets back goes to OnPong
+func (c *Conn) Ping(payload []byte) error {
+	if len(payload) > 125 {
+		return fmt.Errorf("ping payload of %d bytes, the most is 125", len(payload))
+	}
+	return c.writeFrame(opPing, payload)
+}
+
+// KeepAlive pings every interval, with the time it was sent, which
+// pingTime reads back from the pong, until the connection is closed. A
+// peer not heard from, pong or otherwise, for two intervals is taken for
+// gone, as one behind a NAT that forgot it may be: the connection is
+// closed, and ReadMessage fails.
+func (c *Conn) KeepAlive(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-c.done:
+				return
+			case <-ticker.C:
+			}
+			if time.Since(time.Unix(0, c.lastRead.Load())) > 2*interval {
+				c.closeConn()
+				return
+			}
+			payload := binary.BigEndian.AppendUint64(nil, uint64(time.Now().UnixNano()))
+			if err := c.Ping(payload); err != nil {
+				return
+			}
+		}
+	}()
+}
+
+// the time a KeepAlive ping was sent, from its pong's payload
+func pingTime(payload []byte) (time.Time, bool) {
+	if len(payload) != 8 {
+		return time.Time{}, false
+	}
+	return time.Unix(0, int64(binary.BigEndian.Uint64(payload))), true
+}
+
+// how long Close waits for the peer's close frame
+const closeTimeout = 5 * time.Second
+
+// Close closes the connection with the closing handshake: a close frame
+// with code and reason, then the peer's close frame awaited, which the
+// ReadMessage running in another goroutine reads, for up to five seconds.
+// The connection is closed in any case.
+func (c *Conn) Close(code int, reason string) error {
+	err := c.writeClose(code, reason)
+	if err == nil {
+		timer := time.NewTimer(closeTimeout)
+		select {
+		case <-c.peerClosed:
+		case <-c.done:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+	c.closeConn()
+	if errors.Is(err, ErrClosed) || errors.Is(err, net.ErrClosed) {
+		// closed already, by the peer or before
+		return nil
+	}
+	return err
+}
+
+func (c *Conn) closeConn() {
+	c.doneOnce.Do(func() {
+		c.conn.Close()
+		close(c.done)
+	})
+}
+
+// the peer's close frame: answered with the same code unless this side
+// started the closing, which then is complete
+func (c *Conn) closeReceived(payload []byte) error {
+	closeErr := &CloseError{Code: CloseNoStatus}
+	switch {
+	case len(payload) == 1:
+		return c.fail(CloseProtocolError, "close frame of one byte")
+	case len(payload) >= 2:
+		closeErr.Code = int(binary.BigEndian.Uint16(payload))
+		closeErr.Reason = string(payload[2:])
+		if !validCloseCode(closeErr.Code) {
+			return c.fail(CloseProtocolError, fmt.Sprintf("invalid close code %d", closeErr.Code))
+		}
+		if !utf8.Valid(payload[2:]) {
+			return c.fail(CloseInvalidPayload, "close reason is not UTF-8")
+		}
+	}
+	c.peerClosedOnce.Do(func() { close(c.peerClosed) })
+
+	if closeErr.Code == CloseNoStatus {
+		// the empty close frame it sent
+		c.writeClose(0, "")
+	} else {
+		c.writeClose(closeErr.Code, "")
+	}
+	if c.client {
+		// the server closes the TCP connection first, so that it's the
+		// one left in TIME_WAIT; a moment for it to do so
+		c.conn.SetReadDeadline(time.Now().Add(time.Second))
+		io.Copy(io.Discard, c.br)
+	}
+	c.closeConn()
+	return closeErr
+}
+
+// the codes a close frame may carry: the defined ones that may be sent,
+// and those for libraries (3000-3999) and applications (4000-4999)
+func validCloseCode(code int) bool {
+	switch {
+	case code >= 1000 && code <= 1003, code >= 1007 && code <= 1011:
+		return true
+	case code >= 3000 && code <= 4999:
+		return true
+	}
+	return false
+}
+
+// the connection failed, RFC 6455 section 7.1.7: a close frame saying why
+// and the connection closed without waiting for an answer
+func (c *Conn) fail(code int, reason string) error {
+	c.writeClose(code, reason)
+	c.closeConn()
+	return fmt.Errorf("%w: %s", ErrProtocol, reason)
+}
+
+// a close frame, code 0 for one without a code; the last frame sent
+func (c *Conn) writeClose(code int, reason string) error {
+	var payload []byte
+	if code != 0 {
+		// the payload of a control frame is at most 125 bytes
+		for len(reason) > 123 {
+			_, size := utf8.DecodeLastRuneInString(reason)
+			reason = reason[:len(reason)-size]
+		}
+		payload = binary.BigEndian.AppendUint16(nil, uint16(code))
+		payload = append(payload, reason...)
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closeSent {
+		return ErrClosed
+	}
+	c.closeSent = true
+	return c.writeFrameLocked(opClose, payload)
+}
+
+func (c *Conn) writeFrame(op byte, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closeSent {
+		return ErrClosed
+	}
+	return c.writeFrameLocked(op, payload)
+}
+
+// a final frame, masked if this is the client, RFC 6455 section 5.2
+func (c *Conn) writeFrameLocked(op byte, payload []byte) error {
+	frame := make([]byte, 0, 14+len(payload))
+	frame = append(frame, 0x80|op)
+	maskBit := byte(0)
+	if c.client {
+		maskBit = 0x80
+	}
+	switch n := len(payload); {
+	case n <= 125:
+		frame = append(frame, maskBit|byte(n))
+	case n <= 0xffff:
+		frame = append(frame, maskBit|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(n))
+	default:
+		frame = append(frame, maskBit|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(n))
+	}
+	if c.client {
+		// a fresh key per frame, so that a proxy can't be fed bytes the
+		// page chose, section 10.3
+		var key [4]byte
+		if _, err := rand.Read(key[:]); err != nil {
+			return err
+		}
+		frame = append(frame, key[:]...)
+		start := len(frame)
+		frame = append(frame, payload...)
+		mask(frame[start:], key)
+	} else {
+		frame = append(frame, payload...)
+	}
+
+	timeout := c.WriteTimeout
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(timeout))
+	if _, err := c.conn.Write(frame); err != nil {
+		// a frame half written leaves the stream unusable
+		c.closeConn()
+		return err
+	}
+	return nil
+}
+
+type frame struct {
+	fin     bool
+	op      byte
+	payload []byte
+}
+
+// the next frame, its payload unmasked; a data frame's payload at most
+// room bytes
+func (c *Conn) readFrame(room int64) (frame, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(c.br, head[:]); err != nil {
+		return frame{}, err
+	}
+	f := frame{fin: head[0]&0x80 != 0, op: head[0] & 0x0f}
+	if head[0]&0x70 != 0 {
+		return frame{}, c.fail(CloseProtocolError, "reserved bits set with no extension negotiated")
+	}
+	masked := head[1]&0x80 != 0
+	if masked == c.client {
+		if c.client {
+			return frame{}, c.fail(CloseProtocolError, "masked frame from the server")
+		}
+		return frame{}, c.fail(CloseProtocolError, "unmasked frame from the client")
+	}
+
+	length := uint64(head[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return frame{}, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return frame{}, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if f.op >= opClose {
+		if !f.fin || length > 125 {
+			return frame{}, c.fail(CloseProtocolError, "fragmented or oversized control frame")
+		}
+	} else if length > uint64(max(room, 0)) {
+		return frame{}, c.fail(CloseTooBig, "message too big")
+	}
+
+	var key [4]byte
+	if masked {
+		if _, err := io.ReadFull(c.br, key[:]); err != nil {
+			return frame{}, err
+		}
+	}
+	f.payload = make([]byte, length)
+	if _, err := io.ReadFull(c.br, f.payload); err != nil {
+		return frame{}, err
+	}
+	if masked {
+		mask(f.payload, key)
+	}
+	c.lastRead.Store(time.Now().UnixNano())
+	return f, nil
+}
+
+// the masking of section 5.3, which unmasks as well
+func mask(b []byte, key [4]byte) {
+	for i := range b {
+		b[i] ^= key[i%4]
+	}
+}
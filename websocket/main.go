@@ -0,0 +1,22 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "server":
+			runServer(os.Args[2:])
+			return
+		case "client":
+			runClient(os.Args[2:])
+			return
+		}
+	}
+	fmt.Println("usage: websocket server [flags]")
+	fmt.Println("       websocket client [flags] ws://host:port/path")
+	os.Exit(2)
+}
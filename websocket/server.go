@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode"
+)
+
+// a member's messages queued before it counts as too slow for the room
+const sendQueue = 64
+
+// room is a chat room: each text message of a member goes to them all
+type room struct {
+	mu      sync.Mutex
+	members map[*member]bool
+	guests  int
+}
+
+type member struct {
+	name string
+	conn *Conn
+	send chan []byte
+}
+
+func newRoom() *room {
+	return &room{members: map[*member]bool{}}
+}
+
+func (rm *room) join(conn *Conn, name string) *member {
+	rm.mu.Lock()
+	if name == "" {
+		rm.guests++
+		name = fmt.Sprintf("guest-%d", rm.guests)
+	}
+	m := &member{name: name, conn: conn, send: make(chan []byte, sendQueue)}
+	rm.members[m] = true
+	n := len(rm.members)
+	rm.mu.Unlock()
+
+	go m.write()
+	rm.broadcast(fmt.Sprintf("* %s joined, %d here", name, n))
+	return m
+}
+
+func (rm *room) leave(m *member) {
+	rm.mu.Lock()
+	present := rm.members[m]
+	if present {
+		delete(rm.members, m)
+		close(m.send)
+	}
+	rm.mu.Unlock()
+	if present {
+		rm.broadcast(fmt.Sprintf("* %s left", m.name))
+	}
+}
+
+// text to every member. One whose queue is full is dropped rather than
+// holding up the room, or its queue growing without bound.
+func (rm *room) broadcast(text string) {
+	msg := []byte(text)
+	var dropped []*member
+	rm.mu.Lock()
+	for m := range rm.members {
+		select {
+		case m.send <- msg:
+		default:
+			delete(rm.members, m)
+			close(m.send)
+			dropped = append(dropped, m)
+		}
+	}
+	rm.mu.Unlock()
+	for _, m := range dropped {
+		log.Printf("chat: %s (%s) too slow, dropped", m.name, m.conn.RemoteAddr())
+		go m.conn.Close(ClosePolicyViolation, "too slow to keep up")
+		rm.broadcast(fmt.Sprintf("* %s left", m.name))
+	}
+}
+
+// the connections Upgrade took over, which http.Server.Shutdown doesn't
+// know of
+type tracker struct {
+	mu    sync.Mutex
+	conns map[*Conn]bool
+}
+
+func (t *tracker) add(c *Conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.conns == nil {
+		t.conns = map[*Conn]bool{}
+	}
+	t.conns[c] = true
+}
+
+func (t *tracker) remove(c *Conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.conns, c)
+}
+
+// every connection closed with code, the closing handshakes done or timed
+// out
+func (t *tracker) closeAll(code int, reason string) {
+	t.mu.Lock()
+	var wg sync.WaitGroup
+	for c := range t.conns {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.Close(code, reason)
+		}()
+	}
+	t.mu.Unlock()
+	wg.Wait()
+}
+
+// the member's queue to its connection, a writer of its own so that a
+// slow one holds up nobody else
+func (m *member) write() {
+	for msg := range m.send {
+		if err := m.conn.WriteMessage(TextMessage, msg); err != nil {
+			// the reader sees the connection end and leaves
+			for range m.send {
+			}
+			return
+		}
+	}
+}
+
+// GET /chat?name=...: the room, each line a member sends said to everyone
+// as "name: line"
+func (rm *room) handle(conns *tracker, pingInterval time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		conn, err := Upgrade(w, r, nil)
+		if err != nil {
+			log.Printf("chat: %s: %v", r.RemoteAddr, err)
+			return
+		}
+		conns.add(conn)
+		defer conns.remove(conn)
+		conn.MaxMessageSize = 4096
+		conn.KeepAlive(pingInterval)
+		m := rm.join(conn, cleanName(r.URL.Query().Get("name")))
+		log.Printf("chat: %s joined as %s", conn.RemoteAddr(), m.name)
+
+		closing := false
+		for {
+			messageType, data, err := conn.ReadMessage()
+			if err != nil {
+				logEnd("chat", conn, err)
+				break
+			}
+			if closing {
+				// sent before the peer saw the close frame
+				continue
+			}
+			if messageType != TextMessage {
+				// the answering close frame comes through ReadMessage
+				closing = true
+				go conn.Close(CloseUnsupportedData, "the chat is text only")
+				continue
+			}
+			for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+				if line = strings.TrimSpace(line); line != "" {
+					rm.broadcast(m.name + ": " + line)
+				}
+			}
+		}
+		rm.leave(m)
+	}
+}
+
+// a name shown to everyone: printable, and short
+func cleanName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if !unicode.IsPrint(r) {
+			return -1
+		}
+		return r
+	}, strings.TrimSpace(name))
+	if runes := []rune(name); len(runes) > 32 {
+		name = string(runes[:32])
+	}
+	return name
+}
+
+// GET /echo: every message back as it came
+func handleEcho(conns *tracker, pingInterval time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		conn, err := Upgrade(w, r, nil)
+		if err != nil {
+			log.Printf("echo: %s: %v", r.RemoteAddr, err)
+			return
+		}
+		conns.add(conn)
+		defer conns.remove(conn)
+		conn.KeepAlive(pingInterval)
+		log.Printf("echo: %s connected", conn.RemoteAddr())
+		for {
+			messageType, data, err := conn.ReadMessage()
+			if err != nil {
+				logEnd("echo", conn, err)
+				return
+			}
+			if err := conn.WriteMessage(messageType, data); err != nil && !errors.Is(err, ErrClosed) {
+				log.Printf("echo: %s: %v", conn.RemoteAddr(), err)
+				return
+			}
+		}
+	}
+}
+
+// how a connection ended
+func logEnd(service string, conn *Conn, err error) {
+	if errors.Is(err, net.ErrClosed) {
+		// closed from this side: KeepAlive, a slow member, or shutdown
+		log.Printf("%s: %s gone", service, conn.RemoteAddr())
+		return
+	}
+	// a *CloseError says with what code
+	log.Printf("%s: %s: %v", service, conn.RemoteAddr(), err)
+}
+
+// a page to chat from in a browser
+const indexPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>chat</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+#log { border: 1px solid #ccc; height: 20em; overflow-y: auto; padding: 0.5em; white-space: pre-wrap; }
+</style>
+</head>
+<body>
+<div id="log"></div>
+<form id="form"><input id="line" size="60" autocomplete="off" autofocus> <button>Send</button></form>
+<script>
+const log = document.getElementById("log");
+const say = text => { log.textContent += text + "\n"; log.scrollTop = log.scrollHeight; };
+const name = prompt("Your name?") || "";
+const ws = new WebSocket((location.protocol === "https:" ? "wss://" : "ws://") + location.host + "/chat?name=" + encodeURIComponent(name));
+ws.onmessage = e => say(e.data);
+ws.onclose = e => say("* disconnected (" + e.code + (e.reason ? " " + e.reason : "") + ")");
+document.getElementById("form").onsubmit = e => {
+	e.preventDefault();
+	const line = document.getElementById("line");
+	if (line.value) ws.send(line.value);
+	line.value = "";
+};
+</script>
+</body>
+</html>
+`
+
+func runServer(args []string) {
+	fs := flag.NewFlagSet("server", flag.ExitOnError)
+	addr := fs.String("addr", "127.0.0.1:8080", "address to listen on")
+	pingInterval := fs.Duration("ping", 30*time.Second, "keepalive ping interval; a client silent for two is dropped")
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		fmt.Println("usage: websocket server [flags]")
+		os.Exit(2)
+	}
+
+	chat := newRoom()
+	var conns tracker
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		io.WriteString(w, indexPage)
+	})
+	mux.Handle("/chat", chat.handle(&conns, *pingInterval))
+	mux.Handle("/echo", handleEcho(&conns, *pingInterval))
+
+	ln, err := net.Listen("tcp", *addr)
+	if err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	fmt.Printf("Serving the chat on http://%s/, ws://%s/chat and ws://%s/echo\n", ln.Addr(), ln.Addr(), ln.Addr())
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(ln) }()
+	select {
+	case err := <-served:
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	case <-ctx.Done():
+	}
+	stop()
+
+	// no new connections, then the open ones closed with a going away
+	fmt.Println("Shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	srv.Shutdown(shutdownCtx)
+	conns.closeAll(CloseGoingAway, "server shutting down")
+}
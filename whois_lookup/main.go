@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+func main() {
+	server := flag.String("server", "", "ask this WHOIS server instead of the one IANA names")
+	raw := flag.Bool("raw", false, "print the answers as the servers sent them")
+	timeout := flag.Duration("timeout", 15*time.Second, "per server")
+	referrals := flag.Int("referrals", 2, "servers to follow past the first")
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		fmt.Println("usage: whois_lookup [flags] domain|address")
+		os.Exit(2)
+	}
+
+	client := &Client{Timeout: *timeout, MaxReferrals: *referrals}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+	result, err := client.Lookup(ctx, flag.Arg(0), *server)
+	if err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+
+	if *raw {
+		for _, r := range result.Responses {
+			fmt.Printf("; %s\n%s\n", r.Server, strings.TrimRight(r.Raw, "\n"))
+		}
+		return
+	}
+	servers := make([]string, len(result.Responses))
+	for i, r := range result.Responses {
+		servers[i] = r.Server
+	}
+	fmt.Printf("%-12s %s\n", "query", result.Query)
+	fmt.Printf("%-12s %s\n", "servers", strings.Join(servers, " -> "))
+	if result.Registrar != "" {
+		fmt.Printf("%-12s %s\n", "registrar", result.Registrar)
+	}
+	for _, date := range []struct {
+		name string
+		t    time.Time
+	}{{"created", result.Created}, {"updated", result.Updated}, {"expires", result.Expires}} {
+		if !date.t.IsZero() {
+			fmt.Printf("%-12s %s\n", date.name, date.t.Format(time.DateOnly))
+		}
+	}
+	if !result.Expires.IsZero() {
+		fmt.Printf("%-12s %d days\n", "left", int(time.Until(result.Expires).Hours()/24))
+	}
+	for _, ns := range result.NameServers {
+		fmt.Printf("%-12s %s\n", "name server", ns)
+	}
+	if len(result.Status) > 0 {
+		fmt.Printf("%-12s %s\n", "status", strings.Join(result.Status, ", "))
+	}
+}
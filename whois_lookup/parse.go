@@ -0,0 +1,179 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+	"time"
+)
+
+// a "key: value" line of an answer, the key in lower case
+type field struct {
+	key, value string
+}
+
+// the fields of an answer, in order. A key with nothing after it takes the
+// indented lines below it as values, the way .uk and others list their
+// name servers.
+func parseFields(raw string) []field {
+	var fields []field
+	block := "" // the key of the indented lines that follow
+	for _, line := range strings.Split(raw, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "%") || strings.HasPrefix(trimmed, "#") || strings.HasPrefix(trimmed, ">>>") {
+			block = ""
+			continue
+		}
+		indented := line[0] == ' ' || line[0] == '\t'
+		key, value, ok := strings.Cut(trimmed, ":")
+		// "http://..." is a value, not a key
+		if ok && !strings.HasPrefix(value, "//") && len(key) < 50 {
+			key = strings.ToLower(strings.TrimSpace(key))
+			value = strings.TrimSpace(value)
+			if value == "" {
+				block = key
+				continue
+			}
+			// "Registered on: ..." under "Relevant dates:" is its own field
+			if !indented {
+				block = ""
+			}
+			fields = append(fields, field{key, value})
+			continue
+		}
+		if indented && block != "" {
+			fields = append(fields, field{block, trimmed})
+		}
+	}
+	return fields
+}
+
+// the keys the fields go by, in the order they are preferred
+var (
+	registrarKeys = []string{"registrar", "sponsoring registrar", "registrar name", "registrar organization"}
+	createdKeys   = []string{"creation date", "created", "created on", "created date", "registered", "registered on",
+		"registration date", "registration time", "domain registration date", "domain record activated"}
+	updatedKeys = []string{"updated date", "last updated", "last updated on", "last-update", "last modified", "changed", "modified"}
+	expiresKeys = []string{"registry expiry date", "registrar registration expiration date", "expiry date", "expiration date",
+		"expires", "expires on", "expire date", "paid-till", "domain expiration date", "renewal date", "free-date"}
+	nameServerKeys = []string{"name server", "name servers", "nameserver", "nameservers", "nserver", "dns"}
+	statusKeys     = []string{"domain status", "status", "state"}
+)
+
+// the parsed fields, where the result lacks them
+func (r *Result) fill(fields []field) {
+	if r.Registrar == "" {
+		r.Registrar = firstValue(fields, registrarKeys)
+	}
+	for _, date := range []struct {
+		t    *time.Time
+		keys []string
+	}{{&r.Created, createdKeys}, {&r.Updated, updatedKeys}, {&r.Expires, expiresKeys}} {
+		if date.t.IsZero() {
+			*date.t = parseDate(firstValue(fields, date.keys))
+		}
+	}
+	if len(r.NameServers) == 0 {
+		seen := map[string]bool{}
+		for _, f := range fields {
+			if !contains(nameServerKeys, f.key) {
+				continue
+			}
+			// "ns1.example.com 192.0.2.1" and "ns1.example.com." alike
+			name := strings.ToLower(strings.TrimSuffix(strings.Fields(f.value)[0], "."))
+			if strings.Contains(name, ".") && !seen[name] {
+				seen[name] = true
+				r.NameServers = append(r.NameServers, name)
+			}
+		}
+	}
+	if len(r.Status) == 0 {
+		for _, f := range fields {
+			if contains(statusKeys, f.key) {
+				// "clientTransferProhibited https://icann.org/epp#..."
+				r.Status = append(r.Status, strings.Fields(f.value)[0])
+			}
+		}
+	}
+}
+
+func firstValue(fields []field, keys []string) string {
+	for _, key := range keys {
+		for _, f := range fields {
+			if f.key == key {
+				return f.value
+			}
+		}
+	}
+	return ""
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// the server an answer refers to for more: IANA's "refer", a registry's
+// registrar server, or an RIR's ReferralServer; "" if there is none
+func referral(fields []field) string {
+	server := firstValue(fields, []string{"refer", "registrar whois server", "whois server", "whois", "referralserver"})
+	if strings.Contains(server, "://") {
+		// ReferralServer: whois://whois.ripe.net, rwhois:// is another protocol
+		u, err := url.Parse(server)
+		if err != nil || u.Scheme != "whois" {
+			return ""
+		}
+		server = u.Host
+	}
+	server = strings.ToLower(strings.TrimSuffix(server, "/"))
+	if strings.ContainsAny(server, " \t") || !strings.Contains(server, ".") {
+		return ""
+	}
+	return server
+}
+
+// the date formats of the registries, the ICANN one first
+var dateLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05Z",
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05Z07:00",
+	"2006-01-02 15:04:05 MST",
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+	"02-Jan-2006",
+	"02-Jan-2006 15:04:05 MST",
+	"2006.01.02",
+	"2006.01.02 15:04:05",
+	"2006/01/02",
+	"02.01.2006",
+	"02/01/2006",
+	"January 2 2006",
+	"Mon Jan 2 15:04:05 MST 2006",
+	"20060102",
+}
+
+// the date at the start of value, zero if it has none known
+func parseDate(value string) time.Time {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return time.Time{}
+	}
+	// "2024-01-02 (YYYY-MM-DD)" and the like
+	if i := strings.Index(value, " ("); i > 0 {
+		value = value[:i]
+	}
+	for _, layout := range dateLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t.UTC()
+		}
+	}
+	// fractional seconds, "2024-01-02T03:04:05.0Z"
+	if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+		return t.UTC()
+	}
+	return time.Time{}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/idna"
+)
+
+// where every lookup starts: IANA knows the WHOIS server of each TLD and
+// of each regional internet registry
+const ianaServer = "whois.iana.org"
+
+// WHOIS (RFC 3912) over TCP port 43: a query line, the answer as text
+// until the server closes the connection. There is no common format, so
+// the servers the answer refers to are followed and the fields parsed as
+// well as they can be.
+type Client struct {
+	Timeout      time.Duration // per server, default 15 seconds
+	MaxReferrals int           // servers to follow past the first, default 2
+	Retries      int           // after a rate limit reply, default 2
+	RetryWait    time.Duration // before the first retry, doubling, default 5 seconds
+
+	mu      sync.Mutex
+	servers map[string]string // the WHOIS server of a TLD, from IANA
+}
+
+// the answer of one server
+type Response struct {
+	Server string
+	Raw    string
+}
+
+// what Lookup found: every server's answer, the registry's first, and the
+// fields parsed from them. Later answers, the registrar's, only fill in
+// what the earlier ones lack, the registry is authoritative for the dates.
+type Result struct {
+	Query     string
+	Responses []Response
+
+	Registrar   string
+	Created     time.Time // zero when no answer had it
+	Updated     time.Time
+	Expires     time.Time
+	NameServers []string // lower case, without a trailing dot
+	Status      []string // eg. clientTransferProhibited
+}
+
+// the server kept refusing with a rate limit reply
+type RateLimitError struct {
+	Server string
+	Reply  string // the line that said so
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("rate limited by %s: %s", e.Server, e.Reply)
+}
+
+// there is no WHOIS server for the query's TLD
+var ErrNoServer = errors.New("no WHOIS server known")
+
+// Lookup asks about a domain name or an IP address: server, or the one
+// IANA names for the TLD or address, and then the servers the answers
+// refer to, eg. the registrar's after a thin registry's.
+func (c *Client) Lookup(ctx context.Context, query, server string) (*Result, error) {
+	query = strings.TrimSuffix(strings.TrimSpace(query), ".")
+	if _, err := netip.ParseAddr(query); err != nil {
+		ascii, err := idna.Lookup.ToASCII(query)
+		if err != nil {
+			return nil, fmt.Errorf("invalid domain %q: %w", query, err)
+		}
+		query = ascii
+	}
+	if server == "" {
+		var err error
+		if server, err = c.discover(ctx, query); err != nil {
+			return nil, err
+		}
+	}
+
+	result := &Result{Query: query}
+	seen := map[string]bool{}
+	maxReferrals := c.MaxReferrals
+	if maxReferrals <= 0 {
+		maxReferrals = 2
+	}
+	for i := 0; server != "" && i <= maxReferrals && !seen[server]; i++ {
+		seen[server] = true
+		raw, err := c.query(ctx, server, query)
+		if err != nil {
+			if len(result.Responses) > 0 {
+				// the registry answered, a registrar that doesn't is common
+				break
+			}
+			return nil, err
+		}
+		result.Responses = append(result.Responses, Response{Server: server, Raw: raw})
+		fields := parseFields(raw)
+		result.fill(fields)
+		server = referral(fields)
+	}
+	return result, nil
+}
+
+// the WHOIS server IANA names for query's TLD, or for an address
+func (c *Client) discover(ctx context.Context, query string) (string, error) {
+	key := query
+	if _, err := netip.ParseAddr(query); err != nil {
+		key = query[strings.LastIndex(query, ".")+1:]
+	}
+	c.mu.Lock()
+	server, ok := c.servers[key]
+	c.mu.Unlock()
+	if ok {
+		return server, nil
+	}
+
+	raw, err := c.query(ctx, ianaServer, key)
+	if err != nil {
+		return "", err
+	}
+	server = referral(parseFields(raw))
+	if server == "" {
+		return "", fmt.Errorf("%w for %s", ErrNoServer, key)
+	}
+	c.mu.Lock()
+	if c.servers == nil {
+		c.servers = map[string]string{}
+	}
+	c.servers[key] = server
+	c.mu.Unlock()
+	return server, nil
+}
+
+// one query, retried after a rate limit reply
+func (c *Client) query(ctx context.Context, server, query string) (string, error) {
+	retries := c.Retries
+	if retries <= 0 {
+		retries = 2
+	}
+	wait := c.RetryWait
+	if wait <= 0 {
+		wait = 5 * time.Second
+	}
+	for attempt := 0; ; attempt++ {
+		raw, err := c.ask(ctx, server, queryLine(server, query))
+		if err != nil {
+			return "", err
+		}
+		line := rateLimited(raw)
+		if line == "" {
+			return raw, nil
+		}
+		if attempt == retries {
+			return "", &RateLimitError{Server: server, Reply: line}
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return "", &RateLimitError{Server: server, Reply: line}
+		}
+		wait *= 2
+	}
+}
+
+// some servers want flags with the query to answer in full
+func queryLine(server, query string) string {
+	switch strings.ToLower(server) {
+	case "whois.verisign-grs.com":
+		// the domain, not the name servers that match it
+		return "domain " + query
+	case "whois.arin.net":
+		// the network, not the organisations
+		if _, err := netip.ParseAddr(query); err == nil {
+			return "n + " + query
+		}
+	case "whois.denic.de":
+		return "-T dn,ace " + query
+	}
+	return query
+}
+
+// the most a server may answer
+const maxResponse = 1 << 20
+
+func (c *Client) ask(ctx context.Context, server, line string) (string, error) {
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = 15 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	addr := server
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		addr = net.JoinHostPort(server, "43")
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return "", fmt.Errorf("failed to connect to %s: %w", server, err)
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+
+	if _, err := io.WriteString(conn, line+"\r\n"); err != nil {
+		return "", fmt.Errorf("failed to query %s: %w", server, err)
+	}
+	data, err := io.ReadAll(io.LimitReader(conn, maxResponse))
+	if err != nil {
+		return "", fmt.Errorf("failed to read from %s: %w", server, err)
+	}
+	return strings.ReplaceAll(string(data), "\r\n", "\n"), nil
+}
+
+// the line of raw that says the query was refused for a rate limit, ""
+// if there is none; a long answer is a real one that may mention limits
+func rateLimited(raw string) string {
+	if len(raw) > 2048 {
+		return ""
+	}
+	for _, line := range strings.Split(raw, "\n") {
+		lower := strings.ToLower(line)
+		for _, phrase := range []string{
+			"limit exceeded", "rate limit", "too many requests", "quota exceeded",
+			"exceeded the maximum", "query limit", "try again later", "please wait",
+		} {
+			if strings.Contains(lower, phrase) {
+				return strings.TrimSpace(line)
+			}
+		}
+	}
+	return ""
+}